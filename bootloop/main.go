@@ -11,6 +11,7 @@ import (
 
 	"github.com/OpenCHAMI/coresmd/internal/debug"
 	"github.com/OpenCHAMI/coresmd/internal/ipxe"
+	"github.com/OpenCHAMI/coresmd/internal/reply"
 	"github.com/OpenCHAMI/coresmd/internal/version"
 	"github.com/coredhcp/coredhcp/handler"
 	"github.com/coredhcp/coredhcp/logger"
@@ -175,7 +176,7 @@ func (p *PluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool)
 
 		if string(cinfo) != "iPXE" {
 			// BOOT STAGE 1: Send iPXE bootloader over TFTP
-			resp, _ = ipxe.ServeIPXEBootloader(log, req, resp)
+			resp, _ = ipxe.ServeIPXEBootloader(log, req, resp, nil)
 		}
 	} else {
 		if string(cinfo) == "iPXE" {
@@ -189,14 +190,12 @@ func (p *PluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool)
 			// so it can be determined if it has been discovered, so we send a DHCPNAK to
 			// initiate this.
 			var err error
-			resp, err = dhcpv4.New(
+			resp, err = dhcpv4.NewReplyFromRequest(req,
 				dhcpv4.WithMessageType(dhcpv4.MessageTypeNak),
-				dhcpv4.WithTransactionID(req.TransactionID),
-				dhcpv4.WithHwAddr(req.ClientHWAddr),
 				dhcpv4.WithServerIP(resp.ServerIPAddr),
 			)
 			if err != nil {
-				log.Errorf("failed to create new %s message: %w", dhcpv4.MessageTypeNak, err)
+				log.Errorf("failed to create new %s message: %v", dhcpv4.MessageTypeNak, err)
 				return resp, true
 			}
 			err = p.deleteIPAddress(req.ClientHWAddr)
@@ -205,12 +204,13 @@ func (p *PluginState) Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool)
 			}
 			delete(p.Recordsv4, req.ClientHWAddr.String())
 			if err := p.allocator.Free(net.IPNet{IP: record.IP}); err != nil {
-				log.Warnf("unable to delete IP %s: %w", record.IP.String(), err)
+				log.Warnf("unable to delete IP %s: %v", record.IP.String(), err)
 			}
 			log.Printf("MAC %s already exists with IP %s, sending %s to reinitiate DHCP handshake", req.ClientHWAddr.String(), record.IP, dhcpv4.MessageTypeNak)
 		}
 	}
 
+	reply.SetAddressing(req, resp)
 	debug.DebugResponse(log, resp)
 	return resp, true
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+const defaultSocket = "/run/coresmd/admin.sock"
+
+var (
+	socketPath string
+	adminToken string
+)
+
+func init() {
+	rootCmd.PersistentFlags().StringVar(&socketPath, "socket", defaultSocket, "Path of the coresmd admin socket")
+	rootCmd.PersistentFlags().StringVar(&adminToken, "token", os.Getenv("CORESMD_ADMIN_TOKEN"), "Admin API bearer token (default: $CORESMD_ADMIN_TOKEN)")
+
+	rootCmd.AddCommand(&cobra.Command{
+		Use:   "cache",
+		Short: "Dump the data cached by coresmd as JSON",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return adminCopy(http.MethodGet, "/cache", nil)
+		},
+	})
+	rootCmd.AddCommand(&cobra.Command{
+		Use:   "refresh",
+		Short: "Make coresmd refresh its cache from SMD now",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return adminCopy(http.MethodPost, "/refresh", nil)
+		},
+	})
+	rootCmd.AddCommand(&cobra.Command{
+		Use:   "stats",
+		Short: "Show coresmd cache refresh statistics",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return adminCopy(http.MethodGet, "/stats", nil)
+		},
+	})
+}
+
+// adminRequest performs a request against the admin API and returns the
+// response body, or an error if the request did not succeed.
+func adminRequest(method, path string, query url.Values) ([]byte, error) {
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+		},
+	}}
+
+	// The host is ignored since requests go to the socket
+	u := url.URL{Scheme: "http", Host: "coresmd", Path: path, RawQuery: query.Encode()}
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if adminToken != "" {
+		req.Header.Set("Authorization", "Bearer "+adminToken)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach admin API at %s: %w", socketPath, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("admin API returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	return body, nil
+}
+
+// adminCopy performs a request against the admin API and prints the
+// response, indented for readability.
+func adminCopy(method, path string, query url.Values) error {
+	body, err := adminRequest(method, path, query)
+	if err != nil {
+		return err
+	}
+
+	return printJSON(json.RawMessage(body))
+}
+
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
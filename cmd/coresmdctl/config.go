@@ -0,0 +1,41 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/OpenCHAMI/coresmd/coresmd"
+	"github.com/coredhcp/coredhcp/config"
+)
+
+// pluginArgs returns the arguments of the first coresmd plugin in the CoreDHCP
+// config at path, or in CoreDHCP's search path if path is empty.
+func pluginArgs(path string) ([]string, error) {
+	conf, err := config.Load(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+	if conf.Server4 == nil {
+		return nil, errors.New("config does not contain a server4 section")
+	}
+	for _, p := range conf.Server4.Plugins {
+		if p.Name == coresmd.Plugin.Name {
+			return p.Args, nil
+		}
+	}
+
+	return nil, errors.New("config does not contain a coresmd plugin")
+}
+
+// pluginOption returns the value of the key=value option named key in args,
+// or def if it is not set.
+func pluginOption(args []string, key, def string) string {
+	for _, arg := range args {
+		if k, v, ok := strings.Cut(arg, "="); ok && k == key {
+			return strings.Trim(v, `"'`)
+		}
+	}
+
+	return def
+}
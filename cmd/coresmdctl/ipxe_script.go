@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+
+	"github.com/OpenCHAMI/coresmd/coresmd"
+	"github.com/OpenCHAMI/coresmd/internal/ipxe"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "ipxe-script",
+		Short: "Generate the iPXE embedded script matching the coresmd config",
+		Args:  cobra.NoArgs,
+	}
+	confPath := cmd.Flags().String("conf", "", "CoreDHCP configuration file (default: CoreDHCP's search path)")
+	retries := cmd.Flags().Int("retries", 5, "Number of boot attempts before rebooting")
+	delay := cmd.Flags().Int("delay", 2, "Seconds to wait after the first failed attempt, doubled after each failure")
+	output := cmd.Flags().String("output", "", "File to write the script to (default: stdout)")
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		return ipxeScript(*confPath, *retries, *delay, *output)
+	}
+	rootCmd.AddCommand(cmd)
+}
+
+func ipxeScript(confPath string, retries, delay int, output string) error {
+	// Read the coresmd arguments from the CoreDHCP config so that the script
+	// chains to the same boot script URL the plugin hands out
+	args, err := pluginArgs(confPath)
+	if err != nil {
+		return err
+	}
+	if len(args) < 2 {
+		return errors.New("coresmd plugin in config has no boot script base URL")
+	}
+	bootScriptBaseURL, err := url.Parse(args[1])
+	if err != nil {
+		return fmt.Errorf("failed to parse boot script base URL: %w", err)
+	}
+
+	// Only the MAC address is known to the embedded script, as an iPXE
+	// variable
+	tmpl, err := coresmd.ParseBootScriptTemplate(pluginOption(args, "boot_script_path", coresmd.DefaultBootScriptPath))
+	if err != nil {
+		return err
+	}
+	scriptURL, err := tmpl.URL(bootScriptBaseURL, coresmd.BootScriptParams{MAC: "${netX/mac}"})
+	if err != nil {
+		return err
+	}
+
+	script, err := ipxe.EmbeddedScript(scriptURL.String(), retries, delay)
+	if err != nil {
+		return err
+	}
+
+	if output == "" {
+		_, err = fmt.Print(script)
+		return err
+	}
+	if err := os.WriteFile(output, []byte(script), 0644); err != nil {
+		return fmt.Errorf("failed to write script: %w", err)
+	}
+
+	return nil
+}
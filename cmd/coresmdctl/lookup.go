@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/OpenCHAMI/coresmd/coresmd"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	cmd := &cobra.Command{
+		Use:   "lookup <mac>",
+		Short: "Show which address and boot file a client would get",
+		Long: `Show which address and boot file coresmd would give the client with the
+given MAC address, and the decisions that led to them. Nothing is sent to the
+client.
+
+By default, the running coresmd is asked through its admin socket. With
+--direct, data is fetched from SMD using the coresmd configuration in the
+CoreDHCP config file instead, applying the same lookup logic.`,
+		Args: cobra.ExactArgs(1),
+	}
+	arch := cmd.Flags().Int("arch", -1, "Client architecture (IANA processor architecture type, e.g. 7 for x86_64 UEFI)")
+	ipxe := cmd.Flags().Bool("ipxe", false, "Client is iPXE (i.e. requesting its boot script)")
+	request := cmd.Flags().Bool("request", false, "Simulate a DHCPREQUEST instead of a DHCPDISCOVER")
+	requestedIP := cmd.Flags().String("requested-ip", "", "IP address requested by the client")
+	direct := cmd.Flags().Bool("direct", false, "Query SMD directly instead of the admin socket")
+	confPath := cmd.Flags().String("conf", "", "CoreDHCP configuration file for --direct (default: CoreDHCP's search path)")
+	asJSON := cmd.Flags().Bool("json", false, "Print the full result as JSON")
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		query := url.Values{"mac": {args[0]}}
+		if *arch >= 0 {
+			query.Set("arch", strconv.Itoa(*arch))
+		}
+		if *ipxe {
+			query.Set("ipxe", "true")
+		}
+		if *request {
+			query.Set("type", "request")
+		}
+		if *requestedIP != "" {
+			query.Set("requested_ip", *requestedIP)
+		}
+
+		var result coresmd.LookupResult
+		if *direct {
+			pargs, err := pluginArgs(*confPath)
+			if err != nil {
+				return err
+			}
+			result, err = coresmd.Lookup(context.Background(), pargs, query)
+			if err != nil {
+				return err
+			}
+		} else {
+			body, err := adminRequest(http.MethodGet, "/lookup", query)
+			if err != nil {
+				return err
+			}
+			if err := json.Unmarshal(body, &result); err != nil {
+				return fmt.Errorf("failed to decode lookup result: %w", err)
+			}
+		}
+
+		if *asJSON {
+			return printJSON(result)
+		}
+		printLookup(result)
+		return nil
+	}
+	rootCmd.AddCommand(cmd)
+}
+
+func printLookup(result coresmd.LookupResult) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	defer w.Flush()
+
+	if !result.Handled {
+		fmt.Fprintln(w, "coresmd would not answer this client; it is passed on to the next plugin")
+	} else if result.Response == nil {
+		fmt.Fprintln(w, "coresmd would drop this request")
+	} else {
+		r := result.Response
+		for _, f := range []struct{ name, value string }{
+			{"Message type", r.MessageType},
+			{"IP address", r.YourIPAddr},
+			{"Lease time", r.LeaseTime},
+			{"Hostname", r.HostName},
+			{"Next server", r.ServerIPAddr},
+			{"TFTP server", r.TFTPServerName},
+			{"Boot file", r.BootFileName},
+			{"Class identifier", r.ClassIdentifier},
+			{"Message", r.Message},
+		} {
+			if f.value != "" {
+				fmt.Fprintf(w, "%s:\t%s\n", f.name, f.value)
+			}
+		}
+	}
+
+	if result.Trace == nil {
+		return
+	}
+	fmt.Fprintln(w, "\nSTEP\tRESULT\tSOURCE\tREASON")
+	for _, s := range result.Trace.Steps {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", s.Step, s.Result, s.Source, s.Reason)
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/OpenCHAMI/coresmd/internal/version"
+	"github.com/spf13/cobra"
+)
+
+var rootCmd = &cobra.Command{
+	Use:   "coresmdctl",
+	Short: "Inspect and operate the coresmd CoreDHCP plugin",
+	Long: `coresmdctl talks to the coresmd admin API over its Unix socket, or directly
+to SMD using the coresmd configuration, to inspect the cache and show which
+address and boot file a client would get. It also generates the iPXE script
+to embed into bootloaders served by coresmd.`,
+	SilenceUsage: true,
+}
+
+var versionCmd = &cobra.Command{
+	Use:   "version",
+	Short: "Print version information",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		version.PrintVersionInfo()
+	},
+}
+
+func main() {
+	rootCmd.AddCommand(versionCmd)
+	if err := rootCmd.Execute(); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"net/url"
+
+	"github.com/spf13/cobra"
+)
+
+var rescueKernel, rescueInitrd, rescueParams string
+
+func init() {
+	rescueCmd := &cobra.Command{
+		Use:   "rescue",
+		Short: "List the nodes put in rescue boot through the admin API",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return adminCopy(http.MethodGet, "/rescue", nil)
+		},
+	}
+	onCmd := &cobra.Command{
+		Use:   "on <mac>",
+		Short: "Boot a node into a rescue image instead of its boot script",
+		Long: `Boot the node with the given MAC address into a rescue image the next time
+iPXE asks for its boot script, without changing SMD or BSS. The kernel, initrd,
+and kernel parameters default to the rescue_kernel, rescue_initrd, and
+rescue_params options of coresmd.`,
+		Args: cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			query := url.Values{"mac": {args[0]}}
+			for name, val := range map[string]string{"kernel": rescueKernel, "initrd": rescueInitrd, "params": rescueParams} {
+				if val != "" {
+					query.Set(name, val)
+				}
+			}
+			return adminCopy(http.MethodPost, "/rescue", query)
+		},
+	}
+	onCmd.Flags().StringVar(&rescueKernel, "kernel", "", "URL of the rescue kernel")
+	onCmd.Flags().StringVar(&rescueInitrd, "initrd", "", "URL of the rescue initrd")
+	onCmd.Flags().StringVar(&rescueParams, "params", "", "Kernel parameters of the rescue image")
+	rescueCmd.AddCommand(onCmd, &cobra.Command{
+		Use:   "off <mac>",
+		Short: "Take a node out of rescue boot",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return adminCopy(http.MethodDelete, "/rescue", url.Values{"mac": {args[0]}})
+		},
+	})
+	rootCmd.AddCommand(rescueCmd)
+}
@@ -0,0 +1,268 @@
+package coresmd
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Names of admin API endpoints, as used to disable them.
+const (
+	adminEndpointCache     = "cache"
+	adminEndpointRefresh   = "refresh"
+	adminEndpointLookup    = "lookup"
+	adminEndpointStats     = "stats"
+	adminEndpointExplain   = "explain"
+	adminEndpointLeases    = "leases"
+	adminEndpointRescue    = "rescue"
+	adminEndpointFunnel    = "funnel"
+	adminEndpointLifecycle = "lifecycle"
+)
+
+// adminHandler returns the admin API for p, guarded by auth.
+func (p *PluginState) adminHandler(auth *adminAuth) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cache", auth.wrap(adminEndpointCache, adminRead, p.adminCache))
+	mux.HandleFunc("/refresh", auth.wrap(adminEndpointRefresh, adminWrite, p.adminRefresh))
+	mux.HandleFunc("/lookup", auth.wrap(adminEndpointLookup, adminRead, p.adminLookup))
+	mux.HandleFunc("/stats", auth.wrap(adminEndpointStats, adminRead, p.adminStats))
+	mux.HandleFunc("/leases", auth.wrap(adminEndpointLeases, adminRead, p.adminLeases))
+	mux.HandleFunc("/funnel", auth.wrap(adminEndpointFunnel, adminRead, p.adminFunnel))
+	mux.HandleFunc("/lifecycle", auth.wrap(adminEndpointLifecycle, adminRead, p.adminLifecycle))
+	mux.HandleFunc("/explain", func(w http.ResponseWriter, r *http.Request) {
+		access := adminRead
+		if r.Method != http.MethodGet {
+			access = adminWrite
+		}
+		auth.wrap(adminEndpointExplain, access, p.adminExplain)(w, r)
+	})
+	mux.HandleFunc("/rescue", func(w http.ResponseWriter, r *http.Request) {
+		access := adminRead
+		if r.Method != http.MethodGet {
+			access = adminWrite
+		}
+		auth.wrap(adminEndpointRescue, access, p.adminRescue)(w, r)
+	})
+
+	return mux
+}
+
+// startAdminServer serves the admin API for p on a Unix socket at path and
+// returns a function that closes the server and removes the socket.
+func startAdminServer(path string, auth *adminAuth, p *PluginState) (func(), error) {
+	// Remove a socket left behind by an unclean shutdown
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	}
+	ln, err := listenUnixPrivate(path)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &http.Server{Handler: p.adminHandler(auth), ConnContext: adminConnContext}
+	go func() {
+		if err := s.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("admin server failed: %v", err)
+		}
+	}()
+
+	return func() {
+		s.Close()
+		os.Remove(path)
+	}, nil
+}
+
+// listenUnixPrivate listens on a Unix socket at path that only the owner can
+// connect to. The socket is created in a private directory and only moved to
+// path once its permissions are set, so that nobody else can connect to it in
+// between.
+func listenUnixPrivate(path string) (net.Listener, error) {
+	dir, err := os.MkdirTemp(filepath.Dir(path), ".coresmd-admin-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	tmp := filepath.Join(dir, "sock")
+	ln, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	// The socket is removed by the caller under its final name
+	ln.(*net.UnixListener).SetUnlinkOnClose(false)
+	if err := os.Chmod(tmp, 0o600); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to set socket permissions: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		ln.Close()
+		return nil, fmt.Errorf("failed to move socket into place: %w", err)
+	}
+	return ln, nil
+}
+
+// startAdminListener serves the admin API for p on the TCP address listen,
+// over HTTPS if tlsConfig is not nil, and returns a function that closes the
+// server.
+func startAdminListener(listen string, tlsConfig *tls.Config, auth *adminAuth, p *PluginState) (func(), error) {
+	s := &http.Server{
+		Handler:     p.adminHandler(auth),
+		TLSConfig:   tlsConfig,
+		ConnContext: adminConnContext,
+	}
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			err = s.ServeTLS(ln, "", "")
+		} else {
+			err = s.Serve(ln)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("admin server failed: %v", err)
+		}
+	}()
+
+	return func() { s.Close() }, nil
+}
+
+// adminCache dumps the cached SMD data.
+func (p *PluginState) adminCache(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	snapshot := p.cache.Snapshot()
+	writeJSON(w, http.StatusOK, struct {
+		LastUpdated        time.Time                    `json:"last_updated"`
+		Components         map[string]Component         `json:"components"`
+		EthernetInterfaces map[string]EthernetInterface `json:"ethernet_interfaces"`
+		DuplicateIPs       map[string][]string          `json:"duplicate_ips,omitempty"`
+		DuplicateMACs      map[string][]string          `json:"duplicate_macs,omitempty"`
+		DuplicateNIDs      map[int64][]string           `json:"duplicate_nids,omitempty"`
+		MissingNIDs        []string                     `json:"missing_nids,omitempty"`
+	}{snapshot.LastUpdated, snapshot.Components, snapshot.EthernetInterfaces, snapshot.DuplicateIPs, snapshot.DuplicateMACs, snapshot.DuplicateNIDs, snapshot.MissingNIDs})
+}
+
+// adminRefresh refreshes the cache immediately.
+func (p *PluginState) adminRefresh(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	log.Infof("admin: cache refresh requested")
+	if err := p.cache.Refresh(r.Context()); err != nil {
+		log.Errorf("failed to refresh cache: %v", err)
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	snapshot := p.cache.Snapshot()
+	writeJSON(w, http.StatusOK, struct {
+		LastUpdated        time.Time `json:"last_updated"`
+		Components         int       `json:"components"`
+		EthernetInterfaces int       `json:"ethernet_interfaces"`
+	}{snapshot.LastUpdated, len(snapshot.Components), len(snapshot.EthernetInterfaces)})
+}
+
+// adminStats reports refresh statistics.
+func (p *PluginState) adminStats(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	snapshot := p.cache.Snapshot()
+	writeJSON(w, http.StatusOK, struct {
+		RefreshStats
+		Interval           string    `json:"interval"`
+		LastUpdated        time.Time `json:"last_updated"`
+		Components         int       `json:"components"`
+		EthernetInterfaces int       `json:"ethernet_interfaces"`
+		Interfaces         int       `json:"interfaces"`
+	}{p.cache.Stats(), p.cache.RefreshInterval().String(), snapshot.LastUpdated, len(snapshot.Components), len(snapshot.EthernetInterfaces), len(snapshot.Interfaces)})
+}
+
+// adminFunnel lists where each node is in the boot funnel, or only the nodes
+// stuck on stage 1 if the stuck query parameter is true.
+func (p *PluginState) adminFunnel(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	stuckOnly := r.URL.Query().Get("stuck") == "true"
+	nodes := p.funnel.list(stuckOnly)
+	if nodes == nil {
+		nodes = []funnelEntry{}
+	}
+	writeJSON(w, http.StatusOK, struct {
+		StuckLimit int           `json:"stuck_limit"`
+		Nodes      []funnelEntry `json:"nodes"`
+	}{p.config.Load().funnelStuckLimit, nodes})
+}
+
+// adminExplain lists, enables, or disables decision traces for MAC addresses.
+func (p *PluginState) adminExplain(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	explain := p.config.Load().explainMACs
+	if r.Method != http.MethodGet {
+		mac, err := NormalizeMAC(r.URL.Query().Get("mac"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		explain.set(mac, r.Method == http.MethodPost)
+		log.Infof("admin: decision traces for %s enabled: %t", mac, r.Method == http.MethodPost)
+	}
+	all, macs := explain.list()
+	writeJSON(w, http.StatusOK, struct {
+		All  bool     `json:"all"`
+		MACs []string `json:"macs"`
+	}{all, macs})
+}
+
+// adminLookup reports what the handler would answer to a client described by
+// the query parameters (see Lookup).
+func (p *PluginState) adminLookup(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	result, err := p.lookup(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// allowMethods responds with 405 Method Not Allowed and returns false if the
+// method of r is not one of methods.
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, m := range methods {
+		if r.Method == m {
+			return true
+		}
+	}
+	for _, m := range methods {
+		w.Header().Add("Allow", m)
+	}
+	http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Errorf("admin: failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,120 @@
+package coresmd
+
+import (
+	"context"
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// adminAccess is the level of access required by an admin API endpoint.
+type adminAccess int
+
+const (
+	// adminRead endpoints only report state (e.g. dumping the cache).
+	adminRead adminAccess = iota
+	// adminWrite endpoints affect the cache or plugin state (e.g. forcing a
+	// refresh).
+	adminWrite
+)
+
+// adminAuth authorizes requests to admin API endpoints.
+//
+// Requests authenticate with an "Authorization: Bearer <token>" header. The
+// read-write token grants access to every endpoint while the read-only token
+// only grants access to read endpoints, so the latter can be handed to
+// dashboards. If neither token is set, no authentication is required.
+type adminAuth struct {
+	roToken string
+	rwToken string
+	// If set, write endpoints are refused regardless of token.
+	readOnly bool
+	// Names of endpoints that are refused regardless of token.
+	disabled map[string]bool
+}
+
+func newAdminAuth(roToken, rwToken string, readOnly bool, disabled []string) *adminAuth {
+	a := &adminAuth{
+		roToken:  roToken,
+		rwToken:  rwToken,
+		readOnly: readOnly,
+		disabled: make(map[string]bool),
+	}
+	for _, d := range disabled {
+		a.disabled[d] = true
+	}
+
+	return a
+}
+
+// wrap returns a handler that only calls h if the request is authorized to
+// access the named endpoint.
+func (a *adminAuth) wrap(endpoint string, access adminAccess, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if a.disabled[endpoint] {
+			http.Error(w, "endpoint is disabled", http.StatusForbidden)
+			return
+		}
+		if access == adminWrite && a.readOnly {
+			http.Error(w, "admin API is in read-only mode", http.StatusForbidden)
+			return
+		}
+		if !a.authorized(r, access) {
+			log.Warnf("admin: denied unauthorized request from %s to %s", adminPeer(r), endpoint)
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, r)
+	}
+}
+
+func (a *adminAuth) authorized(r *http.Request, access adminAccess) bool {
+	if a.roToken == "" && a.rwToken == "" {
+		return true
+	}
+
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return false
+	}
+	if tokenMatches(token, a.rwToken) {
+		return true
+	}
+	if access == adminRead && tokenMatches(token, a.roToken) {
+		return true
+	}
+
+	return false
+}
+
+func tokenMatches(given, want string) bool {
+	return want != "" && subtle.ConstantTimeCompare([]byte(given), []byte(want)) == 1
+}
+
+// adminPeerKey is the context key of the client description recorded by
+// adminConnContext.
+type adminPeerKey struct{}
+
+// adminConnContext records in ctx who is at the other end of the admin
+// connection c, so that denied requests can be traced back to them: the local
+// user for the Unix socket, the remote address for TCP.
+func adminConnContext(ctx context.Context, c net.Conn) context.Context {
+	peer := peerCredentials(c)
+	if addr := c.RemoteAddr(); peer == "" && addr != nil && addr.Network() == "tcp" {
+		peer = addr.String()
+	}
+	if peer == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, adminPeerKey{}, peer)
+}
+
+// adminPeer describes the client that made r, for logs.
+func adminPeer(r *http.Request) string {
+	if peer, ok := r.Context().Value(adminPeerKey{}).(string); ok {
+		return peer
+	}
+	return "unknown peer"
+}
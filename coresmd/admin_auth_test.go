@@ -0,0 +1,131 @@
+package coresmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestAdminAuthAuthorized(t *testing.T) {
+	tests := []struct {
+		ro, rw string
+		header string
+		access adminAccess
+		want   bool
+	}{
+		{"", "", "", adminWrite, true},
+		{"ro", "rw", "", adminRead, false},
+		{"ro", "rw", "Bearer ro", adminRead, true},
+		{"ro", "rw", "Bearer ro", adminWrite, false},
+		{"ro", "rw", "Bearer rw", adminWrite, true},
+		{"ro", "rw", "Bearer rw", adminRead, true},
+		{"ro", "rw", "Bearer wrong", adminRead, false},
+		{"ro", "rw", "Basic rw", adminRead, false},
+		// An unset token never matches
+		{"", "rw", "Bearer ", adminRead, false},
+		{"ro", "", "Bearer ", adminWrite, false},
+	}
+	for _, tt := range tests {
+		a := newAdminAuth(tt.ro, tt.rw, false, nil)
+		r := httptest.NewRequest(http.MethodGet, "/stats", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		if got := a.authorized(r, tt.access); got != tt.want {
+			t.Errorf("tokens %q/%q, header %q, access %d: got %t, want %t", tt.ro, tt.rw, tt.header, tt.access, got, tt.want)
+		}
+	}
+}
+
+func TestAdminAuthWrap(t *testing.T) {
+	ok := func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusNoContent) }
+	tests := []struct {
+		auth     *adminAuth
+		endpoint string
+		access   adminAccess
+		token    string
+		want     int
+	}{
+		{newAdminAuth("", "", false, nil), adminEndpointRefresh, adminWrite, "", http.StatusNoContent},
+		{newAdminAuth("", "", true, nil), adminEndpointRefresh, adminWrite, "", http.StatusForbidden},
+		{newAdminAuth("", "", true, nil), adminEndpointStats, adminRead, "", http.StatusNoContent},
+		{newAdminAuth("", "rw", true, nil), adminEndpointRefresh, adminWrite, "rw", http.StatusForbidden},
+		{newAdminAuth("", "", false, []string{adminEndpointCache}), adminEndpointCache, adminRead, "", http.StatusForbidden},
+		{newAdminAuth("", "", false, []string{adminEndpointCache}), adminEndpointStats, adminRead, "", http.StatusNoContent},
+		{newAdminAuth("ro", "rw", false, nil), adminEndpointStats, adminRead, "", http.StatusUnauthorized},
+		{newAdminAuth("ro", "rw", false, nil), adminEndpointRefresh, adminWrite, "ro", http.StatusUnauthorized},
+		{newAdminAuth("ro", "rw", false, nil), adminEndpointRefresh, adminWrite, "rw", http.StatusNoContent},
+	}
+	for i, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/"+tt.endpoint, nil)
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		tt.auth.wrap(tt.endpoint, tt.access, ok)(w, r)
+		if w.Code != tt.want {
+			t.Errorf("case %d: status = %d, want %d", i, w.Code, tt.want)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("case %d: missing WWW-Authenticate header", i)
+		}
+	}
+}
+
+func TestAdminPeer(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("peer credentials are only read on Linux")
+	}
+	ln, err := net.Listen("unix", filepath.Join(t.TempDir(), "peer.sock"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("unix", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	r := httptest.NewRequest(http.MethodGet, "/stats", nil)
+	if got := adminPeer(r); got != "unknown peer" {
+		t.Errorf("without credentials: got %q", got)
+	}
+	r = r.WithContext(adminConnContext(context.Background(), server))
+	want := fmt.Sprintf("uid %d (pid %d)", os.Getuid(), os.Getpid())
+	if got := adminPeer(r); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// TCP clients are described by their address
+	tcpLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpLn.Close()
+	tcpClient, err := net.Dial("tcp", tcpLn.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpClient.Close()
+	tcpServer, err := tcpLn.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tcpServer.Close()
+	r = r.WithContext(adminConnContext(context.Background(), tcpServer))
+	if got := adminPeer(r); got != tcpClient.LocalAddr().String() {
+		t.Errorf("TCP: got %q, want %q", got, tcpClient.LocalAddr())
+	}
+}
@@ -0,0 +1,29 @@
+package coresmd
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// peerCredentials describes the process at the other end of the Unix socket
+// connection c from its credentials, or returns "" if they cannot be read.
+func peerCredentials(c net.Conn) string {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return ""
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return ""
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil || credErr != nil {
+		return ""
+	}
+
+	return fmt.Sprintf("uid %d (pid %d)", cred.Uid, cred.Pid)
+}
@@ -0,0 +1,311 @@
+package coresmd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// startTestAdmin serves the admin API for p on a temporary socket and returns
+// a function performing requests against it with the given token.
+func startTestAdmin(t *testing.T, p *PluginState, auth *adminAuth) func(method, path, token string) *http.Response {
+	t.Helper()
+
+	sock := filepath.Join(t.TempDir(), "admin.sock")
+	stop, err := startAdminServer(sock, auth, p)
+	if err != nil {
+		t.Fatalf("startAdminServer: %v", err)
+	}
+	t.Cleanup(stop)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	}}
+
+	return func(method, path, token string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest(method, "http://coresmd"+path, nil)
+		if err != nil {
+			t.Fatalf("NewRequest: %v", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+		t.Cleanup(func() { resp.Body.Close() })
+		return resp
+	}
+}
+
+func TestAdminAccess(t *testing.T) {
+	p := setupHandler(t)
+	do := startTestAdmin(t, p, newAdminAuth("ro", "rw", false, []string{adminEndpointCache}))
+
+	tests := []struct {
+		method, path, token string
+		want                int
+	}{
+		{http.MethodGet, "/stats", "", http.StatusUnauthorized},
+		{http.MethodGet, "/stats", "ro", http.StatusOK},
+		{http.MethodGet, "/stats", "rw", http.StatusOK},
+		{http.MethodPost, "/refresh", "ro", http.StatusUnauthorized},
+		{http.MethodPost, "/refresh", "rw", http.StatusOK},
+		{http.MethodGet, "/refresh", "rw", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/cache", "rw", http.StatusForbidden},
+		{http.MethodGet, "/explain", "ro", http.StatusOK},
+		{http.MethodPost, "/explain?mac=aa:bb:cc:dd:ee:01", "ro", http.StatusUnauthorized},
+		{http.MethodPost, "/explain?mac=aa:bb:cc:dd:ee:01", "rw", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if got := do(tt.method, tt.path, tt.token).StatusCode; got != tt.want {
+			t.Errorf("%s %s with token %q: status = %d, want %d", tt.method, tt.path, tt.token, got, tt.want)
+		}
+	}
+
+	if !p.config.Load().explainMACs.enabled("aa:bb:cc:dd:ee:01") {
+		t.Error("decision traces not enabled for MAC added through admin API")
+	}
+}
+
+func TestAdminSocket(t *testing.T) {
+	p := setupHandler(t)
+	dir := t.TempDir()
+	sock := filepath.Join(dir, "admin.sock")
+	stop, err := startAdminServer(sock, newAdminAuth("", "", false, nil), p)
+	if err != nil {
+		t.Fatalf("startAdminServer: %v", err)
+	}
+
+	fi, err := os.Lstat(sock)
+	if err != nil {
+		t.Fatalf("Lstat: %v", err)
+	}
+	if perm := fi.Mode().Perm(); perm != 0o600 {
+		t.Errorf("socket permissions are %v, want 0600", perm)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("directory holds %d entries, want only the socket", len(entries))
+	}
+
+	stop()
+	if _, err := os.Lstat(sock); !os.IsNotExist(err) {
+		t.Errorf("socket not removed on stop: %v", err)
+	}
+}
+
+func TestAdminReadOnly(t *testing.T) {
+	p := setupHandler(t)
+	do := startTestAdmin(t, p, newAdminAuth("", "", true, nil))
+
+	if got := do(http.MethodPost, "/refresh", "").StatusCode; got != http.StatusForbidden {
+		t.Errorf("refresh in read-only mode: status = %d, want %d", got, http.StatusForbidden)
+	}
+	if got := do(http.MethodGet, "/cache", "").StatusCode; got != http.StatusOK {
+		t.Errorf("cache in read-only mode: status = %d, want %d", got, http.StatusOK)
+	}
+}
+
+func TestAdminLookup(t *testing.T) {
+	p := setupHandler(t)
+	do := startTestAdmin(t, p, newAdminAuth("", "", false, nil))
+
+	tests := []struct {
+		query       string
+		wantHandled bool
+		wantIP      string
+		wantBoot    string
+	}{
+		{query: "mac=AA-BB-CC-DD-EE-01&arch=7", wantHandled: true, wantIP: "172.16.0.1", wantBoot: "ipxe-x86_64.efi"},
+		{query: "mac=aa:bb:cc:dd:ee:01&ipxe=true", wantHandled: true, wantIP: "172.16.0.1", wantBoot: "http://172.16.0.253:8081/boot/v1/bootscript?mac=aa:bb:cc:dd:ee:01"},
+		{query: "mac=aa:bb:cc:dd:ee:ff", wantHandled: false},
+	}
+	for _, tt := range tests {
+		resp := do(http.MethodGet, "/lookup?"+tt.query, "")
+		if resp.StatusCode != http.StatusOK {
+			t.Errorf("%s: status = %d", tt.query, resp.StatusCode)
+			continue
+		}
+		var result LookupResult
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			t.Fatalf("%s: decode: %v", tt.query, err)
+		}
+		if result.Handled != tt.wantHandled {
+			t.Errorf("%s: handled = %t, want %t", tt.query, result.Handled, tt.wantHandled)
+		}
+		if result.Trace == nil || len(result.Trace.Steps) == 0 {
+			t.Errorf("%s: no decision trace", tt.query)
+		}
+		if !tt.wantHandled {
+			continue
+		}
+		if result.Response.YourIPAddr != tt.wantIP {
+			t.Errorf("%s: your_ip = %q, want %q", tt.query, result.Response.YourIPAddr, tt.wantIP)
+		}
+		if result.Response.BootFileName != tt.wantBoot {
+			t.Errorf("%s: boot_file = %q, want %q", tt.query, result.Response.BootFileName, tt.wantBoot)
+		}
+	}
+
+	if got := do(http.MethodGet, "/lookup?mac=nope", "").StatusCode; got != http.StatusBadRequest {
+		t.Errorf("invalid MAC: status = %d, want %d", got, http.StatusBadRequest)
+	}
+}
+
+func TestAdminStats(t *testing.T) {
+	p := setupHandler(t)
+	do := startTestAdmin(t, p, newAdminAuth("", "", false, nil))
+
+	resp := do(http.MethodGet, "/stats", "")
+	var stats map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&stats); err != nil {
+		t.Fatalf("decode: %v", err)
+	}
+	if stats["refreshes"] != float64(1) || stats["components"] != float64(2) {
+		t.Errorf("unexpected stats: %v", stats)
+	}
+	if lastErr, ok := stats["last_error"]; ok {
+		t.Errorf("unexpected error in stats: %v", lastErr)
+	}
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key to
+// dir and returns their paths along with the certificate.
+func writeTestCert(t *testing.T, dir, name string) (certFile, keyFile string, cert tls.Certificate) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	certFile, keyFile = filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certFile, certPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPEM, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile, cert
+}
+
+func TestAdminListenerTLS(t *testing.T) {
+	p := setupHandler(t)
+	dir := t.TempDir()
+	serverCert, serverKey, _ := writeTestCert(t, dir, "server")
+	clientCA, _, client := writeTestCert(t, dir, "client")
+	tlsConfig, err := newServerTLSConfig(serverCert, serverKey, clientCA)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Find a free port
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	stop, err := startAdminListener(addr, tlsConfig, newAdminAuth("ro", "rw", false, nil), p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(stop)
+
+	serverPEM, err := os.ReadFile(serverCert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(serverPEM)
+	get := func(certs []tls.Certificate, token string) (*http.Response, error) {
+		c := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, Certificates: certs}}}
+		req, err := http.NewRequest(http.MethodGet, "https://"+addr+"/stats", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := c.Do(req)
+		if err == nil {
+			t.Cleanup(func() { resp.Body.Close() })
+		}
+		return resp, err
+	}
+
+	if _, err := get(nil, "ro"); err == nil {
+		t.Error("client without certificate was accepted")
+	}
+	resp, err := get([]tls.Certificate{client}, "ro")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	resp, err = get([]tls.Certificate{client}, "wrong")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("wrong token: status = %d, want %d", resp.StatusCode, http.StatusUnauthorized)
+	}
+}
+
+func TestAdminListenOptions(t *testing.T) {
+	tests := []struct {
+		args    []string
+		wantErr bool
+	}{
+		{[]string{"admin_listen=:9443"}, true},
+		{[]string{"admin_listen=:9443", "admin_ro_token=ro"}, false},
+		{[]string{"admin_listen=:9443", "admin_rw_token=rw"}, false},
+		{[]string{"admin_listen=:9443", "admin_cert=cert.pem", "admin_key=key.pem", "admin_client_ca=ca.pem"}, false},
+		// The admin socket needs no tokens
+		{[]string{"admin_socket=/run/coresmd.sock"}, false},
+	}
+	for _, tt := range tests {
+		if _, err := parseOptions(tt.args); (err != nil) != tt.wantErr {
+			t.Errorf("%v: error = %v, want error: %t", tt.args, err, tt.wantErr)
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package coresmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/syslog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+const (
+	// auditSyslog as audit_log sends audit records to the local syslog
+	// daemon instead of a file.
+	auditSyslog = "syslog"
+	// defaultAuditMaxSize and defaultAuditMaxBackups are the size at which
+	// the audit log file is rotated and how many rotated files are kept.
+	defaultAuditMaxSize    = 100 << 20
+	defaultAuditMaxBackups = 5
+)
+
+// auditRecord describes a single DHCP transaction for security review and
+// provisioning debugging.
+type auditRecord struct {
+	Time        time.Time `json:"time"`
+	MAC         string    `json:"mac"`
+	XID         string    `json:"xid"`
+	MessageType string    `json:"message_type"`
+	// Response is the type of the response sent, or "none" if coresmd did
+	// not answer (dropping the request or passing it on).
+	Response string `json:"response"`
+	// Handled is whether coresmd ended the plugin chain rather than passing
+	// the request on to the next plugin.
+	Handled    bool   `json:"handled"`
+	AssignedIP string `json:"assigned_ip,omitempty"`
+	Bootfile   string `json:"bootfile,omitempty"`
+	// CacheAgeSeconds is how old the cached SMD data was, or -1 if the
+	// cache has not been refreshed yet.
+	CacheAgeSeconds float64 `json:"cache_age_seconds"`
+}
+
+// newAuditRecord describes the handling of req, to which coresmd replied with
+// resp (nil if it did not answer).
+func newAuditRecord(req, resp *dhcpv4.DHCPv4, handled bool, lastUpdated time.Time) auditRecord {
+	now := time.Now()
+	r := auditRecord{
+		Time:            now,
+		MAC:             clientKey(req),
+		XID:             req.TransactionID.String(),
+		MessageType:     req.MessageType().String(),
+		Response:        "none",
+		Handled:         handled,
+		CacheAgeSeconds: -1,
+	}
+	if !lastUpdated.IsZero() {
+		r.CacheAgeSeconds = now.Sub(lastUpdated).Seconds()
+	}
+	if handled && resp != nil && resp.MessageType() != dhcpv4.MessageTypeNone {
+		r.Response = resp.MessageType().String()
+		if !resp.YourIPAddr.IsUnspecified() {
+			r.AssignedIP = resp.YourIPAddr.String()
+		}
+		r.Bootfile = resp.BootFileNameOption()
+		if r.Bootfile == "" {
+			r.Bootfile = resp.BootFileName
+		}
+	}
+
+	return r
+}
+
+// auditLog writes audit records as JSON lines to a rotating file or syslog. A
+// nil auditLog discards them.
+type auditLog struct {
+	mu sync.Mutex
+	w  io.WriteCloser
+}
+
+// openAuditLog opens the audit log at dest, which is a file path or
+// auditSyslog.
+func openAuditLog(dest string, maxSize int64, maxBackups int) (*auditLog, error) {
+	if dest == auditSyslog {
+		w, err := syslog.New(syslog.LOG_INFO|syslog.LOG_DAEMON, "coresmd")
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to syslog: %w", err)
+		}
+		return &auditLog{w: w}, nil
+	}
+	f, err := openRotatingFile(dest, maxSize, maxBackups)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{w: f}, nil
+}
+
+// record writes r to the audit log.
+func (a *auditLog) record(r auditRecord) {
+	if a == nil {
+		return
+	}
+	data, err := json.Marshal(logRedaction.Load().auditRecord(r))
+	if err != nil {
+		log.Errorf("failed to encode audit record: %v", err)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(append(data, '\n')); err != nil {
+		log.Errorf("failed to write audit record: %v", err)
+	}
+}
+
+// Close closes the audit log.
+func (a *auditLog) Close() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.w.Close(); err != nil {
+		log.Errorf("failed to close audit log: %v", err)
+	}
+}
+
+// rotatingFile is a file that is renamed to <path>.1 (shifting older files to
+// <path>.2 and so on, keeping up to maxBackups) and recreated once writing to
+// it would make it larger than maxSize.
+type rotatingFile struct {
+	path       string
+	maxSize    int64
+	maxBackups int
+	f          *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+	rf.f, rf.size = f, info.Size()
+	return nil
+}
+
+func (rf *rotatingFile) Write(p []byte) (int, error) {
+	if rf.size > 0 && rf.size+int64(len(p)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(p)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+	if rf.maxBackups > 0 {
+		for i := rf.maxBackups - 1; i > 0; i-- {
+			_ = os.Rename(rf.backup(i), rf.backup(i+1))
+		}
+		if err := os.Rename(rf.path, rf.backup(1)); err != nil {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+	} else if err := os.Remove(rf.path); err != nil {
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) backup(i int) string {
+	return rf.path + "." + strconv.Itoa(i)
+}
+
+func (rf *rotatingFile) Close() error {
+	return rf.f.Close()
+}
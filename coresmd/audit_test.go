@@ -0,0 +1,90 @@
+package coresmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestRotatingFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	rf, err := openRotatingFile(path, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rf.Close()
+
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		if _, err := rf.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, want := range map[string]string{
+		path:        "dddddddd\n",
+		path + ".1": "cccccccc\n",
+		path + ".2": "bbbbbbbb\n",
+	} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != want {
+			t.Errorf("%s = %q, want %q", filepath.Base(name), data, want)
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("more than max backups kept: %v", err)
+	}
+}
+
+func TestHandler4Audit(t *testing.T) {
+	p := setupHandler(t)
+	path := filepath.Join(t.TempDir(), "audit.log")
+	audit, err := openAuditLog(path, defaultAuditMaxSize, defaultAuditMaxBackups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.audit = audit
+
+	req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", withArch(0), withIPXE())
+	p.Handler4(req, resp)
+	req, resp = newRequest(t, dhcpv4.MessageTypeRequest, "aa:bb:cc:dd:ee:99")
+	p.Handler4(req, resp)
+	audit.Close()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var records []auditRecord
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var r auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			t.Fatalf("invalid audit record %q: %v", scanner.Text(), err)
+		}
+		records = append(records, r)
+	}
+	if len(records) != 2 {
+		t.Fatalf("got %d audit records, want 2", len(records))
+	}
+
+	r := records[0]
+	if r.MAC != "aa:bb:cc:dd:ee:01" || r.MessageType != "DISCOVER" || r.Response != "OFFER" || !r.Handled {
+		t.Errorf("known client record = %+v", r)
+	}
+	if r.AssignedIP != "172.16.0.1" || !strings.HasPrefix(r.Bootfile, "http://") || r.CacheAgeSeconds < 0 {
+		t.Errorf("known client record = %+v, want assigned IP, boot script URL, and cache age", r)
+	}
+
+	r = records[1]
+	if r.MAC != "aa:bb:cc:dd:ee:99" || r.MessageType != "REQUEST" || r.Handled || r.Response != "none" || r.AssignedIP != "" {
+		t.Errorf("unknown client record = %+v", r)
+	}
+}
@@ -0,0 +1,106 @@
+package coresmd
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// bootArchs maps the architecture names accepted in boot_script_urls to the
+// client architectures (DHCP option 93) they stand for.
+var bootArchs = map[string][]iana.Arch{
+	"bios":   {iana.INTEL_X86PC},
+	"x86_64": {iana.EFI_X86_64, iana.EFI_BC, iana.EFI_X86_64_HTTP},
+	"arm64":  {iana.EFI_ARM64, iana.EFI_ARM64_HTTP},
+}
+
+// bootScriptRoute points clients of the given architectures and Component
+// role and subrole at their own boot script base URL. Empty fields match
+// anything.
+type bootScriptRoute struct {
+	archs   []iana.Arch
+	role    string
+	subRole string
+	base    *url.URL
+}
+
+// specificity returns the number of fields r matches on.
+func (r bootScriptRoute) specificity() int {
+	n := 0
+	for _, set := range []bool{r.archs != nil, r.role != "", r.subRole != ""} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+func (r bootScriptRoute) matches(archs []iana.Arch, role, subRole string) bool {
+	if r.archs != nil && !slices.ContainsFunc(archs, func(a iana.Arch) bool { return slices.Contains(r.archs, a) }) {
+		return false
+	}
+	if r.role != "" && !strings.EqualFold(r.role, role) {
+		return false
+	}
+	if r.subRole != "" && !strings.EqualFold(r.subRole, subRole) {
+		return false
+	}
+	return true
+}
+
+// parseBootScriptRoutes parses a comma-separated list of
+// <arch>/<role>[/<subrole>]=<url> entries, where any field may be '*'.
+func parseBootScriptRoutes(val string) ([]bootScriptRoute, error) {
+	var routes []bootScriptRoute
+	for _, entry := range strings.Split(val, ",") {
+		match, rawURL, ok := strings.Cut(entry, "=")
+		fields := strings.Split(match, "/")
+		if !ok || len(fields) < 2 || len(fields) > 3 || rawURL == "" {
+			return nil, fmt.Errorf("invalid entry %q: expected <arch>/<role>[/<subrole>]=<url>", entry)
+		}
+		var r bootScriptRoute
+		if arch := fields[0]; arch != "*" {
+			if archs, ok := bootArchs[arch]; ok {
+				r.archs = archs
+			} else if n, err := strconv.ParseUint(arch, 10, 16); err == nil {
+				r.archs = []iana.Arch{iana.Arch(n)}
+			} else {
+				return nil, fmt.Errorf("invalid architecture %q in entry %q: expected bios, x86_64, arm64, a number, or *", arch, entry)
+			}
+		}
+		if fields[1] != "*" {
+			r.role = fields[1]
+		}
+		if len(fields) == 3 && fields[2] != "*" {
+			r.subRole = fields[2]
+		}
+		base, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid URL in entry %q: %w", entry, err)
+		}
+		r.base = base
+		routes = append(routes, r)
+	}
+
+	return routes, nil
+}
+
+// bootScriptBase returns the boot script base URL for a client of the given
+// architectures whose Component has the given role and subrole. The most
+// specific matching entry of boot_script_urls wins, and the first one among
+// equally specific entries. Clients matching none use the base URL passed as
+// the second plugin argument.
+func (cfg *pluginConfig) bootScriptBase(archs []iana.Arch, role, subRole string) *url.URL {
+	base, best := cfg.bootScriptBaseURL, -1
+	for _, r := range cfg.bootScriptRoutes {
+		if s := r.specificity(); s > best && r.matches(archs, role, subRole) {
+			base, best = r.base, s
+		}
+	}
+
+	return base
+}
@@ -0,0 +1,63 @@
+package coresmd
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestBootScriptBase(t *testing.T) {
+	routes, err := parseBootScriptRoutes("arm64/Management=http://arm-mgmt:8081,*/Compute=http://compute:8081,x86_64/Compute/Gateway=http://gateway:8081,*/Compute=http://ignored:8081,11/*=http://arm:8081")
+	if err != nil {
+		t.Fatal(err)
+	}
+	base, _ := url.Parse("http://default:8081")
+	cfg := &pluginConfig{bootScriptBaseURL: base, bootScriptRoutes: routes}
+
+	tests := []struct {
+		name    string
+		archs   []iana.Arch
+		role    string
+		subRole string
+		want    string
+	}{
+		{"arch and role", []iana.Arch{iana.EFI_ARM64}, "Management", "", "http://arm-mgmt:8081"},
+		{"role only", []iana.Arch{iana.EFI_X86_64}, "compute", "", "http://compute:8081"},
+		{"most specific", []iana.Arch{iana.EFI_BC}, "Compute", "Gateway", "http://gateway:8081"},
+		{"numeric arch", []iana.Arch{iana.EFI_ARM64}, "Storage", "", "http://arm:8081"},
+		{"unknown arch", nil, "Management", "", "http://default:8081"},
+		{"no match", []iana.Arch{iana.INTEL_X86PC}, "Management", "", "http://default:8081"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := cfg.bootScriptBase(tt.archs, tt.role, tt.subRole).String(); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	for _, val := range []string{"arm64=http://x", "sparc/Compute=http://x", "*/Compute=", "*/Compute/a/b=http://x"} {
+		if _, err := parseBootScriptRoutes(val); err == nil {
+			t.Errorf("expected %q to be rejected", val)
+		}
+	}
+}
+
+func TestHandler4BootScriptBase(t *testing.T) {
+	p := setupHandler(t)
+	routes, err := parseBootScriptRoutes("bios/*=http://bios:8081,x86_64/*=http://x86:8081")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.config.Load().bootScriptRoutes = routes
+
+	// The client lists legacy BIOS first, but is served the x86_64 UEFI
+	// bootloader, so it gets the x86_64 boot script base URL
+	req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", withArch(iana.INTEL_X86PC, iana.EFI_X86_64), withIPXE())
+	resp, _ = p.Handler4(req, resp)
+	if got, want := resp.BootFileNameOption(), "http://x86:8081/boot/v1/bootscript?mac=aa:bb:cc:dd:ee:01"; got != want {
+		t.Errorf("boot file = %q, want %q", got, want)
+	}
+}
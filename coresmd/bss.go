@@ -0,0 +1,199 @@
+package coresmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/OpenCHAMI/coresmd/pkg/smdclient"
+)
+
+// bootScriptPath is the path at which the built-in HTTP server serves boot
+// scripts generated from BSS boot parameters.
+const bootScriptPath = "/bootscript"
+
+// BootParams are the boot parameters of a set of nodes as stored in BSS.
+type BootParams struct {
+	MACs   []string `json:"macs"`
+	Hosts  []string `json:"hosts"`
+	NIDs   []int64  `json:"nids"`
+	Params string   `json:"params"`
+	Kernel string   `json:"kernel"`
+	Initrd string   `json:"initrd"`
+}
+
+// bootParamsIndex is an immutable view of the boot parameters in BSS as of a
+// single refresh.
+type bootParamsIndex struct {
+	lastUpdated time.Time
+	byMAC       map[string]BootParams
+	byHost      map[string]BootParams
+}
+
+// bootParamsCache holds the boot parameters fetched from BSS so that boot
+// scripts can be generated locally, without BSS having to answer every node
+// during a boot storm.
+type bootParamsCache struct {
+	client *HTTPSmdClient
+	index  atomic.Pointer[bootParamsIndex]
+}
+
+func newBootParamsCache(client *HTTPSmdClient) *bootParamsCache {
+	b := &bootParamsCache{client: client}
+	b.index.Store(&bootParamsIndex{})
+
+	return b
+}
+
+// refresh fetches all boot parameters from BSS, replacing the cached ones if
+// it succeeds.
+func (b *bootParamsCache) refresh(ctx context.Context) error {
+	idx := &bootParamsIndex{
+		lastUpdated: time.Now(),
+		byMAC:       make(map[string]BootParams),
+		byHost:      make(map[string]BootParams),
+	}
+	err := smdclient.StreamList(ctx, b.client, "/boot/v1/bootparameters", nil, "", func(bp BootParams) string { return fmt.Sprint(bp.MACs, bp.Hosts) }, func(bp BootParams) error {
+		for _, m := range bp.MACs {
+			mac, err := NormalizeMAC(m)
+			if err != nil {
+				log.Warnf("ignoring invalid MAC address in BSS boot parameters: %v", err)
+				continue
+			}
+			idx.byMAC[mac] = bp
+		}
+		for _, h := range bp.Hosts {
+			idx.byHost[h] = bp
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to fetch boot parameters from BSS: %w", err)
+	}
+
+	b.index.Store(idx)
+	log.Infof("boot parameters updated with %d MAC addresses and %d hosts", len(idx.byMAC), len(idx.byHost))
+
+	return nil
+}
+
+// lookup returns the boot parameters for the node with the given MAC address
+// and Component ID, falling back to BSS's "Default" host like BSS does.
+func (b *bootParamsCache) lookup(mac, compID string) (BootParams, bool) {
+	idx := b.index.Load()
+	if bp, ok := idx.byMAC[mac]; ok {
+		return bp, true
+	}
+	if bp, ok := idx.byHost[compID]; ok && compID != "" {
+		return bp, true
+	}
+	bp, ok := idx.byHost["Default"]
+
+	return bp, ok
+}
+
+// refreshBootParams refreshes the cached BSS boot parameters, if enabled. It
+// is called after each cache refresh.
+func (p *PluginState) refreshBootParams(ctx context.Context) {
+	if b := p.config.Load().bootParams; b != nil {
+		if err := b.refresh(ctx); err != nil {
+			log.Errorf("failed to refresh boot parameters, keeping previous ones: %v", err)
+		}
+	}
+}
+
+// bootScript returns an iPXE script that boots the kernel and initrd in bp.
+func bootScript(bp BootParams) string {
+	args := []string{"kernel", "--name", "kernel", bp.Kernel}
+	if bp.Initrd != "" {
+		args = append(args, "initrd=initrd")
+	}
+	if bp.Params != "" {
+		args = append(args, bp.Params)
+	}
+
+	var sb strings.Builder
+	sb.WriteString("#!ipxe\n")
+	sb.WriteString(strings.Join(args, " ") + "\n")
+	if bp.Initrd != "" {
+		fmt.Fprintf(&sb, "initrd --name initrd %s\n", bp.Initrd)
+	}
+	sb.WriteString("boot\n")
+
+	return sb.String()
+}
+
+// chainScript returns an iPXE script that chains to u.
+func chainScript(u *url.URL) string {
+	return fmt.Sprintf("#!ipxe\nchain %s\n", u)
+}
+
+// localBootScriptURL returns the URL of the boot script generated by the
+// built-in HTTP server for the given MAC address.
+func localBootScriptURL(httpURL *url.URL, mac string) *url.URL {
+	u := httpURL.JoinPath(bootScriptPath)
+	u.RawQuery = url.Values{"mac": {mac}}.Encode()
+	return u
+}
+
+// serveBootScript serves a boot script generated from the cached BSS boot
+// parameters of the node whose MAC address is given in the mac query
+// parameter. Nodes without cached boot parameters are chained to BSS.
+func (p *PluginState) serveBootScript(w http.ResponseWriter, r *http.Request) {
+	cfg := p.config.Load()
+	if cfg.bootParams == nil {
+		http.NotFound(w, r)
+		return
+	}
+	if cfg.bootScriptKey != nil {
+		if err := VerifyBootScriptQuery(r.URL.Query(), cfg.bootScriptKey, cfg.bootScriptTTL, time.Now()); err != nil {
+			log.Warnf("http: refusing boot script request from %s: %v", remoteIP(r), err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	mac, err := NormalizeMAC(r.URL.Query().Get("mac"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var compID string
+	var comp Component
+	snapshot := p.cache.Snapshot()
+	if ei, ok := snapshot.EthernetInterfaces[mac]; ok {
+		compID = ei.ComponentID
+		comp = snapshot.Components[compID]
+	}
+
+	var script string
+	if bp, ok := cfg.bootParams.lookup(mac, compID); ok && bp.wantsLocalBoot() {
+		script = exitScript
+		log.Infof("http: boot parameters of %s ask for local boot, sending exit script to %s", mac, remoteIP(r))
+	} else if ok && bp.Kernel != "" {
+		script = bootScript(bp)
+		log.Infof("http: sending generated boot script for %s (kernel %s) to %s", mac, path.Base(bp.Kernel), remoteIP(r))
+	} else {
+		// The client architecture is not known here, so only role-based
+		// boot_script_urls entries apply
+		base := cfg.bootScriptBase(nil, comp.Role, comp.SubRole)
+		bssURL, err := cfg.bootScriptPath.URL(base, BootScriptParams{MAC: mac, Xname: compID, NID: comp.NID})
+		if err != nil {
+			log.Errorf("http: unable to build boot script URL for %s: %v", mac, err)
+			http.Error(w, "unable to build boot script URL", http.StatusInternalServerError)
+			return
+		}
+		script = chainScript(bssURL)
+		log.Infof("http: no cached boot parameters for %s, chaining %s to %s", mac, remoteIP(r), bssURL)
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	if _, err := w.Write([]byte(script)); err != nil {
+		log.Errorf("http: failed to send boot script to %s: %v", remoteIP(r), err)
+	}
+}
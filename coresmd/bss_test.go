@@ -0,0 +1,101 @@
+package coresmd
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestBootScriptFromBSS(t *testing.T) {
+	bss := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/boot/v1/bootparameters" {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode([]BootParams{
+			{MACs: []string{"AA:BB:CC:DD:EE:01"}, Kernel: "http://s3/kernel", Initrd: "http://s3/initrd", Params: "console=ttyS0"},
+			{Hosts: []string{"x3000c0s0b0"}, Kernel: "http://s3/bmc-kernel"},
+		})
+	}))
+	defer bss.Close()
+	bssURL, _ := url.Parse(bss.URL)
+
+	p := setupHandler(t)
+	cfg := p.config.Load()
+	cfg.bootScriptBaseURL = bssURL
+	cfg.httpURL, _ = url.Parse("http://10.0.0.1:8080")
+	cfg.bootParams = newBootParamsCache(NewSmdClient(bssURL))
+	p.refreshBootParams(context.Background())
+
+	// iPXE clients are pointed at the built-in HTTP server
+	req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", withArch(iana.EFI_X86_64), withIPXE())
+	got, _ := p.Handler4(req, resp)
+	if bf := got.BootFileNameOption(); bf != "http://10.0.0.1:8080/bootscript?mac=aa%3Abb%3Acc%3Add%3Aee%3A01" {
+		t.Errorf("boot file = %q", bf)
+	}
+
+	tests := []struct {
+		mac  string
+		want string
+	}{
+		{
+			mac:  "aa:bb:cc:dd:ee:01",
+			want: "#!ipxe\nkernel --name kernel http://s3/kernel initrd=initrd console=ttyS0\ninitrd --name initrd http://s3/initrd\nboot\n",
+		},
+		{
+			// Matched by the xname of its Component
+			mac:  "aa:bb:cc:dd:ee:02",
+			want: "#!ipxe\nkernel --name kernel http://s3/bmc-kernel\nboot\n",
+		},
+		{
+			mac:  "aa:bb:cc:dd:ee:03",
+			want: "#!ipxe\nchain " + bss.URL + "/boot/v1/bootscript?mac=aa:bb:cc:dd:ee:03\n",
+		},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		p.serveBootScript(w, httptest.NewRequest(http.MethodGet, "/bootscript?mac="+strings.ToUpper(tt.mac), nil))
+		body, _ := io.ReadAll(w.Result().Body)
+		if string(body) != tt.want {
+			t.Errorf("%s: boot script = %q, want %q", tt.mac, body, tt.want)
+		}
+	}
+}
+
+func TestBSSClientSettings(t *testing.T) {
+	bss := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode([]BootParams{{MACs: []string{"AA:BB:CC:DD:EE:01"}, Kernel: "http://s3/kernel"}})
+	}))
+	defer bss.Close()
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("s3cret\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// BSS is reached with the credentials set for SMD
+	cfg, _, _, err := loadConfig([]string{"http://127.0.0.1:1", bss.URL, "", "1h", "1h",
+		"smd_retries=0", "smd_token_file=" + tokenFile, "bss_embed=true", "http_listen=:0", "http_url=http://10.0.0.1:8080"})
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	if err := cfg.bootParams.refresh(context.Background()); err != nil {
+		t.Fatalf("refresh: %v", err)
+	}
+	if _, ok := cfg.bootParams.index.Load().byMAC["aa:bb:cc:dd:ee:01"]; !ok {
+		t.Error("boot parameters not fetched from BSS")
+	}
+}
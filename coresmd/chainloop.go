@@ -0,0 +1,94 @@
+package coresmd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+const (
+	chainLoopScriptName    = "chain-loop"
+	defaultChainLoopWindow = 10 * time.Minute
+)
+
+// chainLoopScript is served instead of the boot script to iPXE clients that
+// keep coming back to DHCP, which happens when their boot script chains to
+// DHCP again instead of booting. It waits before rebooting so that the client
+// does not hammer the boot services.
+var chainLoopScript = `#!ipxe
+echo coresmd: this node keeps returning to DHCP after chaining to its boot script.
+echo Check the boot script served for ${net0/mac}. Rebooting in 5 minutes.
+sleep 300
+reboot
+`
+
+type chainCount struct {
+	count int
+	first time.Time
+}
+
+// chainTracker counts events per MAC address within a sliding window starting
+// at the first event. It is safe for concurrent use; counts are split into
+// shards by MAC address so that different clients do not wait on each other.
+// It outlives reloads.
+type chainTracker struct {
+	shards [numShards]chainShard
+}
+
+type chainShard struct {
+	mu        sync.Mutex
+	counts    map[string]*chainCount
+	lastSweep time.Time
+}
+
+func newChainTracker() *chainTracker {
+	ct := &chainTracker{}
+	for i := range ct.shards {
+		ct.shards[i].counts = make(map[string]*chainCount)
+	}
+	return ct
+}
+
+// record counts a boot script URL handed out to mac and returns the number
+// counted within window, including this one. A nil chainTracker counts
+// nothing.
+func (ct *chainTracker) record(mac string, window time.Duration, now time.Time) int {
+	if ct == nil {
+		return 0
+	}
+	s := &ct.shards[shardOf(mac)]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Forget clients that have not been seen for a while so that the map
+	// does not grow without bounds
+	if now.Sub(s.lastSweep) > window {
+		for m, c := range s.counts {
+			if now.Sub(c.first) > window {
+				delete(s.counts, m)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	c, ok := s.counts[mac]
+	if !ok || now.Sub(c.first) > window {
+		c = &chainCount{first: now}
+		s.counts[mac] = c
+	}
+	c.count++
+
+	return c.count
+}
+
+// countChain records an iPXE client requesting an address, after which it is
+// handed its boot script URL, and returns the number of times it did so within
+// the chain loop window. Only DHCPREQUESTs are counted so that each DHCP
+// exchange counts once. It returns 0 if loop checking is disabled.
+func (p *PluginState) countChain(cfg *pluginConfig, req *dhcpv4.DHCPv4, mac string) int {
+	if cfg.chainLoopLimit == 0 || req.MessageType() != dhcpv4.MessageTypeRequest {
+		return 0
+	}
+	return p.chainLoops.record(mac, cfg.chainLoopWindow, time.Now())
+}
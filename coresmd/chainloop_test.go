@@ -0,0 +1,58 @@
+package coresmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestChainTracker(t *testing.T) {
+	ct := newChainTracker()
+	now := time.Now()
+	for i := 1; i <= 3; i++ {
+		if got := ct.record("aa:bb:cc:dd:ee:01", time.Minute, now.Add(time.Duration(i)*time.Second)); got != i {
+			t.Fatalf("record %d: got count %d", i, got)
+		}
+	}
+	if got := ct.record("aa:bb:cc:dd:ee:02", time.Minute, now); got != 1 {
+		t.Errorf("other MAC: got count %d, want 1", got)
+	}
+
+	// The count starts over once the window has passed
+	if got := ct.record("aa:bb:cc:dd:ee:01", time.Minute, now.Add(2*time.Minute)); got != 1 {
+		t.Errorf("after window: got count %d, want 1", got)
+	}
+	ct.record(sameShard("aa:bb:cc:dd:ee:02"), time.Minute, now.Add(2*time.Minute))
+	if _, ok := ct.shards[shardOf("aa:bb:cc:dd:ee:02")].counts["aa:bb:cc:dd:ee:02"]; ok {
+		t.Error("expired client was not forgotten")
+	}
+}
+
+func TestHandler4ChainLoop(t *testing.T) {
+	p := setupHandler(t)
+	p.chainLoops = newChainTracker()
+	cfg := p.config.Load()
+	cfg.chainLoopLimit = 2
+	cfg.chainLoopWindow = time.Minute
+
+	bootfile := func(mt dhcpv4.MessageType) string {
+		req, resp := newRequest(t, mt, "aa:bb:cc:dd:ee:01", withArch(iana.EFI_X86_64), withIPXE())
+		got, _ := p.Handler4(req, resp)
+		return got.BootFileNameOption()
+	}
+	bootScript := "http://172.16.0.253:8081/boot/v1/bootscript?mac=aa:bb:cc:dd:ee:01"
+
+	for i := 0; i < 2; i++ {
+		if got := bootfile(dhcpv4.MessageTypeDiscover); got != bootScript {
+			t.Fatalf("discover %d: got boot file %q, want %q", i, got, bootScript)
+		}
+		if got := bootfile(dhcpv4.MessageTypeRequest); got != bootScript {
+			t.Fatalf("request %d: got boot file %q, want %q", i, got, bootScript)
+		}
+	}
+	if got := bootfile(dhcpv4.MessageTypeRequest); got != chainLoopScriptName {
+		t.Errorf("looping client: got boot file %q, want %q", got, chainLoopScriptName)
+	}
+}
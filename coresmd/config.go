@@ -0,0 +1,448 @@
+package coresmd
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/OpenCHAMI/coresmd/internal/ipxe"
+)
+
+// pluginConfig holds the settings used by the handler of a plugin instance. It
+// is replaced as a whole when the configuration is reloaded, so a request is
+// handled with the same settings throughout.
+type pluginConfig struct {
+	bootScriptBaseURL *url.URL
+	// Template of the boot script path and query below bootScriptBaseURL
+	bootScriptPath *BootScriptTemplate
+	// Metadata server URL sent in a site-specific option, or nil
+	metadataURL *metadataURL
+	// Boot script base URLs overriding bootScriptBaseURL by client
+	// architecture and Component role
+	bootScriptRoutes []bootScriptRoute
+	// URL to give to UEFI HTTP boot clients, if set
+	httpURL *url.URL
+	// Actions taken when a request cannot be fully answered
+	outcomes outcomeActions
+	// Whether requests are simulated by the admin API rather than sent by
+	// clients, in which case they are left out of metrics and of the boot
+	// funnel and lifecycle
+	simulated bool
+	// Server identifier to answer as, if set
+	serverID net.IP
+	// TFTP server to give to clients, if set
+	tftpServer        net.IP
+	tftpServerSubnets []subnetIP
+	// Domain search list and interface MTU to give to clients, if set
+	domainSearch        []string
+	domainSearchSubnets []subnetDomains
+	mtu                 uint16
+	mtuSubnets          []subnetMTU
+	// Option profiles by subnet of the assigned IP
+	networks []networkProfile
+	// Notified when a cache refresh finds inventory changes, or nil
+	inventoryHook *inventoryHook
+	// Lease times by Component type
+	defaultLeasePolicy leasePolicy
+	leasePolicies      map[string]leasePolicy
+	// Action to take on requests for an IP other than the assigned one
+	requestedIPMismatch string
+	// Match by client identifier if hardware address is not found
+	clientIDFallback bool
+	// What to do for Nodes without a NID; empty means missingNIDXname
+	missingNID string
+	// How long to wait when probing addresses before offering them, if
+	// nonzero
+	probeTimeout time.Duration
+	// Pool of provisional addresses for clients not in SMD, if set
+	discoveryPool *provisionalPool
+	// Which requests get a decision trace
+	explainMACs *explainSet
+	// How old the cache may get before requests are dropped, if nonzero
+	maxStaleness time.Duration
+	// How old the cache may get before it is reported as stale, if nonzero
+	stalenessAlert time.Duration
+	// Boot file given to iPXE clients while the boot script base URL is
+	// unreachable, if set, and how often to check it
+	fallbackBootfile        string
+	bootScriptCheckInterval time.Duration
+	// Generated stage-1 scripts served instead of boot script URLs, if
+	// enabled
+	stage1 *stage1Config
+	// Image nodes in rescue boot are booted with unless they set their own
+	rescue rescueImage
+	// Times in a row a node may be served its bootloader before it is
+	// considered stuck, or 0 to never consider it stuck
+	funnelStuckLimit int
+	// Where to publish boot lifecycle events, or nil to not
+	events *eventsConfig
+	// Encoded iPXE settings sent in option 175 to iPXE clients, if any
+	ipxeOptions []byte
+	// Network bootstrap programs served instead of iPXE by client class
+	nbpRules []nbpRule
+	// iPXE bootloaders by client architecture, or nil for the defaults
+	bootloaders ipxe.Bootloaders
+	// Bootloaders driving the NIC through the firmware, or nil for the
+	// defaults, and the nodes always given them
+	snpBootloaders ipxe.Bootloaders
+	snpOnly        nodeSelector
+	// Features iPXE clients presenting option 175 need to be given their
+	// boot script instead of being chainloaded to another iPXE
+	ipxeRequire []string
+	// Nodes sent to their local disk instead of their boot script
+	localBoot nodeSelector
+	// Nodes only given an address, whose network boot is managed elsewhere
+	ipOnly nodeSelector
+	// DHCP option bundles by lowercase <role> or <role>/<subrole>
+	roleOptions map[string]roleOptions
+	// NTP servers and time zone given to all clients
+	time timeSettings
+	// Nodes booting the signed shim and GRUB instead of iPXE, or nil
+	secureBoot *secureBootConfig
+	// Leave out options the client did not ask for in option 55
+	honorPRL bool
+	// PXE vendor options (option 43) sent to PXE clients, or nil
+	pxe *pxeVendorOptions
+	// Number of boot script URLs handed out to an iPXE client within
+	// chainLoopWindow after which it is considered to be looping, or 0 to
+	// not check
+	chainLoopLimit  int
+	chainLoopWindow time.Duration
+	// Key to sign boot script URLs with, if set, and how long signed URLs
+	// are valid for
+	bootScriptKey []byte
+	bootScriptTTL time.Duration
+	// Boot parameters cached from BSS to generate boot scripts from, if
+	// enabled
+	bootParams *bootParamsCache
+	// Window over which repeated lookup errors for a client are logged
+	// once, or 0 to log every one
+	logThrottle time.Duration
+	// Rate limits per client MAC address and per relay agent, or nil
+	macRateLimit   *rateLimiter
+	relayRateLimit *rateLimiter
+	// Clients to serve exclusively, if set, and clients never to serve
+	macAllowList *macList
+	macDenyList  *macList
+	// Interfaces serving directly attached clients, or nil to not check
+	// that assigned addresses are routable where requests arrived
+	interfaces *interfaceSet
+	// Per-MAC settings merged over the SMD data, or nil
+	static *staticOverrides
+	// How long an offered address is held for the client it was offered to
+	offerHold time.Duration
+	// Where to publish acknowledged addresses in DNS, or nil to not
+	dnsUpdate *dnsUpdateConfig
+}
+
+// cacheConfig holds the settings of a plugin instance's cache.
+type cacheConfig struct {
+	client   *HTTPSmdClient
+	interval time.Duration
+	jitter   time.Duration
+	types    []string
+	roles    []string
+	diff     DiffLogging
+	redfish  bool
+	groups   bool
+}
+
+// loadConfig parses the plugin arguments into the settings used by the handler
+// and the cache, and the options used to start listeners.
+func loadConfig(args []string) (*pluginConfig, cacheConfig, options, error) {
+	var cc cacheConfig
+
+	// Ensure all required args were passed
+	if len(args) < 5 {
+		return nil, cc, options{}, errors.New("expected at least 5 arguments: base URL, boot script base URL, CA certificate path, cache refresh interval, lease duration")
+	}
+
+	// Parse any optional key=value arguments following the required ones
+	opts, err := parseOptions(args[5:])
+	if err != nil {
+		return nil, cc, opts, fmt.Errorf("failed to parse options: %w", err)
+	}
+
+	cfg := &pluginConfig{
+		httpURL:                 opts.httpURL,
+		serverID:                opts.serverID,
+		outcomes:                opts.outcomes,
+		tftpServer:              opts.tftpServer,
+		tftpServerSubnets:       opts.tftpServerSubnets,
+		leasePolicies:           opts.leasePolicies,
+		requestedIPMismatch:     opts.requestedIPMismatch,
+		missingNID:              opts.missingNID,
+		clientIDFallback:        opts.clientIDFallback,
+		probeTimeout:            opts.probeTimeout,
+		explainMACs:             newExplainSet(opts.explain, opts.explainMACs),
+		maxStaleness:            opts.maxStaleness,
+		stalenessAlert:          opts.stalenessAlert,
+		fallbackBootfile:        opts.fallbackBootfile,
+		rescue:                  opts.rescue,
+		funnelStuckLimit:        opts.funnelStuckLimit,
+		bootScriptRoutes:        opts.bootScriptRoutes,
+		chainLoopLimit:          opts.chainLoopLimit,
+		honorPRL:                opts.honorPRL,
+		nbpRules:                opts.nbpRules,
+		bootloaders:             opts.bootloaders,
+		snpBootloaders:          opts.snpBootloaders,
+		snpOnly:                 opts.snpOnly,
+		ipxeRequire:             opts.ipxeRequire,
+		ipxeOptions:             opts.ipxeOptions,
+		localBoot:               opts.localBoot,
+		ipOnly:                  opts.ipOnly,
+		roleOptions:             opts.roleOptions,
+		chainLoopWindow:         opts.chainLoopWindow,
+		bootScriptCheckInterval: opts.bootScriptCheckInterval,
+		offerHold:               opts.offerHold,
+	}
+
+	// Create new SmdClient using first argument (base URL)
+	log.Debug("generating new SmdClient")
+	baseURL, err := url.Parse(args[0])
+	if err != nil {
+		return nil, cc, opts, fmt.Errorf("failed to parse base URL: %w", err)
+	}
+	cc.client = NewSmdClient(baseURL)
+	cc.client.PageSize = opts.smdPageSize
+	cc.client.APIVersion = opts.smdAPIVersion
+
+	// Parse from the second argument the insecure URL used by iPXE clients
+	// to fetch their boot script via HTTP without a certificate
+	log.Debug("parsing boot script base URL")
+	cfg.bootScriptBaseURL, err = url.Parse(args[1])
+	if err != nil {
+		return nil, cc, opts, fmt.Errorf("failed to parse boot script base URL: %w", err)
+	}
+
+	for _, r := range cfg.bootScriptRoutes {
+		log.Infof("boot script base URL for architectures %v, role %q, subrole %q: %s", r.archs, r.role, r.subRole, r.base)
+	}
+	if opts.pxeVendorOptions {
+		pxe := opts.pxe
+		cfg.pxe = &pxe
+		log.Infof("sending PXE vendor options to PXE clients (discovery control: %#x, %d menu items)", pxe.discoveryControl, len(pxe.menu))
+	}
+	if opts.bootScriptPath != "" {
+		cfg.bootScriptPath, err = ParseBootScriptTemplate(opts.bootScriptPath)
+		if err != nil {
+			return nil, cc, opts, err
+		}
+		log.Infof("boot script path template: %s", opts.bootScriptPath)
+	}
+	if opts.metadataURL != "" {
+		cfg.metadataURL, err = parseMetadataURL(opts.metadataURL, opts.metadataOption)
+		if err != nil {
+			return nil, cc, opts, fmt.Errorf("invalid metadata_url: %w", err)
+		}
+		log.Infof("sending metadata URL %s in option %d", opts.metadataURL, opts.metadataOption)
+	}
+
+	// If nonempty, test that CA cert path exists (third argument)
+	caCertPath := strings.Trim(args[2], `"'`)
+	log.Infof("cacertPath: %s", caCertPath)
+	if err := configureClient(cc.client, caCertPath, opts); err != nil {
+		return nil, cc, opts, fmt.Errorf("failed to configure SMD client: %w", err)
+	}
+	if caCertPath != "" {
+		log.Infof("set CA certificate for SMD to the contents of %s (also trusting system CAs: %t)", caCertPath, opts.smdTLS.SystemCAs)
+	} else {
+		log.Infof("CA certificate path was empty, not setting")
+	}
+	if opts.smdClientCert != "" {
+		log.Infof("authenticating to SMD with client certificate %s", opts.smdClientCert)
+	}
+	if opts.smdTokenFile != "" {
+		log.Infof("authenticating to SMD with token from %s", opts.smdTokenFile)
+	}
+
+	// Parse cache refresh interval from fourth argument
+	cc.interval, err = time.ParseDuration(args[3])
+	if err != nil {
+		return nil, cc, opts, fmt.Errorf("failed to parse cache duration: %w", err)
+	}
+	cc.jitter = opts.refreshJitter
+	if cc.jitter < 0 {
+		cc.jitter = cc.interval / 10
+	}
+	if opts.maxStaleness > 0 && opts.maxStaleness < cc.interval {
+		log.Warnf("max_staleness %s is shorter than the cache refresh interval %s; requests will be dropped between refreshes", opts.maxStaleness, cc.interval)
+	}
+	if opts.stalenessAlert > 0 && opts.stalenessAlert < cc.interval {
+		log.Warnf("staleness_alert %s is shorter than the cache refresh interval %s; the cache will be reported as stale between refreshes", opts.stalenessAlert, cc.interval)
+	}
+	cc.types = opts.componentTypes
+	cc.roles = opts.componentRoles
+	cc.diff = opts.refreshDiff
+	cc.redfish = opts.smdRedfishEndpoints
+	if cc.redfish {
+		log.Info("also serving MAC addresses of RedfishEndpoints in SMD")
+	}
+	cc.groups = opts.smdGroups
+	if !cc.groups && (opts.localBoot.usesGroups() || opts.secureBoot.usesGroups() || opts.ipOnly.usesGroups() || opts.snpOnly.usesGroups()) {
+		log.Info("caching SMD groups and partitions, which local_boot, secure_boot, ip_only, or snp_only select nodes by")
+		cc.groups = true
+	}
+	if len(opts.componentTypes) > 0 || len(opts.componentRoles) > 0 {
+		log.Infof("only caching Components with types %v and roles %v", opts.componentTypes, opts.componentRoles)
+	}
+
+	// Set lease duration from fifth argument
+	log.Debug("setting lease duration")
+	leaseDuration, err := time.ParseDuration(args[4])
+	if err != nil {
+		return nil, cc, opts, fmt.Errorf("failed to parse lease duration: %w", err)
+	}
+	cfg.domainSearch, cfg.domainSearchSubnets = opts.domainSearch, opts.domainSearchSubnets
+	cfg.mtu, cfg.mtuSubnets = opts.mtu, opts.mtuSubnets
+	cfg.networks = opts.networks
+	cfg.logThrottle = opts.logThrottle
+	cfg.macRateLimit = newRateLimiter(opts.rateLimit, opts.rateLimitBurst)
+	cfg.relayRateLimit = newRateLimiter(opts.relayRateLimit, opts.relayRateLimitBurst)
+	if opts.macAllowFile != "" {
+		if cfg.macAllowList, err = loadMACList(opts.macAllowFile); err != nil {
+			return nil, cc, opts, err
+		}
+	}
+	if opts.eventsURL != "" {
+		if cfg.events, err = parseEventsURL(opts.eventsURL, opts.eventsSubject); err != nil {
+			return nil, cc, opts, fmt.Errorf("invalid events_url: %w", err)
+		}
+	}
+	if opts.dnsUpdate.server != "" {
+		d := opts.dnsUpdate
+		cfg.dnsUpdate = &d
+	}
+	if opts.interfaces != nil {
+		if cfg.interfaces, err = newInterfaceSet(opts.interfaces); err != nil {
+			return nil, cc, opts, err
+		}
+	}
+	if opts.overridesFile != "" {
+		if cfg.static, err = loadStaticOverrides(opts.overridesFile); err != nil {
+			return nil, cc, opts, err
+		}
+	}
+	if opts.macDenyFile != "" {
+		if cfg.macDenyList, err = loadMACList(opts.macDenyFile); err != nil {
+			return nil, cc, opts, err
+		}
+	}
+	cfg.inventoryHook = newInventoryHook(opts.inventoryWebhook, opts.inventoryHook, opts.inventoryHookTimeout)
+	for _, n := range cfg.networks {
+		log.Infof("using network profile for %s", n.subnet)
+	}
+	cfg.time = timeSettings{
+		ntp:      opts.ntpServers,
+		location: opts.timezone,
+		posixTZ:  opts.posixTimezone,
+	}
+	cfg.defaultLeasePolicy = leasePolicy{
+		lease:     leaseDuration,
+		renewal:   opts.renewalTime,
+		rebinding: opts.rebindingTime,
+	}
+	if err := cfg.defaultLeasePolicy.validate(); err != nil {
+		return nil, cc, opts, fmt.Errorf("invalid default lease policy: %w", err)
+	}
+	for compType, lp := range cfg.leasePolicies {
+		log.Infof("using lease policy for Components of type %s: %s", compType, lp)
+	}
+	for role := range cfg.roleOptions {
+		log.Infof("using option bundle for Components with role %s", role)
+	}
+
+	// Sign boot script URLs, if enabled
+	if opts.bootScriptKeyFile != "" {
+		cfg.bootScriptKey, err = readSigningKey(opts.bootScriptKeyFile)
+		if err != nil {
+			return nil, cc, opts, err
+		}
+		cfg.bootScriptTTL = opts.bootScriptURLTTL
+		log.Infof("signing boot script URLs with key from %s (valid for %s)", opts.bootScriptKeyFile, cfg.bootScriptTTL)
+	}
+
+	// Generate boot scripts from cached BSS boot parameters, if enabled
+	if opts.bssEmbed {
+		if opts.httpURL == nil || opts.httpListen == "" {
+			return nil, cc, opts, errors.New("bss_embed requires http_listen and http_url")
+		}
+		// BSS sits behind the same gateway as SMD, so it is reached
+		// with the same CA, credentials, and retries
+		bssClient := NewSmdClient(cfg.bootScriptBaseURL)
+		if err := configureClient(bssClient, caCertPath, opts); err != nil {
+			return nil, cc, opts, fmt.Errorf("failed to configure BSS client: %w", err)
+		}
+		cfg.bootParams = newBootParamsCache(bssClient)
+		log.Infof("serving boot scripts generated from boot parameters in BSS at %s", cfg.bootScriptBaseURL)
+	}
+
+	// Serve generated stage-1 scripts, if enabled
+	if opts.stage1Script {
+		if opts.httpURL == nil || opts.httpListen == "" {
+			return nil, cc, opts, errors.New("stage1_script requires http_listen and http_url")
+		}
+		cfg.stage1 = &stage1Config{retries: opts.stage1Retries, timeout: opts.stage1Timeout, fallbacks: opts.stage1Fallbacks}
+		log.Infof("serving stage-1 scripts retrying boot scripts %d times (timeout %s) before falling back to %v", opts.stage1Retries, opts.stage1Timeout, opts.stage1Fallbacks)
+	}
+
+	// Boot selected nodes with Secure Boot, if enabled
+	if len(opts.secureBoot) > 0 {
+		sb := &secureBootConfig{nodes: opts.secureBoot}
+		sb.shims, err = parseSecureBootShims(opts.secureBootShims)
+		if err != nil {
+			return nil, cc, opts, fmt.Errorf("failed to parse secure_boot_shims: %w", err)
+		}
+		if opts.secureBootGrubConfig != "" {
+			sb.configPath, err = ParseBootScriptTemplate(opts.secureBootGrubConfig)
+			if err != nil {
+				return nil, cc, opts, fmt.Errorf("failed to parse secure_boot_grub_config: %w", err)
+			}
+		} else if cfg.bootParams == nil {
+			return nil, cc, opts, errors.New("secure_boot requires secure_boot_grub_config or bss_embed")
+		} else if cfg.httpURL.Scheme != "http" {
+			return nil, cc, opts, errors.New("secure_boot without secure_boot_grub_config requires an http:// http_url, since GRUB cannot fetch HTTPS URLs")
+		}
+		cfg.secureBoot = sb
+		log.Infof("booting nodes matching %v with Secure Boot using shims %v", sb.nodes, opts.secureBootShims)
+	}
+
+	// Lease provisional addresses to clients not in SMD, if enabled
+	if opts.discoveryStart != nil {
+		log.Infof("leasing provisional addresses %s-%s to clients not in SMD for %s", opts.discoveryStart, opts.discoveryEnd, opts.discoveryLease)
+		cfg.discoveryPool = newProvisionalPool(opts.discoveryStart, opts.discoveryEnd, opts.discoveryLease)
+	}
+
+	return cfg, cc, opts, nil
+}
+
+// configureClient applies the SMD client settings in opts to c, trusting the
+// CA certificate at caCertPath, if set: retries, circuit breaker, HTTP, TLS,
+// and credentials. They are shared by the clients of SMD and of BSS.
+func configureClient(c *HTTPSmdClient, caCertPath string, opts options) error {
+	c.MaxRetries = opts.smdRetries
+	c.RetryBackoff = opts.smdRetryBackoff
+	c.SetHTTPConfig(opts.smdHTTP)
+	c.SetCircuitBreaker(opts.smdBreakerThreshold, opts.smdBreakerCooldown)
+
+	tc := opts.smdTLS
+	tc.CACertFile = caCertPath
+	if err := c.SetTLSConfig(tc); err != nil {
+		return fmt.Errorf("failed to set CA certificate: %w", err)
+	}
+	if opts.smdClientCert != "" {
+		if err := c.UseClientCert(opts.smdClientCert, opts.smdClientKey); err != nil {
+			return fmt.Errorf("failed to set client certificate: %w", err)
+		}
+	}
+	if opts.smdTokenFile != "" {
+		if err := c.UseTokenFile(opts.smdTokenFile); err != nil {
+			return fmt.Errorf("failed to set token: %w", err)
+		}
+	}
+
+	return nil
+}
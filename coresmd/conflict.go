@@ -0,0 +1,125 @@
+package coresmd
+
+import (
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// maxConflicts is how many conflicted addresses are remembered at most. Once
+// reached, the address declined longest ago is forgotten to make room.
+const maxConflicts = 4096
+
+// conflicts holds the addresses that clients have declined. It is shared by all
+// plugin instances since conflicts are a property of the network.
+var conflicts = newConflictTracker()
+
+// conflict records a client declining an address, meaning something else on
+// the network already uses it.
+type conflict struct {
+	IP        string    `json:"ip"`
+	MAC       string    `json:"mac"`
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// conflictTracker records conflicted addresses for sharedConflictTTL after
+// they were last declined, like the shared backend, keeping at most
+// maxConflicts. It is safe for concurrent use.
+type conflictTracker struct {
+	mu        sync.RWMutex
+	conflicts map[string]conflict
+}
+
+func newConflictTracker() *conflictTracker {
+	return &conflictTracker{conflicts: make(map[string]conflict)}
+}
+
+// mark records that mac found ip to be in use by something else.
+func (ct *conflictTracker) mark(ip, mac string) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+
+	now := time.Now()
+	c, ok := ct.conflicts[ip]
+	if !ok || c.expired(now) {
+		if len(ct.conflicts) >= maxConflicts {
+			ct.evict(now)
+		}
+		c = conflict{IP: ip, FirstSeen: now}
+	}
+	c.MAC = mac
+	c.Count++
+	c.LastSeen = now
+	ct.conflicts[ip] = c
+	metricConflicts.Set(float64(len(ct.conflicts)))
+}
+
+// evict forgets the expired conflicts, or the one declined longest ago if none
+// has expired. ct.mu must be held.
+func (ct *conflictTracker) evict(now time.Time) {
+	var oldest string
+	for ip, c := range ct.conflicts {
+		if c.expired(now) {
+			delete(ct.conflicts, ip)
+		} else if oldest == "" || c.LastSeen.Before(ct.conflicts[oldest].LastSeen) {
+			oldest = ip
+		}
+	}
+	if len(ct.conflicts) >= maxConflicts {
+		delete(ct.conflicts, oldest)
+	}
+}
+
+// get returns the conflict recorded for ip, if any.
+func (ct *conflictTracker) get(ip string) (conflict, bool) {
+	ct.mu.RLock()
+	defer ct.mu.RUnlock()
+	c, ok := ct.conflicts[ip]
+	if !ok || c.expired(time.Now()) {
+		return conflict{}, false
+	}
+	return c, true
+}
+
+// expired reports whether c is forgotten at now.
+func (c conflict) expired(now time.Time) bool {
+	return now.Sub(c.LastSeen) >= sharedConflictTTL
+}
+
+// handleDecline handles a DHCPDECLINE, which a client sends after finding that
+// the address it was assigned is already in use. No response is sent.
+func (p *PluginState) handleDecline(req *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	metricDeclines.Inc()
+	ip := req.RequestedIPAddress()
+	if ip == nil {
+		log.Warnf("%s sent %s without a requested IP address", clientKey(req), dhcpv4.MessageTypeDecline)
+		return nil, true
+	}
+	// Only the client an address was handed out to can report it in use,
+	// so that clients cannot take addresses out of service at will
+	mac := clientKey(req)
+	if held := p.leases.heldIP(mac, time.Now()); !ip.Equal(held) {
+		log.Warnf("ignoring %s of %s from %s, which was not offered or leased it", dhcpv4.MessageTypeDecline, ip, mac)
+		return nil, true
+	}
+	p.markConflict(ip.String(), mac)
+	log.Errorf("address conflict: %s declined %s (message: %q); the address is likely in use by a device not matching SMD", mac, ip, req.Message())
+
+	return nil, true
+}
+
+// handleRelease handles a DHCPRELEASE. Since addresses are assigned by SMD,
+// there is nothing to free unless the address came from the discovery pool. No
+// response is sent.
+func (cfg *pluginConfig) handleRelease(req *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
+	metricReleases.Inc()
+	log.Infof("%s released %s", clientKey(req), req.ClientIPAddr)
+	if cfg.discoveryPool != nil {
+		cfg.discoveryPool.release(clientKey(req))
+	}
+
+	return nil, true
+}
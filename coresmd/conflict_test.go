@@ -0,0 +1,78 @@
+package coresmd
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestConflictTrackerExpiry(t *testing.T) {
+	ct := newConflictTracker()
+	ct.mark("172.16.0.1", "aa:bb:cc:dd:ee:01")
+	if _, ok := ct.get("172.16.0.1"); !ok {
+		t.Fatal("conflict not recorded")
+	}
+
+	c := ct.conflicts["172.16.0.1"]
+	c.LastSeen = time.Now().Add(-sharedConflictTTL)
+	ct.conflicts["172.16.0.1"] = c
+	if _, ok := ct.get("172.16.0.1"); ok {
+		t.Error("conflict still recorded after sharedConflictTTL")
+	}
+
+	// Declining an expired conflict again starts it over
+	ct.mark("172.16.0.1", "aa:bb:cc:dd:ee:01")
+	if c, _ := ct.get("172.16.0.1"); c.Count != 1 {
+		t.Errorf("count after expiry is %d, want 1", c.Count)
+	}
+}
+
+func TestConflictTrackerCap(t *testing.T) {
+	ct := newConflictTracker()
+	for i := 0; i < maxConflicts; i++ {
+		ct.mark(fmt.Sprintf("10.0.%d.%d", i>>8&0xff, i&0xff), "aa:bb:cc:dd:ee:01")
+	}
+	c := ct.conflicts["10.0.0.0"]
+	c.LastSeen = c.LastSeen.Add(-time.Hour)
+	ct.conflicts["10.0.0.0"] = c
+	ct.mark("10.1.0.0", "aa:bb:cc:dd:ee:01")
+	if n := len(ct.conflicts); n != maxConflicts {
+		t.Errorf("tracking %d conflicts, want %d", n, maxConflicts)
+	}
+	if _, ok := ct.get("10.0.0.0"); ok {
+		t.Error("oldest conflict was not evicted")
+	}
+	if _, ok := ct.get("10.1.0.0"); !ok {
+		t.Error("newest conflict was evicted")
+	}
+}
+
+func TestHandleDeclineUnassigned(t *testing.T) {
+	p := setupHandler(t)
+	lt, err := newLeaseTracker("")
+	if err != nil {
+		t.Fatalf("newLeaseTracker: %v", err)
+	}
+	p.leases = lt
+	now := time.Now()
+	req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01")
+	lt.record(req, answer(resp, "172.16.7.1"), time.Minute, now)
+
+	// Another client cannot take the address out of service
+	req, _ = newRequest(t, dhcpv4.MessageTypeDecline, "aa:bb:cc:dd:ee:02",
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.ParseIP("172.16.7.1"))))
+	p.handleDecline(req)
+	if _, ok := p.conflictFor("172.16.7.1"); ok {
+		t.Error("address marked conflicted by a client it was not offered to")
+	}
+
+	req, _ = newRequest(t, dhcpv4.MessageTypeDecline, "aa:bb:cc:dd:ee:01",
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.ParseIP("172.16.7.1"))))
+	p.handleDecline(req)
+	if c, ok := p.conflictFor("172.16.7.1"); !ok || c.MAC != "aa:bb:cc:dd:ee:01" {
+		t.Errorf("conflictFor = %+v, %t; want conflict declined by aa:bb:cc:dd:ee:01", c, ok)
+	}
+}
@@ -0,0 +1,162 @@
+package coresmd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenCHAMI/coresmd/internal/debug"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// defaultDiscoveryLease is the lease duration given to clients from the
+// discovery pool if none is configured.
+const defaultDiscoveryLease = 5 * time.Minute
+
+// provisionalLease is an address leased to a client from the discovery pool.
+type provisionalLease struct {
+	ip      net.IP
+	expires time.Time
+}
+
+// provisionalPool hands out short leases on addresses from a range to clients
+// not found in SMD, so that they get on the network and check in again soon
+// after they have been added to SMD. It is safe for concurrent use.
+type provisionalPool struct {
+	start, end uint32
+	lease      time.Duration
+
+	mu     sync.Mutex
+	leases map[string]provisionalLease // keyed by MAC address
+	byIP   map[uint32]string
+}
+
+func newProvisionalPool(start, end net.IP, lease time.Duration) *provisionalPool {
+	return &provisionalPool{
+		start:  binary.BigEndian.Uint32(start.To4()),
+		end:    binary.BigEndian.Uint32(end.To4()),
+		lease:  lease,
+		leases: make(map[string]provisionalLease),
+		byIP:   make(map[uint32]string),
+	}
+}
+
+// allocate returns the address leased to mac, leasing it a free address from
+// the pool if it has none. Addresses assigned in snapshot are never leased so
+// that they are not handed out from under their owners.
+func (p *provisionalPool) allocate(snapshot *Snapshot, mac string) (net.IP, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := time.Now()
+	if l, ok := p.leases[mac]; ok {
+		l.expires = now.Add(p.lease)
+		p.leases[mac] = l
+		return l.ip, nil
+	}
+
+	for n := p.start; n <= p.end && n >= p.start; n++ {
+		ip := make(net.IP, net.IPv4len)
+		binary.BigEndian.PutUint32(ip, n)
+		if _, ok := snapshot.IPAddresses[ip.String()]; ok {
+			continue
+		}
+		if owner, ok := p.byIP[n]; ok {
+			if p.leases[owner].expires.After(now) {
+				continue
+			}
+			// Reclaim expired lease
+			delete(p.leases, owner)
+		}
+		p.leases[mac] = provisionalLease{ip: ip, expires: now.Add(p.lease)}
+		p.byIP[n] = mac
+		metricProvisionalLeases.Set(float64(len(p.leases)))
+		return ip, nil
+	}
+
+	return nil, errors.New("discovery pool is exhausted")
+}
+
+// sameAs reports whether p and other lease the same range for the same
+// duration.
+func (p *provisionalPool) sameAs(other *provisionalPool) bool {
+	return p.start == other.start && p.end == other.end && p.lease == other.lease
+}
+
+// release frees the address leased to mac, if any.
+func (p *provisionalPool) release(mac string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	l, ok := p.leases[mac]
+	if !ok {
+		return
+	}
+	delete(p.byIP, binary.BigEndian.Uint32(l.ip))
+	delete(p.leases, mac)
+	metricProvisionalLeases.Set(float64(len(p.leases)))
+}
+
+// handleProvisional responds to a client not found in SMD with a provisional
+// address from the discovery pool. Provisional responses carry a short lease
+// and no hostname or boot file, so the client only gets on the network until
+// it is added to SMD. Once it is, its next request for the provisional address
+// is refused according to requested_ip_mismatch and it moves to its
+// SMD-assigned address.
+func (cfg *pluginConfig) handleProvisional(req, resp *dhcpv4.DHCPv4, snapshot *Snapshot, mac string, tr *trace) (*dhcpv4.DHCPv4, bool) {
+	ip, err := cfg.discoveryPool.allocate(snapshot, mac)
+	if err != nil {
+		log.Errorf("unable to give provisional address to %s: %v", mac, err)
+		tr.add("discovery", "none", "coresmd", err.Error())
+		return resp, false
+	}
+
+	if req.MessageType() == dhcpv4.MessageTypeRequest {
+		if reqIP := requestedIP(req); reqIP != nil && !reqIP.Equal(ip) {
+			log.Warnf("%s requested %s but holds provisional address %s", mac, reqIP, ip)
+			tr.add("requested_ip", reqIP.String(), "client", fmt.Sprintf("does not match provisional address %s", ip))
+			nak, err := newNak(req, resp, fmt.Sprintf("requested address %s is not leased to this client", reqIP))
+			if err != nil {
+				log.Errorf("failed to NAK mismatched request: %v", err)
+				return resp, true
+			}
+			debug.DebugResponse(log, nak)
+			return nak, true
+		}
+	}
+
+	resp.YourIPAddr = ip
+	lp := leasePolicy{lease: cfg.discoveryPool.lease, renewal: cfg.discoveryPool.lease / 2}
+	lp.apply(resp)
+	log.Infof("assigning provisional address %s to %s, which is not in SMD, with %s", ip, mac, lp)
+	tr.add("discovery", ip.String(), "coresmd", "client not found in SMD, leased provisional address from discovery pool")
+	tr.add("lease_time", lp.String(), "coresmd", "discovery pool")
+	debug.DebugResponse(log, resp)
+
+	return resp, true
+}
+
+// parseIPRange parses an inclusive <start>-<end> range of IPv4 addresses.
+func parseIPRange(val string) (net.IP, net.IP, error) {
+	startStr, endStr, ok := strings.Cut(val, "-")
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid range %q: expected <start>-<end>", val)
+	}
+	start := net.ParseIP(startStr).To4()
+	if start == nil {
+		return nil, nil, fmt.Errorf("invalid IPv4 address %q", startStr)
+	}
+	end := net.ParseIP(endStr).To4()
+	if end == nil {
+		return nil, nil, fmt.Errorf("invalid IPv4 address %q", endStr)
+	}
+	if binary.BigEndian.Uint32(start) > binary.BigEndian.Uint32(end) {
+		return nil, nil, fmt.Errorf("invalid range %q: start is after end", val)
+	}
+
+	return start, end, nil
+}
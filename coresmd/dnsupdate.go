@@ -0,0 +1,282 @@
+package coresmd
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/miekg/dns"
+)
+
+// defaultDNSUpdateTimeout is how long a DNS server may take to answer an
+// update.
+const defaultDNSUpdateTimeout = 5 * time.Second
+
+// dnsUpdateQueueSize is how many DNS updates may wait to be sent before new
+// ones are dropped.
+const dnsUpdateQueueSize = 1024
+
+// tsigFudge is the clock skew allowed between us and the server, in seconds.
+const tsigFudge = 300
+
+// tsigAlgorithms maps the supported TSIG algorithms to their names in package
+// dns.
+var tsigAlgorithms = map[string]string{
+	"hmac-sha1":   dns.HmacSHA1,
+	"hmac-sha256": dns.HmacSHA256,
+	"hmac-sha512": dns.HmacSHA512,
+}
+
+// tsigKey is a shared secret to sign DNS updates with (RFC 8945).
+type tsigKey struct {
+	// name and algorithm are fully qualified, as package dns expects them
+	name      string
+	algorithm string
+	// secret is base64-encoded
+	secret string
+}
+
+// parseTSIGKey parses a TSIG key given as <algorithm>:<name>:<base64 secret>,
+// e.g. as generated by tsig-keygen.
+func parseTSIGKey(val string) (*tsigKey, error) {
+	parts := strings.SplitN(val, ":", 3)
+	if len(parts) != 3 {
+		return nil, errors.New("expected <algorithm>:<name>:<secret>")
+	}
+	alg, ok := tsigAlgorithms[strings.ToLower(parts[0])]
+	if !ok {
+		return nil, fmt.Errorf("unsupported algorithm %q (expected hmac-sha1, hmac-sha256, or hmac-sha512)", parts[0])
+	}
+	name := canonicalName(parts[1])
+	if !validName(name) {
+		return nil, fmt.Errorf("invalid key name %q", parts[1])
+	}
+	if _, err := base64.StdEncoding.DecodeString(parts[2]); err != nil {
+		return nil, fmt.Errorf("invalid secret: %w", err)
+	}
+
+	return &tsigKey{name: dns.Fqdn(name), algorithm: alg, secret: parts[2]}, nil
+}
+
+// dnsUpdateConfig holds where and how the addresses assigned to clients are
+// published in DNS.
+type dnsUpdateConfig struct {
+	// server is the address of the primary server of the zones
+	server string
+	// zone is the forward zone that hostnames are published in, and
+	// reverseZones the reverse zones that addresses are, or nil to use the
+	// /24 zone of each address
+	zone         string
+	reverseZones []string
+	// ttl is the TTL of the records, or 0 to use the lease time
+	ttl time.Duration
+	// key signs the updates, or is nil to send them unsigned
+	key     *tsigKey
+	timeout time.Duration
+}
+
+// canonicalName returns name in lowercase without a trailing dot.
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// validName reports whether name, as returned by canonicalName, is a valid
+// DNS name other than the root.
+func validName(name string) bool {
+	_, ok := dns.IsDomainName(name)
+	return ok && name != ""
+}
+
+// fqdn returns the name hostname is published under.
+func (c *dnsUpdateConfig) fqdn(hostname string) string {
+	hostname = canonicalName(hostname)
+	if hostname == c.zone || strings.HasSuffix(hostname, "."+c.zone) {
+		return hostname
+	}
+	return hostname + "." + c.zone
+}
+
+// reverseName returns the name in in-addr.arpa that ip is published under.
+func reverseName(ip net.IP) string {
+	name, _ := dns.ReverseAddr(ip.String())
+	return canonicalName(name)
+}
+
+// reverseZoneFor returns the reverse zone name belongs in: the longest of
+// reverseZones that contains it or, if reverseZones is not set, the /24 zone of
+// the address. It returns "" if none contains it.
+func (c *dnsUpdateConfig) reverseZoneFor(name string) string {
+	if c.reverseZones == nil {
+		_, zone, _ := strings.Cut(name, ".")
+		return zone
+	}
+	var best string
+	for _, zone := range c.reverseZones {
+		if strings.HasSuffix(name, "."+zone) && len(zone) > len(best) {
+			best = zone
+		}
+	}
+	return best
+}
+
+// send replaces the records of rr's name and type in zone with rr, with no
+// prerequisites since SMD is the source of truth. The update is signed if a
+// key is set, and sent over TCP if the response over UDP is truncated. It
+// returns an error if the server does not apply it.
+func (c *dnsUpdateConfig) send(zone string, rr dns.RR) error {
+	m := new(dns.Msg)
+	m.SetUpdate(dns.Fqdn(zone))
+	m.RemoveRRset([]dns.RR{rr})
+	m.Insert([]dns.RR{rr})
+
+	client := &dns.Client{Timeout: c.timeout}
+	if c.key != nil {
+		client.TsigSecret = map[string]string{c.key.name: c.key.secret}
+		m.SetTsig(c.key.name, c.key.algorithm, tsigFudge, time.Now().Unix())
+	}
+	resp, _, err := client.Exchange(m, c.server)
+	if err == nil && resp.Truncated {
+		client.Net = "tcp"
+		resp, _, err = client.Exchange(m, c.server)
+	}
+	// Refusals are not signed if the server could not verify the update
+	if resp != nil && resp.Rcode != dns.RcodeSuccess {
+		name, ok := dns.RcodeToString[resp.Rcode]
+		if !ok {
+			name = fmt.Sprintf("rcode %d", resp.Rcode)
+		}
+		return fmt.Errorf("update of zone %s refused: %s", zone, name)
+	}
+	if err != nil {
+		return fmt.Errorf("update of zone %s: %w", zone, err)
+	}
+	// Package dns only verifies responses that are signed
+	if c.key != nil && resp.IsTsig() == nil {
+		return fmt.Errorf("update of zone %s: response is not signed", zone)
+	}
+
+	return nil
+}
+
+// update points the A record of hostname at ip, and the PTR record of ip at
+// hostname if a reverse zone contains it, replacing any previous records.
+func (c *dnsUpdateConfig) update(hostname string, ip net.IP, ttl uint32) error {
+	fqdn := c.fqdn(hostname)
+	if err := c.send(c.zone, &dns.A{
+		Hdr: dns.RR_Header{Name: dns.Fqdn(fqdn), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: ttl},
+		A:   ip.To4(),
+	}); err != nil {
+		return err
+	}
+
+	rname := reverseName(ip)
+	zone := c.reverseZoneFor(rname)
+	if zone == "" {
+		log.Debugf("no reverse zone for %s, not updating its PTR record", ip)
+		return nil
+	}
+	return c.send(zone, &dns.PTR{
+		Hdr: dns.RR_Header{Name: dns.Fqdn(rname), Rrtype: dns.TypePTR, Class: dns.ClassINET, Ttl: ttl},
+		Ptr: dns.Fqdn(fqdn),
+	})
+}
+
+// dnsUpdate is an assignment to publish in DNS.
+type dnsUpdate struct {
+	cfg      *dnsUpdateConfig
+	hostname string
+	ip       net.IP
+	ttl      uint32
+}
+
+// dnsUpdater publishes the addresses leased to clients in DNS in the
+// background, so that answering clients never waits on the DNS server. An
+// assignment is only sent again once it changes, or if sending it failed. It is
+// safe for concurrent use.
+type dnsUpdater struct {
+	queue chan dnsUpdate
+	// published maps the names updated to the addresses they point at
+	published sync.Map
+}
+
+func newDNSUpdater() *dnsUpdater {
+	return &dnsUpdater{queue: make(chan dnsUpdate, dnsUpdateQueueSize)}
+}
+
+// publish queues an update for the hostname and address acknowledged in resp,
+// as set in cfg. A nil updater or cfg does nothing.
+func (u *dnsUpdater) publish(cfg *dnsUpdateConfig, resp *dhcpv4.DHCPv4) {
+	if u == nil || cfg == nil || resp.MessageType() != dhcpv4.MessageTypeAck {
+		return
+	}
+	hostname := resp.HostName()
+	ip := resp.YourIPAddr.To4()
+	if hostname == "" || ip == nil || ip.IsUnspecified() {
+		return
+	}
+	if prev, ok := u.published.Load(cfg.fqdn(hostname)); ok && prev.(string) == ip.String() {
+		return
+	}
+	ttl := cfg.ttl
+	if ttl == 0 {
+		ttl = resp.IPAddressLeaseTime(0)
+	}
+
+	select {
+	case u.queue <- dnsUpdate{cfg: cfg, hostname: hostname, ip: ip, ttl: uint32(ttl.Seconds())}:
+	default:
+		metricDNSUpdates.Inc("dropped")
+		log.Warnf("DNS update queue is full, not publishing %s at %s", hostname, ip)
+	}
+}
+
+// forget drops the published names whose address is no longer in snapshot, or
+// belongs to an interface that d reports added, removed, or changed, so that
+// they are published again when next leased. A nil updater does nothing.
+func (u *dnsUpdater) forget(snapshot *Snapshot, d SnapshotDiff) {
+	if u == nil {
+		return
+	}
+	stale := make(map[string]bool, len(d.Added)+len(d.Removed)+len(d.Changed))
+	for _, macs := range [][]string{d.Added, d.Removed, d.Changed} {
+		for _, mac := range macs {
+			stale[mac] = true
+		}
+	}
+	u.published.Range(func(name, ip any) bool {
+		if mac, ok := snapshot.IPAddresses[ip.(string)]; !ok || stale[mac] {
+			log.Debugf("inventory of %s at %s changed, publishing it again when next leased", name, ip)
+			u.published.Delete(name)
+		}
+		return true
+	})
+}
+
+// run sends queued updates until ctx is done.
+func (u *dnsUpdater) run(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case upd := <-u.queue:
+			fqdn := upd.cfg.fqdn(upd.hostname)
+			if prev, ok := u.published.Load(fqdn); ok && prev.(string) == upd.ip.String() {
+				continue
+			}
+			if err := upd.cfg.update(upd.hostname, upd.ip, upd.ttl); err != nil {
+				metricDNSUpdates.Inc("failure")
+				log.Errorf("failed to publish %s at %s in DNS: %v", fqdn, upd.ip, err)
+				continue
+			}
+			metricDNSUpdates.Inc("success")
+			log.Infof("published %s at %s in DNS", fqdn, upd.ip)
+			u.published.Store(fqdn, upd.ip.String())
+		}
+	}
+}
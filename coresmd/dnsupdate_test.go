@@ -0,0 +1,219 @@
+package coresmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/miekg/dns"
+)
+
+// fakeDNSServer accepts DNS updates over UDP, recording the records in them,
+// and refuses updates not signed with key, if set.
+type fakeDNSServer struct {
+	addr string
+
+	mu      sync.Mutex
+	updates []string
+}
+
+func startFakeDNSServer(t *testing.T, key *tsigKey) *fakeDNSServer {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeDNSServer{addr: conn.LocalAddr().String()}
+
+	started := make(chan struct{})
+	srv := &dns.Server{
+		PacketConn:        conn,
+		Handler:           dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) { s.handle(w, r, key) }),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	if key != nil {
+		srv.TsigSecret = map[string]string{key.name: key.secret}
+	}
+	go srv.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { srv.Shutdown() })
+
+	return s
+}
+
+// handle records the update r and answers it.
+func (s *fakeDNSServer) handle(w dns.ResponseWriter, r *dns.Msg, key *tsigKey) {
+	resp := new(dns.Msg)
+	resp.SetReply(r)
+	if key != nil {
+		if r.IsTsig() == nil || w.TsigStatus() != nil {
+			resp.Rcode = dns.RcodeNotAuth
+			w.WriteMsg(resp)
+			return
+		}
+		resp.SetTsig(key.name, key.algorithm, tsigFudge, time.Now().Unix())
+	}
+
+	zone := canonicalName(r.Question[0].Name)
+	s.mu.Lock()
+	for _, rr := range r.Ns {
+		h := rr.Header()
+		update := fmt.Sprintf("%s: %s %d", zone, canonicalName(h.Name), h.Rrtype)
+		switch rr := rr.(type) {
+		case *dns.A:
+			update += fmt.Sprintf(" %d %s", h.Ttl, rr.A)
+		case *dns.PTR:
+			update += fmt.Sprintf(" %d %s", h.Ttl, canonicalName(rr.Ptr))
+		default:
+			if h.Class == dns.ClassANY {
+				update += " delete"
+			}
+		}
+		s.updates = append(s.updates, update)
+	}
+	s.mu.Unlock()
+	w.WriteMsg(resp)
+}
+
+// received returns the updates received so far.
+func (s *fakeDNSServer) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.updates...)
+}
+
+func TestParseTSIGKey(t *testing.T) {
+	key, err := parseTSIGKey("HMAC-SHA256:coresmd.:c2VjcmV0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.name != "coresmd." || key.algorithm != dns.HmacSHA256 || key.secret != "c2VjcmV0" {
+		t.Errorf("got %+v", key)
+	}
+	for _, val := range []string{"hmac-md5:coresmd:c2VjcmV0", "hmac-sha256:coresmd", "hmac-sha256:coresmd:!!"} {
+		if _, err := parseTSIGKey(val); err == nil {
+			t.Errorf("%q accepted", val)
+		}
+	}
+}
+
+func TestDNSUpdate(t *testing.T) {
+	key, _ := parseTSIGKey("hmac-sha256:coresmd:c2VjcmV0")
+	srv := startFakeDNSServer(t, key)
+	cfg := &dnsUpdateConfig{server: srv.addr, zone: "cluster.local", key: key, timeout: time.Second}
+
+	if err := cfg.update("nid0001", net.IPv4(172, 16, 0, 1), 3600); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"cluster.local: nid0001.cluster.local 1 delete",
+		"cluster.local: nid0001.cluster.local 1 3600 172.16.0.1",
+		"0.16.172.in-addr.arpa: 1.0.16.172.in-addr.arpa 12 delete",
+		"0.16.172.in-addr.arpa: 1.0.16.172.in-addr.arpa 12 3600 nid0001.cluster.local",
+	}
+	if got := srv.received(); !reflect.DeepEqual(got, want) {
+		t.Errorf("got updates %q, want %q", got, want)
+	}
+
+	// Addresses outside the reverse zones only get an A record
+	cfg.reverseZones = []string{"10.in-addr.arpa"}
+	if err := cfg.update("nid0002.cluster.local", net.IPv4(172, 16, 0, 2), 60); err != nil {
+		t.Fatal(err)
+	}
+	if got := srv.received(); len(got) != 6 || got[5] != "cluster.local: nid0002.cluster.local 1 60 172.16.0.2" {
+		t.Errorf("got updates %q", got)
+	}
+
+	// Updates signed with the wrong key are refused
+	cfg.key, _ = parseTSIGKey("hmac-sha256:coresmd:d3Jvbmc=")
+	if err := cfg.update("nid0001", net.IPv4(172, 16, 0, 1), 3600); err == nil || !strings.Contains(err.Error(), "NOTAUTH") {
+		t.Errorf("got error %v, want NOTAUTH", err)
+	}
+}
+
+func TestHandler4DNSUpdate(t *testing.T) {
+	srv := startFakeDNSServer(t, nil)
+	p := setupHandler(t)
+	cfg := *p.config.Load()
+	cfg.dnsUpdate = &dnsUpdateConfig{server: srv.addr, zone: "cluster.local", timeout: time.Second}
+	p.config.Store(&cfg)
+	p.dnsUpdates = newDNSUpdater()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.dnsUpdates.run(ctx)
+
+	waitFor := func(n int) []string {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			got := srv.received()
+			if len(got) >= n || time.Now().After(deadline) {
+				return got
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// Offers are not published
+	req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01")
+	p.Handler4(req, resp)
+	req, resp = newRequest(t, dhcpv4.MessageTypeRequest, "aa:bb:cc:dd:ee:01")
+	p.Handler4(req, resp)
+	if got := waitFor(4); len(got) != 4 || got[1] != "cluster.local: nid0001.cluster.local 1 3600 172.16.0.1" {
+		t.Fatalf("got updates %q", got)
+	}
+
+	// Renewals of the same address are not published again
+	req, resp = newRequest(t, dhcpv4.MessageTypeRequest, "aa:bb:cc:dd:ee:01")
+	p.Handler4(req, resp)
+	time.Sleep(50 * time.Millisecond)
+	if got := srv.received(); len(got) != 4 {
+		t.Errorf("got updates %q after renewal", got)
+	}
+
+	// Nodes leaving inventory and coming back are published again
+	p.dnsUpdates.forget(&Snapshot{}, SnapshotDiff{Removed: []string{"aa:bb:cc:dd:ee:01"}})
+	req, resp = newRequest(t, dhcpv4.MessageTypeRequest, "aa:bb:cc:dd:ee:01")
+	p.Handler4(req, resp)
+	if got := waitFor(8); len(got) != 8 {
+		t.Errorf("got updates %q after the node came back", got)
+	}
+}
+
+func TestDNSUpdaterForget(t *testing.T) {
+	u := newDNSUpdater()
+	u.published.Store("nid0001.cluster.local", "172.16.0.1")
+	u.published.Store("nid0002.cluster.local", "172.16.0.2")
+	u.published.Store("nid0003.cluster.local", "172.16.0.3")
+	u.published.Store("nid0004.cluster.local", "172.16.0.4")
+	snapshot := &Snapshot{IPAddresses: map[string]string{
+		"172.16.0.1": "aa:bb:cc:dd:ee:01",
+		"172.16.0.3": "aa:bb:cc:dd:ee:03",
+		"172.16.0.4": "aa:bb:cc:dd:ee:05",
+	}}
+
+	// nid0002 left inventory, nid0003 changed, and the address of nid0004
+	// now belongs to a new interface
+	u.forget(snapshot, SnapshotDiff{
+		Added:   []string{"aa:bb:cc:dd:ee:05"},
+		Removed: []string{"aa:bb:cc:dd:ee:02", "aa:bb:cc:dd:ee:04"},
+		Changed: []string{"aa:bb:cc:dd:ee:03"},
+	})
+	var got []string
+	u.published.Range(func(name, _ any) bool {
+		got = append(got, name.(string))
+		return true
+	})
+	if want := []string{"nid0001.cluster.local"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("published names are %q, want %q", got, want)
+	}
+
+	var nilUpdater *dnsUpdater
+	nilUpdater.forget(snapshot, SnapshotDiff{})
+}
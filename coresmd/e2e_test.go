@@ -0,0 +1,427 @@
+package coresmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+
+	"github.com/OpenCHAMI/coresmd/pkg/smdtest"
+)
+
+// The end-to-end tests set coresmd up from plugin arguments against a fake
+// SMD, send it DHCP packets encoded and decoded as on the wire, and check every
+// field and option of the reply, so that changes to what is sent cannot go
+// unnoticed.
+
+// Settings of the plugins before coresmd in the chain, as in
+// resources/config.example.yaml
+var (
+	e2eServerID = net.IPv4(172, 16, 0, 253).To4()
+	e2eNetmask  = net.IPv4Mask(255, 255, 255, 0)
+	e2eRouter   = net.IPv4(172, 16, 0, 254).To4()
+)
+
+// setupE2E starts a fake SMD holding a compute node with addresses on two
+// subnets and its BMC, and returns coresmd set up against it with the given
+// options and its cache refreshed.
+func setupE2E(t *testing.T, opts ...string) *PluginState {
+	t.Helper()
+
+	ei := func(mac, id string, ips ...string) EthernetInterface {
+		ei := EthernetInterface{MACAddress: mac, ComponentID: id}
+		for _, ip := range ips {
+			ei.IPAddresses = append(ei.IPAddresses, struct {
+				IPAddress string `json:"IPAddress"`
+			}{ip})
+		}
+		return ei
+	}
+	srv := smdtest.NewServer(
+		[]EthernetInterface{
+			ei("aa:bb:cc:dd:ee:01", "x3000c0s0b0n0", "172.16.0.1", "172.16.1.1"),
+			ei("aa:bb:cc:dd:ee:02", "x3000c0s0b0", "172.16.0.2"),
+		},
+		[]Component{
+			{ID: "x3000c0s0b0n0", NID: 1, Type: "Node", Role: "Compute"},
+			{ID: "x3000c0s0b0", Type: "NodeBMC"},
+		},
+	)
+	t.Cleanup(srv.Close)
+
+	args := append([]string{srv.URL, "http://172.16.0.253:8081", "", "1h", "1h", "smd_retries=0"}, opts...)
+	cfg, cc, o, err := loadConfig(args)
+	if err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+	c, err := NewCache(cc.interval.String(), cc.client)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+
+	p := &PluginState{cache: c, args: args, opts: o, lookupErrors: newLogThrottle()}
+	p.config.Store(cfg)
+	return p
+}
+
+// exchange sends req to p as CoreDHCP would after the server_id, netmask,
+// and router plugins, and returns the reply as the client decodes it, or nil
+// if p passed the request on.
+func exchange(t *testing.T, p *PluginState, req *dhcpv4.DHCPv4) *dhcpv4.DHCPv4 {
+	t.Helper()
+
+	req, err := dhcpv4.FromBytes(req.ToBytes())
+	if err != nil {
+		t.Fatalf("failed to decode request: %v", err)
+	}
+	resp, err := dhcpv4.NewReplyFromRequest(req,
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(e2eServerID)),
+		dhcpv4.WithNetmask(e2eNetmask),
+		dhcpv4.WithRouter(e2eRouter),
+	)
+	if err != nil {
+		t.Fatalf("NewReplyFromRequest: %v", err)
+	}
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDiscover:
+		resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer))
+	case dhcpv4.MessageTypeRequest:
+		resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
+	}
+	// Other message types are passed through without a message type, as
+	// by a CoreDHCP that lets them reach plugins
+
+	out, stop := p.Handler4(req, resp)
+	if !stop {
+		return nil
+	}
+	if out == nil {
+		t.Fatal("request dropped")
+	}
+	reply, err := dhcpv4.FromBytes(out.ToBytes())
+	if err != nil {
+		t.Fatalf("failed to decode reply: %v", err)
+	}
+	return reply
+}
+
+// pxeRequest returns a request like those of a PXE ROM of architecture arch.
+func pxeRequest(t *testing.T, mt dhcpv4.MessageType, mac string, arch iana.Arch, modifiers ...dhcpv4.Modifier) *dhcpv4.DHCPv4 {
+	t.Helper()
+
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		t.Fatalf("ParseMAC: %v", err)
+	}
+	modifiers = append([]dhcpv4.Modifier{
+		dhcpv4.WithMessageType(mt),
+		dhcpv4.WithHwAddr(hw),
+		dhcpv4.WithBroadcast(true),
+		dhcpv4.WithRequestedOptions(dhcpv4.OptionSubnetMask, dhcpv4.OptionRouter, dhcpv4.OptionHostName,
+			dhcpv4.OptionBootfileName, dhcpv4.OptionTFTPServerName, dhcpv4.OptionVendorSpecificInformation),
+		dhcpv4.WithOption(dhcpv4.OptMaxMessageSize(1464)),
+		dhcpv4.WithOption(dhcpv4.OptClientArch(arch)),
+		dhcpv4.WithGeneric(dhcpv4.OptionClientNetworkInterfaceIdentifier, []byte{1, 3, 16}),
+		dhcpv4.WithOption(dhcpv4.OptClassIdentifier(fmt.Sprintf("PXEClient:Arch:%05d:UNDI:003016", arch))),
+	}, modifiers...)
+	req, err := dhcpv4.New(modifiers...)
+	if err != nil {
+		t.Fatalf("dhcpv4.New: %v", err)
+	}
+	return req
+}
+
+// relayed makes a request look relayed by the agent at giaddr.
+func relayed(giaddr net.IP) dhcpv4.Modifier {
+	return func(d *dhcpv4.DHCPv4) {
+		d.GatewayIPAddr = giaddr
+		d.HopCount = 1
+		d.UpdateOption(dhcpv4.OptRelayAgentInfo(dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte("eth1/1"))))
+	}
+}
+
+// optionsString lists opts one per line, sorted by code, for comparison.
+func optionsString(opts dhcpv4.Options) string {
+	var lines []string
+	for code, val := range opts {
+		lines = append(lines, fmt.Sprintf("%3d: %q", code, val))
+	}
+	slices.Sort(lines)
+	return strings.Join(lines, "\n")
+}
+
+func TestE2E(t *testing.T) {
+	leaseTime := dhcpv4.OptIPAddressLeaseTime(3600e9)
+	// The root path is siaddr, which is unset unless a TFTP server is set
+	rootPath := dhcpv4.OptRootPath("0.0.0.0")
+	relayInfo := dhcpv4.OptRelayAgentInfo(dhcpv4.OptGeneric(dhcpv4.AgentCircuitIDSubOption, []byte("eth1/1")))
+
+	tests := []struct {
+		name string
+		opts []string
+		req  func(t *testing.T) *dhcpv4.DHCPv4
+
+		wantUnicast bool
+		wantCIAddr  string
+		wantYIAddr  string
+		wantSIAddr  string
+		wantGIAddr  string
+		wantFile    string
+		wantSName   string
+		wantOpts    []dhcpv4.Option
+	}{
+		{
+			name: "PXE stage 1 UEFI discover",
+			req: func(t *testing.T) *dhcpv4.DHCPv4 {
+				return pxeRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", iana.EFI_X86_64)
+			},
+			wantYIAddr: "172.16.0.1",
+			wantOpts: []dhcpv4.Option{
+				dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer),
+				dhcpv4.OptServerIdentifier(e2eServerID),
+				dhcpv4.OptSubnetMask(e2eNetmask),
+				dhcpv4.OptRouter(e2eRouter),
+				leaseTime,
+				dhcpv4.OptHostName("nid0001"),
+				rootPath,
+				dhcpv4.OptBootFileName("ipxe-x86_64.efi"),
+			},
+		},
+		{
+			name: "PXE stage 1 legacy BIOS request with TFTP server",
+			opts: []string{"tftp_server=172.16.0.250"},
+			req: func(t *testing.T) *dhcpv4.DHCPv4 {
+				return pxeRequest(t, dhcpv4.MessageTypeRequest, "aa:bb:cc:dd:ee:01", iana.INTEL_X86PC,
+					dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(172, 16, 0, 1))),
+					dhcpv4.WithOption(dhcpv4.OptServerIdentifier(e2eServerID)))
+			},
+			wantYIAddr: "172.16.0.1",
+			wantSIAddr: "172.16.0.250",
+			wantOpts: []dhcpv4.Option{
+				dhcpv4.OptMessageType(dhcpv4.MessageTypeAck),
+				dhcpv4.OptServerIdentifier(e2eServerID),
+				dhcpv4.OptSubnetMask(e2eNetmask),
+				dhcpv4.OptRouter(e2eRouter),
+				leaseTime,
+				dhcpv4.OptHostName("nid0001"),
+				dhcpv4.OptRootPath("172.16.0.250"),
+				dhcpv4.OptTFTPServerName("172.16.0.250"),
+				dhcpv4.OptBootFileName("undionly.kpxe"),
+			},
+		},
+		{
+			name: "iPXE stage 2 discover",
+			req: func(t *testing.T) *dhcpv4.DHCPv4 {
+				return pxeRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", iana.EFI_X86_64,
+					dhcpv4.WithGeneric(dhcpv4.OptionUserClassInformation, []byte("iPXE")))
+			},
+			wantYIAddr: "172.16.0.1",
+			wantOpts: []dhcpv4.Option{
+				dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer),
+				dhcpv4.OptServerIdentifier(e2eServerID),
+				dhcpv4.OptSubnetMask(e2eNetmask),
+				dhcpv4.OptRouter(e2eRouter),
+				leaseTime,
+				dhcpv4.OptHostName("nid0001"),
+				rootPath,
+				dhcpv4.OptBootFileName("http://172.16.0.253:8081/boot/v1/bootscript?mac=aa:bb:cc:dd:ee:01"),
+			},
+		},
+		{
+			name: "BMC discover",
+			req: func(t *testing.T) *dhcpv4.DHCPv4 {
+				return pxeRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:02", iana.EFI_X86_64)
+			},
+			wantYIAddr: "172.16.0.2",
+			wantOpts: []dhcpv4.Option{
+				dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer),
+				dhcpv4.OptServerIdentifier(e2eServerID),
+				dhcpv4.OptSubnetMask(e2eNetmask),
+				dhcpv4.OptRouter(e2eRouter),
+				leaseTime,
+				rootPath,
+				dhcpv4.OptBootFileName("ipxe-x86_64.efi"),
+			},
+		},
+		{
+			name: "relayed discover gets address in relay subnet",
+			req: func(t *testing.T) *dhcpv4.DHCPv4 {
+				return pxeRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", iana.EFI_X86_64,
+					relayed(net.IPv4(172, 16, 1, 254).To4()))
+			},
+			wantYIAddr: "172.16.1.1",
+			wantGIAddr: "172.16.1.254",
+			wantOpts: []dhcpv4.Option{
+				dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer),
+				dhcpv4.OptServerIdentifier(e2eServerID),
+				dhcpv4.OptSubnetMask(e2eNetmask),
+				dhcpv4.OptRouter(e2eRouter),
+				relayInfo,
+				leaseTime,
+				dhcpv4.OptHostName("nid0001"),
+				rootPath,
+				dhcpv4.OptBootFileName("ipxe-x86_64.efi"),
+			},
+		},
+		{
+			name: "iPXE inform gets options without an address",
+			req: func(t *testing.T) *dhcpv4.DHCPv4 {
+				return pxeRequest(t, dhcpv4.MessageTypeInform, "aa:bb:cc:dd:ee:01", iana.EFI_X86_64,
+					dhcpv4.WithGeneric(dhcpv4.OptionUserClassInformation, []byte("iPXE")),
+					dhcpv4.WithClientIP(net.IPv4(172, 16, 0, 1)))
+			},
+			wantCIAddr: "172.16.0.1",
+			wantOpts: []dhcpv4.Option{
+				dhcpv4.OptMessageType(dhcpv4.MessageTypeAck),
+				dhcpv4.OptServerIdentifier(e2eServerID),
+				dhcpv4.OptSubnetMask(e2eNetmask),
+				dhcpv4.OptRouter(e2eRouter),
+				dhcpv4.OptHostName("nid0001"),
+				rootPath,
+				dhcpv4.OptBootFileName("http://172.16.0.253:8081/boot/v1/bootscript?mac=aa:bb:cc:dd:ee:01"),
+			},
+		},
+		{
+			name: "renewing request is answered unicast",
+			req: func(t *testing.T) *dhcpv4.DHCPv4 {
+				return pxeRequest(t, dhcpv4.MessageTypeRequest, "aa:bb:cc:dd:ee:01", iana.EFI_X86_64,
+					dhcpv4.WithBroadcast(false),
+					dhcpv4.WithClientIP(net.IPv4(172, 16, 0, 1)))
+			},
+			wantUnicast: true,
+			wantCIAddr:  "172.16.0.1",
+			wantYIAddr:  "172.16.0.1",
+			wantOpts: []dhcpv4.Option{
+				dhcpv4.OptMessageType(dhcpv4.MessageTypeAck),
+				dhcpv4.OptServerIdentifier(e2eServerID),
+				dhcpv4.OptSubnetMask(e2eNetmask),
+				dhcpv4.OptRouter(e2eRouter),
+				leaseTime,
+				dhcpv4.OptHostName("nid0001"),
+				rootPath,
+				dhcpv4.OptBootFileName("ipxe-x86_64.efi"),
+			},
+		},
+		{
+			name: "relayed NAK is broadcast by the relay",
+			req: func(t *testing.T) *dhcpv4.DHCPv4 {
+				return pxeRequest(t, dhcpv4.MessageTypeRequest, "aa:bb:cc:dd:ee:01", iana.EFI_X86_64,
+					dhcpv4.WithBroadcast(false),
+					dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(172, 16, 1, 9))),
+					relayed(net.IPv4(172, 16, 1, 254).To4()))
+			},
+			wantGIAddr: "172.16.1.254",
+			wantOpts: []dhcpv4.Option{
+				dhcpv4.OptMessageType(dhcpv4.MessageTypeNak),
+				dhcpv4.OptServerIdentifier(e2eServerID),
+				dhcpv4.OptMessage("requested address 172.16.1.9 is not assigned to this client"),
+				relayInfo,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := setupE2E(t, tt.opts...)
+			req := tt.req(t)
+			reply := exchange(t, p, req)
+			if reply == nil {
+				t.Fatal("request passed on to the next plugin")
+			}
+
+			if reply.OpCode != dhcpv4.OpcodeBootReply {
+				t.Errorf("op = %s, want BootReply", reply.OpCode)
+			}
+			if reply.TransactionID != req.TransactionID {
+				t.Errorf("xid = %s, want %s", reply.TransactionID, req.TransactionID)
+			}
+			if reply.ClientHWAddr.String() != req.ClientHWAddr.String() {
+				t.Errorf("chaddr = %s, want %s", reply.ClientHWAddr, req.ClientHWAddr)
+			}
+			if reply.IsBroadcast() == tt.wantUnicast {
+				t.Errorf("broadcast flag = %t, want %t", reply.IsBroadcast(), !tt.wantUnicast)
+			}
+			for field, got := range map[string]struct {
+				ip   net.IP
+				want string
+			}{
+				"ciaddr": {reply.ClientIPAddr, tt.wantCIAddr},
+				"yiaddr": {reply.YourIPAddr, tt.wantYIAddr},
+				"siaddr": {reply.ServerIPAddr, tt.wantSIAddr},
+				"giaddr": {reply.GatewayIPAddr, tt.wantGIAddr},
+			} {
+				want := got.want
+				if want == "" {
+					want = "0.0.0.0"
+				}
+				if got.ip.String() != want {
+					t.Errorf("%s = %s, want %s", field, got.ip, want)
+				}
+			}
+			if reply.BootFileName != tt.wantFile || reply.ServerHostName != tt.wantSName {
+				t.Errorf("file, sname = %q, %q; want %q, %q", reply.BootFileName, reply.ServerHostName, tt.wantFile, tt.wantSName)
+			}
+
+			want := dhcpv4.Options{}
+			for _, o := range tt.wantOpts {
+				want.Update(o)
+			}
+			if got, want := optionsString(reply.Options), optionsString(want); got != want {
+				t.Errorf("options:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+func TestE2EUnknownMAC(t *testing.T) {
+	p := setupE2E(t)
+
+	for _, mt := range []dhcpv4.MessageType{dhcpv4.MessageTypeDiscover, dhcpv4.MessageTypeRequest, dhcpv4.MessageTypeInform} {
+		if reply := exchange(t, p, pxeRequest(t, mt, "aa:bb:cc:dd:ee:99", iana.EFI_X86_64)); reply != nil {
+			t.Errorf("%s from unknown MAC answered with:\n%s", mt, reply.Summary())
+		}
+	}
+}
+
+func TestE2EServerID(t *testing.T) {
+	p := setupE2E(t, "server_id=172.16.0.252")
+	p.leases, _ = newLeaseTracker("")
+	ownID := net.IPv4(172, 16, 0, 252)
+
+	offer := exchange(t, p, pxeRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", iana.EFI_X86_64))
+	if sid := offer.ServerIdentifier(); !sid.Equal(ownID) {
+		t.Errorf("server identifier = %v, want %v", sid, ownID)
+	}
+
+	// A request accepting another server's offer, here the one set by the
+	// server_id plugin, is left to it
+	req := pxeRequest(t, dhcpv4.MessageTypeRequest, "aa:bb:cc:dd:ee:01", iana.EFI_X86_64,
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(172, 16, 0, 1))),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(e2eServerID)))
+	resp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithOption(dhcpv4.OptServerIdentifier(e2eServerID)))
+	if err != nil {
+		t.Fatalf("NewReplyFromRequest: %v", err)
+	}
+	if out, stop := p.Handler4(req, resp); out != nil || !stop {
+		t.Errorf("request to another server answered with:\n%s", out.Summary())
+	}
+	if ip := p.leases.heldIP("aa:bb:cc:dd:ee:01", time.Now()); ip != nil {
+		t.Errorf("%s still held for client that accepted another offer", ip)
+	}
+
+	req = pxeRequest(t, dhcpv4.MessageTypeRequest, "aa:bb:cc:dd:ee:01", iana.EFI_X86_64,
+		dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(172, 16, 0, 1))),
+		dhcpv4.WithOption(dhcpv4.OptServerIdentifier(ownID)))
+	if ack := exchange(t, p, req); ack.MessageType() != dhcpv4.MessageTypeAck {
+		t.Errorf("request to this server answered with %s, want %s", ack.MessageType(), dhcpv4.MessageTypeAck)
+	}
+}
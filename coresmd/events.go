@@ -0,0 +1,344 @@
+package coresmd
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OpenCHAMI/coresmd/internal/version"
+)
+
+const (
+	// defaultEventsSubject is the subject prefix boot events are published
+	// under if events_subject is not set.
+	defaultEventsSubject = "coresmd.boot"
+	// defaultNATSTimeout is how long connecting to the NATS server or
+	// publishing an event may take.
+	defaultNATSTimeout = 5 * time.Second
+	// eventsQueueSize is how many boot events may wait to be published
+	// before new ones are dropped.
+	eventsQueueSize = 1024
+	// natsReconnectDelay is how long to wait after failing to connect to the
+	// NATS server before trying again. Events are dropped in the meantime.
+	natsReconnectDelay = 10 * time.Second
+)
+
+// eventsConfig is where boot events are published: a NATS server and the
+// subject prefix. It holds no connection, so it can be replaced on reload.
+type eventsConfig struct {
+	// raw is the server URL as configured, used to tell whether it changed,
+	// and url the same with any password or token redacted, for logs
+	raw     string
+	url     string
+	addr    string
+	user    string
+	pass    string
+	token   string
+	tls     *tls.Config
+	subject string
+}
+
+// parseEventsURL parses the NATS server URL of events_url, given as
+// nats://[[user:password|token]@]host[:port], or tls:// to connect with TLS.
+func parseEventsURL(rawURL, subject string) (*eventsConfig, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	c := &eventsConfig{raw: rawURL, addr: u.Host, subject: subject}
+	switch u.Scheme {
+	case "nats":
+	case "tls":
+		c.tls = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q: expected nats or tls", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("missing host")
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "4222")
+	}
+	if u.User != nil {
+		if pass, ok := u.User.Password(); ok {
+			c.user, c.pass = u.User.Username(), pass
+		} else {
+			c.token = u.User.Username()
+			u.User = url.User("xxxxx")
+		}
+	}
+	c.url = u.Redacted()
+	if subject == "" || strings.ContainsAny(subject, " \t\r\n*>") {
+		return nil, fmt.Errorf("invalid subject %q", subject)
+	}
+
+	return c, nil
+}
+
+// bootEvent is the JSON document published for each transition of a node's
+// boot lifecycle.
+type bootEvent struct {
+	Time    time.Time `json:"time"`
+	MAC     string    `json:"mac"`
+	CompID  string    `json:"comp_id,omitempty"`
+	State   string    `json:"state"`
+	Message string    `json:"message"`
+}
+
+// subject returns the subject e is published under: the prefix followed by
+// the state in lowercase, e.g. coresmd.boot.scripted, so that subscribers can
+// pick the states they are interested in.
+func (e bootEvent) subject(prefix string) string {
+	return prefix + "." + strings.ToLower(e.State)
+}
+
+type queuedEvent struct {
+	cfg   *eventsConfig
+	event bootEvent
+}
+
+// eventPublisher publishes boot lifecycle events to a NATS server in the
+// background, so that answering clients never waits on the server. Events are
+// published at most once: those that cannot be sent are dropped and counted.
+// It is safe for concurrent use.
+type eventPublisher struct {
+	queue chan queuedEvent
+	// Owned by run
+	conn       *natsConn
+	connURL    string
+	retryAfter time.Time
+}
+
+func newEventPublisher() *eventPublisher {
+	return &eventPublisher{queue: make(chan queuedEvent, eventsQueueSize)}
+}
+
+// publish queues e to be published as set in cfg. A nil publisher or cfg
+// does nothing.
+func (p *eventPublisher) publish(cfg *eventsConfig, e bootEvent) {
+	if p == nil || cfg == nil {
+		return
+	}
+	select {
+	case p.queue <- queuedEvent{cfg: cfg, event: e}:
+	default:
+		metricBootEvents.Inc("dropped")
+		log.Warnf("boot event queue is full, not publishing %s of %s", e.State, e.MAC)
+	}
+}
+
+// run publishes queued events until ctx is done, then closes the connection.
+func (p *eventPublisher) run(ctx context.Context) {
+	defer func() {
+		if p.conn != nil {
+			p.conn.close()
+		}
+	}()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case qe := <-p.queue:
+			if err := p.send(qe.cfg, qe.event); err != nil {
+				metricBootEvents.Inc("failure")
+				log.Debugf("failed to publish %s of %s: %v", qe.event.State, qe.event.MAC, err)
+				continue
+			}
+			metricBootEvents.Inc("published")
+		}
+	}
+}
+
+// send publishes e to the server of cfg, connecting first if needed.
+func (p *eventPublisher) send(cfg *eventsConfig, e bootEvent) error {
+	if p.conn != nil && (p.connURL != cfg.raw || p.conn.closed()) {
+		// The server was changed by a reload, or went away
+		p.conn.close()
+		p.conn = nil
+	}
+	if p.conn == nil {
+		if time.Now().Before(p.retryAfter) {
+			return errors.New("not connected")
+		}
+		conn, err := dialNATS(cfg)
+		if err != nil {
+			p.retryAfter = time.Now().Add(natsReconnectDelay)
+			log.Errorf("failed to connect to NATS server %s, retrying in %s: %v", cfg.url, natsReconnectDelay, err)
+			return err
+		}
+		log.Infof("publishing boot events to NATS server %s under %s", cfg.url, cfg.subject)
+		p.conn, p.connURL = conn, cfg.raw
+	}
+
+	body, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if err := p.conn.publish(e.subject(cfg.subject), body); err != nil {
+		log.Errorf("lost connection to NATS server %s: %v", cfg.url, err)
+		p.conn.close()
+		p.conn = nil
+		return err
+	}
+	return nil
+}
+
+// natsConn is a minimal client connection to a NATS server, covering only
+// publishing so as not to pull in a full client library. A goroutine reads
+// from the server to answer its keepalive PINGs; the connection is closed
+// when reading or writing fails.
+type natsConn struct {
+	conn    net.Conn
+	timeout time.Duration
+	mu      sync.Mutex
+	dead    atomic.Bool
+}
+
+// natsConnect is the CONNECT message sent to the server.
+type natsConnect struct {
+	Verbose  bool   `json:"verbose"`
+	Pedantic bool   `json:"pedantic"`
+	User     string `json:"user,omitempty"`
+	Pass     string `json:"pass,omitempty"`
+	Token    string `json:"auth_token,omitempty"`
+	Name     string `json:"name"`
+	Lang     string `json:"lang"`
+	Version  string `json:"version"`
+	Protocol int    `json:"protocol"`
+}
+
+// dialNATS connects to the server of cfg and authenticates, waiting for the
+// server to acknowledge the connection.
+func dialNATS(cfg *eventsConfig) (*natsConn, error) {
+	conn, err := net.DialTimeout("tcp", cfg.addr, defaultNATSTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &natsConn{conn: conn, timeout: defaultNATSTimeout}
+	rd, err := c.handshake(cfg)
+	if err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	go c.read(rd)
+
+	return c, nil
+}
+
+// handshake reads the server's INFO, upgrades the connection to TLS if
+// required, and sends CONNECT followed by a PING, whose PONG confirms the
+// server accepted the connection. It returns the reader to go on reading from
+// the server with.
+func (c *natsConn) handshake(cfg *eventsConfig) (*bufio.Reader, error) {
+	if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, err
+	}
+	rd := bufio.NewReader(c.conn)
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "INFO ") {
+		return nil, fmt.Errorf("unexpected greeting %q", strings.TrimSpace(line))
+	}
+	if cfg.tls != nil {
+		tc := tls.Client(c.conn, cfg.tls)
+		if err := tc.Handshake(); err != nil {
+			return nil, err
+		}
+		c.conn, rd = tc, bufio.NewReader(tc)
+	}
+
+	connect, err := json.Marshal(natsConnect{
+		User:     cfg.user,
+		Pass:     cfg.pass,
+		Token:    cfg.token,
+		Name:     "coresmd",
+		Lang:     "go",
+		Version:  version.Version,
+		Protocol: 0,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := fmt.Fprintf(c.conn, "CONNECT %s\r\nPING\r\n", connect); err != nil {
+		return nil, err
+	}
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PONG":
+			return rd, c.conn.SetDeadline(time.Time{})
+		case strings.HasPrefix(line, "-ERR"):
+			return nil, fmt.Errorf("server refused connection: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+		// INFO updates and +OK are ignored
+	}
+}
+
+// read answers PINGs from the server until the connection fails.
+func (c *natsConn) read(rd *bufio.Reader) {
+	defer c.close()
+	for {
+		line, err := rd.ReadString('\n')
+		if err != nil {
+			if !c.closed() && err != io.EOF {
+				log.Debugf("NATS connection failed: %v", err)
+			}
+			return
+		}
+		switch line = strings.TrimSpace(line); {
+		case line == "PING":
+			if err := c.write([]byte("PONG\r\n")); err != nil {
+				return
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			log.Errorf("NATS server error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
+
+// publish sends body under subject.
+func (c *natsConn) publish(subject string, body []byte) error {
+	msg := make([]byte, 0, len(subject)+len(body)+24)
+	msg = fmt.Appendf(msg, "PUB %s %d\r\n", subject, len(body))
+	msg = append(msg, body...)
+	msg = append(msg, "\r\n"...)
+	return c.write(msg)
+}
+
+func (c *natsConn) write(b []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed() {
+		return net.ErrClosed
+	}
+	if err := c.conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(b)
+	return err
+}
+
+func (c *natsConn) closed() bool {
+	return c.dead.Load()
+}
+
+func (c *natsConn) close() {
+	if !c.dead.Swap(true) {
+		c.conn.Close()
+	}
+}
@@ -0,0 +1,148 @@
+package coresmd
+
+import (
+	"encoding/json"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// explainSet holds whether decision traces are enabled for all clients or for
+// individual MAC addresses. It is safe for concurrent use so that MACs can be
+// added and removed while requests are handled; since every request checks it,
+// the MACs are replaced rather than updated so that checking needs no lock.
+type explainSet struct {
+	mu   sync.Mutex
+	all  bool
+	macs atomic.Pointer[map[string]bool]
+	// changes holds the MACs traces were enabled (true) or disabled (false)
+	// for through set, so that they can be carried over on reload
+	changes map[string]bool
+}
+
+func newExplainSet(all bool, macs []string) *explainSet {
+	e := &explainSet{all: all, changes: make(map[string]bool)}
+	m := make(map[string]bool)
+	for _, mac := range macs {
+		m[mac] = true
+	}
+	e.macs.Store(&m)
+
+	return e
+}
+
+func (e *explainSet) enabled(mac string) bool {
+	return e.all || (*e.macs.Load())[mac]
+}
+
+// set enables or disables decision traces for mac.
+func (e *explainSet) set(mac string, enabled bool) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	old := *e.macs.Load()
+	m := make(map[string]bool, len(old)+1)
+	for k := range old {
+		m[k] = true
+	}
+	if enabled {
+		m[mac] = true
+	} else {
+		delete(m, mac)
+	}
+	e.macs.Store(&m)
+	e.changes[mac] = enabled
+}
+
+// keepChanges enables and disables traces for the MACs they were enabled or
+// disabled for in old, so that changes made through the admin API survive
+// reloading the configuration.
+func (e *explainSet) keepChanges(old *explainSet) {
+	old.mu.Lock()
+	changes := make(map[string]bool, len(old.changes))
+	for mac, enabled := range old.changes {
+		changes[mac] = enabled
+	}
+	old.mu.Unlock()
+
+	for mac, enabled := range changes {
+		e.set(mac, enabled)
+	}
+}
+
+// list returns whether traces are enabled for all clients and the MAC
+// addresses they are individually enabled for.
+func (e *explainSet) list() (bool, []string) {
+	m := *e.macs.Load()
+	macs := make([]string, 0, len(m))
+	for mac := range m {
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+
+	return e.all, macs
+}
+
+// trace is a machine-readable record of the decisions made while handling a
+// single request. Methods are no-ops on a nil trace so that callers need not
+// check whether tracing is enabled.
+type trace struct {
+	MAC         string      `json:"mac"`
+	XID         string      `json:"xid"`
+	MessageType string      `json:"message_type"`
+	Steps       []traceStep `json:"steps"`
+}
+
+// traceStep records the outcome of a single decision. Step names are stable so
+// that traces can be processed by other tools.
+type traceStep struct {
+	// Step is the decision being made, e.g. "lookup" or "bootfile".
+	Step string `json:"step"`
+	// Result is the outcome of the decision, e.g. the chosen IP address.
+	Result string `json:"result"`
+	// Source is what determined the result, e.g. "smd" or a plugin option.
+	Source string `json:"source,omitempty"`
+	// Reason optionally explains why the result was chosen.
+	Reason string `json:"reason,omitempty"`
+}
+
+// newTrace returns a trace for req if tracing is enabled for its MAC address,
+// or nil otherwise.
+func (e *explainSet) newTrace(req *dhcpv4.DHCPv4) *trace {
+	if !e.enabled(clientKey(req)) {
+		return nil
+	}
+
+	return newTraceFor(req)
+}
+
+// newTraceFor returns a trace for req regardless of whether tracing is
+// enabled.
+func newTraceFor(req *dhcpv4.DHCPv4) *trace {
+	return &trace{
+		MAC:         clientKey(req),
+		XID:         req.TransactionID.String(),
+		MessageType: req.MessageType().String(),
+	}
+}
+
+func (t *trace) add(step, result, source, reason string) {
+	if t == nil {
+		return
+	}
+	t.Steps = append(t.Steps, traceStep{Step: step, Result: result, Source: source, Reason: reason})
+}
+
+// log emits the trace as a single structured log line.
+func (t *trace) log() {
+	if t == nil {
+		return
+	}
+	data, err := json.Marshal(t)
+	if err != nil {
+		log.Errorf("failed to marshal decision trace for %s: %v", t.MAC, err)
+		return
+	}
+	log.WithField("trace", string(data)).Infof("decision trace for %s (xid %s)", t.MAC, t.XID)
+}
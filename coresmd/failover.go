@@ -0,0 +1,169 @@
+package coresmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// defaultFailoverLease is how long a leader holds leadership without renewing
+// it if failover_lease is not set.
+const defaultFailoverLease = 5 * time.Second
+
+const (
+	// failoverRenewScript extends the leadership key if this server still
+	// holds it.
+	failoverRenewScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) else return 0 end`
+	// failoverResignScript deletes the leadership key if this server holds
+	// it.
+	failoverResignScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`
+)
+
+// failoverElector elects a single leader among the coresmd servers sharing a
+// Redis backend, so that only the leader answers clients and a standby takes
+// over once the leader stops renewing its leadership. Leadership is a key
+// holding the leader's ID that expires after the lease unless renewed, which
+// the leader does three times per lease. Campaigning uses a connection of its
+// own so that it is not held up by lease traffic.
+//
+// A leader that cannot reach Redis loses its leadership when its lease runs
+// out, since a standby may have taken over by then. While Redis is unreachable
+// no leader can be determined; if serveUnreachable is set, every server then
+// answers clients as if failover were disabled, so that a Redis outage does not
+// become a DHCP outage, and otherwise every server stands by. A nil elector
+// always leads.
+type failoverElector struct {
+	shared *sharedState
+	redis  *redisClient
+	id     string
+	lease  time.Duration
+	// serveUnreachable makes the server answer clients while Redis is
+	// unreachable
+	serveUnreachable bool
+	// leaderUntil is when this server's leadership runs out unless renewed,
+	// in Unix nanoseconds, or 0 while on standby
+	leaderUntil atomic.Int64
+	// unreachable is set while the last campaign failed to reach Redis
+	unreachable atomic.Bool
+}
+
+// newFailoverElector returns an elector campaigning as id, or as the host name
+// and process ID if id is empty.
+func newFailoverElector(shared *sharedState, id string, lease time.Duration, serveUnreachable bool) (*failoverElector, error) {
+	if id == "" {
+		host, err := os.Hostname()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get host name for failover ID: %w", err)
+		}
+		id = host + ":" + strconv.Itoa(os.Getpid())
+	}
+	return &failoverElector{shared: shared, redis: shared.redis.dedicated(), id: id, lease: lease, serveUnreachable: serveUnreachable}, nil
+}
+
+// isLeader reports whether this server answers clients at now: because it
+// leads, or because no leader can be determined and serveUnreachable is set.
+func (e *failoverElector) isLeader(now time.Time) bool {
+	return e == nil || now.UnixNano() < e.leaderUntil.Load() || e.serveUnreachable && e.unreachable.Load()
+}
+
+// role returns "leader" or "standby" as of now, "unknown" while Redis is
+// unreachable and no leadership is held, or "" for a nil elector.
+func (e *failoverElector) role(now time.Time) string {
+	switch {
+	case e == nil:
+		return ""
+	case now.UnixNano() < e.leaderUntil.Load():
+		return "leader"
+	case e.unreachable.Load():
+		return "unknown"
+	default:
+		return "standby"
+	}
+}
+
+// campaign renews this server's leadership, or acquires it if no server
+// leads, as of now.
+func (e *failoverElector) campaign(now time.Time) error {
+	key := e.shared.key("failover", "leader")
+	ms := strconv.FormatInt(redisMillis(e.lease), 10)
+	reply, err := e.redis.do("EVAL", failoverRenewScript, "1", key, e.id, ms)
+	if err != nil {
+		e.unreachable.Store(true)
+		return err
+	}
+	renewed := reply == int64(1)
+	if !renewed {
+		if renewed, err = e.redis.setNX(key, []byte(e.id), e.lease); err != nil {
+			e.unreachable.Store(true)
+			return err
+		}
+	}
+	e.unreachable.Store(false)
+	if renewed {
+		// Count the lease from before the request so that it runs out
+		// here no later than in Redis
+		e.leaderUntil.Store(now.Add(e.lease).UnixNano())
+	} else {
+		e.leaderUntil.Store(0)
+	}
+
+	return nil
+}
+
+// run campaigns three times per lease until ctx is done, then resigns so that
+// a standby can take over right away.
+func (e *failoverElector) run(ctx context.Context) {
+	ticker := time.NewTicker(e.lease / 3)
+	defer ticker.Stop()
+	wasLeader := false
+	for {
+		now := time.Now()
+		if err := e.campaign(now); err != nil {
+			log.Errorf("failover: failed to renew leadership as %s: %v", e.id, err)
+		}
+		if leader := e.isLeader(now); leader != wasLeader {
+			switch {
+			case !leader:
+				log.Warnf("failover: %s is now on standby, leaving clients to the leader", e.id)
+			case e.role(now) == "unknown":
+				log.Warnf("failover: %s cannot reach redis to determine the leader, answering clients", e.id)
+			default:
+				log.Infof("failover: %s is now the leader, answering clients", e.id)
+			}
+			wasLeader = leader
+		}
+		leading := 0.0
+		if wasLeader {
+			leading = 1
+		}
+		metricFailoverLeader.Set(leading)
+
+		select {
+		case <-ctx.Done():
+			e.resign()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Close closes the elector's connection to Redis.
+func (e *failoverElector) Close() {
+	e.redis.Close()
+}
+
+// resign gives up leadership, if held.
+func (e *failoverElector) resign() {
+	if e.leaderUntil.Swap(0) == 0 {
+		return
+	}
+	metricFailoverLeader.Set(0)
+	if _, err := e.redis.do("EVAL", failoverResignScript, "1", e.shared.key("failover", "leader"), e.id); err != nil {
+		log.Errorf("failover: failed to resign leadership as %s: %v", e.id, err)
+		return
+	}
+	log.Infof("failover: %s resigned leadership", e.id)
+}
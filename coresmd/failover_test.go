@@ -0,0 +1,109 @@
+package coresmd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestFailoverElector(t *testing.T) {
+	url := startFakeRedis(t)
+	electors := make([]*failoverElector, 2)
+	for i, id := range []string{"a", "b"} {
+		shared, err := newSharedState(url, defaultSharedStatePrefix)
+		if err != nil {
+			t.Fatalf("newSharedState: %v", err)
+		}
+		defer shared.Close()
+		electors[i], _ = newFailoverElector(shared, id, 5*time.Second, false)
+		defer electors[i].Close()
+	}
+	now := time.Now()
+
+	// The first to campaign leads
+	for _, e := range electors {
+		if err := e.campaign(now); err != nil {
+			t.Fatalf("campaign: %v", err)
+		}
+	}
+	if !electors[0].isLeader(now) || electors[1].isLeader(now) {
+		t.Fatalf("roles are %s and %s, want leader and standby", electors[0].role(now), electors[1].role(now))
+	}
+
+	// Renewing keeps leadership
+	later := now.Add(2 * time.Second)
+	for _, e := range electors {
+		if err := e.campaign(later); err != nil {
+			t.Fatalf("campaign: %v", err)
+		}
+	}
+	if !electors[0].isLeader(later.Add(4*time.Second)) || electors[1].isLeader(later) {
+		t.Errorf("roles after renewal are %s and %s, want leader and standby", electors[0].role(later), electors[1].role(later))
+	}
+
+	// A leader that stops renewing steps down when its lease runs out
+	if electors[0].isLeader(later.Add(6 * time.Second)) {
+		t.Error("leader still leads after its lease ran out")
+	}
+
+	// The standby takes over once the leader resigns
+	electors[0].resign()
+	if err := electors[1].campaign(later); err != nil {
+		t.Fatalf("campaign: %v", err)
+	}
+	if electors[0].isLeader(later) || !electors[1].isLeader(later) {
+		t.Errorf("roles after resigning are %s and %s, want standby and leader", electors[0].role(later), electors[1].role(later))
+	}
+}
+
+func TestFailoverUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %v", err)
+	}
+	url := "redis://" + ln.Addr().String()
+	ln.Close()
+	shared, err := newSharedState(url, defaultSharedStatePrefix)
+	if err != nil {
+		t.Fatalf("newSharedState: %v", err)
+	}
+	defer shared.Close()
+
+	for _, serve := range []bool{true, false} {
+		e, _ := newFailoverElector(shared, "a", 5*time.Second, serve)
+		now := time.Now()
+		if err := e.campaign(now); err == nil {
+			t.Fatal("campaign reached a server that is down")
+		}
+		if e.isLeader(now) != serve || e.role(now) != "unknown" {
+			t.Errorf("serve %t: leading %t as %s while redis is unreachable, want %t as unknown", serve, e.isLeader(now), e.role(now), serve)
+		}
+		// The elector's own connection does not back off with the
+		// shared one
+		if err := e.campaign(now); err == errRedisDown {
+			t.Errorf("serve %t: campaign skipped while backing off", serve)
+		}
+		e.Close()
+	}
+}
+
+func TestHandler4Standby(t *testing.T) {
+	p := setupHandler(t)
+	p.failover = &failoverElector{id: "standby", lease: 5 * time.Second}
+
+	req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01")
+	if out, stop := p.Handler4(req, resp); out != nil || !stop {
+		t.Errorf("standby answered with %v, stop %t; want dropped", out, stop)
+	}
+	if _, report := getHealth(t, p, "/readyz"); report.FailoverRole != "standby" {
+		t.Errorf("failover role is %q, want standby", report.FailoverRole)
+	}
+
+	p.failover.leaderUntil.Store(time.Now().Add(time.Minute).UnixNano())
+	req, resp = newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01")
+	if out, _ := p.Handler4(req, resp); out == nil {
+		t.Error("leader dropped the request")
+	}
+}
@@ -0,0 +1,77 @@
+package coresmd
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	defaultBootScriptCheckInterval = 30 * time.Second
+	bootScriptCheckTimeout         = 5 * time.Second
+)
+
+// watchBootScriptURL periodically checks whether the boot script base URL is
+// reachable while a fallback boot file is configured, recording the result in
+// p.bootScriptDown, until ctx is canceled. The URL and interval are read from
+// the current settings before each check so that they follow reloads.
+func (p *PluginState) watchBootScriptURL(ctx context.Context) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		cfg := p.config.Load()
+		interval := cfg.bootScriptCheckInterval
+		if interval <= 0 {
+			interval = defaultBootScriptCheckInterval
+		}
+		timer.Reset(interval)
+		if cfg.fallbackBootfile == "" {
+			p.bootScriptDown.Store(false)
+			continue
+		}
+
+		err := checkURL(ctx, cfg.bootScriptBaseURL, min(interval, bootScriptCheckTimeout))
+		if ctx.Err() != nil {
+			return
+		}
+		down := err != nil
+		if was := p.bootScriptDown.Swap(down); was != down {
+			if down {
+				log.Errorf("boot script base URL %s is unreachable, serving fallback boot file %q to iPXE clients: %v", cfg.bootScriptBaseURL, cfg.fallbackBootfile, err)
+			} else {
+				log.Infof("boot script base URL %s is reachable again", cfg.bootScriptBaseURL)
+			}
+		}
+		up := 1.0
+		if down {
+			up = 0
+		}
+		metricBootScriptUp.Set(up, cfg.bootScriptBaseURL.String())
+	}
+}
+
+// checkURL returns an error if u does not answer an HTTP request within
+// timeout. Any response counts as an answer, since only reachability matters.
+func checkURL(ctx context.Context, u *url.URL, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	return nil
+}
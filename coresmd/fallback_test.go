@@ -0,0 +1,55 @@
+package coresmd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestFallbackBootfile(t *testing.T) {
+	bss := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	bssURL, _ := url.Parse(bss.URL)
+
+	p := setupHandler(t)
+	cfg := p.config.Load()
+	cfg.bootScriptBaseURL = bssURL
+	cfg.fallbackBootfile = exitScriptName
+	cfg.bootScriptCheckInterval = 5 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go p.watchBootScriptURL(ctx)
+
+	bootfile := func() string {
+		req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", withArch(iana.EFI_X86_64), withIPXE())
+		got, _ := p.Handler4(req, resp)
+		return got.BootFileNameOption()
+	}
+	waitFor := func(down bool) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for p.bootScriptDown.Load() != down {
+			if time.Now().After(deadline) {
+				t.Fatalf("boot script base URL was not found to be down=%t", down)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	waitFor(false)
+	if bf := bootfile(); bf != BootScriptURL(bssURL, "aa:bb:cc:dd:ee:01").String() {
+		t.Errorf("boot file while BSS is up = %q, want BSS boot script URL", bf)
+	}
+
+	bss.Close()
+	waitFor(true)
+	if bf := bootfile(); bf != exitScriptName {
+		t.Errorf("boot file while BSS is down = %q, want %q", bf, exitScriptName)
+	}
+}
@@ -0,0 +1,191 @@
+package coresmd
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Stages of the boot funnel a node progresses through on each boot.
+const (
+	// funnelStage1 is a firmware PXE client being served its bootloader
+	funnelStage1 = "stage1"
+	// funnelIPXE is iPXE asking for an address
+	funnelIPXE = "ipxe"
+	// funnelBootScript is iPXE being served its boot script URL
+	funnelBootScript = "boot_script"
+)
+
+const (
+	defaultFunnelStuckLimit = 3
+	// funnelRetention is how long nodes are remembered after their last
+	// request, so that the funnel does not grow without bounds
+	funnelRetention = 24 * time.Hour
+)
+
+// funnelEntry is where a node is in the boot funnel, with the time it last
+// reached each stage of its current boot.
+type funnelEntry struct {
+	MAC        string    `json:"mac"`
+	Stage      string    `json:"stage"`
+	Stage1     time.Time `json:"stage1,omitempty"`
+	IPXE       time.Time `json:"ipxe,omitempty"`
+	BootScript time.Time `json:"boot_script,omitempty"`
+	// Stage1Count is the number of times in a row the node was served its
+	// bootloader without iPXE coming back
+	Stage1Count int  `json:"stage1_count"`
+	Stuck       bool `json:"stuck"`
+}
+
+// bootFunnel tracks the progression of each node through the boot funnel
+// (bootloader served, iPXE seen, boot script URL served), to find nodes stuck
+// on stage 1 during a full-system reboot. Like chainTracker, it is split into
+// shards by MAC address and safe for concurrent use. It outlives reloads.
+type bootFunnel struct {
+	shards [numShards]funnelShard
+}
+
+type funnelShard struct {
+	mu        sync.Mutex
+	entries   map[string]*funnelEntry
+	lastSweep time.Time
+}
+
+func newBootFunnel() *bootFunnel {
+	bf := &bootFunnel{}
+	for i := range bf.shards {
+		bf.shards[i].entries = make(map[string]*funnelEntry)
+	}
+	return bf
+}
+
+// record records mac reaching stage at now and returns its entry. A node is
+// stuck once it was served its bootloader stuckLimit times in a row, unless
+// stuckLimit is 0; stuck reports whether it just became so. A nil bootFunnel
+// records nothing.
+func (bf *bootFunnel) record(mac, stage string, stuckLimit int, now time.Time) (e funnelEntry, stuck bool) {
+	if bf == nil {
+		return funnelEntry{}, false
+	}
+	s := &bf.shards[shardOf(mac)]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if now.Sub(s.lastSweep) > funnelRetention {
+		for m, e := range s.entries {
+			if now.Sub(e.latest()) > funnelRetention {
+				e.forget()
+				delete(s.entries, m)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	entry, ok := s.entries[mac]
+	if !ok {
+		entry = &funnelEntry{MAC: mac}
+		s.entries[mac] = entry
+	} else {
+		metricFunnelNodes.Add(-1, entry.Stage)
+	}
+	wasStuck := entry.Stuck
+	switch stage {
+	case funnelStage1:
+		// A new boot; only count it towards being stuck if the last
+		// one did not get past stage 1 either
+		if entry.Stage == funnelStage1 {
+			entry.Stage1Count++
+		} else {
+			entry.Stage1Count = 1
+		}
+		entry.Stage1, entry.IPXE, entry.BootScript = now, time.Time{}, time.Time{}
+	case funnelIPXE:
+		entry.IPXE, entry.Stage1Count = now, 0
+	case funnelBootScript:
+		if entry.IPXE.IsZero() || entry.Stage == funnelBootScript {
+			entry.IPXE = now
+		}
+		entry.BootScript, entry.Stage1Count = now, 0
+	}
+	entry.Stage = stage
+	entry.Stuck = stuckLimit > 0 && entry.Stage1Count >= stuckLimit
+	metricFunnel.Inc(stage)
+	metricFunnelNodes.Add(1, stage)
+	if entry.Stuck != wasStuck {
+		if entry.Stuck {
+			metricFunnelStuck.Add(1)
+		} else {
+			metricFunnelStuck.Add(-1)
+		}
+	}
+
+	return *entry, entry.Stuck && !wasStuck
+}
+
+// forget removes the entry from the metrics before it is deleted.
+func (e *funnelEntry) forget() {
+	metricFunnelNodes.Add(-1, e.Stage)
+	if e.Stuck {
+		metricFunnelStuck.Add(-1)
+	}
+}
+
+// latest returns the time the node was last seen.
+func (e *funnelEntry) latest() time.Time {
+	t := e.Stage1
+	for _, u := range []time.Time{e.IPXE, e.BootScript} {
+		if u.After(t) {
+			t = u
+		}
+	}
+	return t
+}
+
+// list returns the entries of all nodes, or only of stuck ones, by MAC
+// address.
+func (bf *bootFunnel) list(stuckOnly bool) []funnelEntry {
+	if bf == nil {
+		return nil
+	}
+	var entries []funnelEntry
+	for i := range bf.shards {
+		s := &bf.shards[i]
+		s.mu.Lock()
+		for _, e := range s.entries {
+			if !stuckOnly || e.Stuck {
+				entries = append(entries, *e)
+			}
+		}
+		s.mu.Unlock()
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].MAC < entries[j].MAC })
+	return entries
+}
+
+// funnelStage returns the boot funnel stage reached by a client that was
+// answered with decision, or "" if it did not reach one.
+func funnelStage(decision string, isIPXE bool, bootfile string) string {
+	switch {
+	case !isIPXE && bootfile != "" && (decision == "ipxe_bootloader" || decision == "bootloader_override" || decision == "secure_boot" || decision == "nbp_map"):
+		return funnelStage1
+	case isIPXE && bootfile != "" && (decision == "boot_script" || decision == "bss_embed" || decision == "stage1_script" || decision == "bootscript_override" || decision == "rescue"):
+		return funnelBootScript
+	case isIPXE:
+		return funnelIPXE
+	}
+	return ""
+}
+
+// recordFunnel records the boot funnel stage reached by the client with the
+// given MAC address, warning when it becomes stuck on stage 1 as set in cfg.
+func (p *PluginState) recordFunnel(cfg *pluginConfig, l *logrus.Entry, mac, stage string) {
+	if stage == "" {
+		return
+	}
+	e, stuck := p.funnel.record(mac, stage, cfg.funnelStuckLimit, time.Now())
+	if stuck {
+		l.Warnf("%s was served its bootloader %d times in a row without iPXE coming back; it is likely failing to load or run iPXE", mac, e.Stage1Count)
+	}
+}
@@ -0,0 +1,100 @@
+package coresmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestBootFunnel(t *testing.T) {
+	bf := newBootFunnel()
+	now := time.Now()
+	mac := "aa:bb:cc:dd:ee:01"
+
+	// Stage 1 over and over: stuck on the third time
+	for i := 1; i <= 4; i++ {
+		e, stuck := bf.record(mac, funnelStage1, 3, now)
+		if e.Stage1Count != i || e.Stuck != (i >= 3) || stuck != (i == 3) {
+			t.Errorf("stage 1 #%d: got %+v, became stuck %t", i, e, stuck)
+		}
+	}
+	if got := bf.list(true); len(got) != 1 || got[0].MAC != mac {
+		t.Errorf("stuck nodes = %+v", got)
+	}
+
+	// iPXE coming back is progress
+	later := now.Add(time.Minute)
+	e, _ := bf.record(mac, funnelIPXE, 3, later)
+	if e.Stuck || e.Stage1Count != 0 || !e.IPXE.Equal(later) || !e.Stage1.Equal(now) {
+		t.Errorf("iPXE: got %+v", e)
+	}
+	e, _ = bf.record(mac, funnelBootScript, 3, later)
+	if e.Stage != funnelBootScript || !e.BootScript.Equal(later) {
+		t.Errorf("boot script: got %+v", e)
+	}
+	if got := bf.list(true); len(got) != 0 {
+		t.Errorf("stuck nodes = %+v", got)
+	}
+
+	// The next boot starts over
+	e, _ = bf.record(mac, funnelStage1, 3, later.Add(time.Hour))
+	if e.Stage1Count != 1 || !e.IPXE.IsZero() || !e.BootScript.IsZero() {
+		t.Errorf("next boot: got %+v", e)
+	}
+
+	// A limit of 0 never marks nodes as stuck
+	for i := 0; i < 5; i++ {
+		if e, _ := bf.record("aa:bb:cc:dd:ee:02", funnelStage1, 0, now); e.Stuck {
+			t.Fatalf("stuck with limit 0: %+v", e)
+		}
+	}
+}
+
+func TestHandler4BootFunnel(t *testing.T) {
+	p := setupHandler(t)
+	p.funnel = newBootFunnel()
+	p.config.Load().funnelStuckLimit = 2
+	boot := func(mods ...dhcpv4.Modifier) {
+		t.Helper()
+		for _, mt := range []dhcpv4.MessageType{dhcpv4.MessageTypeDiscover, dhcpv4.MessageTypeRequest} {
+			req, resp := newRequest(t, mt, "aa:bb:cc:dd:ee:01", mods...)
+			p.Handler4(req, resp)
+		}
+	}
+	funnel := func(query string) []funnelEntry {
+		t.Helper()
+		w := httptest.NewRecorder()
+		p.adminFunnel(w, httptest.NewRequest(http.MethodGet, "/funnel"+query, nil))
+		var out struct {
+			Nodes []funnelEntry `json:"nodes"`
+		}
+		if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+			t.Fatal(err)
+		}
+		return out.Nodes
+	}
+
+	// Each exchange counts once
+	boot(withArch(iana.EFI_X86_64))
+	if got := funnel(""); len(got) != 1 || got[0].Stage != funnelStage1 || got[0].Stage1Count != 1 {
+		t.Fatalf("after stage 1: %+v", got)
+	}
+	boot(withArch(iana.EFI_X86_64))
+	if got := funnel("?stuck=true"); len(got) != 1 || got[0].Stage1Count != 2 {
+		t.Fatalf("after stage 1 twice: %+v", got)
+	}
+
+	boot(withArch(iana.EFI_X86_64), withIPXE())
+	got := funnel("")
+	if len(got) != 1 || got[0].Stage != funnelBootScript || got[0].Stuck || got[0].IPXE.IsZero() {
+		t.Fatalf("after iPXE: %+v", got)
+	}
+	if got := funnel("?stuck=true"); len(got) != 0 {
+		t.Errorf("stuck nodes after iPXE: %+v", got)
+	}
+}
@@ -0,0 +1,521 @@
+package coresmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/OpenCHAMI/coresmd/internal/ipxe"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// setupHandler returns a plugin instance whose cache is filled from a
+// FakeSmdClient with one Node and one NodeBMC.
+func setupHandler(t *testing.T) *PluginState {
+	t.Helper()
+
+	fake := NewFakeSmdClient(
+		[]EthernetInterface{
+			{
+				MACAddress:  "AA:BB:CC:DD:EE:01",
+				ComponentID: "x3000c0s0b0n0",
+				IPAddresses: []struct {
+					IPAddress string `json:"IPAddress"`
+				}{{IPAddress: "172.16.0.1"}},
+			},
+			{
+				MACAddress:  "aa:bb:cc:dd:ee:02",
+				ComponentID: "x3000c0s0b0",
+				IPAddresses: []struct {
+					IPAddress string `json:"IPAddress"`
+				}{{IPAddress: "172.16.0.2"}},
+			},
+		},
+		[]Component{
+			{ID: "x3000c0s0b0n0", NID: 1, Type: "Node", Role: "Compute"},
+			{ID: "x3000c0s0b0", Type: "NodeBMC"},
+		},
+	)
+	c, err := NewCache("1m", fake)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+
+	bootScriptBaseURL, _ := url.Parse("http://172.16.0.253:8081")
+
+	p := &PluginState{cache: c}
+	p.config.Store(&pluginConfig{
+		bootScriptBaseURL:   bootScriptBaseURL,
+		defaultLeasePolicy:  leasePolicy{lease: time.Hour},
+		requestedIPMismatch: mismatchNAK,
+		explainMACs:         newExplainSet(false, nil),
+	})
+
+	return p
+}
+
+func newRequest(t *testing.T, mt dhcpv4.MessageType, mac string, modifiers ...dhcpv4.Modifier) (*dhcpv4.DHCPv4, *dhcpv4.DHCPv4) {
+	t.Helper()
+
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		t.Fatalf("ParseMAC: %v", err)
+	}
+	modifiers = append([]dhcpv4.Modifier{dhcpv4.WithMessageType(mt), dhcpv4.WithHwAddr(hw)}, modifiers...)
+	req, err := dhcpv4.New(modifiers...)
+	if err != nil {
+		t.Fatalf("dhcpv4.New: %v", err)
+	}
+	resp, err := dhcpv4.NewReplyFromRequest(req)
+	if err != nil {
+		t.Fatalf("NewReplyFromRequest: %v", err)
+	}
+	switch mt {
+	case dhcpv4.MessageTypeDiscover:
+		resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeOffer))
+	case dhcpv4.MessageTypeRequest:
+		resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
+	}
+
+	return req, resp
+}
+
+func withArch(archs ...iana.Arch) dhcpv4.Modifier {
+	return dhcpv4.WithOption(dhcpv4.OptClientArch(archs...))
+}
+
+func withIPXE() dhcpv4.Modifier {
+	return dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionUserClassInformation, []byte("iPXE")))
+}
+
+func TestHandler4(t *testing.T) {
+	tests := []struct {
+		name        string
+		mt          dhcpv4.MessageType
+		mac         string
+		modifiers   []dhcpv4.Modifier
+		wantStop    bool
+		wantNil     bool
+		wantType    dhcpv4.MessageType
+		wantIP      string
+		wantHost    string
+		wantBootURL string
+	}{
+		{
+			name:      "node discover gets bootloader",
+			mt:        dhcpv4.MessageTypeDiscover,
+			mac:       "aa:bb:cc:dd:ee:01",
+			modifiers: []dhcpv4.Modifier{withArch(iana.EFI_X86_64)},
+			wantStop:  true,
+			wantType:  dhcpv4.MessageTypeOffer,
+			wantIP:    "172.16.0.1",
+			wantHost:  "nid0001",
+
+			wantBootURL: "ipxe-x86_64.efi",
+		},
+		{
+			name:        "iPXE node gets boot script URL",
+			mt:          dhcpv4.MessageTypeDiscover,
+			mac:         "aa:bb:cc:dd:ee:01",
+			modifiers:   []dhcpv4.Modifier{withArch(iana.EFI_X86_64), withIPXE()},
+			wantStop:    true,
+			wantType:    dhcpv4.MessageTypeOffer,
+			wantIP:      "172.16.0.1",
+			wantHost:    "nid0001",
+			wantBootURL: "http://172.16.0.253:8081/boot/v1/bootscript?mac=aa:bb:cc:dd:ee:01",
+		},
+		{
+			name:      "BMC gets no hostname",
+			mt:        dhcpv4.MessageTypeDiscover,
+			mac:       "aa:bb:cc:dd:ee:02",
+			modifiers: []dhcpv4.Modifier{withArch(iana.EFI_X86_64)},
+			wantStop:  true,
+			wantType:  dhcpv4.MessageTypeOffer,
+			wantIP:    "172.16.0.2",
+
+			wantBootURL: "ipxe-x86_64.efi",
+		},
+		{
+			name:     "unknown client is passed on",
+			mt:       dhcpv4.MessageTypeDiscover,
+			mac:      "aa:bb:cc:dd:ee:ff",
+			wantStop: false,
+			wantType: dhcpv4.MessageTypeOffer,
+		},
+		{
+			name:      "matching request is acknowledged",
+			mt:        dhcpv4.MessageTypeRequest,
+			mac:       "aa:bb:cc:dd:ee:01",
+			modifiers: []dhcpv4.Modifier{withArch(iana.EFI_X86_64), dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(172, 16, 0, 1)))},
+			wantStop:  true,
+			wantType:  dhcpv4.MessageTypeAck,
+			wantIP:    "172.16.0.1",
+			wantHost:  "nid0001",
+
+			wantBootURL: "ipxe-x86_64.efi",
+		},
+		{
+			name:      "mismatched request is refused",
+			mt:        dhcpv4.MessageTypeRequest,
+			mac:       "aa:bb:cc:dd:ee:01",
+			modifiers: []dhcpv4.Modifier{dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(172, 16, 0, 99)))},
+			wantStop:  true,
+			wantType:  dhcpv4.MessageTypeNak,
+		},
+		{
+			name:     "release is not answered",
+			mt:       dhcpv4.MessageTypeRelease,
+			mac:      "aa:bb:cc:dd:ee:01",
+			wantStop: true,
+			wantNil:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := setupHandler(t)
+			req, resp := newRequest(t, tt.mt, tt.mac, tt.modifiers...)
+
+			got, stop := p.Handler4(req, resp)
+			if stop != tt.wantStop {
+				t.Errorf("stop = %t, want %t", stop, tt.wantStop)
+			}
+			if tt.wantNil {
+				if got != nil {
+					t.Errorf("got response %s, want none", got.Summary())
+				}
+				return
+			}
+			if got == nil {
+				t.Fatal("got no response")
+			}
+			if got.MessageType() != tt.wantType {
+				t.Errorf("message type = %s, want %s", got.MessageType(), tt.wantType)
+			}
+			if tt.wantIP != "" && !got.YourIPAddr.Equal(net.ParseIP(tt.wantIP)) {
+				t.Errorf("yiaddr = %s, want %s", got.YourIPAddr, tt.wantIP)
+			}
+			if host := got.HostName(); host != tt.wantHost {
+				t.Errorf("hostname = %q, want %q", host, tt.wantHost)
+			}
+			if bf := got.BootFileNameOption(); bf != tt.wantBootURL {
+				t.Errorf("boot file = %q, want %q", bf, tt.wantBootURL)
+			}
+		})
+	}
+}
+
+func TestHandler4LeasePolicy(t *testing.T) {
+	p := setupHandler(t)
+	p.config.Load().leasePolicies = map[string]leasePolicy{
+		"NodeBMC": {lease: 10 * time.Minute, renewal: 4 * time.Minute, rebinding: 8 * time.Minute},
+	}
+
+	tests := []struct {
+		mac           string
+		wantLease     time.Duration
+		wantRenewal   time.Duration
+		wantRebinding time.Duration
+	}{
+		{mac: "aa:bb:cc:dd:ee:01", wantLease: time.Hour},
+		{mac: "aa:bb:cc:dd:ee:02", wantLease: 10 * time.Minute, wantRenewal: 4 * time.Minute, wantRebinding: 8 * time.Minute},
+	}
+
+	for _, tt := range tests {
+		req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, tt.mac, withArch(iana.EFI_X86_64))
+		got, _ := p.Handler4(req, resp)
+		if lease := got.IPAddressLeaseTime(0); lease != tt.wantLease {
+			t.Errorf("%s: lease = %s, want %s", tt.mac, lease, tt.wantLease)
+		}
+		if renewal := got.IPAddressRenewalTime(0); renewal != tt.wantRenewal {
+			t.Errorf("%s: renewal = %s, want %s", tt.mac, renewal, tt.wantRenewal)
+		}
+		if rebinding := got.IPAddressRebindingTime(0); rebinding != tt.wantRebinding {
+			t.Errorf("%s: rebinding = %s, want %s", tt.mac, rebinding, tt.wantRebinding)
+		}
+	}
+}
+
+func TestHandler4Bootloaders(t *testing.T) {
+	p := setupHandler(t)
+	bootfile := func(arch iana.Arch) string {
+		t.Helper()
+		req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", withArch(arch))
+		got, _ := p.Handler4(req, resp)
+		return got.BootFileNameOption()
+	}
+
+	// Defaults
+	for arch, want := range map[iana.Arch]string{
+		iana.INTEL_X86PC:     "undionly.kpxe",
+		iana.EFI_BC:          "ipxe-x86_64.efi",
+		iana.EFI_ARM64:       "ipxe-arm64.efi",
+		iana.EFI_X86_64_HTTP: "", // no http_url
+		iana.EFI_RISCV64:     "",
+	} {
+		if got := bootfile(arch); got != want {
+			t.Errorf("default, arch %d: got boot file %q, want %q", arch, got, want)
+		}
+	}
+
+	cfg := p.config.Load()
+	cfg.httpURL, _ = url.Parse("http://10.0.0.1:8080")
+	var err error
+	if cfg.bootloaders, err = ipxe.ParseBootloaders("0:-,7:snponly.efi,27:ipxe-riscv64.efi:http"); err != nil {
+		t.Fatal(err)
+	}
+	for arch, want := range map[iana.Arch]string{
+		iana.INTEL_X86PC:     "",
+		iana.EFI_X86_64:      "snponly.efi",
+		iana.EFI_BC:          "ipxe-x86_64.efi",
+		iana.EFI_X86_64_HTTP: "http://10.0.0.1:8080/ipxe-x86_64.efi",
+		iana.EFI_RISCV64:     "http://10.0.0.1:8080/ipxe-riscv64.efi",
+	} {
+		if got := bootfile(arch); got != want {
+			t.Errorf("configured, arch %d: got boot file %q, want %q", arch, got, want)
+		}
+	}
+
+	for _, val := range []string{"x86:foo.efi", "7", "7:foo.efi:ftp"} {
+		if _, err := ipxe.ParseBootloaders(val); err == nil {
+			t.Errorf("%q accepted", val)
+		}
+	}
+}
+
+func TestHandler4ArchList(t *testing.T) {
+	p := setupHandler(t)
+	bootfile := func(mods ...dhcpv4.Modifier) string {
+		t.Helper()
+		req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", mods...)
+		got, _ := p.Handler4(req, resp)
+		return got.BootFileNameOption()
+	}
+
+	for _, tt := range []struct {
+		archs []iana.Arch
+		want  string
+	}{
+		// EFI is preferred over legacy BIOS whatever the order
+		{[]iana.Arch{iana.INTEL_X86PC, iana.EFI_X86_64}, "ipxe-x86_64.efi"},
+		{[]iana.Arch{iana.EFI_ARM64, iana.INTEL_X86PC}, "ipxe-arm64.efi"},
+		// TFTP is preferred over UEFI HTTP boot
+		{[]iana.Arch{iana.EFI_X86_64_HTTP, iana.EFI_BC}, "ipxe-x86_64.efi"},
+		// Unsupported entries are skipped
+		{[]iana.Arch{iana.EFI_RISCV64, iana.INTEL_X86PC}, "undionly.kpxe"},
+		{[]iana.Arch{iana.EFI_RISCV64, iana.EFI_RISCV32}, ""},
+	} {
+		if got := bootfile(withArch(tt.archs...)); got != tt.want {
+			t.Errorf("archs %v: got boot file %q, want %q", tt.archs, got, tt.want)
+		}
+	}
+
+	// Lists that are not a whole number of entries are refused
+	odd := dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionClientSystemArchitectureType, []byte{0, 7, 0}))
+	if got := bootfile(odd); got != "" {
+		t.Errorf("odd-length list: got boot file %q", got)
+	}
+}
+
+func TestClientArchs(t *testing.T) {
+	req, _ := dhcpv4.New(withArch(iana.EFI_X86_64, iana.EFI_BC, iana.INTEL_X86PC))
+	archs, err := ipxe.ClientArchs(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []iana.Arch{iana.EFI_X86_64, iana.EFI_BC, iana.INTEL_X86PC}; !reflect.DeepEqual(archs, want) {
+		t.Errorf("got %v, want %v", archs, want)
+	}
+	for _, b := range [][]byte{{}, {7}, {0, 7, 0}} {
+		req, _ := dhcpv4.New(dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionClientSystemArchitectureType, b)))
+		if _, err := ipxe.ClientArchs(req); err == nil {
+			t.Errorf("%v accepted", b)
+		}
+	}
+}
+
+func TestHandler4MaxStaleness(t *testing.T) {
+	p := setupHandler(t)
+	p.config.Load().maxStaleness = time.Hour
+
+	req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", withArch(iana.EFI_X86_64))
+	if got, stop := p.Handler4(req, resp); got == nil || !stop {
+		t.Fatalf("fresh cache: Handler4 = %v, %t, want offer", got, stop)
+	}
+
+	// Age the cached data past max_staleness by restarting from a snapshot
+	// taken two hours ago
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	p.cache.SnapshotFile = path
+	if err := p.cache.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	var f map[string]any
+	data, err := os.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(data, &f)
+	}
+	if err != nil {
+		t.Fatalf("failed to read snapshot: %v", err)
+	}
+	f["last_updated"] = time.Now().Add(-2 * time.Hour)
+	data, _ = json.Marshal(f)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("failed to write snapshot: %v", err)
+	}
+	stale, _ := NewCache("1m", NewFakeSmdClient(nil, nil))
+	stale.SnapshotFile = path
+	if err := stale.LoadSnapshotFile(); err != nil {
+		t.Fatalf("LoadSnapshotFile: %v", err)
+	}
+	p.cache = stale
+
+	req, resp = newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", withArch(iana.EFI_X86_64))
+	if got, stop := p.Handler4(req, resp); got != nil || !stop {
+		t.Errorf("stale cache: Handler4 = %v, %t, want request dropped", got, stop)
+	}
+}
+
+func TestCacheRefreshFilters(t *testing.T) {
+	p := setupHandler(t)
+	p.cache.ComponentTypes = []string{"NodeBMC"}
+	if err := p.cache.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+
+	snapshot := p.cache.Snapshot()
+	if _, ok := snapshot.Interfaces["aa:bb:cc:dd:ee:02"]; !ok {
+		t.Error("NodeBMC interface missing from filtered cache")
+	}
+	if _, ok := snapshot.Interfaces["aa:bb:cc:dd:ee:01"]; ok {
+		t.Error("Node interface present in cache filtered to NodeBMC")
+	}
+}
+
+func TestHandler4IndependentInstances(t *testing.T) {
+	p1 := setupHandler(t)
+	p2 := setupHandler(t)
+	p2.cache.Client.(*FakeSmdClient).Set(
+		[]EthernetInterface{{
+			MACAddress:  "aa:bb:cc:dd:ee:01",
+			ComponentID: "x3000c0s0b0n0",
+			IPAddresses: []struct {
+				IPAddress string `json:"IPAddress"`
+			}{{IPAddress: "10.1.0.1"}},
+		}},
+		[]Component{{ID: "x3000c0s0b0n0", NID: 1, Type: "Node"}},
+	)
+	if err := p2.cache.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+
+	for p, want := range map[*PluginState]string{p1: "172.16.0.1", p2: "10.1.0.1"} {
+		req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", withArch(iana.EFI_X86_64))
+		got, _ := p.Handler4(req, resp)
+		if !got.YourIPAddr.Equal(net.ParseIP(want)) {
+			t.Errorf("yiaddr = %s, want %s", got.YourIPAddr, want)
+		}
+	}
+}
+
+// benchPlugin returns a plugin serving n nodes from a refreshed cache and a
+// DISCOVER from each of them.
+func benchPlugin(b *testing.B, n int) (*PluginState, []*dhcpv4.DHCPv4) {
+	eis := make([]EthernetInterface, n)
+	comps := make([]Component, n)
+	reqs := make([]*dhcpv4.DHCPv4, n)
+	for i := range eis {
+		id := fmt.Sprintf("x%dc%ds%db0n0", 1000+i/512, i/64%8, i%64)
+		mac := net.HardwareAddr{2, 0, 0, byte(i >> 16), byte(i >> 8), byte(i)}
+		eis[i] = EthernetInterface{MACAddress: mac.String(), ComponentID: id, IPAddresses: []struct {
+			IPAddress string `json:"IPAddress"`
+		}{{IPAddress: fmt.Sprintf("10.%d.%d.%d", byte(i>>16), byte(i>>8), byte(i))}}}
+		comps[i] = Component{ID: id, NID: int64(i + 1), Type: "Node", Role: "Compute"}
+		reqs[i], _ = dhcpv4.New(dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover), dhcpv4.WithHwAddr(mac),
+			withArch(iana.EFI_X86_64), withIPXE())
+	}
+	c, err := NewCache("1h", NewFakeSmdClient(eis, comps))
+	if err != nil {
+		b.Fatalf("NewCache: %v", err)
+	}
+	if err := c.Refresh(context.Background()); err != nil {
+		b.Fatalf("Refresh: %v", err)
+	}
+	bootScriptBaseURL, _ := url.Parse("http://172.16.0.253:8081")
+	p := &PluginState{cache: c, lookupErrors: newLogThrottle()}
+	p.config.Store(&pluginConfig{
+		bootScriptBaseURL:  bootScriptBaseURL,
+		defaultLeasePolicy: leasePolicy{lease: time.Hour},
+		explainMACs:        newExplainSet(false, nil),
+	})
+
+	return p, reqs
+}
+
+func BenchmarkHandler4(b *testing.B) {
+	out := log.Logger.Out
+	log.Logger.SetOutput(io.Discard)
+	defer log.Logger.SetOutput(out)
+
+	for _, n := range []int{10000, 100000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			p, reqs := benchPlugin(b, n)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				req := reqs[i%n]
+				resp, _ := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer))
+				if got, _ := p.Handler4(req, resp); got == nil || got.YourIPAddr.IsUnspecified() {
+					b.Fatalf("no address offered to %s", req.ClientHWAddr)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkHandler4Parallel answers DISCOVERs from many clients at once, as
+// during a full-system boot, with the lease tracker and per-MAC rate limits
+// enabled since they keep per-client state.
+func BenchmarkHandler4Parallel(b *testing.B) {
+	out := log.Logger.Out
+	log.Logger.SetOutput(io.Discard)
+	defer log.Logger.SetOutput(out)
+
+	const n = 100000
+	p, reqs := benchPlugin(b, n)
+	cfg := *p.config.Load()
+	cfg.macRateLimit = newRateLimiter(1e6, 0)
+	p.config.Store(&cfg)
+	leases, _ := newLeaseTracker("")
+	p.leases = leases
+	var next atomic.Int64
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			req := reqs[next.Add(1)%n]
+			resp, _ := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer))
+			if got, _ := p.Handler4(req, resp); got == nil || got.YourIPAddr.IsUnspecified() {
+				b.Errorf("no address offered to %s", req.ClientHWAddr)
+				return
+			}
+		}
+	})
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "req/s")
+}
@@ -0,0 +1,168 @@
+package coresmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+// healthReport is the body of the health and readiness endpoints.
+type healthReport struct {
+	// Ready is whether the instance can answer clients: the cache has been
+	// loaded and is not older than max_staleness.
+	Ready bool `json:"ready"`
+	// Reason explains why the instance is not ready.
+	Reason string `json:"reason,omitempty"`
+	// SMDReachable is whether the most recent cache refresh succeeded.
+	SMDReachable bool `json:"smd_reachable"`
+	// LastRefreshError is the error of the most recent refresh, if it
+	// failed.
+	LastRefreshError string    `json:"last_refresh_error,omitempty"`
+	LastRefresh      time.Time `json:"last_refresh"`
+	// CacheAgeSeconds is how old the cached data is, or -1 if the cache
+	// has not been loaded yet.
+	CacheAgeSeconds float64 `json:"cache_age_seconds"`
+	Components      int     `json:"components"`
+	Interfaces      int     `json:"interfaces"`
+	// CacheStale is whether the cache is older than staleness_alert. Unlike
+	// max_staleness, this does not make the instance unready.
+	CacheStale bool `json:"cache_stale"`
+	// ConfigValid is false if the last attempt to reload the configuration
+	// failed, in which case the previous configuration is still in use.
+	ConfigValid bool   `json:"config_valid"`
+	ConfigError string `json:"config_error,omitempty"`
+	// FailoverRole is "leader", "standby", or "unknown" while Redis is
+	// unreachable, if failover is enabled. A standby is ready, since it
+	// takes over without further notice.
+	FailoverRole string `json:"failover_role,omitempty"`
+}
+
+// health reports the state of the instance as of now.
+func (p *PluginState) health(now time.Time) healthReport {
+	snapshot := p.cache.Snapshot()
+	stats := p.cache.Stats()
+	r := healthReport{
+		SMDReachable:     !stats.LastSuccess.IsZero() && stats.LastError == "",
+		LastRefreshError: stats.LastError,
+		LastRefresh:      snapshot.LastUpdated,
+		CacheAgeSeconds:  -1,
+		CacheStale:       p.cacheStale.Load(),
+		Components:       len(snapshot.Components),
+		Interfaces:       len(snapshot.Interfaces),
+		ConfigValid:      true,
+		FailoverRole:     p.failover.role(now),
+	}
+	if err := p.reloadErr.Load(); err != nil {
+		r.ConfigValid, r.ConfigError = false, *err
+	}
+
+	maxStaleness := p.config.Load().maxStaleness
+	switch age := now.Sub(snapshot.LastUpdated); {
+	case snapshot.LastUpdated.IsZero():
+		r.Reason = "cache has not been loaded from SMD yet"
+	case maxStaleness > 0 && age > maxStaleness:
+		r.CacheAgeSeconds = age.Seconds()
+		r.Reason = "cache is older than max_staleness " + maxStaleness.String()
+	default:
+		r.CacheAgeSeconds = age.Seconds()
+		r.Ready = true
+	}
+
+	return r
+}
+
+// healthHandler serves the health endpoints of p. GET /healthz always answers
+// 200 while the process is running; GET /readyz answers 503 while the
+// instance is not ready. Both return a healthReport.
+func healthHandler(p *PluginState) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		writeJSON(w, http.StatusOK, p.health(time.Now()))
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		report := p.health(time.Now())
+		status := http.StatusOK
+		if !report.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		writeJSON(w, status, report)
+	})
+
+	return mux
+}
+
+// startHealthServer serves the health endpoints of p over plain HTTP on listen
+// and returns a function that closes the server.
+func startHealthServer(listen string, p *PluginState) (func(), error) {
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	s := &http.Server{Handler: healthHandler(p)}
+	go func() {
+		if err := s.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("health server failed: %v", err)
+		}
+	}()
+
+	return func() { s.Close() }, nil
+}
+
+// cacheAgeCheckInterval is how often the age of the cache is reported.
+const cacheAgeCheckInterval = 5 * time.Second
+
+// watchCacheAge reports the age of the cache and whether it is stale every
+// cacheAgeCheckInterval until ctx is canceled.
+func (p *PluginState) watchCacheAge(ctx context.Context) {
+	ticker := time.NewTicker(cacheAgeCheckInterval)
+	defer ticker.Stop()
+	for {
+		p.checkCacheAge(time.Now())
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkCacheAge sets the cache age metrics as of now, and logs when the cache
+// becomes older than staleness_alert and when it is refreshed again.
+func (p *PluginState) checkCacheAge(now time.Time) {
+	lastUpdated := p.cache.Snapshot().LastUpdated
+	if lastUpdated.IsZero() {
+		// Not loaded yet, which readiness already reports
+		metricCacheAge.Set(-1)
+		return
+	}
+	age := now.Sub(lastUpdated)
+	metricCacheAge.Set(age.Seconds())
+
+	threshold := p.config.Load().stalenessAlert
+	stale := threshold > 0 && age > threshold
+	if was := p.cacheStale.Swap(stale); was != stale {
+		if stale {
+			msg := fmt.Sprintf("SMD cache is stale: last refreshed %s ago, more than staleness_alert %s; clients are being answered from old data", age.Round(time.Second), threshold)
+			if lastErr := p.cache.Stats().LastError; lastErr != "" {
+				msg += ": last refresh failed: " + lastErr
+			}
+			log.Error(msg)
+		} else {
+			log.Infof("SMD cache is no longer stale: last refreshed %s ago", age.Round(time.Second))
+		}
+	}
+	value := 0.0
+	if stale {
+		value = 1
+	}
+	metricCacheStale.Set(value)
+}
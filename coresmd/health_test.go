@@ -0,0 +1,104 @@
+package coresmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func getHealth(t *testing.T, p *PluginState, path string) (int, healthReport) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	healthHandler(p).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	var report healthReport
+	if err := json.NewDecoder(rec.Body).Decode(&report); err != nil {
+		t.Fatalf("failed to decode %s response: %v", path, err)
+	}
+	return rec.Code, report
+}
+
+func TestHealthReady(t *testing.T) {
+	p := setupHandler(t)
+
+	code, report := getHealth(t, p, "/readyz")
+	if code != http.StatusOK || !report.Ready {
+		t.Fatalf("/readyz = %d, ready %t (%s), want 200 and ready", code, report.Ready, report.Reason)
+	}
+	if !report.SMDReachable || !report.ConfigValid {
+		t.Errorf("report = %+v, want SMD reachable and config valid", report)
+	}
+	if report.Components != 2 || report.Interfaces != 2 {
+		t.Errorf("counts = %d Components, %d interfaces, want 2 and 2", report.Components, report.Interfaces)
+	}
+}
+
+func TestHealthNotReady(t *testing.T) {
+	p := setupHandler(t)
+
+	// Stale cache
+	cfg := *p.config.Load()
+	cfg.maxStaleness = time.Minute
+	p.config.Store(&cfg)
+	report := p.health(time.Now().Add(time.Hour))
+	if report.Ready || report.Reason == "" {
+		t.Errorf("stale cache reported ready: %+v", report)
+	}
+
+	// Cache not loaded yet
+	c, err := NewCache("1m", NewFakeSmdClient(nil, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.cache = c
+	code, report := getHealth(t, p, "/readyz")
+	if code != http.StatusServiceUnavailable || report.Ready {
+		t.Errorf("/readyz before first refresh = %d, ready %t, want 503", code, report.Ready)
+	}
+	if code, _ := getHealth(t, p, "/healthz"); code != http.StatusOK {
+		t.Errorf("/healthz = %d, want 200", code)
+	}
+
+	// Failed reload
+	msg := "failed to load coredhcp.yaml"
+	p.reloadErr.Store(&msg)
+	if _, report := getHealth(t, p, "/healthz"); report.ConfigValid || report.ConfigError != msg {
+		t.Errorf("report after failed reload = %+v, want config invalid", report)
+	}
+}
+
+func TestCacheStale(t *testing.T) {
+	p := setupHandler(t)
+	p.config.Load().stalenessAlert = time.Hour
+	t.Cleanup(func() { metricCacheStale.Set(0) })
+
+	now := time.Now()
+	p.checkCacheAge(now.Add(time.Minute))
+	if p.health(now).CacheStale || sampleValue(metricCacheStale) != 0 {
+		t.Error("fresh cache reported stale")
+	}
+	if age := sampleValue(metricCacheAge); age < 59 || age > 61 {
+		t.Errorf("cache age = %v, want about 60", age)
+	}
+
+	// Stale, but still ready without max_staleness
+	p.checkCacheAge(now.Add(2 * time.Hour))
+	report := p.health(now.Add(2 * time.Hour))
+	if !report.CacheStale || !report.Ready || sampleValue(metricCacheStale) != 1 {
+		t.Errorf("stale cache: %+v", report)
+	}
+
+	// A refresh clears it
+	p.checkCacheAge(now)
+	if p.health(now).CacheStale || sampleValue(metricCacheStale) != 0 {
+		t.Error("refreshed cache reported stale")
+	}
+
+	// Disabled
+	p.config.Load().stalenessAlert = 0
+	p.checkCacheAge(now.Add(24 * time.Hour))
+	if p.health(now).CacheStale {
+		t.Error("stale with staleness_alert unset")
+	}
+}
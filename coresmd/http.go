@@ -0,0 +1,120 @@
+package coresmd
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/OpenCHAMI/coresmd/internal/ipxe"
+)
+
+// httpHandlers are the handlers of a plugin instance served by its HTTP
+// server next to the files.
+type httpHandlers struct {
+	// bootScript serves boot scripts at bootScriptPath.
+	bootScript http.HandlerFunc
+	// stage1 serves stage-1 scripts at stage1Path.
+	stage1 http.HandlerFunc
+	// rescue serves the boot scripts of nodes in rescue boot at rescuePath.
+	rescue http.HandlerFunc
+	// grubConfig serves GRUB configs at grubConfigPath.
+	grubConfig http.HandlerFunc
+	// grubStub returns the GRUB config stub for a requested file name, if
+	// it is one.
+	grubStub func(name string) (string, bool)
+	// binaries are the embedded iPXE binaries, served instead of the files
+	// of the same name.
+	binaries map[string]ipxe.Binary
+}
+
+// startHTTPServer serves files from directory on listen, using HTTPS if
+// tlsConfig is non-nil, and returns a function that closes the server.
+func startHTTPServer(listen, directory string, tlsConfig *tls.Config, h httpHandlers) (func(), error) {
+	mux := http.NewServeMux()
+	for name, script := range builtinScripts {
+		mux.HandleFunc("/"+name, serveScript(name, script))
+	}
+	mux.HandleFunc(bootScriptPath, h.bootScript)
+	mux.HandleFunc(stage1Path, h.stage1)
+	mux.HandleFunc(rescuePath, h.rescue)
+	mux.HandleFunc(grubConfigPath, h.grubConfig)
+	files := http.FileServer(http.Dir(directory))
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if stub, ok := h.grubStub(r.URL.Path); ok {
+			serveScript("GRUB config stub", stub)(w, r)
+			return
+		}
+		if b, ok := h.binaries[strings.TrimPrefix(r.URL.Path, "/")]; ok {
+			serveBinary(b)(w, r)
+			return
+		}
+		files.ServeHTTP(w, r)
+	})
+
+	s := &http.Server{
+		Handler:   logRequests(mux),
+		TLSConfig: tlsConfig,
+	}
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			// Certificates are already loaded into tlsConfig
+			err = s.ServeTLS(ln, "", "")
+		} else {
+			err = s.Serve(ln)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("HTTP server failed: %v", err)
+		}
+	}()
+
+	return func() { s.Close() }, nil
+}
+
+// serveScript returns a handler serving the built-in script with the given
+// name.
+func serveScript(name, script string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		nbytes, err := w.Write([]byte(script))
+		if err != nil {
+			log.Errorf("http: failed to send %s script to %s: %v", name, remoteIP(r), err)
+			return
+		}
+		log.Infof("http: sent %d bytes of %s script to %s", nbytes, name, remoteIP(r))
+	}
+}
+
+// serveBinary returns a handler serving the embedded iPXE binary b.
+func serveBinary(b ipxe.Binary) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("ETag", `"`+b.SHA256+`"`)
+		http.ServeContent(w, r, b.Name, time.Time{}, bytes.NewReader(b.Data))
+		log.Infof("http: sent embedded iPXE %s version %s (sha256 %s) to %s", b.Name, b.Version, b.SHA256, remoteIP(r))
+	}
+}
+
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Infof("http: %s requested file %s", remoteIP(r), strings.TrimPrefix(r.URL.Path, "/"))
+		next.ServeHTTP(w, r)
+	})
+}
+
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,99 @@
+package coresmd
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// guidLen is the length of an InfiniBand port GUID.
+const guidLen = 8
+
+// clientHWAddr returns the normalized hardware address of the client of req as
+// it is keyed in snapshot.
+//
+// For Ethernet and other hardware types carrying the address in chaddr, this is
+// the client hardware address. IPoIB clients (RFC 4390) send no chaddr, so the
+// port GUID at the end of their client identifier (option 61) is matched
+// against 8-byte GUIDs or 20-byte IPoIB hardware addresses stored in SMD.
+//
+// If clientIDFallback is set, clients whose client hardware address is not
+// found are matched by their client identifier instead.
+func clientHWAddr(snapshot *Snapshot, req *dhcpv4.DHCPv4, clientIDFallback bool) (string, error) {
+	if req.HWType != iana.HWTypeInfiniband {
+		mac := req.ClientHWAddr.String()
+		if _, ok := snapshot.EthernetInterfaces[mac]; !ok && clientIDFallback {
+			if cidMAC, ok := clientIDHWAddr(snapshot, req); ok {
+				log.Infof("hardware address %s not found, matched client identifier to hardware address %s", mac, cidMAC)
+				return cidMAC, nil
+			}
+		}
+		return mac, nil
+	}
+
+	guid, ok := portGUID(req)
+	if !ok {
+		return "", errors.New("InfiniBand client did not send a client identifier containing a port GUID")
+	}
+	mac, ok := snapshot.GUIDs[guid]
+	if !ok {
+		return "", fmt.Errorf("no EthernetInterfaces were found in cache for InfiniBand port GUID %s", guid)
+	}
+	log.Debugf("InfiniBand port GUID %s matches hardware address %s", guid, mac)
+
+	return mac, nil
+}
+
+// portGUID returns the port GUID at the end of the client identifier of an
+// IPoIB client.
+func portGUID(req *dhcpv4.DHCPv4) (string, bool) {
+	cid := req.Options.Get(dhcpv4.OptionClientIdentifier)
+	if len(cid) < guidLen {
+		return "", false
+	}
+	return net.HardwareAddr(cid[len(cid)-guidLen:]).String(), true
+}
+
+// clientKey returns the address identifying the client of req in the state
+// kept per client regardless of SMD, such as rate limits, MAC lists, and lease
+// records: its client hardware address or, for IPoIB clients, which send none,
+// the port GUID in their client identifier.
+func clientKey(req *dhcpv4.DHCPv4) string {
+	if req.HWType == iana.HWTypeInfiniband {
+		if guid, ok := portGUID(req); ok {
+			return guid
+		}
+	}
+	return req.ClientHWAddr.String()
+}
+
+// clientIDHWAddr matches the client identifier (option 61) of req against
+// snapshot. The identifier is first matched against identifiers declared in
+// EthernetInterface descriptions, then, if it consists of a hardware type and
+// address (RFC 2132), against hardware addresses.
+func clientIDHWAddr(snapshot *Snapshot, req *dhcpv4.DHCPv4) (string, bool) {
+	cid := req.Options.Get(dhcpv4.OptionClientIdentifier)
+	if len(cid) == 0 {
+		return "", false
+	}
+	if mac, ok := snapshot.ClientIDs[hex.EncodeToString(cid)]; ok {
+		return mac, true
+	}
+	if cid[0] == 0 {
+		// Type 0 identifiers are opaque, not hardware addresses
+		return "", false
+	}
+	mac, err := NormalizeMAC(hex.EncodeToString(cid[1:]))
+	if err != nil {
+		return "", false
+	}
+	if _, ok := snapshot.EthernetInterfaces[mac]; !ok {
+		return "", false
+	}
+
+	return mac, true
+}
@@ -0,0 +1,66 @@
+package coresmd
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// withIPoIB makes a request come from an IPoIB client with the port GUID guid,
+// which sends no client hardware address.
+func withIPoIB(guid net.HardwareAddr) dhcpv4.Modifier {
+	return func(d *dhcpv4.DHCPv4) {
+		d.HWType = iana.HWTypeInfiniband
+		d.ClientHWAddr = nil
+		cid := append([]byte{0xff, 0, 0, 0, 1, 0, 2, 0, 0, 0x02, 0xc9, 0, 1}, guid...)
+		d.UpdateOption(dhcpv4.OptClientIdentifier(cid))
+	}
+}
+
+func TestClientKey(t *testing.T) {
+	req, _ := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01")
+	if key := clientKey(req); key != "aa:bb:cc:dd:ee:01" {
+		t.Errorf("Ethernet client key is %q, want aa:bb:cc:dd:ee:01", key)
+	}
+	guid := net.HardwareAddr{0x00, 0x02, 0xc9, 0x03, 0x00, 0x00, 0x00, 0x01}
+	req, _ = newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", withIPoIB(guid))
+	if key := clientKey(req); key != guid.String() {
+		t.Errorf("IPoIB client key is %q, want %s", key, guid)
+	}
+}
+
+func TestIPoIBClientsKeptApart(t *testing.T) {
+	guids := []net.HardwareAddr{
+		{0x00, 0x02, 0xc9, 0x03, 0x00, 0x00, 0x00, 0x01},
+		{0x00, 0x02, 0xc9, 0x03, 0x00, 0x00, 0x00, 0x02},
+	}
+	now := time.Now()
+
+	// Rate limits
+	cfg := &pluginConfig{macRateLimit: newRateLimiter(1, 1)}
+	for _, guid := range guids {
+		req, _ := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", withIPoIB(guid))
+		if cfg.rateLimited(req, now) {
+			t.Errorf("first request from %s was rate limited", guid)
+		}
+	}
+
+	// Lease records
+	lt, err := newLeaseTracker("")
+	if err != nil {
+		t.Fatalf("newLeaseTracker: %v", err)
+	}
+	for i, guid := range guids {
+		req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", withIPoIB(guid))
+		lt.record(req, answer(resp, net.IPv4(172, 16, 2, byte(i+1)).String()), time.Minute, now)
+	}
+	if records := lt.list(); len(records) != 2 {
+		t.Fatalf("records are %+v, want one per client", records)
+	}
+	if m := lt.holder(net.IPv4(172, 16, 2, 1), guids[1].String(), now); m != guids[0].String() {
+		t.Errorf("holder of 172.16.2.1 is %q, want %s", m, guids[0])
+	}
+}
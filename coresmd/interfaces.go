@@ -0,0 +1,174 @@
+package coresmd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// servedInterface is a network interface that CoreDHCP listens on for directly
+// attached clients, optionally only serving clients with given MAC addresses
+// or OUIs, or only handing out addresses in given ranges on it.
+type servedInterface struct {
+	name   string
+	ranges []*net.IPNet
+	// macs is nil if clients are not restricted by MAC address
+	macs *macSet
+}
+
+// interfaceSet holds the interfaces coresmd serves directly attached clients
+// on and the subnets configured on them, which are re-read so that address
+// changes are picked up without a restart. It is safe for concurrent use.
+type interfaceSet struct {
+	ifaces []servedInterface
+	// subnets holds the subnets of each interface in ifaces
+	subnets atomic.Pointer[[][]*net.IPNet]
+}
+
+// interfaceSubnets returns the IPv4 subnets configured on the interface name.
+// It is a variable so that tests can fake interfaces.
+var interfaceSubnets = func(name string) ([]*net.IPNet, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var subnets []*net.IPNet
+	for _, addr := range addrs {
+		if ipn, ok := addr.(*net.IPNet); ok && ipn.IP.To4() != nil {
+			subnets = append(subnets, &net.IPNet{IP: ipn.IP.Mask(ipn.Mask), Mask: ipn.Mask})
+		}
+	}
+
+	return subnets, nil
+}
+
+// parseInterfaces parses a comma-separated list of interface names, each
+// optionally followed by a colon and a '+'-separated list of CIDRs to hand out
+// addresses from and MAC addresses or OUIs to serve, e.g.
+// 'eth1,eth2.100:10.100.0.0/24+aa:bb:cc'.
+func parseInterfaces(val string) ([]servedInterface, error) {
+	var ifaces []servedInterface
+	for _, entry := range strings.Split(val, ",") {
+		name, restrictions, _ := strings.Cut(strings.TrimSpace(entry), ":")
+		if name == "" {
+			return nil, fmt.Errorf("missing interface name in %q", entry)
+		}
+		iface := servedInterface{name: name}
+		if restrictions != "" {
+			for _, r := range strings.Split(restrictions, "+") {
+				if strings.Contains(r, "/") {
+					_, ipn, err := net.ParseCIDR(r)
+					if err != nil {
+						return nil, fmt.Errorf("invalid range for %s: %w", name, err)
+					}
+					iface.ranges = append(iface.ranges, ipn)
+					continue
+				}
+				if iface.macs == nil {
+					iface.macs = &macSet{macs: make(map[string]bool), ouis: make(map[string]bool)}
+				}
+				if oui, ok := parseOUI(r); ok {
+					iface.macs.ouis[oui] = true
+					continue
+				}
+				mac, err := NormalizeMAC(r)
+				if err != nil {
+					return nil, fmt.Errorf("invalid range, MAC address, or OUI for %s: %q", name, r)
+				}
+				iface.macs.macs[mac] = true
+			}
+		}
+		ifaces = append(ifaces, iface)
+	}
+
+	return ifaces, nil
+}
+
+// newInterfaceSet returns the set of ifaces after reading their subnets.
+func newInterfaceSet(ifaces []servedInterface) (*interfaceSet, error) {
+	s := &interfaceSet{ifaces: ifaces}
+	if err := s.load(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load re-reads the subnets of the interfaces.
+func (s *interfaceSet) load() error {
+	subnets := make([][]*net.IPNet, len(s.ifaces))
+	for i, iface := range s.ifaces {
+		var err error
+		if subnets[i], err = interfaceSubnets(iface.name); err != nil {
+			return fmt.Errorf("failed to read addresses of interface %s: %w", iface.name, err)
+		}
+	}
+	s.subnets.Store(&subnets)
+
+	return nil
+}
+
+// routable returns the addresses in ips that can be given to the client of req
+// with hardware address mac on the link its request arrived on or, if there
+// are none, why. A relayed request arrived on the link of the relay agent, and
+// the client must be given an address in its subnet, using the subnet mask set
+// in resp. Otherwise the client is attached to one of the interfaces, and must
+// be given an address in a subnet configured on one that serves it.
+func (s *interfaceSet) routable(req, resp *dhcpv4.DHCPv4, mac string, ips []net.IP) ([]net.IP, string) {
+	var routable []net.IP
+	if link := linkAddress(req); link != nil {
+		mask := resp.SubnetMask()
+		if mask == nil {
+			// There is nothing to tell the subnet of the link by
+			return ips, ""
+		}
+		subnet := net.IPNet{IP: link.Mask(mask), Mask: mask}
+		for _, ip := range ips {
+			if subnet.Contains(ip) {
+				routable = append(routable, ip)
+			}
+		}
+		if routable == nil {
+			return nil, fmt.Sprintf("no address in subnet %s of link address %s", subnet.String(), link)
+		}
+		return routable, ""
+	}
+
+	subnets := *s.subnets.Load()
+	var names []string
+	for i, iface := range s.ifaces {
+		if iface.macs != nil && !iface.macs.contains(mac) {
+			continue
+		}
+		names = append(names, iface.name)
+		for _, ip := range ips {
+			if containsIP(subnets[i], ip) && (iface.ranges == nil || containsIP(iface.ranges, ip)) {
+				routable = append(routable, ip)
+			}
+		}
+	}
+	if routable == nil {
+		if names == nil {
+			return nil, "not served on any interface"
+		}
+		return nil, fmt.Sprintf("no address that can be served on interface(s) %s", strings.Join(names, ", "))
+	}
+
+	return routable, ""
+}
+
+// containsIP reports whether any of subnets contains ip.
+func containsIP(subnets []*net.IPNet, ip net.IP) bool {
+	for _, subnet := range subnets {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,124 @@
+package coresmd
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestParseInterfaces(t *testing.T) {
+	ifaces, err := parseInterfaces("eth1,eth2.100:10.100.0.0/24+aa:bb:cc+AA-BB-CC-DD-EE-01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ifaces) != 2 || ifaces[0].name != "eth1" || ifaces[1].name != "eth2.100" {
+		t.Fatalf("got %+v", ifaces)
+	}
+	if ifaces[0].macs != nil || ifaces[0].ranges != nil {
+		t.Error("unrestricted interface has restrictions")
+	}
+	if len(ifaces[1].ranges) != 1 || ifaces[1].ranges[0].String() != "10.100.0.0/24" {
+		t.Errorf("ranges = %v", ifaces[1].ranges)
+	}
+	if !ifaces[1].macs.contains("aa:bb:cc:00:00:01") || !ifaces[1].macs.contains("aa:bb:cc:dd:ee:01") {
+		t.Error("MAC restrictions not parsed")
+	}
+
+	for _, val := range []string{":10.0.0.0/8", "eth1:10.0.0.0/33", "eth1:bogus"} {
+		if _, err := parseInterfaces(val); err == nil {
+			t.Errorf("%q accepted", val)
+		}
+	}
+}
+
+// fakeInterfaces makes interfaceSubnets return the subnets in ifaces until the
+// test ends.
+func fakeInterfaces(t *testing.T, ifaces map[string][]string) {
+	t.Helper()
+	orig := interfaceSubnets
+	interfaceSubnets = func(name string) ([]*net.IPNet, error) {
+		cidrs, ok := ifaces[name]
+		if !ok {
+			return nil, fmt.Errorf("no such interface")
+		}
+		var subnets []*net.IPNet
+		for _, cidr := range cidrs {
+			_, ipn, _ := net.ParseCIDR(cidr)
+			subnets = append(subnets, ipn)
+		}
+		return subnets, nil
+	}
+	t.Cleanup(func() { interfaceSubnets = orig })
+}
+
+func TestHandler4Interfaces(t *testing.T) {
+	fakeInterfaces(t, map[string][]string{
+		"eth1":     {"10.0.0.0/24"},
+		"eth2.100": {"172.16.0.0/24"},
+	})
+	p := setupHandler(t)
+	ifaces, err := parseInterfaces("eth1,eth2.100:172.16.0.0/30+aa:bb:cc:dd:ee:01")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := *p.config.Load()
+	if cfg.interfaces, err = newInterfaceSet(ifaces); err != nil {
+		t.Fatal(err)
+	}
+	cfg.outcomes = defaultOutcomeActions
+	p.config.Store(&cfg)
+
+	if _, err := newInterfaceSet([]servedInterface{{name: "eth9"}}); err == nil {
+		t.Error("missing interface accepted")
+	}
+
+	tests := []struct {
+		name   string
+		mac    string
+		mods   []dhcpv4.Modifier
+		wantIP net.IP // nil if dropped
+	}{
+		{
+			name:   "served on its interface",
+			mac:    "aa:bb:cc:dd:ee:01",
+			wantIP: net.IPv4(172, 16, 0, 1),
+		},
+		{
+			name: "not served on the interface with its subnet",
+			mac:  "aa:bb:cc:dd:ee:02",
+		},
+		{
+			name: "relayed from its subnet",
+			mac:  "aa:bb:cc:dd:ee:02",
+			mods: []dhcpv4.Modifier{
+				dhcpv4.WithGatewayIP(net.IPv4(172, 16, 0, 254)),
+			},
+			wantIP: net.IPv4(172, 16, 0, 2),
+		},
+		{
+			name: "relayed from another subnet",
+			mac:  "aa:bb:cc:dd:ee:01",
+			mods: []dhcpv4.Modifier{
+				dhcpv4.WithGatewayIP(net.IPv4(10, 0, 0, 254)),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, tt.mac, tt.mods...)
+			resp.UpdateOption(dhcpv4.OptSubnetMask(net.CIDRMask(24, 32)))
+			out, stop := p.Handler4(req, resp)
+			if tt.wantIP == nil {
+				if out != nil || !stop {
+					t.Errorf("got (%v, %t), want dropped", out, stop)
+				}
+				return
+			}
+			if out == nil || !out.YourIPAddr.Equal(tt.wantIP) {
+				t.Errorf("got %v, want yiaddr %s", out, tt.wantIP)
+			}
+		})
+	}
+}
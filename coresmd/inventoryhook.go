@@ -0,0 +1,136 @@
+package coresmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// defaultInventoryHookTimeout is how long an inventory webhook request or hook
+// command may take if inventory_hook_timeout is not set.
+const defaultInventoryHookTimeout = 30 * time.Second
+
+// inventoryHook notifies external automation (e.g. inventory intake or
+// alerting) when a cache refresh finds new interfaces or removed Components,
+// by POSTing the changes as JSON to a webhook and/or running a command with
+// them on its standard input.
+type inventoryHook struct {
+	webhook string
+	command []string
+	timeout time.Duration
+	client  *http.Client
+}
+
+// inventoryChange is the JSON document sent to inventory hooks.
+type inventoryChange struct {
+	Time              time.Time `json:"time"`
+	Added             []string  `json:"added"`
+	Removed           []string  `json:"removed"`
+	Changed           []string  `json:"changed"`
+	AddedComponents   []string  `json:"added_components"`
+	RemovedComponents []string  `json:"removed_components"`
+}
+
+// newInventoryHook returns a hook calling webhook and/or running command (split
+// on whitespace), or nil if both are empty.
+func newInventoryHook(webhook, command string, timeout time.Duration) *inventoryHook {
+	if webhook == "" && command == "" {
+		return nil
+	}
+	return &inventoryHook{
+		webhook: webhook,
+		command: strings.Fields(command),
+		timeout: timeout,
+		client:  &http.Client{Timeout: timeout},
+	}
+}
+
+// inventoryChanged reports whether d has new interfaces or removed
+// Components, which are what inventory hooks are fired for.
+func inventoryChanged(d SnapshotDiff) bool {
+	return len(d.Added) > 0 || len(d.RemovedComponents) > 0
+}
+
+// fire notifies the webhook and command of d in the background. A nil hook
+// does nothing.
+func (h *inventoryHook) fire(d SnapshotDiff) {
+	if h == nil {
+		return
+	}
+	body, err := json.Marshal(inventoryChange{
+		Time:              time.Now(),
+		Added:             d.Added,
+		Removed:           d.Removed,
+		Changed:           d.Changed,
+		AddedComponents:   d.AddedComponents,
+		RemovedComponents: d.RemovedComponents,
+	})
+	if err != nil {
+		log.Errorf("failed to encode inventory change: %v", err)
+		return
+	}
+
+	go func() {
+		if h.webhook != "" {
+			if err := h.post(body); err != nil {
+				log.Errorf("inventory webhook %s failed: %v", h.webhook, err)
+			} else {
+				log.Infof("notified inventory webhook %s", h.webhook)
+			}
+		}
+		if len(h.command) > 0 {
+			if err := h.run(body); err != nil {
+				log.Errorf("inventory hook %s failed: %v", h.command[0], err)
+			} else {
+				log.Infof("ran inventory hook %s", h.command[0])
+			}
+		}
+	}()
+}
+
+// notifyInventoryChange forgets the DNS records published for interfaces that
+// d changed, and fires the inventory hook of the current config if d has new
+// interfaces or removed Components.
+func (p *PluginState) notifyInventoryChange(d SnapshotDiff) {
+	p.dnsUpdates.forget(p.cache.Snapshot(), d)
+	if inventoryChanged(d) {
+		p.config.Load().inventoryHook.fire(d)
+	}
+}
+
+// post sends body to the webhook.
+func (h *inventoryHook) post(body []byte) error {
+	resp, err := h.client.Post(h.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// run runs the command with body on its standard input.
+func (h *inventoryHook) run(body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, h.command[0], h.command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		if len(out) > 0 {
+			return fmt.Errorf("%w: %s", err, bytes.TrimSpace(out))
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package coresmd
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testEI(mac, compID string, ips ...string) EthernetInterface {
+	ei := EthernetInterface{MACAddress: mac, ComponentID: compID}
+	for _, ip := range ips {
+		ei.IPAddresses = append(ei.IPAddresses, struct {
+			IPAddress string `json:"IPAddress"`
+		}{ip})
+	}
+	return ei
+}
+
+func TestInventoryHookWebhook(t *testing.T) {
+	received := make(chan inventoryChange, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var change inventoryChange
+		if err := json.NewDecoder(r.Body).Decode(&change); err != nil {
+			t.Errorf("decoding webhook body: %v", err)
+		}
+		received <- change
+	}))
+	defer srv.Close()
+
+	fake := NewFakeSmdClient(
+		[]EthernetInterface{testEI("aa:bb:cc:dd:ee:01", "x1000c0s0b0n0", "10.0.0.1")},
+		[]Component{{ID: "x1000c0s0b0n0", Type: "Node", NID: 1}},
+	)
+	c, err := NewCache("1h", fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hook := newInventoryHook(srv.URL, "", time.Second)
+	c.OnChange = func(d SnapshotDiff) {
+		if inventoryChanged(d) {
+			hook.fire(d)
+		}
+	}
+
+	// The first refresh and refreshes with only changed interfaces fire
+	// nothing
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	fake.Set(
+		[]EthernetInterface{testEI("aa:bb:cc:dd:ee:01", "x1000c0s0b0n0", "10.0.0.11")},
+		[]Component{{ID: "x1000c0s0b0n0", Type: "Node", NID: 1}},
+	)
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case change := <-received:
+		t.Fatalf("webhook called without new interfaces or removed Components: %+v", change)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	fake.Set(
+		[]EthernetInterface{testEI("aa:bb:cc:dd:ee:02", "x1000c0s1b0n0", "10.0.0.2")},
+		[]Component{{ID: "x1000c0s1b0n0", Type: "Node", NID: 2}},
+	)
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case change := <-received:
+		if !reflect.DeepEqual(change.Added, []string{"aa:bb:cc:dd:ee:02"}) {
+			t.Errorf("added = %v, want [aa:bb:cc:dd:ee:02]", change.Added)
+		}
+		if !reflect.DeepEqual(change.RemovedComponents, []string{"x1000c0s0b0n0"}) {
+			t.Errorf("removed_components = %v, want [x1000c0s0b0n0]", change.RemovedComponents)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("webhook was not called")
+	}
+}
+
+func TestInventoryHookCommand(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "change.json")
+	script := filepath.Join(t.TempDir(), "hook.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\ncat > "+out+"\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	hook := newInventoryHook("", script, time.Second)
+	if err := hook.run([]byte(`{"added":["aa:bb:cc:dd:ee:01"]}`)); err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	data, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"added":["aa:bb:cc:dd:ee:01"]}` {
+		t.Errorf("hook got %q on stdin", data)
+	}
+
+	if err := newInventoryHook("", "false", time.Second).run(nil); err == nil {
+		t.Error("failing hook: expected error")
+	}
+	if newInventoryHook("", "", time.Second) != nil {
+		t.Error("newInventoryHook with neither webhook nor command should return nil")
+	}
+}
@@ -0,0 +1,137 @@
+package coresmd
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/OpenCHAMI/coresmd/internal/ipxe"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/sirupsen/logrus"
+)
+
+// optionIPXEEncapsulated is the option holding the iPXE encapsulated options.
+var optionIPXEEncapsulated = dhcpv4.GenericOptionCode(175)
+
+// ipxeSetting describes an iPXE encapsulated option (see dhcp.h in the iPXE
+// sources) configurable with ipxe_options.
+type ipxeSetting struct {
+	code uint8
+	// kind is "int8", "uint8" or "string".
+	kind string
+}
+
+var ipxeSettings = map[string]ipxeSetting{
+	"priority":      {0x01, "int8"},
+	"keep-san":      {0x08, "uint8"},
+	"skip-san-boot": {0x09, "uint8"},
+	"scriptlet":     {0x51, "string"},
+	"syslogs":       {0x55, "string"},
+	"no-pxedhcp":    {0xb0, "uint8"},
+	"use-cached":    {0xb2, "uint8"},
+	"username":      {0xbe, "string"},
+	"password":      {0xbf, "string"},
+}
+
+// parseIPXEOptions parses a comma-separated list of <name>=<value> iPXE
+// settings and returns them encoded as the value of option 175.
+func parseIPXEOptions(val string) ([]byte, error) {
+	var b []byte
+	for _, entry := range strings.Split(val, ",") {
+		name, value, ok := strings.Cut(entry, "=")
+		setting, known := ipxeSettings[name]
+		if !ok || !known {
+			return nil, fmt.Errorf("invalid entry %q: expected <name>=<value> with a name of %s", entry, ipxeSettingNames())
+		}
+		var data []byte
+		switch setting.kind {
+		case "int8":
+			n, err := strconv.ParseInt(value, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value in entry %q: %w", entry, err)
+			}
+			data = []byte{byte(int8(n))}
+		case "uint8":
+			n, err := strconv.ParseUint(value, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid value in entry %q: %w", entry, err)
+			}
+			data = []byte{byte(n)}
+		default:
+			if len(value) > 255 {
+				return nil, fmt.Errorf("value of %s is longer than 255 bytes", name)
+			}
+			data = []byte(value)
+		}
+		b = append(b, setting.code, byte(len(data)))
+		b = append(b, data...)
+	}
+
+	return b, nil
+}
+
+func ipxeSettingNames() string {
+	names := make([]string, 0, len(ipxeSettings))
+	for name := range ipxeSettings {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return strings.Join(names, ", ")
+}
+
+// defaultIPXERequire are the features iPXE clients need to fetch their boot
+// script from the HTTP server.
+var defaultIPXERequire = []string{"http"}
+
+// missingIPXEFeatures returns the features in required that the iPXE client
+// sending req presents in option 175 that it lacks. Clients not presenting
+// their features are assumed to have them all.
+func missingIPXEFeatures(l *logrus.Entry, req *dhcpv4.DHCPv4, required []string) []string {
+	client, ok, err := ipxe.ParseClient(req)
+	if err != nil {
+		l.Warnf("invalid iPXE encapsulated options: %v", err)
+	}
+	if !ok {
+		return nil
+	}
+	l.Debugf("iPXE client version %q, features %s, bus type %d, device %04x:%04x",
+		client.Version, strings.Join(client.Features, ","), client.BusType, client.VendorID, client.DeviceID)
+	var missing []string
+	for _, f := range required {
+		if !client.Has(f) {
+			missing = append(missing, f)
+		}
+	}
+	return missing
+}
+
+// bootloadersFor returns the iPXE bootloaders served to clients, those driving
+// the NIC through the firmware if snp is set.
+func (cfg *pluginConfig) bootloadersFor(snp bool) ipxe.Bootloaders {
+	switch {
+	case snp && cfg.snpBootloaders != nil:
+		return cfg.snpBootloaders
+	case snp:
+		return ipxe.DefaultSNPBootloaders
+	case cfg.bootloaders != nil:
+		return cfg.bootloaders
+	}
+	return ipxe.DefaultBootloaders
+}
+
+// bootArch returns the architecture the bootloader of the client in req is
+// chosen for: among those it lists, the one bootloadersFor(snp).Select
+// prefers, or the first one if none has a bootloader. It returns false if the
+// client sent no valid architecture.
+func (cfg *pluginConfig) bootArch(req *dhcpv4.DHCPv4, snp bool) (iana.Arch, bool) {
+	archs, err := ipxe.ClientArchs(req)
+	if err != nil {
+		return 0, false
+	}
+	if arch, _, ok := cfg.bootloadersFor(snp).Select(archs); ok {
+		return arch, true
+	}
+	return archs[0], true
+}
@@ -0,0 +1,125 @@
+package coresmd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/OpenCHAMI/coresmd/internal/ipxe"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestIPXEOptions(t *testing.T) {
+	encoded, err := parseIPXEOptions("priority=-1,no-pxedhcp=1,scriptlet=dhcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []byte{0x01, 1, 0xff, 0xb0, 1, 1, 0x51, 4, 'd', 'h', 'c', 'p'}
+	if !bytes.Equal(encoded, want) {
+		t.Errorf("got % x, want % x", encoded, want)
+	}
+
+	for _, val := range []string{"priority", "priority=200", "no-pxedhcp=yes", "colour=blue"} {
+		if _, err := parseIPXEOptions(val); err == nil {
+			t.Errorf("expected %q to be rejected", val)
+		}
+	}
+
+	p := setupHandler(t)
+	p.config.Load().ipxeOptions = encoded
+	for _, isIPXE := range []bool{true, false} {
+		modifiers := []dhcpv4.Modifier{withArch(iana.EFI_X86_64)}
+		if isIPXE {
+			modifiers = append(modifiers, withIPXE())
+		}
+		req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", modifiers...)
+		resp, _ = p.Handler4(req, resp)
+		got := resp.Options.Get(optionIPXEEncapsulated)
+		if isIPXE && !bytes.Equal(got, encoded) {
+			t.Errorf("iPXE client: got option 175 % x, want % x", got, encoded)
+		}
+		if !isIPXE && got != nil {
+			t.Errorf("non-iPXE client: got option 175 % x", got)
+		}
+	}
+}
+
+// withIPXEFeatures makes the request present the given iPXE encapsulated
+// options, as iPXE does in option 175.
+func withIPXEFeatures(b ...byte) dhcpv4.Modifier {
+	return dhcpv4.WithOption(dhcpv4.OptGeneric(optionIPXEEncapsulated, b))
+}
+
+func TestParseIPXEClient(t *testing.T) {
+	req, _ := dhcpv4.New(withIPXEFeatures(
+		0xeb, 3, 1, 21, 1, // version
+		0x13, 1, 1, // http
+		0x24, 1, 1, // efi
+		0xb1, 5, 7, 0x80, 0x86, 0x15, 0x72, // EFI bus, 8086:1572
+	))
+	client, ok, err := ipxe.ParseClient(req)
+	if err != nil || !ok {
+		t.Fatalf("ParseClient = %v, %v", ok, err)
+	}
+	if client.Version != "1.21.1" || !client.Has("http") || !client.Has("efi") || client.Has("https") {
+		t.Errorf("got %+v", client)
+	}
+	if client.BusType != ipxe.BusTypeEFI || client.VendorID != 0x8086 || client.DeviceID != 0x1572 {
+		t.Errorf("got bus %d, device %04x:%04x", client.BusType, client.VendorID, client.DeviceID)
+	}
+
+	req, _ = dhcpv4.New(withIPXEFeatures(0x13, 5, 1))
+	if _, _, err := ipxe.ParseClient(req); err == nil {
+		t.Error("truncated options accepted")
+	}
+	if _, err := ipxe.ParseFeatures("http,gopher"); err == nil {
+		t.Error("unknown feature accepted")
+	}
+}
+
+func TestHandler4IPXEFeatures(t *testing.T) {
+	p := setupHandler(t)
+	p.config.Load().ipxeRequire = defaultIPXERequire
+	bootfile := func(mods ...dhcpv4.Modifier) string {
+		t.Helper()
+		req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", mods...)
+		got, _ := p.Handler4(req, resp)
+		return got.BootFileNameOption()
+	}
+	script := "http://172.16.0.253:8081/boot/v1/bootscript?mac=aa:bb:cc:dd:ee:01"
+
+	// iPXE clients with HTTP, or not presenting their features, get their
+	// boot script
+	if got := bootfile(withArch(iana.EFI_X86_64), withIPXE(), withIPXEFeatures(0x13, 1, 1)); got != script {
+		t.Errorf("iPXE with http: got boot file %q", got)
+	}
+	if got := bootfile(withArch(iana.EFI_X86_64), withIPXE()); got != script {
+		t.Errorf("iPXE without option 175: got boot file %q", got)
+	}
+
+	// Those without are chainloaded to an iPXE using the firmware's driver
+	for arch, want := range map[iana.Arch]string{
+		iana.EFI_X86_64:  "snponly-x86_64.efi",
+		iana.INTEL_X86PC: "undionly.kpxe",
+	} {
+		if got := bootfile(withArch(arch), withIPXE(), withIPXEFeatures(0x15, 1, 1)); got != want {
+			t.Errorf("iPXE without http, arch %d: got boot file %q, want %q", arch, got, want)
+		}
+	}
+
+	// Nodes selected by snp_only always get SNP bootloaders
+	cfg := p.config.Load()
+	cfg.snpOnly = parseNodeSelector("role:compute")
+	var err error
+	if cfg.snpBootloaders, err = ipxe.DefaultSNPBootloaders.Merge("11:snp-arm64.efi"); err != nil {
+		t.Fatal(err)
+	}
+	for arch, want := range map[iana.Arch]string{
+		iana.EFI_X86_64: "snponly-x86_64.efi",
+		iana.EFI_ARM64:  "snp-arm64.efi",
+	} {
+		if got := bootfile(withArch(arch)); got != want {
+			t.Errorf("snp_only, arch %d: got boot file %q, want %q", arch, got, want)
+		}
+	}
+}
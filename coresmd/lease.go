@@ -0,0 +1,99 @@
+package coresmd
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// leasePolicy holds the lease duration and the renewal (T1) and rebinding (T2)
+// times given to a client. The renewal and rebinding times are not sent if
+// zero, in which case clients default to 50% and 87.5% of the lease duration.
+type leasePolicy struct {
+	lease     time.Duration
+	renewal   time.Duration
+	rebinding time.Duration
+}
+
+// leasePolicyFor returns the lease policy for Components of type compType.
+func (cfg *pluginConfig) leasePolicyFor(compType string) leasePolicy {
+	if lp, ok := cfg.leasePolicies[compType]; ok {
+		return lp
+	}
+
+	return cfg.defaultLeasePolicy
+}
+
+// apply sets the lease time, renewal time, and rebinding time options in resp.
+func (p leasePolicy) apply(resp *dhcpv4.DHCPv4) {
+	resp.Options.Update(dhcpv4.OptIPAddressLeaseTime(p.lease))
+	if p.renewal > 0 {
+		resp.Options.Update(dhcpv4.OptRenewTimeValue(p.renewal))
+	}
+	if p.rebinding > 0 {
+		resp.Options.Update(dhcpv4.OptRebindingTimeValue(p.rebinding))
+	}
+}
+
+func (p leasePolicy) String() string {
+	s := fmt.Sprintf("lease %s", p.lease)
+	if p.renewal > 0 {
+		s += fmt.Sprintf(", T1 %s", p.renewal)
+	}
+	if p.rebinding > 0 {
+		s += fmt.Sprintf(", T2 %s", p.rebinding)
+	}
+
+	return s
+}
+
+// validate checks that the renewal time precedes the rebinding time and both
+// precede the end of the lease, as required by RFC 2131.
+func (p leasePolicy) validate() error {
+	if p.lease <= 0 {
+		return fmt.Errorf("lease duration must be positive, got %s", p.lease)
+	}
+	if p.renewal < 0 || p.rebinding < 0 {
+		return fmt.Errorf("renewal and rebinding times must not be negative")
+	}
+	if p.renewal > 0 && p.renewal >= p.lease {
+		return fmt.Errorf("renewal time %s must be less than lease duration %s", p.renewal, p.lease)
+	}
+	if p.rebinding > 0 && p.rebinding >= p.lease {
+		return fmt.Errorf("rebinding time %s must be less than lease duration %s", p.rebinding, p.lease)
+	}
+	if p.renewal > 0 && p.rebinding > 0 && p.renewal >= p.rebinding {
+		return fmt.Errorf("renewal time %s must be less than rebinding time %s", p.renewal, p.rebinding)
+	}
+
+	return nil
+}
+
+// parseLeasePolicies parses a comma-separated list of
+// <type>:<lease>[:<renewal>[:<rebinding>]] entries.
+func parseLeasePolicies(val string) (map[string]leasePolicy, error) {
+	policies := make(map[string]leasePolicy)
+	for _, entry := range strings.Split(val, ",") {
+		fields := strings.Split(entry, ":")
+		if len(fields) < 2 || len(fields) > 4 || fields[0] == "" {
+			return nil, fmt.Errorf("invalid entry %q: expected <type>:<lease>[:<renewal>[:<rebinding>]]", entry)
+		}
+		var durations [3]time.Duration
+		for i, f := range fields[1:] {
+			d, err := time.ParseDuration(f)
+			if err != nil {
+				return nil, fmt.Errorf("invalid duration in entry %q: %w", entry, err)
+			}
+			durations[i] = d
+		}
+		p := leasePolicy{lease: durations[0], renewal: durations[1], rebinding: durations[2]}
+		if err := p.validate(); err != nil {
+			return nil, fmt.Errorf("invalid entry %q: %w", entry, err)
+		}
+		policies[fields[0]] = p
+	}
+
+	return policies, nil
+}
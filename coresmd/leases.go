@@ -0,0 +1,446 @@
+package coresmd
+
+import (
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	// defaultOfferHold is how long an offered address is held for the
+	// client it was offered to if offer_hold is not set.
+	defaultOfferHold = time.Minute
+	// leaseSweepInterval is how often expired records are forgotten.
+	leaseSweepInterval = time.Minute
+)
+
+// Lease states
+const (
+	leaseOffered  = "offered"
+	leaseBound    = "bound"
+	leaseReleased = "released"
+	leaseDeclined = "declined"
+)
+
+// leaseRecord is the latest transaction with a client.
+type leaseRecord struct {
+	MAC   string `json:"mac"`
+	IP    string `json:"ip"`
+	XID   string `json:"xid"`
+	State string `json:"state"`
+	// FirstSeen is when the client was first offered or leased IP, and
+	// Updated when the record last changed.
+	FirstSeen time.Time `json:"first_seen"`
+	Updated   time.Time `json:"updated"`
+	// Expires is when the offer or lease runs out.
+	Expires time.Time `json:"expires"`
+}
+
+// active reports whether the client holds the address at now.
+func (r *leaseRecord) active(now time.Time) bool {
+	return (r.State == leaseOffered || r.State == leaseBound) && now.Before(r.Expires)
+}
+
+// leaseTracker records the addresses offered and leased to each client. SMD
+// decides which address a client gets, so the tracker is not needed to assign
+// them; it keeps answers consistent across duplicate DISCOVERs and overlapping
+// transactions, and records what was handed out for troubleshooting. Records
+// are kept in memory and, optionally, in a SQLite database so that they
+// survive restarts. If shared is set, records are also shared with other
+// servers, and theirs take precedence. A nil tracker records nothing. It is
+// safe for concurrent use.
+//
+// Records are split into shards by MAC address and indexed by address so that
+// requests from different clients neither wait on each other nor scan every
+// record. Changes are written to the database in batches by a background
+// goroutine rather than by the requests making them.
+type leaseTracker struct {
+	shards [numShards]leaseShard
+	// holders maps each address to the MAC address of the latest record
+	// holding it.
+	holders sync.Map
+	shared  *sharedState
+
+	db *sql.DB
+	// pending holds the changes not yet written to db by MAC address, nil
+	// meaning the record was forgotten.
+	pendingMu sync.Mutex
+	pending   map[string]*leaseRecord
+	wake      chan struct{}
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// leaseShard holds the records of the clients whose MAC addresses fall in it.
+type leaseShard struct {
+	mu        sync.Mutex
+	leases    map[string]*leaseRecord
+	lastSweep time.Time
+}
+
+// newLeaseTracker returns a tracker persisting its records in the SQLite
+// database at dbPath, if set, after loading those not yet expired.
+func newLeaseTracker(dbPath string) (*leaseTracker, error) {
+	lt := &leaseTracker{}
+	for i := range lt.shards {
+		lt.shards[i].leases = make(map[string]*leaseRecord)
+	}
+	if dbPath == "" {
+		return lt, nil
+	}
+
+	db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s", dbPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lease database: %w", err)
+	}
+	if _, err := db.Exec("create table if not exists coresmd_leases (mac string not null primary key, ip string not null, xid string not null, state string not null, first_seen int, updated int, expires int)"); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create lease table: %w", err)
+	}
+	rows, err := db.Query("select mac, ip, xid, state, first_seen, updated, expires from coresmd_leases where expires > ?", time.Now().Unix())
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to query lease database: %w", err)
+	}
+	defer rows.Close()
+	n := 0
+	for rows.Next() {
+		var (
+			r                         leaseRecord
+			firstSeen, updated, until int64
+		)
+		if err := rows.Scan(&r.MAC, &r.IP, &r.XID, &r.State, &firstSeen, &updated, &until); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("failed to scan lease: %w", err)
+		}
+		r.FirstSeen, r.Updated, r.Expires = time.Unix(firstSeen, 0), time.Unix(updated, 0), time.Unix(until, 0)
+		lt.shards[shardOf(r.MAC)].leases[r.MAC] = &r
+		lt.holders.Store(r.IP, r.MAC)
+		n++
+	}
+	if err := rows.Err(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to scan leases: %w", err)
+	}
+	lt.db = db
+	lt.pending = make(map[string]*leaseRecord)
+	lt.wake = make(chan struct{}, 1)
+	lt.stop = make(chan struct{})
+	lt.stopped = make(chan struct{})
+	go lt.persist()
+	log.Infof("loaded %d leases from %s", n, dbPath)
+
+	return lt, nil
+}
+
+// record updates the record of the client of req after coresmd answered it
+// with resp (nil if it did not), holding offered addresses for offerHold.
+// Messages that do not name an address leave the record alone.
+func (lt *leaseTracker) record(req, resp *dhcpv4.DHCPv4, offerHold time.Duration, now time.Time) {
+	if lt == nil {
+		return
+	}
+	mac := clientKey(req)
+	var r leaseRecord
+	switch {
+	case req.MessageType() == dhcpv4.MessageTypeInform:
+		// The client was not assigned anything
+		return
+	case req.MessageType() == dhcpv4.MessageTypeRelease:
+		r = leaseRecord{IP: specifiedIP(req.ClientIPAddr), State: leaseReleased, Expires: now}
+	case req.MessageType() == dhcpv4.MessageTypeDecline:
+		r = leaseRecord{IP: specifiedIP(req.RequestedIPAddress()), State: leaseDeclined, Expires: now}
+	case resp == nil:
+		return
+	case resp.MessageType() == dhcpv4.MessageTypeOffer:
+		r = leaseRecord{IP: specifiedIP(resp.YourIPAddr), State: leaseOffered, Expires: now.Add(offerHold)}
+	case resp.MessageType() == dhcpv4.MessageTypeAck:
+		r = leaseRecord{IP: specifiedIP(resp.YourIPAddr), State: leaseBound, Expires: now.Add(resp.IPAddressLeaseTime(0))}
+	case resp.MessageType() == dhcpv4.MessageTypeNak:
+		lt.forget(mac)
+		return
+	default:
+		return
+	}
+	if r.IP == "" {
+		return
+	}
+	r.MAC, r.XID, r.Updated, r.FirstSeen = mac, req.TransactionID.String(), now, now
+
+	s := &lt.shards[shardOf(mac)]
+	s.mu.Lock()
+	lt.sweep(s, now)
+	if prev, ok := s.leases[mac]; ok {
+		if prev.IP == r.IP && prev.active(now) {
+			r.FirstSeen = prev.FirstSeen
+		} else if prev.IP != r.IP {
+			lt.holders.CompareAndDelete(prev.IP, mac)
+		}
+	}
+	s.leases[mac] = &r
+	lt.holders.Store(r.IP, mac)
+	lt.save(mac, &r)
+	s.mu.Unlock()
+
+	if lt.shared != nil {
+		lt.shared.queueLease(r, now)
+	}
+}
+
+// specifiedIP returns ip as a string, or "" if it is unset or 0.0.0.0.
+func specifiedIP(ip net.IP) string {
+	if ip == nil || ip.IsUnspecified() {
+		return ""
+	}
+	return ip.String()
+}
+
+// forget removes the record of mac.
+func (lt *leaseTracker) forget(mac string) {
+	s := &lt.shards[shardOf(mac)]
+	s.mu.Lock()
+	if r, ok := s.leases[mac]; ok {
+		lt.holders.CompareAndDelete(r.IP, mac)
+		delete(s.leases, mac)
+	}
+	lt.save(mac, nil)
+	s.mu.Unlock()
+
+	if lt.shared != nil {
+		lt.shared.deleteLease(mac)
+	}
+}
+
+// forgetOffer removes the record of mac if it was only offered an address, as
+// when it accepts another server's offer instead. Shared records are left
+// alone since the other server may share them.
+func (lt *leaseTracker) forgetOffer(mac string) {
+	if lt == nil {
+		return
+	}
+	s := &lt.shards[shardOf(mac)]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.leases[mac]; ok && r.State == leaseOffered {
+		lt.holders.CompareAndDelete(r.IP, mac)
+		delete(s.leases, mac)
+		lt.save(mac, nil)
+	}
+}
+
+// sweep forgets the expired records in s every leaseSweepInterval so that the
+// map does not grow without bounds. s.mu must be held.
+func (lt *leaseTracker) sweep(s *leaseShard, now time.Time) {
+	if now.Sub(s.lastSweep) < leaseSweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for mac, r := range s.leases {
+		if !now.Before(r.Expires) {
+			lt.holders.CompareAndDelete(r.IP, mac)
+			delete(s.leases, mac)
+		}
+	}
+}
+
+// save queues r, or the deletion of the record of mac if r is nil, to be
+// written to the database. The shard of mac must be locked so that changes to
+// the same record are queued in order.
+func (lt *leaseTracker) save(mac string, r *leaseRecord) {
+	if lt.db == nil {
+		return
+	}
+	lt.pendingMu.Lock()
+	lt.pending[mac] = r
+	lt.pendingMu.Unlock()
+	select {
+	case lt.wake <- struct{}{}:
+	default:
+	}
+}
+
+// persist writes queued changes to the database until the tracker is closed,
+// batching those made while the previous batch was written into a single
+// transaction. Expired records are deleted every leaseSweepInterval.
+func (lt *leaseTracker) persist() {
+	defer close(lt.stopped)
+	var lastSweep time.Time
+	for {
+		select {
+		case <-lt.wake:
+		case <-lt.stop:
+			lt.flush()
+			return
+		}
+		lt.flush()
+		if now := time.Now(); now.Sub(lastSweep) >= leaseSweepInterval {
+			lastSweep = now
+			if _, err := lt.db.Exec("delete from coresmd_leases where expires <= ?", now.Unix()); err != nil {
+				log.Errorf("failed to delete expired leases: %v", err)
+			}
+		}
+	}
+}
+
+// flush writes the queued changes to the database in one transaction.
+func (lt *leaseTracker) flush() {
+	lt.pendingMu.Lock()
+	pending := lt.pending
+	lt.pending = make(map[string]*leaseRecord, len(pending))
+	lt.pendingMu.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+
+	tx, err := lt.db.Begin()
+	if err != nil {
+		log.Errorf("failed to save %d leases: %v", len(pending), err)
+		return
+	}
+	for mac, r := range pending {
+		if r == nil {
+			_, err = tx.Exec("delete from coresmd_leases where mac = ?", mac)
+		} else {
+			_, err = tx.Exec("insert or replace into coresmd_leases (mac, ip, xid, state, first_seen, updated, expires) values (?, ?, ?, ?, ?, ?, ?)",
+				r.MAC, r.IP, r.XID, r.State, r.FirstSeen.Unix(), r.Updated.Unix(), r.Expires.Unix())
+		}
+		if err != nil {
+			log.Errorf("failed to save lease for %s: %v", mac, err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		log.Errorf("failed to save %d leases: %v", len(pending), err)
+	}
+}
+
+// heldIP returns the address currently offered or leased to mac, or nil.
+func (lt *leaseTracker) heldIP(mac string, now time.Time) net.IP {
+	if lt == nil {
+		return nil
+	}
+	if lt.shared != nil {
+		r, err := lt.shared.lease(mac, now)
+		if err == nil {
+			if r == nil {
+				return nil
+			}
+			return net.ParseIP(r.IP).To4()
+		}
+		log.Errorf("failed to get shared lease for %s, using local record: %v", mac, err)
+	}
+	if r, ok := lt.active(mac, now); ok {
+		return net.ParseIP(r.IP).To4()
+	}
+	return nil
+}
+
+// active returns the record of mac if it is active at now.
+func (lt *leaseTracker) active(mac string, now time.Time) (leaseRecord, bool) {
+	s := &lt.shards[shardOf(mac)]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r, ok := s.leases[mac]; ok && r.active(now) {
+		return *r, true
+	}
+	return leaseRecord{}, false
+}
+
+// holder returns the MAC address of another client than mac currently
+// offered or leased ip, or "".
+func (lt *leaseTracker) holder(ip net.IP, mac string, now time.Time) string {
+	if lt == nil {
+		return ""
+	}
+	if lt.shared != nil {
+		m, err := lt.shared.holder(ip.String(), now)
+		if err == nil {
+			if m == mac {
+				return ""
+			}
+			return m
+		}
+		log.Errorf("failed to get shared holder of %s, using local records: %v", ip, err)
+	}
+	addr := ip.String()
+	m, ok := lt.holders.Load(addr)
+	if !ok || m.(string) == mac {
+		return ""
+	}
+	if r, ok := lt.active(m.(string), now); ok && r.IP == addr {
+		return r.MAC
+	}
+	return ""
+}
+
+// list returns the records, sorted by MAC address.
+func (lt *leaseTracker) list() []leaseRecord {
+	if lt == nil {
+		return nil
+	}
+	var records []leaseRecord
+	for i := range lt.shards {
+		s := &lt.shards[i]
+		s.mu.Lock()
+		for _, r := range s.leases {
+			records = append(records, *r)
+		}
+		s.mu.Unlock()
+	}
+	if records == nil {
+		records = []leaseRecord{}
+	}
+	sort.Slice(records, func(i, j int) bool { return records[i].MAC < records[j].MAC })
+	return records
+}
+
+// Close writes the queued changes to the lease database, if any, and closes
+// it.
+func (lt *leaseTracker) Close() {
+	if lt.db == nil {
+		return
+	}
+	lt.closeOnce.Do(func() {
+		close(lt.stop)
+		<-lt.stopped
+		if err := lt.db.Close(); err != nil {
+			log.Errorf("failed to close lease database: %v", err)
+		}
+	})
+}
+
+// keepHeldIP returns the address to assign to mac instead of assigned: the one
+// it was already offered or leased, if that is still one of its addresses.
+// This keeps duplicate DISCOVERs and the REQUEST following an OFFER from
+// being answered with different addresses of a client that has several.
+func (p *PluginState) keepHeldIP(mac string, assigned net.IP, ipList []net.IP, now time.Time) (net.IP, bool) {
+	held := p.leases.heldIP(mac, now)
+	if held == nil || held.Equal(assigned) {
+		return assigned, false
+	}
+	for _, ip := range ipList {
+		if ip.Equal(held) {
+			return held, true
+		}
+	}
+	return assigned, false
+}
+
+// adminLeases lists the offers and leases recorded by the lease tracker.
+func (p *PluginState) adminLeases(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	leases := p.leases.list()
+	if leases == nil {
+		leases = []leaseRecord{}
+	}
+	writeJSON(w, http.StatusOK, leases)
+}
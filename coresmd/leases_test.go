@@ -0,0 +1,150 @@
+package coresmd
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// answer returns resp with the assigned address ip and a lease of an hour.
+func answer(resp *dhcpv4.DHCPv4, ip string) *dhcpv4.DHCPv4 {
+	resp.YourIPAddr = net.ParseIP(ip).To4()
+	resp.UpdateOption(dhcpv4.OptIPAddressLeaseTime(time.Hour))
+	return resp
+}
+
+func TestLeaseTracker(t *testing.T) {
+	db := filepath.Join(t.TempDir(), "leases.db")
+	lt, err := newLeaseTracker(db)
+	if err != nil {
+		t.Fatalf("newLeaseTracker: %v", err)
+	}
+	now := time.Now()
+
+	// Offers are held for offerHold
+	req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01")
+	lt.record(req, answer(resp, "172.16.0.1"), time.Minute, now)
+	if ip := lt.heldIP("aa:bb:cc:dd:ee:01", now); !ip.Equal(net.IPv4(172, 16, 0, 1)) {
+		t.Errorf("held IP after OFFER is %v, want 172.16.0.1", ip)
+	}
+	if ip := lt.heldIP("aa:bb:cc:dd:ee:01", now.Add(2*time.Minute)); ip != nil {
+		t.Errorf("offer still held after offer_hold: %v", ip)
+	}
+	if m := lt.holder(net.IPv4(172, 16, 0, 1), "aa:bb:cc:dd:ee:02", now); m != "aa:bb:cc:dd:ee:01" {
+		t.Errorf("holder is %q, want aa:bb:cc:dd:ee:01", m)
+	}
+	if m := lt.holder(net.IPv4(172, 16, 0, 1), "aa:bb:cc:dd:ee:01", now); m != "" {
+		t.Errorf("client was reported as holding its own address from %q", m)
+	}
+
+	// Leases last for the lease time and keep when they were first seen
+	req, resp = newRequest(t, dhcpv4.MessageTypeRequest, "aa:bb:cc:dd:ee:01")
+	lt.record(req, answer(resp, "172.16.0.1"), time.Minute, now.Add(time.Second))
+	records := lt.list()
+	if len(records) != 1 {
+		t.Fatalf("%d records, want 1", len(records))
+	}
+	if r := records[0]; r.State != leaseBound || !r.FirstSeen.Equal(now) || !r.Expires.Equal(now.Add(time.Second+time.Hour)) {
+		t.Errorf("record after ACK is %+v, want bound, first seen at %s, expiring in an hour", r, now)
+	}
+
+	// Records persist across restarts
+	lt.Close()
+	lt, err = newLeaseTracker(db)
+	if err != nil {
+		t.Fatalf("newLeaseTracker: %v", err)
+	}
+	defer lt.Close()
+	if ip := lt.heldIP("aa:bb:cc:dd:ee:01", now.Add(time.Minute)); !ip.Equal(net.IPv4(172, 16, 0, 1)) {
+		t.Errorf("held IP after restart is %v, want 172.16.0.1", ip)
+	}
+
+	// Released addresses are no longer held
+	req, _ = newRequest(t, dhcpv4.MessageTypeRelease, "aa:bb:cc:dd:ee:01")
+	req.ClientIPAddr = net.IPv4(172, 16, 0, 1).To4()
+	lt.record(req, nil, time.Minute, now.Add(2*time.Minute))
+	if ip := lt.heldIP("aa:bb:cc:dd:ee:01", now.Add(2*time.Minute)); ip != nil {
+		t.Errorf("released address still held: %v", ip)
+	}
+	if r := lt.list(); len(r) != 1 || r[0].State != leaseReleased {
+		t.Errorf("records after RELEASE are %+v, want one released", r)
+	}
+}
+
+func TestLeaseTrackerUnassigned(t *testing.T) {
+	lt, err := newLeaseTracker("")
+	if err != nil {
+		t.Fatalf("newLeaseTracker: %v", err)
+	}
+	now := time.Now()
+
+	// Replies without an address, and DECLINEs and RELEASEs not naming
+	// one, are not recorded
+	req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01")
+	lt.record(req, resp, time.Minute, now)
+	req, _ = newRequest(t, dhcpv4.MessageTypeDecline, "aa:bb:cc:dd:ee:01")
+	lt.record(req, nil, time.Minute, now)
+	req, _ = newRequest(t, dhcpv4.MessageTypeRelease, "aa:bb:cc:dd:ee:01")
+	lt.record(req, nil, time.Minute, now)
+	if r := lt.list(); len(r) != 0 {
+		t.Errorf("records are %+v, want none", r)
+	}
+	if m := lt.holder(net.IPv4zero, "aa:bb:cc:dd:ee:02", now); m != "" {
+		t.Errorf("0.0.0.0 is held by %s", m)
+	}
+}
+
+func TestHandler4PassedOnNotRecorded(t *testing.T) {
+	p := setupHandler(t)
+	lt, err := newLeaseTracker("")
+	if err != nil {
+		t.Fatalf("newLeaseTracker: %v", err)
+	}
+	p.leases = lt
+
+	// Unknown clients are passed on to the next plugins by default
+	req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:99")
+	if _, stop := p.Handler4(req, resp); stop {
+		t.Fatal("request from an unknown client was not passed on")
+	}
+	req, resp = newRequest(t, dhcpv4.MessageTypeDecline, "aa:bb:cc:dd:ee:01")
+	p.Handler4(req, resp)
+	if r := lt.list(); len(r) != 0 {
+		t.Errorf("records are %+v, want none", r)
+	}
+}
+
+func TestNilLeaseTracker(t *testing.T) {
+	var lt *leaseTracker
+	req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01")
+	lt.record(req, answer(resp, "172.16.0.1"), time.Minute, time.Now())
+	if ip := lt.heldIP("aa:bb:cc:dd:ee:01", time.Now()); ip != nil {
+		t.Errorf("nil tracker holds %v", ip)
+	}
+	if r := lt.list(); r != nil {
+		t.Errorf("nil tracker lists %v", r)
+	}
+}
+
+func TestKeepHeldIP(t *testing.T) {
+	lt, err := newLeaseTracker("")
+	if err != nil {
+		t.Fatalf("newLeaseTracker: %v", err)
+	}
+	p := &PluginState{leases: lt}
+	now := time.Now()
+	req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01")
+	lt.record(req, answer(resp, "172.16.1.1"), time.Minute, now)
+
+	ipList := []net.IP{net.IPv4(172, 16, 0, 1), net.IPv4(172, 16, 1, 1)}
+	if ip, kept := p.keepHeldIP("aa:bb:cc:dd:ee:01", ipList[0], ipList, now); !kept || !ip.Equal(ipList[1]) {
+		t.Errorf("keepHeldIP = %v, %t; want offered address 172.16.1.1", ip, kept)
+	}
+	// An address no longer assigned in SMD is not kept
+	if ip, kept := p.keepHeldIP("aa:bb:cc:dd:ee:01", ipList[0], ipList[:1], now); kept || !ip.Equal(ipList[0]) {
+		t.Errorf("keepHeldIP = %v, %t; want assigned address 172.16.0.1", ip, kept)
+	}
+}
@@ -0,0 +1,261 @@
+package coresmd
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// States of the node boot lifecycle, in the order a node normally goes
+// through them on each boot.
+const (
+	stateDiscovered = "DISCOVERED"
+	stateOffered    = "OFFERED"
+	stateAcked      = "ACKED"
+	stateIPXE       = "IPXE"
+	stateScripted   = "SCRIPTED"
+	// stateUnseen is listed by the admin API for Nodes in SMD that have not
+	// sent a request since coresmd started.
+	stateUnseen = "UNSEEN"
+)
+
+// lifecycleStates are the states a node can be listed in, in order.
+var lifecycleStates = []string{stateUnseen, stateDiscovered, stateOffered, stateAcked, stateIPXE, stateScripted}
+
+// lifecycleEvents is how many transitions are kept for each node.
+const lifecycleEvents = 16
+
+// lifecycleEvent is a transition of a node into a state.
+type lifecycleEvent struct {
+	Time  time.Time `json:"time"`
+	State string    `json:"state"`
+	// Message is the DHCP message that caused the transition
+	Message string `json:"message"`
+}
+
+// lifecycleEntry is the state of a node and its latest transitions, oldest
+// first.
+type lifecycleEntry struct {
+	MAC    string           `json:"mac"`
+	CompID string           `json:"comp_id,omitempty"`
+	State  string           `json:"state"`
+	Since  time.Time        `json:"since"`
+	Events []lifecycleEvent `json:"events,omitempty"`
+}
+
+// lifecycleTracker tracks the boot lifecycle of every node that has network
+// booted since coresmd started: DISCOVERED when its firmware asks for an
+// address, OFFERED and ACKED as it is answered, IPXE when iPXE asks for an
+// address, and SCRIPTED once iPXE is given its boot script URL. Requests from
+// the booted OS, which presents no client architecture, do not change it. It
+// is split into shards by MAC address like chainTracker, and outlives reloads.
+type lifecycleTracker struct {
+	shards [numShards]lifecycleShard
+}
+
+type lifecycleShard struct {
+	mu        sync.Mutex
+	entries   map[string]*lifecycleEntry
+	lastSweep time.Time
+}
+
+func newLifecycleTracker() *lifecycleTracker {
+	lt := &lifecycleTracker{}
+	for i := range lt.shards {
+		lt.shards[i].entries = make(map[string]*lifecycleEntry)
+	}
+	return lt
+}
+
+// nextState returns the state a node in state cur moves to when it sends a
+// request of type mt (as iPXE if isIPXE) and is answered with a response of
+// type answer (0 if not answered) and a boot script URL if scripted. It
+// returns cur if the exchange does not move the node.
+func nextState(cur string, mt, answer dhcpv4.MessageType, isIPXE, scripted bool) string {
+	switch {
+	case isIPXE && answer == dhcpv4.MessageTypeAck && scripted:
+		return stateScripted
+	case isIPXE:
+		return stateIPXE
+	case answer == dhcpv4.MessageTypeAck && mt == dhcpv4.MessageTypeRequest:
+		return stateAcked
+	case answer == dhcpv4.MessageTypeOffer:
+		return stateOffered
+	case mt == dhcpv4.MessageTypeDiscover:
+		// A new boot, even if the node was not answered
+		return stateDiscovered
+	}
+	return cur
+}
+
+// record moves the node with the given MAC address through its lifecycle
+// for an exchange described as for nextState, at now. It returns the
+// transition and whether the node changed state. A nil lifecycleTracker
+// records nothing.
+func (lt *lifecycleTracker) record(mac, compID string, mt, answer dhcpv4.MessageType, isIPXE, scripted bool, now time.Time) (lifecycleEvent, bool) {
+	if lt == nil {
+		return lifecycleEvent{}, false
+	}
+	s := &lt.shards[shardOf(mac)]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Forget nodes not seen for a while, like the boot funnel
+	if now.Sub(s.lastSweep) > funnelRetention {
+		for m, e := range s.entries {
+			if now.Sub(e.Events[len(e.Events)-1].Time) > funnelRetention {
+				delete(s.entries, m)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	e, ok := s.entries[mac]
+	if !ok {
+		e = &lifecycleEntry{MAC: mac}
+	}
+	next := nextState(e.State, mt, answer, isIPXE, scripted)
+	if next == "" || (ok && next == e.State) {
+		return lifecycleEvent{}, false
+	}
+	s.entries[mac] = e
+	e.CompID, e.State, e.Since = compID, next, now
+	message := mt.String()
+	if answer != 0 {
+		message += "/" + answer.String()
+	}
+	if len(e.Events) == lifecycleEvents {
+		e.Events = append(e.Events[:0], e.Events[1:]...)
+	}
+	ev := lifecycleEvent{Time: now, State: next, Message: message}
+	e.Events = append(e.Events, ev)
+	return ev, true
+}
+
+// lookup returns a copy of the entry of the node with the given MAC address.
+func (lt *lifecycleTracker) lookup(mac string) (lifecycleEntry, bool) {
+	if lt == nil {
+		return lifecycleEntry{}, false
+	}
+	s := &lt.shards[shardOf(mac)]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[mac]
+	if !ok {
+		return lifecycleEntry{}, false
+	}
+	c := *e
+	c.Events = append([]lifecycleEvent(nil), e.Events...)
+	return c, true
+}
+
+// list returns the entries of all nodes without their events.
+func (lt *lifecycleTracker) list() []lifecycleEntry {
+	if lt == nil {
+		return nil
+	}
+	var entries []lifecycleEntry
+	for i := range lt.shards {
+		s := &lt.shards[i]
+		s.mu.Lock()
+		for _, e := range s.entries {
+			c := *e
+			c.Events = nil
+			entries = append(entries, c)
+		}
+		s.mu.Unlock()
+	}
+	return entries
+}
+
+// recordLifecycle moves the client of req, whose interface in SMD has MAC
+// address mac, through its boot lifecycle given the response resp, and
+// publishes its transitions as set in cfg. Only clients presenting an
+// architecture (firmware PXE and UEFI HTTP boot clients) or identifying as
+// iPXE are tracked.
+func (p *PluginState) recordLifecycle(cfg *pluginConfig, req, resp *dhcpv4.DHCPv4, mac, compID string, isIPXE, scripted bool) {
+	if !isIPXE && !req.Options.Has(dhcpv4.OptionClientSystemArchitectureType) {
+		return
+	}
+	mt, now := req.MessageType(), time.Now()
+	publish := func(ev lifecycleEvent, changed bool) {
+		if changed {
+			p.events.publish(cfg.events, bootEvent{Time: ev.Time, MAC: mac, CompID: compID, State: ev.State, Message: ev.Message})
+		}
+	}
+	if mt == dhcpv4.MessageTypeDiscover && !isIPXE {
+		// Start a new boot before recording the offer
+		publish(p.lifecycles.record(mac, compID, mt, 0, false, false, now))
+	}
+	publish(p.lifecycles.record(mac, compID, mt, resp.MessageType(), isIPXE, scripted, now))
+}
+
+// adminLifecycle lists nodes by boot lifecycle state. With a mac query
+// parameter, it reports that node and its latest transitions. With state, a
+// comma-separated list of states, it only lists nodes in those states; with
+// pending=true, it lists nodes that have not reached SCRIPTED. Nodes in SMD
+// that have not network booted since coresmd started are listed as UNSEEN.
+func (p *PluginState) adminLifecycle(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	query := r.URL.Query()
+	if m := query.Get("mac"); m != "" {
+		mac, err := NormalizeMAC(m)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		e, ok := p.lifecycles.lookup(mac)
+		if !ok {
+			http.Error(w, "node has not network booted since coresmd started", http.StatusNotFound)
+			return
+		}
+		writeJSON(w, http.StatusOK, e)
+		return
+	}
+
+	want := make(map[string]bool)
+	if states := query.Get("state"); states != "" {
+		for _, s := range strings.Split(strings.ToUpper(states), ",") {
+			want[s] = true
+		}
+	}
+	if query.Get("pending") == "true" {
+		for _, s := range lifecycleStates {
+			want[s] = s != stateScripted
+		}
+	}
+
+	entries := p.lifecycles.list()
+	seen := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		seen[e.MAC] = true
+	}
+	for mac, ii := range p.cache.Snapshot().Interfaces {
+		if ii.Type == "Node" && !seen[mac] {
+			entries = append(entries, lifecycleEntry{MAC: mac, CompID: ii.CompID, State: stateUnseen})
+		}
+	}
+
+	counts := make(map[string]int, len(lifecycleStates))
+	for _, s := range lifecycleStates {
+		counts[s] = 0
+	}
+	nodes := make([]lifecycleEntry, 0, len(entries))
+	for _, e := range entries {
+		counts[e.State]++
+		if len(want) == 0 || want[e.State] {
+			nodes = append(nodes, e)
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].MAC < nodes[j].MAC })
+	writeJSON(w, http.StatusOK, struct {
+		Counts map[string]int   `json:"counts"`
+		Nodes  []lifecycleEntry `json:"nodes"`
+	}{counts, nodes})
+}
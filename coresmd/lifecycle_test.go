@@ -0,0 +1,147 @@
+package coresmd
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestNextState(t *testing.T) {
+	const (
+		discover = dhcpv4.MessageTypeDiscover
+		request  = dhcpv4.MessageTypeRequest
+		offer    = dhcpv4.MessageTypeOffer
+		ack      = dhcpv4.MessageTypeAck
+		nak      = dhcpv4.MessageTypeNak
+	)
+	for _, tc := range []struct {
+		name     string
+		cur      string
+		mt       dhcpv4.MessageType
+		answer   dhcpv4.MessageType
+		isIPXE   bool
+		scripted bool
+		want     string
+	}{
+		{"discover", stateScripted, discover, 0, false, false, stateDiscovered},
+		{"offer", stateDiscovered, discover, offer, false, false, stateOffered},
+		{"ack", stateOffered, request, ack, false, false, stateAcked},
+		{"nak", stateOffered, request, nak, false, false, stateOffered},
+		{"ipxe discover", stateAcked, discover, offer, true, false, stateIPXE},
+		{"ipxe ack", stateIPXE, request, ack, true, true, stateScripted},
+		{"ipxe ack without script", stateIPXE, request, ack, true, false, stateIPXE},
+	} {
+		if got := nextState(tc.cur, tc.mt, tc.answer, tc.isIPXE, tc.scripted); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestLifecycleEvents(t *testing.T) {
+	lt := newLifecycleTracker()
+	mac := "aa:bb:cc:dd:ee:01"
+	now := time.Now()
+	for i := 0; i < lifecycleEvents; i++ {
+		lt.record(mac, "x1", dhcpv4.MessageTypeDiscover, 0, false, false, now)
+		lt.record(mac, "x1", dhcpv4.MessageTypeDiscover, dhcpv4.MessageTypeOffer, false, false, now)
+	}
+	e, ok := lt.lookup(mac)
+	if !ok || len(e.Events) != lifecycleEvents || e.State != stateOffered {
+		t.Fatalf("got %+v", e)
+	}
+
+	// Nodes not seen for a while are forgotten
+	lt.record("aa:bb:cc:dd:ee:02", "x2", dhcpv4.MessageTypeDiscover, 0, false, false, now.Add(2*funnelRetention))
+	for i := range lt.shards {
+		lt.shards[i].lastSweep = time.Time{}
+	}
+	lt.record(mac, "x1", dhcpv4.MessageTypeDiscover, 0, false, false, now.Add(2*funnelRetention))
+	if e, _ := lt.lookup(mac); len(e.Events) != 1 {
+		t.Errorf("after retention: %+v", e)
+	}
+}
+
+func TestHandler4Lifecycle(t *testing.T) {
+	p := setupHandler(t)
+	p.lifecycles = newLifecycleTracker()
+	mac := "aa:bb:cc:dd:ee:01"
+	send := func(mt dhcpv4.MessageType, mods ...dhcpv4.Modifier) {
+		t.Helper()
+		req, resp := newRequest(t, mt, mac, mods...)
+		p.Handler4(req, resp)
+	}
+	type listing struct {
+		Counts map[string]int   `json:"counts"`
+		Nodes  []lifecycleEntry `json:"nodes"`
+	}
+	lifecycle := func(query string) (listing, int) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		p.adminLifecycle(w, httptest.NewRequest(http.MethodGet, "/lifecycle"+query, nil))
+		var out listing
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&out); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return out, w.Code
+	}
+
+	// Only the Node is listed, not the NodeBMC
+	out, _ := lifecycle("")
+	if len(out.Nodes) != 1 || out.Nodes[0].State != stateUnseen || out.Nodes[0].CompID != "x3000c0s0b0n0" {
+		t.Fatalf("before booting: %+v", out)
+	}
+	if _, code := lifecycle("?mac=" + mac); code != http.StatusNotFound {
+		t.Errorf("unseen node: got status %d", code)
+	}
+
+	// The booted OS does not present an architecture and is not tracked
+	send(dhcpv4.MessageTypeDiscover)
+	if out, _ := lifecycle("?state=unseen"); len(out.Nodes) != 1 {
+		t.Errorf("after OS request: %+v", out)
+	}
+
+	arch := withArch(iana.EFI_X86_64)
+	send(dhcpv4.MessageTypeDiscover, arch)
+	if out, _ := lifecycle("?state=OFFERED"); len(out.Nodes) != 1 || out.Counts[stateOffered] != 1 || out.Counts[stateUnseen] != 0 {
+		t.Errorf("after discover: %+v", out)
+	}
+	send(dhcpv4.MessageTypeRequest, arch)
+	send(dhcpv4.MessageTypeDiscover, arch, withIPXE())
+	if out, _ := lifecycle("?pending=true"); len(out.Nodes) != 1 || out.Nodes[0].State != stateIPXE {
+		t.Errorf("after iPXE discover: %+v", out)
+	}
+	send(dhcpv4.MessageTypeRequest, arch, withIPXE())
+	if out, _ := lifecycle("?pending=true"); len(out.Nodes) != 0 || out.Counts[stateScripted] != 1 {
+		t.Errorf("after iPXE request: %+v", out)
+	}
+
+	var e lifecycleEntry
+	w := httptest.NewRecorder()
+	p.adminLifecycle(w, httptest.NewRequest(http.MethodGet, "/lifecycle?mac=AA-BB-CC-DD-EE-01", nil))
+	if err := json.NewDecoder(w.Body).Decode(&e); err != nil {
+		t.Fatal(err)
+	}
+	var states []string
+	for _, ev := range e.Events {
+		states = append(states, ev.State)
+	}
+	want := []string{stateDiscovered, stateOffered, stateAcked, stateIPXE, stateScripted}
+	if len(states) != len(want) {
+		t.Fatalf("events = %v, want %v", states, want)
+	}
+	for i := range want {
+		if states[i] != want[i] {
+			t.Fatalf("events = %v, want %v", states, want)
+		}
+	}
+	if e.Events[1].Message != "DISCOVER/OFFER" {
+		t.Errorf("message = %q", e.Events[1].Message)
+	}
+}
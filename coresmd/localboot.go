@@ -0,0 +1,39 @@
+package coresmd
+
+import "strings"
+
+// localBootParam in the BSS kernel parameters of a node makes coresmd send it
+// to its local disk instead of booting the kernel, so that disk-installed nodes
+// can skip network boot while keeping their boot parameters in BSS.
+const localBootParam = "coresmd.boot=local"
+
+// wantsLocalBoot reports whether the BSS kernel parameters in bp ask for local
+// boot.
+func (bp BootParams) wantsLocalBoot() bool {
+	for _, f := range strings.Fields(bp.Params) {
+		if f == localBootParam {
+			return true
+		}
+	}
+	return false
+}
+
+// localBootReason returns why the node owning ii must boot from its local
+// disk, or "" if it must not.
+func (cfg *pluginConfig) localBootReason(ii IfaceInfo) string {
+	ro, _ := cfg.roleOptionsFor(ii)
+	switch {
+	case ro.boot == "local":
+		return "role_options for role " + roleKey(ii) + " ask for local boot"
+	case ro.boot == "network":
+		// The role asks for network boot, overriding local_boot
+	case cfg.localBoot.matches(ii):
+		return "node matches local_boot"
+	}
+	if cfg.bootParams != nil {
+		if bp, ok := cfg.bootParams.lookup(ii.MAC, ii.CompID); ok && bp.wantsLocalBoot() {
+			return "BSS boot parameters contain " + localBootParam
+		}
+	}
+	return ""
+}
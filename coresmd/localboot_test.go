@@ -0,0 +1,69 @@
+package coresmd
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestHandler4LocalBoot(t *testing.T) {
+	p := setupHandler(t)
+	cfg := p.config.Load()
+	cfg.httpURL, _ = url.Parse("http://10.0.0.1:8080")
+
+	bootfile := func(mac string) string {
+		req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, mac, withArch(iana.EFI_X86_64), withIPXE())
+		got, _ := p.Handler4(req, resp)
+		return got.BootFileNameOption()
+	}
+	exit := "http://10.0.0.1:8080/exit"
+
+	// Selected by local_boot
+	cfg.localBoot = nodeSelector{"role:Compute"}
+	if got := bootfile("aa:bb:cc:dd:ee:01"); got != exit {
+		t.Errorf("selected node: got boot file %q, want %q", got, exit)
+	}
+	if got := bootfile("aa:bb:cc:dd:ee:02"); got == exit {
+		t.Error("unselected node was sent to local boot")
+	}
+	cfg.localBoot = nil
+
+	// Asked for by BSS boot parameters
+	cfg.bootParams = &bootParamsCache{}
+	cfg.bootParams.index.Store(&bootParamsIndex{
+		byMAC: map[string]BootParams{
+			"aa:bb:cc:dd:ee:01": {Kernel: "http://s3/kernel", Params: "console=ttyS0 " + localBootParam},
+		},
+		byHost: map[string]BootParams{
+			"x3000c0s0b0": {Kernel: "http://s3/bmc-kernel", Params: "coresmd.boot=network"},
+		},
+	})
+	if got := bootfile("aa:bb:cc:dd:ee:01"); got != exit {
+		t.Errorf("BSS local boot: got boot file %q, want %q", got, exit)
+	}
+	if got := bootfile("aa:bb:cc:dd:ee:02"); got == exit {
+		t.Error("node without local boot parameter was sent to local boot")
+	}
+}
+
+func TestHandler4IPOnly(t *testing.T) {
+	p := setupHandler(t)
+	cfg := p.config.Load()
+	cfg.ipOnly = nodeSelector{"type:NodeBMC"}
+
+	for mac, wantBoot := range map[string]bool{
+		"aa:bb:cc:dd:ee:01": true,  // Node
+		"aa:bb:cc:dd:ee:02": false, // NodeBMC
+	} {
+		req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, mac, withArch(iana.EFI_X86_64), withIPXE())
+		out, stop := p.Handler4(req, resp)
+		if out == nil || !stop || out.YourIPAddr.IsUnspecified() {
+			t.Fatalf("%s: got (%v, %t), want an address", mac, out, stop)
+		}
+		if gotBoot := out.BootFileNameOption() != "" || out.Options.Has(dhcpv4.OptionRootPath); gotBoot != wantBoot {
+			t.Errorf("%s: got boot file %q and root path %t, want boot config: %t", mac, out.BootFileNameOption(), out.Options.Has(dhcpv4.OptionRootPath), wantBoot)
+		}
+	}
+}
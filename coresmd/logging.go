@@ -0,0 +1,47 @@
+package coresmd
+
+import (
+	"fmt"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/sirupsen/logrus"
+)
+
+// requestLog returns the logger for messages about req. Its fields let the
+// messages about a single client or transaction be picked out of a boot storm.
+func requestLog(req *dhcpv4.DHCPv4) *logrus.Entry {
+	fields := logrus.Fields{
+		"mac":      clientKey(req),
+		"xid":      req.TransactionID.String(),
+		"msg_type": req.MessageType().String(),
+	}
+	if archs := req.ClientArch(); len(archs) > 0 {
+		fields["arch"] = uint16(archs[0])
+		if len(archs) > 1 {
+			// Odd firmware presents several; log all of them
+			all := make([]uint16, len(archs))
+			for i, arch := range archs {
+				all[i] = uint16(arch)
+			}
+			fields["archs"] = all
+		}
+	}
+	return log.WithFields(fields)
+}
+
+// parseLogFormat checks that format is "text" or "json".
+func parseLogFormat(format string) (string, error) {
+	if format != "text" && format != "json" {
+		return "", fmt.Errorf("invalid log_format %q: expected text or json", format)
+	}
+	return format, nil
+}
+
+// setLogFormat switches all CoreDHCP log messages to JSON if format is "json".
+// The logger is shared by every plugin, so other formats keep whatever
+// CoreDHCP set up.
+func setLogFormat(format string) {
+	if format == "json" {
+		log.Logger.SetFormatter(&logrus.JSONFormatter{})
+	}
+}
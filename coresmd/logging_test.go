@@ -0,0 +1,72 @@
+package coresmd
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestHandlerLogFields(t *testing.T) {
+	p := setupHandler(t)
+	hook := test.NewLocal(log.Logger)
+	t.Cleanup(func() { log.Logger.ReplaceHooks(make(logrus.LevelHooks)) })
+
+	req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", withArch(0), withIPXE())
+	p.Handler4(req, resp)
+
+	var sent *logrus.Entry
+	for _, e := range hook.AllEntries() {
+		if _, ok := e.Data["decision"]; ok {
+			sent = e
+		}
+	}
+	if sent == nil {
+		t.Fatal("no log entry with a decision field")
+	}
+	want := logrus.Fields{
+		"mac":      "aa:bb:cc:dd:ee:01",
+		"xid":      req.TransactionID.String(),
+		"msg_type": "DISCOVER",
+		"arch":     uint16(0),
+		"comp_id":  "x3000c0s0b0n0",
+		"nid":      int64(1),
+		"decision": "boot_script",
+	}
+	for k, v := range want {
+		if sent.Data[k] != v {
+			t.Errorf("field %s = %v (%T), want %v (%T)", k, sent.Data[k], sent.Data[k], v, v)
+		}
+	}
+}
+
+func TestParseLogFormat(t *testing.T) {
+	for _, f := range []string{"text", "json"} {
+		if _, err := parseLogFormat(f); err != nil {
+			t.Errorf("parseLogFormat(%q): %v", f, err)
+		}
+	}
+	if _, err := parseLogFormat("xml"); err == nil {
+		t.Error("parseLogFormat accepted xml")
+	}
+}
+
+func TestHandlerLogArchs(t *testing.T) {
+	p := setupHandler(t)
+	hook := test.NewLocal(log.Logger)
+	t.Cleanup(func() { log.Logger.ReplaceHooks(make(logrus.LevelHooks)) })
+
+	req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", withArch(iana.INTEL_X86PC, iana.EFI_X86_64))
+	p.Handler4(req, resp)
+
+	e := hook.LastEntry()
+	if e == nil {
+		t.Fatal("nothing logged")
+	}
+	if got := e.Data["archs"]; !reflect.DeepEqual(got, []uint16{0, 7}) {
+		t.Errorf("field archs = %v, want [0 7]", got)
+	}
+}
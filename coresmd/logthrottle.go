@@ -0,0 +1,102 @@
+package coresmd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultLogThrottle is the window over which repeated errors about the same
+// client are logged once if log_throttle is not set.
+const defaultLogThrottle = 10 * time.Minute
+
+// throttledError is an error logged for a client, and the number of times it
+// recurred since without being logged.
+type throttledError struct {
+	first      time.Time
+	suppressed int
+	// Latest message and logger, used for the summary
+	msg string
+	log *logrus.Entry
+}
+
+// logThrottle deduplicates errors logged per client so that a device that is
+// not in SMD but keeps broadcasting DISCOVERs does not fill the logs. The first
+// error for a client is logged, the ones following it within the window are
+// only counted, and a summary of them is logged when the window ends. It is
+// safe for concurrent use. A nil logThrottle logs every error.
+type logThrottle struct {
+	mu     sync.Mutex
+	errors map[string]*throttledError
+}
+
+func newLogThrottle() *logThrottle {
+	return &logThrottle{errors: make(map[string]*throttledError)}
+}
+
+// errorf logs an error about the client with MAC address mac to l, unless one
+// was already logged for it within window. A zero window disables throttling.
+func (lt *logThrottle) errorf(l *logrus.Entry, mac string, window time.Duration, now time.Time, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	if lt == nil || window <= 0 {
+		l.Error(msg)
+		return
+	}
+
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	if e, ok := lt.errors[mac]; ok {
+		if now.Sub(e.first) < window {
+			e.suppressed++
+			e.msg, e.log = msg, l
+			return
+		}
+		e.summarize(mac, window)
+	}
+	lt.errors[mac] = &throttledError{first: now, msg: msg, log: l}
+	l.Error(msg)
+}
+
+// flush logs the summaries of the windows that ended by now and forgets their
+// clients.
+func (lt *logThrottle) flush(window time.Duration, now time.Time) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	for mac, e := range lt.errors {
+		if window <= 0 || now.Sub(e.first) >= window {
+			e.summarize(mac, window)
+			delete(lt.errors, mac)
+		}
+	}
+}
+
+// summarize logs how often the error recurred after being logged, if at all.
+func (e *throttledError) summarize(mac string, window time.Duration) {
+	if e.suppressed == 0 {
+		return
+	}
+	e.log.WithField("suppressed", e.suppressed).Errorf("%s: repeated %d more times for %s in the last %s", e.msg, e.suppressed, mac, window)
+}
+
+// watchLogThrottle logs the summaries of throttled errors as their windows end
+// until ctx is done.
+func (p *PluginState) watchLogThrottle(ctx context.Context) {
+	timer := time.NewTimer(time.Second)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		// Check often enough that summaries are at most a tenth of the
+		// window late
+		window := p.config.Load().logThrottle
+		p.lookupErrors.flush(window, time.Now())
+		timer.Reset(max(window/10, time.Second))
+	}
+}
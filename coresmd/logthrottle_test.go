@@ -0,0 +1,60 @@
+package coresmd
+
+import (
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/sirupsen/logrus/hooks/test"
+)
+
+func TestLogThrottle(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	l := logrus.NewEntry(logger)
+	lt := newLogThrottle()
+	start := time.Now()
+	window := 10 * time.Minute
+
+	for i := 0; i < 5; i++ {
+		lt.errorf(l, "aa:bb:cc:dd:ee:99", window, start.Add(time.Duration(i)*time.Second), "lookup failed")
+	}
+	lt.errorf(l, "aa:bb:cc:dd:ee:98", window, start, "lookup failed")
+	if n := len(hook.AllEntries()); n != 2 {
+		t.Fatalf("logged %d errors within the window, want one per MAC", n)
+	}
+
+	// Nothing to summarize before the window ends
+	lt.flush(window, start.Add(time.Minute))
+	if n := len(hook.AllEntries()); n != 2 {
+		t.Fatalf("flush before window ended logged %d entries, want 2", n)
+	}
+
+	hook.Reset()
+	lt.flush(window, start.Add(window))
+	entries := hook.AllEntries()
+	if len(entries) != 1 {
+		t.Fatalf("flush logged %d summaries, want 1 (for the MAC with repeats)", len(entries))
+	}
+	if got := entries[0].Data["suppressed"]; got != 4 {
+		t.Errorf("suppressed = %v, want 4", got)
+	}
+
+	// A new window logs the error again
+	hook.Reset()
+	lt.errorf(l, "aa:bb:cc:dd:ee:99", window, start.Add(window+time.Second), "lookup failed")
+	if n := len(hook.AllEntries()); n != 1 {
+		t.Errorf("logged %d errors in a new window, want 1", n)
+	}
+}
+
+func TestLogThrottleDisabled(t *testing.T) {
+	logger, hook := test.NewNullLogger()
+	l := logrus.NewEntry(logger)
+	lt := newLogThrottle()
+	for i := 0; i < 3; i++ {
+		lt.errorf(l, "aa:bb:cc:dd:ee:99", 0, time.Now(), "lookup failed")
+	}
+	if n := len(hook.AllEntries()); n != 3 {
+		t.Errorf("logged %d errors with throttling disabled, want 3", n)
+	}
+}
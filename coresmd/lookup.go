@@ -0,0 +1,182 @@
+package coresmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// LookupResult is the response coresmd would send to a client, along with the
+// decisions that led to it.
+type LookupResult struct {
+	// Handled is whether coresmd answered the request itself rather than
+	// passing it on to the next plugin.
+	Handled  bool              `json:"handled"`
+	Response *LookupResponse   `json:"response,omitempty"`
+	Trace    *trace            `json:"trace"`
+	Request  map[string]string `json:"request"`
+}
+
+// LookupResponse holds the fields of a response relevant to booting.
+type LookupResponse struct {
+	MessageType     string `json:"message_type"`
+	YourIPAddr      string `json:"your_ip,omitempty"`
+	ServerIPAddr    string `json:"next_server,omitempty"`
+	HostName        string `json:"hostname,omitempty"`
+	BootFileName    string `json:"boot_file,omitempty"`
+	TFTPServerName  string `json:"tftp_server_name,omitempty"`
+	ClassIdentifier string `json:"class_identifier,omitempty"`
+	LeaseTime       string `json:"lease_time,omitempty"`
+	Message         string `json:"message,omitempty"`
+}
+
+// Lookup reports what a coresmd plugin configured with args would answer to a
+// client, fetching data from SMD once. This is the same as the admin API's
+// lookup endpoint but needs no running server.
+//
+// The client is described by query: its MAC address (mac) and optionally its
+// architecture (arch, an IANA processor architecture type), message type
+// (type, "discover" or "request"), requested IP address (requested_ip), and
+// whether it is iPXE (ipxe=true). Nothing is sent to the client, addresses are
+// not probed, and no provisional addresses are leased.
+func Lookup(ctx context.Context, args []string, query url.Values) (LookupResult, error) {
+	cfg, cc, _, err := loadConfig(args)
+	if err != nil {
+		return LookupResult{}, err
+	}
+	cache, err := NewCache(cc.interval.String(), cc.client)
+	if err != nil {
+		return LookupResult{}, fmt.Errorf("failed to create new cache: %w", err)
+	}
+	cache.ComponentTypes = cc.types
+	cache.ComponentRoles = cc.roles
+	cache.RedfishEndpoints = cc.redfish
+	cache.Groups = cc.groups
+	if err := cache.Refresh(ctx); err != nil {
+		return LookupResult{}, err
+	}
+
+	p := &PluginState{cache: cache}
+	p.config.Store(cfg)
+
+	return p.lookup(query)
+}
+
+// lookup reports what the handler would answer to the client described by
+// query (see Lookup).
+func (p *PluginState) lookup(query url.Values) (LookupResult, error) {
+	req, resp, err := simulatedRequest(query)
+	if err != nil {
+		return LookupResult{}, err
+	}
+
+	// Avoid side effects on the network and on provisional leases
+	cfg := *p.config.Load()
+	cfg.probeTimeout = 0
+	cfg.discoveryPool = nil
+	cfg.chainLoopLimit = 0
+	cfg.simulated = true
+
+	tr := newTraceFor(req)
+	resp, handled := p.handle(context.Background(), &cfg, req, resp, tr)
+
+	result := LookupResult{
+		Handled: handled,
+		Trace:   tr,
+		Request: make(map[string]string),
+	}
+	for key, vals := range query {
+		result.Request[key] = vals[0]
+	}
+	if resp != nil {
+		result.Response = &LookupResponse{
+			MessageType:     resp.MessageType().String(),
+			HostName:        resp.HostName(),
+			BootFileName:    resp.BootFileNameOption(),
+			TFTPServerName:  resp.TFTPServerName(),
+			ClassIdentifier: resp.ClassIdentifier(),
+			Message:         resp.Message(),
+		}
+		if result.Response.BootFileName == "" {
+			result.Response.BootFileName = resp.BootFileName
+		}
+		if result.Response.TFTPServerName == "" {
+			result.Response.TFTPServerName = resp.ServerHostName
+		}
+		if !resp.YourIPAddr.IsUnspecified() {
+			result.Response.YourIPAddr = resp.YourIPAddr.String()
+		}
+		if !resp.ServerIPAddr.IsUnspecified() {
+			result.Response.ServerIPAddr = resp.ServerIPAddr.String()
+		}
+		if lease := resp.IPAddressLeaseTime(0); lease > 0 {
+			result.Response.LeaseTime = lease.String()
+		}
+	}
+
+	return result, nil
+}
+
+// simulatedRequest builds the request described by query and an empty reply
+// to it.
+func simulatedRequest(q url.Values) (*dhcpv4.DHCPv4, *dhcpv4.DHCPv4, error) {
+	mac, err := NormalizeMAC(q.Get("mac"))
+	if err != nil {
+		return nil, nil, err
+	}
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mt, replyType := dhcpv4.MessageTypeDiscover, dhcpv4.MessageTypeOffer
+	switch q.Get("type") {
+	case "", "discover":
+	case "request":
+		mt, replyType = dhcpv4.MessageTypeRequest, dhcpv4.MessageTypeAck
+	default:
+		return nil, nil, fmt.Errorf("unsupported message type %q: expected discover or request", q.Get("type"))
+	}
+
+	modifiers := []dhcpv4.Modifier{dhcpv4.WithMessageType(mt), dhcpv4.WithHwAddr(hw)}
+	if len(hw) != 6 {
+		// Longer hardware addresses are only sent by IPoIB clients, which
+		// are identified by their port GUID in the client identifier
+		modifiers = append(modifiers,
+			dhcpv4.WithHwAddr(nil),
+			dhcpv4.WithHWType(iana.HWTypeInfiniband),
+			dhcpv4.WithOption(dhcpv4.OptClientIdentifier(append([]byte{0xff}, hw...))))
+	}
+	if a := q.Get("arch"); a != "" {
+		var arch uint16
+		if _, err := fmt.Sscan(a, &arch); err != nil {
+			return nil, nil, fmt.Errorf("invalid arch %q: %w", a, err)
+		}
+		modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptClientArch(iana.Arch(arch))))
+	}
+	if q.Get("ipxe") == "true" {
+		modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptGeneric(dhcpv4.OptionUserClassInformation, []byte("iPXE"))))
+	}
+	if ipStr := q.Get("requested_ip"); ipStr != "" {
+		ip := net.ParseIP(ipStr).To4()
+		if ip == nil {
+			return nil, nil, fmt.Errorf("invalid requested_ip %q", ipStr)
+		}
+		modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(ip)))
+	}
+
+	req, err := dhcpv4.New(modifiers...)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(replyType))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return req, resp, nil
+}
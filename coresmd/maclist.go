@@ -0,0 +1,177 @@
+package coresmd
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// macListCheckInterval is how often MAC list files are checked for changes.
+// The overrides file is checked as often.
+const macListCheckInterval = 5 * time.Second
+
+// macSet holds exact MAC addresses and OUI prefixes (the first three octets),
+// all normalized.
+type macSet struct {
+	macs map[string]bool
+	ouis map[string]bool
+}
+
+func (s *macSet) contains(mac string) bool {
+	return s.macs[mac] || (len(mac) >= 8 && s.ouis[mac[:8]])
+}
+
+// macList is a MAC allow or deny list loaded from a file, which is re-read when
+// it changes so that hardware can be blocked without a restart. It is safe for
+// concurrent use.
+type macList struct {
+	path string
+
+	set atomic.Pointer[macSet]
+	// mu serializes reloads; modTime is the modification time of the file
+	// when it was last read
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+// loadMACList reads the MAC list at path.
+func loadMACList(path string) (*macList, error) {
+	l := &macList{path: path}
+	if err := l.load(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// contains reports whether mac, in normalized form, or its OUI is on the list.
+// A nil list contains nothing.
+func (l *macList) contains(mac string) bool {
+	if l == nil {
+		return false
+	}
+	return l.set.Load().contains(mac)
+}
+
+// load reads the file if it changed since it was last read.
+func (l *macList) load() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	fi, err := os.Stat(l.path)
+	if err != nil {
+		return fmt.Errorf("failed to read MAC list: %w", err)
+	}
+	if l.set.Load() != nil && fi.ModTime().Equal(l.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(l.path)
+	if err != nil {
+		return fmt.Errorf("failed to read MAC list: %w", err)
+	}
+	set, err := parseMACList(data)
+	if err != nil {
+		return fmt.Errorf("invalid MAC list %s: %w", l.path, err)
+	}
+	if l.set.Swap(set) != nil {
+		log.Infof("reloaded MAC list %s with %d MAC addresses and %d OUIs", l.path, len(set.macs), len(set.ouis))
+	}
+	l.modTime = fi.ModTime()
+
+	return nil
+}
+
+// parseMACList parses a MAC list: one MAC address or OUI (e.g. "aa:bb:cc")
+// per line, in any format NormalizeMAC accepts. Blank lines and text after a
+// '#' are ignored.
+func parseMACList(data []byte) (*macSet, error) {
+	set := &macSet{macs: make(map[string]bool), ouis: make(map[string]bool)}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if oui, ok := parseOUI(line); ok {
+			set.ouis[oui] = true
+			continue
+		}
+		mac, err := NormalizeMAC(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", n, err)
+		}
+		set.macs[mac] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return set, nil
+}
+
+// parseOUI parses a 3-octet OUI with colon or dash separators, or as bare hex
+// digits, returning it as lowercase colon-separated octets.
+func parseOUI(s string) (string, bool) {
+	b, err := hex.DecodeString(strings.NewReplacer(":", "", "-", "").Replace(s))
+	if err != nil || len(b) != 3 {
+		return "", false
+	}
+	return net.HardwareAddr(b).String(), true
+}
+
+// macDenied returns why requests from mac are refused by the allow and deny
+// lists, or "" if they are not. The deny list takes precedence.
+func (cfg *pluginConfig) macDenied(mac string) string {
+	if cfg.macDenyList.contains(mac) {
+		metricMACListDenied.Inc("deny")
+		return "on the deny list"
+	}
+	if cfg.macAllowList != nil && !cfg.macAllowList.contains(mac) {
+		metricMACListDenied.Inc("allow")
+		return "not on the allow list"
+	}
+	return ""
+}
+
+// watchLocalFiles re-reads the MAC list files and overrides file of the
+// current config when they change, and the addresses of the served
+// interfaces, until ctx is done.
+func (p *PluginState) watchLocalFiles(ctx context.Context) {
+	ticker := time.NewTicker(macListCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		cfg := p.config.Load()
+		for _, l := range []*macList{cfg.macAllowList, cfg.macDenyList} {
+			if l == nil {
+				continue
+			}
+			if err := l.load(); err != nil {
+				log.Errorf("keeping previous MAC list: %v", err)
+			}
+		}
+		if cfg.static != nil {
+			if err := cfg.static.load(); err != nil {
+				log.Errorf("keeping previous overrides: %v", err)
+			}
+		}
+		if cfg.interfaces != nil {
+			if err := cfg.interfaces.load(); err != nil {
+				log.Errorf("keeping previous interface addresses: %v", err)
+			}
+		}
+	}
+}
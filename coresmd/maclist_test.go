@@ -0,0 +1,101 @@
+package coresmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestParseMACList(t *testing.T) {
+	set, err := parseMACList([]byte(`
+# decommissioned
+AA-BB-CC-DD-EE-01
+aabb.ccdd.ee02   # Cisco style
+de:ad:be        # whole vendor
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for mac, want := range map[string]bool{
+		"aa:bb:cc:dd:ee:01": true,
+		"aa:bb:cc:dd:ee:02": true,
+		"de:ad:be:00:00:01": true,
+		"aa:bb:cc:dd:ee:03": false,
+	} {
+		if got := set.contains(mac); got != want {
+			t.Errorf("contains(%s) = %t, want %t", mac, got, want)
+		}
+	}
+
+	if _, err := parseMACList([]byte("aa:bb:cc:dd:ee:01\nnot-a-mac\n")); err == nil {
+		t.Error("invalid line accepted")
+	}
+}
+
+func TestMACListReload(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "deny")
+	if err := os.WriteFile(path, []byte("aa:bb:cc:dd:ee:01\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	l, err := loadMACList(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Invalid changes keep the previous list
+	if err := os.WriteFile(path, []byte("bogus\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, time.Now(), time.Now().Add(time.Second))
+	if err := l.load(); err == nil {
+		t.Error("invalid list loaded")
+	}
+	if !l.contains("aa:bb:cc:dd:ee:01") {
+		t.Error("previous list dropped after invalid change")
+	}
+
+	if err := os.WriteFile(path, []byte("aa:bb:cc:dd:ee:02\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(path, time.Now(), time.Now().Add(2*time.Second))
+	if err := l.load(); err != nil {
+		t.Fatal(err)
+	}
+	if l.contains("aa:bb:cc:dd:ee:01") || !l.contains("aa:bb:cc:dd:ee:02") {
+		t.Error("changed list not picked up")
+	}
+}
+
+func TestHandler4MACLists(t *testing.T) {
+	p := setupHandler(t)
+	dir := t.TempDir()
+	allow := filepath.Join(dir, "allow")
+	deny := filepath.Join(dir, "deny")
+	os.WriteFile(allow, []byte("aa:bb:cc\n"), 0o644)
+	os.WriteFile(deny, []byte("aa:bb:cc:dd:ee:01\n"), 0o644)
+
+	cfg := *p.config.Load()
+	var err error
+	if cfg.macAllowList, err = loadMACList(allow); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.macDenyList, err = loadMACList(deny); err != nil {
+		t.Fatal(err)
+	}
+	p.config.Store(&cfg)
+
+	for mac, wantDropped := range map[string]bool{
+		"aa:bb:cc:dd:ee:01": true,  // in SMD but denied
+		"aa:bb:cc:dd:ee:02": false, // allowed by OUI
+		"11:22:33:44:55:66": true,  // not allowed
+	} {
+		req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, mac)
+		out, stop := p.Handler4(req, resp)
+		if dropped := out == nil && stop; dropped != wantDropped {
+			t.Errorf("%s: dropped %t, want %t", mac, dropped, wantDropped)
+		}
+	}
+}
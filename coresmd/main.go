@@ -1,43 +1,117 @@
 package coresmd
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"net"
 	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/OpenCHAMI/coresmd/internal/debug"
 	"github.com/OpenCHAMI/coresmd/internal/ipxe"
+	"github.com/OpenCHAMI/coresmd/internal/reply"
 	"github.com/OpenCHAMI/coresmd/internal/version"
 	"github.com/coredhcp/coredhcp/handler"
 	"github.com/coredhcp/coredhcp/logger"
 	"github.com/coredhcp/coredhcp/plugins"
 	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
 )
 
-type IfaceInfo struct {
-	CompID  string
-	CompNID int64
-	Type    string
-	MAC     string
-	IPList  []net.IP
-}
-
 var log = logger.GetLogger("plugins/coresmd")
 
+// pluginName is the name under which the plugin is configured.
+const pluginName = "coresmd"
+
 var Plugin = plugins.Plugin{
-	Name:   "coresmd",
+	Name:   pluginName,
 	Setup6: setup6,
 	Setup4: setup4,
 }
 
+// PluginState is the data held by an instance of the coresmd plugin
+type PluginState struct {
+	cache *Cache
+	// config holds the handler settings, which are swapped as a whole on
+	// reload
+	config atomic.Pointer[pluginConfig]
+	// args are the plugin arguments the instance was last configured with
+	args []string
+	// index is the position of this instance among the coresmd entries in
+	// the CoreDHCP config, used to find its arguments on reload
+	index int
+	// opts are the options the instance's listeners were started with
+	opts options
+	// bootScriptDown is set while the boot script base URL is found to be
+	// unreachable
+	bootScriptDown atomic.Bool
+	// cacheStale is set while the cache is older than staleness_alert
+	cacheStale atomic.Bool
+	// audit records every transaction, if enabled
+	audit *auditLog
+	// lookupErrors throttles the errors logged for clients not found in SMD
+	lookupErrors *logThrottle
+	// leases records the addresses offered and leased to clients
+	leases *leaseTracker
+	// dnsUpdates publishes the addresses leased to clients in DNS
+	dnsUpdates *dnsUpdater
+	// events publishes boot lifecycle events to a message bus
+	events *eventPublisher
+	// shared holds the state shared with other servers, if enabled
+	shared *sharedState
+	// failover elects the one server answering clients among those sharing
+	// state, if enabled
+	failover *failoverElector
+	// rescue holds the nodes put in rescue boot through the admin API
+	rescue *rescueSet
+	// funnel tracks where each node is in the boot funnel
+	funnel *bootFunnel
+	// lifecycles tracks the boot lifecycle of each node
+	lifecycles *lifecycleTracker
+	// chainLoops counts the boot script URLs handed out to each iPXE client
+	chainLoops *chainTracker
+	// reloadErr holds the error of the last failed reload, or nil if the
+	// last reload succeeded
+	reloadErr atomic.Pointer[string]
+
+	// teardownFuncs stop the goroutines and close the listeners started by
+	// this instance.
+	teardownFuncs []func()
+}
+
 var (
-	cache             *Cache
-	baseURL           *url.URL
-	bootScriptBaseURL *url.URL
-	leaseDuration     time.Duration
+	// setupMu serializes calls to setup4 so that a previous instance can be
+	// torn down safely before a new one is started.
+	setupMu sync.Mutex
+	// instances holds the running plugin instances keyed by their position
+	// among the coresmd entries of the CoreDHCP config. An instance set up
+	// again at the same position (e.g. when the server is restarted in the
+	// same process) replaces the previous one whatever its arguments, while
+	// instances at different positions (e.g. coresmd listed twice with
+	// different SMD backends) run independently.
+	instances = make(map[int]*PluginState)
+	// setupPos is the position of the next instance set up in the current
+	// setup pass.
+	setupPos int
+	// setupServed is set once requests are handled after a setup pass,
+	// which ends it: CoreDHCP sets up every plugin before serving.
+	setupServed atomic.Bool
+	// caches holds the caches of the running instances for Caches, so that
+	// other plugins can read them without waiting on setupMu.
+	caches atomic.Pointer[[]*Cache]
 )
 
 func setup6(args ...string) (handler.Handler6, error) {
@@ -47,144 +121,960 @@ func setup6(args ...string) (handler.Handler6, error) {
 func setup4(args ...string) (handler.Handler4, error) {
 	log.Infof("initializing coresmd/coresmd %s (%s), built %s", version.Version, version.GitCommit, version.BuildTime)
 
-	// Ensure all required args were passed
-	if len(args) != 5 {
-		return nil, errors.New("expected 5 arguments: base URL, boot script base URL, CA certificate path, cache duration, lease duration")
-	}
+	setupMu.Lock()
+	defer setupMu.Unlock()
+	defer publishCaches()
 
-	// Create new SmdClient using first argument (base URL)
-	log.Debug("generating new SmdClient")
-	var err error
-	baseURL, err = url.Parse(args[0])
+	cfg, cc, opts, err := loadConfig(args)
+	if err != nil {
+		return nil, err
+	}
+	setLogFormat(opts.logFormat)
+	redactor, err := newLogRedactor(opts.logRedact, opts.logRedactKeyFile, opts.logRedactLoggers)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse base URL: %w", err)
+		return nil, err
 	}
-	smdClient := NewSmdClient(baseURL)
+	setLogRedaction(redactor)
 
-	// Parse from the second argument the insecure URL used by iPXE clients
-	// to fetch their boot script via HTTP without a certificate
-	log.Debug("parsing boot script base URL")
-	bootScriptBaseURL, err = url.Parse(args[1])
+	// Create new Cache using the cache refresh interval and new SmdClient
+	// pointer
+	log.Debug("generating new Cache")
+	cache, err := NewCache(cc.interval.String(), cc.client)
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse boot script base URL: %w", err)
+		return nil, fmt.Errorf("failed to create new cache: %w", err)
 	}
+	cache.Jitter = cc.jitter
+	cache.ComponentTypes = cc.types
+	cache.ComponentRoles = cc.roles
+	cache.DiffLogging = cc.diff
+	cache.RedfishEndpoints = cc.redfish
+	cache.Groups = cc.groups
 
-	// If nonempty, test that CA cert path exists (third argument)
-	caCertPath := strings.Trim(args[2], `"'`)
-	log.Infof("cacertPath: %s", caCertPath)
-	if caCertPath != "" {
-		if err := smdClient.UseCACert(caCertPath); err != nil {
-			return nil, fmt.Errorf("failed to set CA certificate: %w", err)
+	p := &PluginState{
+		cache:        cache,
+		args:         args,
+		opts:         opts,
+		lookupErrors: newLogThrottle(),
+		rescue:       newRescueSet(),
+		funnel:       newBootFunnel(),
+		lifecycles:   newLifecycleTracker(),
+		chainLoops:   newChainTracker(),
+	}
+	p.config.Store(cfg)
+	cache.OnRefresh = p.refreshBootParams
+	cache.OnChange = p.notifyInventoryChange
+
+	var tlsConfig, metricsTLSConfig, adminTLSConfig *tls.Config
+	if opts.httpCert != "" {
+		// Firmware clients cannot present client certificates, so the
+		// boot server never requires them
+		tlsConfig, err = newServerTLSConfig(opts.httpCert, opts.httpKey, "")
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure TLS for HTTP server: %w", err)
+		}
+	}
+	if opts.metricsCert != "" {
+		metricsTLSConfig, err = newServerTLSConfig(opts.metricsCert, opts.metricsKey, opts.metricsClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure TLS for metrics server: %w", err)
+		}
+	}
+	if opts.adminCert != "" {
+		adminTLSConfig, err = newServerTLSConfig(opts.adminCert, opts.adminKey, opts.adminClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure TLS for admin server: %w", err)
 		}
-		log.Infof("set CA certificate for SMD to the contents of %s", caCertPath)
-	} else {
-		log.Infof("CA certificate path was empty, not setting")
 	}
 
-	// Create new Cache using fourth argument (cache validity duration) and new SmdClient
-	// pointer
-	log.Debug("generating new Cache")
-	cache, err = NewCache(args[3], smdClient)
+	// If setup is run again (e.g. when the server is restarted), stop the
+	// previous instance's refresh loop and servers before starting new ones
+	p.index = beginSetup()
+
+	p.cache.SnapshotFile = opts.snapshotFile
+	err = p.cache.RefreshLoop(context.Background())
+	p.teardownFuncs = append(p.teardownFuncs, p.cache.Close)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create new cache: %w", err)
+		switch {
+		case opts.startup == startupStrict:
+			p.teardown()
+			return nil, fmt.Errorf("failed to load cache from SMD (startup=strict): %w", err)
+		case opts.snapshotFile != "":
+			if err := p.cache.LoadSnapshotFile(); err != nil {
+				log.Errorf("starting with an empty cache: %v", err)
+			}
+		default:
+			log.Warn("starting with an empty cache; retrying in the background")
+		}
 	}
 
-	// Set lease duration from fifth argument
-	log.Debug("setting lease duration")
-	leaseDuration, err = time.ParseDuration(args[4])
+	// Check the boot script base URL for fallback boot files
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	go p.watchBootScriptURL(watchCtx)
+	p.teardownFuncs = append(p.teardownFuncs, stopWatch)
+
+	// Report the age of the cache and whether it is stale
+	ageCtx, stopAge := context.WithCancel(context.Background())
+	go p.watchCacheAge(ageCtx)
+	p.teardownFuncs = append(p.teardownFuncs, stopAge)
+
+	// Summarize throttled lookup errors
+	throttleCtx, stopThrottle := context.WithCancel(context.Background())
+	go p.watchLogThrottle(throttleCtx)
+	p.teardownFuncs = append(p.teardownFuncs, stopThrottle)
+
+	// Publish leased addresses in DNS while dns_update is set
+	p.dnsUpdates = newDNSUpdater()
+	dnsCtx, stopDNS := context.WithCancel(context.Background())
+	go p.dnsUpdates.run(dnsCtx)
+	p.teardownFuncs = append(p.teardownFuncs, stopDNS)
+
+	// Publish boot lifecycle events while events_url is set
+	p.events = newEventPublisher()
+	eventsCtx, stopEvents := context.WithCancel(context.Background())
+	go p.events.run(eventsCtx)
+	p.teardownFuncs = append(p.teardownFuncs, stopEvents)
+
+	// Pick up changes to the MAC allow and deny lists and overrides file
+	filesCtx, stopFiles := context.WithCancel(context.Background())
+	go p.watchLocalFiles(filesCtx)
+	p.teardownFuncs = append(p.teardownFuncs, stopFiles)
+
+	// Check the embedded iPXE binaries against their recorded checksums
+	binaries, err := ipxe.EmbeddedBinaries()
 	if err != nil {
-		return nil, fmt.Errorf("failed to parse lease duration: %w", err)
+		p.teardown()
+		return nil, fmt.Errorf("invalid embedded iPXE binaries: %w", err)
 	}
 
-	cache.RefreshLoop()
+	// Start tftpserver, unless another instance already has
+	releaseTFTP, err := acquireTFTPServer(binaries)
+	if err != nil {
+		p.teardown()
+		return nil, fmt.Errorf("failed to start TFTP server: %w", err)
+	}
+	p.teardownFuncs = append(p.teardownFuncs, releaseTFTP, registerGrubStubSource(p))
 
-	// Start tftpserver
-	log.Info("starting TFTP server on port 69 with directory /tftpboot")
-	go startTFTPServer("/tftpboot")
+	// Start HTTP server, if enabled
+	if opts.httpListen != "" {
+		log.Infof("starting HTTP server on %s with directory %s (TLS: %t)", opts.httpListen, tftpDirectory, tlsConfig != nil)
+		stopHTTP, err := startHTTPServer(opts.httpListen, tftpDirectory, tlsConfig, httpHandlers{
+			bootScript: p.serveBootScript,
+			stage1:     p.serveStage1Script,
+			rescue:     p.serveRescueScript,
+			grubConfig: p.serveGrubConfig,
+			grubStub:   p.grubStubFor,
+			binaries:   binaries,
+		})
+		if err != nil {
+			p.teardown()
+			return nil, fmt.Errorf("failed to start HTTP server: %w", err)
+		}
+		p.teardownFuncs = append(p.teardownFuncs, stopHTTP)
+	}
 
-	log.Infof("coresmd plugin initialized with base URL %s and validity duration %s", smdClient.BaseURL, cache.Duration.String())
+	// Start health server, if enabled
+	if opts.healthListen != "" {
+		log.Infof("starting health server on %s", opts.healthListen)
+		stopHealth, err := startHealthServer(opts.healthListen, p)
+		if err != nil {
+			p.teardown()
+			return nil, fmt.Errorf("failed to start health server: %w", err)
+		}
+		p.teardownFuncs = append(p.teardownFuncs, stopHealth)
+	}
 
-	return Handler4, nil
+	// Start metrics server, if enabled
+	if opts.metricsListen != "" {
+		log.Infof("starting metrics server on %s (TLS: %t, client auth: %t)", opts.metricsListen, metricsTLSConfig != nil, opts.metricsClientCA != "")
+		stopMetrics, err := startMetricsServer(opts.metricsListen, metricsTLSConfig)
+		if err != nil {
+			p.teardown()
+			return nil, fmt.Errorf("failed to start metrics server: %w", err)
+		}
+		p.teardownFuncs = append(p.teardownFuncs, stopMetrics)
+	}
+
+	// Send metrics to statsd, if enabled
+	if opts.statsdAddr != "" {
+		log.Infof("sending metrics to statsd server %s every %s (format: %s)", opts.statsdAddr, opts.statsdInterval, opts.statsdFormat)
+		stopStatsd, err := startStatsdEmitter(opts.statsdAddr, opts.statsdPrefix, opts.statsdFormat, opts.statsdInterval)
+		if err != nil {
+			p.teardown()
+			return nil, fmt.Errorf("failed to start statsd emitter: %w", err)
+		}
+		p.teardownFuncs = append(p.teardownFuncs, stopStatsd)
+	}
+
+	// Export traces, if enabled
+	if opts.otelEndpoint != "" {
+		log.Infof("exporting traces to %s", opts.otelEndpoint)
+		stopTracing, err := startTracing(opts.otelEndpoint)
+		if err != nil {
+			p.teardown()
+			return nil, err
+		}
+		p.teardownFuncs = append(p.teardownFuncs, stopTracing)
+	}
+
+	// Open lease database, if enabled
+	if opts.leaseDB != "" {
+		log.Infof("persisting offers and leases in %s", opts.leaseDB)
+	}
+	p.leases, err = newLeaseTracker(opts.leaseDB)
+	if err != nil {
+		p.teardown()
+		return nil, err
+	}
+	p.teardownFuncs = append(p.teardownFuncs, p.leases.Close)
+
+	// Share leases and conflicts with other servers, if enabled
+	if opts.sharedState != "" {
+		p.shared, err = newSharedState(opts.sharedState, opts.sharedStatePrefix)
+		if err != nil {
+			p.teardown()
+			return nil, err
+		}
+		log.Infof("sharing leases and conflicts through %s under prefix %s", p.shared.redis.addr, opts.sharedStatePrefix)
+		p.leases.shared = p.shared
+
+		// Only answer clients while elected leader, if enabled
+		if opts.failover {
+			p.failover, err = newFailoverElector(p.shared, opts.failoverID, opts.failoverLease, opts.failoverServeUnreachable)
+			if err != nil {
+				p.shared.Close()
+				p.teardown()
+				return nil, err
+			}
+			log.Infof("failover: campaigning for leadership as %s with a lease of %s", p.failover.id, opts.failoverLease)
+			failoverCtx, stopFailover := context.WithCancel(context.Background())
+			failoverDone := make(chan struct{})
+			go func() {
+				p.failover.run(failoverCtx)
+				close(failoverDone)
+			}()
+			// Wait for the elector to resign before its connection is
+			// closed
+			p.teardownFuncs = append(p.teardownFuncs, func() {
+				stopFailover()
+				<-failoverDone
+				p.failover.Close()
+			})
+		}
+		p.teardownFuncs = append(p.teardownFuncs, p.shared.Close)
+	}
+
+	// Open audit log, if enabled
+	if opts.auditLog != "" {
+		log.Infof("writing audit records to %s", opts.auditLog)
+		p.audit, err = openAuditLog(opts.auditLog, opts.auditLogMaxSize, opts.auditLogMaxBackups)
+		if err != nil {
+			p.teardown()
+			return nil, err
+		}
+		p.teardownFuncs = append(p.teardownFuncs, p.audit.Close)
+	}
+
+	// Start admin servers, if enabled
+	auth := newAdminAuth(opts.adminROToken, opts.adminRWToken, opts.adminReadOnly, opts.adminDisable)
+	if opts.adminSocket != "" {
+		log.Infof("starting admin server on %s (tokens: %t, read-only: %t, disabled endpoints: %v)", opts.adminSocket, opts.adminROToken != "" || opts.adminRWToken != "", opts.adminReadOnly, opts.adminDisable)
+		stopAdmin, err := startAdminServer(opts.adminSocket, auth, p)
+		if err != nil {
+			p.teardown()
+			return nil, fmt.Errorf("failed to start admin server: %w", err)
+		}
+		p.teardownFuncs = append(p.teardownFuncs, stopAdmin)
+	}
+	if opts.adminListen != "" {
+		log.Infof("starting admin server on %s (TLS: %t, client auth: %t, tokens: %t)", opts.adminListen, adminTLSConfig != nil, opts.adminClientCA != "", opts.adminROToken != "" || opts.adminRWToken != "")
+		if adminTLSConfig == nil {
+			log.Warn("admin API is served over plain HTTP on a TCP port; set admin_cert and admin_key to protect tokens and inventory data")
+		}
+		stopAdmin, err := startAdminListener(opts.adminListen, adminTLSConfig, auth, p)
+		if err != nil {
+			p.teardown()
+			return nil, fmt.Errorf("failed to start admin server: %w", err)
+		}
+		p.teardownFuncs = append(p.teardownFuncs, stopAdmin)
+	}
+
+	// Reload configuration on SIGHUP, if enabled
+	if opts.configFile != "" {
+		watchReloadSignal()
+	}
+	watchRefreshSignal()
+
+	instances[p.index] = p
+	log.Infof("coresmd plugin initialized with base URL %s and refresh interval %s", cc.client.BaseURL, cc.interval)
+
+	return p.Handler4, nil
+}
+
+// Shutdown tears down every plugin instance, stopping cache refreshes and
+// closing the TFTP, HTTP, metrics, and admin servers. CoreDHCP has no shutdown hook
+// for plugins, so servers embedding coresmd should call this once they stop
+// serving.
+func Shutdown() {
+	setupMu.Lock()
+	defer setupMu.Unlock()
+
+	for pos, p := range instances {
+		p.teardown()
+		delete(instances, pos)
+	}
+	setupPos = 0
+	setupServed.Store(false)
+	publishCaches()
+	log.Info("coresmd shut down")
 }
 
-func Handler4(req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
-	log.Debugf("HANDLER CALLED ON MESSAGE TYPE: req(%s), resp(%s)", req.MessageType(), resp.MessageType())
-	debug.DebugRequest(log, req)
+// beginSetup returns the position of the instance being set up and tears down
+// the instance previously set up at that position. CoreDHCP sets up the
+// coresmd entries in order and only serves once all of them are set up, so a
+// setup after requests were handled starts a new pass from the first entry.
+// setupMu must be held.
+func beginSetup() int {
+	if setupServed.Swap(false) {
+		setupPos = 0
+	}
+	pos := setupPos
+	setupPos++
+	if prev, ok := instances[pos]; ok {
+		log.Info("tearing down previous coresmd instance")
+		prev.teardown()
+		delete(instances, pos)
+	}
+
+	return pos
+}
+
+// endSetupPass ends the current setup pass once requests are handled, tearing
+// down the instances of previous passes at positions it did not reach, e.g.
+// because coresmd entries were removed from the config.
+func endSetupPass() {
+	setupMu.Lock()
+	defer setupMu.Unlock()
+
+	if setupServed.Load() {
+		return
+	}
+	for pos, p := range instances {
+		if pos >= setupPos {
+			log.Info("tearing down coresmd instance no longer in the config")
+			p.teardown()
+			delete(instances, pos)
+		}
+	}
+	setupServed.Store(true)
+	publishCaches()
+}
 
-	// Make sure cache doesn't get updated while reading
-	(*cache).Mutex.RLock()
-	defer cache.Mutex.RUnlock()
+// Caches returns the caches of the running plugin instances in the order they
+// were set up, so that other plugins in the same server can use the SMD data
+// coresmd holds (see the smdview package). The caches must not be
+// reconfigured or closed.
+func Caches() []*Cache {
+	if cs := caches.Load(); cs != nil {
+		return *cs
+	}
+	return nil
+}
+
+// publishCaches updates the caches returned by Caches. setupMu must be held.
+func publishCaches() {
+	ps := make([]*PluginState, 0, len(instances))
+	for _, p := range instances {
+		ps = append(ps, p)
+	}
+	sort.Slice(ps, func(i, j int) bool { return ps[i].index < ps[j].index })
+	cs := make([]*Cache, len(ps))
+	for i, p := range ps {
+		cs[i] = p.cache
+	}
+	caches.Store(&cs)
+}
+
+var watchRefreshOnce sync.Once
+
+// watchRefreshSignal forces an immediate cache refresh in every plugin instance
+// whenever the process receives SIGUSR1, so that SMD changes can be picked up
+// without waiting for the cache duration to elapse. It only starts watching
+// once.
+func watchRefreshSignal() {
+	watchRefreshOnce.Do(func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGUSR1)
+		go func() {
+			for range sigs {
+				log.Info("received SIGUSR1, refreshing cache")
+				setupMu.Lock()
+				for _, p := range instances {
+					p.cache.RefreshNow()
+				}
+				setupMu.Unlock()
+			}
+		}()
+	})
+}
+
+// teardown calls and clears teardownFuncs. setupMu must be held.
+func (p *PluginState) teardown() {
+	for _, f := range p.teardownFuncs {
+		f()
+	}
+	p.teardownFuncs = nil
+}
+
+func (p *PluginState) Handler4(req, resp *dhcpv4.DHCPv4) (out *dhcpv4.DHCPv4, stop bool) {
+	if !setupServed.Load() {
+		endSetupPass()
+	}
+	rlog := requestLog(req)
+	rlog.Debugf("handling request (response type %s)", resp.MessageType())
+	debug.DebugRequest(rlog, req)
+
+	// Leave clients to the leader while on standby
+	if !p.failover.isLeader(time.Now()) {
+		rlog.Debug("on standby, dropping request")
+		return nil, true
+	}
+	metricMessages.Inc(messageTypeLabel(req.MessageType()))
+
+	ctx, span := tracer().Start(context.Background(), "coresmd.Handler4", requestAttributes(req))
+	defer func() {
+		span.SetAttributes(attribute.Bool("dhcp.handled", stop))
+		span.End()
+	}()
+
+	if p.audit != nil {
+		defer func() {
+			p.audit.record(newAuditRecord(req, out, stop, p.cache.Snapshot().LastUpdated))
+		}()
+	}
+
+	// Use the same settings for the whole request even if the
+	// configuration gets reloaded while handling it
+	cfg := p.config.Load()
+
+	// Drop floods before spending any effort on them
+	if cfg.rateLimited(req, time.Now()) {
+		return nil, true
+	}
+	// Refuse blocked hardware whatever SMD says about it
+	mac := clientKey(req)
+	if reason := cfg.macDenied(mac); reason != "" {
+		p.lookupErrors.errorf(rlog, mac, cfg.logThrottle, time.Now(), "denied request from %s: %s", mac, reason)
+		return nil, true
+	}
+
+	// Leave requests addressed to another server to it, such as a legacy
+	// server during a migration. A client accepting another server's offer
+	// no longer needs the one coresmd made.
+	sid := cfg.serverIDFor(resp)
+	if other := otherServer(req, sid); other != nil {
+		metricOtherServer.Inc()
+		rlog.Debugf("ignoring %s addressed to server %s", req.MessageType(), other)
+		if req.MessageType() == dhcpv4.MessageTypeRequest {
+			p.leases.forgetOffer(mac)
+		}
+		return nil, true
+	}
+
+	// Record what the client was offered or leased once it is answered.
+	// Requests passed on to the next plugins were not answered by coresmd.
+	defer func() {
+		answer := out
+		if !stop {
+			answer = nil
+		}
+		p.leases.record(req, answer, cfg.offerHold, time.Now())
+	}()
+
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeDecline:
+		return p.handleDecline(req)
+	case dhcpv4.MessageTypeRelease:
+		return cfg.handleRelease(req)
+	}
+
+	tr := cfg.explainMACs.newTrace(req)
+	defer tr.log()
+
+	out, stop = p.handle(ctx, cfg, req, resp, tr)
+	if out != nil && out.MessageType() == dhcpv4.MessageTypeNak {
+		cfg.countOutcome(outcomeNAK)
+	}
+	if out != nil && stop {
+		// Make sure the answer reaches the client whatever the plugins
+		// before did to the response
+		reply.SetAddressing(req, out)
+		if sid != nil {
+			out.UpdateOption(dhcpv4.OptServerIdentifier(sid))
+		}
+		p.dnsUpdates.publish(cfg.dnsUpdate, out)
+	}
+	return out, stop
+}
+
+// handle assigns an address and boot configuration to the client of req using
+// the settings in cfg, recording its decisions in tr and on the span in ctx.
+func (p *PluginState) handle(ctx context.Context, cfg *pluginConfig, req, resp *dhcpv4.DHCPv4, tr *trace) (*dhcpv4.DHCPv4, bool) {
+	// Log with fields identifying the request, adding the Component once
+	// it is known
+	log := requestLog(req)
+
+	// Use the same cache data for the whole request even if the cache gets
+	// refreshed while handling it
+	snapshot := p.cache.Snapshot()
+
+	// Don't hand out data SMD may no longer agree with. Dropping the request
+	// lets clients keep their current leases until the cache recovers.
+	if age := time.Since(snapshot.LastUpdated); cfg.maxStaleness > 0 && age > cfg.maxStaleness {
+		log.Warnf("dropping request from %s: cache was last refreshed %s ago, more than max_staleness %s", req.ClientHWAddr, age.Round(time.Second), cfg.maxStaleness)
+		tr.add("cache", "stale", "smd", fmt.Sprintf("last refreshed %s ago, more than max_staleness %s", age.Round(time.Second), cfg.maxStaleness))
+		return nil, true
+	}
 
 	// STEP 1: Assign IP address
-	hwAddr := req.ClientHWAddr.String()
-	ifaceInfo, err := lookupMAC(hwAddr)
+	hwAddr, err := clientHWAddr(snapshot, req, cfg.clientIDFallback)
 	if err != nil {
-		log.Errorf("IP lookup failed: %v", err)
-		return resp, false
+		p.lookupErrors.errorf(log, clientKey(req), cfg.logThrottle, time.Now(), "IP lookup failed: %v", err)
+		tr.add("lookup", "no match", "smd", err.Error())
+		return cfg.takeAction("unknown_mac", cfg.outcomes.unknownMAC, resp, tr)
 	}
-	assignedIP := ifaceInfo.IPList[0].To4()
-	resp.YourIPAddr = assignedIP
+	static, hasStatic := cfg.static.lookup(hwAddr)
+	_, span := tracer().Start(ctx, "coresmd.lookupMAC", oteltrace.WithAttributes(attribute.String("dhcp.mac", hwAddr)))
+	ifaceInfo, err := snapshot.LookupMAC(hwAddr)
+	endSpan(span, err)
+	if err != nil && hasStatic && static.IP != nil {
+		// Serve devices that will never be in SMD from the overrides file
+		// alone
+		ifaceInfo, err = static.ifaceInfo(hwAddr), nil
+	}
+	if err != nil {
+		p.lookupErrors.errorf(log, hwAddr, cfg.logThrottle, time.Now(), "IP lookup failed: %v", err)
+		tr.add("lookup", "no match", "smd", err.Error())
+		if _, known := snapshot.EthernetInterfaces[hwAddr]; known {
+			return cfg.takeAction("lookup_error", cfg.outcomes.lookupError, resp, tr)
+		}
+		if cfg.discoveryPool != nil && req.MessageType() != dhcpv4.MessageTypeInform {
+			return cfg.handleProvisional(req, resp, snapshot, hwAddr, tr)
+		}
+		return cfg.takeAction("unknown_mac", cfg.outcomes.unknownMAC, resp, tr)
+	}
+	if cfg.discoveryPool != nil {
+		// The client may have been leased a provisional address before it
+		// was added to SMD
+		cfg.discoveryPool.release(hwAddr)
+	}
+	if ifaceInfo.CompID == "" {
+		tr.add("lookup", "static", "overrides_file", "client is not in SMD but has an entry in the overrides file")
+	} else {
+		tr.add("lookup", ifaceInfo.CompID, "smd", fmt.Sprintf("EthernetInterface belongs to Component of type %s", ifaceInfo.Type))
+	}
+	if hasStatic && static.IP != nil {
+		ifaceInfo.IPList = []net.IP{static.IP}
+		tr.add("static_ip", static.IP.String(), "overrides_file", "replaces the IP addresses of the client")
+	}
+	log = log.WithFields(logrus.Fields{"comp_id": ifaceInfo.CompID, "nid": ifaceInfo.CompNID})
+	oteltrace.SpanFromContext(ctx).SetAttributes(attribute.String("smd.component_id", ifaceInfo.CompID))
+	var assignedIP net.IP
+	ro, hasRoleOptions := cfg.roleOptionsFor(ifaceInfo)
+	if req.MessageType() == dhcpv4.MessageTypeInform {
+		// The client already has an address and only wants its options,
+		// so answer with those and no address or lease
+		metricInforms.Inc()
+		assignedIP = req.ClientIPAddr.To4()
+		resp.UpdateOption(dhcpv4.OptMessageType(dhcpv4.MessageTypeAck))
+		resp.YourIPAddr = net.IPv4zero
+		resp.Options.Del(dhcpv4.OptionIPAddressLeaseTime)
+		resp.Options.Del(dhcpv4.OptionRenewTimeValue)
+		resp.Options.Del(dhcpv4.OptionRebindingTimeValue)
+		log.Infof("answering %s from %s (%s) at %s with options only", dhcpv4.MessageTypeInform, ifaceInfo.MAC, ifaceInfo.Type, assignedIP)
+		tr.add("ip", "none", "client", fmt.Sprintf("client sent %s from %s, which it already has", dhcpv4.MessageTypeInform, assignedIP))
+	} else {
+		if cfg.interfaces != nil {
+			routable, reason := cfg.interfaces.routable(req, resp, hwAddr, ifaceInfo.IPList)
+			if routable == nil {
+				log.Warnf("not assigning an IP to %s: %s", hwAddr, reason)
+				tr.add("ip", "unroutable", "interfaces", reason)
+				metricUnroutable.Inc()
+				return cfg.takeAction("unroutable", cfg.outcomes.unroutable, resp, tr)
+			}
+			ifaceInfo.IPList = routable
+		}
+		var (
+			out *dhcpv4.DHCPv4
+			ok  bool
+		)
+		if assignedIP, out, ok = p.assignIP(log, cfg, req, resp, ifaceInfo, hwAddr, tr); !ok {
+			return out, true
+		}
 
-	// Set lease time
-	resp.Options.Update(dhcpv4.OptIPAddressLeaseTime(leaseDuration))
-	log.Infof("assigning %s to %s (%s) with a lease duration of %s", assignedIP, ifaceInfo.MAC, ifaceInfo.Type, leaseDuration)
+		// Set lease time and renewal/rebinding times
+		lp := cfg.leasePolicyFor(ifaceInfo.Type)
+		leaseReason := fmt.Sprintf("policy for Component type %s", ifaceInfo.Type)
+		if hasRoleOptions && ro.lease != nil {
+			lp = *ro.lease
+			leaseReason = fmt.Sprintf("role_options for role %s", roleKey(ifaceInfo))
+		}
+		lp.apply(resp)
+		log.Infof("assigning %s to %s (%s) with %s", assignedIP, ifaceInfo.MAC, ifaceInfo.Type, lp)
+		tr.add("lease_time", lp.String(), "coresmd", leaseReason)
+	}
+
+	// Set NTP servers and time zone from the plugin config, then options from
+	// the network profile for the assigned IP, then from the bundle for the
+	// Component's role, then NTP servers and time zone from the Component's
+	// properties, each replacing the ones before
+	now := time.Now()
+	if set := cfg.time.apply(resp, now); set != "" {
+		tr.add("time", set, "coresmd", "plugin config")
+	}
+	if network := cfg.networkFor(assignedIP); network != nil {
+		if set := network.apply(resp); set != "" {
+			tr.add("network", set, "coresmd", fmt.Sprintf("profile for %s", network.subnet))
+		}
+	}
+	if hasRoleOptions {
+		if set := ro.apply(resp); set != "" {
+			tr.add("role_options", set, "coresmd", fmt.Sprintf("bundle for role %s", roleKey(ifaceInfo)))
+		}
+	}
+	if ts, err := nodeTimeSettings(ifaceInfo); err != nil {
+		log.Warnf("%v, ignoring", err)
+		tr.add("time", "none", "smd", err.Error())
+	} else if set := ts.apply(resp, now); set != "" {
+		tr.add("time", set, "smd", fmt.Sprintf("properties of Component %s", ifaceInfo.CompID))
+	}
 
 	// Set client hostname
-	if ifaceInfo.Type == "Node" {
-		resp.Options.Update(dhcpv4.OptHostName(fmt.Sprintf("nid%04d", ifaceInfo.CompNID)))
+	if hasStatic && static.Hostname != "" {
+		resp.Options.Update(dhcpv4.OptHostName(static.Hostname))
+		tr.add("hostname", static.Hostname, "overrides_file", "set for the client in the overrides file")
+	} else if missingNID(ifaceInfo) && (cfg.missingNID == missingNIDOmit || cfg.missingNID == missingNIDDefer) {
+		tr.add("hostname", "none", "smd", fmt.Sprintf("Node has no NID (missing_nid=%s)", cfg.missingNID))
+	} else if ifaceInfo.Hostname == ifaceInfo.CompID && ifaceInfo.Hostname != "" {
+		resp.Options.Update(dhcpv4.OptHostName(ifaceInfo.Hostname))
+		tr.add("hostname", ifaceInfo.Hostname, "smd", "NID of Component is missing or held by another Node, using Component ID")
+	} else if ifaceInfo.Hostname != "" {
+		resp.Options.Update(dhcpv4.OptHostName(ifaceInfo.Hostname))
+		tr.add("hostname", ifaceInfo.Hostname, "smd", "generated from NID")
+	} else {
+		tr.add("hostname", "none", "smd", "Component is not a Node")
+	}
+
+	// Set domain search list and interface MTU
+	if domains := cfg.domainSearchFor(req, assignedIP); domains != nil {
+		resp.Options.Update(optDomainSearch(domains))
+		tr.add("domain_search", strings.Join(domains, " "), "coresmd", "")
+	}
+	if mtu := cfg.mtuFor(req, assignedIP); mtu != 0 {
+		resp.Options.Update(optInterfaceMTU(mtu))
+		tr.add("mtu", strconv.Itoa(int(mtu)), "coresmd", "")
 	}
 
-	// Set root path to this server's IP
-	resp.Options.Update(dhcpv4.OptRootPath(resp.ServerIPAddr.String()))
+	// Leave network boot to be managed elsewhere if selected by ip_only
+	ipOnly := cfg.ipOnly.matches(ifaceInfo)
 
 	// STEP 2: Send boot config
-	if cinfo := req.Options.Get(dhcpv4.OptionUserClassInformation); string(cinfo) != "iPXE" {
+	if tftpIP := cfg.tftpServerFor(req, assignedIP); !ipOnly && tftpIP != nil {
+		resp.ServerIPAddr = tftpIP
+		resp.Options.Update(dhcpv4.OptTFTPServerName(tftpIP.String()))
+		tr.add("tftp_server", tftpIP.String(), "coresmd", "")
+	}
+
+	// Set root path to the IP of the server the client boots from
+	if !ipOnly {
+		resp.Options.Update(dhcpv4.OptRootPath(resp.ServerIPAddr.String()))
+	}
+	isIPXE := string(req.Options.Get(dhcpv4.OptionUserClassInformation)) == "iPXE"
+	snp := cfg.snpOnly.matches(ifaceInfo)
+	if isIPXE {
+		if missing := missingIPXEFeatures(log, req, cfg.ipxeRequire); len(missing) > 0 {
+			// An iPXE that cannot fetch the boot script, usually the one
+			// in the NIC's ROM: chainload an iPXE build using the same
+			// driver
+			isIPXE, snp = false, true
+			log.Infof("iPXE client lacks features %s, chainloading iPXE", strings.Join(missing, ","))
+			tr.add("ipxe", "chainload", "client", fmt.Sprintf("iPXE client lacks features %s", strings.Join(missing, ",")))
+		}
+	}
+	params := BootScriptParams{MAC: hwAddr, Xname: ifaceInfo.CompID, NID: ifaceInfo.CompNID}
+	bootArch, hasArch := cfg.bootArch(req, snp)
+	if hasArch {
+		params.Arch = strconv.Itoa(int(bootArch))
+	}
+	bootScript, overrideErr := bootScriptOverride(ifaceInfo)
+	if overrideErr != nil {
+		log.Warn(overrideErr)
+	}
+	var decision string
+	// Requests that get this far are served unless their bootloader cannot
+	// be chosen
+	outcome := outcomeServed
+	if ipOnly {
+		decision = "ip_only"
+		tr.add("bootfile", "none", "coresmd", "client is selected by ip_only, leaving network boot to another server")
+	} else if hasStatic && static.Bootfile != "" {
+		// Send the boot file set for this client in the overrides file
+		decision = "static_override"
+		resp.Options.Update(dhcpv4.OptBootFileName(static.Bootfile))
+		tr.add("bootfile", static.Bootfile, "overrides_file", "set for the client in the overrides file")
+	} else if ri, source, ok := p.rescueFor(cfg, hwAddr, static); ok && isIPXE {
+		// BOOT STAGE 2: Send URL to the boot script of the rescue image
+		// set through the admin API or the overrides file
+		decision = "rescue"
+		if ri.Kernel == "" || cfg.httpURL == nil {
+			log.Errorf("%s is in rescue boot, but no rescue kernel or no http_url is set to serve it from", hwAddr)
+			tr.add("bootfile", "none", source, "client is in rescue boot, but no rescue kernel or no http_url is set")
+		} else {
+			scriptURL := rescueScriptURL(cfg.httpURL, hwAddr)
+			if cfg.bootScriptKey != nil {
+				SignBootScriptURL(scriptURL, cfg.bootScriptKey, time.Now())
+			}
+			resp.Options.Update(dhcpv4.OptBootFileName(scriptURL.String()))
+			log.Warnf("%s is in rescue boot, booting kernel %s", hwAddr, ri.Kernel)
+			tr.add("bootfile", scriptURL.String(), source, fmt.Sprintf("client is iPXE and in rescue boot, serving URL of boot script for kernel %s", ri.Kernel))
+		}
+	} else if ifaceInfo.CompID == "" {
+		// Devices only in the overrides file (switches, PDUs) do not
+		// network boot unless given a boot file there
+		decision = "none"
+		tr.add("bootfile", "none", "overrides_file", "client is not in SMD and has no boot file in the overrides file")
+	} else if missingNID(ifaceInfo) && cfg.missingNID == missingNIDDefer {
+		// Boot the Node once SMD has given it a NID, which its boot
+		// script and hostname may depend on
+		decision = "missing_nid"
+		log.Warnf("%s has no NID, not booting it until it has one", ifaceInfo.CompID)
+		tr.add("bootfile", "none", "smd", "Node has no NID (missing_nid=defer)")
+	} else if bootloader := ifaceInfo.Overrides.Bootloader; !isIPXE && bootloader != "" {
+		// Send the bootloader set for this node in SMD
+		decision = "bootloader_override"
+		resp.Options.Update(dhcpv4.OptBootFileName(bootloader))
+		tr.add("bootfile", bootloader, "smd", "client is not iPXE, serving bootloader property of Component")
+	} else if isIPXE && bootScript != "" {
+		// BOOT STAGE 2: Send the boot script URL set for this node in SMD
+		decision = "bootscript_override"
+		resp.Options.Update(dhcpv4.OptBootFileName(bootScript))
+		tr.add("bootfile", bootScript, "smd", "client is iPXE, serving bootscript property of Component")
+	} else if sb := cfg.secureBoot; sb != nil && !isIPXE && sb.nodes.matches(ifaceInfo) {
+		// SECURE BOOT: Send the signed shim, which loads GRUB
+		decision = "secure_boot"
+		if shim, ok := sb.serveShim(req, resp, cfg.httpURL); ok {
+			tr.add("bootfile", shim, "coresmd", "node boots with Secure Boot, serving shim for its architecture")
+		} else {
+			log.Errorf("no Secure Boot shim available for architecture %v of %s", req.ClientArch(), hwAddr)
+			tr.add("bootfile", "none", "coresmd", "node boots with Secure Boot, but no shim is available for its architecture")
+		}
+	} else if rule, ok := cfg.matchNBP(req); !isIPXE && ok {
+		// Send the network bootstrap program mapped to the client's class
+		decision = "nbp_map"
+		if nbp, ok := cfg.serveNBP(rule, req, resp); ok {
+			tr.add("bootfile", nbp, "coresmd", "client class matches nbp_map, serving its network bootstrap program")
+		} else {
+			tr.add("bootfile", "none", "coresmd", "client class matches nbp_map, but no http_url is configured for UEFI HTTP boot")
+		}
+	} else if !isIPXE {
 		// BOOT STAGE 1: Send iPXE bootloader over TFTP
-		resp, _ = ipxe.ServeIPXEBootloader(log, req, resp)
+		decision = "ipxe_bootloader"
+		var ok bool
+		resp, ok = cfg.bootloadersFor(snp).Serve(log, req, resp, cfg.httpURL)
+		if ok && snp {
+			tr.add("bootfile", resp.BootFileNameOption(), "coresmd", "client is not iPXE, serving SNP bootloader for its architecture")
+		} else if ok {
+			tr.add("bootfile", resp.BootFileNameOption(), "coresmd", "client is not iPXE, serving bootloader for its architecture")
+		} else if !req.Options.Has(dhcpv4.OptionClientSystemArchitectureType) {
+			tr.add("bootfile", "none", "client", "client sent no architecture")
+			if a := cfg.outcomes.missingArch; a == actionContinue || a == actionDrop {
+				return cfg.takeAction("missing_arch", a, resp, tr)
+			}
+			outcome = "missing_arch"
+		} else {
+			tr.add("bootfile", "none", "coresmd", "no bootloader available for client architecture")
+			if a := cfg.outcomes.unknownArch; a == actionContinue || a == actionDrop {
+				return cfg.takeAction("unknown_arch", a, resp, tr)
+			}
+			outcome = "unknown_arch"
+		}
+	} else if reason := cfg.localBootReason(ifaceInfo); reason != "" {
+		// BOOT STAGE 2: Make iPXE exit so that the firmware boots from
+		// the next boot device, the local disk
+		decision = "local_boot"
+		bootfile := cfg.builtinScriptBootfile(exitScriptName)
+		resp.Options.Update(dhcpv4.OptBootFileName(bootfile))
+		tr.add("bootfile", bootfile, "coresmd", "client is iPXE but "+reason+", serving exit script for local boot")
+	} else if n := p.countChain(cfg, req, hwAddr); cfg.chainLoopLimit > 0 && n > cfg.chainLoopLimit {
+		// BOOT STAGE 2: The client keeps coming back after chaining to
+		// its boot script, so stop the loop
+		decision = "chain_loop"
+		if n == cfg.chainLoopLimit+1 {
+			metricChainLoops.Inc()
+			log.Errorf("%s was handed its boot script URL %d times within %s; its boot script likely chains back to DHCP, serving %s script", hwAddr, cfg.chainLoopLimit, cfg.chainLoopWindow, chainLoopScriptName)
+		}
+		bootfile := cfg.builtinScriptBootfile(chainLoopScriptName)
+		resp.Options.Update(dhcpv4.OptBootFileName(bootfile))
+		tr.add("bootfile", bootfile, "coresmd", fmt.Sprintf("client is iPXE but was handed its boot script URL %d times within %s, serving chain loop script", n-1, cfg.chainLoopWindow))
+	} else if cfg.bootParams != nil {
+		// BOOT STAGE 2: Send URL to boot script generated from cached BSS
+		// boot parameters
+		decision = "bss_embed"
+		scriptURL := localBootScriptURL(cfg.httpURL, hwAddr)
+		if cfg.bootScriptKey != nil {
+			SignBootScriptURL(scriptURL, cfg.bootScriptKey, time.Now())
+		}
+		resp.Options.Update(dhcpv4.OptBootFileName(scriptURL.String()))
+		tr.add("bootfile", scriptURL.String(), "coresmd", "client is iPXE, serving URL of boot script generated from BSS boot parameters")
+	} else if cfg.fallbackBootfile != "" && p.bootScriptDown.Load() {
+		// BOOT STAGE 2: BSS is down, so fail into a defined state instead
+		// of leaving the client hanging on it
+		decision = "fallback_bootfile"
+		resp.Options.Update(dhcpv4.OptBootFileName(cfg.fallbackBootfile))
+		tr.add("bootfile", cfg.fallbackBootfile, "coresmd", "client is iPXE but boot script base URL is unreachable, serving fallback boot file")
+	} else if cfg.stage1 != nil {
+		// BOOT STAGE 2: Send URL to a generated script that chains to the
+		// BSS boot script, retrying and falling back if it fails
+		decision = "stage1_script"
+		scriptURL := stage1URL(cfg.httpURL, hwAddr, params.Arch)
+		if cfg.bootScriptKey != nil {
+			SignBootScriptURL(scriptURL, cfg.bootScriptKey, time.Now())
+		}
+		resp.Options.Update(dhcpv4.OptBootFileName(scriptURL.String()))
+		tr.add("bootfile", scriptURL.String(), "coresmd", "client is iPXE, serving URL of stage-1 script chaining to its boot script")
 	} else {
 		// BOOT STAGE 2: Send URL to BSS boot script
-		bssURL := bootScriptBaseURL.JoinPath("/boot/v1/bootscript")
-		bssURL.RawQuery = fmt.Sprintf("mac=%s", hwAddr)
+		decision = "boot_script"
+		var archs []iana.Arch
+		if hasArch {
+			archs = []iana.Arch{bootArch}
+		}
+		base := cfg.bootScriptBase(archs, ifaceInfo.Role, ifaceInfo.SubRole)
+		bssURL, err := cfg.bootScriptPath.URL(base, params)
+		if err != nil {
+			log.Errorf("unable to build boot script URL for %s: %v", hwAddr, err)
+			tr.add("bootfile", "none", "coresmd", err.Error())
+			return resp, true
+		}
+		if cfg.bootScriptKey != nil {
+			SignBootScriptURL(bssURL, cfg.bootScriptKey, time.Now())
+		}
 		resp.Options.Update(dhcpv4.OptBootFileName(bssURL.String()))
+		tr.add("bootfile", bssURL.String(), "coresmd", "client is iPXE, serving boot script URL")
+	}
+
+	if !ipOnly && isIPXE && len(cfg.ipxeOptions) > 0 {
+		resp.Options.Update(dhcpv4.OptGeneric(optionIPXEEncapsulated, cfg.ipxeOptions))
+		tr.add("ipxe_options", fmt.Sprintf("%x", cfg.ipxeOptions), "coresmd", "client is iPXE, sending configured iPXE settings")
+	}
+	if !ipOnly && !isIPXE && cfg.pxe.apply(req, resp) {
+		tr.add("vendor_options", fmt.Sprintf("%x", cfg.pxe.encode()), "coresmd", "client is a PXE client, sending PXE vendor options")
+	}
+	if u, err := cfg.metadataURL.apply(resp, params); err != nil {
+		log.Errorf("unable to build metadata URL for %s: %v", hwAddr, err)
+	} else if u != "" {
+		tr.add("metadata_url", u, "coresmd", fmt.Sprintf("sent in option %d", cfg.metadataURL.code.Code()))
+	}
+
+	if hasStatic && len(static.Options) > 0 {
+		tr.add("static_options", static.applyOptions(resp), "overrides_file", "set for the client in the overrides file")
+	}
+
+	if cfg.honorPRL {
+		if changes := applyParameterRequestList(req, resp); changes != "" {
+			tr.add("parameter_request_list", changes, "coresmd", "fitted to the options requested by the client")
+		}
 	}
 
+	changes, err := fitMessageSize(req, resp)
+	if err != nil {
+		log.Warnf("response to %s may be dropped or truncated by the client: %v", hwAddr, err)
+	}
+	if changes != "" {
+		tr.add("message_size", changes, "coresmd", fmt.Sprintf("response exceeded the maximum message size of %d bytes", maxResponseSize(req)))
+	}
+
+	cfg.countOutcome(outcome)
+	if !cfg.simulated {
+		// Count each DHCP exchange once in the boot funnel
+		stage := funnelStage(decision, isIPXE, resp.BootFileNameOption())
+		if req.MessageType() == dhcpv4.MessageTypeRequest {
+			p.recordFunnel(cfg, log, hwAddr, stage)
+		}
+		p.recordLifecycle(cfg, req, resp, hwAddr, ifaceInfo.CompID, isIPXE, stage == funnelBootScript)
+	}
+
+	log.WithFields(logrus.Fields{"decision": decision, "bootfile": resp.BootFileNameOption()}).Infof("sending %s", resp.MessageType())
+	oteltrace.SpanFromContext(ctx).SetAttributes(attribute.String("coresmd.decision", decision))
 	debug.DebugResponse(log, resp)
 
 	return resp, true
 }
 
-func lookupMAC(mac string) (IfaceInfo, error) {
-	var ii IfaceInfo
-
-	// Match MAC address with EthernetInterface
-	ei, ok := cache.EthernetInterfaces[mac]
-	if !ok {
-		return ii, fmt.Errorf("no EthernetInterfaces were found in cache for hardware address %s", mac)
+// assignIP assigns the client of req, with the interface ifaceInfo, one of its
+// addresses, setting it in resp and returning it. If the request must not be
+// answered with an address, ok is false and out is the response to send
+// instead, nil to drop the request.
+func (p *PluginState) assignIP(log *logrus.Entry, cfg *pluginConfig, req, resp *dhcpv4.DHCPv4, ifaceInfo IfaceInfo, hwAddr string, tr *trace) (assignedIP net.IP, out *dhcpv4.DHCPv4, ok bool) {
+	assignedIP = selectIP(req, resp, ifaceInfo.IPList, tr).To4()
+	// Keep answering with the address already offered or leased to the
+	// client
+	if held, ok := p.keepHeldIP(clientKey(req), assignedIP, ifaceInfo.IPList, time.Now()); ok {
+		tr.add("ip", held.String(), "leases", fmt.Sprintf("already offered or leased to the client, instead of %s", assignedIP))
+		assignedIP = held
 	}
-	ii.MAC = mac
 
-	// If found, make sure Component exists with ID matching to EthernetInterface ID
-	ii.CompID = ei.ComponentID
-	log.Debugf("EthernetInterface found in cache for hardware address %s with ID %s", ii.MAC, ii.CompID)
-	comp, ok := cache.Components[ii.CompID]
-	if !ok {
-		return ii, fmt.Errorf("no Component %s found in cache for EthernetInterface hardware address %s", ii.CompID, ii.MAC)
+	// Make sure a client requesting an address is requesting the one it is
+	// assigned (e.g. not a stale lease from before it was re-addressed)
+	if req.MessageType() == dhcpv4.MessageTypeRequest {
+		if reqIP := requestedIP(req); reqIP != nil && !reqIP.Equal(assignedIP) {
+			log.Warnf("%s requested %s but is assigned %s in SMD (action: %s)", hwAddr, reqIP, assignedIP, cfg.requestedIPMismatch)
+			tr.add("requested_ip", reqIP.String(), "client", fmt.Sprintf("does not match assigned address %s, action: %s", assignedIP, cfg.requestedIPMismatch))
+			switch cfg.requestedIPMismatch {
+			case mismatchNAK:
+				nak, err := newNak(req, resp, fmt.Sprintf("requested address %s is not assigned to this client", reqIP))
+				if err != nil {
+					log.Errorf("failed to NAK mismatched request: %v", err)
+					return nil, resp, false
+				}
+				debug.DebugResponse(log, nak)
+				return nil, nak, false
+			case mismatchDrop:
+				return nil, nil, false
+			}
+		}
 	}
-	ii.Type = comp.Type
-	log.Debugf("matching Component of type %s with ID %s found in cache for hardware address %s", ii.Type, ii.CompID, ii.MAC)
-	if ii.Type == "Node" {
-		ii.CompNID = comp.NID
+	// Make sure nothing else is using the address before offering it, if
+	// enabled
+	if cfg.probeTimeout > 0 && req.MessageType() == dhcpv4.MessageTypeDiscover {
+		conflicted, conflictMAC, err := probeConflict(assignedIP, hwAddr, cfg.probeTimeout)
+		if err != nil {
+			log.Warnf("unable to probe %s before offering it to %s: %v", assignedIP, hwAddr, err)
+		} else if conflicted {
+			metricProbeConflicts.Inc()
+			if conflictMAC == "" {
+				conflictMAC = "unknown"
+			}
+			p.markConflict(assignedIP.String(), conflictMAC)
+			log.Errorf("address conflict: %s is assigned to %s in SMD but is in use by another device (hardware address: %s)", assignedIP, hwAddr, conflictMAC)
+			tr.add("probe", "conflict", "network", fmt.Sprintf("address in use by %s", conflictMAC))
+		}
 	}
-	if len(ei.IPAddresses) == 0 {
-		return ii, fmt.Errorf("EthernetInterface for Component %s (type %s) contains no IP addresses for hardware address %s", ii.CompID, ii.Type, ii.MAC)
+	if c, ok := p.conflictFor(assignedIP.String()); ok {
+		log.Warnf("assigning %s to %s although %s declined it as conflicted %d time(s), last at %s", assignedIP, hwAddr, c.MAC, c.Count, c.LastSeen.Format(time.RFC3339))
 	}
-	log.Debugf("IP addresses available for hardware address %s (Component %s of type %s): %v", ii.MAC, ii.CompID, ii.Type, ei.IPAddresses)
-	var ipList []net.IP
-	for _, ipStr := range ei.IPAddresses {
-		ip := net.ParseIP(ipStr.IPAddress)
-		ipList = append(ipList, ip)
+	if holder := p.leases.holder(assignedIP, clientKey(req), time.Now()); holder != "" {
+		log.Warnf("assigning %s to %s although it is currently offered or leased to %s", assignedIP, hwAddr, holder)
+		tr.add("leases", "conflict", "coresmd", fmt.Sprintf("address currently offered or leased to %s", holder))
 	}
-	ii.IPList = ipList
+	resp.YourIPAddr = assignedIP
+
+	return assignedIP, nil, true
+}
 
-	return ii, nil
+// BootScriptURL returns the URL of the BSS boot script for the given MAC
+// address using DefaultBootScriptPath. The MAC is not escaped so that iPXE
+// variables (e.g. ${netX/mac}) can be passed in its place.
+func BootScriptURL(base *url.URL, mac string) *url.URL {
+	bssURL, _ := defaultBootScriptTemplate.URL(base, BootScriptParams{MAC: mac})
+	return bssURL
 }
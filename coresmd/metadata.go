@@ -0,0 +1,70 @@
+package coresmd
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// defaultMetadataOption is the site-specific option (RFC 2132) carrying the
+// metadata URL if metadata_option is not set.
+const defaultMetadataOption = 224
+
+// metadataURL is the URL of the cloud-init or metadata server sent to clients
+// in a site-specific option, so that images can find it without having it
+// baked in.
+type metadataURL struct {
+	tmpl *template.Template
+	code dhcpv4.OptionCode
+}
+
+// parseMetadataURL parses a metadata URL template with the same fields as
+// boot_script_path, to be sent in option code.
+func parseMetadataURL(text string, code int) (*metadataURL, error) {
+	if code < 224 || code > 254 {
+		return nil, fmt.Errorf("option %d is not a site-specific option (224-254)", code)
+	}
+	tmpl, err := template.New("metadata_url").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse metadata URL template: %w", err)
+	}
+	m := &metadataURL{tmpl: tmpl, code: dhcpv4.GenericOptionCode(code)}
+
+	// Catch references to unknown fields and relative URLs now rather than on
+	// every request
+	sample, err := m.url(BootScriptParams{MAC: "00:00:00:00:00:00", Xname: "x0", NID: 1, Arch: "7"})
+	if err != nil {
+		return nil, err
+	}
+	if u, err := url.Parse(sample); err != nil || u.Scheme == "" || u.Host == "" {
+		return nil, fmt.Errorf("metadata URL %q is not an absolute URL", sample)
+	}
+
+	return m, nil
+}
+
+// url returns the metadata URL for params.
+func (m *metadataURL) url(params BootScriptParams) (string, error) {
+	var b strings.Builder
+	if err := m.tmpl.Execute(&b, params); err != nil {
+		return "", fmt.Errorf("failed to execute metadata URL template: %w", err)
+	}
+	return b.String(), nil
+}
+
+// apply sets the metadata URL for params in resp and returns it. A nil
+// metadataURL sets nothing.
+func (m *metadataURL) apply(resp *dhcpv4.DHCPv4, params BootScriptParams) (string, error) {
+	if m == nil {
+		return "", nil
+	}
+	u, err := m.url(params)
+	if err != nil {
+		return "", err
+	}
+	resp.Options.Update(dhcpv4.OptGeneric(m.code, []byte(u)))
+	return u, nil
+}
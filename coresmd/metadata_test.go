@@ -0,0 +1,52 @@
+package coresmd
+
+import (
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestParseMetadataURL(t *testing.T) {
+	for _, tt := range []struct {
+		text string
+		code int
+		ok   bool
+	}{
+		{"http://10.0.0.1:27777/cloud-init/{{.Xname}}/", 224, true},
+		{"http://10.0.0.1:27777/", 254, true},
+		{"http://10.0.0.1:27777/", 223, false},
+		{"http://10.0.0.1:27777/", 255, false},
+		{"/cloud-init/", 224, false},
+		{"http://10.0.0.1/{{.Bogus}}", 224, false},
+		{"http://10.0.0.1/{{", 224, false},
+	} {
+		_, err := parseMetadataURL(tt.text, tt.code)
+		if (err == nil) != tt.ok {
+			t.Errorf("parseMetadataURL(%q, %d): got error %v, want ok %t", tt.text, tt.code, err, tt.ok)
+		}
+	}
+}
+
+func TestHandler4MetadataURL(t *testing.T) {
+	p := setupHandler(t)
+	cfg := p.config.Load()
+
+	// Nothing is sent unless configured
+	req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01")
+	resp, _ = p.Handler4(req, resp)
+	if got := resp.Options.Get(dhcpv4.GenericOptionCode(defaultMetadataOption)); got != nil {
+		t.Errorf("got metadata URL %q without metadata_url", got)
+	}
+
+	m, err := parseMetadataURL("http://10.0.0.1:27777/cloud-init/{{.Xname}}/", 230)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.metadataURL = m
+	req, resp = newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01")
+	resp, _ = p.Handler4(req, resp)
+	want := "http://10.0.0.1:27777/cloud-init/x3000c0s0b0n0/"
+	if got := string(resp.Options.Get(dhcpv4.GenericOptionCode(230))); got != want {
+		t.Errorf("metadata URL = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,134 @@
+package coresmd
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/OpenCHAMI/coresmd/internal/metrics"
+)
+
+var (
+	metricMessages = metrics.NewCounter("coresmd_messages_total",
+		"DHCP messages handled by type (discover, request, inform, release, decline, or other).", "type")
+	metricOutcomes = metrics.NewCounter("coresmd_outcomes_total",
+		"Requests answered in full (outcome=served), refused with a DHCPNAK (outcome=nak), or that could not be fully answered: client not in SMD (outcome=unknown_mac), client in SMD without a usable address (outcome=lookup_error), no address usable on the link (outcome=unroutable), or no bootloader for the client's architecture (outcome=missing_arch or outcome=unknown_arch).", "outcome")
+	metricDeclines = metrics.NewCounter("coresmd_declines_total",
+		"DHCPDECLINE messages received, indicating an address conflict.")
+	metricReleases = metrics.NewCounter("coresmd_releases_total",
+		"DHCPRELEASE messages received.")
+	metricOtherServer = metrics.NewCounter("coresmd_other_server_requests_total",
+		"DHCPREQUEST, DHCPDECLINE, and DHCPRELEASE messages ignored because they were addressed to another DHCP server.")
+	metricInforms = metrics.NewCounter("coresmd_informs_total",
+		"DHCPINFORM messages answered with options only.")
+	metricUnroutable = metrics.NewCounter("coresmd_unroutable_total",
+		"Requests from clients with no address usable on the link the request arrived on.")
+	metricDNSUpdates = metrics.NewCounter("coresmd_dns_updates_total",
+		"Assignments published in DNS (result=success), that the DNS server did not apply (result=failure), or dropped because too many were waiting (result=dropped).", "result")
+	metricProbeConflicts = metrics.NewCounter("coresmd_probe_conflicts_total",
+		"Addresses found to be in use by another device when probed before offering.")
+	metricConflicts = metrics.NewGauge("coresmd_address_conflicts",
+		"Addresses currently marked as conflicted.")
+	metricProvisionalLeases = metrics.NewGauge("coresmd_provisional_leases",
+		"Addresses currently leased from the discovery pool.")
+	metricCacheAge = metrics.NewGauge("coresmd_smd_cache_age_seconds",
+		"Seconds since the last successful refresh of the SMD cache, or -1 if it has not been loaded yet.")
+	metricCacheStale = metrics.NewGauge("coresmd_smd_cache_stale",
+		"Whether the SMD cache is older than staleness_alert (1) or not (0).")
+	metricBootScriptUp = metrics.NewGauge("coresmd_boot_script_url_up",
+		"Whether the boot script base URL was reachable at the last check, if a fallback boot file is configured.", "url")
+	metricChainLoops = metrics.NewCounter("coresmd_chain_loops_total",
+		"iPXE clients found to return to DHCP too often after chaining to their boot script.")
+	metricRateLimited = metrics.NewCounter("coresmd_rate_limited_total",
+		"Requests dropped because their client (limit=mac) or relay agent (limit=relay) exceeded its rate limit.", "limit")
+	metricMACListDenied = metrics.NewCounter("coresmd_mac_list_denied_total",
+		"Requests dropped because their client is on the deny list (list=deny) or not on the allow list (list=allow).", "list")
+	metricFailoverLeader = metrics.NewGauge("coresmd_failover_leader",
+		"Whether this server is the failover leader answering clients (1) or on standby (0), if failover is enabled.")
+	metricFunnel = metrics.NewCounter("coresmd_boot_funnel_total",
+		"Nodes reaching a stage of the boot funnel: bootloader served (stage=stage1), iPXE seen (stage=ipxe), or boot script URL served (stage=boot_script).", "stage")
+	metricFunnelNodes = metrics.NewGauge("coresmd_boot_funnel_nodes",
+		"Nodes by the last boot funnel stage they reached.", "stage")
+	metricBootEvents = metrics.NewCounter("coresmd_boot_events_total",
+		"Boot lifecycle events published to the message bus (result=published), that could not be sent (result=failure), or dropped because too many were waiting (result=dropped).", "result")
+	metricFunnelStuck = metrics.NewGauge("coresmd_boot_funnel_stuck_nodes",
+		"Nodes served their bootloader funnel_stuck_limit times in a row without iPXE coming back.")
+)
+
+// startMetricsServer serves metrics at /metrics on listen, using HTTPS if
+// tlsConfig is non-nil, and returns a function that closes the server.
+func startMetricsServer(listen string, tlsConfig *tls.Config) (func(), error) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.DefaultRegistry.Handler())
+
+	s := &http.Server{
+		Handler:   mux,
+		TLSConfig: tlsConfig,
+	}
+	ln, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		var err error
+		if tlsConfig != nil {
+			err = s.ServeTLS(ln, "", "")
+		} else {
+			err = s.Serve(ln)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Errorf("metrics server failed: %v", err)
+		}
+	}()
+
+	return func() { s.Close() }, nil
+}
+
+// defaultStatsdInterval is how often metrics are sent to the statsd server if
+// metrics_statsd_interval is not set.
+const defaultStatsdInterval = 10 * time.Second
+
+// startStatsdEmitter sends metrics to the statsd server at addr every interval
+// and returns a function that sends them one last time and stops.
+func startStatsdEmitter(addr, prefix string, format metrics.StatsdFormat, interval time.Duration) (func(), error) {
+	e, err := metrics.DefaultRegistry.NewStatsdEmitter(addr, prefix, format)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		failing := false
+		for {
+			select {
+			case <-ctx.Done():
+				e.Flush()
+				e.Close()
+				return
+			case <-ticker.C:
+			}
+			// Only log when sending starts and stops failing, since
+			// the statsd server going away fails every flush
+			if err := e.Flush(); err != nil && !failing {
+				log.Errorf("failed to send metrics to statsd server %s: %v", addr, err)
+				failing = true
+			} else if err == nil && failing {
+				log.Infof("sending metrics to statsd server %s again", addr)
+				failing = false
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}, nil
+}
@@ -0,0 +1,150 @@
+package coresmd
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OpenCHAMI/coresmd/internal/metrics"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+// listenStatsd returns the address of a UDP socket and a function returning
+// the lines of the next packet received on it.
+func listenStatsd(t *testing.T) (string, func() []string) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return conn.LocalAddr().String(), func() []string {
+		t.Helper()
+		buf := make([]byte, 65535)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Split(string(buf[:n]), "\n")
+	}
+}
+
+func TestStatsdEmitter(t *testing.T) {
+	for _, tc := range []struct {
+		format metrics.StatsdFormat
+		first  []string
+		second []string
+	}{
+		{
+			format: metrics.StatsdGraphite,
+			first:  []string{"coresmd.leases:3|g", "coresmd.requests_total.result.ack:2|c", "coresmd.requests_total.result.nak:1|c", "coresmd.skew.server.dhcp1_example_com:0|g", "coresmd.skew.server.dhcp1_example_com:-1.5|g"},
+			second: []string{"coresmd.leases:3|g", "coresmd.requests_total.result.ack:1|c", "coresmd.skew.server.dhcp1_example_com:0|g", "coresmd.skew.server.dhcp1_example_com:-1.5|g"},
+		},
+		{
+			format: metrics.StatsdTags,
+			first:  []string{"coresmd.leases:3|g", "coresmd.requests_total:2|c|#result:ack", "coresmd.requests_total:1|c|#result:nak", "coresmd.skew:0|g|#server:dhcp1_example_com", "coresmd.skew:-1.5|g|#server:dhcp1_example_com"},
+			second: []string{"coresmd.leases:3|g", "coresmd.requests_total:1|c|#result:ack", "coresmd.skew:0|g|#server:dhcp1_example_com", "coresmd.skew:-1.5|g|#server:dhcp1_example_com"},
+		},
+	} {
+		r := metrics.NewRegistry()
+		requests := r.Register("requests_total", "", metrics.CounterType, "result")
+		leases := r.Register("leases", "", metrics.GaugeType)
+		skew := r.Register("skew", "", metrics.GaugeType, "server")
+		addr, receive := listenStatsd(t)
+		e, err := r.NewStatsdEmitter(addr, "coresmd", tc.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		requests.Add(2, "ack")
+		requests.Inc("nak")
+		leases.Set(3)
+		skew.Set(-1.5, "dhcp1.example.com")
+		if err := e.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if got := receive(); strings.Join(got, "\n") != strings.Join(tc.first, "\n") {
+			t.Errorf("%s: first flush got %q, want %q", tc.format, got, tc.first)
+		}
+		// Counters are sent as the increase since the last flush and
+		// skipped if unchanged
+		requests.Inc("ack")
+		if err := e.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if got := receive(); strings.Join(got, "\n") != strings.Join(tc.second, "\n") {
+			t.Errorf("%s: second flush got %q, want %q", tc.format, got, tc.second)
+		}
+		e.Close()
+	}
+}
+
+// sampleValue returns the value of the series of m with the given label
+// values, or 0 if there is none.
+func sampleValue(m *metrics.Metric, labelValues ...string) float64 {
+	for _, s := range m.Samples() {
+		if strings.Join(s.LabelValues, ",") == strings.Join(labelValues, ",") {
+			return s.Value
+		}
+	}
+	return 0
+}
+
+func TestHandler4Counters(t *testing.T) {
+	p := setupHandler(t)
+	p.lifecycles = newLifecycleTracker()
+	cfg := p.config.Load()
+	cfg.outcomes = defaultOutcomeActions
+
+	type counts struct {
+		discovers, requests                  float64
+		served, nak, unknownMAC, missingArch float64
+	}
+	read := func() counts {
+		return counts{
+			discovers:   sampleValue(metricMessages, "discover"),
+			requests:    sampleValue(metricMessages, "request"),
+			served:      sampleValue(metricOutcomes, outcomeServed),
+			nak:         sampleValue(metricOutcomes, outcomeNAK),
+			unknownMAC:  sampleValue(metricOutcomes, "unknown_mac"),
+			missingArch: sampleValue(metricOutcomes, "missing_arch"),
+		}
+	}
+	before := read()
+
+	send := func(mt dhcpv4.MessageType, mac string, mods ...dhcpv4.Modifier) {
+		t.Helper()
+		req, resp := newRequest(t, mt, mac, mods...)
+		p.Handler4(req, resp)
+	}
+	send(dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", withArch(iana.EFI_X86_64))
+	send(dhcpv4.MessageTypeRequest, "aa:bb:cc:dd:ee:01", withArch(iana.EFI_X86_64))
+	send(dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01")
+	send(dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:ff")
+	send(dhcpv4.MessageTypeRequest, "aa:bb:cc:dd:ee:01", withArch(iana.EFI_X86_64), dhcpv4.WithOption(dhcpv4.OptRequestedIPAddress(net.IPv4(172, 16, 0, 99))))
+
+	// Simulated requests are not counted
+	if _, err := p.lookup(map[string][]string{"mac": {"aa:bb:cc:dd:ee:01"}, "arch": {"7"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := p.lifecycles.lookup("aa:bb:cc:dd:ee:01"); !ok {
+		t.Fatal("node not tracked")
+	}
+
+	after := read()
+	got := counts{
+		discovers:   after.discovers - before.discovers,
+		requests:    after.requests - before.requests,
+		served:      after.served - before.served,
+		nak:         after.nak - before.nak,
+		unknownMAC:  after.unknownMAC - before.unknownMAC,
+		missingArch: after.missingArch - before.missingArch,
+	}
+	want := counts{discovers: 3, requests: 2, served: 2, nak: 1, unknownMAC: 1, missingArch: 1}
+	if got != want {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
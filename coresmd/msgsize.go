@@ -0,0 +1,161 @@
+package coresmd
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+const (
+	// ipUDPHeaderLen is the size of the IP and UDP headers, which count
+	// towards the maximum message size (option 57).
+	ipUDPHeaderLen = 28
+	// fileFieldLen and snameFieldLen are the usable sizes of the file and
+	// sname header fields, which dhcpv4 always NUL-terminates.
+	fileFieldLen  = 127
+	snameFieldLen = 63
+
+	overloadFile  = 1
+	overloadSname = 2
+)
+
+// requiredOptions are never dropped to make a response fit: they are needed by
+// every client (RFC 2131) or by PXE and HTTP boot clients.
+var requiredOptions = []dhcpv4.OptionCode{
+	dhcpv4.OptionDHCPMessageType,
+	dhcpv4.OptionServerIdentifier,
+	dhcpv4.OptionIPAddressLeaseTime,
+	dhcpv4.OptionRenewTimeValue,
+	dhcpv4.OptionRebindingTimeValue,
+	dhcpv4.OptionSubnetMask,
+	dhcpv4.OptionBootfileName,
+	dhcpv4.OptionClassIdentifier,
+	dhcpv4.OptionVendorSpecificInformation,
+}
+
+// maxResponseSize returns the largest DHCP message req's client accepts,
+// excluding the IP and UDP headers. Every client must accept 576 bytes.
+func maxResponseSize(req *dhcpv4.DHCPv4) int {
+	size := dhcpv4.MaxMessageSize
+	if m, err := req.MaxMessageSize(); err == nil && int(m) > size {
+		size = int(m)
+	}
+	return size - ipUDPHeaderLen
+}
+
+// fitMessageSize shrinks resp until it fits in the maximum message size of
+// req's client, so that long boot file URLs do not produce packets the client
+// drops or truncates. In order, it:
+//
+//  1. moves a boot file name short enough for the file header field there,
+//  2. moves other options into the unused file and sname fields (option
+//     overload, RFC 2131),
+//  3. drops options the client did not request in its Parameter Request List,
+//     except the ones in requiredOptions.
+//
+// The boot file name is never truncated since a partial URL is useless. It
+// returns a description of the changes made, and an error if resp still does
+// not fit.
+func fitMessageSize(req, resp *dhcpv4.DHCPv4) (string, error) {
+	limit := maxResponseSize(req)
+	if len(resp.ToBytes()) <= limit {
+		return "", nil
+	}
+
+	var changes []string
+	fits := func() bool { return len(resp.ToBytes()) <= limit }
+
+	// The file field is where BOOTP clients looked for the boot file in the
+	// first place
+	if bootfile := resp.BootFileNameOption(); bootfile != "" && len(bootfile) <= fileFieldLen && resp.BootFileName == "" {
+		resp.BootFileName = bootfile
+		resp.Options.Del(dhcpv4.OptionBootfileName)
+		changes = append(changes, "moved boot file name to file field")
+		if fits() {
+			return strings.Join(changes, ", "), nil
+		}
+	}
+
+	var overload byte
+	if resp.BootFileName == "" {
+		if resp.BootFileName = packOptions(resp, fileFieldLen); resp.BootFileName != "" {
+			overload |= overloadFile
+		}
+	}
+	if resp.ServerHostName == "" {
+		if resp.ServerHostName = packOptions(resp, snameFieldLen); resp.ServerHostName != "" {
+			overload |= overloadSname
+		}
+	}
+	if overload != 0 {
+		resp.Options.Update(dhcpv4.OptGeneric(dhcpv4.OptionOptionOverload, []byte{overload}))
+		changes = append(changes, "moved options to file and sname fields")
+		if fits() {
+			return strings.Join(changes, ", "), nil
+		}
+	}
+
+	if prl := req.ParameterRequestList(); len(prl) > 0 {
+		for _, code := range sortedOptionCodes(resp) {
+			oc := dhcpv4.GenericOptionCode(code)
+			if prl.Has(oc) || code == dhcpv4.OptionOptionOverload.Code() || isRequiredOption(code) {
+				continue
+			}
+			resp.Options.Del(oc)
+			changes = append(changes, fmt.Sprintf("dropped unrequested %s", oc))
+			if fits() {
+				return strings.Join(changes, ", "), nil
+			}
+		}
+	}
+
+	return strings.Join(changes, ", "), fmt.Errorf("response is %d bytes, more than the %d the client accepts", len(resp.ToBytes()), limit)
+}
+
+// packOptions removes from resp the largest options that fit together in a
+// header field of the given size, and returns them encoded for that field,
+// terminated by an End option. Required options and the boot file name stay in
+// the options field, where clients that ignore option overload find them.
+func packOptions(resp *dhcpv4.DHCPv4, size int) string {
+	var codes []uint8
+	for _, code := range sortedOptionCodes(resp) {
+		if len(resp.Options[code]) <= 255 && !isRequiredOption(code) {
+			codes = append(codes, code)
+		}
+	}
+	slices.SortStableFunc(codes, func(a, b uint8) int { return len(resp.Options[b]) - len(resp.Options[a]) })
+
+	var b []byte
+	for _, code := range codes {
+		data := resp.Options[code]
+		// Leave room for the End option
+		if len(b)+2+len(data) > size-1 {
+			continue
+		}
+		b = append(b, code, byte(len(data)))
+		b = append(b, data...)
+		delete(resp.Options, code)
+	}
+	if len(b) == 0 {
+		return ""
+	}
+
+	return string(append(b, dhcpv4.OptionEnd.Code()))
+}
+
+func isRequiredOption(code uint8) bool {
+	return slices.ContainsFunc(requiredOptions, func(r dhcpv4.OptionCode) bool { return r.Code() == code })
+}
+
+// sortedOptionCodes returns the codes of the options in resp in ascending
+// order.
+func sortedOptionCodes(resp *dhcpv4.DHCPv4) []uint8 {
+	codes := make([]uint8, 0, len(resp.Options))
+	for code := range resp.Options {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	return codes
+}
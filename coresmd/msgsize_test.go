@@ -0,0 +1,110 @@
+package coresmd
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// overloadedOptions decodes the options packed into a header field.
+func overloadedOptions(t *testing.T, field string) dhcpv4.Options {
+	t.Helper()
+
+	opts := make(dhcpv4.Options)
+	b := []byte(field)
+	for len(b) > 0 && b[0] != dhcpv4.OptionEnd.Code() {
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			t.Fatalf("malformed overloaded options % x", field)
+		}
+		opts[b[0]] = b[2 : 2+b[1]]
+		b = b[2+b[1]:]
+	}
+	if len(b) == 0 {
+		t.Fatalf("overloaded options % x are not terminated", field)
+	}
+
+	return opts
+}
+
+func TestFitMessageSize(t *testing.T) {
+	newResponse := func(t *testing.T, bootfile string, modifiers ...dhcpv4.Modifier) (*dhcpv4.DHCPv4, *dhcpv4.DHCPv4) {
+		req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", modifiers...)
+		resp.UpdateOption(dhcpv4.OptIPAddressLeaseTime(time.Hour))
+		resp.UpdateOption(dhcpv4.OptHostName("nid0001"))
+		resp.UpdateOption(dhcpv4.OptRootPath("172.16.0.253"))
+		resp.UpdateOption(dhcpv4.OptDomainName(strings.Repeat("d", 40)))
+		resp.UpdateOption(dhcpv4.OptBootFileName(bootfile))
+		return req, resp
+	}
+
+	t.Run("fits", func(t *testing.T) {
+		req, resp := newResponse(t, "http://172.16.0.253:8081/boot/v1/bootscript?mac=aa:bb:cc:dd:ee:01")
+		changes, err := fitMessageSize(req, resp)
+		if err != nil || changes != "" {
+			t.Fatalf("got changes %q and error %v, want none", changes, err)
+		}
+	})
+
+	t.Run("larger maximum", func(t *testing.T) {
+		req, resp := newResponse(t, strings.Repeat("u", 280), dhcpv4.WithOption(dhcpv4.OptMaxMessageSize(1500)))
+		changes, err := fitMessageSize(req, resp)
+		if err != nil || changes != "" {
+			t.Fatalf("got changes %q and error %v, want none", changes, err)
+		}
+	})
+
+	t.Run("boot file moved to file field", func(t *testing.T) {
+		bootfile := strings.Repeat("u", 120)
+		req, resp := newResponse(t, bootfile)
+		resp.UpdateOption(dhcpv4.OptDomainName(strings.Repeat("d", 200)))
+		if _, err := fitMessageSize(req, resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp.BootFileName != bootfile || resp.Options.Has(dhcpv4.OptionBootfileName) {
+			t.Errorf("boot file name was not moved to file field")
+		}
+		if n := len(resp.ToBytes()); n > maxResponseSize(req) {
+			t.Errorf("response is %d bytes", n)
+		}
+	})
+
+	t.Run("overload", func(t *testing.T) {
+		bootfile := strings.Repeat("u", 280)
+		req, resp := newResponse(t, bootfile)
+		if _, err := fitMessageSize(req, resp); err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.BootFileNameOption(); got != bootfile {
+			t.Errorf("boot file option changed to %q", got)
+		}
+		if got := resp.Options.Get(dhcpv4.OptionOptionOverload); len(got) != 1 || got[0]&overloadFile == 0 {
+			t.Fatalf("got option overload % x, want file field used", got)
+		}
+		moved := overloadedOptions(t, resp.BootFileName)
+		if got := string(moved.Get(dhcpv4.OptionHostName)); got != "nid0001" {
+			t.Errorf("got overloaded hostname %q", got)
+		}
+		if resp.Options.Has(dhcpv4.OptionHostName) {
+			t.Error("hostname is still in options field")
+		}
+		if n := len(resp.ToBytes()); n > maxResponseSize(req) {
+			t.Errorf("response is %d bytes", n)
+		}
+	})
+
+	t.Run("too long", func(t *testing.T) {
+		bootfile := strings.Repeat("u", 400)
+		req, resp := newResponse(t, bootfile, dhcpv4.WithRequestedOptions(dhcpv4.OptionBootfileName))
+		if _, err := fitMessageSize(req, resp); err == nil {
+			t.Fatal("expected an error")
+		}
+		if got := resp.BootFileNameOption(); got != bootfile {
+			t.Errorf("boot file name was truncated to %d bytes", len(got))
+		}
+		if resp.Options.Has(dhcpv4.OptionDomainName) || !resp.Options.Has(dhcpv4.OptionIPAddressLeaseTime) {
+			t.Errorf("got options %v, want only required and requested ones", resp.Options)
+		}
+	})
+}
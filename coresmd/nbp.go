@@ -0,0 +1,80 @@
+package coresmd
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// httpClientClass starts the vendor class of UEFI HTTP boot clients.
+const httpClientClass = "HTTPClient"
+
+// nbpRule serves a network bootstrap program other than iPXE (e.g. wdsnbp.com
+// for Windows Deployment Services or mboot.efi for ESXi) to clients whose
+// vendor class (option 60) starts with vendorPrefix or whose user class
+// (option 77) is userClass.
+type nbpRule struct {
+	vendorPrefix string
+	userClass    string
+	file         string
+}
+
+func (r nbpRule) matches(req *dhcpv4.DHCPv4) bool {
+	if r.vendorPrefix != "" {
+		return strings.HasPrefix(req.ClassIdentifier(), r.vendorPrefix)
+	}
+	return slices.Contains(req.UserClass(), r.userClass)
+}
+
+// parseNBPMap parses a comma-separated list of vendor:<prefix>=<file> and
+// user:<class>=<file> entries.
+func parseNBPMap(val string) ([]nbpRule, error) {
+	var rules []nbpRule
+	for _, entry := range strings.Split(val, ",") {
+		class, file, ok := strings.Cut(entry, "=")
+		kind, value, kindOK := strings.Cut(class, ":")
+		if !ok || !kindOK || value == "" || file == "" {
+			return nil, fmt.Errorf("invalid entry %q: expected vendor:<prefix>=<file> or user:<class>=<file>", entry)
+		}
+		switch kind {
+		case "vendor":
+			rules = append(rules, nbpRule{vendorPrefix: value, file: file})
+		case "user":
+			rules = append(rules, nbpRule{userClass: value, file: file})
+		default:
+			return nil, fmt.Errorf("invalid class type %q in entry %q: expected vendor or user", kind, entry)
+		}
+	}
+
+	return rules, nil
+}
+
+// matchNBP returns the first rule matching req.
+func (cfg *pluginConfig) matchNBP(req *dhcpv4.DHCPv4) (nbpRule, bool) {
+	for _, r := range cfg.nbpRules {
+		if r.matches(req) {
+			return r, true
+		}
+	}
+	return nbpRule{}, false
+}
+
+// serveNBP sets the boot file in resp to the network bootstrap program of r.
+// UEFI HTTP boot clients are given a URL on httpURL unless the file already is
+// one.
+func (cfg *pluginConfig) serveNBP(r nbpRule, req, resp *dhcpv4.DHCPv4) (string, bool) {
+	file := r.file
+	if u, err := url.Parse(file); (err != nil || u.Scheme == "") && strings.HasPrefix(req.ClassIdentifier(), httpClientClass) {
+		if cfg.httpURL == nil {
+			log.Errorf("%s requested UEFI HTTP boot, but no http_url is configured to serve %s from", req.ClientHWAddr, file)
+			return "", false
+		}
+		file = cfg.httpURL.JoinPath(file).String()
+		resp.Options.Update(dhcpv4.OptClassIdentifier(httpClientClass))
+	}
+	resp.Options.Update(dhcpv4.OptBootFileName(file))
+	return file, true
+}
@@ -0,0 +1,53 @@
+package coresmd
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestHandler4NBPMap(t *testing.T) {
+	rules, err := parseNBPMap("vendor:PXEClient:Arch:00000=boot/x86/wdsnbp.com,user:ESXi=mboot.efi,vendor:HTTPClient=mboot.efi")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := setupHandler(t)
+	cfg := p.config.Load()
+	cfg.nbpRules = rules
+	cfg.httpURL, _ = url.Parse("http://172.16.0.253:8080")
+
+	vendor := func(class string) dhcpv4.Modifier {
+		return dhcpv4.WithOption(dhcpv4.OptClassIdentifier(class))
+	}
+	user := func(class string) dhcpv4.Modifier {
+		return dhcpv4.WithOption(dhcpv4.OptUserClass(class))
+	}
+	tests := []struct {
+		name      string
+		modifiers []dhcpv4.Modifier
+		want      string
+	}{
+		{"vendor class prefix", []dhcpv4.Modifier{withArch(iana.INTEL_X86PC), vendor("PXEClient:Arch:00000:UNDI:002001")}, "boot/x86/wdsnbp.com"},
+		{"user class", []dhcpv4.Modifier{withArch(iana.EFI_X86_64), user("ESXi")}, "mboot.efi"},
+		{"HTTP boot", []dhcpv4.Modifier{withArch(iana.EFI_X86_64_HTTP), vendor("HTTPClient:Arch:00016")}, "http://172.16.0.253:8080/mboot.efi"},
+		{"no match", []dhcpv4.Modifier{withArch(iana.EFI_X86_64), vendor("PXEClient:Arch:00007:UNDI:003016")}, "ipxe-x86_64.efi"},
+		{"iPXE is not affected", []dhcpv4.Modifier{withArch(iana.EFI_X86_64), vendor("PXEClient:Arch:00000"), withIPXE()}, "http://172.16.0.253:8081/boot/v1/bootscript?mac=aa:bb:cc:dd:ee:01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", tt.modifiers...)
+			resp, _ = p.Handler4(req, resp)
+			if got := resp.BootFileNameOption(); got != tt.want {
+				t.Errorf("got boot file %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	for _, val := range []string{"PXEClient=wdsnbp.com", "vendor:PXEClient", "arch:7=x.efi", "user:=x.efi"} {
+		if _, err := parseNBPMap(val); err == nil {
+			t.Errorf("expected %q to be rejected", val)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package coresmd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/rfc1035label"
+)
+
+// subnetDomains is a domain search list for clients in a subnet.
+type subnetDomains struct {
+	subnet  *net.IPNet
+	domains []string
+}
+
+// subnetMTU is an interface MTU for clients in a subnet.
+type subnetMTU struct {
+	subnet *net.IPNet
+	mtu    uint16
+}
+
+// subnetMatchIP returns the address matched against per-subnet settings for a
+// client being assigned ip: the link address of relayed requests, or ip.
+func subnetMatchIP(req *dhcpv4.DHCPv4, ip net.IP) net.IP {
+	if link := linkAddress(req); link != nil {
+		return link
+	}
+	return ip
+}
+
+// domainSearchFor returns the domain search list for a client being assigned
+// ip, or nil if none is configured.
+func (cfg *pluginConfig) domainSearchFor(req *dhcpv4.DHCPv4, ip net.IP) []string {
+	match := subnetMatchIP(req, ip)
+	for _, s := range cfg.domainSearchSubnets {
+		if s.subnet.Contains(match) {
+			return s.domains
+		}
+	}
+
+	return cfg.domainSearch
+}
+
+// mtuFor returns the interface MTU for a client being assigned ip, or 0 if
+// none is configured. The network profile for ip takes precedence.
+func (cfg *pluginConfig) mtuFor(req *dhcpv4.DHCPv4, ip net.IP) uint16 {
+	if n := cfg.networkFor(ip); n != nil && n.mtu != 0 {
+		return n.mtu
+	}
+	match := subnetMatchIP(req, ip)
+	for _, s := range cfg.mtuSubnets {
+		if s.subnet.Contains(match) {
+			return s.mtu
+		}
+	}
+
+	return cfg.mtu
+}
+
+// optDomainSearch returns the domain search list option (option 119).
+func optDomainSearch(domains []string) dhcpv4.Option {
+	return dhcpv4.OptDomainSearch(&rfc1035label.Labels{Labels: domains})
+}
+
+// optInterfaceMTU returns the interface MTU option (option 26).
+func optInterfaceMTU(mtu uint16) dhcpv4.Option {
+	return dhcpv4.OptGeneric(dhcpv4.OptionInterfaceMTU, binary.BigEndian.AppendUint16(nil, mtu))
+}
+
+// parseDomainList parses a sep-separated list of domain names.
+func parseDomainList(val, sep string) ([]string, error) {
+	var domains []string
+	for _, d := range strings.Split(val, sep) {
+		d = strings.TrimSuffix(strings.TrimSpace(d), ".")
+		if d == "" || len(d) > 253 {
+			return nil, fmt.Errorf("invalid domain name %q", d)
+		}
+		for _, label := range strings.Split(d, ".") {
+			if label == "" || len(label) > 63 {
+				return nil, fmt.Errorf("invalid domain name %q", d)
+			}
+		}
+		domains = append(domains, d)
+	}
+
+	return domains, nil
+}
+
+// parseMTU parses an interface MTU, which must be at least 68 (RFC 2132).
+func parseMTU(val string) (uint16, error) {
+	n, err := strconv.ParseUint(val, 10, 16)
+	if err != nil {
+		return 0, err
+	}
+	if n < 68 {
+		return 0, fmt.Errorf("MTU must be at least 68, got %d", n)
+	}
+	return uint16(n), nil
+}
+
+// parseSubnetDomains parses a comma-separated list of
+// <cidr>:<domain>[+<domain>...] pairs.
+func parseSubnetDomains(val string) ([]subnetDomains, error) {
+	var subnets []subnetDomains
+	for _, pair := range strings.Split(val, ",") {
+		cidr, list, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid pair %q: expected <cidr>:<domain>[+<domain>...]", pair)
+		}
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q: %w", cidr, err)
+		}
+		domains, err := parseDomainList(list, "+")
+		if err != nil {
+			return nil, fmt.Errorf("invalid domains for subnet %s: %w", cidr, err)
+		}
+		subnets = append(subnets, subnetDomains{subnet: subnet, domains: domains})
+	}
+
+	return subnets, nil
+}
+
+// parseSubnetMTUs parses a comma-separated list of <cidr>:<mtu> pairs.
+func parseSubnetMTUs(val string) ([]subnetMTU, error) {
+	var subnets []subnetMTU
+	for _, pair := range strings.Split(val, ",") {
+		cidr, mtuStr, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid pair %q: expected <cidr>:<mtu>", pair)
+		}
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q: %w", cidr, err)
+		}
+		mtu, err := parseMTU(mtuStr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MTU for subnet %s: %w", cidr, err)
+		}
+		subnets = append(subnets, subnetMTU{subnet: subnet, mtu: mtu})
+	}
+
+	return subnets, nil
+}
@@ -0,0 +1,80 @@
+package coresmd
+
+import (
+	"encoding/binary"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestParseNetworkOptions(t *testing.T) {
+	domains, err := parseDomainList("cluster.local, hsn.cluster.local.", ",")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"cluster.local", "hsn.cluster.local"}; !reflect.DeepEqual(domains, want) {
+		t.Errorf("parseDomainList: got %v, want %v", domains, want)
+	}
+	for _, val := range []string{"", "a..b", "x." + string(make([]byte, 64))} {
+		if _, err := parseDomainList(val, ","); err == nil {
+			t.Errorf("parseDomainList(%q): expected error", val)
+		}
+	}
+
+	subnets, err := parseSubnetDomains("10.1.0.0/16:bmc.cluster.local+cluster.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subnets) != 1 || len(subnets[0].domains) != 2 {
+		t.Errorf("parseSubnetDomains: got %+v", subnets)
+	}
+	for _, val := range []string{"10.1.0.0/16", "10.1.0.0:cluster.local", "10.1.0.0/16:"} {
+		if _, err := parseSubnetDomains(val); err == nil {
+			t.Errorf("parseSubnetDomains(%q): expected error", val)
+		}
+	}
+
+	mtus, err := parseSubnetMTUs("10.1.0.0/16:1500,172.16.0.0/24:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mtus) != 2 || mtus[1].mtu != 9000 {
+		t.Errorf("parseSubnetMTUs: got %+v", mtus)
+	}
+	for _, val := range []string{"10.1.0.0/16:67", "10.1.0.0/16:70000", "10.1.0.0/16:jumbo", "1500"} {
+		if _, err := parseSubnetMTUs(val); err == nil {
+			t.Errorf("parseSubnetMTUs(%q): expected error", val)
+		}
+	}
+}
+
+func TestHandler4NetworkOptions(t *testing.T) {
+	p := setupHandler(t)
+	cfg := p.config.Load()
+	cfg.domainSearch = []string{"cluster.local"}
+	cfg.mtu = 1500
+	subnets, err := parseSubnetMTUs("172.16.0.0/24:9000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.mtuSubnets = subnets
+
+	req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01")
+	resp, _ = p.Handler4(req, resp)
+	if ds := resp.DomainSearch(); ds == nil || !reflect.DeepEqual(ds.Labels, []string{"cluster.local"}) {
+		t.Errorf("domain search = %v, want [cluster.local]", ds)
+	}
+	if b := resp.Options.Get(dhcpv4.OptionInterfaceMTU); len(b) != 2 || binary.BigEndian.Uint16(b) != 9000 {
+		t.Errorf("MTU = %v, want 9000 for 172.16.0.1", b)
+	}
+
+	// Relayed requests are matched by the relay address
+	req, resp = newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01")
+	req.GatewayIPAddr = net.IPv4(10, 1, 0, 1)
+	resp, _ = p.Handler4(req, resp)
+	if b := resp.Options.Get(dhcpv4.OptionInterfaceMTU); len(b) != 2 || binary.BigEndian.Uint16(b) != 1500 {
+		t.Errorf("relayed MTU = %v, want 1500", b)
+	}
+}
@@ -0,0 +1,103 @@
+package coresmd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// networkProfile is a set of options for clients assigned an IP in a subnet,
+// so that one plugin instance can serve several networks (e.g. management,
+// BMC, and HSN-adjacent ones). Unset fields fall back to the plugin-wide
+// settings.
+type networkProfile struct {
+	subnet     *net.IPNet
+	router     []net.IP
+	dns        []net.IP
+	ntp        []net.IP
+	mtu        uint16
+	tftpServer net.IP
+}
+
+// networkFor returns the first network profile whose subnet contains ip, or
+// nil if there is none.
+func (cfg *pluginConfig) networkFor(ip net.IP) *networkProfile {
+	for i := range cfg.networks {
+		if cfg.networks[i].subnet.Contains(ip) {
+			return &cfg.networks[i]
+		}
+	}
+	return nil
+}
+
+// apply sets the router, DNS server, and NTP server options of n in resp and
+// returns a description of what it set, or "" if nothing. The MTU and TFTP
+// server are handled by mtuFor and tftpServerFor.
+func (n *networkProfile) apply(resp *dhcpv4.DHCPv4) string {
+	if n == nil {
+		return ""
+	}
+	var set []string
+	if n.router != nil {
+		resp.Options.Update(dhcpv4.OptRouter(n.router...))
+		set = append(set, "router "+joinIPs(n.router))
+	}
+	if n.dns != nil {
+		resp.Options.Update(dhcpv4.OptDNS(n.dns...))
+		set = append(set, "dns "+joinIPs(n.dns))
+	}
+	if n.ntp != nil {
+		resp.Options.Update(dhcpv4.OptNTPServers(n.ntp...))
+		set = append(set, "ntp "+joinIPs(n.ntp))
+	}
+	return strings.Join(set, ", ")
+}
+
+// parseNetworks parses a comma-separated list of network profiles of the form
+// <cidr>:<setting>[;<setting>...], where each setting is one of
+// router=<ip>[+<ip>...], dns=<ip>[+<ip>...], ntp=<ip>[+<ip>...], mtu=<mtu>,
+// or tftp_server=<ip>.
+func parseNetworks(val string) ([]networkProfile, error) {
+	var networks []networkProfile
+	for _, entry := range strings.Split(val, ",") {
+		cidr, settings, ok := strings.Cut(entry, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid entry %q: expected <cidr>:<setting>[;<setting>...]", entry)
+		}
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q: %w", cidr, err)
+		}
+		n := networkProfile{subnet: subnet}
+		for _, s := range strings.Split(settings, ";") {
+			name, v, found := strings.Cut(s, "=")
+			if !found || v == "" {
+				return nil, fmt.Errorf("invalid setting %q for %s: expected <name>=<value>", s, cidr)
+			}
+			switch strings.TrimSpace(name) {
+			case "router":
+				n.router, err = parseIPList(v)
+			case "dns":
+				n.dns, err = parseIPList(v)
+			case "ntp":
+				n.ntp, err = parseIPList(v)
+			case "mtu":
+				n.mtu, err = parseMTU(v)
+			case "tftp_server":
+				if n.tftpServer = net.ParseIP(v).To4(); n.tftpServer == nil {
+					err = fmt.Errorf("invalid IPv4 address %q", v)
+				}
+			default:
+				err = fmt.Errorf("unknown setting %q", name)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid setting %q for %s: %w", s, cidr, err)
+			}
+		}
+		networks = append(networks, n)
+	}
+
+	return networks, nil
+}
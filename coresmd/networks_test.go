@@ -0,0 +1,79 @@
+package coresmd
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := parseNetworks("172.16.0.0/24:router=172.16.0.254;dns=10.0.0.1+10.0.0.2;mtu=9000,10.1.0.0/16:tftp_server=10.1.0.253")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(networks) != 2 {
+		t.Fatalf("got %d networks, want 2", len(networks))
+	}
+	n := networks[0]
+	if n.subnet.String() != "172.16.0.0/24" || len(n.router) != 1 || len(n.dns) != 2 || n.mtu != 9000 {
+		t.Errorf("first network = %+v", n)
+	}
+	if !networks[1].tftpServer.Equal(net.IPv4(10, 1, 0, 253)) {
+		t.Errorf("second network TFTP server = %s, want 10.1.0.253", networks[1].tftpServer)
+	}
+
+	for _, val := range []string{
+		"172.16.0.0/24",
+		"172.16.0.0:mtu=9000",
+		"172.16.0.0/24:mtu=10",
+		"172.16.0.0/24:router=gw",
+		"172.16.0.0/24:tftp_server=fd00::1",
+		"172.16.0.0/24:lease=1h",
+		"172.16.0.0/24:mtu",
+	} {
+		if _, err := parseNetworks(val); err == nil {
+			t.Errorf("parseNetworks(%q): expected error", val)
+		}
+	}
+}
+
+func TestHandler4Networks(t *testing.T) {
+	p := setupHandler(t)
+	cfg := p.config.Load()
+	cfg.tftpServer = net.IPv4(10, 0, 0, 1).To4()
+	cfg.mtu = 1500
+	networks, err := parseNetworks("10.9.0.0/16:router=10.9.0.1,172.16.0.0/24:router=172.16.0.254;mtu=9000;tftp_server=172.16.0.253")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.networks = networks
+
+	req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01")
+	resp, _ = p.Handler4(req, resp)
+	if r := resp.Router(); len(r) != 1 || !r[0].Equal(net.IPv4(172, 16, 0, 254)) {
+		t.Errorf("router = %v, want [172.16.0.254]", r)
+	}
+	if b := resp.Options.Get(dhcpv4.OptionInterfaceMTU); len(b) != 2 || binary.BigEndian.Uint16(b) != 9000 {
+		t.Errorf("MTU = %v, want 9000", b)
+	}
+	if !resp.ServerIPAddr.Equal(net.IPv4(172, 16, 0, 253)) {
+		t.Errorf("next server = %s, want 172.16.0.253", resp.ServerIPAddr)
+	}
+	if rp := resp.Options.Get(dhcpv4.OptionRootPath); string(rp) != "172.16.0.253" {
+		t.Errorf("root path = %q, want 172.16.0.253", rp)
+	}
+
+	// Role options take precedence over the network profile
+	bundles, err := parseRoleOptions("Compute:router=172.16.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.roleOptions = bundles
+	req, resp = newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01")
+	resp, _ = p.Handler4(req, resp)
+	if r := resp.Router(); len(r) != 1 || !r[0].Equal(net.IPv4(172, 16, 0, 1)) {
+		t.Errorf("router with role options = %v, want [172.16.0.1]", r)
+	}
+}
@@ -0,0 +1,29 @@
+package coresmd
+
+import "fmt"
+
+// What to do for Nodes without a NID, which SMD may not have assigned yet to
+// newly discovered hardware.
+const (
+	// missingNIDXname names the Node after its Component ID.
+	missingNIDXname = "xname"
+	// missingNIDOmit sends no hostname.
+	missingNIDOmit = "omit"
+	// missingNIDDefer sends no hostname and no boot file, so the Node gets
+	// an address but does not boot until it has a NID.
+	missingNIDDefer = "defer"
+)
+
+func parseMissingNID(val string) (string, error) {
+	switch val {
+	case missingNIDXname, missingNIDOmit, missingNIDDefer:
+		return val, nil
+	default:
+		return "", fmt.Errorf("unknown action %q (expected %s, %s, or %s)", val, missingNIDXname, missingNIDOmit, missingNIDDefer)
+	}
+}
+
+// missingNID reports whether ii is a Node without a NID.
+func missingNID(ii IfaceInfo) bool {
+	return ii.Type == "Node" && ii.CompNID <= 0
+}
@@ -0,0 +1,65 @@
+package coresmd
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestHandler4MissingNID(t *testing.T) {
+	p := setupHandler(t)
+	fake := NewFakeSmdClient(
+		[]EthernetInterface{{
+			MACAddress:  "aa:bb:cc:dd:ee:03",
+			ComponentID: "x3000c0s1b0n0",
+			IPAddresses: []struct {
+				IPAddress string `json:"IPAddress"`
+			}{{IPAddress: "172.16.0.3"}},
+		}},
+		[]Component{{ID: "x3000c0s1b0n0", Type: "Node", Role: "Compute"}},
+	)
+	c, err := NewCache("1m", fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	p.cache = c
+
+	tests := []struct {
+		missingNID string
+		wantHost   string
+		wantBoot   bool
+	}{
+		{missingNID: "", wantHost: "x3000c0s1b0n0", wantBoot: true},
+		{missingNID: missingNIDXname, wantHost: "x3000c0s1b0n0", wantBoot: true},
+		{missingNID: missingNIDOmit, wantBoot: true},
+		{missingNID: missingNIDDefer},
+	}
+	for _, tt := range tests {
+		t.Run("missing_nid="+tt.missingNID, func(t *testing.T) {
+			cfg := *p.config.Load()
+			cfg.missingNID = tt.missingNID
+			p.config.Store(&cfg)
+
+			req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:03", withArch(iana.EFI_X86_64), withIPXE())
+			out, stop := p.Handler4(req, resp)
+			if out == nil || !stop {
+				t.Fatalf("got (%v, %t), want an answer", out, stop)
+			}
+			if !out.YourIPAddr.Equal(net.IPv4(172, 16, 0, 3)) {
+				t.Errorf("yiaddr = %s, want 172.16.0.3", out.YourIPAddr)
+			}
+			if got := out.HostName(); got != tt.wantHost {
+				t.Errorf("hostname = %q, want %q", got, tt.wantHost)
+			}
+			if got := out.BootFileNameOption() != ""; got != tt.wantBoot {
+				t.Errorf("boot file %q, want one: %t", out.BootFileNameOption(), tt.wantBoot)
+			}
+		})
+	}
+}
@@ -0,0 +1,1180 @@
+package coresmd
+
+import (
+	"crypto/tls"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OpenCHAMI/coresmd/internal/ipxe"
+	"github.com/OpenCHAMI/coresmd/internal/metrics"
+	"github.com/OpenCHAMI/coresmd/pkg/smdclient"
+)
+
+// options holds the optional key=value arguments that may follow the required
+// positional arguments of the coresmd plugin.
+type options struct {
+	// Address (e.g. ":8080") for the built-in HTTP file server. The server
+	// is disabled if this is empty.
+	httpListen string
+	// Certificate and key used to serve HTTPS instead of HTTP. Both must be
+	// set to enable TLS.
+	httpCert string
+	httpKey  string
+	// Address (e.g. ":9100") on which to serve metrics, optionally over
+	// HTTPS with client certificate verification.
+	metricsListen   string
+	metricsCert     string
+	metricsKey      string
+	metricsClientCA string
+	// Address (e.g. "127.0.0.1:8125") of a statsd server to send metrics to
+	// every statsdInterval, with names prefixed by statsdPrefix and labels
+	// sent as statsdFormat
+	statsdAddr     string
+	statsdPrefix   string
+	statsdFormat   metrics.StatsdFormat
+	statsdInterval time.Duration
+	// Address (e.g. ":8080") on which to serve the health and readiness
+	// endpoints
+	healthListen string
+	// Path of a Unix socket on which to serve the admin API, optionally
+	// requiring read-only or read-write bearer tokens. If readOnly is set,
+	// endpoints that affect the cache are refused, as are endpoints listed
+	// in adminDisable.
+	adminSocket   string
+	adminROToken  string
+	adminRWToken  string
+	adminReadOnly bool
+	adminDisable  []string
+	// Address (e.g. ":9443") on which to also serve the admin API over TCP,
+	// optionally over HTTPS with client certificate verification
+	adminListen   string
+	adminCert     string
+	adminKey      string
+	adminClientCA string
+	// URL at which clients can reach the HTTP server. This is used to give
+	// UEFI HTTP boot clients a bootloader URL.
+	httpURL *url.URL
+	// Actions taken when a request cannot be fully answered
+	outcomes outcomeActions
+	// Server identifier (option 54) to answer as instead of the one set by
+	// the server_id plugin
+	serverID net.IP
+	// Address of the TFTP server to set as the next server (siaddr) and in
+	// option 66. Per-subnet addresses take precedence over the default one.
+	tftpServer        net.IP
+	tftpServerSubnets []subnetIP
+	// Domain search list (option 119) and interface MTU (option 26) to give
+	// to clients. Per-subnet values take precedence over the default ones.
+	domainSearch        []string
+	domainSearchSubnets []subnetDomains
+	mtu                 uint16
+	mtuSubnets          []subnetMTU
+	// Option profiles for clients assigned an IP in specific subnets
+	networks []networkProfile
+	// If nonempty, only SMD Components with these types and roles are
+	// cached.
+	componentTypes []string
+	componentRoles []string
+	// Log a decision trace for every request, or only for requests from
+	// these MAC addresses.
+	explain     bool
+	explainMACs []string
+	// Match clients by their client identifier (option 61) if their client
+	// hardware address is not found.
+	clientIDFallback bool
+	// Action to take when a client requests an IP address other than the
+	// one assigned to it in SMD.
+	requestedIPMismatch string
+	// What to do for Nodes without a NID: name them after their xname,
+	// omit the hostname, or also defer booting them until they have one
+	missingNID string
+	// How long to wait for a response when probing an address for conflicts
+	// before offering it. Disabled if zero.
+	probeTimeout time.Duration
+	// Renewal (T1) and rebinding (T2) times for the default lease policy,
+	// and lease policies that override it for specific Component types.
+	renewalTime   time.Duration
+	rebindingTime time.Duration
+	leasePolicies map[string]leasePolicy
+	// Range of addresses to lease provisionally to clients not found in
+	// SMD, and the lease duration for them. Disabled if unset.
+	discoveryStart net.IP
+	discoveryEnd   net.IP
+	discoveryLease time.Duration
+	// Random delay of up to refreshJitter added to each cache refresh
+	// interval, or a tenth of the interval if negative. maxStaleness is how
+	// old the cache may get before requests are no longer answered from it,
+	// or unlimited if zero. stalenessAlert is how old it may get before it is
+	// reported as stale, or never if zero.
+	refreshJitter  time.Duration
+	maxStaleness   time.Duration
+	stalenessAlert time.Duration
+	// What to log about changes between cache refreshes
+	refreshDiff DiffLogging
+	// Webhook to POST to and command to run when a refresh finds new
+	// interfaces or removed Components, and how long they may take
+	inventoryWebhook     string
+	inventoryHook        string
+	inventoryHookTimeout time.Duration
+	// How often and how long to retry failed requests to SMD, and how many
+	// consecutive failures open the circuit breaker for how long (disabled
+	// if zero).
+	smdRetries          int
+	smdRetryBackoff     time.Duration
+	smdBreakerThreshold int
+	smdBreakerCooldown  time.Duration
+	// Number of items per page when fetching lists from SMD, or zero to
+	// fetch them in one request.
+	smdPageSize int
+	// Version of the SMD API to query, or SmdAPIAuto to probe for it
+	smdAPIVersion string
+	// Also serve the MAC addresses of RedfishEndpoints
+	smdRedfishEndpoints bool
+	// Also cache SMD groups and partitions
+	smdGroups bool
+	// Settings of the HTTP client used to query SMD
+	smdHTTP SmdHTTPConfig
+	// TLS settings for SMD, other than the CA certificate which is a
+	// positional argument
+	smdTLS SmdTLSConfig
+	// Certificate and key to authenticate to SMD with, if set
+	smdClientCert string
+	smdClientKey  string
+	// File holding a bearer token to authenticate to SMD with, if set
+	smdTokenFile string
+	// Boot file (e.g. "exit" or a URL) to give iPXE clients while the boot
+	// script base URL is unreachable, as checked every
+	// bootScriptCheckInterval.
+	fallbackBootfile        string
+	bootScriptCheckInterval time.Duration
+	// Serve iPXE clients a generated stage-1 script chaining to their boot
+	// script, and how it retries and falls back
+	stage1Script    bool
+	stage1Retries   int
+	stage1Timeout   time.Duration
+	stage1Fallbacks []string
+	// Image nodes in rescue boot are booted with unless they set their own
+	rescue rescueImage
+	// Times in a row a node may be served its bootloader before it is
+	// considered stuck, or 0 to never consider it stuck
+	funnelStuckLimit int
+	// NATS server to publish boot lifecycle events to, if any, and the
+	// subject prefix to publish them under
+	eventsURL     string
+	eventsSubject string
+	// Template of the boot script path and query below the boot script base
+	// URL
+	bootScriptPath string
+	// Template of the metadata server URL and the site-specific option to
+	// send it in
+	metadataURL    string
+	metadataOption int
+	// Boot script base URLs by client architecture and Component role
+	bootScriptRoutes []bootScriptRoute
+	// Encoded iPXE settings sent in option 175 to iPXE clients
+	ipxeOptions []byte
+	// Network bootstrap programs served instead of iPXE by client class
+	nbpRules []nbpRule
+	// iPXE bootloaders served by client architecture, if not the defaults
+	bootloaders ipxe.Bootloaders
+	// Bootloaders driving the NIC through the firmware, the nodes always
+	// given them, and the features iPXE clients need to not be chainloaded
+	snpBootloaders ipxe.Bootloaders
+	snpOnly        nodeSelector
+	ipxeRequire    []string
+	// Nodes to send to their local disk instead of their boot script
+	localBoot nodeSelector
+	// Nodes only given an address and no boot configuration
+	ipOnly nodeSelector
+	// DHCP option bundles by Component role and subrole
+	roleOptions map[string]roleOptions
+	// NTP servers and time zone given to all clients
+	ntpServers    []net.IP
+	timezone      *time.Location
+	posixTimezone string
+	// Nodes to boot with Secure Boot, the shims to boot them with, and the
+	// template of their GRUB config path below the boot script base URL
+	secureBoot           nodeSelector
+	secureBootShims      string
+	secureBootGrubConfig string
+	// Fit responses to the client's Parameter Request List (option 55)
+	honorPRL bool
+	// PXE vendor options (option 43) sent to PXE clients, if enabled
+	pxeVendorOptions bool
+	pxe              pxeVendorOptions
+	// Number of boot script URLs handed out to an iPXE client within
+	// chainLoopWindow after which it is served the chain loop script
+	chainLoopLimit  int
+	chainLoopWindow time.Duration
+	// File holding the key to sign boot script URLs with, and how long
+	// signed URLs are valid for
+	bootScriptKeyFile string
+	bootScriptURLTTL  time.Duration
+	// Cache boot parameters from BSS and serve boot scripts generated from
+	// them over the HTTP server instead of pointing clients at BSS.
+	bssEmbed bool
+	// Path to the CoreDHCP config file to reload the plugin arguments from
+	// on SIGHUP. Reloading is disabled if this is empty.
+	configFile string
+	// Where to write a record of every DHCP transaction (a file path or
+	// "syslog"), and the size in bytes at which to rotate the file and how
+	// many rotated files to keep
+	auditLog           string
+	auditLogMaxSize    int64
+	auditLogMaxBackups int
+	// Format of log messages, "text" or "json"
+	logFormat string
+	// Whether and how to redact MAC and IP addresses in the output of the
+	// loggers listed in logRedactLoggers, and the file holding the key of
+	// hashes
+	logRedact        string
+	logRedactKeyFile string
+	logRedactLoggers []string
+	// Window over which repeated lookup errors for a client are logged
+	// once
+	logThrottle time.Duration
+	// OTLP/HTTP endpoint to export traces to, if set
+	otelEndpoint string
+	// What to do if the first cache refresh fails (startupServe or
+	// startupStrict), and where to save the cached data to start from in
+	// that case
+	startup      string
+	snapshotFile string
+	// Requests per second and burst size allowed per client MAC address
+	// and per relay agent, or zero for no limit
+	rateLimit           float64
+	rateLimitBurst      int
+	relayRateLimit      float64
+	relayRateLimitBurst int
+	// Files listing the MAC addresses and OUIs to serve exclusively and
+	// never to serve
+	macAllowFile string
+	macDenyFile  string
+	// Interfaces to serve directly attached clients on, restricted to
+	// the clients and ranges listed for each, if set
+	interfaces []servedInterface
+	// File of per-MAC settings merged over the SMD data
+	overridesFile string
+	// SQLite database to persist offers and leases in, if set, and how long
+	// an offered address is held for the client it was offered to
+	leaseDB   string
+	offerHold time.Duration
+	// URL of a Redis server to share leases and conflicts with other
+	// servers through, if set, and the prefix of the keys stored there
+	sharedState       string
+	sharedStatePrefix string
+	// Only answer clients while elected leader among the servers sharing
+	// state, campaigning as failoverID with leadership lasting
+	// failoverLease unless renewed
+	failover      bool
+	failoverID    string
+	failoverLease time.Duration
+	// Whether to answer clients while Redis is unreachable, so that no
+	// leader can be determined
+	failoverServeUnreachable bool
+	// Where to publish assigned addresses in DNS, if a server is set
+	dnsUpdate dnsUpdateConfig
+}
+
+// listenerOptions are the options of the servers coresmd listens with, which
+// are only started at setup and so cannot be changed by reloading.
+type listenerOptions struct {
+	httpListen, httpCert, httpKey                           string
+	metricsListen, metricsCert, metricsKey, metricsClientCA string
+	healthListen                                            string
+	adminSocket, adminListen, adminCert, adminKey           string
+	adminClientCA, adminROToken, adminRWToken               string
+	adminReadOnly                                           bool
+	adminDisable                                            string
+}
+
+// listeners returns the listener options in o.
+func (o options) listeners() listenerOptions {
+	return listenerOptions{
+		httpListen:      o.httpListen,
+		httpCert:        o.httpCert,
+		httpKey:         o.httpKey,
+		metricsListen:   o.metricsListen,
+		metricsCert:     o.metricsCert,
+		metricsKey:      o.metricsKey,
+		metricsClientCA: o.metricsClientCA,
+		healthListen:    o.healthListen,
+		adminSocket:     o.adminSocket,
+		adminListen:     o.adminListen,
+		adminCert:       o.adminCert,
+		adminKey:        o.adminKey,
+		adminClientCA:   o.adminClientCA,
+		adminROToken:    o.adminROToken,
+		adminRWToken:    o.adminRWToken,
+		adminReadOnly:   o.adminReadOnly,
+		adminDisable:    strings.Join(o.adminDisable, ","),
+	}
+}
+
+// tlsVersions maps TLS versions as given in options to their crypto/tls
+// constants.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// subnetIP maps a subnet to an IP address used for clients within it.
+type subnetIP struct {
+	subnet *net.IPNet
+	ip     net.IP
+}
+
+func parseOptions(args []string) (options, error) {
+	o := options{
+		requestedIPMismatch:      mismatchNAK,
+		missingNID:               missingNIDXname,
+		outcomes:                 defaultOutcomeActions,
+		discoveryLease:           defaultDiscoveryLease,
+		refreshJitter:            -1,
+		bootScriptURLTTL:         defaultBootScriptURLTTL,
+		chainLoopWindow:          defaultChainLoopWindow,
+		secureBootShims:          defaultSecureBootShims,
+		pxe:                      pxeVendorOptions{discoveryControl: defaultPXEDiscoveryControl},
+		metadataOption:           defaultMetadataOption,
+		inventoryHookTimeout:     defaultInventoryHookTimeout,
+		auditLogMaxSize:          defaultAuditMaxSize,
+		auditLogMaxBackups:       defaultAuditMaxBackups,
+		logThrottle:              defaultLogThrottle,
+		startup:                  startupServe,
+		smdRetries:               smdclient.DefaultRetries,
+		smdRetryBackoff:          smdclient.DefaultRetryBackoff,
+		smdBreakerThreshold:      smdclient.DefaultBreakerThreshold,
+		smdBreakerCooldown:       smdclient.DefaultBreakerCooldown,
+		smdHTTP:                  DefaultSmdHTTPConfig(),
+		smdAPIVersion:            SmdAPIAuto,
+		offerHold:                defaultOfferHold,
+		sharedStatePrefix:        defaultSharedStatePrefix,
+		failoverLease:            defaultFailoverLease,
+		failoverServeUnreachable: true,
+		dnsUpdate:                dnsUpdateConfig{timeout: defaultDNSUpdateTimeout},
+		ipxeRequire:              defaultIPXERequire,
+		stage1Retries:            defaultStage1Retries,
+		stage1Timeout:            defaultStage1Timeout,
+		funnelStuckLimit:         defaultFunnelStuckLimit,
+		eventsSubject:            defaultEventsSubject,
+		logRedact:                redactOff,
+		logRedactLoggers:         defaultRedactLoggers,
+		statsdFormat:             metrics.StatsdGraphite,
+		statsdInterval:           defaultStatsdInterval,
+	}
+	for _, arg := range args {
+		key, val, ok := strings.Cut(arg, "=")
+		if !ok {
+			return o, fmt.Errorf("invalid option %q: expected key=value", arg)
+		}
+		val = strings.Trim(val, `"'`)
+		switch key {
+		case "http_listen":
+			o.httpListen = val
+		case "http_cert":
+			o.httpCert = val
+		case "http_key":
+			o.httpKey = val
+		case "metrics_listen":
+			o.metricsListen = val
+		case "metrics_cert":
+			o.metricsCert = val
+		case "metrics_key":
+			o.metricsKey = val
+		case "metrics_client_ca":
+			o.metricsClientCA = val
+		case "metrics_statsd":
+			o.statsdAddr = val
+		case "metrics_statsd_prefix":
+			o.statsdPrefix = val
+		case "metrics_statsd_format":
+			f, err := metrics.ParseStatsdFormat(val)
+			if err != nil {
+				return o, err
+			}
+			o.statsdFormat = f
+		case "metrics_statsd_interval":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse metrics_statsd_interval: %w", err)
+			}
+			if d <= 0 {
+				return o, fmt.Errorf("metrics_statsd_interval must be positive, got %s", d)
+			}
+			o.statsdInterval = d
+		case "health_listen":
+			o.healthListen = val
+		case "admin_socket":
+			o.adminSocket = val
+		case "admin_ro_token":
+			o.adminROToken = val
+		case "admin_rw_token":
+			o.adminRWToken = val
+		case "admin_listen":
+			o.adminListen = val
+		case "admin_cert":
+			o.adminCert = val
+		case "admin_key":
+			o.adminKey = val
+		case "admin_client_ca":
+			o.adminClientCA = val
+		case "admin_read_only":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse admin_read_only: %w", err)
+			}
+			o.adminReadOnly = b
+		case "admin_disable":
+			for _, e := range strings.Split(val, ",") {
+				switch e {
+				case adminEndpointCache, adminEndpointRefresh, adminEndpointLookup, adminEndpointStats, adminEndpointExplain, adminEndpointLeases, adminEndpointRescue, adminEndpointFunnel, adminEndpointLifecycle:
+				default:
+					return o, fmt.Errorf("failed to parse admin_disable: unknown endpoint %q", e)
+				}
+				o.adminDisable = append(o.adminDisable, e)
+			}
+		case "http_url":
+			u, err := url.Parse(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse http_url: %w", err)
+			}
+			o.httpURL = u
+		case "server_id":
+			o.serverID = net.ParseIP(val).To4()
+			if o.serverID == nil {
+				return o, fmt.Errorf("invalid IPv4 address for server_id: %s", val)
+			}
+		case "tftp_server":
+			o.tftpServer = net.ParseIP(val).To4()
+			if o.tftpServer == nil {
+				return o, fmt.Errorf("invalid IPv4 address for tftp_server: %s", val)
+			}
+		case "tftp_server_subnets":
+			subnets, err := parseSubnetIPs(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse tftp_server_subnets: %w", err)
+			}
+			o.tftpServerSubnets = subnets
+		case "domain_search":
+			domains, err := parseDomainList(val, ",")
+			if err != nil {
+				return o, fmt.Errorf("failed to parse domain_search: %w", err)
+			}
+			o.domainSearch = domains
+		case "domain_search_subnets":
+			subnets, err := parseSubnetDomains(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse domain_search_subnets: %w", err)
+			}
+			o.domainSearchSubnets = subnets
+		case "mtu":
+			mtu, err := parseMTU(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse mtu: %w", err)
+			}
+			o.mtu = mtu
+		case "networks":
+			networks, err := parseNetworks(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse networks: %w", err)
+			}
+			o.networks = networks
+		case "mtu_subnets":
+			subnets, err := parseSubnetMTUs(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse mtu_subnets: %w", err)
+			}
+			o.mtuSubnets = subnets
+		case "component_types":
+			o.componentTypes = strings.Split(val, ",")
+		case "component_roles":
+			o.componentRoles = strings.Split(val, ",")
+		case "explain":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse explain: %w", err)
+			}
+			o.explain = b
+		case "client_id_fallback":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse client_id_fallback: %w", err)
+			}
+			o.clientIDFallback = b
+		case "on_unknown_mac", "on_lookup_error", "on_missing_arch", "on_unknown_arch", "on_unroutable":
+			action, err := parseOutcomeAction(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse %s: %w", key, err)
+			}
+			switch key {
+			case "on_unknown_mac":
+				o.outcomes.unknownMAC = action
+			case "on_lookup_error":
+				o.outcomes.lookupError = action
+			case "on_missing_arch":
+				o.outcomes.missingArch = action
+			case "on_unknown_arch":
+				o.outcomes.unknownArch = action
+			case "on_unroutable":
+				o.outcomes.unroutable = action
+			}
+		case "missing_nid":
+			action, err := parseMissingNID(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse missing_nid: %w", err)
+			}
+			o.missingNID = action
+		case "requested_ip_mismatch":
+			action, err := parseMismatchAction(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse requested_ip_mismatch: %w", err)
+			}
+			o.requestedIPMismatch = action
+		case "probe_timeout":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse probe_timeout: %w", err)
+			}
+			o.probeTimeout = d
+		case "renewal_time":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse renewal_time: %w", err)
+			}
+			o.renewalTime = d
+		case "rebinding_time":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse rebinding_time: %w", err)
+			}
+			o.rebindingTime = d
+		case "lease_policies":
+			policies, err := parseLeasePolicies(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse lease_policies: %w", err)
+			}
+			o.leasePolicies = policies
+		case "discovery_pool":
+			start, end, err := parseIPRange(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse discovery_pool: %w", err)
+			}
+			o.discoveryStart, o.discoveryEnd = start, end
+		case "discovery_lease":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse discovery_lease: %w", err)
+			}
+			if d <= 0 {
+				return o, fmt.Errorf("discovery_lease must be positive, got %s", d)
+			}
+			o.discoveryLease = d
+		case "refresh_jitter":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse refresh_jitter: %w", err)
+			}
+			if d < 0 {
+				return o, fmt.Errorf("refresh_jitter must not be negative, got %s", d)
+			}
+			o.refreshJitter = d
+		case "refresh_diff":
+			d, err := ParseDiffLogging(val)
+			if err != nil {
+				return o, err
+			}
+			o.refreshDiff = d
+		case "inventory_webhook":
+			u, err := url.Parse(val)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+				return o, fmt.Errorf("invalid inventory_webhook %q: expected an http or https URL", val)
+			}
+			o.inventoryWebhook = val
+		case "inventory_hook":
+			o.inventoryHook = val
+		case "inventory_hook_timeout":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse inventory_hook_timeout: %w", err)
+			}
+			if d <= 0 {
+				return o, fmt.Errorf("inventory_hook_timeout must be positive, got %s", d)
+			}
+			o.inventoryHookTimeout = d
+		case "max_staleness":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse max_staleness: %w", err)
+			}
+			if d < 0 {
+				return o, fmt.Errorf("max_staleness must not be negative, got %s", d)
+			}
+			o.maxStaleness = d
+		case "staleness_alert":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse staleness_alert: %w", err)
+			}
+			if d < 0 {
+				return o, fmt.Errorf("staleness_alert must not be negative, got %s", d)
+			}
+			o.stalenessAlert = d
+		case "startup":
+			if val != startupServe && val != startupStrict {
+				return o, fmt.Errorf("invalid startup %q: expected %s or %s", val, startupServe, startupStrict)
+			}
+			o.startup = val
+		case "snapshot_file":
+			o.snapshotFile = val
+		case "smd_retries":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return o, fmt.Errorf("invalid smd_retries %q: expected a non-negative integer", val)
+			}
+			o.smdRetries = n
+		case "smd_retry_backoff":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse smd_retry_backoff: %w", err)
+			}
+			if d <= 0 {
+				return o, fmt.Errorf("smd_retry_backoff must be positive, got %s", d)
+			}
+			o.smdRetryBackoff = d
+		case "smd_breaker_threshold":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return o, fmt.Errorf("invalid smd_breaker_threshold %q: expected a non-negative integer", val)
+			}
+			o.smdBreakerThreshold = n
+		case "smd_breaker_cooldown":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse smd_breaker_cooldown: %w", err)
+			}
+			if d <= 0 {
+				return o, fmt.Errorf("smd_breaker_cooldown must be positive, got %s", d)
+			}
+			o.smdBreakerCooldown = d
+		case "smd_page_size":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return o, fmt.Errorf("invalid smd_page_size %q: expected a non-negative integer", val)
+			}
+			o.smdPageSize = n
+		case "smd_api_version":
+			switch val {
+			case SmdAPIAuto, SmdAPIv2, SmdAPIv1:
+			default:
+				return o, fmt.Errorf("invalid smd_api_version %q: expected %s, %s, or %s", val, SmdAPIAuto, SmdAPIv2, SmdAPIv1)
+			}
+			o.smdAPIVersion = val
+		case "smd_redfish_endpoints":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse smd_redfish_endpoints: %w", err)
+			}
+			o.smdRedfishEndpoints = b
+		case "smd_groups":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse smd_groups: %w", err)
+			}
+			o.smdGroups = b
+		case "smd_timeout", "smd_dial_timeout", "smd_tls_handshake_timeout", "smd_response_header_timeout":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse %s: %w", key, err)
+			}
+			if d < 0 {
+				return o, fmt.Errorf("%s must not be negative, got %s", key, d)
+			}
+			switch key {
+			case "smd_timeout":
+				o.smdHTTP.Timeout = d
+			case "smd_dial_timeout":
+				o.smdHTTP.DialTimeout = d
+			case "smd_tls_handshake_timeout":
+				o.smdHTTP.TLSHandshakeTimeout = d
+			case "smd_response_header_timeout":
+				o.smdHTTP.ResponseHeaderTimeout = d
+			}
+		case "smd_max_idle_conns":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return o, fmt.Errorf("invalid smd_max_idle_conns %q: expected a non-negative integer", val)
+			}
+			o.smdHTTP.MaxIdleConns = n
+		case "smd_proxy":
+			switch val {
+			case "environment":
+				o.smdHTTP.Proxy, o.smdHTTP.ProxyFromEnvironment = nil, true
+			case "none":
+				o.smdHTTP.Proxy, o.smdHTTP.ProxyFromEnvironment = nil, false
+			default:
+				u, err := url.Parse(val)
+				if err != nil || u.Host == "" {
+					return o, fmt.Errorf("invalid smd_proxy %q: expected 'environment', 'none', or a proxy URL", val)
+				}
+				o.smdHTTP.Proxy = u
+			}
+		case "smd_client_cert":
+			o.smdClientCert = val
+		case "smd_client_key":
+			o.smdClientKey = val
+		case "smd_tls_min_version":
+			v, ok := tlsVersions[val]
+			if !ok {
+				return o, fmt.Errorf("invalid smd_tls_min_version %q: expected 1.0, 1.1, 1.2, or 1.3", val)
+			}
+			o.smdTLS.MinVersion = v
+		case "smd_system_cas":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse smd_system_cas: %w", err)
+			}
+			o.smdTLS.SystemCAs = b
+		case "smd_insecure_skip_verify":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse smd_insecure_skip_verify: %w", err)
+			}
+			o.smdTLS.InsecureSkipVerify = b
+		case "smd_token_file":
+			o.smdTokenFile = val
+		case "fallback_bootfile":
+			o.fallbackBootfile = val
+		case "funnel_stuck_limit":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return o, fmt.Errorf("invalid funnel_stuck_limit %q: expected a number", val)
+			}
+			o.funnelStuckLimit = n
+		case "events_url":
+			o.eventsURL = val
+		case "events_subject":
+			o.eventsSubject = val
+		case "rescue_kernel":
+			o.rescue.Kernel = val
+		case "rescue_initrd":
+			o.rescue.Initrd = val
+		case "rescue_params":
+			o.rescue.Params = val
+		case "stage1_script":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse stage1_script: %w", err)
+			}
+			o.stage1Script = b
+		case "stage1_retries":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 1 {
+				return o, fmt.Errorf("invalid stage1_retries %q: expected a positive number", val)
+			}
+			o.stage1Retries = n
+		case "stage1_timeout":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse stage1_timeout: %w", err)
+			}
+			if d < time.Millisecond {
+				return o, fmt.Errorf("stage1_timeout must be at least 1ms, got %s", d)
+			}
+			o.stage1Timeout = d
+		case "stage1_fallbacks":
+			fallbacks, err := parseStage1Fallbacks(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse stage1_fallbacks: %w", err)
+			}
+			o.stage1Fallbacks = fallbacks
+		case "boot_script_check_interval":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse boot_script_check_interval: %w", err)
+			}
+			if d <= 0 {
+				return o, fmt.Errorf("boot_script_check_interval must be positive, got %s", d)
+			}
+			o.bootScriptCheckInterval = d
+		case "boot_script_path":
+			o.bootScriptPath = val
+		case "metadata_url":
+			o.metadataURL = val
+		case "metadata_option":
+			n, err := strconv.Atoi(val)
+			if err != nil {
+				return o, fmt.Errorf("invalid metadata_option %q: expected an option code", val)
+			}
+			o.metadataOption = n
+		case "boot_script_urls":
+			routes, err := parseBootScriptRoutes(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse boot_script_urls: %w", err)
+			}
+			o.bootScriptRoutes = routes
+		case "ipxe_options":
+			b, err := parseIPXEOptions(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse ipxe_options: %w", err)
+			}
+			o.ipxeOptions = b
+		case "nbp_map":
+			rules, err := parseNBPMap(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse nbp_map: %w", err)
+			}
+			o.nbpRules = rules
+		case "bootloaders":
+			bootloaders, err := ipxe.ParseBootloaders(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse bootloaders: %w", err)
+			}
+			o.bootloaders = bootloaders
+		case "snp_bootloaders":
+			bootloaders, err := ipxe.DefaultSNPBootloaders.Merge(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse snp_bootloaders: %w", err)
+			}
+			o.snpBootloaders = bootloaders
+		case "snp_only":
+			o.snpOnly = parseNodeSelector(val)
+		case "ipxe_require":
+			if val == "none" {
+				o.ipxeRequire = nil
+				break
+			}
+			required, err := ipxe.ParseFeatures(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse ipxe_require: %w", err)
+			}
+			o.ipxeRequire = required
+		case "local_boot":
+			o.localBoot = parseNodeSelector(val)
+		case "ip_only":
+			o.ipOnly = parseNodeSelector(val)
+		case "role_options":
+			bundles, err := parseRoleOptions(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse role_options: %w", err)
+			}
+			o.roleOptions = bundles
+		case "ntp_servers":
+			ips, err := parseNTPServers(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse ntp_servers: %w", err)
+			}
+			o.ntpServers = ips
+		case "timezone":
+			loc, err := time.LoadLocation(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse timezone: %w", err)
+			}
+			o.timezone = loc
+		case "posix_timezone":
+			o.posixTimezone = val
+		case "secure_boot":
+			o.secureBoot = parseNodeSelector(val)
+		case "secure_boot_shims":
+			o.secureBootShims = val
+		case "secure_boot_grub_config":
+			o.secureBootGrubConfig = val
+		case "honor_parameter_request_list":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse honor_parameter_request_list: %w", err)
+			}
+			o.honorPRL = b
+		case "pxe_vendor_options":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse pxe_vendor_options: %w", err)
+			}
+			o.pxeVendorOptions = b
+		case "pxe_discovery_control":
+			n, err := strconv.ParseUint(val, 0, 8)
+			if err != nil || n > 0x0f {
+				return o, fmt.Errorf("invalid pxe_discovery_control %q: expected a bit field from 0 to 15", val)
+			}
+			o.pxe.discoveryControl = byte(n)
+		case "pxe_menu":
+			menu, err := parsePXEMenu(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse pxe_menu: %w", err)
+			}
+			o.pxe.menu = menu
+		case "pxe_menu_prompt":
+			timeout, prompt, err := parsePXEMenuPrompt(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse pxe_menu_prompt: %w", err)
+			}
+			o.pxe.promptTimeout, o.pxe.prompt = timeout, prompt
+		case "chain_loop_limit":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return o, fmt.Errorf("invalid chain_loop_limit %q: expected a non-negative integer", val)
+			}
+			o.chainLoopLimit = n
+		case "chain_loop_window":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse chain_loop_window: %w", err)
+			}
+			if d <= 0 {
+				return o, fmt.Errorf("chain_loop_window must be positive, got %s", d)
+			}
+			o.chainLoopWindow = d
+		case "boot_script_key_file":
+			o.bootScriptKeyFile = val
+		case "boot_script_url_ttl":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse boot_script_url_ttl: %w", err)
+			}
+			if d <= 0 {
+				return o, fmt.Errorf("boot_script_url_ttl must be positive, got %s", d)
+			}
+			o.bootScriptURLTTL = d
+		case "bss_embed":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse bss_embed: %w", err)
+			}
+			o.bssEmbed = b
+		case "audit_log":
+			o.auditLog = val
+		case "audit_log_max_size":
+			n, err := strconv.ParseInt(val, 10, 64)
+			if err != nil || n <= 0 {
+				return o, fmt.Errorf("invalid audit_log_max_size %q: expected a positive number of megabytes", val)
+			}
+			o.auditLogMaxSize = n << 20
+		case "audit_log_max_backups":
+			n, err := strconv.Atoi(val)
+			if err != nil || n < 0 {
+				return o, fmt.Errorf("invalid audit_log_max_backups %q: expected a non-negative integer", val)
+			}
+			o.auditLogMaxBackups = n
+		case "log_format":
+			f, err := parseLogFormat(val)
+			if err != nil {
+				return o, err
+			}
+			o.logFormat = f
+		case "log_redact":
+			m, err := parseRedactMode(val)
+			if err != nil {
+				return o, err
+			}
+			o.logRedact = m
+		case "log_redact_key_file":
+			o.logRedactKeyFile = val
+		case "log_redact_loggers":
+			o.logRedactLoggers = nil
+			for _, l := range strings.Split(val, ",") {
+				if l = strings.TrimSpace(l); l != "" {
+					o.logRedactLoggers = append(o.logRedactLoggers, l)
+				}
+			}
+		case "log_throttle":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse log_throttle: %w", err)
+			}
+			if d < 0 {
+				return o, fmt.Errorf("log_throttle must not be negative, got %s", d)
+			}
+			o.logThrottle = d
+		case "otel_endpoint":
+			e, err := parseOTelEndpoint(val)
+			if err != nil {
+				return o, err
+			}
+			o.otelEndpoint = e
+		case "rate_limit", "relay_rate_limit":
+			r, err := strconv.ParseFloat(val, 64)
+			if err != nil || r < 0 || math.IsInf(r, 0) || math.IsNaN(r) {
+				return o, fmt.Errorf("invalid %s %q: expected a non-negative number of requests per second", key, val)
+			}
+			if key == "rate_limit" {
+				o.rateLimit = r
+			} else {
+				o.relayRateLimit = r
+			}
+		case "rate_limit_burst", "relay_rate_limit_burst":
+			n, err := strconv.Atoi(val)
+			if err != nil || n <= 0 {
+				return o, fmt.Errorf("invalid %s %q: expected a positive integer", key, val)
+			}
+			if key == "rate_limit_burst" {
+				o.rateLimitBurst = n
+			} else {
+				o.relayRateLimitBurst = n
+			}
+		case "mac_allow_file":
+			o.macAllowFile = val
+		case "mac_deny_file":
+			o.macDenyFile = val
+		case "interfaces":
+			ifaces, err := parseInterfaces(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse interfaces: %w", err)
+			}
+			o.interfaces = ifaces
+		case "overrides_file":
+			o.overridesFile = val
+		case "lease_db":
+			o.leaseDB = val
+		case "offer_hold":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse offer_hold: %w", err)
+			}
+			if d <= 0 {
+				return o, fmt.Errorf("offer_hold must be positive, got %s", d)
+			}
+			o.offerHold = d
+		case "shared_state":
+			if _, err := newRedisClient(val); err != nil {
+				return o, fmt.Errorf("invalid shared_state: %w", err)
+			}
+			o.sharedState = val
+		case "shared_state_prefix":
+			if val == "" {
+				return o, fmt.Errorf("shared_state_prefix must not be empty")
+			}
+			o.sharedStatePrefix = val
+		case "failover":
+			b, err := strconv.ParseBool(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse failover: %w", err)
+			}
+			o.failover = b
+		case "failover_id":
+			o.failoverID = val
+		case "failover_lease":
+			d, err := time.ParseDuration(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse failover_lease: %w", err)
+			}
+			if d < time.Second {
+				return o, fmt.Errorf("failover_lease must be at least 1s, got %s", d)
+			}
+			o.failoverLease = d
+		case "failover_unreachable":
+			switch val {
+			case "serve":
+				o.failoverServeUnreachable = true
+			case "standby":
+				o.failoverServeUnreachable = false
+			default:
+				return o, fmt.Errorf("failed to parse failover_unreachable: expected serve or standby, got %q", val)
+			}
+		case "dns_update":
+			if _, _, err := net.SplitHostPort(val); err != nil {
+				val = net.JoinHostPort(val, "53")
+			}
+			o.dnsUpdate.server = val
+		case "dns_zone":
+			o.dnsUpdate.zone = canonicalName(val)
+			if !validName(o.dnsUpdate.zone) {
+				return o, fmt.Errorf("invalid dns_zone %q", val)
+			}
+		case "dns_reverse_zones":
+			for _, z := range strings.Split(val, ",") {
+				zone := canonicalName(z)
+				if !strings.HasSuffix(zone, ".in-addr.arpa") {
+					return o, fmt.Errorf("invalid dns_reverse_zones entry %q: expected a zone in in-addr.arpa", z)
+				}
+				o.dnsUpdate.reverseZones = append(o.dnsUpdate.reverseZones, zone)
+			}
+		case "dns_tsig":
+			key, err := parseTSIGKey(val)
+			if err != nil {
+				return o, fmt.Errorf("failed to parse dns_tsig: %w", err)
+			}
+			o.dnsUpdate.key = key
+		case "dns_ttl":
+			d, err := time.ParseDuration(val)
+			if err != nil || d < time.Second {
+				return o, fmt.Errorf("invalid dns_ttl %q: expected a duration of at least 1s", val)
+			}
+			o.dnsUpdate.ttl = d
+		case "config_file":
+			o.configFile = val
+		case "explain_macs":
+			for _, m := range strings.Split(val, ",") {
+				mac, err := NormalizeMAC(m)
+				if err != nil {
+					return o, fmt.Errorf("failed to parse explain_macs: %w", err)
+				}
+				o.explainMACs = append(o.explainMACs, mac)
+			}
+		default:
+			return o, fmt.Errorf("unknown option %q", key)
+		}
+	}
+
+	if (o.httpCert == "") != (o.httpKey == "") {
+		return o, fmt.Errorf("http_cert and http_key must be set together")
+	}
+	if (o.smdClientCert == "") != (o.smdClientKey == "") {
+		return o, fmt.Errorf("smd_client_cert and smd_client_key must be set together")
+	}
+	if !o.pxeVendorOptions && (o.pxe.menu != nil || o.pxe.prompt != "") {
+		return o, fmt.Errorf("pxe_menu and pxe_menu_prompt require pxe_vendor_options")
+	}
+	if o.failover && o.sharedState == "" {
+		return o, fmt.Errorf("failover requires shared_state")
+	}
+	if (o.dnsUpdate.server == "") != (o.dnsUpdate.zone == "") {
+		return o, fmt.Errorf("dns_update and dns_zone must be set together")
+	}
+	if (o.metricsCert == "") != (o.metricsKey == "") {
+		return o, fmt.Errorf("metrics_cert and metrics_key must be set together")
+	}
+	if o.metricsClientCA != "" && o.metricsCert == "" {
+		return o, fmt.Errorf("metrics_client_ca requires metrics_cert and metrics_key")
+	}
+	if (o.adminCert == "") != (o.adminKey == "") {
+		return o, fmt.Errorf("admin_cert and admin_key must be set together")
+	}
+	if o.adminClientCA != "" && o.adminCert == "" {
+		return o, fmt.Errorf("admin_client_ca requires admin_cert and admin_key")
+	}
+	// Unlike the admin socket, which file permissions protect, anyone on the
+	// network can reach admin_listen
+	if o.adminListen != "" && o.adminROToken == "" && o.adminRWToken == "" && o.adminClientCA == "" {
+		return o, fmt.Errorf("admin_listen requires admin_ro_token, admin_rw_token, or admin_client_ca")
+	}
+
+	return o, nil
+}
+
+// parseSubnetIPs parses a comma-separated list of <cidr>:<ip> pairs.
+func parseSubnetIPs(val string) ([]subnetIP, error) {
+	var subnets []subnetIP
+	for _, pair := range strings.Split(val, ",") {
+		cidr, ipStr, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid pair %q: expected <cidr>:<ip>", pair)
+		}
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet %q: %w", cidr, err)
+		}
+		ip := net.ParseIP(ipStr).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q for subnet %s", ipStr, cidr)
+		}
+		subnets = append(subnets, subnetIP{subnet: subnet, ip: ip})
+	}
+
+	return subnets, nil
+}
@@ -0,0 +1,95 @@
+package coresmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// Actions that can be taken when coresmd cannot fully answer a request.
+const (
+	// actionTerminate sends the response as it is and stops the plugin
+	// chain.
+	actionTerminate = "terminate"
+	// actionContinue passes the response on to the next plugin.
+	actionContinue = "continue"
+	// actionDrop sends no response.
+	actionDrop = "drop"
+)
+
+// outcomeActions sets the action taken at each point where coresmd cannot
+// fully answer a request.
+type outcomeActions struct {
+	// unknownMAC is taken when the client is not in SMD.
+	unknownMAC string
+	// lookupError is taken when the client is in SMD but cannot be given
+	// an address, e.g. because its Component is missing or its
+	// EthernetInterface has no IP address.
+	lookupError string
+	// missingArch and unknownArch are taken when a client that is not
+	// iPXE sends no architecture (option 93), or one that there is no
+	// bootloader for. It has already been given an address.
+	missingArch string
+	unknownArch string
+	// unroutable is taken when none of the client's addresses can be
+	// used on the link its request arrived on (see interfaces).
+	unroutable string
+}
+
+var defaultOutcomeActions = outcomeActions{
+	unknownMAC:  actionContinue,
+	lookupError: actionContinue,
+	missingArch: actionTerminate,
+	unknownArch: actionTerminate,
+	unroutable:  actionDrop,
+}
+
+func parseOutcomeAction(val string) (string, error) {
+	switch val {
+	case actionTerminate, actionContinue, actionDrop:
+		return val, nil
+	default:
+		return "", fmt.Errorf("unknown action %q (expected %s, %s, or %s)", val, actionTerminate, actionContinue, actionDrop)
+	}
+}
+
+// takeAction returns what Handler4 returns for resp when taking action, set
+// by the on_<outcome> option, recording it in tr and counting the outcome.
+func (cfg *pluginConfig) takeAction(outcome, action string, resp *dhcpv4.DHCPv4, tr *trace) (*dhcpv4.DHCPv4, bool) {
+	tr.add("action", action, "coresmd", "on_"+outcome)
+	cfg.countOutcome(outcome)
+	switch action {
+	case actionTerminate:
+		return resp, true
+	case actionDrop:
+		return nil, true
+	default:
+		return resp, false
+	}
+}
+
+// outcomeServed and outcomeNAK are the outcomes of requests answered in full
+// and of those refused with a DHCPNAK, counted alongside those taking the
+// action of an on_<outcome> option.
+const (
+	outcomeServed = "served"
+	outcomeNAK    = "nak"
+)
+
+// countOutcome counts a request handled with outcome, unless it is simulated.
+func (cfg *pluginConfig) countOutcome(outcome string) {
+	if !cfg.simulated {
+		metricOutcomes.Inc(outcome)
+	}
+}
+
+// messageTypeLabel returns the value of the type label counting a message of
+// type mt.
+func messageTypeLabel(mt dhcpv4.MessageType) string {
+	switch mt {
+	case dhcpv4.MessageTypeDiscover, dhcpv4.MessageTypeRequest, dhcpv4.MessageTypeInform, dhcpv4.MessageTypeRelease, dhcpv4.MessageTypeDecline:
+		return strings.ToLower(mt.String())
+	}
+	return "other"
+}
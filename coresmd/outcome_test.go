@@ -0,0 +1,63 @@
+package coresmd
+
+import (
+	"net"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestOutcomeActions(t *testing.T) {
+	noArch := func(t *testing.T) *dhcpv4.DHCPv4 {
+		req, err := dhcpv4.New(dhcpv4.WithMessageType(dhcpv4.MessageTypeDiscover),
+			dhcpv4.WithHwAddr(net.HardwareAddr{0xaa, 0xbb, 0xcc, 0xdd, 0xee, 0x01}))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return req
+	}
+	unknownMAC := func(t *testing.T) *dhcpv4.DHCPv4 {
+		return pxeRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:99", iana.EFI_X86_64)
+	}
+	unknownArch := func(t *testing.T) *dhcpv4.DHCPv4 {
+		return pxeRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", iana.Arch(0x99))
+	}
+
+	for _, tt := range []struct {
+		name     string
+		opt      string
+		req      func(t *testing.T) *dhcpv4.DHCPv4
+		wantResp bool
+		wantStop bool
+	}{
+		{"unknown MAC by default", "", unknownMAC, true, false},
+		{"unknown MAC terminate", "on_unknown_mac=terminate", unknownMAC, true, true},
+		{"unknown MAC drop", "on_unknown_mac=drop", unknownMAC, false, true},
+		{"missing arch by default", "", noArch, true, true},
+		{"missing arch continue", "on_missing_arch=continue", noArch, true, false},
+		{"unknown arch by default", "", unknownArch, true, true},
+		{"unknown arch drop", "on_unknown_arch=drop", unknownArch, false, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var opts []string
+			if tt.opt != "" {
+				opts = append(opts, tt.opt)
+			}
+			p := setupE2E(t, opts...)
+			req := tt.req(t)
+			resp, err := dhcpv4.NewReplyFromRequest(req, dhcpv4.WithMessageType(dhcpv4.MessageTypeOffer))
+			if err != nil {
+				t.Fatal(err)
+			}
+			out, stop := p.Handler4(req, resp)
+			if (out != nil) != tt.wantResp || stop != tt.wantStop {
+				t.Errorf("got response %t, stop %t; want %t, %t", out != nil, stop, tt.wantResp, tt.wantStop)
+			}
+		})
+	}
+
+	if _, err := parseOptions([]string{"on_lookup_error=ignore"}); err == nil {
+		t.Error("unknown action accepted")
+	}
+}
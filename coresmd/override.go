@@ -0,0 +1,19 @@
+package coresmd
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// bootScriptOverride returns the boot script URL override of the node owning
+// ii, if it has a valid one.
+func bootScriptOverride(ii IfaceInfo) (string, error) {
+	if ii.Overrides.BootScript == "" {
+		return "", nil
+	}
+	u, err := url.Parse(ii.Overrides.BootScript)
+	if err != nil || u.Scheme == "" {
+		return "", fmt.Errorf("invalid bootscript property %q of Component %s: expected a URL", ii.Overrides.BootScript, ii.CompID)
+	}
+	return ii.Overrides.BootScript, nil
+}
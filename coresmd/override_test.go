@@ -0,0 +1,48 @@
+package coresmd
+
+import (
+	"context"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestHandler4BootOverrides(t *testing.T) {
+	p := setupHandler(t)
+	fake := NewFakeSmdClient(
+		[]EthernetInterface{{
+			MACAddress:  "aa:bb:cc:dd:ee:01",
+			ComponentID: "x3000c0s0b0n0",
+			IPAddresses: []struct {
+				IPAddress string `json:"IPAddress"`
+			}{{IPAddress: "172.16.0.1"}},
+		}},
+		[]Component{{
+			ID: "x3000c0s0b0n0", NID: 1, Type: "Node",
+			ExtraProperties: BootOverrides{Bootloader: "snponly.efi", BootScript: "http://10.0.0.9/custom.ipxe"},
+		}},
+	)
+	p.cache.Client = fake
+	if err := p.cache.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct {
+		ipxe bool
+		want string
+	}{
+		{false, "snponly.efi"},
+		{true, "http://10.0.0.9/custom.ipxe"},
+	} {
+		modifiers := []dhcpv4.Modifier{withArch(iana.EFI_X86_64)}
+		if tt.ipxe {
+			modifiers = append(modifiers, withIPXE())
+		}
+		req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", modifiers...)
+		resp, _ = p.Handler4(req, resp)
+		if got := resp.BootFileNameOption(); got != tt.want {
+			t.Errorf("iPXE %t: got boot file %q, want %q", tt.ipxe, got, tt.want)
+		}
+	}
+}
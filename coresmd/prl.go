@@ -0,0 +1,99 @@
+package coresmd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// prlFilteredOptions are the options set by coresmd that are left out of the
+// response unless the client lists them in its Parameter Request List (option
+// 55). Options required by RFC 2131 (e.g. lease time and server identifier) and
+// the vendor class and vendor-specific information that PXE and HTTP boot
+// clients rely on are always sent.
+var prlFilteredOptions = []dhcpv4.OptionCode{
+	dhcpv4.OptionHostName,
+	dhcpv4.OptionRootPath,
+	dhcpv4.OptionTFTPServerName,
+	dhcpv4.OptionBootfileName,
+}
+
+// applyParameterRequestList fits resp to the Parameter Request List of req, for
+// the benefit of firmware that only understands the options it asked for. A
+// boot file name or TFTP server name the client did not request is moved into
+// the file or sname header field, which BOOTP-era PXE ROMs read instead, and
+// requested options missing from resp are added where they can be derived from
+// it. It returns a description of the changes made, or "" if there were none.
+func applyParameterRequestList(req, resp *dhcpv4.DHCPv4) string {
+	prl := req.ParameterRequestList()
+	if len(prl) == 0 {
+		return ""
+	}
+
+	var changes []string
+	for _, code := range prlFilteredOptions {
+		if prl.Has(code) || !resp.Options.Has(code) {
+			continue
+		}
+		val := string(resp.Options.Get(code))
+		resp.Options.Del(code)
+		switch {
+		// The header fields are NUL-terminated
+		case code == dhcpv4.OptionBootfileName && len(val) < 128:
+			resp.BootFileName = val
+			changes = append(changes, fmt.Sprintf("moved %s to file field", code))
+		case code == dhcpv4.OptionTFTPServerName && len(val) < 64:
+			resp.ServerHostName = val
+			changes = append(changes, fmt.Sprintf("moved %s to sname field", code))
+		default:
+			changes = append(changes, fmt.Sprintf("removed %s", code))
+		}
+	}
+
+	for _, code := range prl {
+		if resp.Options.Has(code) {
+			continue
+		}
+		if opt, ok := derivedOption(code, resp); ok {
+			resp.Options.Update(opt)
+			changes = append(changes, fmt.Sprintf("added %s", code))
+		}
+	}
+
+	return strings.Join(changes, ", ")
+}
+
+// derivedOption returns the option with the given code as derived from the
+// header fields and other options of resp, for clients that only read the
+// options they request: the boot file name and TFTP server name from the file
+// and sname fields or the next server address, and the broadcast address from
+// the assigned address and subnet mask. It returns false if code is not one of
+// these or resp holds nothing to derive it from.
+func derivedOption(code dhcpv4.OptionCode, resp *dhcpv4.DHCPv4) (dhcpv4.Option, bool) {
+	switch code {
+	case dhcpv4.OptionBootfileName:
+		if resp.BootFileName != "" {
+			return dhcpv4.OptBootFileName(resp.BootFileName), true
+		}
+	case dhcpv4.OptionTFTPServerName:
+		if resp.ServerHostName != "" {
+			return dhcpv4.OptTFTPServerName(resp.ServerHostName), true
+		}
+		if ip := resp.ServerIPAddr.To4(); ip != nil && !ip.IsUnspecified() {
+			return dhcpv4.OptTFTPServerName(ip.String()), true
+		}
+	case dhcpv4.OptionBroadcastAddress:
+		ip, mask := resp.YourIPAddr.To4(), resp.SubnetMask()
+		if ip == nil || ip.IsUnspecified() || len(mask) != net.IPv4len {
+			break
+		}
+		broadcast := make(net.IP, net.IPv4len)
+		for i := range broadcast {
+			broadcast[i] = ip[i] | ^mask[i]
+		}
+		return dhcpv4.OptBroadcastAddress(broadcast), true
+	}
+	return dhcpv4.Option{}, false
+}
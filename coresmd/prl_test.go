@@ -0,0 +1,99 @@
+package coresmd
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestHandler4ParameterRequestList(t *testing.T) {
+	p := setupHandler(t)
+	p.config.Load().honorPRL = true
+
+	tests := []struct {
+		name         string
+		prl          []dhcpv4.OptionCode
+		wantHostName string
+		wantOption   string
+		wantHeader   string
+	}{
+		{
+			name:         "no list",
+			wantHostName: "nid0001",
+			wantOption:   "ipxe-x86_64.efi",
+		},
+		{
+			name:         "boot file requested",
+			prl:          []dhcpv4.OptionCode{dhcpv4.OptionSubnetMask, dhcpv4.OptionHostName, dhcpv4.OptionBootfileName},
+			wantHostName: "nid0001",
+			wantOption:   "ipxe-x86_64.efi",
+		},
+		{
+			name:       "boot file not requested",
+			prl:        []dhcpv4.OptionCode{dhcpv4.OptionSubnetMask, dhcpv4.OptionRouter},
+			wantHeader: "ipxe-x86_64.efi",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			modifiers := []dhcpv4.Modifier{withArch(iana.EFI_X86_64)}
+			if tt.prl != nil {
+				modifiers = append(modifiers, dhcpv4.WithRequestedOptions(tt.prl...))
+			}
+			req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", modifiers...)
+			resp, _ = p.Handler4(req, resp)
+
+			if got := resp.HostName(); got != tt.wantHostName {
+				t.Errorf("got hostname %q, want %q", got, tt.wantHostName)
+			}
+			if got := resp.BootFileNameOption(); got != tt.wantOption {
+				t.Errorf("got boot file option %q, want %q", got, tt.wantOption)
+			}
+			if got := resp.BootFileName; got != tt.wantHeader {
+				t.Errorf("got file field %q, want %q", got, tt.wantHeader)
+			}
+			if resp.IPAddressLeaseTime(0) == 0 {
+				t.Error("lease time was removed")
+			}
+		})
+	}
+}
+
+func TestParameterRequestListAddsOptions(t *testing.T) {
+	req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01",
+		dhcpv4.WithRequestedOptions(dhcpv4.OptionBootfileName, dhcpv4.OptionTFTPServerName, dhcpv4.OptionBroadcastAddress, dhcpv4.OptionDomainName))
+	resp.BootFileName = "undionly.kpxe"
+	resp.ServerIPAddr = net.IPv4(10, 0, 0, 1)
+	resp.YourIPAddr = net.IPv4(172, 16, 0, 5)
+	resp.Options.Update(dhcpv4.OptSubnetMask(net.CIDRMask(24, 32)))
+
+	changes := applyParameterRequestList(req, resp)
+	if got := resp.BootFileNameOption(); got != "undionly.kpxe" {
+		t.Errorf("boot file option = %q, want undionly.kpxe", got)
+	}
+	if got := resp.TFTPServerName(); got != "10.0.0.1" {
+		t.Errorf("TFTP server name = %q, want 10.0.0.1", got)
+	}
+	if got := resp.BroadcastAddress(); !got.Equal(net.IPv4(172, 16, 0, 255)) {
+		t.Errorf("broadcast address = %s, want 172.16.0.255", got)
+	}
+	// Options that cannot be derived are left out
+	if resp.Options.Has(dhcpv4.OptionDomainName) {
+		t.Error("domain name was added")
+	}
+	if !strings.Contains(changes, "added") {
+		t.Errorf("changes = %q", changes)
+	}
+
+	// The sname field takes precedence over the next server
+	req, resp = newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", dhcpv4.WithRequestedOptions(dhcpv4.OptionTFTPServerName))
+	resp.ServerHostName = "tftp.example"
+	resp.ServerIPAddr = net.IPv4(10, 0, 0, 1)
+	applyParameterRequestList(req, resp)
+	if got := resp.TFTPServerName(); got != "tftp.example" {
+		t.Errorf("TFTP server name = %q, want tftp.example", got)
+	}
+}
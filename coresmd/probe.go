@@ -0,0 +1,133 @@
+package coresmd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	icmpEchoRequest = 8
+	icmpEchoReply   = 0
+
+	// arpTable lists the kernel's neighbor entries for IPv4.
+	arpTable = "/proc/net/arp"
+	// arpFlagComplete marks an ARP table entry that has been resolved.
+	arpFlagComplete = 0x2
+)
+
+// probeConflict checks whether something other than the client with hardware
+// address mac is using ip by sending an ICMP echo request and then checking
+// the kernel's ARP table, which the request populates if ip is on a directly
+// connected network. The latter catches devices that do not answer ICMP. It
+// returns whether a conflict was found and, if known, the hardware address of
+// the conflicting device.
+func probeConflict(ip net.IP, mac string, timeout time.Duration) (bool, string, error) {
+	replied, err := icmpEcho(ip, timeout)
+	if err != nil {
+		return false, "", fmt.Errorf("ICMP probe failed: %w", err)
+	}
+
+	arpMAC, err := arpLookup(ip)
+	if err != nil {
+		log.Debugf("unable to check ARP table for %s: %v", ip, err)
+	}
+	if arpMAC != "" {
+		// The client itself may still hold its address (e.g. it is
+		// rebooting), which is not a conflict
+		return arpMAC != mac, arpMAC, nil
+	}
+
+	return replied, "", nil
+}
+
+// icmpEcho sends an ICMP echo request to ip and reports whether a reply was
+// received within timeout. It requires the privileges to open a raw socket,
+// which CoreDHCP already needs to serve DHCP.
+func icmpEcho(ip net.IP, timeout time.Duration) (bool, error) {
+	conn, err := net.ListenPacket("ip4:icmp", "0.0.0.0")
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	id := uint16(os.Getpid())
+	seq := uint16(time.Now().UnixNano())
+	msg := make([]byte, 8)
+	msg[0] = icmpEchoRequest
+	binary.BigEndian.PutUint16(msg[4:], id)
+	binary.BigEndian.PutUint16(msg[6:], seq)
+	binary.BigEndian.PutUint16(msg[2:], icmpChecksum(msg))
+
+	if _, err := conn.WriteTo(msg, &net.IPAddr{IP: ip}); err != nil {
+		return false, err
+	}
+
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return false, err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if nerr, ok := err.(net.Error); ok && nerr.Timeout() {
+				return false, nil
+			}
+			return false, err
+		}
+		src, ok := addr.(*net.IPAddr)
+		if !ok || !src.IP.Equal(ip) || n < 8 {
+			continue
+		}
+		if buf[0] == icmpEchoReply && binary.BigEndian.Uint16(buf[4:]) == id && binary.BigEndian.Uint16(buf[6:]) == seq {
+			return true, nil
+		}
+	}
+}
+
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(b[i:]))
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+
+	return ^uint16(sum)
+}
+
+// arpLookup returns the hardware address of ip from the kernel's ARP table if
+// it has a resolved entry for it, or an empty string otherwise.
+func arpLookup(ip net.IP) (string, error) {
+	f, err := os.Open(arpTable)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	// Each line after the header is:
+	// IP address  HW type  Flags  HW address  Mask  Device
+	scanner := bufio.NewScanner(f)
+	scanner.Scan()
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 4 || fields[0] != ip.String() {
+			continue
+		}
+		var flags int
+		if _, err := fmt.Sscanf(fields[2], "0x%x", &flags); err != nil || flags&arpFlagComplete == 0 {
+			return "", nil
+		}
+		return NormalizeMAC(fields[3])
+	}
+
+	return "", scanner.Err()
+}
@@ -0,0 +1,114 @@
+package coresmd
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// PXE vendor-specific information (DHCP option 43) suboptions, as defined by
+// the PXE specification.
+const (
+	pxeDiscoveryControl = 6
+	pxeBootMenu         = 9
+	pxeMenuPrompt       = 10
+	pxeEnd              = 255
+
+	pxeClientClass = "PXEClient"
+	// defaultPXEDiscoveryControl tells the client to skip boot server
+	// discovery and download the boot file it was given.
+	defaultPXEDiscoveryControl = 0x08
+)
+
+// pxeMenuItem is an entry of the PXE boot menu. Type 0 means boot from the
+// local disk.
+type pxeMenuItem struct {
+	bootType    uint16
+	description string
+}
+
+// pxeVendorOptions are sent as option 43 to PXE clients, which some PXE ROMs
+// and vendor firmwares need in order to boot.
+type pxeVendorOptions struct {
+	discoveryControl byte
+	menu             []pxeMenuItem
+	// promptTimeout is how many seconds the prompt is shown for before the
+	// first menu item is booted (255: wait for a key press).
+	promptTimeout byte
+	prompt        string
+}
+
+// encode returns the value of option 43.
+func (po *pxeVendorOptions) encode() []byte {
+	b := []byte{pxeDiscoveryControl, 1, po.discoveryControl}
+	if len(po.menu) > 0 {
+		var menu []byte
+		for _, item := range po.menu {
+			menu = binary.BigEndian.AppendUint16(menu, item.bootType)
+			menu = append(menu, byte(len(item.description)))
+			menu = append(menu, item.description...)
+		}
+		b = append(b, pxeBootMenu, byte(len(menu)))
+		b = append(b, menu...)
+	}
+	if po.prompt != "" {
+		b = append(b, pxeMenuPrompt, byte(1+len(po.prompt)), po.promptTimeout)
+		b = append(b, po.prompt...)
+	}
+
+	return append(b, pxeEnd)
+}
+
+// apply adds the PXE vendor options to resp if req comes from a PXE client.
+func (po *pxeVendorOptions) apply(req, resp *dhcpv4.DHCPv4) bool {
+	if po == nil || !strings.HasPrefix(req.ClassIdentifier(), pxeClientClass) {
+		return false
+	}
+	resp.Options.Update(dhcpv4.OptClassIdentifier(pxeClientClass))
+	resp.Options.Update(dhcpv4.OptGeneric(dhcpv4.OptionVendorSpecificInformation, po.encode()))
+	return true
+}
+
+// parsePXEMenu parses a comma-separated list of <type>:<description> entries.
+func parsePXEMenu(val string) ([]pxeMenuItem, error) {
+	var items []pxeMenuItem
+	size := 0
+	for _, entry := range strings.Split(val, ",") {
+		typ, desc, ok := strings.Cut(entry, ":")
+		if !ok || desc == "" {
+			return nil, fmt.Errorf("invalid entry %q: expected <type>:<description>", entry)
+		}
+		n, err := strconv.ParseUint(typ, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid boot server type in entry %q: %w", entry, err)
+		}
+		size += 3 + len(desc)
+		if size > 255 {
+			return nil, errors.New("menu does not fit in 255 bytes")
+		}
+		items = append(items, pxeMenuItem{bootType: uint16(n), description: desc})
+	}
+
+	return items, nil
+}
+
+// parsePXEMenuPrompt parses a <timeout>:<prompt> pair.
+func parsePXEMenuPrompt(val string) (byte, string, error) {
+	timeout, prompt, ok := strings.Cut(val, ":")
+	if !ok || prompt == "" {
+		return 0, "", fmt.Errorf("invalid prompt %q: expected <timeout>:<prompt>", val)
+	}
+	n, err := strconv.ParseUint(timeout, 10, 8)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid timeout in prompt %q: %w", val, err)
+	}
+	if len(prompt) > 254 {
+		return 0, "", errors.New("prompt does not fit in 254 bytes")
+	}
+
+	return byte(n), prompt, nil
+}
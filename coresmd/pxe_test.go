@@ -0,0 +1,63 @@
+package coresmd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestPXEVendorOptions(t *testing.T) {
+	menu, err := parsePXEMenu("0:Local,32768:Net")
+	if err != nil {
+		t.Fatal(err)
+	}
+	timeout, prompt, err := parsePXEMenuPrompt("10:Boot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	po := &pxeVendorOptions{discoveryControl: defaultPXEDiscoveryControl, menu: menu, promptTimeout: timeout, prompt: prompt}
+
+	want := []byte{
+		pxeDiscoveryControl, 1, 0x08,
+		pxeBootMenu, 14, 0x00, 0x00, 5, 'L', 'o', 'c', 'a', 'l', 0x80, 0x00, 3, 'N', 'e', 't',
+		pxeMenuPrompt, 5, 10, 'B', 'o', 'o', 't',
+		pxeEnd,
+	}
+	if got := po.encode(); !bytes.Equal(got, want) {
+		t.Errorf("got % x, want % x", got, want)
+	}
+
+	for _, val := range []string{"Local", "x:Local", "70000:Local", "0:"} {
+		if _, err := parsePXEMenu(val); err == nil {
+			t.Errorf("expected menu %q to be rejected", val)
+		}
+	}
+
+	p := setupHandler(t)
+	p.config.Load().pxe = po
+	tests := []struct {
+		class string
+		want  bool
+	}{
+		{"PXEClient:Arch:00007:UNDI:003016", true},
+		{"HTTPClient:Arch:00016:UNDI:003001", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		modifiers := []dhcpv4.Modifier{withArch(iana.EFI_X86_64)}
+		if tt.class != "" {
+			modifiers = append(modifiers, dhcpv4.WithOption(dhcpv4.OptClassIdentifier(tt.class)))
+		}
+		req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", modifiers...)
+		resp, _ = p.Handler4(req, resp)
+		got := resp.Options.Get(dhcpv4.OptionVendorSpecificInformation)
+		if tt.want != (got != nil) {
+			t.Errorf("class %q: got option 43 % x, want it sent: %t", tt.class, got, tt.want)
+		}
+		if tt.want && resp.ClassIdentifier() != pxeClientClass {
+			t.Errorf("class %q: got class identifier %q in response, want %q", tt.class, resp.ClassIdentifier(), pxeClientClass)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package coresmd
+
+import (
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// rateLimitSweepInterval is how often idle clients are forgotten by a
+// rateLimiter.
+const rateLimitSweepInterval = time.Minute
+
+// tokenBucket holds the tokens left to a client, as of last.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	// limited is set while the client's requests are being dropped, so
+	// that it is reported once
+	limited bool
+}
+
+// rateLimiter is a token-bucket rate limiter keyed by client (MAC or relay
+// address). Each client may send burst requests at once, and rate requests per
+// second after that. It is safe for concurrent use; buckets are split into
+// shards by key so that different clients do not wait on each other.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	shards [numShards]bucketShard
+}
+
+type bucketShard struct {
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+// newRateLimiter returns a limiter allowing rate requests per second with
+// bursts of up to burst, or nil if rate is zero. A burst of zero defaults to
+// rate, rounded up.
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	rl := &rateLimiter{rate: rate, burst: float64(burst)}
+	for i := range rl.shards {
+		rl.shards[i].buckets = make(map[string]*tokenBucket)
+	}
+	return rl
+}
+
+// sameAs reports whether rl and other apply the same limits.
+func (rl *rateLimiter) sameAs(other *rateLimiter) bool {
+	if rl == nil || other == nil {
+		return rl == other
+	}
+	return rl.rate == other.rate && rl.burst == other.burst
+}
+
+// allow takes a token for a request from key at now, reporting whether there
+// was one and whether key has just started being limited. A nil limiter allows
+// every request.
+func (rl *rateLimiter) allow(key string, now time.Time) (ok, started bool) {
+	if rl == nil {
+		return true, false
+	}
+	s := &rl.shards[shardOf(key)]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Forget clients whose buckets have refilled so that the map does not
+	// grow without bounds
+	if now.Sub(s.lastSweep) > rateLimitSweepInterval {
+		for k, b := range s.buckets {
+			if b.tokens+now.Sub(b.last).Seconds()*rl.rate >= rl.burst {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+
+	b, found := s.buckets[key]
+	if !found {
+		b = &tokenBucket{tokens: rl.burst, last: now}
+		s.buckets[key] = b
+	}
+	b.tokens = min(rl.burst, b.tokens+now.Sub(b.last).Seconds()*rl.rate)
+	b.last = now
+	if b.tokens < 1 {
+		started = !b.limited
+		b.limited = true
+		return false, started
+	}
+	b.tokens--
+	b.limited = false
+
+	return true, false
+}
+
+// rateLimited reports whether req should be dropped because its client or
+// relay agent sends requests faster than allowed.
+func (cfg *pluginConfig) rateLimited(req *dhcpv4.DHCPv4, now time.Time) bool {
+	mac := clientKey(req)
+	if ok, started := cfg.macRateLimit.allow(mac, now); !ok {
+		metricRateLimited.Inc("mac")
+		if started {
+			log.Warnf("dropping requests from %s: more than %g per second", mac, cfg.macRateLimit.rate)
+		}
+		return true
+	}
+	if relay := req.GatewayIPAddr; relay != nil && !relay.Equal(net.IPv4zero) {
+		if ok, started := cfg.relayRateLimit.allow(relay.String(), now); !ok {
+			metricRateLimited.Inc("relay")
+			if started {
+				log.Warnf("dropping requests relayed by %s: more than %g per second", relay, cfg.relayRateLimit.rate)
+			}
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,94 @@
+package coresmd
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl := newRateLimiter(2, 3)
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := rl.allow("aa:bb:cc:dd:ee:01", now); !ok {
+			t.Fatalf("request %d within burst was limited", i+1)
+		}
+	}
+	ok, started := rl.allow("aa:bb:cc:dd:ee:01", now)
+	if ok || !started {
+		t.Fatalf("request beyond burst: allowed %t, started %t, want limited and started", ok, started)
+	}
+	if _, started := rl.allow("aa:bb:cc:dd:ee:01", now); started {
+		t.Error("limiting reported as started twice")
+	}
+	if ok, _ := rl.allow("aa:bb:cc:dd:ee:02", now); !ok {
+		t.Error("another client was limited")
+	}
+
+	// Tokens refill at the rate
+	if ok, _ := rl.allow("aa:bb:cc:dd:ee:01", now.Add(500*time.Millisecond)); !ok {
+		t.Error("request after refill was limited")
+	}
+	if ok, _ := rl.allow("aa:bb:cc:dd:ee:01", now.Add(500*time.Millisecond)); ok {
+		t.Error("refill gave more than rate allows")
+	}
+
+	// Idle clients are forgotten when their shard is next swept
+	rl.allow(sameShard("aa:bb:cc:dd:ee:01"), now.Add(2*rateLimitSweepInterval))
+	if _, ok := rl.shards[shardOf("aa:bb:cc:dd:ee:01")].buckets["aa:bb:cc:dd:ee:01"]; ok {
+		t.Error("idle client was not forgotten")
+	}
+}
+
+// sameShard returns another key than key in the same shard.
+func sameShard(key string) string {
+	for i := 0; ; i++ {
+		if k := fmt.Sprintf("10.0.%d.%d", i/256, i%256); shardOf(k) == shardOf(key) {
+			return k
+		}
+	}
+}
+
+func TestNilRateLimiter(t *testing.T) {
+	var rl *rateLimiter
+	if newRateLimiter(0, 5) != nil {
+		t.Error("limiter created for a rate of zero")
+	}
+	if ok, _ := rl.allow("aa:bb:cc:dd:ee:01", time.Now()); !ok {
+		t.Error("nil limiter limited a request")
+	}
+	if !rl.sameAs(nil) || rl.sameAs(newRateLimiter(1, 1)) {
+		t.Error("sameAs mismatched nil limiters")
+	}
+}
+
+func TestHandler4RateLimit(t *testing.T) {
+	p := setupHandler(t)
+	cfg := *p.config.Load()
+	cfg.macRateLimit = newRateLimiter(1, 1)
+	cfg.relayRateLimit = newRateLimiter(1, 2)
+	p.config.Store(&cfg)
+
+	req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01")
+	if out, _ := p.Handler4(req, resp); out == nil {
+		t.Fatal("first request was dropped")
+	}
+	req, resp = newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01")
+	if out, stop := p.Handler4(req, resp); out != nil || !stop {
+		t.Errorf("flooding request got response %v, stop %t; want dropped", out, stop)
+	}
+
+	// Per relay agent
+	relay := func(d *dhcpv4.DHCPv4) { d.GatewayIPAddr = net.IPv4(172, 16, 0, 254) }
+	for i, mac := range []string{"aa:bb:cc:dd:ee:11", "aa:bb:cc:dd:ee:12", "aa:bb:cc:dd:ee:13"} {
+		req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, mac, relay)
+		out, stop := p.Handler4(req, resp)
+		if dropped := out == nil && stop; dropped != (i == 2) {
+			t.Errorf("relayed request %d: dropped %t, want %t", i+1, dropped, i == 2)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package coresmd
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Modes of log_redact.
+const (
+	// redactOff logs MAC and IP addresses as they are.
+	redactOff = "off"
+	// redactHash replaces them with a keyed hash, so that the messages
+	// about a client can still be picked out without revealing it.
+	redactHash = "hash"
+	// redactTruncate keeps the vendor part (OUI) of MAC addresses and the
+	// /24 network of IP addresses.
+	redactTruncate = "truncate"
+)
+
+const (
+	// redactAuditLog is the name of the audit log in log_redact_loggers,
+	// alongside the prefixes of CoreDHCP loggers.
+	redactAuditLog = "audit"
+	// redactHashLength is the number of hexadecimal digits of the hashes
+	// replacing addresses.
+	redactHashLength = 12
+)
+
+// defaultRedactLoggers are the loggers whose output is redacted if
+// log_redact_loggers is not set: this plugin's and the audit log.
+var defaultRedactLoggers = []string{"plugins/coresmd", redactAuditLog}
+
+var (
+	// macPattern matches MAC addresses separated by colons or hyphens.
+	macPattern = regexp.MustCompile(`(?i)\b[0-9a-f]{2}[:-][0-9a-f]{2}(?:[:-][0-9a-f]{2}){4}\b`)
+	// ipv4Pattern matches candidate IPv4 addresses, checked by ip.
+	ipv4Pattern = regexp.MustCompile(`\b\d{1,3}(?:\.\d{1,3}){3}\b`)
+)
+
+// logRedactor rewrites the MAC and IP addresses in log output so that logs
+// shipped off the system do not identify clients. It only applies to what is
+// logged: requests are handled with the real addresses.
+type logRedactor struct {
+	mode string
+	// key keys the hashes, so that they cannot be reversed by hashing
+	// every possible address
+	key []byte
+	// loggers holds the prefixes of the loggers to redact, and
+	// redactAuditLog if the audit log is redacted
+	loggers map[string]bool
+}
+
+// newLogRedactor returns a redactor in mode for loggers, or nil if mode is
+// redactOff. Hashes are keyed with the secret in keyFile, or with a random key
+// if it is empty, in which case they change when CoreDHCP restarts.
+func newLogRedactor(mode, keyFile string, loggers []string) (*logRedactor, error) {
+	if mode == redactOff {
+		return nil, nil
+	}
+	r := &logRedactor{mode: mode, loggers: make(map[string]bool, len(loggers))}
+	for _, l := range loggers {
+		r.loggers[l] = true
+	}
+	if mode == redactHash {
+		if keyFile != "" {
+			key, err := readSigningKey(keyFile)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read log_redact_key_file: %w", err)
+			}
+			r.key = key
+		} else {
+			r.key = make([]byte, 32)
+			if _, err := rand.Read(r.key); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return r, nil
+}
+
+// parseRedactMode checks that mode is a mode of log_redact.
+func parseRedactMode(mode string) (string, error) {
+	switch mode {
+	case redactOff, redactHash, redactTruncate:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid log_redact %q: expected %s, %s, or %s", mode, redactOff, redactHash, redactTruncate)
+}
+
+// redacts returns whether the output of logger is redacted. A nil redactor
+// redacts nothing.
+func (r *logRedactor) redacts(logger string) bool {
+	return r != nil && r.loggers[logger]
+}
+
+// hash returns the keyed hash of addr, prefixed with kind.
+func (r *logRedactor) hash(kind, addr string) string {
+	h := hmac.New(sha256.New, r.key)
+	h.Write([]byte(strings.ToLower(addr)))
+	return kind + "-" + hex.EncodeToString(h.Sum(nil))[:redactHashLength]
+}
+
+// mac returns the redacted form of the MAC address mac, whose octets are
+// separated by sep.
+func (r *logRedactor) mac(mac, sep string) string {
+	if r.mode == redactHash {
+		// Hash the canonical form so that both separators give the same
+		// hash
+		return r.hash("mac", strings.ReplaceAll(mac, sep, ":"))
+	}
+	return mac[:8] + strings.Repeat(sep+"xx", 3)
+}
+
+// ip returns the redacted form of the IPv4 address ip.
+func (r *logRedactor) ip(ip string) string {
+	if r.mode == redactHash {
+		return r.hash("ip", ip)
+	}
+	return ip[:strings.LastIndexByte(ip, '.')] + ".x"
+}
+
+// text returns s with the MAC and IPv4 addresses in it redacted. A nil
+// redactor returns s unchanged.
+func (r *logRedactor) text(s string) string {
+	if r == nil {
+		return s
+	}
+	s = macPattern.ReplaceAllStringFunc(s, func(m string) string {
+		return r.mac(m, m[2:3])
+	})
+	return ipv4Pattern.ReplaceAllStringFunc(s, func(m string) string {
+		if net.ParseIP(m) == nil {
+			// Not an address, e.g. a version number
+			return m
+		}
+		return r.ip(m)
+	})
+}
+
+// value returns the redacted form of a log field value. Values other than
+// strings, errors, addresses, and slices of strings are logged as they are.
+func (r *logRedactor) value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return r.text(v)
+	case error:
+		return r.text(v.Error())
+	case net.IP, net.HardwareAddr, *net.IPNet:
+		return r.text(fmt.Sprint(v))
+	case []string:
+		out := make([]string, len(v))
+		for i, s := range v {
+			out[i] = r.text(s)
+		}
+		return out
+	}
+	return v
+}
+
+// logRedaction is the redactor applied by redactHook, or nil if log
+// redaction is off.
+var logRedaction atomic.Pointer[logRedactor]
+
+var redactHookOnce sync.Once
+
+// setLogRedaction redacts log messages with r, or turns redaction off if r is
+// nil. The logger is shared by every plugin, so redaction is process-wide: the
+// coresmd instance set up last decides it for all of them. The hook is
+// installed once and only rewrites the messages of the loggers r is for.
+func setLogRedaction(r *logRedactor) {
+	logRedaction.Store(r)
+	if r == nil {
+		return
+	}
+	redactHookOnce.Do(func() {
+		log.Logger.AddHook(redactHook{})
+	})
+}
+
+// redactHook is a logrus hook redacting the messages and fields of entries
+// logged by the loggers selected in logRedaction.
+type redactHook struct{}
+
+func (redactHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (redactHook) Fire(entry *logrus.Entry) error {
+	r := logRedaction.Load()
+	prefix, _ := entry.Data["prefix"].(string)
+	if !r.redacts(prefix) {
+		return nil
+	}
+	// Entries are copied before hooks are fired, so their fields can be
+	// replaced without affecting the logger they were logged with
+	entry.Message = r.text(entry.Message)
+	for k, v := range entry.Data {
+		if k != "prefix" {
+			entry.Data[k] = r.value(v)
+		}
+	}
+	return nil
+}
+
+// auditRecord returns rec with its MAC address, assigned IP address, and boot
+// file redacted, if r redacts the audit log.
+func (r *logRedactor) auditRecord(rec auditRecord) auditRecord {
+	if !r.redacts(redactAuditLog) {
+		return rec
+	}
+	rec.MAC = r.text(rec.MAC)
+	rec.AssignedIP = r.text(rec.AssignedIP)
+	rec.Bootfile = r.text(rec.Bootfile)
+	return rec
+}
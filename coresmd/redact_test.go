@@ -0,0 +1,137 @@
+package coresmd
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestLogRedactorText(t *testing.T) {
+	truncate, err := newLogRedactor(redactTruncate, "", defaultRedactLoggers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "key")
+	if err := os.WriteFile(keyFile, []byte("0123456789abcdef\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	hash, err := newLogRedactor(redactHash, keyFile, defaultRedactLoggers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in := "assigning 172.16.0.1 to AA-BB-CC-DD-EE-01 (version 1.2.3.400, at 07:59:58) via http://172.16.0.253:8081/boot?mac=aa:bb:cc:dd:ee:01"
+	want := "assigning 172.16.0.x to AA-BB-CC-xx-xx-xx (version 1.2.3.400, at 07:59:58) via http://172.16.0.x:8081/boot?mac=aa:bb:cc:xx:xx:xx"
+	if got := truncate.text(in); got != want {
+		t.Errorf("truncate: got %q, want %q", got, want)
+	}
+
+	got := hash.text(in)
+	if strings.Contains(got, "172.16") || strings.Contains(strings.ToLower(got), "aa") {
+		t.Errorf("hash: addresses left in %q", got)
+	}
+	// The same client gets the same hash whatever its notation
+	macHash := hash.hash("mac", "aa:bb:cc:dd:ee:01")
+	if strings.Count(got, macHash) != 2 {
+		t.Errorf("hash: want %s twice in %q", macHash, got)
+	}
+	if !strings.Contains(got, "version 1.2.3.400") {
+		t.Errorf("hash: version number redacted in %q", got)
+	}
+
+	// Hashes depend on the key
+	other, err := newLogRedactor(redactHash, "", defaultRedactLoggers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.hash("mac", "aa:bb:cc:dd:ee:01") == macHash {
+		t.Error("random key gives the same hash")
+	}
+
+	if r, err := newLogRedactor(redactOff, "", defaultRedactLoggers); r != nil || err != nil {
+		t.Errorf("off: got %v, %v", r, err)
+	}
+	if r := (*logRedactor)(nil); r.text(in) != in {
+		t.Error("nil redactor changed text")
+	}
+}
+
+func TestRedactHook(t *testing.T) {
+	saved := logRedaction.Load()
+	t.Cleanup(func() { logRedaction.Store(saved) })
+	r, err := newLogRedactor(redactTruncate, "", []string{"plugins/coresmd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logRedaction.Store(r)
+
+	var buf bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&buf)
+	l.SetFormatter(&logrus.TextFormatter{DisableTimestamp: true})
+	l.AddHook(redactHook{})
+
+	mac, _ := net.ParseMAC("aa:bb:cc:dd:ee:01")
+	entry := l.WithFields(logrus.Fields{"prefix": "plugins/coresmd", "mac": mac.String(), "ip": net.IPv4(172, 16, 0, 1), "arch": uint16(7)})
+	entry.WithError(errors.New("no lease for aa:bb:cc:dd:ee:01")).Errorf("refusing %s", mac)
+	out := buf.String()
+	for _, want := range []string{"refusing aa:bb:cc:xx:xx:xx", "mac=\"aa:bb:cc:xx:xx:xx\"", "ip=172.16.0.x", "arch=7", "no lease for aa:bb:cc:xx:xx:xx"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("missing %q in %q", want, out)
+		}
+	}
+	// The logger's own fields are left alone
+	if entry.Data["mac"] != "aa:bb:cc:dd:ee:01" {
+		t.Errorf("logger fields changed: %v", entry.Data)
+	}
+
+	// Other loggers are not redacted
+	buf.Reset()
+	l.WithField("prefix", "plugins/file").Infof("leasing 172.16.0.1 to %s", mac)
+	if !strings.Contains(buf.String(), "leasing 172.16.0.1 to aa:bb:cc:dd:ee:01") {
+		t.Errorf("other logger redacted: %q", buf.String())
+	}
+}
+
+func TestSetLogRedaction(t *testing.T) {
+	saved := logRedaction.Load()
+	t.Cleanup(func() { logRedaction.Store(saved) })
+	r, err := newLogRedactor(redactTruncate, "", defaultRedactLoggers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	setLogRedaction(r)
+	if logRedaction.Load() != r {
+		t.Fatal("redactor not set")
+	}
+	// Turning log_redact off on reload turns redaction off
+	setLogRedaction(nil)
+	if got := logRedaction.Load(); got != nil {
+		t.Errorf("redaction still on after it was turned off: %v", got)
+	}
+}
+
+func TestRedactAuditRecord(t *testing.T) {
+	rec := auditRecord{MAC: "aa:bb:cc:dd:ee:01", AssignedIP: "172.16.0.1", Bootfile: "ipxe-x86_64.efi"}
+	r, err := newLogRedactor(redactTruncate, "", defaultRedactLoggers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := r.auditRecord(rec)
+	if got.MAC != "aa:bb:cc:xx:xx:xx" || got.AssignedIP != "172.16.0.x" || got.Bootfile != rec.Bootfile {
+		t.Errorf("got %+v", got)
+	}
+
+	// Only if the audit log is listed
+	r.loggers = map[string]bool{"plugins/coresmd": true}
+	if got := r.auditRecord(rec); got != rec {
+		t.Errorf("audit log not listed: got %+v", got)
+	}
+}
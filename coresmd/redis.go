@@ -0,0 +1,376 @@
+package coresmd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultRedisTimeout is how long a Redis command may take, including
+	// connecting, before it fails.
+	defaultRedisTimeout = time.Second
+	// defaultRedisPoolSize is how many connections a client opens at most.
+	defaultRedisPoolSize = 4
+	// redisMinBackoff and redisMaxBackoff bound how long commands fail
+	// right away after the server could not be reached.
+	redisMinBackoff = time.Second
+	redisMaxBackoff = 30 * time.Second
+)
+
+var (
+	// errRedisNil is returned for a nil reply, e.g. by GET for a missing
+	// key.
+	errRedisNil = errors.New("redis: nil reply")
+	// errRedisDown is returned without trying the server while backing off
+	// after it could not be reached.
+	errRedisDown = errors.New("redis: server unreachable, backing off")
+	// errRedisBusy is returned if no connection became free within the
+	// timeout.
+	errRedisBusy = errors.New("redis: no connection available")
+)
+
+// redisError is an error reply from the server.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// redisClient is a minimal client of the Redis protocol (RESP2), covering the
+// few commands needed to share state between coresmd servers without pulling
+// in a full client library. Commands are sent over a small pool of
+// connections, each dropped on any error and re-established by a later
+// command. Once the server cannot be reached, commands fail right away with
+// errRedisDown for a backoff doubling from redisMinBackoff to maxBackoff, so
+// that requests are not held up redialling a server that is down. It is safe
+// for concurrent use.
+type redisClient struct {
+	addr       string
+	username   string
+	password   string
+	db         int
+	tls        *tls.Config
+	timeout    time.Duration
+	maxBackoff time.Duration
+
+	// slots limits the connections in use, and idle holds the open ones
+	// that are not
+	slots chan struct{}
+	idle  chan *redisConn
+
+	// backoff is the current backoff, guarded by backoffMu, and downUntil
+	// when it ends, in Unix nanoseconds, or 0 if the last command reached
+	// the server
+	backoffMu sync.Mutex
+	backoff   time.Duration
+	downUntil atomic.Int64
+
+	closed atomic.Bool
+}
+
+// redisConn is a connection to the server.
+type redisConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+// newRedisClient returns a client of the server at rawURL, given as
+// redis://[[user]:password@]host[:port][/db], or rediss:// for TLS. No
+// connection is made until the first command.
+func newRedisClient(rawURL string) (*redisClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisClient{addr: u.Host, timeout: defaultRedisTimeout, maxBackoff: redisMaxBackoff}
+	switch u.Scheme {
+	case "redis":
+	case "rediss":
+		c.tls = &tls.Config{ServerName: u.Hostname()}
+	default:
+		return nil, fmt.Errorf("unsupported scheme %q: expected redis or rediss", u.Scheme)
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("missing host")
+	}
+	if u.Port() == "" {
+		c.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		c.username = u.User.Username()
+		c.password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if c.db, err = strconv.Atoi(db); err != nil || c.db < 0 {
+			return nil, fmt.Errorf("invalid database number %q", db)
+		}
+	}
+	c.setPoolSize(defaultRedisPoolSize)
+
+	return c, nil
+}
+
+// dedicated returns a client of the same server with a single connection of
+// its own and no backoff, for commands that must neither wait for others nor
+// be skipped.
+func (c *redisClient) dedicated() *redisClient {
+	d := &redisClient{
+		addr:     c.addr,
+		username: c.username,
+		password: c.password,
+		db:       c.db,
+		tls:      c.tls,
+		timeout:  c.timeout,
+	}
+	d.setPoolSize(1)
+
+	return d
+}
+
+// setPoolSize makes the client open at most n connections. It must be called
+// before the first command.
+func (c *redisClient) setPoolSize(n int) {
+	c.slots = make(chan struct{}, n)
+	c.idle = make(chan *redisConn, n)
+}
+
+// do sends a command and returns its reply: a string for simple strings, an
+// int64 for integers, a []byte for bulk strings, or a []interface{} for
+// arrays. Nil replies are returned as errRedisNil and error replies as a
+// redisError.
+func (c *redisClient) do(args ...string) (interface{}, error) {
+	if time.Now().UnixNano() < c.downUntil.Load() {
+		return nil, errRedisDown
+	}
+	timer := time.NewTimer(c.timeout)
+	defer timer.Stop()
+	select {
+	case c.slots <- struct{}{}:
+	case <-timer.C:
+		return nil, errRedisBusy
+	}
+	defer func() { <-c.slots }()
+
+	var conn *redisConn
+	select {
+	case conn = <-c.idle:
+	default:
+		var err error
+		if conn, err = c.connect(); err != nil {
+			c.failed()
+			return nil, err
+		}
+	}
+	reply, err := conn.roundTrip(args, c.timeout)
+	var re redisError
+	if err != nil && err != errRedisNil && !errors.As(err, &re) {
+		// The connection may be out of sync with the server
+		conn.Close()
+		c.failed()
+		return reply, err
+	}
+	c.reached()
+	if c.closed.Load() {
+		conn.Close()
+	} else {
+		c.idle <- conn
+	}
+
+	return reply, err
+}
+
+// failed backs off after the server could not be reached.
+func (c *redisClient) failed() {
+	if c.maxBackoff == 0 {
+		return
+	}
+	c.backoffMu.Lock()
+	defer c.backoffMu.Unlock()
+	c.backoff = min(max(2*c.backoff, redisMinBackoff), c.maxBackoff)
+	c.downUntil.Store(time.Now().Add(c.backoff).UnixNano())
+	log.Warnf("redis at %s is unreachable, retrying in %s", c.addr, c.backoff)
+}
+
+// reached resets the backoff after the server was reached.
+func (c *redisClient) reached() {
+	if c.downUntil.Load() == 0 {
+		return
+	}
+	c.backoffMu.Lock()
+	defer c.backoffMu.Unlock()
+	c.backoff = 0
+	c.downUntil.Store(0)
+}
+
+// connect dials the server and authenticates and selects the database, if
+// set.
+func (c *redisClient) connect() (*redisConn, error) {
+	d := &net.Dialer{Timeout: c.timeout}
+	var (
+		nc  net.Conn
+		err error
+	)
+	if c.tls != nil {
+		nc, err = tls.DialWithDialer(d, "tcp", c.addr, c.tls)
+	} else {
+		nc, err = d.Dial("tcp", c.addr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to redis at %s: %w", c.addr, err)
+	}
+	conn := &redisConn{Conn: nc, rd: bufio.NewReader(nc)}
+
+	var setup [][]string
+	switch {
+	case c.username != "":
+		setup = append(setup, []string{"AUTH", c.username, c.password})
+	case c.password != "":
+		setup = append(setup, []string{"AUTH", c.password})
+	}
+	if c.db != 0 {
+		setup = append(setup, []string{"SELECT", strconv.Itoa(c.db)})
+	}
+	for _, args := range setup {
+		if _, err := conn.roundTrip(args, c.timeout); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("failed to %s on redis at %s: %w", strings.ToLower(args[0]), c.addr, err)
+		}
+	}
+
+	return conn, nil
+}
+
+// roundTrip writes a command as an array of bulk strings and reads its reply,
+// failing if that takes longer than timeout.
+func (conn *redisConn) roundTrip(args []string, timeout time.Duration) (interface{}, error) {
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := io.WriteString(conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	return readRedisReply(conn.rd)
+}
+
+// readRedisReply reads one reply from rd.
+func readRedisReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, redisError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed bulk length %q", body)
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		return buf[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, fmt.Errorf("redis: malformed array length %q", body)
+		}
+		if n < 0 {
+			return nil, errRedisNil
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i], err = readRedisReply(rd)
+			if err != nil && err != errRedisNil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", kind)
+	}
+}
+
+// get returns the value of key, or errRedisNil if it does not exist.
+func (c *redisClient) get(key string) ([]byte, error) {
+	reply, err := c.do("GET", key)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := reply.([]byte)
+	if !ok {
+		return nil, fmt.Errorf("redis: unexpected reply %v to GET", reply)
+	}
+	return b, nil
+}
+
+// set sets key to val, expiring after ttl (rounded up to a millisecond).
+func (c *redisClient) set(key string, val []byte, ttl time.Duration) error {
+	_, err := c.do("SET", key, string(val), "PX", strconv.FormatInt(redisMillis(ttl), 10))
+	return err
+}
+
+// setNX sets key to val, expiring after ttl, unless it exists, and reports
+// whether it was set.
+func (c *redisClient) setNX(key string, val []byte, ttl time.Duration) (bool, error) {
+	_, err := c.do("SET", key, string(val), "NX", "PX", strconv.FormatInt(redisMillis(ttl), 10))
+	if err == errRedisNil {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// del deletes keys.
+func (c *redisClient) del(keys ...string) error {
+	_, err := c.do(append([]string{"DEL"}, keys...)...)
+	return err
+}
+
+// Close closes the idle connections, and those in use once their command
+// completes.
+func (c *redisClient) Close() {
+	c.closed.Store(true)
+	for {
+		select {
+		case conn := <-c.idle:
+			conn.Close()
+		default:
+			return
+		}
+	}
+}
+
+// redisMillis returns d in milliseconds, at least 1.
+func redisMillis(d time.Duration) int64 {
+	ms := int64((d + time.Millisecond - 1) / time.Millisecond)
+	if ms < 1 {
+		return 1
+	}
+	return ms
+}
@@ -0,0 +1,56 @@
+package coresmd
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// linkAddress returns the address identifying the client's subnet for a
+// relayed request: the link selection sub-option of option 82 if the relay
+// agent provided one (RFC 3527), otherwise the relay agent address (giaddr).
+// It returns nil if the request was not relayed.
+func linkAddress(req *dhcpv4.DHCPv4) net.IP {
+	if rai := req.RelayAgentInfo(); rai != nil {
+		if ls := rai.Get(dhcpv4.LinkSelectionSubOption); len(ls) == net.IPv4len {
+			return net.IP(ls)
+		}
+	}
+	if req.GatewayIPAddr != nil && !req.GatewayIPAddr.IsUnspecified() {
+		return req.GatewayIPAddr
+	}
+
+	return nil
+}
+
+// selectIP returns the IP address from ipList to assign to the client of req.
+// For relayed requests, the first address in the same subnet as the link
+// address is chosen, using the subnet mask already set in resp (e.g. by the
+// netmask plugin). Otherwise, the first address is chosen.
+func selectIP(req, resp *dhcpv4.DHCPv4, ipList []net.IP, tr *trace) net.IP {
+	link := linkAddress(req)
+	if link == nil {
+		tr.add("ip", ipList[0].String(), "smd", "request not relayed, using first address")
+		return ipList[0]
+	}
+	mask := resp.SubnetMask()
+	if mask == nil {
+		log.Warnf("request from %s was relayed via %s, but no subnet mask is set to select an IP address by; using %s", req.ClientHWAddr, link, ipList[0])
+		tr.add("ip", ipList[0].String(), "smd", "no subnet mask set, using first address")
+		return ipList[0]
+	}
+
+	subnet := link.Mask(mask)
+	for _, ip := range ipList {
+		if ip.To4() != nil && ip.Mask(mask).Equal(subnet) {
+			log.Debugf("selected %s for %s from subnet %s/%s", ip, req.ClientHWAddr, subnet, net.IP(mask))
+			tr.add("ip", ip.String(), "smd", fmt.Sprintf("address in subnet %s/%s of link address %s", subnet, net.IP(mask), link))
+			return ip
+		}
+	}
+	log.Warnf("no IP address for %s is in subnet %s/%s of link address %s; using %s", req.ClientHWAddr, subnet, net.IP(mask), link, ipList[0])
+	tr.add("ip", ipList[0].String(), "smd", fmt.Sprintf("no address in subnet %s/%s of link address %s, using first address", subnet, net.IP(mask), link))
+
+	return ipList[0]
+}
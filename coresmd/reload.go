@@ -0,0 +1,123 @@
+package coresmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/coredhcp/coredhcp/config"
+)
+
+var watchReloadOnce sync.Once
+
+// watchReloadSignal reloads every plugin instance configured with a config file
+// whenever the process receives SIGHUP. It only starts watching once.
+func watchReloadSignal() {
+	watchReloadOnce.Do(func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, syscall.SIGHUP)
+		go func() {
+			for range sigs {
+				log.Info("received SIGHUP, reloading configuration")
+				reloadAll()
+			}
+		}()
+	})
+}
+
+// reloadAll reloads every plugin instance configured with a config file.
+func reloadAll() {
+	setupMu.Lock()
+	defer setupMu.Unlock()
+
+	for _, p := range instances {
+		if p.opts.configFile == "" {
+			continue
+		}
+		if err := p.reload(); err != nil {
+			log.Errorf("failed to reload configuration, keeping previous configuration: %v", err)
+			msg := err.Error()
+			p.reloadErr.Store(&msg)
+			continue
+		}
+		p.reloadErr.Store(nil)
+	}
+}
+
+// reload re-reads the instance's arguments from the CoreDHCP config file and
+// applies them. The new handler settings are swapped in atomically so requests
+// being handled finish with the old ones, and the cache keeps its data until
+// it is refreshed with the new SMD settings. Listeners are not restarted, so
+// changes to their options require a restart. setupMu must be held.
+func (p *PluginState) reload() error {
+	conf, err := config.Load(p.opts.configFile)
+	if err != nil {
+		return fmt.Errorf("failed to load %s: %w", p.opts.configFile, err)
+	}
+	args, err := pluginArgs(conf, p.index)
+	if err != nil {
+		return err
+	}
+	cfg, cc, opts, err := loadConfig(args)
+	if err != nil {
+		return err
+	}
+
+	// Keep provisional leases if the discovery pool is unchanged
+	old := p.config.Load()
+	if old.discoveryPool != nil && cfg.discoveryPool != nil && old.discoveryPool.sameAs(cfg.discoveryPool) {
+		cfg.discoveryPool = old.discoveryPool
+	}
+	// Keep the rate limiters' state if their limits are unchanged
+	if old.macRateLimit.sameAs(cfg.macRateLimit) {
+		cfg.macRateLimit = old.macRateLimit
+	}
+	if old.relayRateLimit.sameAs(cfg.relayRateLimit) {
+		cfg.relayRateLimit = old.relayRateLimit
+	}
+	// Keep decision traces enabled or disabled through the admin API
+	cfg.explainMACs.keepChanges(old.explainMACs)
+	// Keep cached boot parameters until they are refreshed below
+	if old.bootParams != nil && cfg.bootParams != nil {
+		cfg.bootParams.index.Store(old.bootParams.index.Load())
+	}
+	if opts.listeners() != p.opts.listeners() {
+		log.Warn("listener options changed; restart CoreDHCP to apply them")
+	}
+
+	p.cache.Reconfigure(cc.client, cc.interval, cc.jitter, cc.types, cc.roles, cc.diff, cc.redfish, cc.groups)
+	p.config.Store(cfg)
+	p.args = args
+	p.opts.configFile = opts.configFile
+	log.Infof("reloaded coresmd configuration with base URL %s and refresh interval %s", cc.client.BaseURL, cc.interval)
+
+	// Fetch data using the new SMD settings right away
+	if err := p.cache.Refresh(context.Background()); err != nil {
+		log.Errorf("failed to refresh cache after reload: %v", err)
+	}
+
+	return nil
+}
+
+// pluginArgs returns the arguments of the coresmd entry at index among the
+// coresmd entries of the DHCPv4 plugin chain in conf.
+func pluginArgs(conf *config.Config, index int) ([]string, error) {
+	if conf.Server4 == nil {
+		return nil, fmt.Errorf("config has no DHCPv4 server")
+	}
+	n := 0
+	for _, pc := range conf.Server4.Plugins {
+		if pc.Name != pluginName {
+			continue
+		}
+		if n == index {
+			return pc.Args, nil
+		}
+		n++
+	}
+
+	return nil, fmt.Errorf("config has no %s plugin entry #%d", pluginName, index+1)
+}
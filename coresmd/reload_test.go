@@ -0,0 +1,189 @@
+package coresmd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coredhcp/coredhcp/handler"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+
+	"github.com/OpenCHAMI/coresmd/pkg/smdtest"
+)
+
+func TestReload(t *testing.T) {
+	p := setupHandler(t)
+
+	confFile := filepath.Join(t.TempDir(), "config.yaml")
+	conf := `server4:
+  listen:
+    - "127.0.0.1:6767"
+  plugins:
+    - server_id: 127.0.0.1
+    - coresmd: http://127.0.0.1:1 http://10.0.0.1:8081 "" 1h 30m smd_retries=0 config_file=` + confFile + `
+`
+	if err := os.WriteFile(confFile, []byte(conf), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	p.opts.configFile = confFile
+
+	// Hold settings from before the reload as an in-flight request would
+	before := p.config.Load()
+	before.explainMACs.set("aa:bb:cc:dd:ee:01", true)
+	p.funnel = newBootFunnel()
+	p.funnel.record("aa:bb:cc:dd:ee:01", funnelStage1, 0, time.Now())
+	p.lifecycles = newLifecycleTracker()
+	p.lifecycles.record("aa:bb:cc:dd:ee:01", "x3000c0s0b0n0", dhcpv4.MessageTypeDiscover, dhcpv4.MessageTypeOffer, false, false, time.Now())
+	p.chainLoops = newChainTracker()
+	p.chainLoops.record("aa:bb:cc:dd:ee:01", time.Hour, time.Now())
+
+	if err := p.reload(); err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+
+	if got := before.bootScriptBaseURL.String(); got != "http://172.16.0.253:8081" {
+		t.Errorf("settings held before reload changed: boot script base URL = %s", got)
+	}
+	if got := p.config.Load().bootScriptBaseURL.String(); got != "http://10.0.0.1:8081" {
+		t.Errorf("boot script base URL = %s, want http://10.0.0.1:8081", got)
+	}
+	if got := p.cache.RefreshInterval(); got != time.Hour {
+		t.Errorf("cache duration = %s, want 1h", got)
+	}
+	if !p.config.Load().explainMACs.enabled("aa:bb:cc:dd:ee:01") {
+		t.Error("decision traces enabled through the admin API were dropped")
+	}
+	if got := p.funnel.list(false); len(got) != 1 {
+		t.Errorf("boot funnel after reload is %+v, want the node recorded before", got)
+	}
+	if _, ok := p.lifecycles.lookup("aa:bb:cc:dd:ee:01"); !ok {
+		t.Error("boot lifecycle recorded before reload was dropped")
+	}
+	if n := p.chainLoops.record("aa:bb:cc:dd:ee:01", time.Hour, time.Now()); n != 2 {
+		t.Errorf("chain loop count after reload is %d, want 2", n)
+	}
+
+	// SMD is unreachable at the new URL, so the cached data must be kept
+	req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", withArch(iana.EFI_X86_64), withIPXE())
+	got, _ := p.Handler4(req, resp)
+	if !got.YourIPAddr.Equal([]byte{172, 16, 0, 1}) {
+		t.Errorf("yiaddr = %s, want 172.16.0.1", got.YourIPAddr)
+	}
+	if lease := got.IPAddressLeaseTime(0); lease != 30*time.Minute {
+		t.Errorf("lease = %s, want 30m", lease)
+	}
+	if bf := got.BootFileNameOption(); bf != "http://10.0.0.1:8081/boot/v1/bootscript?mac=aa:bb:cc:dd:ee:01" {
+		t.Errorf("boot file = %q", bf)
+	}
+}
+
+func TestListenerOptions(t *testing.T) {
+	base, err := parseOptions([]string{"http_listen=:8080", "admin_disable=cache,refresh"})
+	if err != nil {
+		t.Fatalf("parseOptions: %v", err)
+	}
+	tests := []struct {
+		args    []string
+		changed bool
+	}{
+		{[]string{"http_listen=:8080", "admin_disable=cache,refresh", "smd_retries=5", "lease_db=/tmp/leases.db"}, false},
+		{[]string{"http_listen=:8081", "admin_disable=cache,refresh"}, true},
+		{[]string{"http_listen=:8080", "admin_disable=cache"}, true},
+		{[]string{"http_listen=:8080", "admin_disable=cache,refresh", "admin_read_only=true"}, true},
+	}
+	for _, tt := range tests {
+		o, err := parseOptions(tt.args)
+		if err != nil {
+			t.Fatalf("parseOptions(%q): %v", tt.args, err)
+		}
+		if changed := o.listeners() != base.listeners(); changed != tt.changed {
+			t.Errorf("%q: listener options changed = %t, want %t", tt.args, changed, tt.changed)
+		}
+	}
+}
+
+func TestReloadInvalidConfig(t *testing.T) {
+	p := setupHandler(t)
+
+	confFile := filepath.Join(t.TempDir(), "config.yaml")
+	conf := `server4:
+  listen:
+    - "127.0.0.1:6767"
+  plugins:
+    - coresmd: http://127.0.0.1:1 http://10.0.0.1:8081 "" 1h notaduration
+`
+	if err := os.WriteFile(confFile, []byte(conf), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	p.opts.configFile = confFile
+
+	before := p.config.Load()
+	if err := p.reload(); err == nil {
+		t.Fatal("reload succeeded with invalid lease duration")
+	}
+	if p.config.Load() != before {
+		t.Error("settings were replaced by a failed reload")
+	}
+}
+
+func TestSetupAgain(t *testing.T) {
+	srv := smdtest.NewServer(
+		[]EthernetInterface{{MACAddress: "aa:bb:cc:dd:ee:01", ComponentID: "x3000c0s0b0n0"}},
+		[]Component{{ID: "x3000c0s0b0n0", NID: 1, Type: "Node"}},
+	)
+	t.Cleanup(srv.Close)
+	t.Cleanup(Shutdown)
+
+	// Find a free port for the metrics server, which a leaked instance would
+	// keep holding
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	metricsListen := "metrics_listen=" + ln.Addr().String()
+	ln.Close()
+
+	setup := func(args ...string) handler.Handler4 {
+		t.Helper()
+		h, err := setup4(append([]string{srv.URL, "http://172.16.0.253:8081", ""}, args...)...)
+		if err != nil && strings.Contains(err.Error(), "TFTP") {
+			t.Skipf("cannot start TFTP server: %v", err)
+		}
+		if err != nil {
+			t.Fatalf("setup4(%v): %v", args, err)
+		}
+		return h
+	}
+	serve := func(h handler.Handler4) {
+		t.Helper()
+		req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01")
+		h(req, resp)
+	}
+
+	// Two entries set up in one pass run side by side
+	h := setup("1h", "1h", metricsListen)
+	setup("1h", "2h")
+	if len(instances) != 2 {
+		t.Fatalf("%d instances after first pass, want 2", len(instances))
+	}
+	serve(h)
+
+	// Setting up again with different arguments replaces the instance at
+	// each position, and instances not set up again are torn down once the
+	// server serves
+	h = setup("1h", "30m", metricsListen)
+	if len(instances) != 2 {
+		t.Errorf("%d instances during second pass, want 2", len(instances))
+	}
+	serve(h)
+	if len(instances) != 1 || instances[0].args[4] != "30m" {
+		t.Fatalf("instances after second pass: %v", instances)
+	}
+	if got := len(Caches()); got != 1 {
+		t.Errorf("%d caches published, want 1", got)
+	}
+}
@@ -0,0 +1,60 @@
+package coresmd
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// Actions that can be taken when a client requests an IP address other than
+// the one assigned to it in SMD.
+const (
+	// mismatchNAK sends a DHCPNAK so the client restarts with a DISCOVER.
+	mismatchNAK = "nak"
+	// mismatchDrop sends no response.
+	mismatchDrop = "drop"
+	// mismatchOverride ACKs the SMD-assigned address regardless.
+	mismatchOverride = "override"
+)
+
+// requestedIP returns the IP address requested by the client of a DHCPREQUEST:
+// the requested IP address (option 50) when selecting or rebooting, or the
+// client IP address (ciaddr) when renewing or rebinding. It returns nil if
+// neither is set.
+func requestedIP(req *dhcpv4.DHCPv4) net.IP {
+	if ip := req.RequestedIPAddress(); ip != nil && !ip.IsUnspecified() {
+		return ip
+	}
+	if req.ClientIPAddr != nil && !req.ClientIPAddr.IsUnspecified() {
+		return req.ClientIPAddr
+	}
+
+	return nil
+}
+
+// newNak returns a DHCPNAK in reply to req with msg as the message (option
+// 56), using the server identifier already set in resp, if any.
+func newNak(req, resp *dhcpv4.DHCPv4, msg string) (*dhcpv4.DHCPv4, error) {
+	nak, err := dhcpv4.NewReplyFromRequest(req,
+		dhcpv4.WithMessageType(dhcpv4.MessageTypeNak),
+		dhcpv4.WithOption(dhcpv4.OptMessage(msg)),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create new %s message: %w", dhcpv4.MessageTypeNak, err)
+	}
+	if sid := resp.ServerIdentifier(); sid != nil {
+		nak.UpdateOption(dhcpv4.OptServerIdentifier(sid))
+	}
+
+	return nak, nil
+}
+
+func parseMismatchAction(val string) (string, error) {
+	switch val {
+	case mismatchNAK, mismatchDrop, mismatchOverride:
+		return val, nil
+	default:
+		return "", fmt.Errorf("unknown action %q (expected %s, %s, or %s)", val, mismatchNAK, mismatchDrop, mismatchOverride)
+	}
+}
@@ -0,0 +1,197 @@
+package coresmd
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// rescuePath is the path at which the built-in HTTP server serves the boot
+// scripts of nodes in rescue boot.
+const rescuePath = "/rescue"
+
+// rescueImage is the kernel, initrd, and kernel parameters a node in rescue
+// boot is booted with instead of its boot script. Empty fields take the values
+// of the rescue_kernel, rescue_initrd, and rescue_params options.
+type rescueImage struct {
+	Kernel string `yaml:"kernel" json:"kernel,omitempty"`
+	Initrd string `yaml:"initrd" json:"initrd,omitempty"`
+	Params string `yaml:"params" json:"params,omitempty"`
+}
+
+// UnmarshalYAML accepts 'rescue: true' in the overrides file for the default
+// rescue image, as well as a map of its fields. 'rescue: false' is rejected
+// here and handled by the caller, since it cannot be told from a zero image.
+func (ri *rescueImage) UnmarshalYAML(n *yaml.Node) error {
+	var enabled bool
+	if n.Kind == yaml.ScalarNode && n.Decode(&enabled) == nil {
+		if !enabled {
+			return errors.New("rescue: false is not supported, remove the setting instead")
+		}
+		*ri = rescueImage{}
+		return nil
+	}
+	type plain rescueImage
+	return n.Decode((*plain)(ri))
+}
+
+// withDefaults returns ri with its empty fields set from def.
+func (ri rescueImage) withDefaults(def rescueImage) rescueImage {
+	if ri.Kernel == "" {
+		ri.Kernel = def.Kernel
+	}
+	if ri.Initrd == "" {
+		ri.Initrd = def.Initrd
+	}
+	if ri.Params == "" {
+		ri.Params = def.Params
+	}
+	return ri
+}
+
+// rescueSet holds the nodes put in rescue boot through the admin API by MAC
+// address. Like explainSet, the map is replaced rather than updated so that
+// requests check it without a lock. It outlives reloads.
+type rescueSet struct {
+	mu    sync.Mutex
+	nodes atomic.Pointer[map[string]rescueImage]
+}
+
+func newRescueSet() *rescueSet {
+	rs := &rescueSet{}
+	rs.nodes.Store(&map[string]rescueImage{})
+	return rs
+}
+
+// lookup returns the rescue image of mac. A nil rescueSet has no nodes.
+func (rs *rescueSet) lookup(mac string) (rescueImage, bool) {
+	if rs == nil {
+		return rescueImage{}, false
+	}
+	ri, ok := (*rs.nodes.Load())[mac]
+	return ri, ok
+}
+
+// set puts mac in rescue boot with ri, or takes it out of rescue boot if ri
+// is nil.
+func (rs *rescueSet) set(mac string, ri *rescueImage) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	old := *rs.nodes.Load()
+	m := make(map[string]rescueImage, len(old)+1)
+	for k, v := range old {
+		m[k] = v
+	}
+	if ri != nil {
+		m[mac] = *ri
+	} else {
+		delete(m, mac)
+	}
+	rs.nodes.Store(&m)
+}
+
+// rescueFor returns the rescue image of the client with the given MAC address
+// and overrides file entry, and where it was set, if the client is in rescue
+// boot. The admin API takes precedence over the overrides file.
+func (p *PluginState) rescueFor(cfg *pluginConfig, mac string, static staticEntry) (rescueImage, string, bool) {
+	if ri, ok := p.rescue.lookup(mac); ok {
+		return ri.withDefaults(cfg.rescue), "admin", true
+	}
+	if static.Rescue != nil {
+		return static.Rescue.withDefaults(cfg.rescue), "overrides_file", true
+	}
+	return rescueImage{}, "", false
+}
+
+// rescueScriptURL returns the URL of the rescue boot script served by the
+// built-in HTTP server for the given MAC address.
+func rescueScriptURL(httpURL *url.URL, mac string) *url.URL {
+	u := httpURL.JoinPath(rescuePath)
+	u.RawQuery = url.Values{"mac": {mac}}.Encode()
+	return u
+}
+
+// serveRescueScript serves a boot script booting the rescue image of the node
+// whose MAC address is given in the mac query parameter.
+func (p *PluginState) serveRescueScript(w http.ResponseWriter, r *http.Request) {
+	cfg := p.config.Load()
+	if cfg.bootScriptKey != nil {
+		if err := VerifyBootScriptQuery(r.URL.Query(), cfg.bootScriptKey, cfg.bootScriptTTL, time.Now()); err != nil {
+			log.Warnf("http: refusing rescue script request from %s: %v", remoteIP(r), err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	mac, err := NormalizeMAC(r.URL.Query().Get("mac"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	static, _ := cfg.static.lookup(mac)
+	ri, _, ok := p.rescueFor(cfg, mac, static)
+	if !ok || ri.Kernel == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	if _, err := w.Write([]byte(bootScript(BootParams{Kernel: ri.Kernel, Initrd: ri.Initrd, Params: ri.Params}))); err != nil {
+		log.Errorf("http: failed to send rescue script to %s: %v", remoteIP(r), err)
+		return
+	}
+	log.Infof("http: sent rescue boot script for %s (kernel %s) to %s", mac, path.Base(ri.Kernel), remoteIP(r))
+}
+
+// adminRescue lists the nodes put in rescue boot through the admin API, or
+// puts a node in or takes it out of rescue boot. Nodes in rescue boot in the
+// overrides file are not listed or changed.
+func (p *PluginState) adminRescue(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost, http.MethodDelete) {
+		return
+	}
+	if r.Method != http.MethodGet {
+		query := r.URL.Query()
+		mac, err := NormalizeMAC(query.Get("mac"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodPost {
+			ri := rescueImage{Kernel: query.Get("kernel"), Initrd: query.Get("initrd"), Params: query.Get("params")}
+			if ri.withDefaults(p.config.Load().rescue).Kernel == "" {
+				http.Error(w, "no kernel given and rescue_kernel is not set", http.StatusBadRequest)
+				return
+			}
+			p.rescue.set(mac, &ri)
+			log.Infof("admin: %s put in rescue boot", mac)
+		} else {
+			p.rescue.set(mac, nil)
+			log.Infof("admin: %s taken out of rescue boot", mac)
+		}
+	}
+
+	nodes := *p.rescue.nodes.Load()
+	macs := make([]string, 0, len(nodes))
+	for mac := range nodes {
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+	type rescueNode struct {
+		MAC string `json:"mac"`
+		rescueImage
+	}
+	list := make([]rescueNode, len(macs))
+	for i, mac := range macs {
+		list[i] = rescueNode{mac, nodes[mac]}
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Nodes []rescueNode `json:"nodes"`
+	}{list})
+}
@@ -0,0 +1,101 @@
+package coresmd
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestHandler4Rescue(t *testing.T) {
+	p := setupHandler(t)
+	p.rescue = newRescueSet()
+	path := filepath.Join(t.TempDir(), "overrides.yaml")
+	overrides := "aa:bb:cc:dd:ee:01:\n  rescue: true\naa:bb:cc:dd:ee:02:\n  rescue:\n    kernel: http://s3/bmc-rescue\n"
+	if err := os.WriteFile(path, []byte(overrides), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := *p.config.Load()
+	var err error
+	if cfg.static, err = loadStaticOverrides(path); err != nil {
+		t.Fatal(err)
+	}
+	cfg.httpURL, _ = url.Parse("http://10.0.0.1:8080")
+	cfg.rescue = rescueImage{Kernel: "http://s3/rescue", Initrd: "http://s3/rescue.img", Params: "rd.shell"}
+	p.config.Store(&cfg)
+
+	bootfile := func(mac string, mods ...dhcpv4.Modifier) string {
+		t.Helper()
+		req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, mac, mods...)
+		got, _ := p.Handler4(req, resp)
+		return got.BootFileNameOption()
+	}
+	script := func(mac string) string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		p.serveRescueScript(w, httptest.NewRequest(http.MethodGet, "/rescue?mac="+mac, nil))
+		body, _ := io.ReadAll(w.Result().Body)
+		return string(body)
+	}
+
+	// iPXE clients in rescue boot are pointed at their rescue script
+	if got := bootfile("aa:bb:cc:dd:ee:01", withArch(iana.EFI_X86_64), withIPXE()); got != "http://10.0.0.1:8080/rescue?mac=aa%3Abb%3Acc%3Add%3Aee%3A01" {
+		t.Errorf("boot file = %q", got)
+	}
+	if got := bootfile("aa:bb:cc:dd:ee:01", withArch(iana.EFI_X86_64)); got != "ipxe-x86_64.efi" {
+		t.Errorf("non-iPXE client: boot file = %q", got)
+	}
+	if got, want := script("aa:bb:cc:dd:ee:01"), "#!ipxe\nkernel --name kernel http://s3/rescue initrd=initrd rd.shell\ninitrd --name initrd http://s3/rescue.img\nboot\n"; got != want {
+		t.Errorf("rescue script = %q, want %q", got, want)
+	}
+	if got := script("aa:bb:cc:dd:ee:02"); !strings.Contains(got, "kernel --name kernel http://s3/bmc-rescue ") {
+		t.Errorf("rescue script with own kernel = %q", got)
+	}
+
+	// Nodes are put in and taken out of rescue boot through the admin API
+	admin := func(method, query string) string {
+		t.Helper()
+		w := httptest.NewRecorder()
+		p.adminRescue(w, httptest.NewRequest(method, "/rescue?"+query, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s %s: status %d", method, query, w.Code)
+		}
+		var list struct {
+			Nodes []struct {
+				MAC    string `json:"mac"`
+				Kernel string `json:"kernel"`
+			} `json:"nodes"`
+		}
+		json.NewDecoder(w.Body).Decode(&list)
+		var macs []string
+		for _, n := range list.Nodes {
+			macs = append(macs, n.MAC+" "+n.Kernel)
+		}
+		return strings.Join(macs, ",")
+	}
+	req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:03", withArch(iana.EFI_X86_64), withIPXE())
+	if got, _ := p.Handler4(req, resp); got != nil && strings.Contains(got.BootFileNameOption(), "/rescue") {
+		t.Errorf("node not in rescue boot: boot file = %q", got.BootFileNameOption())
+	}
+	if got := admin(http.MethodPost, "mac=AA:BB:CC:DD:EE:02&kernel=http://s3/other"); got != "aa:bb:cc:dd:ee:02 http://s3/other" {
+		t.Errorf("nodes = %q", got)
+	}
+	if got := script("aa:bb:cc:dd:ee:02"); !strings.Contains(got, "http://s3/other") {
+		t.Errorf("admin API does not take precedence over overrides file: %q", got)
+	}
+	if got := admin(http.MethodDelete, "mac=aa:bb:cc:dd:ee:02"); got != "" {
+		t.Errorf("nodes = %q", got)
+	}
+
+	if _, err := parseStaticOverrides([]byte("aa:bb:cc:dd:ee:01:\n  rescue: false\n")); err == nil {
+		t.Error("rescue: false accepted")
+	}
+}
@@ -0,0 +1,190 @@
+package coresmd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// roleOptions is a bundle of DHCP options sent to Components with a given role
+// and, optionally, subrole. Unset fields leave the response as it is.
+type roleOptions struct {
+	dns    []net.IP
+	ntp    []net.IP
+	router []net.IP
+	domain string
+	lease  *leasePolicy
+	// "local" or "network", or "" to leave the boot behavior unchanged
+	boot string
+}
+
+// merge returns ro with the fields set in o replacing its own.
+func (ro roleOptions) merge(o roleOptions) roleOptions {
+	if o.dns != nil {
+		ro.dns = o.dns
+	}
+	if o.ntp != nil {
+		ro.ntp = o.ntp
+	}
+	if o.router != nil {
+		ro.router = o.router
+	}
+	if o.domain != "" {
+		ro.domain = o.domain
+	}
+	if o.lease != nil {
+		ro.lease = o.lease
+	}
+	if o.boot != "" {
+		ro.boot = o.boot
+	}
+	return ro
+}
+
+// apply sets the DNS server, NTP server, router, and domain name options in
+// resp and returns a description of what it set, or "" if nothing.
+func (ro roleOptions) apply(resp *dhcpv4.DHCPv4) string {
+	var set []string
+	if ro.dns != nil {
+		resp.Options.Update(dhcpv4.OptDNS(ro.dns...))
+		set = append(set, "dns "+joinIPs(ro.dns))
+	}
+	if ro.ntp != nil {
+		resp.Options.Update(dhcpv4.OptNTPServers(ro.ntp...))
+		set = append(set, "ntp "+joinIPs(ro.ntp))
+	}
+	if ro.router != nil {
+		resp.Options.Update(dhcpv4.OptRouter(ro.router...))
+		set = append(set, "router "+joinIPs(ro.router))
+	}
+	if ro.domain != "" {
+		resp.Options.Update(dhcpv4.OptDomainName(ro.domain))
+		set = append(set, "domain "+ro.domain)
+	}
+	return strings.Join(set, ", ")
+}
+
+func joinIPs(ips []net.IP) string {
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return strings.Join(s, " ")
+}
+
+// roleOptionsFor returns the option bundle for the Component owning ii: the
+// bundle for its role, with the bundle for its role and subrole on top. ok is
+// false if neither exists.
+func (cfg *pluginConfig) roleOptionsFor(ii IfaceInfo) (ro roleOptions, ok bool) {
+	if ii.Role == "" {
+		return ro, false
+	}
+	role := strings.ToLower(ii.Role)
+	if o, found := cfg.roleOptions[role]; found {
+		ro, ok = o, true
+	}
+	if ii.SubRole != "" {
+		if o, found := cfg.roleOptions[role+"/"+strings.ToLower(ii.SubRole)]; found {
+			ro, ok = ro.merge(o), true
+		}
+	}
+	return ro, ok
+}
+
+// roleKey returns the name of the bundle a Component with ii's role and
+// subrole gets, for logging.
+func roleKey(ii IfaceInfo) string {
+	if ii.SubRole != "" {
+		return ii.Role + "/" + ii.SubRole
+	}
+	return ii.Role
+}
+
+// parseRoleOptions parses a comma-separated list of option bundles of the form
+// <role>[/<subrole>]:<setting>[;<setting>...], where each setting is one of
+// dns=<ip>[+<ip>...], ntp=<ip>[+<ip>...], router=<ip>[+<ip>...],
+// domain=<name>, lease=<lease>[/<renewal>[/<rebinding>]], or
+// boot=local|network. Roles and subroles match case-insensitively.
+func parseRoleOptions(val string) (map[string]roleOptions, error) {
+	bundles := make(map[string]roleOptions)
+	for _, entry := range strings.Split(val, ",") {
+		key, settings, found := strings.Cut(entry, ":")
+		key = strings.ToLower(strings.TrimSpace(key))
+		if !found || key == "" || strings.HasPrefix(key, "/") || strings.HasSuffix(key, "/") || strings.Count(key, "/") > 1 {
+			return nil, fmt.Errorf("invalid entry %q: expected <role>[/<subrole>]:<setting>[;<setting>...]", entry)
+		}
+		if _, dup := bundles[key]; dup {
+			return nil, fmt.Errorf("duplicate entry for %s", key)
+		}
+		var ro roleOptions
+		for _, s := range strings.Split(settings, ";") {
+			name, v, found := strings.Cut(s, "=")
+			if !found || v == "" {
+				return nil, fmt.Errorf("invalid setting %q for %s: expected <name>=<value>", s, key)
+			}
+			var err error
+			switch strings.TrimSpace(name) {
+			case "dns":
+				ro.dns, err = parseIPList(v)
+			case "ntp":
+				ro.ntp, err = parseIPList(v)
+			case "router":
+				ro.router, err = parseIPList(v)
+			case "domain":
+				ro.domain = v
+			case "lease":
+				ro.lease, err = parseRoleLease(v)
+			case "boot":
+				if v != "local" && v != "network" {
+					err = fmt.Errorf("boot must be local or network, got %q", v)
+				}
+				ro.boot = v
+			default:
+				err = fmt.Errorf("unknown setting %q", name)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid setting %q for %s: %w", s, key, err)
+			}
+		}
+		bundles[key] = ro
+	}
+
+	return bundles, nil
+}
+
+// parseIPList parses a '+'-separated list of IPv4 addresses.
+func parseIPList(val string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, s := range strings.Split(val, "+") {
+		ip := net.ParseIP(s)
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q", s)
+		}
+		ips = append(ips, ip.To4())
+	}
+	return ips, nil
+}
+
+// parseRoleLease parses <lease>[/<renewal>[/<rebinding>]].
+func parseRoleLease(val string) (*leasePolicy, error) {
+	fields := strings.Split(val, "/")
+	if len(fields) > 3 {
+		return nil, fmt.Errorf("expected <lease>[/<renewal>[/<rebinding>]]")
+	}
+	var durations [3]time.Duration
+	for i, f := range fields {
+		d, err := time.ParseDuration(f)
+		if err != nil {
+			return nil, err
+		}
+		durations[i] = d
+	}
+	p := leasePolicy{lease: durations[0], renewal: durations[1], rebinding: durations[2]}
+	if err := p.validate(); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
@@ -0,0 +1,122 @@
+package coresmd
+
+import (
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestParseRoleOptions(t *testing.T) {
+	bundles, err := parseRoleOptions("Management:dns=10.0.0.1+10.0.0.2;lease=24h/12h;domain=mgmt.local,management/Master:boot=local")
+	if err != nil {
+		t.Fatalf("parseRoleOptions: %v", err)
+	}
+	m, ok := bundles["management"]
+	if !ok {
+		t.Fatalf("missing bundle for management: %v", bundles)
+	}
+	if len(m.dns) != 2 || m.dns[1].String() != "10.0.0.2" {
+		t.Errorf("dns = %v, want [10.0.0.1 10.0.0.2]", m.dns)
+	}
+	if m.lease == nil || m.lease.lease != 24*time.Hour || m.lease.renewal != 12*time.Hour {
+		t.Errorf("lease = %v, want 24h with T1 12h", m.lease)
+	}
+	if m.domain != "mgmt.local" {
+		t.Errorf("domain = %q, want mgmt.local", m.domain)
+	}
+	if bundles["management/master"].boot != "local" {
+		t.Errorf("management/master boot = %q, want local", bundles["management/master"].boot)
+	}
+
+	for _, val := range []string{
+		"Compute",
+		":dns=10.0.0.1",
+		"Compute/:dns=10.0.0.1",
+		"Compute:dns=10.0.0.1,Compute:ntp=10.0.0.1",
+		"Compute:dns=not-an-ip",
+		"Compute:dns=fd00::1",
+		"Compute:lease=1h/2h",
+		"Compute:boot=maybe",
+		"Compute:mtu=9000",
+		"Compute:dns",
+	} {
+		if _, err := parseRoleOptions(val); err == nil {
+			t.Errorf("parseRoleOptions(%q): expected error", val)
+		}
+	}
+}
+
+func TestRoleOptionsFor(t *testing.T) {
+	bundles, err := parseRoleOptions("compute:dns=10.0.0.1;ntp=10.0.0.5,Compute/Worker:dns=10.0.0.9;boot=local")
+	if err != nil {
+		t.Fatalf("parseRoleOptions: %v", err)
+	}
+	cfg := &pluginConfig{roleOptions: bundles}
+
+	ro, ok := cfg.roleOptionsFor(IfaceInfo{Role: "Compute", SubRole: "Worker"})
+	if !ok {
+		t.Fatal("no bundle for Compute/Worker")
+	}
+	if ro.dns[0].String() != "10.0.0.9" || ro.ntp[0].String() != "10.0.0.5" || ro.boot != "local" {
+		t.Errorf("Compute/Worker bundle = %+v, want subrole dns and boot on top of role ntp", ro)
+	}
+
+	ro, ok = cfg.roleOptionsFor(IfaceInfo{Role: "Compute", SubRole: "Other"})
+	if !ok || ro.dns[0].String() != "10.0.0.1" || ro.boot != "" {
+		t.Errorf("Compute/Other bundle = %+v, want the Compute bundle", ro)
+	}
+
+	if _, ok := cfg.roleOptionsFor(IfaceInfo{Role: "Storage"}); ok {
+		t.Error("got bundle for Storage, want none")
+	}
+}
+
+func TestHandler4RoleOptions(t *testing.T) {
+	p := setupHandler(t)
+	cfg := p.config.Load()
+	cfg.httpURL, _ = url.Parse("http://10.0.0.1:8080")
+	bundles, err := parseRoleOptions("Compute:dns=10.0.0.1;router=172.16.0.254;lease=2h,Management:dns=10.9.9.9")
+	if err != nil {
+		t.Fatalf("parseRoleOptions: %v", err)
+	}
+	cfg.roleOptions = bundles
+
+	req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01")
+	got, _ := p.Handler4(req, resp)
+	if dns := got.DNS(); len(dns) != 1 || dns[0].String() != "10.0.0.1" {
+		t.Errorf("DNS = %v, want [10.0.0.1]", dns)
+	}
+	if r := got.Router(); len(r) != 1 || r[0].String() != "172.16.0.254" {
+		t.Errorf("Router = %v, want [172.16.0.254]", r)
+	}
+	if lt := got.IPAddressLeaseTime(0); lt != 2*time.Hour {
+		t.Errorf("lease time = %s, want 2h", lt)
+	}
+
+	// The BMC has no role, so it gets no bundle
+	req, resp = newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:02")
+	got, _ = p.Handler4(req, resp)
+	if dns := got.DNS(); len(dns) != 0 {
+		t.Errorf("BMC DNS = %v, want none", dns)
+	}
+
+	// boot=local sends the role's nodes to local boot
+	bundles["compute"] = roleOptions{boot: "local"}
+	req, resp = newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", withArch(iana.EFI_X86_64), withIPXE())
+	got, _ = p.Handler4(req, resp)
+	if bf := got.BootFileNameOption(); bf != "http://10.0.0.1:8080/exit" {
+		t.Errorf("boot file = %q, want exit script", bf)
+	}
+
+	// boot=network overrides local_boot
+	bundles["compute"] = roleOptions{boot: "network"}
+	cfg.localBoot = nodeSelector{"*"}
+	req, resp = newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", withArch(iana.EFI_X86_64), withIPXE())
+	got, _ = p.Handler4(req, resp)
+	if bf := got.BootFileNameOption(); bf == "http://10.0.0.1:8080/exit" {
+		t.Error("boot=network node was sent to local boot")
+	}
+}
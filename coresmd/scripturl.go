@@ -0,0 +1,81 @@
+package coresmd
+
+import (
+	"fmt"
+	"io"
+	"net/url"
+	"strings"
+	"text/template"
+)
+
+// DefaultBootScriptPath is the template for the path and query of the boot
+// script URL used when none is configured. It matches the BSS v1 API.
+const DefaultBootScriptPath = "/boot/v1/bootscript?mac={{.MAC}}"
+
+// BootScriptParams are the values available to a boot script path template.
+type BootScriptParams struct {
+	// MAC is the hardware address of the booting interface.
+	MAC string
+	// Xname is the ID of the component the interface belongs to in SMD.
+	Xname string
+	// NID is the node ID of the component, or 0 if it has none.
+	NID int64
+	// Arch is the client system architecture (DHCP option 93) as a decimal
+	// number, or empty if the client did not send one. For clients listing
+	// several architectures, it is the one their bootloader is chosen for.
+	Arch string
+}
+
+// BootScriptTemplate builds boot script URLs from a text/template of their
+// path and query, relative to the boot script base URL.
+type BootScriptTemplate struct {
+	tmpl *template.Template
+}
+
+var defaultBootScriptTemplate = MustParseBootScriptTemplate(DefaultBootScriptPath)
+
+// ParseBootScriptTemplate parses a boot script path template such as
+// DefaultBootScriptPath. Values are not escaped, so that iPXE variables (e.g.
+// ${netX/mac}) can be passed in their place; use the urlquery function to
+// escape them.
+func ParseBootScriptTemplate(text string) (*BootScriptTemplate, error) {
+	tmpl, err := template.New("boot_script_path").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse boot script path template: %w", err)
+	}
+
+	// Catch references to unknown fields now rather than on every request
+	sample := BootScriptParams{MAC: "00:00:00:00:00:00", Xname: "x0", NID: 1, Arch: "7"}
+	if err := tmpl.Execute(io.Discard, sample); err != nil {
+		return nil, fmt.Errorf("failed to execute boot script path template: %w", err)
+	}
+
+	return &BootScriptTemplate{tmpl: tmpl}, nil
+}
+
+// MustParseBootScriptTemplate is like ParseBootScriptTemplate but panics if
+// the template cannot be parsed.
+func MustParseBootScriptTemplate(text string) *BootScriptTemplate {
+	t, err := ParseBootScriptTemplate(text)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// URL returns the boot script URL for params below base. A nil template
+// uses DefaultBootScriptPath.
+func (t *BootScriptTemplate) URL(base *url.URL, params BootScriptParams) (*url.URL, error) {
+	if t == nil {
+		t = defaultBootScriptTemplate
+	}
+	var b strings.Builder
+	if err := t.tmpl.Execute(&b, params); err != nil {
+		return nil, fmt.Errorf("failed to execute boot script path template: %w", err)
+	}
+	p, query, _ := strings.Cut(b.String(), "?")
+	u := base.JoinPath(p)
+	u.RawQuery = query
+
+	return u, nil
+}
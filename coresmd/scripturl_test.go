@@ -0,0 +1,68 @@
+package coresmd
+
+import (
+	"net/url"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestBootScriptTemplate(t *testing.T) {
+	base, _ := url.Parse("http://bss.example:8081/api")
+	params := BootScriptParams{MAC: "aa:bb:cc:dd:ee:01", Xname: "x3000c0s0b0n0", NID: 4, Arch: "7"}
+
+	tests := []struct {
+		name string
+		text string
+		want string
+	}{
+		{"default", DefaultBootScriptPath, "http://bss.example:8081/api/boot/v1/bootscript?mac=aa:bb:cc:dd:ee:01"},
+		{"path only", "/boot/v2/nodes/{{.Xname}}/script", "http://bss.example:8081/api/boot/v2/nodes/x3000c0s0b0n0/script"},
+		{"all fields", "/script?mac={{.MAC}}&name={{.Xname}}&nid={{.NID}}&arch={{.Arch}}", "http://bss.example:8081/api/script?mac=aa:bb:cc:dd:ee:01&name=x3000c0s0b0n0&nid=4&arch=7"},
+		{"escaped", "/script?mac={{urlquery .MAC}}", "http://bss.example:8081/api/script?mac=aa%3Abb%3Acc%3Add%3Aee%3A01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tmpl, err := ParseBootScriptTemplate(tt.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, err := tmpl.URL(base, params)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := u.String(); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	for _, text := range []string{"/script?mac={{.MAC", "/script?id={{.ID}}"} {
+		if _, err := ParseBootScriptTemplate(text); err == nil {
+			t.Errorf("expected %q to be rejected", text)
+		}
+	}
+
+	// A nil template falls back to the default, matching BootScriptURL
+	u, err := (*BootScriptTemplate)(nil).URL(base, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := u.String(), BootScriptURL(base, params.MAC).String(); got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestHandler4BootScriptArch(t *testing.T) {
+	p := setupHandler(t)
+	p.config.Load().bootScriptPath = MustParseBootScriptTemplate("/script?mac={{.MAC}}&arch={{.Arch}}")
+
+	// The client lists legacy BIOS first, but is served the x86_64 UEFI
+	// bootloader, so its boot script is for x86_64 UEFI
+	req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", withArch(iana.INTEL_X86PC, iana.EFI_X86_64), withIPXE())
+	resp, _ = p.Handler4(req, resp)
+	if got, want := resp.BootFileNameOption(), "http://172.16.0.253:8081/script?mac=aa:bb:cc:dd:ee:01&arch=7"; got != want {
+		t.Errorf("boot file = %q, want %q", got, want)
+	}
+}
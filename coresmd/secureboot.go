@@ -0,0 +1,251 @@
+package coresmd
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+const (
+	// grubConfigPath is where the built-in HTTP server serves GRUB configs
+	// generated from cached BSS boot parameters.
+	grubConfigPath = "/grubconfig"
+	// grubStubPrefix starts the name of the first config file GRUB looks
+	// for when booted from the network, followed by the client's MAC
+	// address with dashes (e.g. grub.cfg-01-aa-bb-cc-dd-ee-ff).
+	grubStubPrefix = "grub.cfg-01-"
+
+	defaultSecureBootShims = "x86_64:shimx64.efi,arm64:shimaa64.efi"
+)
+
+// secureBootConfig makes selected nodes boot the signed shim and GRUB instead
+// of iPXE, so that they can boot with Secure Boot enabled. Shim loads GRUB from
+// the same directory, and GRUB then fetches a grub.cfg-01-<mac> stub generated
+// by coresmd that points it at the node's GRUB config.
+type secureBootConfig struct {
+	nodes nodeSelector
+	// shims are the shim boot files by client architecture.
+	shims map[iana.Arch]string
+	// configPath is the template of the GRUB config path below the boot
+	// script base URL, or nil to use the GRUB configs generated by the
+	// built-in HTTP server.
+	configPath *BootScriptTemplate
+}
+
+// parseSecureBootShims parses a comma-separated list of <arch>:<file> pairs,
+// where <arch> is one of the names in bootArchs other than bios.
+func parseSecureBootShims(val string) (map[iana.Arch]string, error) {
+	shims := make(map[iana.Arch]string)
+	for _, pair := range strings.Split(val, ",") {
+		arch, file, ok := strings.Cut(pair, ":")
+		archs, known := bootArchs[arch]
+		if !ok || file == "" || !known || arch == "bios" {
+			return nil, fmt.Errorf("invalid pair %q: expected <x86_64|arm64>:<file>", pair)
+		}
+		for _, a := range archs {
+			shims[a] = file
+		}
+	}
+
+	return shims, nil
+}
+
+// serveShim sets the boot file in resp to the shim for the architecture of req.
+// UEFI HTTP boot clients are given a URL on httpURL.
+func (sb *secureBootConfig) serveShim(req, resp *dhcpv4.DHCPv4, httpURL *url.URL) (string, bool) {
+	for _, arch := range req.ClientArch() {
+		shim, ok := sb.shims[arch]
+		if !ok {
+			continue
+		}
+		if arch == iana.EFI_X86_64_HTTP || arch == iana.EFI_ARM64_HTTP {
+			if httpURL == nil {
+				return "", false
+			}
+			shim = httpURL.JoinPath(shim).String()
+			resp.Options.Update(dhcpv4.OptClassIdentifier("HTTPClient"))
+		}
+		resp.Options.Update(dhcpv4.OptBootFileName(shim))
+		return shim, true
+	}
+	return "", false
+}
+
+// grubPath converts an HTTP URL to a GRUB path, e.g. (http,host:8080)/path.
+// GRUB cannot fetch HTTPS URLs.
+func grubPath(u *url.URL) (string, error) {
+	if u.Scheme != "http" {
+		return "", fmt.Errorf("GRUB cannot fetch %s: only http URLs are supported", u)
+	}
+	// URLs joined onto a base URL without a path lack the leading slash
+	uri := u.RequestURI()
+	if !strings.HasPrefix(uri, "/") {
+		uri = "/" + uri
+	}
+	return fmt.Sprintf("(http,%s)%s", u.Host, uri), nil
+}
+
+// grubStub returns a GRUB config that loads the config at u.
+func grubStub(u *url.URL) (string, error) {
+	p, err := grubPath(u)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("set timeout=0\nconfigfile %s\n", p), nil
+}
+
+// grubConfig returns a GRUB config booting the kernel and initrd in bp.
+func grubConfig(bp BootParams) (string, error) {
+	var sb strings.Builder
+	sb.WriteString("set timeout=0\n")
+	kernel, err := parseGrubPath(bp.Kernel)
+	if err != nil {
+		return "", err
+	}
+	args := []string{"linux", kernel}
+	if bp.Params != "" {
+		args = append(args, bp.Params)
+	}
+	sb.WriteString(strings.Join(args, " ") + "\n")
+	if bp.Initrd != "" {
+		initrd, err := parseGrubPath(bp.Initrd)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&sb, "initrd %s\n", initrd)
+	}
+	sb.WriteString("boot\n")
+
+	return sb.String(), nil
+}
+
+func parseGrubPath(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", fmt.Errorf("invalid URL %q: %w", rawURL, err)
+	}
+	return grubPath(u)
+}
+
+// grubConfigURL returns the URL of the GRUB config for the node owning mac.
+func (p *PluginState) grubConfigURL(cfg *pluginConfig, mac string) (*url.URL, error) {
+	if cfg.secureBoot.configPath == nil {
+		u := cfg.httpURL.JoinPath(grubConfigPath)
+		u.RawQuery = url.Values{"mac": {mac}}.Encode()
+		return u, nil
+	}
+
+	params := BootScriptParams{MAC: mac}
+	if ii, err := p.cache.Snapshot().LookupMAC(mac); err == nil {
+		params.Xname, params.NID = ii.CompID, ii.CompNID
+	}
+	return cfg.secureBoot.configPath.URL(cfg.bootScriptBaseURL, params)
+}
+
+// grubStubFor returns the grub.cfg-01-<mac> stub for the file name GRUB
+// requested, if it is one and this instance boots the node with Secure Boot.
+func (p *PluginState) grubStubFor(name string) (string, bool) {
+	cfg := p.config.Load()
+	base := path.Base(name)
+	if cfg.secureBoot == nil || !strings.HasPrefix(base, grubStubPrefix) {
+		return "", false
+	}
+	mac, err := NormalizeMAC(strings.ReplaceAll(strings.TrimPrefix(base, grubStubPrefix), "-", ":"))
+	if err != nil {
+		return "", false
+	}
+	ii, err := p.cache.Snapshot().LookupMAC(mac)
+	if err != nil || !cfg.secureBoot.nodes.matches(ii) {
+		return "", false
+	}
+
+	u, err := p.grubConfigURL(cfg, mac)
+	if err == nil {
+		var stub string
+		if stub, err = grubStub(u); err == nil {
+			return stub, true
+		}
+	}
+	log.Errorf("unable to generate GRUB config stub for %s: %v", mac, err)
+	return "", false
+}
+
+// serveGrubConfig serves a GRUB config generated from the cached BSS boot
+// parameters of the node whose MAC address is given in the mac query
+// parameter.
+func (p *PluginState) serveGrubConfig(w http.ResponseWriter, r *http.Request) {
+	cfg := p.config.Load()
+	if cfg.bootParams == nil {
+		http.NotFound(w, r)
+		return
+	}
+	mac, err := NormalizeMAC(r.URL.Query().Get("mac"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var compID string
+	if ei, ok := p.cache.Snapshot().EthernetInterfaces[mac]; ok {
+		compID = ei.ComponentID
+	}
+	bp, ok := cfg.bootParams.lookup(mac, compID)
+	if !ok || bp.Kernel == "" {
+		log.Warnf("http: no cached boot parameters for %s, unable to generate GRUB config for %s", mac, remoteIP(r))
+		http.NotFound(w, r)
+		return
+	}
+	config, err := grubConfig(bp)
+	if err != nil {
+		log.Errorf("http: unable to generate GRUB config for %s: %v", mac, err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	if _, err := w.Write([]byte(config)); err != nil {
+		log.Errorf("http: failed to send GRUB config to %s: %v", remoteIP(r), err)
+		return
+	}
+	log.Infof("http: sent GRUB config for %s (kernel %s) to %s", mac, path.Base(bp.Kernel), remoteIP(r))
+}
+
+var (
+	// grubStubSourcesMu guards grubStubSources, the plugin instances the
+	// shared TFTP server asks for GRUB config stubs.
+	grubStubSourcesMu sync.RWMutex
+	grubStubSources   = make(map[*PluginState]struct{})
+)
+
+// registerGrubStubSource makes the TFTP server serve GRUB config stubs of p
+// and returns a function undoing it.
+func registerGrubStubSource(p *PluginState) func() {
+	grubStubSourcesMu.Lock()
+	defer grubStubSourcesMu.Unlock()
+	grubStubSources[p] = struct{}{}
+
+	return func() {
+		grubStubSourcesMu.Lock()
+		defer grubStubSourcesMu.Unlock()
+		delete(grubStubSources, p)
+	}
+}
+
+// tftpGrubStub returns the GRUB config stub for a file name requested over
+// TFTP from any plugin instance.
+func tftpGrubStub(name string) (string, bool) {
+	grubStubSourcesMu.RLock()
+	defer grubStubSourcesMu.RUnlock()
+	for p := range grubStubSources {
+		if stub, ok := p.grubStubFor(name); ok {
+			return stub, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,78 @@
+package coresmd
+
+import (
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestSecureBoot(t *testing.T) {
+	shims, err := parseSecureBootShims(defaultSecureBootShims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := setupHandler(t)
+	p.config.Load().secureBoot = &secureBootConfig{
+		nodes:      nodeSelector{"role:compute"},
+		shims:      shims,
+		configPath: MustParseBootScriptTemplate("/boot/v1/grub.cfg?mac={{.MAC}}&nid={{.NID}}"),
+	}
+
+	tests := []struct {
+		name      string
+		mac       string
+		modifiers []dhcpv4.Modifier
+		want      string
+	}{
+		{"selected node gets shim", "aa:bb:cc:dd:ee:01", []dhcpv4.Modifier{withArch(iana.EFI_X86_64)}, "shimx64.efi"},
+		{"arm64 shim", "aa:bb:cc:dd:ee:01", []dhcpv4.Modifier{withArch(iana.EFI_ARM64)}, "shimaa64.efi"},
+		{"other node gets iPXE", "aa:bb:cc:dd:ee:02", []dhcpv4.Modifier{withArch(iana.EFI_X86_64)}, "ipxe-x86_64.efi"},
+		{"no shim for BIOS", "aa:bb:cc:dd:ee:01", []dhcpv4.Modifier{withArch(iana.INTEL_X86PC)}, ""},
+		{"iPXE is not affected", "aa:bb:cc:dd:ee:01", []dhcpv4.Modifier{withArch(iana.EFI_X86_64), withIPXE()}, "http://172.16.0.253:8081/boot/v1/bootscript?mac=aa:bb:cc:dd:ee:01"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, tt.mac, tt.modifiers...)
+			resp, _ = p.Handler4(req, resp)
+			if got := resp.BootFileNameOption(); got != tt.want {
+				t.Errorf("got boot file %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	stub, ok := p.grubStubFor("/EFI/BOOT/grub.cfg-01-aa-bb-cc-dd-ee-01")
+	if !ok {
+		t.Fatal("no GRUB config stub for selected node")
+	}
+	if want := "set timeout=0\nconfigfile (http,172.16.0.253:8081)/boot/v1/grub.cfg?mac=aa:bb:cc:dd:ee:01&nid=1\n"; stub != want {
+		t.Errorf("got stub %q, want %q", stub, want)
+	}
+	for _, name := range []string{"grub.cfg-01-aa-bb-cc-dd-ee-02", "grub.cfg", "grub.cfg-01-zz"} {
+		if _, ok := p.grubStubFor(name); ok {
+			t.Errorf("got GRUB config stub for %s", name)
+		}
+	}
+}
+
+func TestGrubConfig(t *testing.T) {
+	got, err := grubConfig(BootParams{
+		Kernel: "http://s3.example:9000/boot/vmlinuz",
+		Initrd: "http://s3.example:9000/boot/initrd.img",
+		Params: "console=ttyS0 root=live:http://s3.example/image",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "set timeout=0\n" +
+		"linux (http,s3.example:9000)/boot/vmlinuz console=ttyS0 root=live:http://s3.example/image\n" +
+		"initrd (http,s3.example:9000)/boot/initrd.img\n" +
+		"boot\n"
+	if got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if _, err := grubConfig(BootParams{Kernel: "https://s3.example/boot/vmlinuz"}); err == nil {
+		t.Error("expected HTTPS kernel URL to be rejected")
+	}
+}
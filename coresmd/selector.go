@@ -0,0 +1,48 @@
+package coresmd
+
+import (
+	"slices"
+	"strings"
+)
+
+// nodeSelector selects nodes by xname (e.g. x3000c0s0b0n0), type:<type>,
+// role:<role>, subrole:<subrole>, group:<label>, partition:<name>, or '*' for
+// all nodes.
+// Groups and partitions are only known if the cache fetches them.
+type nodeSelector []string
+
+// parseNodeSelector parses a comma-separated node selector.
+func parseNodeSelector(val string) nodeSelector {
+	return strings.Split(val, ",")
+}
+
+// matches reports whether the node owning ii is selected.
+func (ns nodeSelector) matches(ii IfaceInfo) bool {
+	for _, s := range ns {
+		switch {
+		case s == "*", s == ii.CompID:
+			return true
+		case strings.HasPrefix(s, "type:") && strings.EqualFold(s[len("type:"):], ii.Type):
+			return true
+		case strings.HasPrefix(s, "role:") && strings.EqualFold(s[len("role:"):], ii.Role):
+			return true
+		case strings.HasPrefix(s, "subrole:") && strings.EqualFold(s[len("subrole:"):], ii.SubRole):
+			return true
+		case strings.HasPrefix(s, "group:") && slices.Contains(ii.Groups, s[len("group:"):]):
+			return true
+		case strings.HasPrefix(s, "partition:") && ii.Partition != "" && s[len("partition:"):] == ii.Partition:
+			return true
+		}
+	}
+	return false
+}
+
+// usesGroups reports whether ns selects nodes by group or partition.
+func (ns nodeSelector) usesGroups() bool {
+	for _, s := range ns {
+		if strings.HasPrefix(s, "group:") || strings.HasPrefix(s, "partition:") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,40 @@
+package coresmd
+
+import (
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// serverIDFor returns the server identifier (option 54) coresmd answers as:
+// server_id if set, or else the one already set in resp by the plugins before
+// it (e.g. server_id), if any.
+func (cfg *pluginConfig) serverIDFor(resp *dhcpv4.DHCPv4) net.IP {
+	if cfg.serverID != nil {
+		return cfg.serverID
+	}
+	if resp == nil {
+		return nil
+	}
+	return resp.ServerIdentifier()
+}
+
+// otherServer returns the server identifier of the DHCP server other than sid
+// that req is addressed to, or nil. Clients name the server in DHCPREQUESTs
+// accepting its offer and in DHCPDECLINEs and DHCPRELEASEs, so these are left
+// to that server, for example a legacy server still answering part of the
+// network while clients are migrated to coresmd.
+func otherServer(req *dhcpv4.DHCPv4, sid net.IP) net.IP {
+	if sid == nil {
+		return nil
+	}
+	switch req.MessageType() {
+	case dhcpv4.MessageTypeRequest, dhcpv4.MessageTypeDecline, dhcpv4.MessageTypeRelease:
+	default:
+		return nil
+	}
+	if other := req.ServerIdentifier(); other != nil && !other.IsUnspecified() && !other.Equal(sid) {
+		return other
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+package coresmd
+
+import "hash/maphash"
+
+// numShards is the number of shards that per-client state is split into so
+// that concurrent requests from different clients rarely wait on the same
+// lock.
+const numShards = 64
+
+var shardSeed = maphash.MakeSeed()
+
+// shardOf returns the shard that key belongs to.
+func shardOf(key string) int {
+	return int(maphash.String(shardSeed, key) % numShards)
+}
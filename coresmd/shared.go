@@ -0,0 +1,319 @@
+package coresmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultSharedStatePrefix is prepended to the keys coresmd stores in
+	// the shared backend if shared_state_prefix is not set.
+	defaultSharedStatePrefix = "coresmd"
+	// sharedConflictTTL is how long a declined address is remembered in the
+	// shared backend.
+	sharedConflictTTL = 24 * time.Hour
+	// sharedWriteQueue is how many writes may wait to be sent to the
+	// backend before further ones are dropped.
+	sharedWriteQueue = 1024
+	// sharedHolderScript returns the lease record of the MAC address
+	// holding the address in KEYS[1], given the prefix of lease keys in
+	// ARGV[1], so that it takes a single round trip.
+	sharedHolderScript = `local mac = redis.call("GET", KEYS[1]) if not mac then return false end return redis.call("GET", ARGV[1] .. mac)`
+)
+
+// sharedState holds the lease records and declined addresses of the coresmd
+// servers sharing a Redis backend, so that servers answering the same clients
+// (e.g. an active/active pair behind the same relays) agree on which address
+// each client holds and which addresses are conflicted. Each server keeps its
+// own records too and falls back to them while the backend is unreachable.
+// Changes are sent by a background goroutine so that requests do not wait for
+// them. A nil sharedState shares nothing.
+type sharedState struct {
+	redis  *redisClient
+	prefix string
+
+	writes  chan sharedWrite
+	stop    chan struct{}
+	stopped chan struct{}
+	// pending holds the lease changes queued but not yet sent by MAC
+	// address, so that this server reads its own changes
+	pendingMu sync.Mutex
+	pending   map[string]*pendingLease
+}
+
+// pendingLease is a queued lease change: the record to store, or nil to
+// delete it.
+type pendingLease struct {
+	r *leaseRecord
+}
+
+// sharedWrite is a change queued to be sent to the backend.
+type sharedWrite struct {
+	what  string
+	write func() error
+}
+
+// newSharedState returns the shared state kept in the Redis server at rawURL
+// under keys starting with prefix.
+func newSharedState(rawURL, prefix string) (*sharedState, error) {
+	c, err := newRedisClient(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid shared_state: %w", err)
+	}
+	s := &sharedState{
+		redis:   c,
+		prefix:  prefix,
+		writes:  make(chan sharedWrite, sharedWriteQueue),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+		pending: make(map[string]*pendingLease),
+	}
+	go s.send()
+
+	return s, nil
+}
+
+// queue queues write, describing the change as what in logs, and reports
+// whether it was queued.
+func (s *sharedState) queue(what string, write func() error) bool {
+	select {
+	case s.writes <- sharedWrite{what, write}:
+		return true
+	default:
+		log.Errorf("failed to share %s: too many changes waiting to be sent", what)
+		return false
+	}
+}
+
+// send sends queued writes until s is closed, then the ones still queued.
+func (s *sharedState) send() {
+	defer close(s.stopped)
+	for {
+		select {
+		case w := <-s.writes:
+			w.send()
+		case <-s.stop:
+			for {
+				select {
+				case w := <-s.writes:
+					w.send()
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (w sharedWrite) send() {
+	if err := w.write(); err != nil {
+		log.Errorf("failed to share %s: %v", w.what, err)
+	}
+}
+
+// flush waits for the writes queued so far to be sent. s must not be closed.
+func (s *sharedState) flush() {
+	done := make(chan struct{})
+	s.writes <- sharedWrite{write: func() error { close(done); return nil }}
+	<-done
+}
+
+func (s *sharedState) key(kind, id string) string {
+	return s.prefix + ":" + kind + ":" + id
+}
+
+// queueLease queues storing r with putLease.
+func (s *sharedState) queueLease(r leaseRecord, now time.Time) {
+	pl := s.setPending(r.MAC, &r)
+	queued := s.queue("lease for "+r.MAC, func() error {
+		defer s.clearPending(r.MAC, pl)
+		return s.putLease(r, now)
+	})
+	if !queued {
+		s.clearPending(r.MAC, pl)
+	}
+}
+
+// setPending records a queued change of the lease of mac.
+func (s *sharedState) setPending(mac string, r *leaseRecord) *pendingLease {
+	pl := &pendingLease{r: r}
+	s.pendingMu.Lock()
+	s.pending[mac] = pl
+	s.pendingMu.Unlock()
+	return pl
+}
+
+// clearPending forgets pl once sent, unless a later change of the lease of mac
+// was queued since.
+func (s *sharedState) clearPending(mac string, pl *pendingLease) {
+	s.pendingMu.Lock()
+	if s.pending[mac] == pl {
+		delete(s.pending, mac)
+	}
+	s.pendingMu.Unlock()
+}
+
+// pendingLease returns the queued change of the lease of mac, if any.
+func (s *sharedState) pendingLease(mac string) (*leaseRecord, bool) {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	pl, ok := s.pending[mac]
+	if !ok {
+		return nil, false
+	}
+	return pl.r, true
+}
+
+// pendingHolder returns the MAC address of a queued lease of ip active at now,
+// or "".
+func (s *sharedState) pendingHolder(ip string, now time.Time) string {
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	for mac, pl := range s.pending {
+		if pl.r != nil && pl.r.IP == ip && pl.r.active(now) {
+			return mac
+		}
+	}
+	return ""
+}
+
+// putLease stores r until it expires, along with the MAC address holding its
+// IP. Records no longer active at now are deleted instead.
+func (s *sharedState) putLease(r leaseRecord, now time.Time) error {
+	if !r.active(now) {
+		return s.redis.del(s.key("lease", r.MAC))
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	ttl := r.Expires.Sub(now)
+	if err := s.redis.set(s.key("lease", r.MAC), b, ttl); err != nil {
+		return err
+	}
+	return s.redis.set(s.key("ip", r.IP), []byte(r.MAC), ttl)
+}
+
+// lease returns the active record of mac at now, or nil.
+func (s *sharedState) lease(mac string, now time.Time) (*leaseRecord, error) {
+	if r, ok := s.pendingLease(mac); ok {
+		if r == nil || !r.active(now) {
+			return nil, nil
+		}
+		c := *r
+		return &c, nil
+	}
+	b, err := s.redis.get(s.key("lease", mac))
+	return activeLease(b, err, now)
+}
+
+// holder returns the MAC address currently offered or leased ip at now, or "".
+func (s *sharedState) holder(ip string, now time.Time) (string, error) {
+	if mac := s.pendingHolder(ip, now); mac != "" {
+		return mac, nil
+	}
+	reply, err := s.redis.do("EVAL", sharedHolderScript, "1", s.key("ip", ip), s.key("lease", ""))
+	b, ok := reply.([]byte)
+	if err == nil && !ok {
+		return "", fmt.Errorf("redis: unexpected reply %v to holder script", reply)
+	}
+	// The address may have been released or reassigned since
+	r, err := activeLease(b, err, now)
+	if err != nil || r == nil || r.IP != ip {
+		return "", err
+	}
+	// Unless this server changed it since
+	if _, ok := s.pendingLease(r.MAC); ok {
+		return "", nil
+	}
+	return r.MAC, nil
+}
+
+// activeLease decodes the lease record b, as returned with err, returning nil
+// if there is none or it is not active at now.
+func activeLease(b []byte, err error, now time.Time) (*leaseRecord, error) {
+	if err == errRedisNil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var r leaseRecord
+	if err := json.Unmarshal(b, &r); err != nil {
+		return nil, fmt.Errorf("invalid lease record: %w", err)
+	}
+	if !r.active(now) {
+		return nil, nil
+	}
+	return &r, nil
+}
+
+// deleteLease queues deleting the record of mac.
+func (s *sharedState) deleteLease(mac string) {
+	pl := s.setPending(mac, nil)
+	queued := s.queue("deletion of lease for "+mac, func() error {
+		defer s.clearPending(mac, pl)
+		return s.redis.del(s.key("lease", mac))
+	})
+	if !queued {
+		s.clearPending(mac, pl)
+	}
+}
+
+// putConflict stores c for sharedConflictTTL.
+func (s *sharedState) putConflict(c conflict) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	return s.redis.set(s.key("conflict", c.IP), b, sharedConflictTTL)
+}
+
+// conflict returns the conflict stored for ip, if any.
+func (s *sharedState) conflict(ip string) (conflict, bool, error) {
+	b, err := s.redis.get(s.key("conflict", ip))
+	if err == errRedisNil {
+		return conflict{}, false, nil
+	}
+	if err != nil {
+		return conflict{}, false, err
+	}
+	var c conflict
+	if err := json.Unmarshal(b, &c); err != nil {
+		return conflict{}, false, fmt.Errorf("invalid conflict record for %s: %w", ip, err)
+	}
+	return c, true, nil
+}
+
+// Close sends the queued writes and closes the connections to the backend.
+func (s *sharedState) Close() {
+	close(s.stop)
+	<-s.stopped
+	s.redis.Close()
+}
+
+// markConflict records that mac found ip to be in use by something else, and
+// shares it with the other servers.
+func (p *PluginState) markConflict(ip, mac string) {
+	conflicts.mark(ip, mac)
+	if p.shared == nil {
+		return
+	}
+	c, _ := conflicts.get(ip)
+	p.shared.queue("conflict on "+ip, func() error { return p.shared.putConflict(c) })
+}
+
+// conflictFor returns the conflict recorded for ip by this server or, if state
+// is shared, by another one.
+func (p *PluginState) conflictFor(ip string) (conflict, bool) {
+	if c, ok := conflicts.get(ip); ok || p.shared == nil {
+		return c, ok
+	}
+	c, ok, err := p.shared.conflict(ip)
+	if err != nil {
+		log.Errorf("failed to get shared conflict on %s: %v", ip, err)
+	}
+	return c, ok
+}
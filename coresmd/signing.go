@@ -0,0 +1,70 @@
+package coresmd
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const defaultBootScriptURLTTL = 5 * time.Minute
+
+// SignBootScriptURL adds a timestamp (ts) and an HMAC-SHA256 signature (sig)
+// of the mac query parameter and the timestamp to u, so that the boot script
+// endpoint can verify that the request comes from a client that was given the
+// URL by coresmd. See VerifyBootScriptQuery.
+func SignBootScriptURL(u *url.URL, key []byte, now time.Time) {
+	mac := u.Query().Get("mac")
+	ts := strconv.FormatInt(now.Unix(), 10)
+	if u.RawQuery != "" {
+		u.RawQuery += "&"
+	}
+	u.RawQuery += "ts=" + ts + "&sig=" + bootScriptSignature(key, mac, ts)
+}
+
+// VerifyBootScriptQuery returns an error unless query holds a signature made
+// by SignBootScriptURL with key no longer than ttl before now.
+func VerifyBootScriptQuery(query url.Values, key []byte, ttl time.Duration, now time.Time) error {
+	mac, ts, sig := query.Get("mac"), query.Get("ts"), query.Get("sig")
+	if ts == "" || sig == "" {
+		return errors.New("boot script URL is not signed")
+	}
+	if !hmac.Equal([]byte(sig), []byte(bootScriptSignature(key, mac, ts))) {
+		return errors.New("invalid boot script URL signature")
+	}
+	unix, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid boot script URL timestamp: %w", err)
+	}
+	if age := now.Sub(time.Unix(unix, 0)); age > ttl {
+		return fmt.Errorf("boot script URL expired %s ago", (age - ttl).Round(time.Second))
+	}
+
+	return nil
+}
+
+func bootScriptSignature(key []byte, mac, ts string) string {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(mac + "\n" + ts))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// readSigningKey reads the key used to sign boot script URLs from path.
+func readSigningKey(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	key := strings.TrimSpace(string(data))
+	if len(key) < 16 {
+		return nil, errors.New("signing key must be at least 16 characters long")
+	}
+
+	return []byte(key), nil
+}
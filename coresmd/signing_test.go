@@ -0,0 +1,50 @@
+package coresmd
+
+import (
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestVerifyBootScriptQuery(t *testing.T) {
+	key := []byte("0123456789abcdef")
+	now := time.Unix(1700000000, 0)
+	base, _ := url.Parse("http://bss.example/boot/v1")
+	signed := BootScriptURL(base, "aa:bb:cc:dd:ee:01")
+	SignBootScriptURL(signed, key, now)
+
+	tamper := func(k, v string) url.Values {
+		q := signed.Query()
+		q.Set(k, v)
+		return q
+	}
+	unsigned := signed.Query()
+	unsigned.Del("sig")
+
+	tests := []struct {
+		name  string
+		query url.Values
+		key   []byte
+		now   time.Time
+		ok    bool
+	}{
+		{"valid", signed.Query(), key, now, true},
+		{"within ttl", signed.Query(), key, now.Add(time.Minute), true},
+		{"expired", signed.Query(), key, now.Add(2 * time.Minute), false},
+		{"wrong key", signed.Query(), []byte("fedcba9876543210"), now, false},
+		{"other mac", tamper("mac", "aa:bb:cc:dd:ee:02"), key, now, false},
+		{"other timestamp", tamper("ts", "1700000060"), key, now, false},
+		{"unsigned", unsigned, key, now, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := VerifyBootScriptQuery(tt.query, tt.key, time.Minute, tt.now)
+			if tt.ok && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !tt.ok && err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
@@ -1,104 +1,100 @@
 package coresmd
 
 import (
-	"crypto/tls"
-	"crypto/x509"
-	"fmt"
-	"io/ioutil"
-	"net/http"
 	"net/url"
-	"os"
-	"time"
+
+	"github.com/OpenCHAMI/coresmd/pkg/cache"
+	"github.com/OpenCHAMI/coresmd/pkg/smdclient"
+)
+
+// The SMD client and cache live in pkg/smdclient and pkg/cache so that other
+// tools can reuse them. They are aliased here so that the plugin, and code
+// written against earlier versions of this package, can keep using them from
+// the coresmd package.
+
+type (
+	SmdClient             = smdclient.SmdClient
+	HTTPSmdClient         = smdclient.HTTPSmdClient
+	SmdTLSConfig          = smdclient.SmdTLSConfig
+	SmdHTTPConfig         = smdclient.SmdHTTPConfig
+	FakeSmdClient         = smdclient.FakeSmdClient
+	EthernetInterface     = smdclient.EthernetInterface
+	Component             = smdclient.Component
+	BootOverrides         = smdclient.BootOverrides
+	RedfishEndpoint       = smdclient.RedfishEndpoint
+	RedfishEndpointClient = smdclient.RedfishEndpointClient
+	Members               = smdclient.Members
+	Group                 = smdclient.Group
+	Partition             = smdclient.Partition
+	GroupClient           = smdclient.GroupClient
+
+	Cache        = cache.Cache
+	RefreshStats = cache.RefreshStats
+	Snapshot     = cache.Snapshot
+	SnapshotDiff = cache.SnapshotDiff
+	DiffLogging  = cache.DiffLogging
+	IfaceInfo    = cache.IfaceInfo
 )
 
-var (
-	defaultTlsHandshakeTimeout   = 120 * time.Second
-	defaultResponseHeaderTimeout = 120 * time.Second
+const (
+	SmdAPIAuto = smdclient.SmdAPIAuto
+	SmdAPIv2   = smdclient.SmdAPIv2
+	SmdAPIv1   = smdclient.SmdAPIv1
+
+	DiffSummary = cache.DiffSummary
+	DiffDetail  = cache.DiffDetail
+	DiffOff     = cache.DiffOff
 )
 
-type SmdClient struct {
-	*http.Client
-	BaseURL *url.URL
+// ErrCircuitOpen is returned by HTTPSmdClient instead of querying SMD while
+// its circuit breaker is open.
+var ErrCircuitOpen = smdclient.ErrCircuitOpen
+
+// Startup modes, which set what setup does when the first cache refresh
+// fails.
+const (
+	// startupServe starts anyway, serving from the snapshot file if one is
+	// set and readable or with an empty cache otherwise, and keeps retrying
+	// in the background.
+	startupServe = "serve"
+	// startupStrict fails setup.
+	startupStrict = "strict"
+)
+
+func init() {
+	smdclient.SetLogger(log)
+	cache.SetLogger(log)
 }
 
-type EthernetInterface struct {
-	MACAddress  string `json:"MACAddress"`
-	ComponentID string `json:"ComponentID"`
-	Type        string `json:"Type"`
-	Description string `json:"Description"`
-	IPAddresses []struct {
-		IPAddress string `json:"IPAddress"`
-	} `json:"IPAddresses"`
+// NewSmdClient returns a client of the SMD API at baseURL (see
+// smdclient.NewSmdClient).
+func NewSmdClient(baseURL *url.URL) *HTTPSmdClient {
+	return smdclient.NewSmdClient(baseURL)
 }
 
-type Component struct {
-	ID   string `json:"ID"`
-	NID  int64  `json:"NID"`
-	Type string `json:"Type"`
+// DefaultSmdHTTPConfig returns the HTTP client settings used by NewSmdClient.
+func DefaultSmdHTTPConfig() SmdHTTPConfig {
+	return smdclient.DefaultSmdHTTPConfig()
 }
 
-func NewSmdClient(baseURL *url.URL) *SmdClient {
-	s := &SmdClient{
-		BaseURL: baseURL,
-		Client:  &http.Client{},
-	}
+// NewFakeSmdClient returns a FakeSmdClient holding eis and comps.
+func NewFakeSmdClient(eis []EthernetInterface, comps []Component) *FakeSmdClient {
+	return smdclient.NewFakeSmdClient(eis, comps)
+}
 
-	return s
+// NewCache returns a cache of the data fetched by client every duration (see
+// cache.NewCache).
+func NewCache(duration string, client SmdClient) (*Cache, error) {
+	return cache.NewCache(duration, client)
 }
 
-func (sc *SmdClient) UseCACert(path string) error {
-	cacert, err := os.ReadFile(path)
-	if err != nil {
-		return fmt.Errorf("failed to read CA certificate: %w", err)
-	}
-
-	certPool := x509.NewCertPool()
-	certPool.AppendCertsFromPEM(cacert)
-
-	if sc == nil {
-		return fmt.Errorf("SmdClient is nil")
-	}
-	if sc.Client == nil {
-		return fmt.Errorf("SmdClient's HTTP client is nil")
-	}
-
-	(*sc).Transport = &http.Transport{
-		TLSClientConfig: &tls.Config{
-			RootCAs:            certPool,
-			InsecureSkipVerify: false,
-		},
-		DisableKeepAlives:     true,
-		TLSHandshakeTimeout:   defaultTlsHandshakeTimeout,
-		ResponseHeaderTimeout: defaultResponseHeaderTimeout,
-	}
-
-	return nil
+// NormalizeMAC returns mac in the canonical form used for cache keys and
+// lookups (see cache.NormalizeMAC).
+func NormalizeMAC(mac string) (string, error) {
+	return cache.NormalizeMAC(mac)
 }
 
-func (sc *SmdClient) APIGet(path string) ([]byte, error) {
-	endpoint := sc.BaseURL.JoinPath(path)
-	req, err := http.NewRequest("GET", endpoint.String(), nil)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %w", err)
-	}
-
-	if sc == nil {
-		return nil, fmt.Errorf("SmdClient is nil")
-	}
-	if sc.Client == nil {
-		return nil, fmt.Errorf("SmdClient's HTTP client is nil")
-	}
-
-	resp, err := sc.Client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("failed to execute HTTP request: %w", err)
-	}
-	defer resp.Body.Close()
-
-	data, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body: %w", err)
-	}
-
-	return data, nil
+// ParseDiffLogging parses "summary", "detail", or "off".
+func ParseDiffLogging(s string) (DiffLogging, error) {
+	return cache.ParseDiffLogging(s)
 }
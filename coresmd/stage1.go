@@ -0,0 +1,130 @@
+package coresmd
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/OpenCHAMI/coresmd/internal/ipxe"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+const (
+	// stage1Path is the path at which the built-in HTTP server serves
+	// generated stage-1 scripts.
+	stage1Path = "/stage1"
+
+	defaultStage1Retries = 3
+	defaultStage1Timeout = 30 * time.Second
+	// stage1Delay is the delay in seconds before the first retry of a
+	// target, doubling with each further retry.
+	stage1Delay = 5
+)
+
+// stage1Config configures the scripts served to iPXE clients instead of their
+// boot script URL, which retry and fall back to other targets when the boot
+// script cannot be fetched.
+type stage1Config struct {
+	retries int
+	timeout time.Duration
+	// fallbacks are the URLs, "exit" or "reboot" tried in order once the
+	// boot script fails.
+	fallbacks []string
+}
+
+// parseStage1Fallbacks parses a comma-separated list of fallback targets:
+// http(s) or tftp URLs, "exit" or "reboot".
+func parseStage1Fallbacks(val string) ([]string, error) {
+	fallbacks := strings.Split(val, ",")
+	for _, f := range fallbacks {
+		if f == "exit" || f == "reboot" {
+			continue
+		}
+		u, err := url.Parse(f)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "tftp") || u.Host == "" {
+			return nil, fmt.Errorf("invalid fallback %q: expected an http(s) or tftp URL, exit or reboot", f)
+		}
+	}
+	return fallbacks, nil
+}
+
+// stage1URL returns the URL of the stage-1 script served by the built-in HTTP
+// server to the client with the given MAC address and architecture.
+func stage1URL(httpURL *url.URL, mac, arch string) *url.URL {
+	u := httpURL.JoinPath(stage1Path)
+	q := url.Values{"mac": {mac}}
+	if arch != "" {
+		q.Set("arch", arch)
+	}
+	u.RawQuery = q.Encode()
+	return u
+}
+
+// serveStage1Script serves the stage-1 script of the node whose MAC address is
+// given in the mac query parameter: it chains to the node's boot script URL,
+// retrying and then falling back to stage1_fallbacks if it cannot be fetched.
+func (p *PluginState) serveStage1Script(w http.ResponseWriter, r *http.Request) {
+	cfg := p.config.Load()
+	if cfg.stage1 == nil {
+		http.NotFound(w, r)
+		return
+	}
+	query := r.URL.Query()
+	if cfg.bootScriptKey != nil {
+		if err := VerifyBootScriptQuery(query, cfg.bootScriptKey, cfg.bootScriptTTL, time.Now()); err != nil {
+			log.Warnf("http: refusing stage-1 script request from %s: %v", remoteIP(r), err)
+			http.Error(w, err.Error(), http.StatusForbidden)
+			return
+		}
+	}
+	mac, err := NormalizeMAC(query.Get("mac"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	params := BootScriptParams{MAC: mac}
+	var archs []iana.Arch
+	if a := query.Get("arch"); a != "" {
+		n, err := strconv.ParseUint(a, 10, 16)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid arch %q", a), http.StatusBadRequest)
+			return
+		}
+		params.Arch = a
+		archs = []iana.Arch{iana.Arch(n)}
+	}
+
+	var comp Component
+	snapshot := p.cache.Snapshot()
+	if ei, ok := snapshot.EthernetInterfaces[mac]; ok {
+		comp = snapshot.Components[ei.ComponentID]
+		params.Xname, params.NID = comp.ID, comp.NID
+	}
+	base := cfg.bootScriptBase(archs, comp.Role, comp.SubRole)
+	bssURL, err := cfg.bootScriptPath.URL(base, params)
+	if err != nil {
+		log.Errorf("http: unable to build boot script URL for %s: %v", mac, err)
+		http.Error(w, "unable to build boot script URL", http.StatusInternalServerError)
+		return
+	}
+	if cfg.bootScriptKey != nil {
+		SignBootScriptURL(bssURL, cfg.bootScriptKey, time.Now())
+	}
+
+	targets := append([]string{bssURL.String()}, cfg.stage1.fallbacks...)
+	script, err := ipxe.Stage1Script(targets, cfg.stage1.retries, cfg.stage1.timeout, stage1Delay)
+	if err != nil {
+		log.Errorf("http: unable to generate stage-1 script for %s: %v", mac, err)
+		http.Error(w, "unable to generate stage-1 script", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	if _, err := w.Write([]byte(script)); err != nil {
+		log.Errorf("http: failed to send stage-1 script to %s: %v", remoteIP(r), err)
+		return
+	}
+	log.Infof("http: sent stage-1 script chaining %s to %s", remoteIP(r), bssURL)
+}
@@ -0,0 +1,66 @@
+package coresmd
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/OpenCHAMI/coresmd/internal/ipxe"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/insomniacslk/dhcp/iana"
+)
+
+func TestStage1Script(t *testing.T) {
+	p := setupHandler(t)
+	cfg := p.config.Load()
+	cfg.httpURL, _ = url.Parse("http://10.0.0.1:8080")
+	fallbacks, err := parseStage1Fallbacks("http://172.16.0.252:8081/boot/v1/bootscript,exit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.stage1 = &stage1Config{retries: 2, timeout: 10 * time.Second, fallbacks: fallbacks}
+
+	// iPXE clients are pointed at the built-in HTTP server
+	req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", withArch(iana.EFI_X86_64), withIPXE())
+	got, _ := p.Handler4(req, resp)
+	bf := got.BootFileNameOption()
+	if bf != "http://10.0.0.1:8080/stage1?arch=7&mac=aa%3Abb%3Acc%3Add%3Aee%3A01" {
+		t.Fatalf("boot file = %q", bf)
+	}
+
+	// The script chains to the boot script, then to the fallbacks
+	w := httptest.NewRecorder()
+	p.serveStage1Script(w, httptest.NewRequest(http.MethodGet, strings.TrimPrefix(bf, "http://10.0.0.1:8080"), nil))
+	body, _ := io.ReadAll(w.Result().Body)
+	script := string(body)
+	for _, want := range []string{
+		"chain --autofree --timeout 10000 http://172.16.0.253:8081/boot/v1/bootscript?mac=aa:bb:cc:dd:ee:01 && goto done ||",
+		"iseq ${attempt} 2 && goto target1 ||",
+		"chain --autofree --timeout 10000 http://172.16.0.252:8081/boot/v1/bootscript && goto done ||",
+		":target2\necho Exiting to the next boot device...\nexit\n",
+		":failed\n",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("stage-1 script does not contain %q:\n%s", want, script)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	p.serveStage1Script(w, httptest.NewRequest(http.MethodGet, "/stage1?mac=aa:bb:cc:dd:ee:01&arch=x86", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("invalid arch: got status %d", w.Code)
+	}
+
+	for _, val := range []string{"ftp://host/script", "/bootscript", "exit,bss"} {
+		if _, err := parseStage1Fallbacks(val); err == nil {
+			t.Errorf("%q accepted", val)
+		}
+	}
+	if _, err := ipxe.Stage1Script(nil, 1, time.Second, 1); err == nil {
+		t.Error("script without targets generated")
+	}
+}
@@ -0,0 +1,181 @@
+package coresmd
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"gopkg.in/yaml.v3"
+)
+
+// staticEntry is what the overrides file sets for one client. Every field is
+// optional for clients in SMD, for which it replaces what SMD says; clients
+// not in SMD need an IP address.
+type staticEntry struct {
+	IP       net.IP
+	Hostname string
+	Bootfile string
+	// Options are raw DHCP options sent last, replacing any set otherwise
+	Options map[uint8][]byte
+	// Rescue is the image to boot the client with instead of its boot
+	// script, if it is in rescue boot
+	Rescue *rescueImage
+}
+
+// staticEntryFile is a staticEntry as written in the overrides file. Option
+// values are sent as text, or as bytes if prefixed with "hex:".
+type staticEntryFile struct {
+	IP       string           `yaml:"ip"`
+	Hostname string           `yaml:"hostname"`
+	Bootfile string           `yaml:"bootfile"`
+	Options  map[uint8]string `yaml:"options"`
+	Rescue   *rescueImage     `yaml:"rescue"`
+	Extra    map[string]any   `yaml:",inline"`
+}
+
+// staticOverrides are per-MAC settings from a local file, merged over the SMD
+// data with higher precedence, for emergency fixes and for devices that will
+// never be in SMD (switches, PDUs). The file is re-read when it changes. It is
+// safe for concurrent use.
+type staticOverrides struct {
+	path string
+
+	entries atomic.Pointer[map[string]staticEntry]
+	// mu serializes reloads; modTime is the modification time of the file
+	// when it was last read
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+// loadStaticOverrides reads the overrides file at path.
+func loadStaticOverrides(path string) (*staticOverrides, error) {
+	so := &staticOverrides{path: path}
+	if err := so.load(); err != nil {
+		return nil, err
+	}
+	return so, nil
+}
+
+// lookup returns the entry for mac, in normalized form. A nil staticOverrides
+// has no entries.
+func (so *staticOverrides) lookup(mac string) (staticEntry, bool) {
+	if so == nil {
+		return staticEntry{}, false
+	}
+	e, ok := (*so.entries.Load())[mac]
+	return e, ok
+}
+
+// load reads the file if it changed since it was last read.
+func (so *staticOverrides) load() error {
+	so.mu.Lock()
+	defer so.mu.Unlock()
+
+	fi, err := os.Stat(so.path)
+	if err != nil {
+		return fmt.Errorf("failed to read overrides file: %w", err)
+	}
+	if so.entries.Load() != nil && fi.ModTime().Equal(so.modTime) {
+		return nil
+	}
+	data, err := os.ReadFile(so.path)
+	if err != nil {
+		return fmt.Errorf("failed to read overrides file: %w", err)
+	}
+	entries, err := parseStaticOverrides(data)
+	if err != nil {
+		return fmt.Errorf("invalid overrides file %s: %w", so.path, err)
+	}
+	if so.entries.Swap(&entries) != nil {
+		log.Infof("reloaded overrides file %s with %d entries", so.path, len(entries))
+	}
+	so.modTime = fi.ModTime()
+
+	return nil
+}
+
+// parseStaticOverrides parses an overrides file: a YAML map of MAC addresses
+// to entries.
+func parseStaticOverrides(data []byte) (map[string]staticEntry, error) {
+	var file map[string]staticEntryFile
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	entries := make(map[string]staticEntry, len(file))
+	for key, ef := range file {
+		mac, err := NormalizeMAC(key)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := entries[mac]; ok {
+			return nil, fmt.Errorf("hardware address %s is listed more than once", mac)
+		}
+		if len(ef.Extra) > 0 {
+			return nil, fmt.Errorf("%s: unknown setting %q", mac, firstKey(ef.Extra))
+		}
+		e := staticEntry{Hostname: ef.Hostname, Bootfile: ef.Bootfile, Rescue: ef.Rescue}
+		if ef.IP != "" {
+			if e.IP = net.ParseIP(ef.IP).To4(); e.IP == nil {
+				return nil, fmt.Errorf("%s: invalid IPv4 address %q", mac, ef.IP)
+			}
+		}
+		for code, val := range ef.Options {
+			if code == 0 || code == 255 {
+				return nil, fmt.Errorf("%s: invalid option code %d", mac, code)
+			}
+			b := []byte(val)
+			if h, ok := strings.CutPrefix(val, "hex:"); ok {
+				if b, err = hex.DecodeString(h); err != nil {
+					return nil, fmt.Errorf("%s: invalid hex value of option %d: %w", mac, code, err)
+				}
+			}
+			if e.Options == nil {
+				e.Options = make(map[uint8][]byte)
+			}
+			e.Options[code] = b
+		}
+		entries[mac] = e
+	}
+
+	return entries, nil
+}
+
+func firstKey(m map[string]any) string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys[0]
+}
+
+// ifaceInfo returns the lookup result for a client that is only in the
+// overrides file.
+func (e staticEntry) ifaceInfo(mac string) IfaceInfo {
+	return IfaceInfo{MAC: mac, IPList: []net.IP{e.IP}}
+}
+
+// applyOptions sets the entry's raw options in resp, returning them for the
+// trace.
+func (e staticEntry) applyOptions(resp *dhcpv4.DHCPv4) string {
+	codes := make([]int, 0, len(e.Options))
+	for code := range e.Options {
+		codes = append(codes, int(code))
+	}
+	sort.Ints(codes)
+	var set []string
+	for _, code := range codes {
+		val := e.Options[uint8(code)]
+		resp.Options.Update(dhcpv4.OptGeneric(dhcpv4.GenericOptionCode(code), val))
+		set = append(set, fmt.Sprintf("%d=%x", code, val))
+	}
+	return strings.Join(set, " ")
+}
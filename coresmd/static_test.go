@@ -0,0 +1,99 @@
+package coresmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+const testOverrides = `
+"AA-BB-CC-DD-EE-01":
+  ip: 172.16.0.99
+  hostname: fixed-node
+"de:ad:be:ef:00:01":
+  ip: 172.16.0.200
+  hostname: leaf-switch-01
+  bootfile: http://172.16.0.253/onie-installer
+  options:
+    43: hex:0104c0a80001
+    252: http://172.16.0.253/wpad.dat
+"de:ad:be:ef:00:02":
+  ip: 172.16.0.201
+`
+
+func TestParseStaticOverrides(t *testing.T) {
+	entries, err := parseStaticOverrides([]byte(testOverrides))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, ok := entries["de:ad:be:ef:00:01"]
+	if !ok {
+		t.Fatal("entry not keyed by normalized MAC")
+	}
+	if string(e.Options[252]) != "http://172.16.0.253/wpad.dat" || string(e.Options[43]) != "\x01\x04\xc0\xa8\x00\x01" {
+		t.Errorf("options = %q", e.Options)
+	}
+
+	for name, data := range map[string]string{
+		"bad MAC":        "nope:\n  ip: 10.0.0.1\n",
+		"bad IP":         "aa:bb:cc:dd:ee:01:\n  ip: 10.0.0\n",
+		"unknown key":    "aa:bb:cc:dd:ee:01:\n  addr: 10.0.0.1\n",
+		"bad hex":        "aa:bb:cc:dd:ee:01:\n  options:\n    43: hex:zz\n",
+		"duplicate MACs": "aa:bb:cc:dd:ee:01: {}\nAA:BB:CC:DD:EE:01: {}\n",
+	} {
+		if _, err := parseStaticOverrides([]byte(data)); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestHandler4StaticOverrides(t *testing.T) {
+	p := setupHandler(t)
+	path := filepath.Join(t.TempDir(), "overrides.yaml")
+	if err := os.WriteFile(path, []byte(testOverrides), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := *p.config.Load()
+	var err error
+	if cfg.static, err = loadStaticOverrides(path); err != nil {
+		t.Fatal(err)
+	}
+	p.config.Store(&cfg)
+
+	// In SMD: the overrides take precedence
+	req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", withArch(0), withIPXE())
+	out, stop := p.Handler4(req, resp)
+	if !stop || out == nil {
+		t.Fatal("client in SMD not handled")
+	}
+	if got := out.YourIPAddr.String(); got != "172.16.0.99" {
+		t.Errorf("yiaddr = %s, want address from overrides file", got)
+	}
+	if got := out.HostName(); got != "fixed-node" {
+		t.Errorf("hostname = %q, want fixed-node", got)
+	}
+
+	// Not in SMD: served from the overrides file alone
+	req, resp = newRequest(t, dhcpv4.MessageTypeDiscover, "de:ad:be:ef:00:01")
+	out, stop = p.Handler4(req, resp)
+	if !stop || out == nil {
+		t.Fatal("client only in overrides file not handled")
+	}
+	if got := out.YourIPAddr.String(); got != "172.16.0.200" {
+		t.Errorf("yiaddr = %s, want 172.16.0.200", got)
+	}
+	if got := out.BootFileNameOption(); got != "http://172.16.0.253/onie-installer" {
+		t.Errorf("bootfile = %q", got)
+	}
+	if got := out.Options.Get(dhcpv4.GenericOptionCode(252)); string(got) != "http://172.16.0.253/wpad.dat" {
+		t.Errorf("option 252 = %q", got)
+	}
+
+	req, resp = newRequest(t, dhcpv4.MessageTypeDiscover, "de:ad:be:ef:00:02")
+	out, _ = p.Handler4(req, resp)
+	if out == nil || out.BootFileNameOption() != "" {
+		t.Errorf("client only in overrides file without bootfile was sent a boot file")
+	}
+}
@@ -1,19 +1,53 @@
 package coresmd
 
 import (
+	"bytes"
 	"io"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 
+	"github.com/OpenCHAMI/coresmd/internal/ipxe"
+	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/pin/tftp"
 )
 
-const defaultScriptName = "default"
+const (
+	defaultScriptName = "default"
+	exitScriptName    = "exit"
+	tftpDirectory     = "/tftpboot"
+)
 
 var defaultScript = `#!ipxe
 reboot
 `
 
+// exitScript makes iPXE give up and return to the firmware, which moves on to
+// the next boot device.
+var exitScript = `#!ipxe
+exit
+`
+
+// builtinScripts are the scripts served over TFTP and HTTP by name without
+// needing to exist in the served directory.
+var builtinScripts = map[string]string{
+	defaultScriptName:   defaultScript,
+	exitScriptName:      exitScript,
+	chainLoopScriptName: chainLoopScript,
+}
+
+// builtinScriptBootfile returns the boot file name pointing at the built-in
+// script with the given name: a URL on the HTTP server if there is one, and a
+// TFTP path otherwise.
+func (cfg *pluginConfig) builtinScriptBootfile(name string) string {
+	if cfg.httpURL != nil {
+		return cfg.httpURL.JoinPath(name).String()
+	}
+	return name
+}
+
 type ScriptReader struct{}
 
 func (sr ScriptReader) Read(b []byte) (int, error) {
@@ -21,15 +55,66 @@ func (sr ScriptReader) Read(b []byte) (int, error) {
 	return nBytes, io.EOF
 }
 
-func startTFTPServer(directory string) {
-	s := tftp.NewServer(readHandler(directory), nil)
-	err := s.ListenAndServe(":69") // default TFTP port
+// startTFTPServer serves directory and the embedded iPXE binaries over TFTP
+// and returns a function that shuts down the server.
+func startTFTPServer(directory string, binaries map[string]ipxe.Binary) (func(), error) {
+	addr, err := net.ResolveUDPAddr("udp", ":69") // default TFTP port
 	if err != nil {
-		log.Fatalf("failed to start TFTP server: %v", err)
+		return nil, err
 	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	s := tftp.NewServer(readHandler(directory, binaries), nil)
+	go s.Serve(conn)
+
+	return s.Shutdown, nil
 }
 
-func readHandler(directory string) func(string, io.ReaderFrom) error {
+var (
+	// tftpMu guards the TFTP server shared by all plugin instances, since
+	// only one can listen on the TFTP port.
+	tftpMu    sync.Mutex
+	tftpUsers int
+	stopTFTP  func()
+)
+
+// acquireTFTPServer starts the shared TFTP server if no plugin instance is
+// using it yet and returns a function releasing it. The server is shut down
+// once every instance has released it.
+func acquireTFTPServer(binaries map[string]ipxe.Binary) (func(), error) {
+	tftpMu.Lock()
+	defer tftpMu.Unlock()
+
+	if tftpUsers == 0 {
+		log.Infof("starting TFTP server on port 69 with directory %s", tftpDirectory)
+		if len(binaries) > 0 {
+			log.Infof("serving embedded iPXE binaries instead of those in %s: %s", tftpDirectory, ipxe.BinaryList(binaries))
+		}
+		stop, err := startTFTPServer(tftpDirectory, binaries)
+		if err != nil {
+			return nil, err
+		}
+		stopTFTP = stop
+	}
+	tftpUsers++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			tftpMu.Lock()
+			defer tftpMu.Unlock()
+			tftpUsers--
+			if tftpUsers == 0 {
+				stopTFTP()
+				stopTFTP = nil
+			}
+		})
+	}, nil
+}
+
+func readHandler(directory string, binaries map[string]ipxe.Binary) func(string, io.ReaderFrom) error {
 	return func(filename string, rf io.ReaderFrom) error {
 		var raddr string
 		ot, ok := rf.(tftp.OutgoingTransfer)
@@ -41,11 +126,20 @@ func readHandler(directory string) func(string, io.ReaderFrom) error {
 			raptr := &ra
 			raddr = raptr.IP.String()
 		}
-		if filename == defaultScriptName {
-			log.Infof("tftp: %s requested default script")
-			var sr ScriptReader
-			nbytes, err := rf.ReadFrom(sr)
-			log.Infof("tftp: sent %d bytes of default script to %s", nbytes, raddr)
+		if script, ok := builtinScripts[filename]; ok {
+			log.Infof("tftp: %s requested %s script", raddr, filename)
+			nbytes, err := rf.ReadFrom(strings.NewReader(script))
+			log.Infof("tftp: sent %d bytes of %s script to %s", nbytes, filename, raddr)
+			return err
+		}
+		if stub, ok := tftpGrubStub(filename); ok {
+			nbytes, err := rf.ReadFrom(strings.NewReader(stub))
+			log.Infof("tftp: sent %d bytes of GRUB config stub %s to %s", nbytes, filename, raddr)
+			return err
+		}
+		if b, ok := binaries[filename]; ok {
+			nbytes, err := rf.ReadFrom(bytes.NewReader(b.Data))
+			log.Infof("tftp: sent %d bytes of embedded iPXE %s version %s (sha256 %s) to %s", nbytes, filename, b.Version, b.SHA256, raddr)
 			return err
 		}
 		log.Infof("tftp: %s requested file %s", raddr, filename)
@@ -61,3 +155,21 @@ func readHandler(directory string) func(string, io.ReaderFrom) error {
 		return err
 	}
 }
+
+// tftpServerFor returns the configured TFTP server address for a client being
+// assigned ip, or nil if none is configured. The network profile for ip takes
+// precedence, then tftp_server_subnets, where relayed requests are matched by
+// their link address and others by the assigned IP.
+func (cfg *pluginConfig) tftpServerFor(req *dhcpv4.DHCPv4, ip net.IP) net.IP {
+	if n := cfg.networkFor(ip); n != nil && n.tftpServer != nil {
+		return n.tftpServer
+	}
+	match := subnetMatchIP(req, ip)
+	for _, s := range cfg.tftpServerSubnets {
+		if s.subnet.Contains(match) {
+			return s.ip
+		}
+	}
+
+	return cfg.tftpServer
+}
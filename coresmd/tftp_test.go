@@ -0,0 +1,64 @@
+package coresmd
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"testing/fstest"
+
+	"github.com/OpenCHAMI/coresmd/internal/ipxe"
+)
+
+func TestLoadBinaries(t *testing.T) {
+	sum := sha256.Sum256([]byte("ipxe"))
+	checksum := hex.EncodeToString(sum[:])
+	fsys := fstest.MapFS{
+		"bin/MANIFEST":        {Data: []byte("# comment\n" + checksum + "  ipxe-x86_64.efi  v1.21.1\n")},
+		"bin/ipxe-x86_64.efi": {Data: []byte("ipxe")},
+	}
+	binaries, err := ipxe.LoadBinaries(fsys, "bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, ok := binaries["ipxe-x86_64.efi"]
+	if !ok || b.Version != "v1.21.1" || b.SHA256 != checksum || string(b.Data) != "ipxe" {
+		t.Errorf("got %+v", binaries)
+	}
+
+	// Binaries that do not match their checksum, or are missing, are
+	// refused
+	fsys["bin/ipxe-x86_64.efi"] = &fstest.MapFile{Data: []byte("drifted")}
+	if _, err := ipxe.LoadBinaries(fsys, "bin"); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Errorf("got error %v for mismatched checksum", err)
+	}
+	delete(fsys, "bin/ipxe-x86_64.efi")
+	if _, err := ipxe.LoadBinaries(fsys, "bin"); err == nil {
+		t.Error("missing binary accepted")
+	}
+
+	// The binaries built into coresmd match their manifest
+	if _, err := ipxe.EmbeddedBinaries(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestTFTPEmbeddedBinaries(t *testing.T) {
+	dir := t.TempDir()
+	binaries := map[string]ipxe.Binary{
+		"ipxe-x86_64.efi": {Name: "ipxe-x86_64.efi", Version: "v1.21.1", Data: []byte("embedded")},
+	}
+	read := readHandler(dir, binaries)
+
+	var buf bytes.Buffer
+	if err := read("ipxe-x86_64.efi", &buf); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != "embedded" {
+		t.Errorf("got %q, want embedded binary", buf.String())
+	}
+	if err := read("snponly-x86_64.efi", &buf); err == nil {
+		t.Error("served a file that is neither embedded nor in the directory")
+	}
+}
@@ -0,0 +1,89 @@
+package coresmd
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	// The container image may not ship a time zone database
+	_ "time/tzdata"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+var (
+	// optionPOSIXTimezone is the POSIX TZ string option (RFC 4833).
+	optionPOSIXTimezone = dhcpv4.GenericOptionCode(100)
+	// optionTZDBTimezone is the TZ database name option (RFC 4833).
+	optionTZDBTimezone = dhcpv4.GenericOptionCode(101)
+)
+
+// timeSettings are the NTP servers (option 42) and time zone given to clients.
+// The time zone is sent as its TZ database name (option 101), its POSIX TZ
+// string (option 100), if known, and its current offset from UTC (option 2).
+// Unset fields are not sent.
+type timeSettings struct {
+	ntp      []net.IP
+	location *time.Location
+	posixTZ  string
+}
+
+// apply sets the options for ts in resp, computing the time offset at now,
+// and returns a description of what it set, or "" if nothing.
+func (ts timeSettings) apply(resp *dhcpv4.DHCPv4, now time.Time) string {
+	var set []string
+	if ts.ntp != nil {
+		resp.Options.Update(dhcpv4.OptNTPServers(ts.ntp...))
+		set = append(set, "ntp "+joinIPs(ts.ntp))
+	}
+	if ts.location != nil {
+		_, offset := now.In(ts.location).Zone()
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(int32(offset)))
+		resp.Options.Update(dhcpv4.OptGeneric(dhcpv4.OptionTimeOffset, b))
+		resp.Options.Update(dhcpv4.OptGeneric(optionTZDBTimezone, []byte(ts.location.String())))
+		set = append(set, fmt.Sprintf("timezone %s (offset %ds)", ts.location, offset))
+	}
+	if ts.posixTZ != "" {
+		resp.Options.Update(dhcpv4.OptGeneric(optionPOSIXTimezone, []byte(ts.posixTZ)))
+		set = append(set, "posix timezone "+ts.posixTZ)
+	}
+	return strings.Join(set, ", ")
+}
+
+// nodeTimeSettings returns the time settings from the "ntp_servers" and
+// "timezone" properties of the Component owning ii. Settings it does not have
+// are left unset.
+func nodeTimeSettings(ii IfaceInfo) (timeSettings, error) {
+	var ts timeSettings
+	if ii.Overrides.NTPServers != "" {
+		ips, err := parseNTPServers(ii.Overrides.NTPServers)
+		if err != nil {
+			return ts, fmt.Errorf("invalid ntp_servers property of Component %s: %w", ii.CompID, err)
+		}
+		ts.ntp = ips
+	}
+	if ii.Overrides.Timezone != "" {
+		loc, err := time.LoadLocation(ii.Overrides.Timezone)
+		if err != nil {
+			return ts, fmt.Errorf("invalid timezone property of Component %s: %w", ii.CompID, err)
+		}
+		ts.location = loc
+	}
+	return ts, nil
+}
+
+// parseNTPServers parses a comma-separated list of NTP server IPv4 addresses.
+func parseNTPServers(val string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, s := range strings.Split(val, ",") {
+		ip := net.ParseIP(strings.TrimSpace(s))
+		if ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q", s)
+		}
+		ips = append(ips, ip.To4())
+	}
+	return ips, nil
+}
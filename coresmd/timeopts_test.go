@@ -0,0 +1,115 @@
+package coresmd
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+func TestTimeSettingsApply(t *testing.T) {
+	loc, err := time.LoadLocation("America/Denver")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := timeSettings{
+		ntp:      []net.IP{net.IPv4(10, 0, 0, 1).To4()},
+		location: loc,
+		posixTZ:  "MST7MDT,M3.2.0,M11.1.0",
+	}
+	resp, err := dhcpv4.New()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// January, so MST at UTC-7
+	ts.apply(resp, time.Date(2024, 1, 15, 12, 0, 0, 0, time.UTC))
+	if ntp := resp.NTPServers(); len(ntp) != 1 || !ntp[0].Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Errorf("NTP servers = %v, want [10.0.0.1]", ntp)
+	}
+	if got := string(resp.Options.Get(optionTZDBTimezone)); got != "America/Denver" {
+		t.Errorf("TZ database name = %q, want America/Denver", got)
+	}
+	if got := string(resp.Options.Get(optionPOSIXTimezone)); got != ts.posixTZ {
+		t.Errorf("POSIX TZ string = %q, want %q", got, ts.posixTZ)
+	}
+	if got := int32(binary.BigEndian.Uint32(resp.Options.Get(dhcpv4.OptionTimeOffset))); got != -7*3600 {
+		t.Errorf("time offset = %d, want %d", got, -7*3600)
+	}
+
+	// An empty timeSettings sets nothing
+	resp, _ = dhcpv4.New()
+	if set := (timeSettings{}).apply(resp, time.Now()); set != "" || len(resp.Options) != 0 {
+		t.Errorf("empty timeSettings set %q", set)
+	}
+}
+
+func TestParseNTPServers(t *testing.T) {
+	ips, err := parseNTPServers("10.0.0.1, 10.0.0.2")
+	if err != nil || len(ips) != 2 {
+		t.Fatalf("parseNTPServers: got %v, %v", ips, err)
+	}
+	for _, val := range []string{"", "ntp.example.com", "10.0.0.1,fd00::1"} {
+		if _, err := parseNTPServers(val); err == nil {
+			t.Errorf("parseNTPServers(%q): expected error", val)
+		}
+	}
+}
+
+func TestHandler4TimeSettings(t *testing.T) {
+	p := setupHandler(t)
+	fake := NewFakeSmdClient(
+		[]EthernetInterface{
+			{
+				MACAddress:  "aa:bb:cc:dd:ee:01",
+				ComponentID: "x3000c0s0b0n0",
+				IPAddresses: []struct {
+					IPAddress string `json:"IPAddress"`
+				}{{IPAddress: "172.16.0.1"}},
+			},
+			{
+				MACAddress:  "aa:bb:cc:dd:ee:02",
+				ComponentID: "x3000c0s1b0n0",
+				IPAddresses: []struct {
+					IPAddress string `json:"IPAddress"`
+				}{{IPAddress: "172.16.0.2"}},
+			},
+		},
+		[]Component{
+			{
+				ID: "x3000c0s0b0n0", NID: 1, Type: "Node",
+				ExtraProperties: BootOverrides{NTPServers: "10.0.0.9", Timezone: "UTC"},
+			},
+			{ID: "x3000c0s1b0n0", NID: 2, Type: "Node"},
+		},
+	)
+	p.cache.Client = fake
+	if err := p.cache.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := p.config.Load()
+	cfg.time = timeSettings{ntp: []net.IP{net.IPv4(10, 0, 0, 1).To4()}, location: loc}
+
+	for _, tt := range []struct {
+		mac, ntp, tz string
+	}{
+		{"aa:bb:cc:dd:ee:01", "10.0.0.9", "UTC"},
+		{"aa:bb:cc:dd:ee:02", "10.0.0.1", "Europe/Berlin"},
+	} {
+		req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, tt.mac)
+		resp, _ = p.Handler4(req, resp)
+		if ntp := resp.NTPServers(); len(ntp) != 1 || ntp[0].String() != tt.ntp {
+			t.Errorf("%s: NTP servers = %v, want [%s]", tt.mac, ntp, tt.ntp)
+		}
+		if got := string(resp.Options.Get(optionTZDBTimezone)); got != tt.tz {
+			t.Errorf("%s: time zone = %q, want %q", tt.mac, got, tt.tz)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package coresmd
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/OpenCHAMI/coresmd/internal/version"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+// tracerShutdownTimeout is how long flushing buffered spans may take on
+// teardown.
+const tracerShutdownTimeout = 5 * time.Second
+
+// tracer returns the tracer creating the spans for requests and SMD calls,
+// which does nothing unless startTracing has installed an exporting tracer
+// provider. It is looked up on every use rather than kept, since a tracer
+// obtained before a provider is replaced keeps using the old one.
+func tracer() oteltrace.Tracer {
+	return otel.Tracer("github.com/OpenCHAMI/coresmd/coresmd")
+}
+
+// startTracing exports spans over OTLP/HTTP to endpoint (e.g.
+// http://otel-collector:4318) and returns a function flushing and stopping the
+// exporter. The tracer provider is process-wide, so the last instance started
+// with otel_endpoint set exports the spans of all instances.
+func startTracing(endpoint string) (func(), error) {
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+	tp := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", "coresmd"),
+			attribute.String("service.version", version.Version),
+		)),
+	)
+	otel.SetTracerProvider(tp)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), tracerShutdownTimeout)
+		defer cancel()
+		if err := tp.Shutdown(ctx); err != nil {
+			log.Errorf("failed to shut down tracer provider: %v", err)
+		}
+	}, nil
+}
+
+// parseOTelEndpoint checks that endpoint is an http or https URL.
+func parseOTelEndpoint(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid otel_endpoint %q: expected an http or https URL", endpoint)
+	}
+	return endpoint, nil
+}
+
+// requestAttributes returns the span attributes identifying req.
+func requestAttributes(req *dhcpv4.DHCPv4) oteltrace.SpanStartOption {
+	return oteltrace.WithAttributes(
+		attribute.String("dhcp.mac", clientKey(req)),
+		attribute.String("dhcp.xid", req.TransactionID.String()),
+		attribute.String("dhcp.message_type", req.MessageType().String()),
+	)
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span oteltrace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
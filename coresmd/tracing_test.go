@@ -0,0 +1,115 @@
+package coresmd
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// recordSpans installs a tracer provider recording the spans ended during the
+// test.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	sr := tracetest.NewSpanRecorder()
+	prev := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)))
+	t.Cleanup(func() { otel.SetTracerProvider(prev) })
+	return sr
+}
+
+func spanAttrs(s sdktrace.ReadOnlySpan) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	for _, kv := range s.Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	return attrs
+}
+
+func TestHandler4Spans(t *testing.T) {
+	sr := recordSpans(t)
+	p := setupHandler(t)
+
+	req, resp := newRequest(t, dhcpv4.MessageTypeDiscover, "aa:bb:cc:dd:ee:01", withArch(0), withIPXE())
+	p.Handler4(req, resp)
+
+	spans := sr.Ended()
+	byName := make(map[string]sdktrace.ReadOnlySpan)
+	for _, s := range spans {
+		byName[s.Name()] = s
+	}
+	handler, ok := byName["coresmd.Handler4"]
+	if !ok {
+		t.Fatalf("no Handler4 span in %d spans", len(spans))
+	}
+	lookup, ok := byName["coresmd.lookupMAC"]
+	if !ok {
+		t.Fatal("no lookupMAC span")
+	}
+	if lookup.Parent().SpanID() != handler.SpanContext().SpanID() {
+		t.Error("lookupMAC span is not a child of the Handler4 span")
+	}
+
+	attrs := spanAttrs(handler)
+	for key, want := range map[attribute.Key]string{
+		"dhcp.mac":          "aa:bb:cc:dd:ee:01",
+		"dhcp.xid":          req.TransactionID.String(),
+		"smd.component_id":  "x3000c0s0b0n0",
+		"coresmd.decision":  "boot_script",
+		"dhcp.message_type": "DISCOVER",
+	} {
+		if got := attrs[key].AsString(); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+	if !attrs["dhcp.handled"].AsBool() {
+		t.Error("dhcp.handled = false, want true")
+	}
+}
+
+func TestSMDGetSpan(t *testing.T) {
+	sr := recordSpans(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	baseURL, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := NewSmdClient(baseURL)
+	if _, err := sc.APIGet(context.Background(), "/hsm/v2/State/Components", nil); err == nil {
+		t.Fatal("expected error for 404 response")
+	}
+
+	spans := sr.Ended()
+	if len(spans) != 1 || spans[0].Name() != "coresmd.smd.get" {
+		t.Fatalf("got %d spans, want one coresmd.smd.get span", len(spans))
+	}
+	if got := spanAttrs(spans[0])["http.response.status_code"].AsInt64(); got != http.StatusNotFound {
+		t.Errorf("status code = %d, want 404", got)
+	}
+	if spans[0].Status().Code.String() != "Error" {
+		t.Errorf("span status = %s, want Error", spans[0].Status().Code)
+	}
+}
+
+func TestParseOTelEndpoint(t *testing.T) {
+	for endpoint, valid := range map[string]bool{
+		"http://otel-collector:4318": true,
+		"https://otel.example.com":   true,
+		"otel-collector:4318":        false,
+		"grpc://otel-collector:4317": false,
+	} {
+		if _, err := parseOTelEndpoint(endpoint); (err == nil) != valid {
+			t.Errorf("parseOTelEndpoint(%q) error = %v, want valid %t", endpoint, err, valid)
+		}
+	}
+}
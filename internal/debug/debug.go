@@ -5,10 +5,19 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// DebugRequest logs a summary of req at debug level. The summary is only built
+// if debug logging is enabled, since it is expensive.
 func DebugRequest(log *logrus.Entry, req *dhcpv4.DHCPv4) {
+	if !log.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		return
+	}
 	log.Debugf("REQUEST: %v", req.Summary())
 }
 
+// DebugResponse logs a summary of resp at debug level, like DebugRequest.
 func DebugResponse(log *logrus.Entry, resp *dhcpv4.DHCPv4) {
+	if !log.Logger.IsLevelEnabled(logrus.DebugLevel) {
+		return
+	}
 	log.Debugf("RESPONSE: %v", resp.Summary())
 }
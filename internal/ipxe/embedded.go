@@ -0,0 +1,89 @@
+package ipxe
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+)
+
+//go:generate go run fetch.go
+
+// bin holds the embedded iPXE binaries and the manifest recording their
+// versions and checksums.
+//
+//go:embed bin
+var bin embed.FS
+
+const manifestName = "MANIFEST"
+
+// Binary is an iPXE binary embedded in coresmd.
+type Binary struct {
+	Name    string
+	Version string
+	SHA256  string
+	Data    []byte
+}
+
+// EmbeddedBinaries returns the embedded iPXE binaries by file name, checked
+// against the checksums recorded in the manifest. It returns an error if a
+// binary is missing or does not match its checksum, which means the build is
+// broken. It returns no binaries if none were fetched before building.
+var EmbeddedBinaries = sync.OnceValues(func() (map[string]Binary, error) {
+	return LoadBinaries(bin, "bin")
+})
+
+// LoadBinaries loads the iPXE binaries listed in the manifest in dir of fsys,
+// like EmbeddedBinaries.
+func LoadBinaries(fsys fs.FS, dir string) (map[string]Binary, error) {
+	manifest, err := fs.ReadFile(fsys, path.Join(dir, manifestName))
+	if err != nil {
+		return nil, err
+	}
+
+	binaries := make(map[string]Binary)
+	scanner := bufio.NewScanner(bytes.NewReader(manifest))
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Fields(text)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("invalid manifest line %d: expected <sha256> <file> <version>", line)
+		}
+		b := Binary{SHA256: fields[0], Name: fields[1], Version: fields[2]}
+		if b.Data, err = fs.ReadFile(fsys, path.Join(dir, b.Name)); err != nil {
+			return nil, fmt.Errorf("embedded iPXE binary %s is missing: %w", b.Name, err)
+		}
+		sum := sha256.Sum256(b.Data)
+		if got := hex.EncodeToString(sum[:]); got != b.SHA256 {
+			return nil, fmt.Errorf("embedded iPXE binary %s has checksum %s, expected %s", b.Name, got, b.SHA256)
+		}
+		binaries[b.Name] = b
+	}
+
+	return binaries, scanner.Err()
+}
+
+// BinaryList lists binaries with their versions and checksums for logging.
+func BinaryList(binaries map[string]Binary) string {
+	names := make([]string, 0, len(binaries))
+	for name := range binaries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	entries := make([]string, len(names))
+	for i, name := range names {
+		b := binaries[name]
+		entries[i] = fmt.Sprintf("%s %s (sha256 %s)", b.Name, b.Version, b.SHA256)
+	}
+	return strings.Join(entries, ", ")
+}
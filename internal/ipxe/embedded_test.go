@@ -0,0 +1,90 @@
+package ipxe
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+)
+
+// TestEmbeddedBinaries fails unless go generate ./internal/ipxe has fetched the
+// binaries, so that a release is never built without them. Builds without
+// them are fine for development, so it only runs if IPXE_REQUIRE_EMBEDDED is
+// set, as it is by the release build.
+func TestEmbeddedBinaries(t *testing.T) {
+	if os.Getenv("IPXE_REQUIRE_EMBEDDED") == "" {
+		t.Skip("IPXE_REQUIRE_EMBEDDED is not set")
+	}
+	binaries, err := EmbeddedBinaries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(binaries) == 0 {
+		t.Fatal("bin/MANIFEST lists no iPXE binaries; run go generate ./internal/ipxe")
+	}
+}
+
+func TestLoadBinaries(t *testing.T) {
+	data := []byte("ipxe")
+	sum := sha256.Sum256(data)
+	line := hex.EncodeToString(sum[:]) + "  ipxe.efi  v1.0.0\n"
+
+	tests := []struct {
+		name    string
+		fsys    fstest.MapFS
+		want    int
+		wantErr string
+	}{
+		{
+			name: "ok",
+			fsys: fstest.MapFS{
+				"bin/MANIFEST": {Data: []byte("# comment\n" + line)},
+				"bin/ipxe.efi": {Data: data},
+			},
+			want: 1,
+		},
+		{
+			name: "empty",
+			fsys: fstest.MapFS{"bin/MANIFEST": {Data: []byte("# comment\n")}},
+		},
+		{
+			name:    "missing",
+			fsys:    fstest.MapFS{"bin/MANIFEST": {Data: []byte(line)}},
+			wantErr: "missing",
+		},
+		{
+			name: "checksum",
+			fsys: fstest.MapFS{
+				"bin/MANIFEST": {Data: []byte(line)},
+				"bin/ipxe.efi": {Data: []byte("other")},
+			},
+			wantErr: "checksum",
+		},
+		{
+			name:    "invalid",
+			fsys:    fstest.MapFS{"bin/MANIFEST": {Data: []byte("ipxe.efi\n")}},
+			wantErr: "invalid manifest line 1",
+		},
+	}
+	for _, tt := range tests {
+		binaries, err := LoadBinaries(tt.fsys, "bin")
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("%s: got error %v, expected %q", tt.name, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(binaries) != tt.want {
+			t.Errorf("%s: got %d binaries, expected %d", tt.name, len(binaries), tt.want)
+		}
+		if b, ok := binaries["ipxe.efi"]; ok && b.Version != "v1.0.0" {
+			t.Errorf("%s: got version %s, expected v1.0.0", tt.name, b.Version)
+		}
+	}
+}
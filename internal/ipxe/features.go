@@ -0,0 +1,134 @@
+package ipxe
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// optionEncapsulated is the option in which iPXE clients present their
+// version and features.
+var optionEncapsulated = dhcpv4.GenericOptionCode(175)
+
+// Feature indicators and other encapsulated options sent by iPXE clients (see
+// dhcp.h in the iPXE sources).
+const (
+	optBusID   = 0xb1
+	optVersion = 0xeb
+)
+
+// features maps the names of iPXE feature indicators to their option codes.
+var features = map[string]uint8{
+	"pxe-ext":   0x10,
+	"iscsi":     0x11,
+	"aoe":       0x12,
+	"http":      0x13,
+	"https":     0x14,
+	"tftp":      0x15,
+	"ftp":       0x16,
+	"dns":       0x17,
+	"bzimage":   0x18,
+	"multiboot": 0x19,
+	"slam":      0x1a,
+	"srp":       0x1b,
+	"nbi":       0x20,
+	"pxe":       0x21,
+	"elf":       0x22,
+	"comboot":   0x23,
+	"efi":       0x24,
+	"fcoe":      0x25,
+	"vlan":      0x26,
+	"menu":      0x27,
+	"sdi":       0x28,
+	"nfs":       0x29,
+}
+
+// BusTypeEFI is the bus type of network devices driven through the firmware's
+// Simple Network Protocol, as snponly.efi does.
+const BusTypeEFI = 7
+
+// Client is what an iPXE client tells about itself in option 175.
+type Client struct {
+	// Version is the iPXE version, e.g. "1.21.1", if presented.
+	Version string
+	// Features are the names of the features the client was built with.
+	Features []string
+	// BusType, VendorID and DeviceID describe the network device the client
+	// booted from (e.g. 1 for PCI, with its PCI IDs), if presented.
+	BusType  uint8
+	VendorID uint16
+	DeviceID uint16
+}
+
+// ParseClient parses the encapsulated options presented by an iPXE client in
+// req. It returns false if req has no option 175, as is the case for
+// firmware PXE clients and for iPXE builds that do not present their features.
+func ParseClient(req *dhcpv4.DHCPv4) (Client, bool, error) {
+	if !req.Options.Has(optionEncapsulated) {
+		return Client{}, false, nil
+	}
+	b := req.Options.Get(optionEncapsulated)
+	var c Client
+	for len(b) > 0 {
+		code := b[0]
+		if code == 0 {
+			b = b[1:]
+			continue
+		}
+		if code == 0xff {
+			break
+		}
+		if len(b) < 2 || len(b) < 2+int(b[1]) {
+			return c, true, fmt.Errorf("truncated iPXE option %#x", code)
+		}
+		data := b[2 : 2+int(b[1])]
+		b = b[2+int(b[1]):]
+
+		switch code {
+		case optVersion:
+			if len(data) == 3 {
+				c.Version = fmt.Sprintf("%d.%d.%d", data[0], data[1], data[2])
+			}
+		case optBusID:
+			if len(data) == 5 {
+				c.BusType = data[0]
+				c.VendorID = binary.BigEndian.Uint16(data[1:])
+				c.DeviceID = binary.BigEndian.Uint16(data[3:])
+			}
+		default:
+			for name, fc := range features {
+				if fc == code {
+					c.Features = append(c.Features, name)
+				}
+			}
+		}
+	}
+	sort.Strings(c.Features)
+
+	return c, true, nil
+}
+
+// Has reports whether the client was built with the named feature.
+func (c Client) Has(feature string) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseFeatures parses a comma-separated list of iPXE feature names, such as
+// "http,https".
+func ParseFeatures(val string) ([]string, error) {
+	names := strings.Split(val, ",")
+	for _, name := range names {
+		if _, ok := features[name]; !ok {
+			return nil, fmt.Errorf("unknown iPXE feature %q", name)
+		}
+	}
+	return names, nil
+}
@@ -0,0 +1,187 @@
+//go:build ignore
+
+// fetch downloads the iPXE binaries of a release of
+// https://github.com/OpenCHAMI/ipxe-binaries into bin, to be embedded in
+// coresmd, and records their versions and checksums in bin/MANIFEST. Run it
+// with go generate ./internal/ipxe. The release and the SHA-256 checksum of its
+// archive are pinned in RELEASE, so that every build embeds the same binaries;
+// IPXE_RELEASE and IPXE_SHA256 override them together to try another release.
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	releasesURL = "https://api.github.com/repos/OpenCHAMI/ipxe-binaries/releases/"
+	assetName   = "ipxe.tar.gz"
+	binDir      = "bin"
+	releaseFile = "RELEASE"
+)
+
+type release struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+func main() {
+	tag, digest, err := pinnedRelease()
+	if err != nil {
+		log.Fatal(err)
+	}
+	rel, err := getRelease(tag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var assetURL string
+	for _, a := range rel.Assets {
+		if a.Name == assetName {
+			assetURL = a.URL
+		}
+	}
+	if assetURL == "" {
+		log.Fatalf("release %s has no %s", rel.TagName, assetName)
+	}
+
+	resp, err := http.Get(assetURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		log.Fatalf("failed to download %s: %s", assetURL, resp.Status)
+	}
+	archive, err := io.ReadAll(resp.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	sum := sha256.Sum256(archive)
+	if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, digest) {
+		log.Fatalf("%s of release %s has checksum %s, expected %s", assetName, rel.TagName, got, digest)
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(archive))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Replace the binaries of the previous release
+	old, _ := filepath.Glob(filepath.Join(binDir, "*"))
+	for _, name := range old {
+		if filepath.Base(name) != "MANIFEST" {
+			os.Remove(name)
+		}
+	}
+
+	var lines []string
+	tr := tar.NewReader(gz)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		name := path.Base(hdr.Name)
+		if hdr.Typeflag != tar.TypeReg || !isBinary(name) {
+			continue
+		}
+		data, err := io.ReadAll(tr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(binDir, name), data, 0o644); err != nil {
+			log.Fatal(err)
+		}
+		sum := sha256.Sum256(data)
+		lines = append(lines, fmt.Sprintf("%s  %s  %s", hex.EncodeToString(sum[:]), name, rel.TagName))
+	}
+	if len(lines) == 0 {
+		log.Fatalf("%s of release %s contains no iPXE binaries", assetName, rel.TagName)
+	}
+	sort.Slice(lines, func(i, j int) bool { return lines[i][66:] < lines[j][66:] })
+
+	manifest := "# iPXE binaries embedded in coresmd, one per line as\n" +
+		"#   <sha256>  <file>  <version>\n" +
+		"# Written by fetch.go (go generate ./internal/ipxe) along with the binaries, and\n" +
+		"# checked when coresmd starts. Do not edit by hand.\n" +
+		strings.Join(lines, "\n") + "\n"
+	if err := os.WriteFile(filepath.Join(binDir, "MANIFEST"), []byte(manifest), 0o644); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("fetched %d iPXE binaries of release %s", len(lines), rel.TagName)
+}
+
+// pinnedRelease returns the release tag and archive checksum set in
+// IPXE_RELEASE and IPXE_SHA256, or else pinned in RELEASE.
+func pinnedRelease() (tag, digest string, err error) {
+	tag, digest = os.Getenv("IPXE_RELEASE"), os.Getenv("IPXE_SHA256")
+	if tag != "" || digest != "" {
+		if tag == "" || digest == "" {
+			return "", "", fmt.Errorf("IPXE_RELEASE and IPXE_SHA256 must be set together")
+		}
+		return tag, digest, nil
+	}
+
+	data, err := os.ReadFile(releaseFile)
+	if err != nil {
+		return "", "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return "", "", fmt.Errorf("invalid %s line %q: expected <tag> <sha256>", releaseFile, line)
+		}
+		return fields[0], fields[1], nil
+	}
+	return "", "", fmt.Errorf("no iPXE release is pinned in %s", releaseFile)
+}
+
+// getRelease returns the release with the given tag.
+func getRelease(tag string) (*release, error) {
+	u := releasesURL + "tags/" + tag
+	resp, err := http.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to get release from %s: %s", u, resp.Status)
+	}
+	var rel release
+	if err := json.NewDecoder(resp.Body).Decode(&rel); err != nil {
+		return nil, err
+	}
+	return &rel, nil
+}
+
+// isBinary reports whether name is an iPXE binary served to clients.
+func isBinary(name string) bool {
+	for _, ext := range []string{".efi", ".kpxe", ".kkpxe", ".pxe", ".lkrn", ".usb"} {
+		if strings.HasSuffix(name, ext) {
+			return true
+		}
+	}
+	return false
+}
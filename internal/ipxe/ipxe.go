@@ -2,45 +2,242 @@ package ipxe
 
 import (
 	"encoding/binary"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/insomniacslk/dhcp/iana"
 	"github.com/sirupsen/logrus"
 )
 
-func ServeIPXEBootloader(l *logrus.Entry, req, resp *dhcpv4.DHCPv4) (*dhcpv4.DHCPv4, bool) {
-	if req.Options.Has(dhcpv4.OptionClientSystemArchitectureType) {
-		var carch iana.Arch
-		carchBytes := req.Options.Get(dhcpv4.OptionClientSystemArchitectureType)
-		l.Debugf("client architecture of %s is %v (%q)", req.ClientHWAddr, carchBytes, string(carchBytes))
-		carch = iana.Arch(binary.BigEndian.Uint16(carchBytes))
-		switch carch {
-		case iana.INTEL_X86PC:
-			// iPXE legacy 32-bit x86 bootloader
-			resp.Options.Update(dhcpv4.OptBootFileName("undionly.kpxe"))
-			return resp, true
-		case iana.EFI_IA32:
-			// iPXE EFI 32-bit bootloader
-			resp.Options.Update(dhcpv4.OptBootFileName("ipxe-i386.efi"))
-			return resp, true
-		case iana.EFI_X86_64:
-			// iPXE 64-bit x86 bootloader
-			resp.Options.Update(dhcpv4.OptBootFileName("ipxe-x86_64.efi"))
-			return resp, true
-		case iana.EFI_ARM32:
-			// iPXE EFI 32-bit ARM bootloader
-			resp.Options.Update(dhcpv4.OptBootFileName("ipxe-arm32.efi"))
-			return resp, true
-		case iana.EFI_ARM64:
-			// iPXE EFI 64-bit ARM bootloader
-			resp.Options.Update(dhcpv4.OptBootFileName("ipxe-arm64.efi"))
-			return resp, true
-		default:
-			l.Errorf("no iPXE bootloader available for unknown architecture: %d (%s)", carch, carch.String())
-			return resp, false
+// Protocol is how a client fetches its bootloader.
+type Protocol string
+
+const (
+	// TFTP clients are given the bootloader file name, which they fetch
+	// from the TFTP server.
+	TFTP Protocol = "tftp"
+	// HTTP clients perform UEFI HTTP boot and are given a URL.
+	HTTP Protocol = "http"
+)
+
+// Bootloader is the iPXE binary served to clients of an architecture.
+type Bootloader struct {
+	File     string
+	Protocol Protocol
+}
+
+// Bootloaders maps client architectures (DHCP option 93) to the bootloaders
+// served to them.
+type Bootloaders map[iana.Arch]Bootloader
+
+// DefaultBootloaders are the bootloaders served to each architecture unless
+// configured otherwise. Legacy BIOS clients get undionly.kpxe, which uses the
+// UNDI driver of the PXE ROM that loaded it; EFI BC clients are x86-64.
+var DefaultBootloaders = Bootloaders{
+	iana.INTEL_X86PC:     {"undionly.kpxe", TFTP},
+	iana.EFI_IA32:        {"ipxe-i386.efi", TFTP},
+	iana.EFI_X86_64:      {"ipxe-x86_64.efi", TFTP},
+	iana.EFI_BC:          {"ipxe-x86_64.efi", TFTP},
+	iana.EFI_ARM32:       {"ipxe-arm32.efi", TFTP},
+	iana.EFI_ARM64:       {"ipxe-arm64.efi", TFTP},
+	iana.EFI_X86_HTTP:    {"ipxe-i386.efi", HTTP},
+	iana.EFI_X86_64_HTTP: {"ipxe-x86_64.efi", HTTP},
+	iana.EFI_BC_HTTP:     {"ipxe-x86_64.efi", HTTP},
+	iana.EFI_ARM32_HTTP:  {"ipxe-arm32.efi", HTTP},
+	iana.EFI_ARM64_HTTP:  {"ipxe-arm64.efi", HTTP},
+}
+
+// DefaultSNPBootloaders are the bootloaders served to each architecture when
+// iPXE must drive the network device through the firmware, unless configured
+// otherwise: snponly.efi builds on EFI, which use the firmware's Simple Network
+// Protocol, and undionly.kpxe on legacy BIOS. Some NICs only work with these.
+var DefaultSNPBootloaders = Bootloaders{
+	iana.INTEL_X86PC:     {"undionly.kpxe", TFTP},
+	iana.EFI_IA32:        {"snponly-i386.efi", TFTP},
+	iana.EFI_X86_64:      {"snponly-x86_64.efi", TFTP},
+	iana.EFI_BC:          {"snponly-x86_64.efi", TFTP},
+	iana.EFI_ARM32:       {"snponly-arm32.efi", TFTP},
+	iana.EFI_ARM64:       {"snponly-arm64.efi", TFTP},
+	iana.EFI_X86_HTTP:    {"snponly-i386.efi", HTTP},
+	iana.EFI_X86_64_HTTP: {"snponly-x86_64.efi", HTTP},
+	iana.EFI_BC_HTTP:     {"snponly-x86_64.efi", HTTP},
+	iana.EFI_ARM32_HTTP:  {"snponly-arm32.efi", HTTP},
+	iana.EFI_ARM64_HTTP:  {"snponly-arm64.efi", HTTP},
+}
+
+// ParseBootloaders parses a comma-separated list of
+// <arch>:<file>[:tftp|http] entries, where arch is the number of a client
+// architecture (e.g. 0 for legacy BIOS or 16 for x86-64 UEFI HTTP boot), and
+// returns DefaultBootloaders with the entries added or replaced. A file of '-'
+// removes the architecture, so that its clients are not served.
+func ParseBootloaders(val string) (Bootloaders, error) {
+	return DefaultBootloaders.Merge(val)
+}
+
+// Merge returns bs with the entries in val, in the format of ParseBootloaders,
+// added or replaced. bs is not modified.
+func (bs Bootloaders) Merge(val string) (Bootloaders, error) {
+	bootloaders := make(Bootloaders, len(bs))
+	for arch, b := range bs {
+		bootloaders[arch] = b
+	}
+	for _, entry := range strings.Split(val, ",") {
+		fields := strings.Split(entry, ":")
+		if len(fields) < 2 || len(fields) > 3 || fields[1] == "" {
+			return nil, fmt.Errorf("invalid entry %q: expected <arch>:<file>[:tftp|http]", entry)
+		}
+		n, err := strconv.ParseUint(fields[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid architecture %q in entry %q: expected a number", fields[0], entry)
+		}
+		arch := iana.Arch(n)
+		if fields[1] == "-" {
+			delete(bootloaders, arch)
+			continue
+		}
+		b := Bootloader{File: fields[1], Protocol: TFTP}
+		if len(fields) == 3 {
+			switch p := Protocol(fields[2]); p {
+			case TFTP, HTTP:
+				b.Protocol = p
+			default:
+				return nil, fmt.Errorf("invalid protocol %q in entry %q: expected tftp or http", fields[2], entry)
+			}
+		}
+		bootloaders[arch] = b
+	}
+
+	return bootloaders, nil
+}
+
+// String lists the bootloaders by architecture.
+func (bs Bootloaders) String() string {
+	archs := make([]int, 0, len(bs))
+	for arch := range bs {
+		archs = append(archs, int(arch))
+	}
+	sort.Ints(archs)
+	entries := make([]string, len(archs))
+	for i, arch := range archs {
+		b := bs[iana.Arch(arch)]
+		entries[i] = fmt.Sprintf("%d:%s:%s", arch, b.File, b.Protocol)
+	}
+	return strings.Join(entries, ",")
+}
+
+// ServeIPXEBootloader sets the boot file name in resp to the default iPXE
+// bootloader matching the client architecture in req. Clients performing UEFI
+// HTTP boot are given a URL relative to httpBaseURL, which may be nil if there
+// is no HTTP server to fetch bootloaders from.
+func ServeIPXEBootloader(l *logrus.Entry, req, resp *dhcpv4.DHCPv4, httpBaseURL *url.URL) (*dhcpv4.DHCPv4, bool) {
+	return DefaultBootloaders.Serve(l, req, resp, httpBaseURL)
+}
+
+// ArchPreference is the order in which architectures are chosen when a client
+// presents several: 64-bit EFI over 32-bit EFI, TFTP over UEFI HTTP boot, and
+// any EFI over legacy BIOS. Architectures not listed come last, in the order
+// the client presented them.
+var ArchPreference = []iana.Arch{
+	iana.EFI_X86_64,
+	iana.EFI_BC,
+	iana.EFI_ARM64,
+	iana.EFI_IA32,
+	iana.EFI_ARM32,
+	iana.EFI_X86_64_HTTP,
+	iana.EFI_BC_HTTP,
+	iana.EFI_ARM64_HTTP,
+	iana.EFI_X86_HTTP,
+	iana.EFI_ARM32_HTTP,
+	iana.INTEL_X86PC,
+}
+
+// ClientArchs returns every architecture in the client architecture option
+// (DHCP option 93) of req, in the order the client presented them. It returns
+// an error if the option is empty or not a whole number of 2-byte entries.
+func ClientArchs(req *dhcpv4.DHCPv4) ([]iana.Arch, error) {
+	b := req.Options.Get(dhcpv4.OptionClientSystemArchitectureType)
+	if len(b) == 0 || len(b)%2 != 0 {
+		return nil, fmt.Errorf("invalid client architecture list %v: expected one or more 2-byte entries", b)
+	}
+	archs := make([]iana.Arch, len(b)/2)
+	for i := range archs {
+		archs[i] = iana.Arch(binary.BigEndian.Uint16(b[2*i:]))
+	}
+	return archs, nil
+}
+
+// Select returns the architecture in archs with a bootloader in bs that comes
+// first in ArchPreference.
+func (bs Bootloaders) Select(archs []iana.Arch) (iana.Arch, Bootloader, bool) {
+	best, bestRank, found := iana.Arch(0), len(ArchPreference), false
+	for _, arch := range archs {
+		if _, ok := bs[arch]; !ok {
+			continue
 		}
-	} else {
+		rank := len(ArchPreference)
+		for i, pref := range ArchPreference {
+			if pref == arch {
+				rank = i
+				break
+			}
+		}
+		if !found || rank < bestRank {
+			best, bestRank, found = arch, rank, true
+		}
+	}
+	return best, bs[best], found
+}
+
+// Serve sets the boot file name in resp to the bootloader in bs matching the
+// client architecture in req, like ServeIPXEBootloader. Clients presenting
+// several architectures are served the bootloader of the one Select prefers.
+func (bs Bootloaders) Serve(l *logrus.Entry, req, resp *dhcpv4.DHCPv4, httpBaseURL *url.URL) (*dhcpv4.DHCPv4, bool) {
+	if !req.Options.Has(dhcpv4.OptionClientSystemArchitectureType) {
 		l.Errorf("client did not present an architecture, unable to provide correct iPXE bootloader")
 		return resp, false
 	}
+	archs, err := ClientArchs(req)
+	if err != nil {
+		l.Errorf("%v, unable to provide correct iPXE bootloader", err)
+		return resp, false
+	}
+	l.Debugf("client architectures of %s are %s", req.ClientHWAddr, archList(archs))
+	carch, b, ok := bs.Select(archs)
+	if !ok {
+		l.Errorf("no iPXE bootloader available for architectures: %s", archList(archs))
+		return resp, false
+	}
+	if len(archs) > 1 {
+		l.Debugf("chose architecture %d (%s) of %s", carch, carch.String(), archList(archs))
+	}
+	if b.Protocol == HTTP {
+		return serveHTTPBootloader(l, resp, httpBaseURL, b.File)
+	}
+	resp.Options.Update(dhcpv4.OptBootFileName(b.File))
+	return resp, true
+}
+
+// archList formats archs with their names for logging.
+func archList(archs []iana.Arch) string {
+	entries := make([]string, len(archs))
+	for i, arch := range archs {
+		entries[i] = fmt.Sprintf("%d (%s)", arch, arch.String())
+	}
+	return strings.Join(entries, ", ")
+}
+
+func serveHTTPBootloader(l *logrus.Entry, resp *dhcpv4.DHCPv4, httpBaseURL *url.URL, name string) (*dhcpv4.DHCPv4, bool) {
+	if httpBaseURL == nil {
+		l.Errorf("client requested UEFI HTTP boot, but no HTTP URL is configured to serve %s from", name)
+		return resp, false
+	}
+
+	// UEFI HTTP boot clients ignore offers that do not identify as HTTPClient
+	resp.Options.Update(dhcpv4.OptClassIdentifier("HTTPClient"))
+	resp.Options.Update(dhcpv4.OptBootFileName(httpBaseURL.JoinPath(name).String()))
+	return resp, true
 }
@@ -0,0 +1,135 @@
+package ipxe
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// embeddedScript is the script recommended to be embedded into iPXE binaries
+// served by coresmd. It configures the network via DHCP and chains to the boot
+// script URL, retrying with an exponential backoff before rebooting.
+var embeddedScript = template.Must(template.New("embedded").Parse(`#!ipxe
+set attempt:int32 0
+set delay:int32 {{ .Delay }}
+
+:retry
+dhcp || goto failed
+chain --autofree {{ .URL }} || goto failed
+
+:failed
+inc attempt
+iseq ${attempt} {{ .Retries }} && goto reboot ||
+echo Boot attempt ${attempt} failed, retrying in ${delay} seconds...
+sleep ${delay}
+inc delay ${delay}
+goto retry
+
+:reboot
+echo Boot failed after ${attempt} attempts, rebooting...
+sleep {{ .Delay }}
+reboot
+`))
+
+// EmbeddedScript returns an iPXE script suitable for embedding into iPXE
+// binaries that chains to url. Each failed attempt doubles the delay (in
+// seconds) before the next one, and the client is rebooted after retries
+// failed attempts.
+func EmbeddedScript(url string, retries, delay int) (string, error) {
+	if retries < 1 {
+		return "", fmt.Errorf("retries must be at least 1, got %d", retries)
+	}
+	if delay < 1 {
+		return "", fmt.Errorf("delay must be at least 1 second, got %d", delay)
+	}
+
+	var b bytes.Buffer
+	err := embeddedScript.Execute(&b, struct {
+		URL     string
+		Retries int
+		Delay   int
+	}{url, retries, delay})
+	if err != nil {
+		return "", fmt.Errorf("failed to generate embedded script: %w", err)
+	}
+
+	return b.String(), nil
+}
+
+// stage1Script chains to each target in turn, retrying each with an
+// exponential backoff before moving on to the next. Targets are URLs, "exit"
+// or "reboot".
+var stage1Script = template.Must(template.New("stage1").Parse(`#!ipxe
+{{- range .Targets }}
+
+:{{ .Label }}
+{{- if eq .URL "exit" }}
+echo Exiting to the next boot device...
+exit
+{{- else if eq .URL "reboot" }}
+echo Rebooting...
+reboot
+{{- else }}
+set attempt:int32 0
+set delay:int32 {{ $.Delay }}
+:{{ .Label }}_retry
+chain --autofree --timeout {{ $.Timeout }} {{ .URL }} && goto done ||
+inc attempt
+iseq ${attempt} {{ $.Retries }} && goto {{ .Next }} ||
+echo Fetching {{ .URL }} failed (attempt ${attempt}), retrying in ${delay} seconds...
+sleep ${delay}
+inc delay ${delay}
+goto {{ .Label }}_retry
+{{- end }}
+{{- end }}
+
+:failed
+echo Boot failed, rebooting in {{ .Delay }} seconds...
+sleep {{ .Delay }}
+reboot
+
+:done
+`))
+
+// Stage1Script returns an iPXE script that chains to the first of targets,
+// retrying it retries times with an exponential backoff starting at delay
+// seconds, with each attempt timing out after timeout, before falling back to
+// the next target. A target of "exit" returns to the firmware, which moves on
+// to the next boot device, and "reboot" reboots. The client is rebooted if
+// all targets fail.
+func Stage1Script(targets []string, retries int, timeout time.Duration, delay int) (string, error) {
+	if len(targets) == 0 {
+		return "", fmt.Errorf("no targets to chain to")
+	}
+	if retries < 1 {
+		return "", fmt.Errorf("retries must be at least 1, got %d", retries)
+	}
+	if delay < 1 {
+		return "", fmt.Errorf("delay must be at least 1 second, got %d", delay)
+	}
+
+	type target struct{ Label, Next, URL string }
+	ts := make([]target, len(targets))
+	for i, t := range targets {
+		if strings.ContainsAny(t, " \n") {
+			return "", fmt.Errorf("invalid target %q", t)
+		}
+		ts[i] = target{Label: fmt.Sprintf("target%d", i), Next: fmt.Sprintf("target%d", i+1), URL: t}
+	}
+	ts[len(ts)-1].Next = "failed"
+
+	var b bytes.Buffer
+	err := stage1Script.Execute(&b, struct {
+		Targets []target
+		Retries int
+		Timeout int64
+		Delay   int
+	}{ts, retries, timeout.Milliseconds(), delay})
+	if err != nil {
+		return "", fmt.Errorf("failed to generate stage-1 script: %w", err)
+	}
+
+	return b.String(), nil
+}
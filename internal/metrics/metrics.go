@@ -0,0 +1,228 @@
+// Package metrics implements simple counters and gauges that can be exposed in
+// the Prometheus text exposition format or sent to a statsd server.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Type is the type of a metric.
+type Type string
+
+const (
+	CounterType Type = "counter"
+	GaugeType   Type = "gauge"
+)
+
+// Registry holds a set of metrics.
+type Registry struct {
+	mu      sync.RWMutex
+	metrics map[string]*Metric
+}
+
+// DefaultRegistry is the registry used by NewCounter and NewGauge.
+var DefaultRegistry = NewRegistry()
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{metrics: make(map[string]*Metric)}
+}
+
+// Metric is a named counter or gauge with zero or more labels. Each unique set
+// of label values is tracked as a separate series. Updating a series that
+// already exists takes no lock, so that metrics updated on every request do
+// not serialize concurrent requests.
+type Metric struct {
+	Name       string
+	Help       string
+	Type       Type
+	LabelNames []string
+
+	// series maps the label values, joined by labelSep, to their series.
+	// New series are rare, so the map is replaced rather than updated when
+	// one is added; mu serializes additions.
+	mu     sync.Mutex
+	series atomic.Pointer[map[string]*series]
+}
+
+// labelSep separates label values in series keys.
+const labelSep = "\xff"
+
+type series struct {
+	labelValues []string
+	// bits holds the value as returned by math.Float64bits.
+	bits atomic.Uint64
+}
+
+// Sample is the value of a single series of a metric.
+type Sample struct {
+	LabelValues []string
+	Value       float64
+}
+
+// NewCounter registers and returns a counter in DefaultRegistry.
+func NewCounter(name, help string, labelNames ...string) *Metric {
+	return DefaultRegistry.Register(name, help, CounterType, labelNames...)
+}
+
+// NewGauge registers and returns a gauge in DefaultRegistry.
+func NewGauge(name, help string, labelNames ...string) *Metric {
+	return DefaultRegistry.Register(name, help, GaugeType, labelNames...)
+}
+
+// Register adds a metric to the registry and returns it. If a metric with the
+// same name is already registered, it is returned instead so that plugin
+// instances can share metrics.
+func (r *Registry) Register(name, help string, t Type, labelNames ...string) *Metric {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if m, ok := r.metrics[name]; ok {
+		return m
+	}
+	m := &Metric{
+		Name:       name,
+		Help:       help,
+		Type:       t,
+		LabelNames: labelNames,
+	}
+	r.metrics[name] = m
+
+	return m
+}
+
+// Metrics returns the registered metrics sorted by name.
+func (r *Registry) Metrics() []*Metric {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ms := make([]*Metric, 0, len(r.metrics))
+	for _, m := range r.metrics {
+		ms = append(ms, m)
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Name < ms[j].Name })
+
+	return ms
+}
+
+// Inc adds 1 to the series with the given label values.
+func (m *Metric) Inc(labelValues ...string) {
+	m.Add(1, labelValues...)
+}
+
+// Add adds v to the series with the given label values.
+func (m *Metric) Add(v float64, labelValues ...string) {
+	s := m.get(labelValues)
+	for {
+		old := s.bits.Load()
+		if s.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// Set sets the series with the given label values to v.
+func (m *Metric) Set(v float64, labelValues ...string) {
+	m.get(labelValues).bits.Store(math.Float64bits(v))
+}
+
+// Samples returns the current value of each series sorted by label values.
+func (m *Metric) Samples() []Sample {
+	all := m.loadSeries()
+	samples := make([]Sample, 0, len(all))
+	for _, s := range all {
+		samples = append(samples, Sample{LabelValues: s.labelValues, Value: math.Float64frombits(s.bits.Load())})
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		return strings.Join(samples[i].LabelValues, labelSep) < strings.Join(samples[j].LabelValues, labelSep)
+	})
+
+	return samples
+}
+
+// get returns the series for labelValues, creating it if needed.
+func (m *Metric) get(labelValues []string) *series {
+	if len(labelValues) != len(m.LabelNames) {
+		panic(fmt.Sprintf("metric %s expects %d label values, got %d", m.Name, len(m.LabelNames), len(labelValues)))
+	}
+	var key string
+	switch len(labelValues) {
+	case 0:
+	case 1:
+		key = labelValues[0]
+	default:
+		key = strings.Join(labelValues, labelSep)
+	}
+	if s, ok := m.loadSeries()[key]; ok {
+		return s
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	old := m.loadSeries()
+	if s, ok := old[key]; ok {
+		return s
+	}
+	all := make(map[string]*series, len(old)+1)
+	for k, s := range old {
+		all[k] = s
+	}
+	s := &series{labelValues: append([]string(nil), labelValues...)}
+	all[key] = s
+	m.series.Store(&all)
+
+	return s
+}
+
+// loadSeries returns the series of m, which must not be modified.
+func (m *Metric) loadSeries() map[string]*series {
+	if all := m.series.Load(); all != nil {
+		return *all
+	}
+	return nil
+}
+
+// WritePrometheus writes all metrics in r to w in the Prometheus text
+// exposition format.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	for _, m := range r.Metrics() {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", m.Name, m.Help, m.Name, m.Type); err != nil {
+			return err
+		}
+		for _, s := range m.Samples() {
+			if _, err := fmt.Fprintf(w, "%s%s %s\n", m.Name, formatLabels(m.LabelNames, s.LabelValues), strconv.FormatFloat(s.Value, 'g', -1, 64)); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Handler returns an HTTP handler serving the metrics in r.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		r.WritePrometheus(w)
+	})
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf("%s=%s", name, strconv.Quote(values[i]))
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
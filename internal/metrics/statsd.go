@@ -0,0 +1,154 @@
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// StatsdFormat is how the labels of a series are sent to a statsd server.
+type StatsdFormat string
+
+const (
+	// StatsdGraphite appends labels to the metric name as label.value path
+	// components, as understood by plain statsd and Graphite.
+	StatsdGraphite StatsdFormat = "graphite"
+	// StatsdTags sends labels as DogStatsD tags (|#label:value), as
+	// understood by DogStatsD, Telegraf, and statsd_exporter.
+	StatsdTags StatsdFormat = "tags"
+)
+
+// ParseStatsdFormat parses a StatsdFormat from its name.
+func ParseStatsdFormat(s string) (StatsdFormat, error) {
+	switch f := StatsdFormat(s); f {
+	case StatsdGraphite, StatsdTags:
+		return f, nil
+	}
+	return "", fmt.Errorf("invalid statsd format %q: expected %s or %s", s, StatsdGraphite, StatsdTags)
+}
+
+// maxStatsdPacket is the largest UDP payload sent to the statsd server, small
+// enough not to be fragmented on a standard Ethernet link.
+const maxStatsdPacket = 1432
+
+// StatsdEmitter sends the metrics of a registry to a statsd server over UDP:
+// counters as the increase since the previous flush, gauges as their current
+// value. It is not safe for concurrent use.
+type StatsdEmitter struct {
+	r      *Registry
+	conn   net.Conn
+	prefix string
+	format StatsdFormat
+	// last holds the value of each counter series at the previous flush,
+	// keyed by metric name and label values
+	last map[string]float64
+}
+
+// NewStatsdEmitter returns an emitter sending the metrics in r to the statsd
+// server at addr, with metric names prefixed by prefix and a dot if prefix
+// is not empty.
+func (r *Registry) NewStatsdEmitter(addr, prefix string, format StatsdFormat) (*StatsdEmitter, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if prefix != "" {
+		prefix += "."
+	}
+
+	return &StatsdEmitter{r: r, conn: conn, prefix: prefix, format: format, last: make(map[string]float64)}, nil
+}
+
+// Flush sends the current values of all metrics. Counters that did not change
+// since the previous flush are skipped.
+func (e *StatsdEmitter) Flush() error {
+	var packet []byte
+	var firstErr error
+	send := func() {
+		if len(packet) == 0 {
+			return
+		}
+		if _, err := e.conn.Write(packet); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		packet = packet[:0]
+	}
+
+	for _, m := range e.r.Metrics() {
+		for _, s := range m.Samples() {
+			value, kind := s.Value, "g"
+			if m.Type == CounterType {
+				key := m.Name + labelSep + strings.Join(s.LabelValues, labelSep)
+				value, kind = s.Value-e.last[key], "c"
+				e.last[key] = s.Value
+				if value == 0 {
+					continue
+				}
+			}
+			line := e.line(m, s.LabelValues, value, kind)
+			if len(packet) > 0 && len(packet)+1+len(line) > maxStatsdPacket {
+				send()
+			}
+			if len(packet) > 0 {
+				packet = append(packet, '\n')
+			}
+			packet = append(packet, line...)
+		}
+	}
+	send()
+
+	return firstErr
+}
+
+// line formats a series as a statsd line. Negative gauges are preceded by a
+// line setting them to zero, since statsd reads a signed gauge value as a
+// change.
+func (e *StatsdEmitter) line(m *Metric, labelValues []string, value float64, kind string) string {
+	var name, tags strings.Builder
+	name.WriteString(e.prefix)
+	name.WriteString(m.Name)
+	for i, label := range m.LabelNames {
+		switch e.format {
+		case StatsdGraphite:
+			name.WriteString("." + label + "." + statsdSafe(labelValues[i]))
+		case StatsdTags:
+			if i == 0 {
+				tags.WriteString("|#")
+			} else {
+				tags.WriteByte(',')
+			}
+			tags.WriteString(label + ":" + statsdSafe(labelValues[i]))
+		}
+	}
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		value = 0
+	}
+
+	line := name.String() + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + kind + tags.String()
+	if kind == "g" && value < 0 {
+		line = name.String() + ":0|g" + tags.String() + "\n" + line
+	}
+	return line
+}
+
+// Close closes the connection to the statsd server.
+func (e *StatsdEmitter) Close() error {
+	return e.conn.Close()
+}
+
+// statsdSafe replaces the characters of a label value that would break a
+// statsd line or Graphite path with underscores.
+func statsdSafe(v string) string {
+	if v == "" {
+		return "none"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ':', '|', '@', '#', ',', ' ', '\t', '\n', '/':
+			return '_'
+		}
+		return r
+	}, v)
+}
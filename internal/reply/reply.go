@@ -0,0 +1,51 @@
+// Package reply sets the header fields of DHCPv4 replies that decide how they
+// reach the client.
+package reply
+
+import (
+	"net"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// SetAddressing sets the fields of resp that RFC 2131 section 4.1 uses to
+// deliver it, from req, so that replies reach clients behind relay agents and
+// clients that cannot receive unicast before they are configured:
+//
+//   - giaddr and the relay agent information option (82) are echoed, so that
+//     the relay agent forwards the reply to the right link.
+//   - The broadcast flag is echoed, and always set in a DHCPNAK sent through
+//     a relay agent since the client may not have an address to receive it on.
+//   - ciaddr is echoed in a DHCPACK and cleared in a DHCPOFFER or DHCPNAK.
+//   - yiaddr is cleared in a DHCPNAK and in the DHCPACK to a DHCPINFORM.
+//
+// Replies built from scratch instead of with dhcpv4.NewReplyFromRequest, or
+// after other plugins have changed these fields, are fixed the same way.
+func SetAddressing(req, resp *dhcpv4.DHCPv4) {
+	resp.OpCode = dhcpv4.OpcodeBootReply
+	resp.TransactionID = req.TransactionID
+	resp.HWType = req.HWType
+	resp.ClientHWAddr = req.ClientHWAddr
+
+	relayed := req.GatewayIPAddr != nil && !req.GatewayIPAddr.IsUnspecified()
+	resp.GatewayIPAddr = req.GatewayIPAddr
+	if relayed && req.Options.Has(dhcpv4.OptionRelayAgentInformation) {
+		resp.Options.Update(dhcpv4.OptGeneric(dhcpv4.OptionRelayAgentInformation, req.Options.Get(dhcpv4.OptionRelayAgentInformation)))
+	}
+
+	mt := resp.MessageType()
+	if req.IsBroadcast() || (relayed && mt == dhcpv4.MessageTypeNak) {
+		resp.SetBroadcast()
+	} else {
+		resp.SetUnicast()
+	}
+
+	if mt == dhcpv4.MessageTypeAck && req.ClientIPAddr != nil {
+		resp.ClientIPAddr = req.ClientIPAddr
+	} else {
+		resp.ClientIPAddr = net.IPv4zero
+	}
+	if mt == dhcpv4.MessageTypeNak || req.MessageType() == dhcpv4.MessageTypeInform {
+		resp.YourIPAddr = net.IPv4zero
+	}
+}
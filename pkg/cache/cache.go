@@ -0,0 +1,686 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/OpenCHAMI/coresmd/pkg/smdclient"
+	"golang.org/x/sync/errgroup"
+)
+
+// startupRetryMin and startupRetryMax bound the backoff between refreshes
+// until the cache has been loaded from SMD for the first time.
+const (
+	startupRetryMin = 5 * time.Second
+	startupRetryMax = time.Minute
+)
+
+type Cache struct {
+	Client smdclient.SmdClient
+	// Duration is the interval between refreshes, to which a random delay
+	// of up to Jitter is added so that several instances refreshing from the
+	// same SMD spread out their requests.
+	Duration time.Duration
+	Jitter   time.Duration
+
+	// If nonempty, only Components with these types and roles (and
+	// EthernetInterfaces belonging to them) are cached.
+	ComponentTypes []string
+	ComponentRoles []string
+
+	// DiffLogging sets what is logged about changes since the previous
+	// refresh.
+	DiffLogging DiffLogging
+
+	// RedfishEndpoints, if set and supported by Client, makes the cache
+	// also serve the MAC and IP addresses of RedfishEndpoints (typically
+	// BMCs) that have no EthernetInterface for their MAC address.
+	RedfishEndpoints bool
+	// Groups, if set and supported by Client, makes the cache also hold
+	// the SMD groups and partitions and the Components in each.
+	Groups bool
+
+	// SnapshotFile, if set, is where the data is saved after each
+	// successful refresh, to be loaded by LoadSnapshotFile.
+	SnapshotFile string
+
+	// OnRefresh, if set, is called after each successful refresh to
+	// refresh data kept alongside the cache.
+	OnRefresh func(ctx context.Context)
+	// OnChange, if set, is called after each successful refresh but the
+	// first with the changes since the previous one.
+	OnChange func(d SnapshotDiff)
+
+	// snapshot holds the data from the latest refresh. It is replaced as a
+	// whole on each refresh so readers never need to take a lock.
+	snapshot atomic.Pointer[Snapshot]
+
+	// mu guards the settings above against Reconfigure and cancel. cancel
+	// stops the refresh loop, which signals wg once it has exited.
+	mu     sync.Mutex
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	// trigger wakes the refresh loop to refresh immediately.
+	trigger chan struct{}
+
+	statsMu sync.Mutex
+	stats   RefreshStats
+}
+
+// RefreshStats summarizes the outcome of cache refreshes.
+type RefreshStats struct {
+	Refreshes   int       `json:"refreshes"`
+	Failures    int       `json:"failures"`
+	LastAttempt time.Time `json:"last_attempt"`
+	LastSuccess time.Time `json:"last_success"`
+	// LastError is the error of the most recent refresh, or empty if it
+	// succeeded.
+	LastError string `json:"last_error,omitempty"`
+	// LastDurationSeconds is how long the most recent refresh took.
+	LastDurationSeconds float64 `json:"last_duration_seconds"`
+}
+
+// Snapshot is an immutable view of SMD data as of a single cache refresh. It
+// must not be modified once stored in the Cache.
+type Snapshot struct {
+	// LastUpdated is when the data was fetched, or zero if the cache has
+	// not been refreshed successfully yet.
+	LastUpdated time.Time
+
+	EthernetInterfaces map[string]smdclient.EthernetInterface
+	Components         map[string]smdclient.Component
+
+	// Interfaces holds the pre-parsed lookup result for each MAC address
+	// whose EthernetInterface has a matching Component and at least one
+	// valid IP address.
+	Interfaces map[string]IfaceInfo
+	// ComponentInterfaces maps Component IDs to the MAC addresses of their
+	// EthernetInterfaces.
+	ComponentInterfaces map[string][]string
+	// IPAddresses maps IP addresses to the MAC address they belong to.
+	IPAddresses map[string]string
+	// GUIDs maps InfiniBand port GUIDs (the last 8 bytes of 8- or 20-byte
+	// hardware addresses) to the hardware address they belong to.
+	GUIDs map[string]string
+	// ClientIDs maps client identifiers (option 61, as lowercase hex)
+	// declared in EthernetInterface descriptions to the hardware address of
+	// the EthernetInterface.
+	ClientIDs map[string]string
+
+	// DuplicateIPs maps IP addresses held by more than one
+	// EthernetInterface to their MAC addresses, the one it is assigned to
+	// first. The others are not given the IP address.
+	DuplicateIPs map[string][]string
+	// DuplicateMACs maps MAC addresses claimed by more than one Component
+	// to the Component IDs, the one whose EthernetInterface was kept first.
+	DuplicateMACs map[string][]string
+	// DuplicateNIDs maps NIDs held by more than one Node to their
+	// Component IDs, the one named after the NID first, and MissingNIDs
+	// holds the sorted IDs of Nodes without a NID. Nodes not named after
+	// their NID are named after their Component ID.
+	DuplicateNIDs map[int64][]string
+	MissingNIDs   []string
+
+	// Groups and Partitions hold the SMD groups and partitions by label and
+	// name, respectively, if the cache fetches them.
+	Groups     map[string]smdclient.Group
+	Partitions map[string]smdclient.Partition
+	// ComponentGroups maps Component IDs to the sorted labels of the groups
+	// they are in, and ComponentPartitions to the partition they are in.
+	ComponentGroups     map[string][]string
+	ComponentPartitions map[string]string
+}
+
+// newSnapshot builds a Snapshot from EthernetInterfaces and Components keyed by
+// MAC address and ID, respectively, parsing and indexing them so that lookups
+// need no further processing.
+//
+// Systems may have a hundred thousand interfaces, so the indexes share the
+// strings of eiMap and compMap rather than holding copies, and the parsed IP
+// addresses are carved out of a few large allocations rather than one each.
+func newSnapshot(eiMap map[string]smdclient.EthernetInterface, compMap map[string]smdclient.Component) *Snapshot {
+	s := &Snapshot{
+		LastUpdated:         time.Now(),
+		EthernetInterfaces:  eiMap,
+		Components:          compMap,
+		Interfaces:          make(map[string]IfaceInfo, len(eiMap)),
+		ComponentInterfaces: make(map[string][]string, len(compMap)),
+		IPAddresses:         make(map[string]string, len(eiMap)),
+		GUIDs:               make(map[string]string),
+		ClientIDs:           make(map[string]string),
+	}
+
+	// Parse IP addresses first so that each goes to a single
+	// EthernetInterface, however many SMD has it on
+	nIPs := 0
+	for _, ei := range eiMap {
+		nIPs += len(ei.IPAddresses)
+	}
+	ips := make([]net.IP, 0, nIPs)
+	ip4s := make([]byte, 0, net.IPv4len*nIPs)
+	ipLists := make(map[string][]net.IP, len(eiMap))
+	// shared holds the MAC addresses of every EthernetInterface with an IP
+	// address held by more than one
+	shared := make(map[string][]string)
+	for mac, ei := range eiMap {
+		first := len(ips)
+		for _, ipStr := range ei.IPAddresses {
+			addr, err := netip.ParseAddr(ipStr.IPAddress)
+			if err != nil || addr.Zone() != "" {
+				log.Warnf("ignoring invalid IP address %q for hardware address %s", ipStr.IPAddress, mac)
+				continue
+			}
+			addr = addr.Unmap()
+			var ip net.IP
+			if addr.Is4() {
+				a4 := addr.As4()
+				ip4s = append(ip4s, a4[:]...)
+				ip = ip4s[len(ip4s)-net.IPv4len : len(ip4s) : len(ip4s)]
+			} else {
+				ip = addr.AsSlice()
+			}
+			ips = append(ips, ip)
+
+			key := ipKey(ipStr.IPAddress, addr)
+			if owner, ok := s.IPAddresses[key]; !ok {
+				s.IPAddresses[key] = mac
+			} else if owner != mac {
+				if shared[key] == nil {
+					shared[key] = []string{owner}
+				}
+				shared[key] = append(shared[key], mac)
+			}
+		}
+		if len(ips) > first {
+			ipLists[mac] = ips[first:len(ips):len(ips)]
+		}
+	}
+	s.DuplicateIPs = resolveDuplicateIPs(shared, eiMap, compMap)
+	s.DuplicateNIDs, s.MissingNIDs = checkNIDs(compMap)
+	for ip, macs := range s.DuplicateIPs {
+		s.IPAddresses[ip] = macs[0]
+	}
+
+	var buf [64]byte
+	for mac, ei := range eiMap {
+		comp, hasComp := compMap[ei.ComponentID]
+		if hasComp && ei.ComponentID != "" {
+			// Hold one copy of the Component ID
+			ei.ComponentID = comp.ID
+			eiMap[mac] = ei
+		}
+
+		s.ComponentInterfaces[ei.ComponentID] = append(s.ComponentInterfaces[ei.ComponentID], mac)
+		if len(mac) == 23 || len(mac) == 59 {
+			if hw, err := net.ParseMAC(mac); err == nil {
+				s.GUIDs[hw[len(hw)-8:].String()] = mac
+			}
+		}
+		if cid := descriptionClientID(ei.Description); cid != "" {
+			s.ClientIDs[cid] = mac
+		}
+
+		// Keep the addresses this interface won, in place
+		ipList := ipLists[mac][:0]
+		for _, ip := range ipLists[mac] {
+			addr, _ := netip.AddrFromSlice(ip)
+			if s.IPAddresses[string(addr.AppendTo(buf[:0]))] == mac {
+				ipList = append(ipList, ip)
+			}
+		}
+
+		if !hasComp || len(ipList) == 0 {
+			continue
+		}
+		ii := IfaceInfo{
+			CompID:    comp.ID,
+			Type:      comp.Type,
+			Role:      comp.Role,
+			SubRole:   comp.SubRole,
+			MAC:       mac,
+			IPList:    ipList,
+			Overrides: comp.ExtraProperties,
+		}
+		if comp.Type == "Node" {
+			ii.CompNID = comp.NID
+			ii.Hostname = nodeHostname(comp, s.DuplicateNIDs)
+		}
+		s.Interfaces[mac] = ii
+	}
+
+	return s
+}
+
+// ipKey returns the key of addr, parsed from str, in the IPAddresses index:
+// its canonical string form, which is str itself unless SMD holds it in
+// another form (e.g. with leading zeros in an IPv6 address).
+func ipKey(str string, addr netip.Addr) string {
+	var buf [64]byte
+	if b := addr.AppendTo(buf[:0]); string(b) == str {
+		return str
+	}
+	return addr.String()
+}
+
+func NewCache(duration string, client smdclient.SmdClient) (*Cache, error) {
+	cacheDuration, err := time.ParseDuration(duration)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse cache duration: %w", err)
+	}
+	if client == nil {
+		return nil, errors.New("new Client needs non-nil SmdClient")
+	}
+
+	c := &Cache{
+		Client:   client,
+		Duration: cacheDuration,
+		trigger:  make(chan struct{}, 1),
+	}
+	empty := newSnapshot(nil, nil)
+	empty.LastUpdated = time.Time{}
+	c.snapshot.Store(empty)
+
+	return c, nil
+}
+
+// Reconfigure replaces the client, refresh interval and jitter, filters, diff
+// logging, and RedfishEndpoints and Groups settings used by the cache. The
+// cached data is kept until the next refresh, and a running refresh loop
+// switches to the new interval after its current wait.
+func (c *Cache) Reconfigure(client smdclient.SmdClient, duration, jitter time.Duration, types, roles []string, diff DiffLogging, redfish, groups bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.Client = client
+	c.Duration = duration
+	c.Jitter = jitter
+	c.ComponentTypes = types
+	c.ComponentRoles = roles
+	c.DiffLogging = diff
+	c.RedfishEndpoints = redfish
+	c.Groups = groups
+}
+
+// Snapshot returns the data from the latest cache refresh. The returned
+// Snapshot remains consistent even if the cache is refreshed while it is in
+// use.
+func (c *Cache) Snapshot() *Snapshot {
+	return c.snapshot.Load()
+}
+
+// Refresh fetches the latest data from SMD and replaces the cache's snapshot
+// with it. Requests to SMD are aborted if ctx is canceled.
+func (c *Cache) Refresh(ctx context.Context) (err error) {
+	log.Info("initiating cache refresh")
+
+	if c == nil {
+		return fmt.Errorf("cache is nil")
+	}
+	defer c.recordRefresh(time.Now(), &err)
+	c.mu.Lock()
+	client, types, roles, diffLogging, snapshotFile := c.Client, c.ComponentTypes, c.ComponentRoles, c.DiffLogging, c.SnapshotFile
+	reClient, fetchRedfish := client.(smdclient.RedfishEndpointClient)
+	fetchRedfish = fetchRedfish && c.RedfishEndpoints
+	groupClient, fetchGroups := client.(smdclient.GroupClient)
+	fetchGroups = fetchGroups && c.Groups
+	c.mu.Unlock()
+
+	// Fetch both concurrently so a refresh takes as long as the slower
+	// query rather than both, assembling the maps as data is received
+	// rather than holding complete responses in memory. If either fails,
+	// the previous snapshot is kept.
+	// The maps are sized for the previous refresh's data, which is about
+	// as large, so that they need not grow while being filled.
+	prev := c.Snapshot()
+	compMap := make(map[string]smdclient.Component, len(prev.Components))
+	eiMap := make(map[string]smdclient.EthernetInterface, len(prev.EthernetInterfaces))
+	dupes := make(map[string][]smdclient.EthernetInterface)
+	g, gctx := errgroup.WithContext(ctx)
+	g.Go(func() error {
+		log.Debug("fetching Components")
+		in := make(interner)
+		err := eachComponent(gctx, client, types, roles, func(comp smdclient.Component) error {
+			comp.Type, comp.Role, comp.SubRole = in.intern(comp.Type), in.intern(comp.Role), in.intern(comp.SubRole)
+			compMap[comp.ID] = comp
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to fetch Components from SMD: %w", err)
+		}
+		return nil
+	})
+	g.Go(func() error {
+		log.Debug("fetching EthernetInterfaces")
+		in := make(interner)
+		err := eachEthernetInterface(gctx, client, types, func(ei smdclient.EthernetInterface) error {
+			// Key by normalized MAC so lookups match regardless of
+			// how the address is formatted in SMD
+			mac, err := NormalizeMAC(ei.MACAddress)
+			if err != nil {
+				log.Warnf("ignoring EthernetInterface for Component %s: %v", ei.ComponentID, err)
+				return nil
+			}
+			ei.Type = in.intern(ei.Type)
+			if prev, ok := eiMap[mac]; ok {
+				if dupes[mac] == nil {
+					dupes[mac] = []smdclient.EthernetInterface{prev}
+				}
+				dupes[mac] = append(dupes[mac], ei)
+			}
+			eiMap[mac] = ei
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to fetch EthernetInterfaces from SMD: %w", err)
+		}
+		return nil
+	})
+	var res []smdclient.RedfishEndpoint
+	if fetchRedfish {
+		g.Go(func() error {
+			log.Debug("fetching RedfishEndpoints")
+			var err error
+			res, err = reClient.RedfishEndpoints(gctx, types)
+			if err != nil {
+				return fmt.Errorf("failed to fetch RedfishEndpoints from SMD: %w", err)
+			}
+			return nil
+		})
+	}
+	var (
+		groups []smdclient.Group
+		parts  []smdclient.Partition
+	)
+	if fetchGroups {
+		g.Go(func() error {
+			log.Debug("fetching groups")
+			var err error
+			groups, err = groupClient.Groups(gctx)
+			if err != nil {
+				return fmt.Errorf("failed to fetch groups from SMD: %w", err)
+			}
+			return nil
+		})
+		g.Go(func() error {
+			log.Debug("fetching partitions")
+			var err error
+			parts, err = groupClient.Partitions(gctx)
+			if err != nil {
+				return fmt.Errorf("failed to fetch partitions from SMD: %w", err)
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return err
+	}
+
+	dupMACs := resolveDuplicateMACs(eiMap, dupes, compMap)
+	if n := addRedfishEndpoints(eiMap, res); n > 0 {
+		log.Infof("serving %d RedfishEndpoint(s) without an EthernetInterface", n)
+	}
+
+	// EthernetInterfaces cannot be filtered by role in SMD, so drop any
+	// whose Component was filtered out
+	if len(types) > 0 || len(roles) > 0 {
+		for mac, ei := range eiMap {
+			if _, ok := compMap[ei.ComponentID]; !ok {
+				delete(eiMap, mac)
+			}
+		}
+	}
+
+	// Update cache with info
+	log.Debug("updating cache with map data")
+	s := newSnapshot(eiMap, compMap)
+	s.DuplicateMACs = dupMACs
+	s.setGroups(groups, parts)
+	metricDuplicates.Set(float64(len(s.DuplicateIPs)), "ip")
+	metricDuplicates.Set(float64(len(dupMACs)), "mac")
+	metricDuplicates.Set(float64(len(s.DuplicateNIDs)), "nid")
+	metricMissingNIDs.Set(float64(len(s.MissingNIDs)))
+	if old := c.snapshot.Swap(s); !old.LastUpdated.IsZero() {
+		d := diffSnapshots(old, s)
+		logDiff(diffLogging, d)
+		if c.OnChange != nil {
+			c.OnChange(d)
+		}
+	}
+	log.Infof("Cache updated with %d EthernetInterfaces and %d Components", len(eiMap), len(compMap))
+	if snapshotFile != "" {
+		if err := saveSnapshot(snapshotFile, s); err != nil {
+			log.Errorf("failed to save cache snapshot: %v", err)
+		}
+	}
+	log.Debugf("EthernetInterfaces: %v", eiMap)
+	log.Debugf("Components: %v", compMap)
+
+	if c.OnRefresh != nil {
+		c.OnRefresh(ctx)
+	}
+
+	return nil
+}
+
+// interner deduplicates strings decoded from SMD that take few distinct values
+// (Component types and roles), so that each is held once rather than once per
+// Component.
+type interner map[string]string
+
+func (in interner) intern(s string) string {
+	if v, ok := in[s]; ok {
+		return v
+	}
+	in[s] = s
+	return s
+}
+
+// addRedfishEndpoints adds to eiMap an EthernetInterface for the MAC and IP
+// address of each RedfishEndpoint in res whose MAC address has none, so that
+// BMCs only known to SMD through Redfish discovery are served like any other
+// interface of their Component. It returns the number added.
+func addRedfishEndpoints(eiMap map[string]smdclient.EthernetInterface, res []smdclient.RedfishEndpoint) int {
+	n := 0
+	for _, re := range res {
+		if re.MACAddr == "" || re.IPAddress == "" {
+			continue
+		}
+		mac, err := NormalizeMAC(re.MACAddr)
+		if err != nil {
+			log.Warnf("ignoring RedfishEndpoint %s: %v", re.ID, err)
+			continue
+		}
+		if _, ok := eiMap[mac]; ok {
+			continue
+		}
+		ei := smdclient.EthernetInterface{
+			MACAddress:  mac,
+			ComponentID: re.ID,
+			Description: "RedfishEndpoint",
+		}
+		ei.IPAddresses = append(ei.IPAddresses, struct {
+			IPAddress string `json:"IPAddress"`
+		}{IPAddress: re.IPAddress})
+		eiMap[mac] = ei
+		n++
+	}
+
+	return n
+}
+
+// eachComponent calls fn for each Component fetched by client, as it is
+// received if client supports streaming.
+func eachComponent(ctx context.Context, client smdclient.SmdClient, types, roles []string, fn func(smdclient.Component) error) error {
+	if sc, ok := client.(interface {
+		EachComponent(context.Context, []string, []string, func(smdclient.Component) error) error
+	}); ok {
+		return sc.EachComponent(ctx, types, roles, fn)
+	}
+	comps, err := client.Components(ctx, types, roles)
+	if err != nil {
+		return err
+	}
+	for _, comp := range comps {
+		if err := fn(comp); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// eachEthernetInterface calls fn for each EthernetInterface fetched by client,
+// as it is received if client supports streaming.
+func eachEthernetInterface(ctx context.Context, client smdclient.SmdClient, types []string, fn func(smdclient.EthernetInterface) error) error {
+	if sc, ok := client.(interface {
+		EachEthernetInterface(context.Context, []string, func(smdclient.EthernetInterface) error) error
+	}); ok {
+		return sc.EachEthernetInterface(ctx, types, fn)
+	}
+	eis, err := client.EthernetInterfaces(ctx, types)
+	if err != nil {
+		return err
+	}
+	for _, ei := range eis {
+		if err := fn(ei); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// recordRefresh updates the refresh statistics with the outcome of a refresh
+// started at start that returned *err.
+func (c *Cache) recordRefresh(start time.Time, err *error) {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+
+	c.stats.Refreshes++
+	c.stats.LastAttempt = start
+	c.stats.LastDurationSeconds = time.Since(start).Seconds()
+	if *err != nil {
+		c.stats.Failures++
+		c.stats.LastError = (*err).Error()
+		return
+	}
+	c.stats.LastSuccess = start
+	c.stats.LastError = ""
+}
+
+// Stats returns statistics about the refreshes performed so far.
+func (c *Cache) Stats() RefreshStats {
+	c.statsMu.Lock()
+	defer c.statsMu.Unlock()
+	return c.stats
+}
+
+// RefreshLoop refreshes the cache once and then every Duration in the
+// background until ctx is canceled or Close is called, returning the error of
+// the first refresh. Until a refresh succeeds, it retries sooner, starting
+// after startupRetryMin. RefreshNow makes it refresh early.
+func (c *Cache) RefreshLoop(ctx context.Context) error {
+	log.Info("initiating cache refresh loop")
+	log.Infof("refreshing cache every duration: %s (jitter: %s)", c.Duration.String(), c.Jitter.String())
+
+	c.mu.Lock()
+	ctx, c.cancel = context.WithCancel(ctx)
+	c.mu.Unlock()
+
+	// Initial refresh
+	initErr := c.Refresh(ctx)
+	if initErr != nil {
+		log.Errorf("failed to refresh cache: %v", initErr)
+	}
+
+	// ...then each duration, which may change if the cache is reconfigured.
+	// Until the cache has been loaded from SMD, retry sooner, backing off.
+	retry := startupRetryMin
+	wait := func() time.Duration {
+		if !c.Stats().LastSuccess.IsZero() {
+			return c.nextWait()
+		}
+		d := min(retry, c.nextWait())
+		retry = min(2*retry, startupRetryMax)
+		return d
+	}
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		timer := time.NewTimer(wait())
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				log.Info("cache refresh loop stopped")
+				return
+			case <-timer.C:
+				timer.Reset(wait())
+				err := c.Refresh(ctx)
+				if err != nil {
+					log.Errorf("failed to refresh cache: %v", err)
+				}
+			case <-c.trigger:
+				// Wait a full duration after the forced refresh
+				if !timer.Stop() {
+					<-timer.C
+				}
+				timer.Reset(wait())
+				err := c.Refresh(ctx)
+				if err != nil {
+					log.Errorf("failed to refresh cache: %v", err)
+				}
+			}
+		}
+	}()
+
+	return initErr
+}
+
+// RefreshNow makes the refresh loop refresh the cache immediately instead of
+// waiting out the rest of Duration, and restarts the wait from there. It does
+// not block, and does nothing if the loop is not running. Requests made while a
+// forced refresh is pending are coalesced into it.
+func (c *Cache) RefreshNow() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// RefreshInterval returns the interval between refreshes, excluding jitter.
+func (c *Cache) RefreshInterval() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Duration
+}
+
+// nextWait returns how long the refresh loop should wait before its next
+// refresh: Duration plus a random delay of up to Jitter.
+func (c *Cache) nextWait() time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.Jitter <= 0 {
+		return c.Duration
+	}
+	return c.Duration + time.Duration(rand.Int63n(int64(c.Jitter)))
+}
+
+// Close stops the refresh loop started by RefreshLoop, aborting any refresh in
+// progress, and waits for it to exit. It is safe to call more than once and if
+// the loop was never started.
+func (c *Cache) Close() {
+	c.mu.Lock()
+	if c.cancel != nil {
+		c.cancel()
+	}
+	c.mu.Unlock()
+	c.wg.Wait()
+}
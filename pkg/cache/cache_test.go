@@ -0,0 +1,375 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/OpenCHAMI/coresmd/pkg/smdclient"
+	"github.com/OpenCHAMI/coresmd/pkg/smdtest"
+	"github.com/sirupsen/logrus"
+)
+
+func TestCacheClose(t *testing.T) {
+	fake := smdclient.NewFakeSmdClient(nil, nil)
+	c, err := NewCache("5ms", fake)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+
+	// Closing a cache whose loop never started must not block
+	c.Close()
+
+	c.RefreshLoop(context.Background())
+	time.Sleep(20 * time.Millisecond)
+	c.Close()
+	c.Close()
+
+	calls := fake.Calls()
+	time.Sleep(20 * time.Millisecond)
+	if fake.Calls() != calls {
+		t.Errorf("cache refreshed %d more time(s) after Close", fake.Calls()-calls)
+	}
+}
+
+func TestCacheRefreshLoopContext(t *testing.T) {
+	fake := smdclient.NewFakeSmdClient(nil, nil)
+	c, err := NewCache("5ms", fake)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	c.RefreshLoop(ctx)
+	cancel()
+
+	done := make(chan struct{})
+	go func() {
+		c.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("refresh loop did not stop after its context was canceled")
+	}
+}
+
+func TestCacheRefreshNow(t *testing.T) {
+	fake := smdclient.NewFakeSmdClient(nil, nil)
+	c, err := NewCache("1h", fake)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	defer c.Close()
+
+	c.RefreshLoop(context.Background())
+	calls := fake.Calls()
+	c.RefreshNow()
+
+	deadline := time.Now().Add(time.Second)
+	for fake.Calls() == calls {
+		if time.Now().After(deadline) {
+			t.Fatal("cache was not refreshed after RefreshNow")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCacheNextWait(t *testing.T) {
+	c, err := NewCache("1m", smdclient.NewFakeSmdClient(nil, nil))
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	if got := c.nextWait(); got != time.Minute {
+		t.Errorf("without jitter: nextWait() = %s, want %s", got, time.Minute)
+	}
+
+	c.Jitter = 10 * time.Second
+	for i := 0; i < 100; i++ {
+		if got := c.nextWait(); got < time.Minute || got >= time.Minute+c.Jitter {
+			t.Fatalf("with jitter: nextWait() = %s, want in [%s, %s)", got, time.Minute, time.Minute+c.Jitter)
+		}
+	}
+}
+
+// barrierSmdClient is an SmdClient whose queries only return once both are in
+// flight, failing Components with compErr.
+type barrierSmdClient struct {
+	arrived sync.WaitGroup
+	compErr error
+}
+
+func (b *barrierSmdClient) wait(ctx context.Context) error {
+	b.arrived.Done()
+	done := make(chan struct{})
+	go func() {
+		b.arrived.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(time.Second):
+		return errors.New("queries were not made concurrently")
+	}
+}
+
+func (b *barrierSmdClient) EthernetInterfaces(ctx context.Context, types []string) ([]smdclient.EthernetInterface, error) {
+	if err := b.wait(ctx); err != nil {
+		return nil, err
+	}
+	return []smdclient.EthernetInterface{{MACAddress: "aa:bb:cc:dd:ee:01", ComponentID: "x3000c0s0b0n0"}}, nil
+}
+
+func (b *barrierSmdClient) Components(ctx context.Context, types, roles []string) ([]smdclient.Component, error) {
+	if err := b.wait(ctx); err != nil {
+		return nil, err
+	}
+	return []smdclient.Component{{ID: "x3000c0s0b0n0", Type: "Node"}}, b.compErr
+}
+
+func TestCacheRefreshConcurrent(t *testing.T) {
+	client := &barrierSmdClient{}
+	client.arrived.Add(2)
+	c, err := NewCache("1h", client)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	before := c.Snapshot()
+	if len(before.EthernetInterfaces) != 1 || len(before.Components) != 1 {
+		t.Fatalf("cached %d EthernetInterfaces and %d Components, want 1 each", len(before.EthernetInterfaces), len(before.Components))
+	}
+
+	// A failed query must leave the previous snapshot in place
+	client.arrived.Add(2)
+	client.compErr = errors.New("SMD is down")
+	if err := c.Refresh(context.Background()); err == nil {
+		t.Fatal("Refresh succeeded with a failing query")
+	}
+	if c.Snapshot() != before {
+		t.Error("snapshot was replaced after a failed refresh")
+	}
+}
+
+func TestCacheRedfishEndpoints(t *testing.T) {
+	ip := func(s string) []struct {
+		IPAddress string `json:"IPAddress"`
+	} {
+		return []struct {
+			IPAddress string `json:"IPAddress"`
+		}{{IPAddress: s}}
+	}
+	fake := smdclient.NewFakeSmdClient(
+		[]smdclient.EthernetInterface{{MACAddress: "aa:bb:cc:dd:ee:02", ComponentID: "x3000c0s1b0", IPAddresses: ip("172.16.0.2")}},
+		[]smdclient.Component{{ID: "x3000c0s0b0", Type: "NodeBMC"}, {ID: "x3000c0s1b0", Type: "NodeBMC"}},
+	)
+	fake.SetRedfishEndpoints([]smdclient.RedfishEndpoint{
+		{ID: "x3000c0s0b0", Type: "NodeBMC", MACAddr: "AA-BB-CC-DD-EE-01", IPAddress: "172.16.0.1"},
+		// EthernetInterfaces take precedence
+		{ID: "x3000c0s1b0", Type: "NodeBMC", MACAddr: "aa:bb:cc:dd:ee:02", IPAddress: "172.16.0.99"},
+		// No Component
+		{ID: "x3000c0s2b0", Type: "NodeBMC", MACAddr: "aa:bb:cc:dd:ee:03", IPAddress: "172.16.0.3"},
+	})
+	c, err := NewCache("1h", fake)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if _, ok := c.Snapshot().Interfaces["aa:bb:cc:dd:ee:01"]; ok {
+		t.Error("RedfishEndpoint served without smd_redfish_endpoints")
+	}
+
+	c.RedfishEndpoints = true
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	s := c.Snapshot()
+	if ii, ok := s.Interfaces["aa:bb:cc:dd:ee:01"]; !ok || ii.CompID != "x3000c0s0b0" || ii.IPList[0].String() != "172.16.0.1" {
+		t.Errorf("interface for RedfishEndpoint is %+v, want x3000c0s0b0 with 172.16.0.1", ii)
+	}
+	if ii := s.Interfaces["aa:bb:cc:dd:ee:02"]; ii.IPList[0].String() != "172.16.0.2" {
+		t.Errorf("EthernetInterface was replaced by RedfishEndpoint: %+v", ii)
+	}
+	if _, ok := s.Interfaces["aa:bb:cc:dd:ee:03"]; ok {
+		t.Error("RedfishEndpoint without a Component was served")
+	}
+}
+
+func TestCacheGroups(t *testing.T) {
+	fake := smdclient.NewFakeSmdClient(
+		[]smdclient.EthernetInterface{{MACAddress: "aa:bb:cc:dd:ee:01", ComponentID: "x3000c0s0b0n0", IPAddresses: []struct {
+			IPAddress string `json:"IPAddress"`
+		}{{IPAddress: "172.16.0.1"}}}},
+		[]smdclient.Component{{ID: "x3000c0s0b0n0", Type: "Node"}, {ID: "x3000c0s1b0n0", Type: "Node"}},
+	)
+	fake.SetGroups(
+		[]smdclient.Group{
+			{Label: "storage", Members: smdclient.Members{IDs: []string{"x3000c0s0b0n0", "x3000c0s1b0n0"}}},
+			{Label: "canary", Members: smdclient.Members{IDs: []string{"x3000c0s0b0n0"}}},
+		},
+		[]smdclient.Partition{{Name: "p1", Members: smdclient.Members{IDs: []string{"x3000c0s1b0n0"}}}},
+	)
+	c, err := NewCache("1h", fake)
+	if err != nil {
+		t.Fatalf("NewCache: %v", err)
+	}
+	c.Groups = true
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+
+	s := c.Snapshot()
+	if !s.InGroup("x3000c0s0b0n0", "canary") || s.InGroup("x3000c0s1b0n0", "canary") {
+		t.Error("InGroup does not follow canary membership")
+	}
+	if g := s.GroupsOf("x3000c0s0b0n0"); !slices.Equal(g, []string{"canary", "storage"}) {
+		t.Errorf("GroupsOf = %v, want [canary storage]", g)
+	}
+	if p := s.PartitionOf("x3000c0s1b0n0"); p != "p1" {
+		t.Errorf("PartitionOf = %q, want p1", p)
+	}
+	if m := s.GroupMembers("storage"); len(m) != 2 {
+		t.Errorf("GroupMembers = %v, want both nodes", m)
+	}
+
+	if ii := s.Interfaces["aa:bb:cc:dd:ee:01"]; !slices.Equal(ii.Groups, []string{"canary", "storage"}) || ii.Partition != "" {
+		t.Errorf("interface of x3000c0s0b0n0 is %+v, want groups canary and storage and no partition", ii)
+	}
+}
+
+func TestSnapshotIPAddresses(t *testing.T) {
+	ei := func(mac string, ips ...string) smdclient.EthernetInterface {
+		ei := smdclient.EthernetInterface{MACAddress: mac, ComponentID: "x3000c0s0b0n0"}
+		for _, ip := range ips {
+			ei.IPAddresses = append(ei.IPAddresses, struct {
+				IPAddress string `json:"IPAddress"`
+			}{ip})
+		}
+		return ei
+	}
+	s := newSnapshot(map[string]smdclient.EthernetInterface{
+		"aa:bb:cc:dd:ee:01": ei("aa:bb:cc:dd:ee:01", "10.0.0.1", "2001:DB8::1", "::ffff:10.0.1.1", "bogus"),
+		"aa:bb:cc:dd:ee:02": ei("aa:bb:cc:dd:ee:02", "10.0.0.2", "10.0.0.1"),
+	}, map[string]smdclient.Component{"x3000c0s0b0n0": {ID: "x3000c0s0b0n0", Type: "Node"}})
+
+	want := map[string]string{
+		"10.0.0.1":    "aa:bb:cc:dd:ee:01",
+		"10.0.0.2":    "aa:bb:cc:dd:ee:02",
+		"10.0.1.1":    "aa:bb:cc:dd:ee:01",
+		"2001:db8::1": "aa:bb:cc:dd:ee:01",
+	}
+	if !reflect.DeepEqual(s.IPAddresses, want) {
+		t.Errorf("IPAddresses = %v, want %v", s.IPAddresses, want)
+	}
+	if got := fmt.Sprint(s.Interfaces["aa:bb:cc:dd:ee:01"].IPList); got != "[10.0.0.1 2001:db8::1 10.0.1.1]" {
+		t.Errorf("IP addresses of aa:bb:cc:dd:ee:01 = %s", got)
+	}
+	if got := fmt.Sprint(s.Interfaces["aa:bb:cc:dd:ee:02"].IPList); got != "[10.0.0.2]" {
+		t.Errorf("IP addresses of aa:bb:cc:dd:ee:02 = %s", got)
+	}
+	for _, ip := range s.Interfaces["aa:bb:cc:dd:ee:01"].IPList {
+		if ip.To4() != nil && len(ip) != net.IPv4len {
+			t.Errorf("IPv4 address %s is held in %d bytes", ip, len(ip))
+		}
+	}
+}
+
+// benchInventory returns n node EthernetInterfaces and their Components, laid
+// out like a large system: a few types and roles, one IP address each.
+func benchInventory(n int) ([]smdclient.EthernetInterface, []smdclient.Component) {
+	eis := make([]smdclient.EthernetInterface, n)
+	comps := make([]smdclient.Component, n)
+	for i := range eis {
+		id := fmt.Sprintf("x%dc%ds%db0n0", 1000+i/512, i/64%8, i%64)
+		eis[i] = smdclient.EthernetInterface{
+			MACAddress:  fmt.Sprintf("02:00:00:%02x:%02x:%02x", i>>16&0xff, i>>8&0xff, i&0xff),
+			ComponentID: id,
+			Type:        "Node",
+			IPAddresses: []struct {
+				IPAddress string `json:"IPAddress"`
+			}{{IPAddress: fmt.Sprintf("10.%d.%d.%d", i>>16&0xff, i>>8&0xff, i&0xff)}},
+		}
+		comps[i] = smdclient.Component{ID: id, NID: int64(i + 1), Type: "Node", Role: "Compute", SubRole: []string{"", "Worker"}[i%2]}
+	}
+	return eis, comps
+}
+
+func BenchmarkRefresh(b *testing.B) {
+	quiet := logrus.New()
+	quiet.SetOutput(io.Discard)
+	SetLogger(quiet)
+	defer SetLogger(logrus.StandardLogger())
+
+	for _, n := range []int{10000, 100000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			// Serve the data over HTTP so that decoding is measured too
+			srv := smdtest.NewServer(benchInventory(n))
+			defer srv.Close()
+			c, err := NewCache("1h", srv.Client())
+			if err != nil {
+				b.Fatalf("NewCache: %v", err)
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := c.Refresh(context.Background()); err != nil {
+					b.Fatalf("Refresh: %v", err)
+				}
+			}
+			b.StopTimer()
+
+			// Report what the cache holds on to once garbage is collected
+			var before, after runtime.MemStats
+			c.snapshot.Store(newSnapshot(nil, nil))
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			if err := c.Refresh(context.Background()); err != nil {
+				b.Fatalf("Refresh: %v", err)
+			}
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			b.ReportMetric((float64(after.HeapAlloc)-float64(before.HeapAlloc))/float64(n), "heap-B/iface")
+			runtime.KeepAlive(c)
+		})
+	}
+}
+
+func BenchmarkLookupMAC(b *testing.B) {
+	for _, n := range []int{10000, 100000} {
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			eis, comps := benchInventory(n)
+			eiMap := make(map[string]smdclient.EthernetInterface, n)
+			compMap := make(map[string]smdclient.Component, n)
+			for i := range eis {
+				eiMap[eis[i].MACAddress] = eis[i]
+				compMap[comps[i].ID] = comps[i]
+			}
+			s := newSnapshot(eiMap, compMap)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := s.LookupMAC(eis[i%n].MACAddress); err != nil {
+					b.Fatalf("LookupMAC: %v", err)
+				}
+			}
+		})
+	}
+}
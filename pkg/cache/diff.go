@@ -0,0 +1,118 @@
+package cache
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DiffLogging sets what Refresh logs about how the cached data changed since
+// the previous refresh.
+type DiffLogging int
+
+const (
+	// DiffSummary logs the number of interfaces added, removed, and
+	// changed, and which Components disappeared.
+	DiffSummary DiffLogging = iota
+	// DiffDetail additionally logs the MAC addresses of the added, removed,
+	// and changed interfaces in a structured log line.
+	DiffDetail
+	// DiffOff logs nothing.
+	DiffOff
+)
+
+// ParseDiffLogging parses "summary", "detail", or "off".
+func ParseDiffLogging(s string) (DiffLogging, error) {
+	switch s {
+	case "summary":
+		return DiffSummary, nil
+	case "detail":
+		return DiffDetail, nil
+	case "off":
+		return DiffOff, nil
+	}
+	return 0, fmt.Errorf("invalid refresh diff logging %q: expected summary, detail, or off", s)
+}
+
+// SnapshotDiff lists the changes between two Snapshots that affect DHCP: the
+// MAC addresses of interfaces served (Snapshot.Interfaces) that were added,
+// removed, or changed, and the IDs of Components that were added or removed.
+type SnapshotDiff struct {
+	Added             []string
+	Removed           []string
+	Changed           []string
+	AddedComponents   []string
+	RemovedComponents []string
+}
+
+// diffSnapshots returns the changes from old to new, each list sorted.
+func diffSnapshots(old, new *Snapshot) SnapshotDiff {
+	var d SnapshotDiff
+	for mac, ii := range new.Interfaces {
+		prev, ok := old.Interfaces[mac]
+		switch {
+		case !ok:
+			d.Added = append(d.Added, mac)
+		case !reflect.DeepEqual(prev, ii):
+			d.Changed = append(d.Changed, mac)
+		}
+	}
+	for mac := range old.Interfaces {
+		if _, ok := new.Interfaces[mac]; !ok {
+			d.Removed = append(d.Removed, mac)
+		}
+	}
+	for id := range new.Components {
+		if _, ok := old.Components[id]; !ok {
+			d.AddedComponents = append(d.AddedComponents, id)
+		}
+	}
+	for id := range old.Components {
+		if _, ok := new.Components[id]; !ok {
+			d.RemovedComponents = append(d.RemovedComponents, id)
+		}
+	}
+	for _, l := range [][]string{d.Added, d.Removed, d.Changed, d.AddedComponents, d.RemovedComponents} {
+		sort.Strings(l)
+	}
+
+	return d
+}
+
+func (d SnapshotDiff) empty() bool {
+	return len(d.Added)+len(d.Removed)+len(d.Changed)+len(d.AddedComponents)+len(d.RemovedComponents) == 0
+}
+
+func (d SnapshotDiff) String() string {
+	s := fmt.Sprintf("%d interface(s) added, %d removed, %d changed; %d Component(s) added, %d removed",
+		len(d.Added), len(d.Removed), len(d.Changed), len(d.AddedComponents), len(d.RemovedComponents))
+	if len(d.RemovedComponents) > 0 {
+		s += " (" + strings.Join(d.RemovedComponents, ", ") + ")"
+	}
+	return s
+}
+
+// logDiff logs the changes in d at the level of detail set by mode.
+func logDiff(mode DiffLogging, d SnapshotDiff) {
+	if mode == DiffOff {
+		return
+	}
+	if d.empty() {
+		log.Debug("cache unchanged since last refresh")
+		return
+	}
+	if mode == DiffDetail {
+		log.WithFields(logrus.Fields{
+			"added":              d.Added,
+			"removed":            d.Removed,
+			"changed":            d.Changed,
+			"added_components":   d.AddedComponents,
+			"removed_components": d.RemovedComponents,
+		}).Infof("cache changed since last refresh: %s", d)
+		return
+	}
+	log.Infof("cache changed since last refresh: %s", d)
+}
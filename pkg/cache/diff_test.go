@@ -0,0 +1,79 @@
+package cache
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/OpenCHAMI/coresmd/pkg/smdclient"
+)
+
+func TestDiffSnapshots(t *testing.T) {
+	fake := smdclient.NewFakeSmdClient(
+		[]smdclient.EthernetInterface{
+			testEI("aa:bb:cc:dd:ee:01", "x1000c0s0b0n0", "10.0.0.1"),
+			testEI("aa:bb:cc:dd:ee:02", "x1000c0s1b0n0", "10.0.0.2"),
+			testEI("aa:bb:cc:dd:ee:03", "x1000c0s2b0n0", "10.0.0.3"),
+		},
+		[]smdclient.Component{
+			{ID: "x1000c0s0b0n0", Type: "Node", NID: 1},
+			{ID: "x1000c0s1b0n0", Type: "Node", NID: 2},
+			{ID: "x1000c0s2b0n0", Type: "Node", NID: 3},
+		},
+	)
+	c, err := NewCache("1h", fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	old := c.Snapshot()
+
+	// Change the IP of one node, remove another, and add a third
+	fake.Set(
+		[]smdclient.EthernetInterface{
+			testEI("aa:bb:cc:dd:ee:01", "x1000c0s0b0n0", "10.0.0.1"),
+			testEI("aa:bb:cc:dd:ee:02", "x1000c0s1b0n0", "10.0.0.20"),
+			testEI("aa:bb:cc:dd:ee:04", "x1000c0s3b0n0", "10.0.0.4"),
+		},
+		[]smdclient.Component{
+			{ID: "x1000c0s0b0n0", Type: "Node", NID: 1},
+			{ID: "x1000c0s1b0n0", Type: "Node", NID: 2},
+			{ID: "x1000c0s3b0n0", Type: "Node", NID: 4},
+		},
+	)
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	got := diffSnapshots(old, c.Snapshot())
+	want := SnapshotDiff{
+		Added:             []string{"aa:bb:cc:dd:ee:04"},
+		Removed:           []string{"aa:bb:cc:dd:ee:03"},
+		Changed:           []string{"aa:bb:cc:dd:ee:02"},
+		AddedComponents:   []string{"x1000c0s3b0n0"},
+		RemovedComponents: []string{"x1000c0s2b0n0"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diffSnapshots:\ngot  %+v\nwant %+v", got, want)
+	}
+	if wantStr := "1 interface(s) added, 1 removed, 1 changed; 1 Component(s) added, 1 removed (x1000c0s2b0n0)"; got.String() != wantStr {
+		t.Errorf("String() = %q, want %q", got.String(), wantStr)
+	}
+
+	if d := diffSnapshots(c.Snapshot(), c.Snapshot()); !d.empty() {
+		t.Errorf("diff of a snapshot with itself is not empty: %+v", d)
+	}
+}
+
+func TestParseDiffLogging(t *testing.T) {
+	for s, want := range map[string]DiffLogging{"summary": DiffSummary, "detail": DiffDetail, "off": DiffOff} {
+		if got, err := ParseDiffLogging(s); err != nil || got != want {
+			t.Errorf("ParseDiffLogging(%q) = %v, %v; want %v", s, got, err, want)
+		}
+	}
+	if _, err := ParseDiffLogging("verbose"); err == nil {
+		t.Error("ParseDiffLogging(\"verbose\"): expected error")
+	}
+}
@@ -0,0 +1,15 @@
+// Package cache keeps a periodically refreshed, immutable snapshot of the SMD
+// data coresmd serves DHCP from, indexed for lookups by MAC address, IP
+// address, client identifier, and Component. Readers never take a lock: each
+// refresh builds a new Snapshot and swaps it in whole.
+package cache
+
+import "github.com/sirupsen/logrus"
+
+var log logrus.FieldLogger = logrus.StandardLogger()
+
+// SetLogger makes the package log to l instead of the standard logrus logger.
+// It must be called before any cache is used.
+func SetLogger(l logrus.FieldLogger) {
+	log = l
+}
@@ -0,0 +1,133 @@
+package cache
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/OpenCHAMI/coresmd/pkg/smdclient"
+)
+
+// SMD is not guaranteed to hold each MAC address and IP address only once: an
+// EthernetInterface may be added twice with differently formatted MAC
+// addresses, and nothing stops two EthernetInterfaces from being given the
+// same IP address. Rather than serve whichever was loaded last, the cache
+// picks one owner for each by the rules below, independent of the order SMD
+// returned them in, and reports the others.
+
+// preferInterface reports whether EthernetInterface a takes precedence over b
+// for the same MAC address: one whose Component is cached wins, then one with
+// IP addresses, then the one with the lowest Component ID.
+func preferInterface(a, b smdclient.EthernetInterface, compMap map[string]smdclient.Component) bool {
+	_, aComp := compMap[a.ComponentID]
+	_, bComp := compMap[b.ComponentID]
+	if aComp != bComp {
+		return aComp
+	}
+	if (len(a.IPAddresses) > 0) != (len(b.IPAddresses) > 0) {
+		return len(a.IPAddresses) > 0
+	}
+	return a.ComponentID < b.ComponentID
+}
+
+// resolveDuplicateMACs picks the EthernetInterface to keep for each MAC
+// address in dupes, which holds every EthernetInterface SMD returned for it,
+// and stores it in eiMap. It returns the IDs of the Components claiming each
+// MAC address that is claimed by more than one Component, winner first.
+func resolveDuplicateMACs(eiMap map[string]smdclient.EthernetInterface, dupes map[string][]smdclient.EthernetInterface, compMap map[string]smdclient.Component) map[string][]string {
+	conflicts := make(map[string][]string)
+	for mac, eis := range dupes {
+		sort.SliceStable(eis, func(i, j int) bool { return preferInterface(eis[i], eis[j], compMap) })
+		eiMap[mac] = eis[0]
+
+		ids := []string{eis[0].ComponentID}
+		for _, ei := range eis[1:] {
+			if !slices.Contains(ids, ei.ComponentID) {
+				ids = append(ids, ei.ComponentID)
+			}
+		}
+		if len(ids) > 1 {
+			conflicts[mac] = ids
+			log.Warnf("MAC address %s is on multiple Components in SMD: %s, using %s", mac, strings.Join(ids, ", "), ids[0])
+		}
+	}
+
+	return conflicts
+}
+
+// Nodes are named after their NID, which SMD does not require to be set or
+// unique. A Node without a NID, or whose NID is also held by a Node with a lower
+// Component ID, is named after its Component ID instead, so that no two Nodes
+// are handed the same hostname.
+
+// NIDHostname returns the hostname generated for a Node with NID nid.
+func NIDHostname(nid int64) string {
+	return fmt.Sprintf("nid%04d", nid)
+}
+
+// checkNIDs returns the IDs of the Nodes in compMap sharing each NID, lowest
+// first, and the sorted IDs of the Nodes without a (positive) NID.
+func checkNIDs(compMap map[string]smdclient.Component) (map[int64][]string, []string) {
+	holders := make(map[int64][]string)
+	var missing []string
+	for id, comp := range compMap {
+		switch {
+		case comp.Type != "Node":
+		case comp.NID <= 0:
+			missing = append(missing, id)
+		default:
+			holders[comp.NID] = append(holders[comp.NID], id)
+		}
+	}
+	dupes := make(map[int64][]string)
+	for nid, ids := range holders {
+		if len(ids) < 2 {
+			continue
+		}
+		sort.Strings(ids)
+		dupes[nid] = ids
+		log.Warnf("NID %d is on multiple Nodes in SMD: %s, naming %s %s and the others after their Component IDs", nid, strings.Join(ids, ", "), ids[0], NIDHostname(nid))
+	}
+	sort.Strings(missing)
+	if len(missing) > 0 {
+		log.Warnf("%d Node(s) in SMD have no NID and are named after their Component IDs: %s", len(missing), strings.Join(missing, ", "))
+	}
+
+	return dupes, missing
+}
+
+// nodeHostname returns the hostname of Node comp given the NIDs held by
+// multiple Nodes.
+func nodeHostname(comp smdclient.Component, dupNIDs map[int64][]string) string {
+	if ids, dup := dupNIDs[comp.NID]; comp.NID <= 0 || dup && ids[0] != comp.ID {
+		return comp.ID
+	}
+	return NIDHostname(comp.NID)
+}
+
+// resolveDuplicateIPs picks the owner of each IP address in owners, which maps
+// IP addresses to the MAC addresses of every EthernetInterface holding it. An
+// EthernetInterface whose Component is cached wins, then the one with the
+// lowest MAC address. It returns the MAC addresses holding each IP address
+// held by more than one, winner first.
+func resolveDuplicateIPs(owners map[string][]string, eiMap map[string]smdclient.EthernetInterface, compMap map[string]smdclient.Component) map[string][]string {
+	conflicts := make(map[string][]string)
+	for ip, macs := range owners {
+		if len(macs) < 2 {
+			continue
+		}
+		sort.Slice(macs, func(i, j int) bool {
+			_, iComp := compMap[eiMap[macs[i]].ComponentID]
+			_, jComp := compMap[eiMap[macs[j]].ComponentID]
+			if iComp != jComp {
+				return iComp
+			}
+			return macs[i] < macs[j]
+		})
+		conflicts[ip] = macs
+		log.Warnf("IP address %s is on multiple EthernetInterfaces in SMD: %s, assigning it to %s only", ip, strings.Join(macs, ", "), macs[0])
+	}
+
+	return conflicts
+}
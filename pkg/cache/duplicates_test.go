@@ -0,0 +1,111 @@
+package cache
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/OpenCHAMI/coresmd/pkg/smdclient"
+)
+
+func testEI(mac, compID string, ips ...string) smdclient.EthernetInterface {
+	ei := smdclient.EthernetInterface{MACAddress: mac, ComponentID: compID}
+	for _, ip := range ips {
+		ei.IPAddresses = append(ei.IPAddresses, struct {
+			IPAddress string `json:"IPAddress"`
+		}{ip})
+	}
+	return ei
+}
+
+func TestCacheDuplicates(t *testing.T) {
+	comps := []smdclient.Component{
+		{ID: "x1000c0s0b0n0", Type: "Node", NID: 1},
+		{ID: "x1000c0s1b0n0", Type: "Node", NID: 2},
+		{ID: "x1000c0s2b0n0", Type: "Node", NID: 3},
+	}
+	eis := []smdclient.EthernetInterface{
+		// Same IP on two interfaces
+		testEI("aa:bb:cc:dd:ee:02", "x1000c0s1b0n0", "10.0.0.1", "10.0.0.2"),
+		testEI("aa:bb:cc:dd:ee:01", "x1000c0s0b0n0", "10.0.0.1"),
+		// Same MAC on two Components, one of which is not cached
+		testEI("AA-BB-CC-DD-EE-03", "x9999c0s0b0n0", "10.0.0.9"),
+		testEI("aa:bb:cc:dd:ee:03", "x1000c0s2b0n0", "10.0.0.3"),
+	}
+
+	// The outcome must not depend on the order SMD returns things in
+	for _, order := range [][]int{{0, 1, 2, 3}, {3, 2, 1, 0}} {
+		var ordered []smdclient.EthernetInterface
+		for _, i := range order {
+			ordered = append(ordered, eis[i])
+		}
+		c, err := NewCache("1h", smdclient.NewFakeSmdClient(ordered, comps))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Refresh(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		s := c.Snapshot()
+
+		if want := map[string][]string{"10.0.0.1": {"aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02"}}; !reflect.DeepEqual(s.DuplicateIPs, want) {
+			t.Errorf("order %v: DuplicateIPs = %v, want %v", order, s.DuplicateIPs, want)
+		}
+		if got := s.IPAddresses["10.0.0.1"]; got != "aa:bb:cc:dd:ee:01" {
+			t.Errorf("order %v: 10.0.0.1 belongs to %s, want aa:bb:cc:dd:ee:01", order, got)
+		}
+		if ips := s.Interfaces["aa:bb:cc:dd:ee:02"].IPList; len(ips) != 1 || ips[0].String() != "10.0.0.2" {
+			t.Errorf("order %v: losing interface has IPs %v, want [10.0.0.2]", order, ips)
+		}
+
+		if want := map[string][]string{"aa:bb:cc:dd:ee:03": {"x1000c0s2b0n0", "x9999c0s0b0n0"}}; !reflect.DeepEqual(s.DuplicateMACs, want) {
+			t.Errorf("order %v: DuplicateMACs = %v, want %v", order, s.DuplicateMACs, want)
+		}
+		if got := s.Interfaces["aa:bb:cc:dd:ee:03"].CompID; got != "x1000c0s2b0n0" {
+			t.Errorf("order %v: aa:bb:cc:dd:ee:03 belongs to %s, want x1000c0s2b0n0", order, got)
+		}
+	}
+}
+
+func TestCacheNIDs(t *testing.T) {
+	comps := []smdclient.Component{
+		{ID: "x1000c0s0b0n0", Type: "Node", NID: 1},
+		{ID: "x1000c0s1b0n0", Type: "Node", NID: 1},
+		{ID: "x1000c0s2b0n0", Type: "Node"},
+		{ID: "x1000c0s3b0n0", Type: "Node", NID: 3},
+		{ID: "x1000c0s0b0", Type: "NodeBMC"},
+	}
+	eis := []smdclient.EthernetInterface{
+		testEI("aa:bb:cc:dd:ee:01", "x1000c0s0b0n0", "10.0.0.1"),
+		testEI("aa:bb:cc:dd:ee:02", "x1000c0s1b0n0", "10.0.0.2"),
+		testEI("aa:bb:cc:dd:ee:03", "x1000c0s2b0n0", "10.0.0.3"),
+		testEI("aa:bb:cc:dd:ee:04", "x1000c0s3b0n0", "10.0.0.4"),
+		testEI("aa:bb:cc:dd:ee:05", "x1000c0s0b0", "10.0.0.5"),
+	}
+	c, err := NewCache("1h", smdclient.NewFakeSmdClient(eis, comps))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	s := c.Snapshot()
+
+	if want := map[int64][]string{1: {"x1000c0s0b0n0", "x1000c0s1b0n0"}}; !reflect.DeepEqual(s.DuplicateNIDs, want) {
+		t.Errorf("DuplicateNIDs = %v, want %v", s.DuplicateNIDs, want)
+	}
+	if want := []string{"x1000c0s2b0n0"}; !reflect.DeepEqual(s.MissingNIDs, want) {
+		t.Errorf("MissingNIDs = %v, want %v", s.MissingNIDs, want)
+	}
+	for mac, want := range map[string]string{
+		"aa:bb:cc:dd:ee:01": "nid0001",
+		"aa:bb:cc:dd:ee:02": "x1000c0s1b0n0", // NID taken by a lower Component ID
+		"aa:bb:cc:dd:ee:03": "x1000c0s2b0n0", // no NID
+		"aa:bb:cc:dd:ee:04": "nid0003",
+		"aa:bb:cc:dd:ee:05": "", // not a Node
+	} {
+		if got := s.Interfaces[mac].Hostname; got != want {
+			t.Errorf("hostname of %s = %q, want %q", mac, got, want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/OpenCHAMI/coresmd/pkg/smdclient"
+)
+
+// snapshotFile is the JSON document a Cache saves its data in so that it can
+// start from it while SMD is unreachable.
+type snapshotFile struct {
+	LastUpdated        time.Time                              `json:"last_updated"`
+	EthernetInterfaces map[string]smdclient.EthernetInterface `json:"ethernet_interfaces"`
+	Components         map[string]smdclient.Component         `json:"components"`
+	DuplicateMACs      map[string][]string                    `json:"duplicate_macs,omitempty"`
+	Groups             []smdclient.Group                      `json:"groups,omitempty"`
+	Partitions         []smdclient.Partition                  `json:"partitions,omitempty"`
+}
+
+// saveSnapshot writes s to path, replacing the file atomically so that a
+// crash while writing does not leave a truncated snapshot behind.
+func saveSnapshot(path string, s *Snapshot) error {
+	var (
+		groups []smdclient.Group
+		parts  []smdclient.Partition
+	)
+	for _, g := range s.Groups {
+		groups = append(groups, g)
+	}
+	for _, p := range s.Partitions {
+		parts = append(parts, p)
+	}
+	data, err := json.Marshal(snapshotFile{
+		LastUpdated:        s.LastUpdated,
+		EthernetInterfaces: s.EthernetInterfaces,
+		Components:         s.Components,
+		DuplicateMACs:      s.DuplicateMACs,
+		Groups:             groups,
+		Partitions:         parts,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// LoadSnapshotFile fills the cache from SnapshotFile, keeping the time the
+// data was fetched so that max_staleness still applies. It does nothing if
+// the cache has already been refreshed from SMD.
+func (c *Cache) LoadSnapshotFile() error {
+	c.mu.Lock()
+	path := c.SnapshotFile
+	c.mu.Unlock()
+	if path == "" {
+		return fmt.Errorf("no snapshot file set")
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	var f snapshotFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return fmt.Errorf("failed to decode snapshot %s: %w", path, err)
+	}
+	s := newSnapshot(f.EthernetInterfaces, f.Components)
+	s.LastUpdated = f.LastUpdated
+	s.DuplicateMACs = f.DuplicateMACs
+	s.setGroups(f.Groups, f.Partitions)
+
+	// Don't replace data fetched from SMD in the meantime
+	old := c.Snapshot()
+	if !old.LastUpdated.IsZero() || !c.snapshot.CompareAndSwap(old, s) {
+		return nil
+	}
+	log.Infof("loaded %d EthernetInterfaces and %d Components from snapshot %s taken %s", len(f.EthernetInterfaces), len(f.Components), path, f.LastUpdated.Format(time.RFC3339))
+
+	return nil
+}
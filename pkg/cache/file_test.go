@@ -0,0 +1,77 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/OpenCHAMI/coresmd/pkg/smdclient"
+)
+
+func TestCacheSnapshotFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	fake := smdclient.NewFakeSmdClient(
+		[]smdclient.EthernetInterface{testEI("aa:bb:cc:dd:ee:01", "x3000c0s0b0n0", "172.16.0.1")},
+		[]smdclient.Component{{ID: "x3000c0s0b0n0", NID: 1, Type: "Node"}},
+	)
+	c, err := NewCache("1h", fake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SnapshotFile = path
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	saved := c.Snapshot()
+
+	// A new cache whose SMD is down starts from the snapshot
+	down := smdclient.NewFakeSmdClient(nil, nil)
+	down.SetErr(errors.New("connection refused"))
+	c2, err := NewCache("1h", down)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c2.SnapshotFile = path
+	if err := c2.RefreshLoop(context.Background()); err == nil {
+		t.Fatal("RefreshLoop returned no error with SMD down")
+	}
+	defer c2.Close()
+	if err := c2.LoadSnapshotFile(); err != nil {
+		t.Fatal(err)
+	}
+
+	s := c2.Snapshot()
+	if !s.LastUpdated.Equal(saved.LastUpdated) {
+		t.Errorf("LastUpdated = %s, want time of the saved refresh %s", s.LastUpdated, saved.LastUpdated)
+	}
+	ii, ok := s.Interfaces["aa:bb:cc:dd:ee:01"]
+	if !ok || ii.CompID != "x3000c0s0b0n0" || len(ii.IPList) != 1 {
+		t.Errorf("interface from snapshot = %+v, %t", ii, ok)
+	}
+}
+
+func TestLoadSnapshotFileKeepsFreshData(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot.json")
+	old := newSnapshot(nil, map[string]smdclient.Component{"x1": {ID: "x1"}})
+	old.LastUpdated = time.Now().Add(-time.Hour)
+	if err := saveSnapshot(path, old); err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := NewCache("1h", smdclient.NewFakeSmdClient(nil, []smdclient.Component{{ID: "x2"}}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.SnapshotFile = path
+	if err := c.Refresh(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.LoadSnapshotFile(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Snapshot().Components["x2"]; !ok {
+		t.Error("snapshot file replaced data refreshed from SMD")
+	}
+}
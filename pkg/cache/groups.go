@@ -0,0 +1,68 @@
+package cache
+
+import (
+	"slices"
+
+	"github.com/OpenCHAMI/coresmd/pkg/smdclient"
+)
+
+// setGroups indexes groups and partitions by Component, and records the groups
+// and partition of each interface's Component in s.Interfaces. It must be
+// called before s is stored in a Cache.
+func (s *Snapshot) setGroups(groups []smdclient.Group, parts []smdclient.Partition) {
+	s.Groups = make(map[string]smdclient.Group, len(groups))
+	s.Partitions = make(map[string]smdclient.Partition, len(parts))
+	s.ComponentGroups = make(map[string][]string)
+	s.ComponentPartitions = make(map[string]string)
+	if len(groups) == 0 && len(parts) == 0 {
+		return
+	}
+
+	for _, g := range groups {
+		s.Groups[g.Label] = g
+		for _, id := range g.Members.IDs {
+			s.ComponentGroups[id] = append(s.ComponentGroups[id], g.Label)
+		}
+	}
+	for _, labels := range s.ComponentGroups {
+		slices.Sort(labels)
+	}
+	for _, p := range parts {
+		s.Partitions[p.Name] = p
+		for _, id := range p.Members.IDs {
+			if prev, ok := s.ComponentPartitions[id]; ok {
+				log.Warnf("Component %s is in partitions %s and %s; using %s", id, prev, p.Name, prev)
+				continue
+			}
+			s.ComponentPartitions[id] = p.Name
+		}
+	}
+
+	for mac, ii := range s.Interfaces {
+		ii.Groups = s.ComponentGroups[ii.CompID]
+		ii.Partition = s.ComponentPartitions[ii.CompID]
+		s.Interfaces[mac] = ii
+	}
+}
+
+// InGroup reports whether Component id is in the group labeled label.
+func (s *Snapshot) InGroup(id, label string) bool {
+	return slices.Contains(s.ComponentGroups[id], label)
+}
+
+// GroupsOf returns the sorted labels of the groups Component id is in. The
+// result must not be modified.
+func (s *Snapshot) GroupsOf(id string) []string {
+	return s.ComponentGroups[id]
+}
+
+// PartitionOf returns the name of the partition Component id is in, or "".
+func (s *Snapshot) PartitionOf(id string) string {
+	return s.ComponentPartitions[id]
+}
+
+// GroupMembers returns the IDs of the Components in the group labeled label.
+// The result must not be modified.
+func (s *Snapshot) GroupMembers(label string) []string {
+	return s.Groups[label].Members.IDs
+}
@@ -0,0 +1,81 @@
+package cache
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/OpenCHAMI/coresmd/pkg/smdclient"
+)
+
+// IfaceInfo is what the cache knows about an interface it can serve: the
+// Component it belongs to and the IP addresses assigned to it.
+type IfaceInfo struct {
+	CompID  string
+	CompNID int64
+	Type    string
+	Role    string
+	SubRole string
+	MAC     string
+	IPList  []net.IP
+	// Hostname is the hostname generated for a Node: nidNNNN, or its
+	// Component ID if its NID is missing or held by another Node
+	Hostname string
+	// Overrides are the boot overrides of the Component
+	Overrides smdclient.BootOverrides
+	// Groups are the sorted labels of the SMD groups the Component is in,
+	// and Partition the SMD partition it is in, if the cache fetches them
+	Groups    []string
+	Partition string
+}
+
+// clientIDPrefix marks a client identifier in an EthernetInterface
+// description, e.g. "client_id=01aabbccddeeff".
+const clientIDPrefix = "client_id="
+
+// LookupMAC returns the interface with hardware address mac, in any format
+// accepted by NormalizeMAC, or an error saying why it cannot be served.
+func (s *Snapshot) LookupMAC(mac string) (IfaceInfo, error) {
+	// Addresses are usually normalized already
+	if _, ok := s.Interfaces[mac]; !ok {
+		norm, err := NormalizeMAC(mac)
+		if err != nil {
+			return IfaceInfo{}, err
+		}
+		mac = norm
+	}
+	if ii, ok := s.Interfaces[mac]; ok {
+		return ii, nil
+	}
+
+	// No usable interface was found, so determine why
+	ei, ok := s.EthernetInterfaces[mac]
+	if !ok {
+		return IfaceInfo{}, fmt.Errorf("no EthernetInterfaces were found in cache for hardware address %s", mac)
+	}
+	comp, ok := s.Components[ei.ComponentID]
+	if !ok {
+		return IfaceInfo{}, fmt.Errorf("no Component %s found in cache for EthernetInterface hardware address %s", ei.ComponentID, mac)
+	}
+
+	return IfaceInfo{}, fmt.Errorf("EthernetInterface for Component %s (type %s) contains no valid IP addresses for hardware address %s", comp.ID, comp.Type, mac)
+}
+
+// descriptionClientID returns the client identifier declared in an
+// EthernetInterface description as lowercase hex without separators, or an
+// empty string if there is none.
+func descriptionClientID(description string) string {
+	for _, field := range strings.Fields(description) {
+		if cid, ok := strings.CutPrefix(field, clientIDPrefix); ok {
+			cid = strings.ToLower(strings.NewReplacer(":", "", "-", "", ".", "").Replace(cid))
+			if _, err := hex.DecodeString(cid); err != nil {
+				log.Warnf("ignoring invalid client identifier %q in EthernetInterface description", cid)
+				return ""
+			}
+			return cid
+		}
+	}
+
+	return ""
+}
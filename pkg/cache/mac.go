@@ -0,0 +1,60 @@
+package cache
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// NormalizeMAC returns mac in the canonical form used for cache keys and
+// lookups: lowercase hex octets separated by colons (e.g. "aa:bb:cc:dd:ee:ff").
+// It accepts any case with colon, dash, or Cisco-style dot separators, as well
+// as bare hex digits, for 6-byte (MAC-48), 8-byte (EUI-64), and 20-byte
+// (IPoIB) addresses.
+func NormalizeMAC(mac string) (string, error) {
+	if isNormalMAC(mac) {
+		return mac, nil
+	}
+	mac = strings.TrimSpace(mac)
+	if !strings.ContainsAny(mac, ":-.") {
+		b, err := hex.DecodeString(mac)
+		if err != nil {
+			return "", fmt.Errorf("invalid hardware address %q: %w", mac, err)
+		}
+		switch len(b) {
+		case 6, 8, 20:
+			return net.HardwareAddr(b).String(), nil
+		default:
+			return "", fmt.Errorf("invalid hardware address %q: unsupported length %d", mac, len(b))
+		}
+	}
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return "", fmt.Errorf("invalid hardware address %q: %w", mac, err)
+	}
+
+	return hw.String(), nil
+}
+
+// isNormalMAC reports whether mac is already in the form returned by
+// NormalizeMAC, as most addresses in SMD and all those of DHCP clients are, so
+// that it can be used without allocating a copy.
+func isNormalMAC(mac string) bool {
+	switch len(mac) {
+	case 17, 23, 59:
+	default:
+		return false
+	}
+	for i := 0; i < len(mac); i++ {
+		c := mac[i]
+		if i%3 == 2 {
+			if c != ':' {
+				return false
+			}
+		} else if !('0' <= c && c <= '9' || 'a' <= c && c <= 'f') {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,57 @@
+package cache
+
+import "testing"
+
+func TestNormalizeMAC(t *testing.T) {
+	tests := []struct {
+		name    string
+		mac     string
+		want    string
+		wantErr bool
+	}{
+		{name: "lowercase colons", mac: "aa:bb:cc:dd:ee:ff", want: "aa:bb:cc:dd:ee:ff"},
+		{name: "uppercase colons", mac: "AA:BB:CC:DD:EE:FF", want: "aa:bb:cc:dd:ee:ff"},
+		{name: "mixed case dashes", mac: "Aa-bB-cc-DD-ee-FF", want: "aa:bb:cc:dd:ee:ff"},
+		{name: "cisco dots", mac: "aabb.ccdd.eeff", want: "aa:bb:cc:dd:ee:ff"},
+		{name: "cisco dots uppercase", mac: "AABB.CCDD.EEFF", want: "aa:bb:cc:dd:ee:ff"},
+		{name: "bare hex", mac: "AABBCCDDEEFF", want: "aa:bb:cc:dd:ee:ff"},
+		{name: "surrounding whitespace", mac: " aa:bb:cc:dd:ee:ff\n", want: "aa:bb:cc:dd:ee:ff"},
+		{name: "eui-64 colons", mac: "02:00:5E:FF:FE:00:53:01", want: "02:00:5e:ff:fe:00:53:01"},
+		{name: "eui-64 dashes", mac: "02-00-5e-ff-fe-00-53-01", want: "02:00:5e:ff:fe:00:53:01"},
+		{name: "eui-64 cisco dots", mac: "0200.5eff.fe00.5301", want: "02:00:5e:ff:fe:00:53:01"},
+		{name: "eui-64 bare hex", mac: "02005EFFFE005301", want: "02:00:5e:ff:fe:00:53:01"},
+		{name: "ipoib", mac: "00:00:01:00:fe:80:00:00:00:00:00:00:02:c9:03:00:00:0f:12:34", want: "00:00:01:00:fe:80:00:00:00:00:00:00:02:c9:03:00:00:0f:12:34"},
+		{name: "empty", mac: "", wantErr: true},
+		{name: "too short", mac: "aa:bb:cc:dd:ee", wantErr: true},
+		{name: "bad bare length", mac: "aabbccddee", wantErr: true},
+		{name: "non-hex", mac: "gg:bb:cc:dd:ee:ff", wantErr: true},
+		{name: "mixed separators", mac: "aa:bb-cc:dd:ee:ff", wantErr: true},
+		{name: "no separators in normal length", mac: "aabbccddeeff01234", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NormalizeMAC(tt.mac)
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("NormalizeMAC(%q) = %q, want error", tt.mac, got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NormalizeMAC(%q) returned error: %v", tt.mac, err)
+			}
+			if got != tt.want {
+				t.Errorf("NormalizeMAC(%q) = %q, want %q", tt.mac, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeMACNoAlloc(t *testing.T) {
+	// Addresses already normalized, like those of DHCP clients, are
+	// returned as is
+	if n := testing.AllocsPerRun(10, func() { NormalizeMAC("aa:bb:cc:dd:ee:ff") }); n != 0 {
+		t.Errorf("NormalizeMAC of a normalized address allocated %v times", n)
+	}
+}
@@ -0,0 +1,10 @@
+package cache
+
+import "github.com/OpenCHAMI/coresmd/internal/metrics"
+
+var (
+	metricDuplicates = metrics.NewGauge("coresmd_smd_duplicates",
+		"IP addresses (kind=ip) on multiple EthernetInterfaces, MAC addresses (kind=mac) on multiple Components, and NIDs (kind=nid) on multiple Nodes in SMD as of the last refresh.", "kind")
+	metricMissingNIDs = metrics.NewGauge("coresmd_smd_nodes_without_nid",
+		"Nodes in SMD without a NID as of the last refresh, which are named after their Component IDs.")
+)
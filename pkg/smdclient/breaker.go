@@ -0,0 +1,129 @@
+package smdclient
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// DefaultBreakerThreshold and DefaultBreakerCooldown are the circuit breaker
+// settings of clients returned by NewSmdClient.
+const (
+	DefaultBreakerThreshold = 5
+	DefaultBreakerCooldown  = 30 * time.Second
+)
+
+// ErrCircuitOpen is returned by HTTPSmdClient instead of querying SMD while
+// its circuit breaker is open.
+var ErrCircuitOpen = errors.New("circuit breaker is open, not querying SMD")
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "open"
+	}
+}
+
+// circuitBreaker stops requests to SMD once it is clearly down so that it is
+// not hammered with retries while it recovers.
+//
+// The breaker opens after threshold consecutive failed requests. While open,
+// requests fail immediately with ErrCircuitOpen. Once cooldown has passed, a
+// single trial request is let through (half-open): the breaker closes if it
+// succeeds and opens again if it fails. A nil breaker or one with a threshold
+// of zero lets every request through.
+type circuitBreaker struct {
+	// name identifies the SMD instance in logs and metrics
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration) *circuitBreaker {
+	b := &circuitBreaker{
+		name:      name,
+		threshold: threshold,
+		cooldown:  cooldown,
+	}
+	metricBreakerState.Set(float64(breakerClosed), name)
+
+	return b
+}
+
+// allow returns ErrCircuitOpen if a request may not be made now.
+func (b *circuitBreaker) allow() error {
+	if b == nil || b.threshold <= 0 {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return ErrCircuitOpen
+		}
+		log.Infof("circuit breaker for SMD at %s is half-open, trying a request", b.name)
+		b.setState(breakerHalfOpen)
+		return nil
+	case breakerHalfOpen:
+		// Only the trial request is let through
+		return ErrCircuitOpen
+	}
+
+	return nil
+}
+
+// success records that SMD answered a request.
+func (b *circuitBreaker) success() {
+	if b == nil || b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state != breakerClosed {
+		log.Infof("circuit breaker for SMD at %s closed, SMD is reachable again", b.name)
+		b.setState(breakerClosed)
+	}
+	b.failures = 0
+}
+
+// failure records that a request to SMD failed after all retries.
+func (b *circuitBreaker) failure() {
+	if b == nil || b.threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.state == breakerHalfOpen || (b.state == breakerClosed && b.failures >= b.threshold) {
+		log.Warnf("circuit breaker for SMD at %s opened after %d consecutive failure(s), pausing requests for %s", b.name, b.failures, b.cooldown)
+		b.openedAt = time.Now()
+		b.setState(breakerOpen)
+	}
+}
+
+// setState changes the state of the breaker. b.mu must be held.
+func (b *circuitBreaker) setState(s breakerState) {
+	b.state = s
+	metricBreakerState.Set(float64(s), b.name)
+}
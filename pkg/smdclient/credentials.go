@@ -0,0 +1,117 @@
+package smdclient
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+// fileWatch tracks whether a file has changed since it was last checked, by
+// its modification time and size.
+type fileWatch struct {
+	path    string
+	modTime time.Time
+	size    int64
+}
+
+// newFileWatch returns a fileWatch for path as it is now.
+func newFileWatch(path string) *fileWatch {
+	w := &fileWatch{path: path}
+	w.changed()
+
+	return w
+}
+
+// changed reports whether the file has changed since the last call. A file
+// that cannot be read, or a nil w, is reported as unchanged so that the
+// previous contents stay in use.
+func (w *fileWatch) changed() bool {
+	if w == nil {
+		return false
+	}
+	fi, err := os.Stat(w.path)
+	if err != nil {
+		return false
+	}
+	if fi.ModTime().Equal(w.modTime) && fi.Size() == w.size {
+		return false
+	}
+	w.modTime, w.size = fi.ModTime(), fi.Size()
+
+	return true
+}
+
+// copy returns a copy of w, to check for changes without updating w.
+func (w *fileWatch) copy() *fileWatch {
+	if w == nil {
+		return nil
+	}
+	c := *w
+
+	return &c
+}
+
+// UseTokenFile makes the client authenticate to SMD with the bearer token in
+// the file at path. The file is read again whenever it changes, so rotated
+// tokens are used without a restart.
+func (sc *HTTPSmdClient) UseTokenFile(path string) error {
+	w := newFileWatch(path)
+	token, err := readToken(path)
+	if err != nil {
+		return err
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.token, sc.tokenFile = token, w
+
+	return nil
+}
+
+func readToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to read token: %w", err)
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", errors.New("token file is empty")
+	}
+
+	return token, nil
+}
+
+// reloadCredentials loads the CA certificate and token again if their files
+// changed since they were last loaded, rebuilding the transport for a new CA
+// certificate. If loading fails, the previous credentials are kept. The files
+// are checked without holding sc.mu, which is only locked to reload them.
+func (sc *HTTPSmdClient) reloadCredentials() {
+	sc.mu.RLock()
+	caFile, tokenFile := sc.caFile.copy(), sc.tokenFile.copy()
+	sc.mu.RUnlock()
+	if !caFile.changed() && !tokenFile.changed() {
+		return
+	}
+
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if sc.caFile != nil && sc.caFile.changed() {
+		if err := sc.setTLSConfig(sc.tlsSettings); err != nil {
+			log.Errorf("failed to reload CA certificate %s, keeping previous one: %v", sc.caFile.path, err)
+		} else {
+			log.Infof("reloaded CA certificate %s", sc.caFile.path)
+		}
+	}
+	if sc.tokenFile != nil && sc.tokenFile.changed() {
+		token, err := readToken(sc.tokenFile.path)
+		if err != nil {
+			log.Errorf("failed to reload SMD token %s, keeping previous one: %v", sc.tokenFile.path, err)
+			return
+		}
+		sc.token = token
+		log.Infof("reloaded SMD token %s", sc.tokenFile.path)
+	}
+}
@@ -0,0 +1,34 @@
+// Package smdclient is a client of the OpenCHAMI State Management Database
+// (SMD) API, fetching the EthernetInterfaces, Components, and related
+// inventory that coresmd serves DHCP from. HTTPSmdClient handles API version
+// negotiation, pagination, retries, a circuit breaker, and credentials that are
+// reloaded when their files change; FakeSmdClient serves fixed data for tests.
+package smdclient
+
+import (
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+var log logrus.FieldLogger = logrus.StandardLogger()
+
+// SetLogger makes the package log to l instead of the standard logrus logger.
+// It must be called before any client is used.
+func SetLogger(l logrus.FieldLogger) {
+	log = l
+}
+
+func tracer() oteltrace.Tracer {
+	return otel.Tracer("github.com/OpenCHAMI/coresmd/pkg/smdclient")
+}
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span oteltrace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
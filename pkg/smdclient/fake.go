@@ -0,0 +1,145 @@
+package smdclient
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// FakeSmdClient is an in-memory SmdClient for tests. It serves the
+// EthernetInterfaces, Components, RedfishEndpoints, Groups, and Partitions it
+// holds, applying type and role filters like SMD does, or Err if it is set.
+type FakeSmdClient struct {
+	mu     sync.Mutex
+	eis    []EthernetInterface
+	comps  []Component
+	res    []RedfishEndpoint
+	groups []Group
+	parts  []Partition
+	err    error
+	nCalls int
+}
+
+// NewFakeSmdClient returns a FakeSmdClient holding eis and comps.
+func NewFakeSmdClient(eis []EthernetInterface, comps []Component) *FakeSmdClient {
+	return &FakeSmdClient{eis: eis, comps: comps}
+}
+
+// Set replaces the data held by the fake.
+func (f *FakeSmdClient) Set(eis []EthernetInterface, comps []Component) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.eis, f.comps = eis, comps
+}
+
+// SetRedfishEndpoints replaces the RedfishEndpoints held by the fake.
+func (f *FakeSmdClient) SetRedfishEndpoints(res []RedfishEndpoint) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.res = res
+}
+
+// SetGroups replaces the Groups and Partitions held by the fake.
+func (f *FakeSmdClient) SetGroups(groups []Group, parts []Partition) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.groups, f.parts = groups, parts
+}
+
+// SetErr makes subsequent requests fail with err, or succeed if err is nil.
+func (f *FakeSmdClient) SetErr(err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.err = err
+}
+
+// Calls returns the number of requests made to the fake.
+func (f *FakeSmdClient) Calls() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.nCalls
+}
+
+func (f *FakeSmdClient) EthernetInterfaces(ctx context.Context, types []string) ([]EthernetInterface, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nCalls++
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	compTypes := make(map[string]string, len(f.comps))
+	for _, comp := range f.comps {
+		compTypes[comp.ID] = comp.Type
+	}
+	var eis []EthernetInterface
+	for _, ei := range f.eis {
+		if len(types) > 0 && !slices.Contains(types, compTypes[ei.ComponentID]) {
+			continue
+		}
+		eis = append(eis, ei)
+	}
+
+	return eis, nil
+}
+
+func (f *FakeSmdClient) Components(ctx context.Context, types, roles []string) ([]Component, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nCalls++
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	var comps []Component
+	for _, comp := range f.comps {
+		if len(types) > 0 && !slices.Contains(types, comp.Type) {
+			continue
+		}
+		if len(roles) > 0 && !slices.Contains(roles, comp.Role) {
+			continue
+		}
+		comps = append(comps, comp)
+	}
+
+	return comps, nil
+}
+
+func (f *FakeSmdClient) RedfishEndpoints(ctx context.Context, types []string) ([]RedfishEndpoint, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nCalls++
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	var res []RedfishEndpoint
+	for _, re := range f.res {
+		if len(types) > 0 && !slices.Contains(types, re.Type) {
+			continue
+		}
+		res = append(res, re)
+	}
+
+	return res, nil
+}
+
+func (f *FakeSmdClient) Groups(ctx context.Context) ([]Group, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nCalls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return slices.Clone(f.groups), nil
+}
+
+func (f *FakeSmdClient) Partitions(ctx context.Context) ([]Partition, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nCalls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return slices.Clone(f.parts), nil
+}
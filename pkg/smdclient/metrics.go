@@ -0,0 +1,10 @@
+package smdclient
+
+import "github.com/OpenCHAMI/coresmd/internal/metrics"
+
+var (
+	metricSMDRetries = metrics.NewCounter("coresmd_smd_request_retries_total",
+		"Requests to SMD retried after a transient error.", "smd")
+	metricBreakerState = metrics.NewGauge("coresmd_smd_circuit_breaker_state",
+		"State of the circuit breaker for requests to SMD (0: closed, 1: half-open, 2: open).", "smd")
+)
@@ -0,0 +1,45 @@
+package smdclient
+
+import "encoding/json"
+
+// BootOverrides are per-node boot settings read from the ExtraProperties of
+// SMD Components, letting admins change how a single node boots without
+// changing the plugin config. Other properties are ignored.
+type BootOverrides struct {
+	// Bootloader replaces the boot file given to clients not running iPXE
+	// yet (the "bootloader" property).
+	Bootloader string `json:"bootloader,omitempty"`
+	// BootScript replaces the boot script URL given to iPXE clients (the
+	// "bootscript" property).
+	BootScript string `json:"bootscript,omitempty"`
+	// NTPServers replaces the comma-separated NTP servers given to the node
+	// (the "ntp_servers" property).
+	NTPServers string `json:"ntp_servers,omitempty"`
+	// Timezone replaces the TZ database name of the time zone given to the
+	// node (the "timezone" property).
+	Timezone string `json:"timezone,omitempty"`
+}
+
+// UnmarshalJSON reads the boot overrides from an ExtraProperties object.
+// Properties that are not strings are ignored rather than failing the decoding
+// of every Component.
+func (bo *BootOverrides) UnmarshalJSON(data []byte) error {
+	var props map[string]json.RawMessage
+	if err := json.Unmarshal(data, &props); err != nil {
+		// Not an object, so there are no overrides
+		return nil
+	}
+	for key, dst := range map[string]*string{
+		"bootloader":  &bo.Bootloader,
+		"bootscript":  &bo.BootScript,
+		"ntp_servers": &bo.NTPServers,
+		"timezone":    &bo.Timezone,
+	} {
+		if raw, ok := props[key]; ok {
+			if err := json.Unmarshal(raw, dst); err != nil {
+				log.Debugf("ignoring non-string Component property %q: %s", key, raw)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package smdclient
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestBootOverrides(t *testing.T) {
+	var comps []Component
+	err := json.Unmarshal([]byte(`[
+		{"ID": "x1", "ExtraProperties": {"bootloader": "snponly.efi", "bootscript": "http://10.0.0.9/custom.ipxe", "rack": 7}},
+		{"ID": "x2", "ExtraProperties": {"bootloader": 42}},
+		{"ID": "x3", "ExtraProperties": "unexpected"},
+		{"ID": "x4"}
+	]`), &comps)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []BootOverrides{
+		{Bootloader: "snponly.efi", BootScript: "http://10.0.0.9/custom.ipxe"},
+		{},
+		{},
+		{},
+	}
+	for i, c := range comps {
+		if c.ExtraProperties != want[i] {
+			t.Errorf("%s: got %+v, want %+v", c.ID, c.ExtraProperties, want[i])
+		}
+	}
+}
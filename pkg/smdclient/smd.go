@@ -0,0 +1,798 @@
+package smdclient
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	oteltrace "go.opentelemetry.io/otel/trace"
+)
+
+var (
+	defaultTlsHandshakeTimeout   = 120 * time.Second
+	defaultResponseHeaderTimeout = 120 * time.Second
+	defaultDialTimeout           = 30 * time.Second
+	defaultMaxIdleConns          = 2
+)
+
+// SMD API versions, as set in HTTPSmdClient.APIVersion. SmdAPIAuto probes
+// the versions supported by SMD and uses the newest one.
+const (
+	SmdAPIAuto = "auto"
+	SmdAPIv2   = "v2"
+	SmdAPIv1   = "v1"
+)
+
+// smdAPIVersions are the SMD API versions this client speaks, newest first.
+var smdAPIVersions = []string{SmdAPIv2, SmdAPIv1}
+
+// DefaultRetries and DefaultRetryBackoff are the MaxRetries and RetryBackoff
+// of clients returned by NewSmdClient.
+const (
+	DefaultRetries      = 3
+	DefaultRetryBackoff = time.Second
+)
+
+const maxSMDRetryBackoff = 30 * time.Second
+
+// SmdClient fetches the inventory data cached by coresmd from SMD. Type and
+// role filters are passed through to SMD; empty filters match everything.
+type SmdClient interface {
+	EthernetInterfaces(ctx context.Context, types []string) ([]EthernetInterface, error)
+	Components(ctx context.Context, types, roles []string) ([]Component, error)
+}
+
+// HTTPSmdClient is an SmdClient that queries the SMD API over HTTP(S).
+//
+// Requests failing with a transient error (a network error, a 5xx status, or
+// 429 Too Many Requests) are retried up to MaxRetries times, waiting
+// RetryBackoff before the first retry and doubling the wait after each one.
+// Requests that still fail count towards the client's circuit breaker.
+type HTTPSmdClient struct {
+	*http.Client
+	BaseURL      *url.URL
+	MaxRetries   int
+	RetryBackoff time.Duration
+	// If nonzero, lists are fetched in pages of this many items.
+	PageSize int
+	// APIVersion is the version of the SMD API to query (SmdAPIv2 or
+	// SmdAPIv1), or SmdAPIAuto to use the newest one SMD supports.
+	APIVersion string
+
+	// versionMu guards negotiated, the API version found by probing SMD
+	// if APIVersion is SmdAPIAuto.
+	versionMu  sync.Mutex
+	negotiated string
+
+	breaker *circuitBreaker
+	// httpConfig and tlsConfig are used to build the HTTP client's
+	// transport whenever either changes. tlsConfig is built from
+	// tlsSettings and clientCert.
+	httpConfig  SmdHTTPConfig
+	tlsConfig   *tls.Config
+	tlsSettings SmdTLSConfig
+	clientCert  *keyPairReloader
+
+	// mu guards the HTTP client's settings and the credentials below
+	// against being reloaded while a request is made. caFile and
+	// tokenFile track the files the CA certificate and token were loaded
+	// from, which are loaded again before a request if they changed.
+	mu        sync.RWMutex
+	caFile    *fileWatch
+	token     string
+	tokenFile *fileWatch
+}
+
+// SmdTLSConfig holds the TLS settings used to connect to SMD.
+type SmdTLSConfig struct {
+	// CACertFile is a PEM file of CAs to trust. The system's CAs are
+	// trusted if it is empty.
+	CACertFile string
+	// SystemCAs trusts the system's CAs in addition to those in
+	// CACertFile.
+	SystemCAs bool
+	// MinVersion is the minimum TLS version accepted, or TLS 1.2 if zero.
+	MinVersion uint16
+	// InsecureSkipVerify disables verification of SMD's certificate. It
+	// must only be used in lab environments.
+	InsecureSkipVerify bool
+}
+
+// SmdHTTPConfig tunes the HTTP client used to query SMD.
+type SmdHTTPConfig struct {
+	// Timeout limits the time taken by a request including reading the
+	// response body, if nonzero. It applies to each attempt separately.
+	Timeout time.Duration
+	// DialTimeout, TLSHandshakeTimeout, and ResponseHeaderTimeout limit the
+	// time taken to connect to SMD, complete the TLS handshake, and receive
+	// response headers, respectively, if nonzero.
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	// MaxIdleConns is the number of idle connections kept open for reuse.
+	// Keep-alives are disabled if zero.
+	MaxIdleConns int
+	// Proxy is the URL of the proxy to send requests through. If nil and
+	// ProxyFromEnvironment is set, the proxy is taken from the HTTP_PROXY,
+	// HTTPS_PROXY, and NO_PROXY environment variables.
+	Proxy                *url.URL
+	ProxyFromEnvironment bool
+}
+
+// DefaultSmdHTTPConfig returns the HTTP client settings used by NewSmdClient.
+func DefaultSmdHTTPConfig() SmdHTTPConfig {
+	return SmdHTTPConfig{
+		DialTimeout:           defaultDialTimeout,
+		TLSHandshakeTimeout:   defaultTlsHandshakeTimeout,
+		ResponseHeaderTimeout: defaultResponseHeaderTimeout,
+		MaxIdleConns:          defaultMaxIdleConns,
+		ProxyFromEnvironment:  true,
+	}
+}
+
+// smdStatusError is returned when SMD responds with a non-2xx status.
+type smdStatusError struct {
+	code   int
+	status string
+	body   string
+}
+
+func (e *smdStatusError) Error() string {
+	return fmt.Sprintf("SMD responded with %s: %s", e.status, e.body)
+}
+
+// retryable reports whether a request made with ctx that failed with err may
+// succeed if retried. Only the caller giving up on ctx is final: timeouts of
+// the HTTP client itself are transport errors like any other.
+func retryable(ctx context.Context, err error) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	var se *smdStatusError
+	if errors.As(err, &se) {
+		return se.code >= 500 || se.code == http.StatusTooManyRequests
+	}
+
+	return true
+}
+
+type EthernetInterface struct {
+	MACAddress  string `json:"MACAddress"`
+	ComponentID string `json:"ComponentID"`
+	Type        string `json:"Type"`
+	Description string `json:"Description"`
+	IPAddresses []struct {
+		IPAddress string `json:"IPAddress"`
+	} `json:"IPAddresses"`
+}
+
+// ethernetInterfaceV1 is an EthernetInterface as returned by version 1 of the
+// SMD API, which has a single IP address per interface.
+type ethernetInterfaceV1 struct {
+	MACAddress  string `json:"MACAddress"`
+	ComponentID string `json:"ComponentID"`
+	Type        string `json:"Type"`
+	Description string `json:"Description"`
+	IPAddress   string `json:"IPAddress"`
+}
+
+// v2 converts ei to its version 2 form.
+func (ei ethernetInterfaceV1) v2() EthernetInterface {
+	v2 := EthernetInterface{
+		MACAddress:  ei.MACAddress,
+		ComponentID: ei.ComponentID,
+		Type:        ei.Type,
+		Description: ei.Description,
+	}
+	if ei.IPAddress != "" {
+		v2.IPAddresses = []struct {
+			IPAddress string `json:"IPAddress"`
+		}{{IPAddress: ei.IPAddress}}
+	}
+
+	return v2
+}
+
+// RedfishEndpoint is a Redfish endpoint (typically a BMC) discovered by SMD.
+// Its MAC and IP address are often only recorded here rather than in an
+// EthernetInterface.
+type RedfishEndpoint struct {
+	ID        string `json:"ID"`
+	Type      string `json:"Type"`
+	FQDN      string `json:"FQDN"`
+	MACAddr   string `json:"MACAddr"`
+	IPAddress string `json:"IPAddress"`
+	Enabled   bool   `json:"Enabled"`
+}
+
+// RedfishEndpointClient is implemented by SmdClients that can also fetch
+// RedfishEndpoints.
+type RedfishEndpointClient interface {
+	RedfishEndpoints(ctx context.Context, types []string) ([]RedfishEndpoint, error)
+}
+
+// Members lists the IDs of the Components in a Group or Partition.
+type Members struct {
+	IDs []string `json:"ids"`
+}
+
+// Group is a named set of Components in SMD. A Component may be in any number
+// of groups, except that it is in at most one of the groups sharing an
+// ExclusiveGroup.
+type Group struct {
+	Label          string   `json:"label"`
+	Description    string   `json:"description,omitempty"`
+	Tags           []string `json:"tags,omitempty"`
+	ExclusiveGroup string   `json:"exclusiveGroup,omitempty"`
+	Members        Members  `json:"members"`
+}
+
+// Partition is a named set of Components in SMD. A Component is in at most one
+// partition.
+type Partition struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Members     Members  `json:"members"`
+}
+
+// GroupClient is implemented by SmdClients that can also fetch Groups and
+// Partitions.
+type GroupClient interface {
+	Groups(ctx context.Context) ([]Group, error)
+	Partitions(ctx context.Context) ([]Partition, error)
+}
+
+type Component struct {
+	ID      string `json:"ID"`
+	NID     int64  `json:"NID"`
+	Type    string `json:"Type"`
+	Role    string `json:"Role"`
+	SubRole string `json:"SubRole"`
+	// ExtraProperties holds the per-node boot overrides, if SMD returns any
+	ExtraProperties BootOverrides `json:"ExtraProperties"`
+}
+
+func NewSmdClient(baseURL *url.URL) *HTTPSmdClient {
+	s := &HTTPSmdClient{
+		BaseURL:      baseURL,
+		Client:       &http.Client{},
+		MaxRetries:   DefaultRetries,
+		RetryBackoff: DefaultRetryBackoff,
+		APIVersion:   SmdAPIv2,
+		tlsConfig:    &tls.Config{},
+	}
+	s.SetCircuitBreaker(DefaultBreakerThreshold, DefaultBreakerCooldown)
+	s.SetHTTPConfig(DefaultSmdHTTPConfig())
+
+	return s
+}
+
+// SetHTTPConfig replaces the settings of the HTTP client used to query SMD.
+func (sc *HTTPSmdClient) SetHTTPConfig(hc SmdHTTPConfig) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	sc.httpConfig = hc
+	sc.Client.Timeout = hc.Timeout
+	sc.updateTransport()
+}
+
+// updateTransport replaces the HTTP client's transport with one built from
+// the client's HTTP and TLS settings. Idle connections made with the previous
+// settings are closed. sc.mu must be held.
+func (sc *HTTPSmdClient) updateTransport() {
+	hc := sc.httpConfig
+	t := &http.Transport{
+		DialContext:           (&net.Dialer{Timeout: hc.DialTimeout, KeepAlive: 30 * time.Second}).DialContext,
+		TLSClientConfig:       sc.tlsConfig,
+		TLSHandshakeTimeout:   hc.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: hc.ResponseHeaderTimeout,
+		DisableKeepAlives:     hc.MaxIdleConns == 0,
+		MaxIdleConns:          hc.MaxIdleConns,
+		MaxIdleConnsPerHost:   hc.MaxIdleConns,
+		IdleConnTimeout:       90 * time.Second,
+		ForceAttemptHTTP2:     true,
+	}
+	switch {
+	case hc.Proxy != nil:
+		t.Proxy = http.ProxyURL(hc.Proxy)
+	case hc.ProxyFromEnvironment:
+		t.Proxy = http.ProxyFromEnvironment
+	}
+
+	if old, ok := sc.Client.Transport.(*http.Transport); ok {
+		old.CloseIdleConnections()
+	}
+	sc.Client.Transport = t
+}
+
+// SetCircuitBreaker makes the client stop querying SMD for cooldown after
+// threshold consecutive requests have failed. A threshold of zero disables the
+// circuit breaker.
+func (sc *HTTPSmdClient) SetCircuitBreaker(threshold int, cooldown time.Duration) {
+	sc.breaker = newCircuitBreaker(sc.BaseURL.String(), threshold, cooldown)
+}
+
+// UseClientCert makes the client authenticate to SMD with the certificate and
+// key in certFile and keyFile (mTLS). The files are loaded again whenever they
+// change, so rotated certificates are used for new connections without a
+// restart.
+func (sc *HTTPSmdClient) UseClientCert(certFile, keyFile string) error {
+	r, err := newKeyPairReloader(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.clientCert = r
+
+	return sc.setTLSConfig(sc.tlsSettings)
+}
+
+// UseCACert makes the client trust the CAs in the PEM file at path instead of
+// the system's.
+func (sc *HTTPSmdClient) UseCACert(path string) error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	tc := sc.tlsSettings
+	tc.CACertFile = path
+
+	return sc.setTLSConfig(tc)
+}
+
+// SetTLSConfig replaces the TLS settings used to connect to SMD. The CA
+// certificate file is loaded again if it changes.
+func (sc *HTTPSmdClient) SetTLSConfig(tc SmdTLSConfig) error {
+	if sc == nil {
+		return fmt.Errorf("SmdClient is nil")
+	}
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	return sc.setTLSConfig(tc)
+}
+
+// setTLSConfig implements SetTLSConfig. sc.mu must be held.
+func (sc *HTTPSmdClient) setTLSConfig(tc SmdTLSConfig) error {
+	if sc.Client == nil {
+		return fmt.Errorf("SmdClient's HTTP client is nil")
+	}
+
+	cfg := &tls.Config{
+		MinVersion:         tc.MinVersion,
+		InsecureSkipVerify: tc.InsecureSkipVerify,
+	}
+	var caFile *fileWatch
+	if tc.CACertFile != "" {
+		caFile = newFileWatch(tc.CACertFile)
+		cacert, err := os.ReadFile(tc.CACertFile)
+		if err != nil {
+			return fmt.Errorf("failed to read CA certificate: %w", err)
+		}
+		certPool := x509.NewCertPool()
+		if tc.SystemCAs {
+			if certPool, err = x509.SystemCertPool(); err != nil {
+				return fmt.Errorf("failed to load system CA certificates: %w", err)
+			}
+		}
+		if !certPool.AppendCertsFromPEM(cacert) {
+			return fmt.Errorf("no valid certificates found in %s", tc.CACertFile)
+		}
+		cfg.RootCAs = certPool
+	}
+	if sc.clientCert != nil {
+		cfg.GetClientCertificate = sc.clientCert.getClientCertificate
+	}
+	if tc.InsecureSkipVerify {
+		log.Warnf("INSECURE: TLS certificates of SMD at %s will NOT be verified; never skip verification outside of lab environments", sc.BaseURL)
+	}
+
+	sc.tlsSettings = tc
+	sc.tlsConfig = cfg
+	sc.caFile = caFile
+	sc.updateTransport()
+
+	return nil
+}
+
+// APIGet performs a GET request against path relative to the base URL with
+// the (optional) query parameters and returns the response body. Transient
+// failures are retried with exponential backoff, and ErrCircuitOpen is returned
+// without querying SMD while the circuit breaker is open.
+func (sc *HTTPSmdClient) APIGet(ctx context.Context, path string, query url.Values) ([]byte, error) {
+	body, err := sc.open(ctx, path, query)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body: %w", err)
+	}
+
+	return data, nil
+}
+
+// open performs a GET request like APIGet but returns the response body
+// unread, so that it can be decoded as it is received. The caller must close
+// it.
+func (sc *HTTPSmdClient) open(ctx context.Context, path string, query url.Values) (io.ReadCloser, error) {
+	if sc == nil {
+		return nil, fmt.Errorf("SmdClient is nil")
+	}
+	if sc.Client == nil {
+		return nil, fmt.Errorf("SmdClient's HTTP client is nil")
+	}
+	endpoint := sc.BaseURL.JoinPath(path)
+	endpoint.RawQuery = query.Encode()
+	sc.reloadCredentials()
+
+	if err := sc.breaker.allow(); err != nil {
+		return nil, err
+	}
+
+	backoff := sc.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		body, err := sc.get(ctx, endpoint.String())
+		if err == nil {
+			sc.breaker.success()
+			return body, nil
+		}
+		if !retryable(ctx, err) {
+			// SMD answered, or the caller abandoned the request, so
+			// neither says anything about whether SMD is down
+			if ctx.Err() == nil {
+				sc.breaker.success()
+			}
+			return nil, err
+		}
+		if attempt >= sc.MaxRetries {
+			sc.breaker.failure()
+			return nil, err
+		}
+
+		log.Warnf("request to %s failed (attempt %d of %d), retrying in %s: %v", endpoint.Path, attempt+1, sc.MaxRetries+1, backoff, err)
+		metricSMDRetries.Inc(sc.BaseURL.String())
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("gave up retrying request: %w", ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff = min(2*backoff, maxSMDRetryBackoff)
+	}
+}
+
+// get performs a single GET request for endpoint and returns the response
+// body, or an *smdStatusError if the response status is not 2xx.
+func (sc *HTTPSmdClient) get(ctx context.Context, endpoint string) (body io.ReadCloser, err error) {
+	ctx, span := tracer().Start(ctx, "coresmd.smd.get", oteltrace.WithSpanKind(oteltrace.SpanKindClient),
+		oteltrace.WithAttributes(attribute.String("http.request.method", "GET"), attribute.String("url.full", endpoint)))
+	defer func() { endSpan(span, err) }()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+
+	// Copy the settings so that the request does not hold up reloading
+	// them, nor other requests waiting for a reload
+	sc.mu.RLock()
+	token, client := sc.token, *sc.Client
+	sc.mu.RUnlock()
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to execute HTTP request: %w", err)
+	}
+	span.SetAttributes(attribute.Int("http.response.status_code", resp.StatusCode))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, &smdStatusError{code: resp.StatusCode, status: resp.Status, body: strings.TrimSpace(string(data))}
+	}
+
+	return resp.Body, nil
+}
+
+// apiVersion returns the SMD API version to query, probing SMD for the newest
+// version it supports the first time it is called if sc.APIVersion is
+// SmdAPIAuto. A version is probed by requesting its readiness endpoint, and
+// considered unsupported if SMD answers 404 Not Found. Probing is tried again
+// on the next call if it fails for any other reason.
+func (sc *HTTPSmdClient) apiVersion(ctx context.Context) (string, error) {
+	if sc.APIVersion != SmdAPIAuto {
+		return sc.APIVersion, nil
+	}
+	sc.versionMu.Lock()
+	defer sc.versionMu.Unlock()
+	if sc.negotiated != "" {
+		return sc.negotiated, nil
+	}
+
+	for _, v := range smdAPIVersions {
+		_, err := sc.APIGet(ctx, "/hsm/"+v+"/service/ready", nil)
+		var se *smdStatusError
+		if errors.As(err, &se) && se.code == http.StatusNotFound {
+			log.Debugf("SMD at %s does not support API %s", sc.BaseURL, v)
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to probe SMD API %s: %w", v, err)
+		}
+		log.Infof("using API %s of SMD at %s", v, sc.BaseURL)
+		sc.negotiated = v
+		return v, nil
+	}
+
+	return "", fmt.Errorf("SMD at %s supports none of the API versions this client speaks (%s); check the base URL or pin the API version", sc.BaseURL, strings.Join(smdAPIVersions, ", "))
+}
+
+// EthernetInterfaces fetches the EthernetInterfaces belonging to Components of
+// the given types.
+func (sc *HTTPSmdClient) EthernetInterfaces(ctx context.Context, types []string) ([]EthernetInterface, error) {
+	var eis []EthernetInterface
+	err := sc.EachEthernetInterface(ctx, types, func(ei EthernetInterface) error {
+		eis = append(eis, ei)
+		return nil
+	})
+
+	return eis, err
+}
+
+// Components fetches the Components of the given types and roles.
+func (sc *HTTPSmdClient) Components(ctx context.Context, types, roles []string) ([]Component, error) {
+	var comps []Component
+	err := sc.EachComponent(ctx, types, roles, func(comp Component) error {
+		comps = append(comps, comp)
+		return nil
+	})
+
+	return comps, err
+}
+
+// RedfishEndpoints fetches the RedfishEndpoints of the given types.
+func (sc *HTTPSmdClient) RedfishEndpoints(ctx context.Context, types []string) ([]RedfishEndpoint, error) {
+	var res []RedfishEndpoint
+	err := sc.EachRedfishEndpoint(ctx, types, func(re RedfishEndpoint) error {
+		res = append(res, re)
+		return nil
+	})
+
+	return res, err
+}
+
+// EachRedfishEndpoint calls fn for each RedfishEndpoint of the given types as
+// it is decoded from SMD's response (see EachEthernetInterface).
+func (sc *HTTPSmdClient) EachRedfishEndpoint(ctx context.Context, types []string, fn func(RedfishEndpoint) error) error {
+	version, err := sc.apiVersion(ctx)
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	for _, t := range types {
+		query.Add("type", t)
+	}
+	return StreamList(ctx, sc, "/hsm/"+version+"/Inventory/RedfishEndpoints", query, "RedfishEndpoints", func(re RedfishEndpoint) string { return re.ID }, fn)
+}
+
+// Groups fetches all Groups and their members.
+func (sc *HTTPSmdClient) Groups(ctx context.Context) ([]Group, error) {
+	version, err := sc.apiVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var groups []Group
+	err = StreamList(ctx, sc, "/hsm/"+version+"/groups", url.Values{}, "", func(g Group) string { return g.Label }, func(g Group) error {
+		groups = append(groups, g)
+		return nil
+	})
+
+	return groups, err
+}
+
+// Partitions fetches all Partitions and their members.
+func (sc *HTTPSmdClient) Partitions(ctx context.Context) ([]Partition, error) {
+	version, err := sc.apiVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var parts []Partition
+	err = StreamList(ctx, sc, "/hsm/"+version+"/partitions", url.Values{}, "", func(p Partition) string { return p.Name }, func(p Partition) error {
+		parts = append(parts, p)
+		return nil
+	})
+
+	return parts, err
+}
+
+// EachEthernetInterface calls fn for each EthernetInterface belonging to
+// Components of the given types as it is decoded from SMD's response, so the
+// whole response never needs to be held in memory.
+func (sc *HTTPSmdClient) EachEthernetInterface(ctx context.Context, types []string, fn func(EthernetInterface) error) error {
+	version, err := sc.apiVersion(ctx)
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	for _, t := range types {
+		query.Add("Type", t)
+	}
+	path := "/hsm/" + version + "/Inventory/EthernetInterfaces"
+	if version == SmdAPIv1 {
+		return StreamList(ctx, sc, path, query, "", func(ei ethernetInterfaceV1) string { return ei.MACAddress }, func(ei ethernetInterfaceV1) error { return fn(ei.v2()) })
+	}
+	return StreamList(ctx, sc, path, query, "", func(ei EthernetInterface) string { return ei.MACAddress }, fn)
+}
+
+// EachComponent calls fn for each Component of the given types and roles as
+// it is decoded from SMD's response (see EachEthernetInterface).
+func (sc *HTTPSmdClient) EachComponent(ctx context.Context, types, roles []string, fn func(Component) error) error {
+	version, err := sc.apiVersion(ctx)
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	for _, t := range types {
+		query.Add("type", t)
+	}
+	for _, r := range roles {
+		query.Add("role", r)
+	}
+	return StreamList(ctx, sc, "/hsm/"+version+"/State/Components", query, "Components", func(comp Component) string { return comp.ID }, fn)
+}
+
+// StreamList fetches the JSON list at path, found under key in the response
+// object or at the top level if key is empty, and calls fn for each item as it
+// is decoded. It lets other OpenCHAMI services reachable with the same
+// credentials (e.g. BSS) be queried like SMD.
+//
+// If sc.PageSize is set, the list is fetched in pages using the limit and
+// offset query parameters. Should SMD ignore them and return more than a page,
+// or the same page again (as identified by id), the response is used as the
+// whole list.
+func StreamList[T any](ctx context.Context, sc *HTTPSmdClient, path string, query url.Values, key string, id func(T) string, fn func(T) error) error {
+	if sc.PageSize <= 0 {
+		body, err := sc.open(ctx, path, query)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		_, err = decodeList(body, key, func(v T) error { return fn(v) })
+		return err
+	}
+
+	var prevFirst string
+	for offset := 0; ; offset += sc.PageSize {
+		q := url.Values{}
+		for k, v := range query {
+			q[k] = v
+		}
+		q.Set("limit", strconv.Itoa(sc.PageSize))
+		q.Set("offset", strconv.Itoa(offset))
+
+		body, err := sc.open(ctx, path, q)
+		if err != nil {
+			return err
+		}
+		var first string
+		n, err := decodeList(body, key, func(v T) error {
+			if first == "" {
+				first = id(v)
+				if offset > 0 && first == prevFirst {
+					return errRepeatedPage
+				}
+			}
+			return fn(v)
+		})
+		body.Close()
+		if errors.Is(err, errRepeatedPage) {
+			log.Warnf("SMD returned the same page of %s at offset %d; it does not seem to support pagination", path, offset)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		log.Debugf("fetched %d item(s) of %s at offset %d", n, path, offset)
+		if n > sc.PageSize {
+			log.Warnf("SMD returned %d items of %s for a page of %d; it does not seem to support pagination", n, path, sc.PageSize)
+			return nil
+		}
+		if n < sc.PageSize {
+			return nil
+		}
+		prevFirst = first
+	}
+}
+
+var errRepeatedPage = errors.New("repeated page")
+
+// decodeList decodes the JSON list in r, found under key in the top-level
+// object or at the top level if key is empty, calling fn for each item. It
+// returns the number of items decoded.
+func decodeList[T any](r io.Reader, key string, fn func(T) error) (int, error) {
+	dec := json.NewDecoder(r)
+	if key != "" {
+		if err := expectDelim(dec, '{'); err != nil {
+			return 0, err
+		}
+		for {
+			tok, err := dec.Token()
+			if err != nil {
+				return 0, fmt.Errorf("failed to find %q in response: %w", key, err)
+			}
+			if k, ok := tok.(string); ok && k == key {
+				break
+			}
+			if tok == json.Delim('}') {
+				return 0, fmt.Errorf("response has no %q", key)
+			}
+			// Skip the value of other keys
+			var skip json.RawMessage
+			if err := dec.Decode(&skip); err != nil {
+				return 0, fmt.Errorf("failed to decode response: %w", err)
+			}
+		}
+	}
+
+	// A null list has no items
+	if !dec.More() {
+		return 0, nil
+	}
+	tok, err := dec.Token()
+	if err != nil {
+		return 0, fmt.Errorf("failed to decode response: %w", err)
+	}
+	if tok == nil {
+		return 0, nil
+	}
+	if tok != json.Delim('[') {
+		return 0, fmt.Errorf("failed to decode response: expected list, got %v", tok)
+	}
+
+	n := 0
+	for dec.More() {
+		var v T
+		if err := dec.Decode(&v); err != nil {
+			return n, fmt.Errorf("failed to unmarshal item %d: %w", n, err)
+		}
+		n++
+		if err := fn(v); err != nil {
+			return n, err
+		}
+	}
+	if err := expectDelim(dec, ']'); err != nil {
+		return n, err
+	}
+
+	return n, nil
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return fmt.Errorf("failed to decode response: %w", err)
+	}
+	if tok != delim {
+		return fmt.Errorf("failed to decode response: expected %q, got %v", delim, tok)
+	}
+
+	return nil
+}
@@ -0,0 +1,338 @@
+package smdclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestSmdClient returns an HTTPSmdClient for an SMD served by h, retrying
+// without delay.
+func newTestSmdClient(t *testing.T, h http.HandlerFunc) *HTTPSmdClient {
+	t.Helper()
+
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	baseURL, err := url.Parse(srv.URL)
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+	sc := NewSmdClient(baseURL)
+	sc.RetryBackoff = time.Millisecond
+
+	return sc
+}
+
+func TestAPIGetRetry(t *testing.T) {
+	tests := []struct {
+		name      string
+		statuses  []int
+		wantErr   bool
+		wantCalls int32
+	}{
+		{name: "success", statuses: []int{200}, wantCalls: 1},
+		{name: "transient", statuses: []int{503, 502, 200}, wantCalls: 3},
+		{name: "rate limited", statuses: []int{429, 200}, wantCalls: 2},
+		{name: "retries exhausted", statuses: []int{500, 500, 500, 500, 200}, wantErr: true, wantCalls: 4},
+		{name: "client error", statuses: []int{404, 200}, wantErr: true, wantCalls: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			sc := newTestSmdClient(t, func(w http.ResponseWriter, r *http.Request) {
+				n := calls.Add(1)
+				w.WriteHeader(tt.statuses[n-1])
+				w.Write([]byte("[]"))
+			})
+
+			_, err := sc.APIGet(context.Background(), "/hsm/v2/Inventory/EthernetInterfaces", nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("APIGet error = %v, want error: %t", err, tt.wantErr)
+			}
+			if got := calls.Load(); got != tt.wantCalls {
+				t.Errorf("SMD was called %d time(s), want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestAPIGetCircuitBreaker(t *testing.T) {
+	var calls atomic.Int32
+	var down atomic.Bool
+	down.Store(true)
+	sc := newTestSmdClient(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		if down.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("[]"))
+	})
+	sc.MaxRetries = 0
+	sc.SetCircuitBreaker(2, 50*time.Millisecond)
+
+	get := func() error {
+		_, err := sc.APIGet(context.Background(), "/hsm/v2/Inventory/EthernetInterfaces", nil)
+		return err
+	}
+
+	// Two failures open the breaker, after which SMD is not queried
+	for i := 0; i < 2; i++ {
+		if err := get(); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("request %d: error = %v, want SMD error", i+1, err)
+		}
+	}
+	if err := get(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("open breaker: error = %v, want %v", err, ErrCircuitOpen)
+	}
+	if got := calls.Load(); got != 2 {
+		t.Errorf("SMD was called %d time(s) with the breaker open, want 2", got)
+	}
+
+	// After the cooldown, a failed trial request opens it again...
+	time.Sleep(60 * time.Millisecond)
+	if err := get(); err == nil || errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("half-open breaker: error = %v, want SMD error", err)
+	}
+	if err := get(); !errors.Is(err, ErrCircuitOpen) {
+		t.Fatalf("reopened breaker: error = %v, want %v", err, ErrCircuitOpen)
+	}
+
+	// ...and a successful one closes it
+	down.Store(false)
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if err := get(); err != nil {
+			t.Fatalf("closed breaker: request %d: %v", i+1, err)
+		}
+	}
+}
+
+func TestAPIGetTimeout(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	sc := newTestSmdClient(t, func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		select {
+		case <-release:
+		case <-time.After(time.Second):
+		}
+		w.Write([]byte("[]"))
+	})
+	defer close(release)
+	sc.MaxRetries = 1
+	sc.SetCircuitBreaker(2, time.Minute)
+	hc := DefaultSmdHTTPConfig()
+	hc.ResponseHeaderTimeout = 20 * time.Millisecond
+	sc.SetHTTPConfig(hc)
+
+	// Timeouts of the HTTP client are retried and count as failures, so a
+	// hung SMD opens the breaker
+	for i := 0; i < 2; i++ {
+		if _, err := sc.APIGet(context.Background(), "/hsm/v2/Inventory/EthernetInterfaces", nil); err == nil || errors.Is(err, ErrCircuitOpen) {
+			t.Fatalf("request %d: error = %v, want timeout", i+1, err)
+		}
+	}
+	if got := calls.Load(); got != 4 {
+		t.Errorf("SMD was called %d time(s), want 4", got)
+	}
+	if _, err := sc.APIGet(context.Background(), "/hsm/v2/Inventory/EthernetInterfaces", nil); !errors.Is(err, ErrCircuitOpen) {
+		t.Errorf("hung SMD: error = %v, want %v", err, ErrCircuitOpen)
+	}
+
+	// The caller giving up is not retried
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	sc.SetCircuitBreaker(0, 0)
+	calls.Store(0)
+	if _, err := sc.APIGet(ctx, "/hsm/v2/Inventory/EthernetInterfaces", nil); err == nil {
+		t.Error("request with an expired context succeeded")
+	}
+	if got := calls.Load(); got != 1 {
+		t.Errorf("SMD was called %d time(s) after the caller gave up, want 1", got)
+	}
+}
+
+func TestEachComponentPagination(t *testing.T) {
+	comps := make([]Component, 7)
+	for i := range comps {
+		comps[i] = Component{ID: fmt.Sprintf("x3000c0s%db0n0", i), Type: "Node"}
+	}
+
+	tests := []struct {
+		name      string
+		pageSize  int
+		paginate  bool
+		wantCalls int32
+	}{
+		{name: "unpaginated", pageSize: 0, paginate: true, wantCalls: 1},
+		{name: "partial last page", pageSize: 3, paginate: true, wantCalls: 3},
+		{name: "full last page", pageSize: 7, paginate: true, wantCalls: 2},
+		{name: "unsupported, larger than page", pageSize: 3, paginate: false, wantCalls: 1},
+		{name: "unsupported, exactly one page", pageSize: 7, paginate: false, wantCalls: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var calls atomic.Int32
+			sc := newTestSmdClient(t, func(w http.ResponseWriter, r *http.Request) {
+				calls.Add(1)
+				page := comps
+				if limit := r.URL.Query().Get("limit"); limit != "" && tt.paginate {
+					l, _ := strconv.Atoi(limit)
+					o, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+					page = comps[min(o, len(comps)):min(o+l, len(comps))]
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{"Version": 1, "Components": page})
+			})
+			sc.PageSize = tt.pageSize
+
+			got, err := sc.Components(context.Background(), nil, nil)
+			if err != nil {
+				t.Fatalf("Components: %v", err)
+			}
+			if !reflect.DeepEqual(got, comps) {
+				t.Errorf("Components = %v, want %v", got, comps)
+			}
+			if n := calls.Load(); n != tt.wantCalls {
+				t.Errorf("SMD was called %d time(s), want %d", n, tt.wantCalls)
+			}
+		})
+	}
+}
+
+func TestDecodeList(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		key     string
+		want    []string
+		wantErr bool
+	}{
+		{name: "top level", body: `[{"ID":"a"},{"ID":"b"}]`, want: []string{"a", "b"}},
+		{name: "keyed", body: `{"Other":{"x":[1]},"Components":[{"ID":"a"}]}`, key: "Components", want: []string{"a"}},
+		{name: "null", body: `{"Components":null}`, key: "Components"},
+		{name: "missing key", body: `{"Other":[]}`, key: "Components", wantErr: true},
+		{name: "not a list", body: `{"ID":"a"}`, wantErr: true},
+		{name: "truncated", body: `[{"ID":"a"},{"ID":`, want: []string{"a"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			_, err := decodeList(strings.NewReader(tt.body), tt.key, func(c Component) error {
+				got = append(got, c.ID)
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("decodeList error = %v, want error: %t", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("decoded %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSetHTTPConfig(t *testing.T) {
+	release := make(chan struct{})
+	sc := newTestSmdClient(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("[]"))
+	})
+	defer close(release)
+	sc.MaxRetries = 0
+
+	hc := DefaultSmdHTTPConfig()
+	hc.Timeout = 20 * time.Millisecond
+	sc.SetHTTPConfig(hc)
+	if _, err := sc.EthernetInterfaces(context.Background(), nil); err == nil {
+		t.Error("request to a hanging SMD succeeded despite the timeout")
+	}
+}
+
+func TestSetHTTPConfigProxy(t *testing.T) {
+	var proxied atomic.Int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Proxied requests carry the absolute URL of SMD
+		if r.URL.Host == "smd.invalid" {
+			proxied.Add(1)
+		}
+		w.Write([]byte("[]"))
+	}))
+	defer proxy.Close()
+	proxyURL, _ := url.Parse(proxy.URL)
+	baseURL, _ := url.Parse("http://smd.invalid")
+
+	sc := NewSmdClient(baseURL)
+	hc := DefaultSmdHTTPConfig()
+	hc.Proxy = proxyURL
+	sc.SetHTTPConfig(hc)
+	if _, err := sc.EthernetInterfaces(context.Background(), nil); err != nil {
+		t.Fatalf("EthernetInterfaces: %v", err)
+	}
+	if proxied.Load() != 1 {
+		t.Error("request was not sent through the proxy")
+	}
+}
+
+func TestAPIVersionNegotiation(t *testing.T) {
+	tests := []struct {
+		name        string
+		supported   []string
+		wantVersion string
+		wantErr     bool
+	}{
+		{name: "v2", supported: []string{"v1", "v2"}, wantVersion: "v2"},
+		{name: "v1 only", supported: []string{"v1"}, wantVersion: "v1"},
+		{name: "unsupported", supported: []string{"v3"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := newTestSmdClient(t, func(w http.ResponseWriter, r *http.Request) {
+				for _, v := range tt.supported {
+					switch r.URL.Path {
+					case "/hsm/" + v + "/service/ready":
+						w.Write([]byte(`{"code":0,"message":"HSM is healthy"}`))
+						return
+					case "/hsm/" + v + "/Inventory/EthernetInterfaces":
+						if v == "v1" {
+							w.Write([]byte(`[{"MACAddress":"aa:bb:cc:dd:ee:01","ComponentID":"x3000c0s0b0n0","IPAddress":"172.16.0.1"}]`))
+						} else {
+							w.Write([]byte(`[{"MACAddress":"aa:bb:cc:dd:ee:01","ComponentID":"x3000c0s0b0n0","IPAddresses":[{"IPAddress":"172.16.0.1"}]}]`))
+						}
+						return
+					}
+				}
+				http.NotFound(w, r)
+			})
+			sc.APIVersion = SmdAPIAuto
+
+			eis, err := sc.EthernetInterfaces(context.Background(), nil)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("EthernetInterfaces error = %v, want error: %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if sc.negotiated != tt.wantVersion {
+				t.Errorf("negotiated API %q, want %q", sc.negotiated, tt.wantVersion)
+			}
+			if len(eis) != 1 || len(eis[0].IPAddresses) != 1 || eis[0].IPAddresses[0].IPAddress != "172.16.0.1" {
+				t.Errorf("EthernetInterfaces = %+v, want one with IP 172.16.0.1", eis)
+			}
+		})
+	}
+}
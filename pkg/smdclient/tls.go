@@ -0,0 +1,77 @@
+package smdclient
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// keyPairReloader holds a certificate and key loaded from files, loading them
+// again when either file changes so that rotated certificates are picked up
+// without a restart.
+type keyPairReloader struct {
+	certFile string
+	keyFile  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	certTime time.Time
+	keyTime  time.Time
+}
+
+// newKeyPairReloader loads the certificate and key from certFile and keyFile.
+func newKeyPairReloader(certFile, keyFile string) (*keyPairReloader, error) {
+	r := &keyPairReloader{certFile: certFile, keyFile: keyFile}
+	if _, err := r.get(); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// get returns the current certificate, loading it again if either file was
+// modified since it was last loaded. If loading fails, the previous
+// certificate is returned along with the error so that a rotation caught
+// halfway does not break connections.
+func (r *keyPairReloader) get() (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return r.cert, fmt.Errorf("failed to stat certificate: %w", err)
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return r.cert, fmt.Errorf("failed to stat key: %w", err)
+	}
+	if r.cert != nil && certInfo.ModTime().Equal(r.certTime) && keyInfo.ModTime().Equal(r.keyTime) {
+		return r.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return r.cert, fmt.Errorf("failed to load certificate and key: %w", err)
+	}
+	if r.cert != nil {
+		log.Infof("reloaded certificate %s", r.certFile)
+	}
+	r.cert, r.certTime, r.keyTime = &cert, certInfo.ModTime(), keyInfo.ModTime()
+
+	return r.cert, nil
+}
+
+// getClientCertificate implements tls.Config.GetClientCertificate.
+func (r *keyPairReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	cert, err := r.get()
+	if err != nil {
+		if cert == nil {
+			return nil, err
+		}
+		log.Errorf("using previous client certificate: %v", err)
+	}
+
+	return cert, nil
+}
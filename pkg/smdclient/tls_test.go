@@ -0,0 +1,348 @@
+package smdclient
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testCA issues certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate: %v", err)
+	}
+
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue writes a certificate for 127.0.0.1 with the given serial number and
+// its key to certFile and keyFile.
+func (ca *testCA) issue(t *testing.T, serial int64, certFile, keyFile string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "coresmd"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("CreateCertificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("MarshalECPrivateKey: %v", err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+}
+
+// serverTLSConfig returns the TLS config of a test server using the given
+// certificate and key, requiring client certificates signed by the CAs in
+// clientCAs if it is non-nil.
+func serverTLSConfig(t *testing.T, certFile, keyFile string, clientCAs []byte) *tls.Config {
+	t.Helper()
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("LoadX509KeyPair: %v", err)
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCAs != nil {
+		cfg.ClientCAs = x509.NewCertPool()
+		cfg.ClientCAs.AppendCertsFromPEM(clientCAs)
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return cfg
+}
+
+func TestUseClientCert(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, ca.pem, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	serverCert, serverKey := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	ca.issue(t, 2, serverCert, serverKey)
+	clientCert, clientKey := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	ca.issue(t, 3, clientCert, clientKey)
+
+	// Record the serial number of the client certificate of each request
+	var serial atomic.Int64
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		serial.Store(r.TLS.PeerCertificates[0].SerialNumber.Int64())
+		w.Write([]byte("[]"))
+	}))
+	srv.TLS = serverTLSConfig(t, serverCert, serverKey, ca.pem)
+	srv.StartTLS()
+	defer srv.Close()
+
+	baseURL, _ := url.Parse(srv.URL)
+	sc := NewSmdClient(baseURL)
+	sc.MaxRetries = 0
+	if err := sc.UseCACert(caFile); err != nil {
+		t.Fatalf("UseCACert: %v", err)
+	}
+	if _, err := sc.EthernetInterfaces(context.Background(), nil); err == nil {
+		t.Fatal("request without client certificate succeeded")
+	}
+	if err := sc.UseClientCert(clientCert, clientKey); err != nil {
+		t.Fatalf("UseClientCert: %v", err)
+	}
+	if _, err := sc.EthernetInterfaces(context.Background(), nil); err != nil {
+		t.Fatalf("EthernetInterfaces: %v", err)
+	}
+	if got := serial.Load(); got != 3 {
+		t.Errorf("client certificate serial = %d, want 3", got)
+	}
+
+	// Rotate the client certificate; new connections must use it
+	ca.issue(t, 4, clientCert, clientKey)
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(clientCert, later, later)
+	os.Chtimes(clientKey, later, later)
+	sc.Client.CloseIdleConnections()
+	if _, err := sc.EthernetInterfaces(context.Background(), nil); err != nil {
+		t.Fatalf("EthernetInterfaces after rotation: %v", err)
+	}
+	if got := serial.Load(); got != 4 {
+		t.Errorf("client certificate serial after rotation = %d, want 4", got)
+	}
+}
+
+func TestKeyPairReloaderKeepsPrevious(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certFile, keyFile := filepath.Join(dir, "client.pem"), filepath.Join(dir, "client.key")
+	ca.issue(t, 2, certFile, keyFile)
+
+	r, err := newKeyPairReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatalf("newKeyPairReloader: %v", err)
+	}
+
+	// A certificate written without its key yet must not break connections
+	later := time.Now().Add(time.Minute)
+	os.WriteFile(certFile, []byte("garbage"), 0o600)
+	os.Chtimes(certFile, later, later)
+	cert, err := r.getClientCertificate(nil)
+	if err != nil || cert == nil {
+		t.Fatalf("getClientCertificate = %v, %v, want previous certificate", cert, err)
+	}
+	if leaf, _ := x509.ParseCertificate(cert.Certificate[0]); leaf.SerialNumber.Int64() != 2 {
+		t.Errorf("serial = %d, want 2", leaf.SerialNumber.Int64())
+	}
+}
+
+func TestSetTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(caFile, ca.pem, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	serverCert, serverKey := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	ca.issue(t, 2, serverCert, serverKey)
+
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("[]"))
+	}))
+	tlsConfig := serverTLSConfig(t, serverCert, serverKey, nil)
+	tlsConfig.MaxVersion = tls.VersionTLS12
+	srv.TLS = tlsConfig
+	srv.StartTLS()
+	defer srv.Close()
+	baseURL, _ := url.Parse(srv.URL)
+
+	tests := []struct {
+		name    string
+		tc      SmdTLSConfig
+		wantErr bool
+	}{
+		{name: "untrusted CA", tc: SmdTLSConfig{}, wantErr: true},
+		{name: "CA file", tc: SmdTLSConfig{CACertFile: caFile}},
+		{name: "CA file and system CAs", tc: SmdTLSConfig{CACertFile: caFile, SystemCAs: true}},
+		{name: "minimum version too high", tc: SmdTLSConfig{CACertFile: caFile, MinVersion: tls.VersionTLS13}, wantErr: true},
+		{name: "insecure", tc: SmdTLSConfig{InsecureSkipVerify: true}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sc := NewSmdClient(baseURL)
+			sc.MaxRetries = 0
+			if err := sc.SetTLSConfig(tt.tc); err != nil {
+				t.Fatalf("SetTLSConfig: %v", err)
+			}
+			_, err := sc.EthernetInterfaces(context.Background(), nil)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("EthernetInterfaces error = %v, want error: %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestReloadCredentials(t *testing.T) {
+	dir := t.TempDir()
+	ca, otherCA := newTestCA(t), newTestCA(t)
+	serverCert, serverKey := filepath.Join(dir, "server.pem"), filepath.Join(dir, "server.key")
+	ca.issue(t, 2, serverCert, serverKey)
+
+	var token atomic.Value
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer "+token.Load().(string) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("[]"))
+	}))
+	tlsConfig := serverTLSConfig(t, serverCert, serverKey, nil)
+	srv.TLS = tlsConfig
+	srv.StartTLS()
+	defer srv.Close()
+	baseURL, _ := url.Parse(srv.URL)
+
+	// Start out trusting the wrong CA
+	caFile, tokenFile := filepath.Join(dir, "ca.pem"), filepath.Join(dir, "token")
+	if err := os.WriteFile(caFile, otherCA.pem, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := os.WriteFile(tokenFile, []byte("old\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	token.Store("old")
+	sc := NewSmdClient(baseURL)
+	sc.MaxRetries = 0
+	if err := sc.UseCACert(caFile); err != nil {
+		t.Fatalf("UseCACert: %v", err)
+	}
+	if err := sc.UseTokenFile(tokenFile); err != nil {
+		t.Fatalf("UseTokenFile: %v", err)
+	}
+	if _, err := sc.EthernetInterfaces(context.Background(), nil); err == nil {
+		t.Fatal("request trusting the wrong CA succeeded")
+	}
+
+	// Rotating the CA bundle must take effect without reconfiguring
+	if err := os.WriteFile(caFile, append(otherCA.pem, ca.pem...), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := sc.EthernetInterfaces(context.Background(), nil); err != nil {
+		t.Fatalf("EthernetInterfaces after CA rotation: %v", err)
+	}
+
+	// So must rotating the token, while an invalid one is ignored
+	token.Store("rotated")
+	if err := os.WriteFile(tokenFile, []byte("rotated\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := sc.EthernetInterfaces(context.Background(), nil); err != nil {
+		t.Fatalf("EthernetInterfaces after token rotation: %v", err)
+	}
+	if err := os.WriteFile(tokenFile, nil, 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if _, err := sc.EthernetInterfaces(context.Background(), nil); err != nil {
+		t.Fatalf("EthernetInterfaces after emptying token file: %v", err)
+	}
+}
+
+func TestReloadCredentialsDuringRequest(t *testing.T) {
+	release := make(chan struct{})
+	var token atomic.Value
+	token.Store("old")
+	sc := newTestSmdClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/hang" {
+			<-release
+		}
+		if r.Header.Get("Authorization") != "Bearer "+token.Load().(string) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte("[]"))
+	})
+	defer close(release)
+	sc.MaxRetries = 0
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("old\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	if err := sc.UseTokenFile(tokenFile); err != nil {
+		t.Fatalf("UseTokenFile: %v", err)
+	}
+
+	// A hung request must hold up neither other requests nor a token
+	// rotation
+	go sc.APIGet(context.Background(), "/hang", nil)
+	time.Sleep(20 * time.Millisecond)
+	token.Store("rotated")
+	if err := os.WriteFile(tokenFile, []byte("rotated\n"), 0o600); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := sc.EthernetInterfaces(context.Background(), nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("EthernetInterfaces during a hung request: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("request blocked by a hung request")
+	}
+}
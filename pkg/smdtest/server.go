@@ -0,0 +1,420 @@
+// Package smdtest provides an in-process fake of the SMD HTTP API, so that
+// coresmd's integration tests and programs built on pkg/smdclient can be
+// tested without a live SMD.
+//
+// A Server serves the EthernetInterfaces, Components, RedfishEndpoints,
+// Groups, and Partitions it is seeded with, applying the type and role filters
+// and the limit/offset pagination SMD supports. Its data can be changed while
+// it runs, and faults (error statuses, delays, dropped connections) can be
+// injected into its responses.
+package smdtest
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/OpenCHAMI/coresmd/pkg/smdclient"
+)
+
+// Fault is a failure injected into a Server's responses.
+type Fault struct {
+	// Path, if nonempty, limits the fault to requests whose path contains
+	// it, e.g. "State/Components".
+	Path string
+	// Count is the number of matching requests the fault applies to, or
+	// all of them until ClearFaults is called if zero.
+	Count int
+
+	// Delay is waited before responding, or until the request is
+	// canceled.
+	Delay time.Duration
+	// Status, if nonzero, is responded with instead of the data.
+	Status int
+	// Drop closes the connection without responding.
+	Drop bool
+	// Truncate cuts the response body short, as if the connection broke
+	// while it was sent.
+	Truncate bool
+}
+
+// Server is a fake SMD serving the data it holds over HTTP. All its methods
+// are safe for concurrent use.
+type Server struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	eis      []smdclient.EthernetInterface
+	comps    []smdclient.Component
+	res      []smdclient.RedfishEndpoint
+	groups   []smdclient.Group
+	parts    []smdclient.Partition
+	versions []string
+	token    string
+	noPages  bool
+	faults   []*Fault
+	requests map[string]int
+}
+
+// NewServer starts and returns a Server holding eis and comps and serving
+// both version 2 and version 1 of the API. The caller should call Close when
+// finished, to shut it down.
+func NewServer(eis []smdclient.EthernetInterface, comps []smdclient.Component) *Server {
+	s := newServer(eis, comps)
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// NewTLSServer is like NewServer but serves HTTPS. Clients returned by
+// Client trust its certificate.
+func NewTLSServer(eis []smdclient.EthernetInterface, comps []smdclient.Component) *Server {
+	s := newServer(eis, comps)
+	s.Server = httptest.NewTLSServer(s)
+	return s
+}
+
+func newServer(eis []smdclient.EthernetInterface, comps []smdclient.Component) *Server {
+	return &Server{
+		eis:      eis,
+		comps:    comps,
+		versions: []string{smdclient.SmdAPIv2, smdclient.SmdAPIv1},
+		requests: make(map[string]int),
+	}
+}
+
+// BaseURL returns the URL to reach the server at, as passed to
+// smdclient.NewSmdClient.
+func (s *Server) BaseURL() *url.URL {
+	u, err := url.Parse(s.URL)
+	if err != nil {
+		panic("smdtest: invalid server URL: " + err.Error())
+	}
+	return u
+}
+
+// Client returns an HTTPSmdClient for the server that retries without delay
+// and, if the server serves HTTPS, trusts its certificate.
+func (s *Server) Client() *smdclient.HTTPSmdClient {
+	sc := smdclient.NewSmdClient(s.BaseURL())
+	sc.RetryBackoff = time.Millisecond
+	if s.TLS != nil {
+		sc.Client = s.Server.Client()
+	}
+	return sc
+}
+
+// Set replaces the EthernetInterfaces and Components held by the server.
+func (s *Server) Set(eis []smdclient.EthernetInterface, comps []smdclient.Component) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.eis, s.comps = eis, comps
+}
+
+// SetRedfishEndpoints replaces the RedfishEndpoints held by the server.
+func (s *Server) SetRedfishEndpoints(res []smdclient.RedfishEndpoint) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.res = res
+}
+
+// SetGroups replaces the Groups and Partitions held by the server.
+func (s *Server) SetGroups(groups []smdclient.Group, parts []smdclient.Partition) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.groups, s.parts = groups, parts
+}
+
+// PutComponent adds comp, replacing any Component with the same ID.
+func (s *Server) PutComponent(comp smdclient.Component) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.comps = slices.DeleteFunc(slices.Clone(s.comps), func(c smdclient.Component) bool { return c.ID == comp.ID })
+	s.comps = append(s.comps, comp)
+}
+
+// DeleteComponent removes the Component with ID id and its
+// EthernetInterfaces.
+func (s *Server) DeleteComponent(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.comps = slices.DeleteFunc(slices.Clone(s.comps), func(c smdclient.Component) bool { return c.ID == id })
+	s.eis = slices.DeleteFunc(slices.Clone(s.eis), func(ei smdclient.EthernetInterface) bool { return ei.ComponentID == id })
+}
+
+// PutEthernetInterface adds ei, replacing any EthernetInterface with the same
+// MAC address.
+func (s *Server) PutEthernetInterface(ei smdclient.EthernetInterface) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.eis = slices.DeleteFunc(slices.Clone(s.eis), func(e smdclient.EthernetInterface) bool {
+		return strings.EqualFold(e.MACAddress, ei.MACAddress)
+	})
+	s.eis = append(s.eis, ei)
+}
+
+// DeleteEthernetInterface removes the EthernetInterface with MAC address mac.
+func (s *Server) DeleteEthernetInterface(mac string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.eis = slices.DeleteFunc(slices.Clone(s.eis), func(e smdclient.EthernetInterface) bool {
+		return strings.EqualFold(e.MACAddress, mac)
+	})
+}
+
+// SetAPIVersions sets the API versions served (smdclient.SmdAPIv2 and/or
+// smdclient.SmdAPIv1). Requests for other versions get 404 Not Found, like
+// an SMD that does not support them.
+func (s *Server) SetAPIVersions(versions ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.versions = versions
+}
+
+// RequireToken makes requests without the bearer token token fail with 401
+// Unauthorized, or no longer be checked if token is empty.
+func (s *Server) RequireToken(token string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.token = token
+}
+
+// SetPagination sets whether the limit and offset query parameters are
+// honored. If not, every request gets the whole list, like an SMD that does
+// not support pagination. They are honored by default.
+func (s *Server) SetPagination(enabled bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.noPages = !enabled
+}
+
+// Inject adds f to the faults applied to requests. Faults are applied in the
+// order they were injected; the first matching one is used.
+func (s *Server) Inject(f Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, &f)
+}
+
+// ClearFaults removes all injected faults.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// Requests returns the number of requests received whose path contains path,
+// or all requests if path is empty.
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for p, c := range s.requests {
+		if strings.Contains(p, path) {
+			n += c
+		}
+	}
+	return n
+}
+
+// fault returns the fault to apply to a request for path, if any, counting
+// it against the fault's Count.
+func (s *Server) fault(path string) *Fault {
+	for i, f := range s.faults {
+		if f.Path != "" && !strings.Contains(path, f.Path) {
+			continue
+		}
+		applied := *f
+		if f.Count > 0 {
+			f.Count--
+			if f.Count == 0 {
+				s.faults = slices.Delete(s.faults, i, i+1)
+			}
+		}
+		return &applied
+	}
+	return nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests[r.URL.Path]++
+	f := s.fault(r.URL.Path)
+	token := s.token
+	s.mu.Unlock()
+
+	if f != nil {
+		if f.Delay > 0 {
+			select {
+			case <-time.After(f.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if f.Drop {
+			if hj, ok := w.(http.Hijacker); ok {
+				if conn, _, err := hj.Hijack(); err == nil {
+					conn.Close()
+					return
+				}
+			}
+			panic(http.ErrAbortHandler)
+		}
+		if f.Status != 0 {
+			http.Error(w, http.StatusText(f.Status), f.Status)
+			return
+		}
+	}
+	if token != "" && r.Header.Get("Authorization") != "Bearer "+token {
+		http.Error(w, "missing or invalid token", http.StatusUnauthorized)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, ok := s.respond(r)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if f != nil && f.Truncate {
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Write(data[:len(data)/2])
+		panic(http.ErrAbortHandler)
+	}
+	w.Write(data)
+}
+
+// respond returns the response body for r, or false if r is not for an
+// endpoint the server serves.
+func (s *Server) respond(r *http.Request) (interface{}, bool) {
+	rest, ok := strings.CutPrefix(r.URL.Path, "/hsm/")
+	if !ok {
+		return nil, false
+	}
+	version, endpoint, _ := strings.Cut(rest, "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !slices.Contains(s.versions, version) {
+		return nil, false
+	}
+
+	query := r.URL.Query()
+	switch endpoint {
+	case "service/ready":
+		return map[string]interface{}{"code": 0, "message": "HSM is healthy"}, true
+	case "Inventory/EthernetInterfaces":
+		eis := s.ethernetInterfaces(query["Type"])
+		eis = paginate(eis, query, !s.noPages)
+		if version == smdclient.SmdAPIv1 {
+			return ethernetInterfacesV1(eis), true
+		}
+		return eis, true
+	case "State/Components":
+		comps := filter(s.comps, func(c smdclient.Component) bool {
+			return matches(query["type"], c.Type) && matches(query["role"], c.Role)
+		})
+		return map[string]interface{}{"Components": paginate(comps, query, !s.noPages)}, true
+	case "Inventory/RedfishEndpoints":
+		res := filter(s.res, func(re smdclient.RedfishEndpoint) bool { return matches(query["type"], re.Type) })
+		return map[string]interface{}{"RedfishEndpoints": paginate(res, query, !s.noPages)}, true
+	case "groups":
+		return paginate(s.groups, query, !s.noPages), true
+	case "partitions":
+		return paginate(s.parts, query, !s.noPages), true
+	}
+
+	return nil, false
+}
+
+// ethernetInterfaces returns the EthernetInterfaces belonging to Components of
+// the given types, or all if types is empty.
+func (s *Server) ethernetInterfaces(types []string) []smdclient.EthernetInterface {
+	compTypes := make(map[string]string, len(s.comps))
+	for _, comp := range s.comps {
+		compTypes[comp.ID] = comp.Type
+	}
+	return filter(s.eis, func(ei smdclient.EthernetInterface) bool { return matches(types, compTypes[ei.ComponentID]) })
+}
+
+// paginate returns the page of items selected by the limit and offset query
+// parameters, or all of them if they are not set or enabled is false.
+func paginate[T any](items []T, query url.Values, enabled bool) []T {
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if !enabled || err != nil || limit <= 0 {
+		return window(items, 0, len(items))
+	}
+	offset, _ := strconv.Atoi(query.Get("offset"))
+	return window(items, offset, limit)
+}
+
+func window[T any](items []T, offset, limit int) []T {
+	offset = min(max(offset, 0), len(items))
+	// Encode an empty page as [] rather than null, like SMD
+	return append([]T{}, items[offset:min(offset+limit, len(items))]...)
+}
+
+func filter[T any](items []T, keep func(T) bool) []T {
+	kept := []T{}
+	for _, item := range items {
+		if keep(item) {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+// matches reports whether value is in filter, ignoring case like SMD, or
+// filter is empty.
+func matches(filter []string, value string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	for _, f := range filter {
+		if strings.EqualFold(f, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// ethernetInterfaceV1 is an EthernetInterface as returned by version 1 of the
+// SMD API, which has a single IP address per interface.
+type ethernetInterfaceV1 struct {
+	MACAddress  string `json:"MACAddress"`
+	ComponentID string `json:"ComponentID"`
+	Type        string `json:"Type"`
+	Description string `json:"Description"`
+	IPAddress   string `json:"IPAddress"`
+}
+
+func ethernetInterfacesV1(eis []smdclient.EthernetInterface) []ethernetInterfaceV1 {
+	v1 := make([]ethernetInterfaceV1, 0, len(eis))
+	for _, ei := range eis {
+		e := ethernetInterfaceV1{
+			MACAddress:  ei.MACAddress,
+			ComponentID: ei.ComponentID,
+			Type:        ei.Type,
+			Description: ei.Description,
+		}
+		if len(ei.IPAddresses) > 0 {
+			e.IPAddress = ei.IPAddresses[0].IPAddress
+		}
+		v1 = append(v1, e)
+	}
+	return v1
+}
@@ -0,0 +1,131 @@
+package smdtest
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/OpenCHAMI/coresmd/pkg/smdclient"
+)
+
+func testData() ([]smdclient.EthernetInterface, []smdclient.Component) {
+	ei := func(mac, id, ip string) smdclient.EthernetInterface {
+		return smdclient.EthernetInterface{MACAddress: mac, ComponentID: id, IPAddresses: []struct {
+			IPAddress string `json:"IPAddress"`
+		}{{IPAddress: ip}}}
+	}
+	return []smdclient.EthernetInterface{
+		ei("aa:bb:cc:dd:ee:01", "x3000c0s0b0n0", "172.16.0.1"),
+		ei("aa:bb:cc:dd:ee:02", "x3000c0s1b0n0", "172.16.0.2"),
+		ei("aa:bb:cc:dd:ee:03", "x3000c0s0b0", "172.16.0.3"),
+	}, []smdclient.Component{
+		{ID: "x3000c0s0b0n0", NID: 1, Type: "Node", Role: "Compute"},
+		{ID: "x3000c0s1b0n0", NID: 2, Type: "Node", Role: "Management"},
+		{ID: "x3000c0s0b0", Type: "NodeBMC"},
+	}
+}
+
+func TestServer(t *testing.T) {
+	for _, version := range []string{smdclient.SmdAPIv2, smdclient.SmdAPIv1} {
+		t.Run(version, func(t *testing.T) {
+			srv := NewServer(testData())
+			defer srv.Close()
+			srv.SetAPIVersions(version)
+			sc := srv.Client()
+			sc.APIVersion = smdclient.SmdAPIAuto
+			sc.PageSize = 2
+			ctx := context.Background()
+
+			eis, err := sc.EthernetInterfaces(ctx, []string{"Node"})
+			if err != nil || len(eis) != 2 {
+				t.Fatalf("EthernetInterfaces = %v, %v; want 2 node interfaces", eis, err)
+			}
+			if ip := eis[0].IPAddresses[0].IPAddress; ip != "172.16.0.1" {
+				t.Errorf("IP address = %s, want 172.16.0.1", ip)
+			}
+			comps, err := sc.Components(ctx, []string{"Node"}, []string{"Compute"})
+			if err != nil || len(comps) != 1 || comps[0].ID != "x3000c0s0b0n0" {
+				t.Errorf("Components = %v, %v; want x3000c0s0b0n0", comps, err)
+			}
+			// Three interfaces in pages of two
+			if n := srv.Requests("EthernetInterfaces"); n != 2 {
+				t.Errorf("EthernetInterfaces fetched in %d requests, want 2", n)
+			}
+		})
+	}
+}
+
+func TestServerMutation(t *testing.T) {
+	srv := NewServer(testData())
+	defer srv.Close()
+	sc := srv.Client()
+	ctx := context.Background()
+
+	srv.DeleteComponent("x3000c0s1b0n0")
+	srv.PutComponent(smdclient.Component{ID: "x3000c0s0b0n0", NID: 10, Type: "Node"})
+	srv.PutEthernetInterface(smdclient.EthernetInterface{MACAddress: "AA:BB:CC:DD:EE:01", ComponentID: "x3000c0s0b0n0"})
+
+	comps, err := sc.Components(ctx, []string{"Node"}, nil)
+	if err != nil || len(comps) != 1 || comps[0].NID != 10 {
+		t.Errorf("Components = %v, %v; want x3000c0s0b0n0 with NID 10", comps, err)
+	}
+	eis, err := sc.EthernetInterfaces(ctx, nil)
+	if err != nil || len(eis) != 2 {
+		t.Errorf("EthernetInterfaces = %v, %v; want 2", eis, err)
+	}
+}
+
+func TestServerFaults(t *testing.T) {
+	srv := NewServer(testData())
+	defer srv.Close()
+	sc := srv.Client()
+	sc.APIVersion = smdclient.SmdAPIv2
+	ctx := context.Background()
+
+	// Transient failures are retried
+	srv.Inject(Fault{Path: "State/Components", Count: 1, Status: http.StatusServiceUnavailable})
+	srv.Inject(Fault{Path: "State/Components", Count: 1, Drop: true})
+	if _, err := sc.Components(ctx, nil, nil); err != nil {
+		t.Errorf("Components failed despite retries: %v", err)
+	}
+	if n := srv.Requests("State/Components"); n != 3 {
+		t.Errorf("Components fetched in %d requests, want 3", n)
+	}
+
+	srv.Inject(Fault{Path: "EthernetInterfaces", Truncate: true})
+	if _, err := sc.EthernetInterfaces(ctx, nil); err == nil {
+		t.Error("EthernetInterfaces succeeded with a truncated response")
+	}
+	srv.Inject(Fault{Status: http.StatusNotFound})
+	if _, err := sc.Components(ctx, nil, nil); err == nil {
+		t.Error("Components succeeded with 404 Not Found")
+	}
+	srv.ClearFaults()
+	if _, err := sc.EthernetInterfaces(ctx, nil); err != nil {
+		t.Errorf("EthernetInterfaces after ClearFaults: %v", err)
+	}
+}
+
+func TestServerToken(t *testing.T) {
+	srv := NewTLSServer(testData())
+	defer srv.Close()
+	srv.RequireToken("secret")
+	sc := srv.Client()
+	ctx := context.Background()
+
+	if _, err := sc.Components(ctx, nil, nil); err == nil {
+		t.Error("Components succeeded without a token")
+	}
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.UseTokenFile(tokenFile); err != nil {
+		t.Fatalf("UseTokenFile: %v", err)
+	}
+	if _, err := sc.Components(ctx, nil, nil); err != nil {
+		t.Errorf("Components with token: %v", err)
+	}
+}
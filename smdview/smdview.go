@@ -0,0 +1,154 @@
+// Package smdview gives other CoreDHCP plugins running in the same server
+// read-only access to the SMD data cached by the coresmd plugin, so that they
+// can look up nodes (e.g. to update DNS) without building their own SMD client
+// and cache.
+//
+// Lookups consult the running coresmd instances in the order they were set
+// up, and the first one that can serve the node answers. The data is as of each
+// instance's latest cache refresh.
+package smdview
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/OpenCHAMI/coresmd/coresmd"
+)
+
+type (
+	// IfaceInfo describes an interface coresmd serves: its Component, MAC
+	// address, and IP addresses.
+	IfaceInfo = coresmd.IfaceInfo
+	// Snapshot is the SMD data of a coresmd instance as of a single cache
+	// refresh.
+	Snapshot = coresmd.Snapshot
+)
+
+var (
+	// ErrNotRunning is returned when no coresmd instance is running.
+	ErrNotRunning = errors.New("coresmd is not running")
+	// ErrNotLoaded is returned when no coresmd instance has loaded data from
+	// SMD yet.
+	ErrNotLoaded = errors.New("coresmd has not loaded data from SMD yet")
+	// ErrNotFound is returned, wrapped, when no coresmd instance can serve
+	// the node looked up.
+	ErrNotFound = errors.New("not found in SMD")
+)
+
+// caches returns the caches of the running coresmd instances. It is replaced
+// in tests.
+var caches = coresmd.Caches
+
+// Snapshots returns the latest data of each running coresmd instance that has
+// loaded data from SMD, in the order the instances were set up.
+func Snapshots() ([]*Snapshot, error) {
+	cs := caches()
+	if len(cs) == 0 {
+		return nil, ErrNotRunning
+	}
+	var ss []*Snapshot
+	for _, c := range cs {
+		if s := c.Snapshot(); !s.LastUpdated.IsZero() {
+			ss = append(ss, s)
+		}
+	}
+	if len(ss) == 0 {
+		return nil, ErrNotLoaded
+	}
+
+	return ss, nil
+}
+
+// LookupMAC returns the interface with hardware address mac, in any format
+// accepted by coresmd.NormalizeMAC. If no instance can serve it, the error
+// wraps ErrNotFound and says why.
+func LookupMAC(ctx context.Context, mac string) (IfaceInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return IfaceInfo{}, err
+	}
+	norm, err := coresmd.NormalizeMAC(mac)
+	if err != nil {
+		return IfaceInfo{}, err
+	}
+	ss, err := Snapshots()
+	if err != nil {
+		return IfaceInfo{}, err
+	}
+	var first error
+	for _, s := range ss {
+		ii, err := s.LookupMAC(norm)
+		if err == nil {
+			return ii, nil
+		}
+		if first == nil {
+			first = err
+		}
+	}
+
+	return IfaceInfo{}, fmt.Errorf("%w: %v", ErrNotFound, first)
+}
+
+// LookupIP returns the interface assigned ip. If no instance has it, the error
+// wraps ErrNotFound.
+func LookupIP(ctx context.Context, ip net.IP) (IfaceInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return IfaceInfo{}, err
+	}
+	ss, err := Snapshots()
+	if err != nil {
+		return IfaceInfo{}, err
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	for _, s := range ss {
+		if mac, ok := s.IPAddresses[ip.String()]; ok {
+			if ii, err := s.LookupMAC(mac); err == nil {
+				return ii, nil
+			}
+		}
+	}
+
+	return IfaceInfo{}, fmt.Errorf("%w: no interface with IP address %s", ErrNotFound, ip)
+}
+
+// ComponentInterfaces returns the interfaces of the Component with ID id (an
+// xname), from the first instance that serves any. If none does, the error
+// wraps ErrNotFound.
+func ComponentInterfaces(ctx context.Context, id string) ([]IfaceInfo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ss, err := Snapshots()
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range ss {
+		var iis []IfaceInfo
+		for _, mac := range s.ComponentInterfaces[id] {
+			if ii, ok := s.Interfaces[mac]; ok {
+				iis = append(iis, ii)
+			}
+		}
+		if len(iis) > 0 {
+			return iis, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: no interfaces for Component %s", ErrNotFound, id)
+}
+
+// InGroup reports whether the Component with ID id is in the SMD group labeled
+// label in any instance. Groups are only known to instances that fetch them
+// (see the smd_groups option).
+func InGroup(id, label string) bool {
+	ss, _ := Snapshots()
+	for _, s := range ss {
+		if s.InGroup(id, label) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+package smdview
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/OpenCHAMI/coresmd/coresmd"
+)
+
+// useCaches makes lookups consult a cache per fake, refreshed once.
+func useCaches(t *testing.T, fakes ...*coresmd.FakeSmdClient) {
+	t.Helper()
+	var cs []*coresmd.Cache
+	for _, fake := range fakes {
+		c, err := coresmd.NewCache("1h", fake)
+		if err != nil {
+			t.Fatalf("NewCache: %v", err)
+		}
+		if err := c.Refresh(context.Background()); err != nil {
+			t.Fatalf("Refresh: %v", err)
+		}
+		cs = append(cs, c)
+	}
+	caches = func() []*coresmd.Cache { return cs }
+	t.Cleanup(func() { caches = coresmd.Caches })
+}
+
+func newFake(mac, id, ip string) *coresmd.FakeSmdClient {
+	return coresmd.NewFakeSmdClient(
+		[]coresmd.EthernetInterface{{MACAddress: mac, ComponentID: id, IPAddresses: []struct {
+			IPAddress string `json:"IPAddress"`
+		}{{IPAddress: ip}}}},
+		[]coresmd.Component{{ID: id, NID: 1, Type: "Node"}},
+	)
+}
+
+func TestNotRunning(t *testing.T) {
+	caches = func() []*coresmd.Cache { return nil }
+	t.Cleanup(func() { caches = coresmd.Caches })
+	if _, err := LookupMAC(context.Background(), "aa:bb:cc:dd:ee:01"); !errors.Is(err, ErrNotRunning) {
+		t.Errorf("LookupMAC returned %v, want ErrNotRunning", err)
+	}
+}
+
+func TestLookup(t *testing.T) {
+	useCaches(t,
+		newFake("aa:bb:cc:dd:ee:01", "x3000c0s0b0n0", "172.16.0.1"),
+		newFake("AA-BB-CC-DD-EE-02", "x3000c0s1b0n0", "172.16.1.1"),
+	)
+	ctx := context.Background()
+
+	// Served by the second instance
+	ii, err := LookupMAC(ctx, "AA:BB:CC:DD:EE:02")
+	if err != nil || ii.CompID != "x3000c0s1b0n0" {
+		t.Errorf("LookupMAC = %+v, %v; want x3000c0s1b0n0", ii, err)
+	}
+	if _, err := LookupMAC(ctx, "aa:bb:cc:dd:ee:03"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("LookupMAC of unknown MAC returned %v, want ErrNotFound", err)
+	}
+	if _, err := LookupMAC(ctx, "not-a-mac"); err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("LookupMAC of invalid MAC returned %v", err)
+	}
+
+	if ii, err := LookupIP(ctx, net.IPv4(172, 16, 0, 1)); err != nil || ii.MAC != "aa:bb:cc:dd:ee:01" {
+		t.Errorf("LookupIP = %+v, %v; want aa:bb:cc:dd:ee:01", ii, err)
+	}
+	if iis, err := ComponentInterfaces(ctx, "x3000c0s1b0n0"); err != nil || len(iis) != 1 {
+		t.Errorf("ComponentInterfaces = %+v, %v; want one interface", iis, err)
+	}
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := LookupMAC(canceled, "aa:bb:cc:dd:ee:01"); !errors.Is(err, context.Canceled) {
+		t.Errorf("LookupMAC with canceled context returned %v", err)
+	}
+}